@@ -0,0 +1,135 @@
+// Command check-aof validates an append-only file written by the server:
+// either a multi-part file through its manifest, or a single file. It
+// reports the first bad offset in each file with the bytes around it and,
+// with -fix, truncates the final file to its last complete command.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"redis-like-server/internal/aof"
+	"redis-like-server/internal/crypt"
+	"redis-like-server/internal/handler"
+	"redis-like-server/internal/resp2"
+	"redis-like-server/internal/server"
+)
+
+// contextBytes is how many bytes are shown on each side of a bad offset
+const contextBytes = 32
+
+func main() {
+	fix := flag.Bool("fix", false, "Truncate the final file to its last complete command")
+	keyFile := flag.String("encryption-key-file", "", "Key file for encrypted files (defaults to $"+crypt.EnvKey+")")
+	oldKeyFiles := flag.String("encryption-old-key-files", "", "Comma-separated key files of earlier keys")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-fix] <file.manifest|file.aof>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	path := flag.Arg(0)
+	keyring, err := crypt.LoadKeyring(*keyFile, *oldKeyFiles)
+	if err != nil {
+		fmt.Printf("Invalid encryption key: %v\n", err)
+		os.Exit(2)
+	}
+
+	checker := aof.Checker{
+		CheckRDB: func(path string) (int64, error) {
+			report, err := server.CheckSnapshot(path, keyring)
+			return report.ValidSize, err
+		},
+		CheckCommand: func(cmd *resp2.Command) error {
+			if !handler.IsWriteCommand(cmd.Name) {
+				return fmt.Errorf("unexpected command '%s'", cmd.Name)
+			}
+			return nil
+		},
+		Keyring: keyring,
+	}
+
+	var reports []aof.CheckReport
+	if strings.HasSuffix(path, ".manifest") {
+		if reports, err = checker.CheckManifest(path); err != nil {
+			fmt.Printf("Cannot read the manifest: %v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		reports = []aof.CheckReport{checker.CheckFile(path)}
+	}
+
+	valid := true
+	for _, report := range reports {
+		if !checkReport(report, *fix) {
+			valid = false
+		}
+	}
+	if !valid {
+		fmt.Println("AOF is not valid")
+		os.Exit(1)
+	}
+	fmt.Println("AOF is valid")
+}
+
+// checkReport prints one file's report, repairing it if allowed, and
+// reports whether the file is usable afterwards
+func checkReport(report aof.CheckReport, fix bool) bool {
+	format := "AOF"
+	if report.RDB {
+		format = "RDB"
+	}
+	fmt.Printf("Checking %s (%s, %s): ", filepath.Base(report.Path), fileTypeName(report.Type), format)
+	if report.OK() {
+		if report.RDB {
+			fmt.Printf("OK, %d bytes\n", report.Size)
+		} else {
+			fmt.Printf("OK, %d commands in %d bytes\n", report.Commands, report.Size)
+		}
+		return true
+	}
+
+	fmt.Printf("%d of %d bytes valid, %d bytes to discard\n", report.ValidSize, report.Size, report.Size-report.ValidSize)
+	fmt.Printf("Bad data at offset %d: %v\n", report.ValidSize, report.Err)
+	if report.Encrypted {
+		if errors.Is(report.Err, crypt.ErrNoKey) || errors.Is(report.Err, crypt.ErrUnknownKey) {
+			fmt.Println("Pass the key the file was encrypted with using -encryption-key-file")
+			return false
+		}
+	} else if before, after, err := aof.Context(report.Path, report.ValidSize, contextBytes); err == nil {
+		fmt.Printf("  before: %q\n  after:  %q\n", before, after)
+	}
+
+	if !fix {
+		return false
+	}
+	if !report.Repairable() {
+		if report.Encrypted && report.Last && !report.RDB {
+			fmt.Println("The damage is inside an encrypted chunk and cannot be fixed by truncation; restore this file from a backup")
+		} else {
+			fmt.Println("Only the final AOF file can be fixed by truncation; restore this file from a backup")
+		}
+		return false
+	}
+	if err := os.Truncate(report.Path, report.ValidSize); err != nil {
+		fmt.Printf("Failed to truncate %s: %v\n", report.Path, err)
+		return false
+	}
+	fmt.Printf("Successfully truncated %s to %d bytes\n", filepath.Base(report.Path), report.ValidSize)
+	return true
+}
+
+// fileTypeName names a manifest file type
+func fileTypeName(fileType aof.FileType) string {
+	if fileType == aof.FileBase {
+		return "base"
+	}
+	return "incr"
+}
@@ -0,0 +1,72 @@
+// Command check-rdb validates a snapshot file the way the server loads it:
+// the RDB structure and checksum, counting the keys the server would skip
+// because they are not strings in database 0. It reports the first bad
+// offset with the bytes around it.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"redis-like-server/internal/aof"
+	"redis-like-server/internal/crypt"
+	"redis-like-server/internal/server"
+)
+
+// contextBytes is how many bytes are shown on each side of a bad offset
+const contextBytes = 32
+
+func main() {
+	keyFile := flag.String("encryption-key-file", "", "Key file for an encrypted file (defaults to $"+crypt.EnvKey+")")
+	oldKeyFiles := flag.String("encryption-old-key-files", "", "Comma-separated key files of earlier keys")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-encryption-key-file file] <dump.rdb>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	path := flag.Arg(0)
+	keyring, err := crypt.LoadKeyring(*keyFile, *oldKeyFiles)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid encryption key: %v\n", err)
+		os.Exit(2)
+	}
+
+	fmt.Printf("Checking RDB file %s\n", path)
+	report, err := server.CheckSnapshot(path, keyring)
+	if report.Version != 0 {
+		fmt.Printf("RDB version %d\n", report.Version)
+	}
+	keys := make([]string, 0, len(report.Aux))
+	for key := range report.Aux {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("AUX %s = %q\n", key, report.Aux[key])
+	}
+
+	if err != nil {
+		fmt.Printf("Bad data at offset %d of %d: %v\n", report.ValidSize, report.Size, err)
+		if errors.Is(err, crypt.ErrNoKey) || errors.Is(err, crypt.ErrUnknownKey) {
+			fmt.Println("Pass the key the file was encrypted with using -encryption-key-file")
+		} else if report.Encrypted {
+			fmt.Println("The file is encrypted; the offset counts decrypted bytes")
+		} else if before, after, err := aof.Context(path, report.ValidSize, contextBytes); err == nil {
+			fmt.Printf("  before: %q\n  after:  %q\n", before, after)
+		}
+		fmt.Println("RDB is not valid")
+		os.Exit(1)
+	}
+	fmt.Printf("%d keys, %d with an expiry, %d already expired\n", report.Keys, report.Expires, report.Expired)
+	if warning := report.SkippedWarning(); warning != "" {
+		fmt.Println(warning)
+	}
+	fmt.Println("RDB is valid")
+}
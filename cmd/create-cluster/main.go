@@ -0,0 +1,113 @@
+// Command create-cluster turns empty servers started with -cluster-enabled
+// into one cluster: it splits the hash slots evenly between them,
+// introduces every node to the first one and waits until all of them see
+// the whole cluster.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"redis-like-server/internal/client"
+	"redis-like-server/internal/cluster"
+)
+
+func main() {
+	timeout := flag.Duration("timeout", 30*time.Second, "How long to wait for the nodes to agree on the cluster")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-timeout duration] <host:port> <host:port>...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	nodes := make([]*client.Client, flag.NArg())
+	busPorts := make([]string, flag.NArg())
+	for i, addr := range flag.Args() {
+		c, err := client.Dial(addr, 5*time.Second)
+		if err != nil {
+			log.Fatalf("Cannot connect to %s: %v", addr, err)
+		}
+		defer c.Close()
+		myself, err := checkEmpty(c)
+		if err != nil {
+			log.Fatalf("Node %s cannot join a new cluster: %v", addr, err)
+		}
+		nodes[i], busPorts[i] = c, strconv.Itoa(myself.BusPort)
+	}
+
+	for i, c := range nodes {
+		start, end := i*cluster.SlotCount/len(nodes), (i+1)*cluster.SlotCount/len(nodes)-1
+		if _, err := c.Do("CLUSTER", "ADDSLOTSRANGE", strconv.Itoa(start), strconv.Itoa(end)); err != nil {
+			log.Fatalf("Cannot assign slots to %s: %v", c.Addr(), err)
+		}
+		fmt.Printf("Slots %d-%d -> %s\n", start, end, c.Addr())
+	}
+	host, port, err := net.SplitHostPort(nodes[0].Addr())
+	if err != nil {
+		log.Fatalf("Invalid address %s: %v", nodes[0].Addr(), err)
+	}
+	for _, c := range nodes[1:] {
+		if _, err := c.Do("CLUSTER", "MEET", host, port, busPorts[0]); err != nil {
+			log.Fatalf("Cannot introduce %s to %s: %v", c.Addr(), nodes[0].Addr(), err)
+		}
+	}
+
+	fmt.Print("Waiting for the cluster to join")
+	deadline := time.Now().Add(*timeout)
+	for !joined(nodes) {
+		if time.Now().After(deadline) {
+			fmt.Println()
+			log.Fatalf("The nodes did not agree on the cluster within %v", *timeout)
+		}
+		fmt.Print(".")
+		time.Sleep(500 * time.Millisecond)
+	}
+	fmt.Printf("\nAll %d slots covered by %d nodes\n", cluster.SlotCount, len(nodes))
+}
+
+// checkEmpty returns the node a client is connected to, failing unless it
+// knows no other node and serves no slot
+func checkEmpty(c *client.Client) (*cluster.Node, error) {
+	reply, err := c.Do("CLUSTER", "NODES")
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(reply.Str), "\n")
+	if len(lines) != 1 {
+		return nil, fmt.Errorf("it already knows %d other nodes", len(lines)-1)
+	}
+	line, err := cluster.ParseNode(lines[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(line.Ranges) > 0 {
+		return nil, fmt.Errorf("it already serves slots")
+	}
+	return &line.Node, nil
+}
+
+// joined reports whether every node sees a healthy cluster of all nodes
+func joined(nodes []*client.Client) bool {
+	for _, c := range nodes {
+		reply, err := c.Do("CLUSTER", "INFO")
+		if err != nil {
+			return false
+		}
+		info := reply.Str
+		if !strings.Contains(info, "cluster_state:ok\r\n") ||
+			!strings.Contains(info, fmt.Sprintf("cluster_known_nodes:%d\r\n", len(nodes))) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,59 @@
+// Command import-jsonl loads a JSON Lines file, as written by export-jsonl,
+// into a snapshot file. The keys are added to the dataset of -base, when it
+// exists, and the result is written atomically to -output; an invalid file
+// or a conflict under -conflict fail writes nothing. Start a server with
+// the output as its dbfilename to serve it, or use the server's
+// -import-jsonl flag to import at startup instead.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"redis-like-server/internal/crypt"
+	"redis-like-server/internal/jsonl"
+	"redis-like-server/internal/server"
+)
+
+func main() {
+	base := flag.String("base", "", "Snapshot file whose dataset the keys are added to, if it exists")
+	conflict := flag.String("conflict", "fail", "What to do with keys that exist in -base: skip, replace or fail")
+	keyFile := flag.String("encryption-key-file", "", "Key file for encrypted files (defaults to $"+crypt.EnvKey+"); the output is encrypted with it too")
+	oldKeyFiles := flag.String("encryption-old-key-files", "", "Comma-separated key files of earlier keys")
+	output := flag.String("output", "dump.rdb", "Path of the RDB file to write")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-base dump.rdb] [-conflict policy] [-output file] <keys.jsonl|->\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	policy, err := jsonl.ParseConflictPolicy(*conflict)
+	if err != nil {
+		log.Fatalf("Invalid -conflict: %v", err)
+	}
+	keyring, err := crypt.LoadKeyring(*keyFile, *oldKeyFiles)
+	if err != nil {
+		log.Fatalf("Invalid encryption key: %v", err)
+	}
+
+	var input io.Reader = os.Stdin
+	if flag.Arg(0) != "-" {
+		file, err := os.Open(flag.Arg(0))
+		if err != nil {
+			log.Fatalf("Import failed: %v", err)
+		}
+		defer file.Close()
+		input = file
+	}
+	result, err := server.ImportToFile(input, *base, policy, keyring, *output)
+	if err != nil {
+		log.Fatalf("Import failed: %v", err)
+	}
+	fmt.Printf("Imported %d keys (%d replaced, %d skipped) into %s\n", result.Imported, result.Replaced, result.Skipped, *output)
+}
@@ -0,0 +1,64 @@
+// Command proxy is a sharding proxy in front of independent servers: clients
+// that know nothing of sharding connect to it as to a single server, and it
+// routes each command to the server holding its keys.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"redis-like-server/internal/proxy"
+)
+
+func main() {
+	port := flag.Int("port", 22121, "Port to listen on")
+	distribution := flag.String("distribution", proxy.DistributionKetama, "How keys are spread over the backends: ketama (consistent hashing) or slots (hash slots split evenly)")
+	poolSize := flag.Int("pool-size", proxy.DefaultPoolSize, "Connections to each backend the commands of all clients are pipelined over")
+	timeout := flag.Duration("timeout", proxy.DefaultTimeout, "How long to wait for a backend to accept a connection or reply")
+	ejectAfter := flag.Int("eject-after", proxy.DefaultEjectAfter, "Failures in a row after which a backend is ejected until it answers again (0 never ejects)")
+	healthInterval := flag.Duration("health-interval", proxy.DefaultHealthInterval, "How often backends are pinged, bringing ejected ones back")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] <host:port>[,<host:port>...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	p, err := proxy.New(proxy.Config{
+		Backends:       strings.Split(flag.Arg(0), ","),
+		Distribution:   *distribution,
+		PoolSize:       *poolSize,
+		Timeout:        *timeout,
+		EjectAfter:     *ejectAfter,
+		HealthInterval: *healthInterval,
+	})
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		p.Close()
+	}()
+
+	fmt.Printf("Proxying port %d to %s by %s\n", *port, flag.Arg(0), *distribution)
+	if err := p.Serve(listener); err != nil {
+		log.Fatalf("Proxy failed: %v", err)
+	}
+	fmt.Println("Proxy shutdown complete.")
+}
@@ -0,0 +1,45 @@
+// Command rebalance-cluster evens out the hash slots of a running cluster,
+// for instance after an empty node joined it with CLUSTER MEET. Slots move
+// one at a time with their keys while clients keep being served.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"redis-like-server/internal/reshard"
+)
+
+func main() {
+	timeout := flag.Duration("timeout", 30*time.Second, "How long to wait for a node to answer and for the nodes to agree on the slots")
+	batch := flag.Int("batch", 100, "How many keys to move with each MIGRATE")
+	quiet := flag.Bool("quiet", false, "Do not report every slot moved")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-timeout duration] [-batch keys] [-quiet] <host:port>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	moved, keys := 0, 0
+	err := reshard.Rebalance(flag.Arg(0), reshard.Options{
+		Timeout: *timeout,
+		Batch:   *batch,
+		Log: func(move reshard.Move, moveKeys int) {
+			moved, keys = moved+1, keys+moveKeys
+			if !*quiet {
+				fmt.Printf("Moved slot %d with %d keys from %.8s to %.8s\n", move.Slot, moveKeys, move.From, move.To)
+			}
+		},
+	})
+	if err != nil {
+		log.Fatalf("Rebalance failed after moving %d slots: %v", moved, err)
+	}
+	fmt.Printf("Moved %d slots with %d keys, the cluster is balanced\n", moved, keys)
+}
@@ -0,0 +1,50 @@
+// Command recover-aof rebuilds a dataset from an append-only file up to a
+// point in time or a byte offset and writes it as an RDB snapshot. The
+// append-only file is only read, so it can run next to a live server; the
+// output can be loaded by starting a server with it as its dbfilename.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"redis-like-server/internal/aof"
+	"redis-like-server/internal/crypt"
+	"redis-like-server/internal/server"
+)
+
+func main() {
+	dir := flag.String("dir", ".", "Directory holding the append-only directory")
+	appendFilename := flag.String("appendfilename", "appendonly.aof", "Append-only file name")
+	appendDirname := flag.String("appenddirname", "appendonlydir", "Directory, inside -dir, holding the append-only file parts")
+	toTime := flag.String("to-time", "", "Keep the commands logged up to this time (RFC 3339, \"YYYY-MM-DD HH:MM:SS\" or Unix seconds)")
+	toOffset := flag.String("to-offset", "", "Keep the commands ending within this byte offset of the command logs")
+	keyFile := flag.String("encryption-key-file", "", "Key file for encrypted files (defaults to $"+crypt.EnvKey+"); the output is encrypted with it too")
+	oldKeyFiles := flag.String("encryption-old-key-files", "", "Comma-separated key files of earlier keys")
+	output := flag.String("output", "recovered.rdb", "Path of the RDB file to write")
+	flag.Parse()
+
+	target, err := aof.ParseTarget(*toTime, *toOffset)
+	if err != nil {
+		log.Fatalf("Invalid recovery target: %v", err)
+	}
+	if target == nil {
+		log.Fatal("Specify -to-time, -to-offset or both")
+	}
+	keyring, err := crypt.LoadKeyring(*keyFile, *oldKeyFiles)
+	if err != nil {
+		log.Fatalf("Invalid encryption key: %v", err)
+	}
+
+	config := &server.ServerConfig{
+		Dir:            *dir,
+		AppendFilename: *appendFilename,
+		AppendDirname:  *appendDirname,
+		Encryption:     keyring,
+	}
+	if _, err := server.RecoverToFile(config, target, *output); err != nil {
+		log.Fatalf("Recovery failed: %v", err)
+	}
+	fmt.Printf("Wrote the recovered dataset to %s\n", *output)
+}
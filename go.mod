@@ -2,4 +2,12 @@ module redis-like-server
 
 go 1.21
 
-require github.com/leanovate/gopter v0.2.9
+require (
+	github.com/leanovate/gopter v0.2.9
+	github.com/redis/go-redis/v9 v9.7.3
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+)
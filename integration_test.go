@@ -2,12 +2,29 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/redis/go-redis/v9"
+
+	"redis-like-server/internal/aof"
+	"redis-like-server/internal/client"
+	"redis-like-server/internal/cluster"
+	"redis-like-server/internal/crypt"
+	"redis-like-server/internal/jsonl"
+	"redis-like-server/internal/proxy"
+	"redis-like-server/internal/reshard"
+	"redis-like-server/internal/resp2"
 	"redis-like-server/internal/server"
 )
 
@@ -551,4 +568,2449 @@ func TestConcurrentClientScenarios(t *testing.T) {
 			t.Error(err)
 		}
 	})
-}
\ No newline at end of file
+}
+// TestPubSubInteraction tests publish/subscribe between clients
+func TestPubSubInteraction(t *testing.T) {
+	port := startTestServer(t, &server.ServerConfig{
+		Port:         0,
+		MaxClients:   10,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+	})
+
+	subscriber := dialTestClient(t, port)
+	publisher := dialTestClient(t, port)
+
+	// Subscribe writes one confirmation per channel
+	subscriber.send("SUBSCRIBE", "news", "weather")
+	for i, channel := range []string{"news", "weather"} {
+		reply := subscriber.read()
+		if len(reply.Array) != 3 || reply.Array[0].Str != "subscribe" || reply.Array[1].Str != channel || reply.Array[2].Int != int64(i+1) {
+			t.Fatalf("Unexpected subscribe confirmation: %+v", reply)
+		}
+	}
+
+	t.Run("subscriber mode rejects regular commands", func(t *testing.T) {
+		reply := subscriber.do("GET", "key")
+		if reply.Type != resp2.Error || !strings.Contains(reply.Str, "only (P)SUBSCRIBE") {
+			t.Errorf("Expected subscriber mode error, got %+v", reply)
+		}
+		reply = subscriber.do("PING")
+		if len(reply.Array) != 2 || reply.Array[0].Str != "pong" {
+			t.Errorf("Expected pong array, got %+v", reply)
+		}
+	})
+
+	t.Run("PUBSUB introspection", func(t *testing.T) {
+		reply := publisher.do("PUBSUB", "NUMSUB", "news", "other")
+		if len(reply.Array) != 4 || reply.Array[1].Int != 1 || reply.Array[3].Int != 0 {
+			t.Errorf("Unexpected NUMSUB reply: %+v", reply)
+		}
+		reply = publisher.do("PUBSUB", "CHANNELS", "n*")
+		if len(reply.Array) != 1 || reply.Array[0].Str != "news" {
+			t.Errorf("Unexpected CHANNELS reply: %+v", reply)
+		}
+	})
+
+	t.Run("PUBLISH delivers message", func(t *testing.T) {
+		reply := publisher.do("PUBLISH", "news", "hello")
+		if reply.Type != resp2.Integer || reply.Int != 1 {
+			t.Fatalf("Expected 1 receiver, got %+v", reply)
+		}
+		message := subscriber.read()
+		if len(message.Array) != 3 || message.Array[0].Str != "message" || message.Array[1].Str != "news" || message.Array[2].Str != "hello" {
+			t.Errorf("Unexpected message: %+v", message)
+		}
+	})
+
+	t.Run("pattern subscriptions receive pmessage", func(t *testing.T) {
+		subscriber.send("PSUBSCRIBE", "news.*")
+		if reply := subscriber.read(); reply.Array[0].Str != "psubscribe" || reply.Array[2].Int != 3 {
+			t.Fatalf("Unexpected psubscribe confirmation: %+v", reply)
+		}
+		if reply := publisher.do("PUBSUB", "NUMPAT"); reply.Int != 1 {
+			t.Errorf("Expected 1 pattern, got %+v", reply)
+		}
+		if reply := publisher.do("PUBLISH", "news.sport", "goal"); reply.Int != 1 {
+			t.Fatalf("Expected 1 receiver, got %+v", reply)
+		}
+		message := subscriber.read()
+		if len(message.Array) != 4 || message.Array[0].Str != "pmessage" || message.Array[1].Str != "news.*" ||
+			message.Array[2].Str != "news.sport" || message.Array[3].Str != "goal" {
+			t.Errorf("Unexpected pmessage: %+v", message)
+		}
+		subscriber.send("PUNSUBSCRIBE")
+		if reply := subscriber.read(); reply.Array[0].Str != "punsubscribe" || reply.Array[2].Int != 2 {
+			t.Fatalf("Unexpected punsubscribe confirmation: %+v", reply)
+		}
+	})
+
+	t.Run("UNSUBSCRIBE leaves subscriber mode", func(t *testing.T) {
+		subscriber.send("UNSUBSCRIBE")
+		for i := 0; i < 2; i++ {
+			if reply := subscriber.read(); reply.Array[0].Str != "unsubscribe" {
+				t.Fatalf("Unexpected unsubscribe confirmation: %+v", reply)
+			}
+		}
+		if reply := subscriber.do("PING"); reply.Type != resp2.SimpleString || reply.Str != "PONG" {
+			t.Errorf("Expected +PONG after unsubscribing, got %+v", reply)
+		}
+	})
+}
+
+// startTestServer starts a server for the duration of the test and returns its port
+func startTestServer(t *testing.T, config *server.ServerConfig) int {
+	t.Helper()
+	srv := server.NewServer(config)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	t.Cleanup(func() { srv.Stop() })
+	return srv.GetListener().Addr().(*net.TCPAddr).Port
+}
+
+// testClient is a minimal RESP2 client used by the integration tests
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	parser resp2.RESP2Parser
+}
+
+// dialTestClient connects a test client to the server on the given port
+func dialTestClient(t *testing.T, port int) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, reader: bufio.NewReader(conn), parser: resp2.NewRESP2Parser()}
+}
+
+// send writes a command without waiting for the reply
+func (c *testClient) send(args ...string) {
+	c.t.Helper()
+	request := &resp2.RESPValue{Type: resp2.Array}
+	for _, arg := range args {
+		request.Array = append(request.Array, resp2.RESPValue{Type: resp2.BulkString, Str: arg})
+	}
+	if _, err := c.conn.Write(c.parser.Serialize(request)); err != nil {
+		c.t.Fatalf("Failed to send %v: %v", args, err)
+	}
+}
+
+// read reads the next reply
+func (c *testClient) read() *resp2.RESPValue {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := c.parser.Parse(c.reader)
+	if err != nil {
+		c.t.Fatalf("Failed to read reply: %v", err)
+	}
+	return reply
+}
+
+// do sends a command and returns its reply
+func (c *testClient) do(args ...string) *resp2.RESPValue {
+	c.t.Helper()
+	c.send(args...)
+	return c.read()
+}
+
+// TestKeyspaceNotifications tests keyspace notifications delivered over pub/sub
+func TestKeyspaceNotifications(t *testing.T) {
+	port := startTestServer(t, &server.ServerConfig{
+		Port:         0,
+		MaxClients:   10,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+	})
+
+	subscriber := dialTestClient(t, port)
+	client := dialTestClient(t, port)
+
+	if reply := client.do("CONFIG", "SET", "notify-keyspace-events", "KEA"); reply.Str != "OK" {
+		t.Fatalf("CONFIG SET failed: %+v", reply)
+	}
+	if reply := client.do("CONFIG", "GET", "notify-keyspace-events"); len(reply.Array) != 2 || reply.Array[1].Str != "AKE" {
+		t.Fatalf("Unexpected CONFIG GET reply: %+v", reply)
+	}
+
+	subscriber.send("PSUBSCRIBE", "__keyspace@0__:*")
+	subscriber.read()
+
+	client.do("SET", "cache:1", "value")
+	client.do("DEL", "cache:1")
+
+	for _, event := range []string{"set", "del"} {
+		message := subscriber.read()
+		if len(message.Array) != 4 || message.Array[2].Str != "__keyspace@0__:cache:1" || message.Array[3].Str != event {
+			t.Errorf("Expected %s notification, got %+v", event, message)
+		}
+	}
+}
+
+// TestKeyExpiry tests that keys past their expiry are deleted when looked up
+// and by the active expire cycle, notifying expired and propagating a DEL
+func TestKeyExpiry(t *testing.T) {
+	dir := t.TempDir()
+	masterPort := startTestServer(t, &server.ServerConfig{
+		Port:         0,
+		MaxClients:   10,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		Dir:          dir,
+		AppendOnly:   true,
+		AppendFsync:  aof.FsyncAlways,
+	})
+	replicaPort := startTestServer(t, &server.ServerConfig{
+		Port:         0,
+		MaxClients:   10,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		Dir:          t.TempDir(),
+		ReplicaOf:    fmt.Sprintf("127.0.0.1 %d", masterPort),
+	})
+	master, replica, subscriber := dialTestClient(t, masterPort), dialTestClient(t, replicaPort), dialTestClient(t, masterPort)
+	if !eventually(func() bool { return infoField(replica, "replication", "master_link_status") == "up" }) {
+		t.Fatalf("Expected the replica to connect, got %q", replica.do("INFO", "replication").Str)
+	}
+	master.do("CONFIG", "SET", "notify-keyspace-events", "Ex")
+	subscriber.send("SUBSCRIBE", "__keyevent@0__:expired")
+	subscriber.read()
+
+	master.do("SET", "source", "value")
+	payload := master.do("DUMP", "source").Str
+	for _, key := range []string{"looked-up", "untouched"} {
+		if reply := master.do("RESTORE", key, "100", payload); reply.Str != "OK" {
+			t.Fatalf("RESTORE %s failed: %+v", key, reply)
+		}
+	}
+	time.Sleep(150 * time.Millisecond)
+	if reply := master.do("GET", "looked-up"); !reply.Null {
+		t.Errorf("Expected looked-up to have expired, got %+v", reply)
+	}
+
+	// One key expires as it is looked up, the other in the active cycle
+	expired := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		message := subscriber.read()
+		if len(message.Array) != 3 || message.Array[0].Str != "message" {
+			t.Fatalf("Unexpected expired notification %+v", message)
+		}
+		expired[message.Array[2].Str] = true
+	}
+	if !expired["looked-up"] || !expired["untouched"] {
+		t.Errorf("Expected both keys to be notified as expired, got %v", expired)
+	}
+
+	// The deletions are logged and replicated as DEL
+	data, err := os.ReadFile(filepath.Join(dir, "appendonlydir", "appendonly.aof.1.incr.aof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"looked-up", "untouched"} {
+		if del := fmt.Sprintf("$3\r\nDEL\r\n$%d\r\n%s\r\n", len(key), key); !strings.Contains(string(data), del) {
+			t.Errorf("Expected the append-only file to log DEL %s", key)
+		}
+	}
+	if !eventually(func() bool {
+		return infoField(replica, "replication", "master_repl_offset") == infoField(master, "replication", "master_repl_offset")
+	}) {
+		t.Error("Expected the replica to receive the deletions")
+	}
+}
+
+// TestSnapshotPersistence tests that snapshots survive a server restart
+func TestSnapshotPersistence(t *testing.T) {
+	dir := t.TempDir()
+	config := &server.ServerConfig{
+		Port:         0,
+		MaxClients:   10,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		Dir:          dir,
+		DBFilename:   "dump.rdb",
+	}
+
+	srv := server.NewServer(config)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	client := dialTestClient(t, srv.GetListener().Addr().(*net.TCPAddr).Port)
+
+	client.do("SET", "greeting", "hello")
+	client.do("SET", "counter", "42")
+	if reply := client.do("SAVE"); reply.Str != "OK" {
+		t.Fatalf("SAVE failed: %+v", reply)
+	}
+	client.do("SET", "unsaved", "value")
+
+	if reply := client.do("BGSAVE"); reply.Str != "Background saving started" {
+		t.Fatalf("BGSAVE failed: %+v", reply)
+	}
+	if reply := client.do("LASTSAVE"); reply.Type != resp2.Integer || reply.Int <= 0 {
+		t.Errorf("Unexpected LASTSAVE reply: %+v", reply)
+	}
+	srv.Stop()
+
+	// A fresh server loads the snapshot before accepting clients
+	port := startTestServer(t, config)
+	client = dialTestClient(t, port)
+	for key, want := range map[string]string{"greeting": "hello", "counter": "42", "unsaved": "value"} {
+		if reply := client.do("GET", key); reply.Str != want {
+			t.Errorf("GET %s = %+v, want %q", key, reply, want)
+		}
+	}
+}
+
+// TestLoadRedisSnapshot tests that a snapshot written by Redis loads, with
+// the keys the server cannot hold skipped. The fixture joins the records of
+// RDB files Redis wrote for the github.com/cupcake/rdb tests: strings, a
+// hash, sets, a sorted set and a list in database 0 and a string in
+// database 2.
+func TestLoadRedisSnapshot(t *testing.T) {
+	fixture := filepath.Join("testdata", "redis-multitype.rdb")
+	report, err := server.CheckSnapshot(fixture, nil)
+	if err != nil || report.Keys != 7 || report.OtherTypes != 5 || report.OtherDBs != 1 {
+		t.Fatalf("CheckSnapshot = %+v, %v, want 7 keys, 5 of other types and 1 in another database", report, err)
+	}
+
+	dir := t.TempDir()
+	data, err := os.ReadFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "dump.rdb"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	port := startTestServer(t, &server.ServerConfig{
+		Port:         0,
+		MaxClients:   10,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		Dir:          dir,
+		DBFilename:   "dump.rdb",
+	})
+	client := dialTestClient(t, port)
+
+	for key, want := range map[string]string{
+		"key_in_zeroth_database": "zero",
+		"125":                    "Positive 8 bit integer",
+		"-183358245":             "Negative 32 bit integer",
+	} {
+		if reply := client.do("GET", key); reply.Str != want {
+			t.Errorf("GET %s = %+v, want %q", key, reply, want)
+		}
+	}
+	if reply := client.do("EXISTS", "key_in_second_database", "zimap_doesnt_compress", "intset_16",
+		"sorted_set_as_ziplist", "ziplist_doesnt_compress", "regular_set"); reply.Int != 0 {
+		t.Errorf("%d of the skipped keys exist", reply.Int)
+	}
+}
+
+// TestAutomaticSnapshot tests that save rules trigger background saves
+func TestAutomaticSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	port := startTestServer(t, &server.ServerConfig{
+		Port:         0,
+		MaxClients:   10,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		Dir:          dir,
+		DBFilename:   "dump.rdb",
+		SaveRules:    []server.SaveRule{{Seconds: 1, Changes: 1}},
+	})
+	client := dialTestClient(t, port)
+	client.do("SET", "key", "value")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(filepath.Join(dir, "dump.rdb")); err == nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Error("Expected an automatic snapshot to be written")
+}
+
+// TestAppendOnlyPersistence tests that logged writes survive a restart without a snapshot
+func TestAppendOnlyPersistence(t *testing.T) {
+	dir := t.TempDir()
+	config := &server.ServerConfig{
+		Port:             0,
+		MaxClients:       10,
+		ReadTimeout:      5 * time.Second,
+		WriteTimeout:     5 * time.Second,
+		Dir:              dir,
+		AppendOnly:       true,
+		AppendFsync:      aof.FsyncAlways,
+		AOFLoadTruncated: true,
+	}
+
+	srv := server.NewServer(config)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	client := dialTestClient(t, srv.GetListener().Addr().(*net.TCPAddr).Port)
+	client.do("SET", "kept", "1")
+	client.do("SET", "deleted", "2")
+	client.do("DEL", "deleted")
+
+	info := client.do("INFO", "persistence")
+	if !strings.Contains(info.Str, "aof_enabled:1") || !strings.Contains(info.Str, "aof_last_write_status:ok") {
+		t.Errorf("Unexpected INFO persistence output: %q", info.Str)
+	}
+	srv.Stop()
+
+	// Simulate a crash in the middle of writing a command
+	aofFile, err := os.OpenFile(filepath.Join(dir, "appendonlydir", "appendonly.aof.1.incr.aof"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open the incremental file: %v", err)
+	}
+	aofFile.WriteString("*3\r\n$3\r\nSET\r\n$4\r\nlost")
+	aofFile.Close()
+
+	port := startTestServer(t, config)
+	client = dialTestClient(t, port)
+	if reply := client.do("GET", "kept"); reply.Str != "1" {
+		t.Errorf("Expected kept=1, got %+v", reply)
+	}
+	if reply := client.do("EXISTS", "deleted", "lost"); reply.Int != 0 {
+		t.Errorf("Expected deleted and lost to be absent, got %+v", reply)
+	}
+}
+
+// TestAppendOnlyRewrite tests that BGREWRITEAOF compacts the log into a new
+// base while writes keep being logged, and that the result survives a restart
+func TestAppendOnlyRewrite(t *testing.T) {
+	dir := t.TempDir()
+	config := &server.ServerConfig{
+		Port:         0,
+		MaxClients:   10,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		Dir:          dir,
+		AppendOnly:   true,
+		AppendFsync:  aof.FsyncAlways,
+	}
+
+	srv := server.NewServer(config)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	client := dialTestClient(t, srv.GetListener().Addr().(*net.TCPAddr).Port)
+	for i := 0; i < 20; i++ {
+		client.do("SET", "counter", fmt.Sprintf("%d", i))
+	}
+	client.do("SET", "gone", "x")
+	client.do("DEL", "gone")
+
+	if reply := client.do("BGREWRITEAOF"); reply.Str != "Background append only file rewriting started" {
+		t.Fatalf("Unexpected BGREWRITEAOF reply: %+v", reply)
+	}
+	client.do("SET", "after", "rewrite")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(client.do("INFO", "persistence").Str, "aof_rewrite_in_progress:0") {
+		if time.Now().After(deadline) {
+			t.Fatal("Rewrite did not finish")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	srv.Stop()
+
+	manifest, err := os.ReadFile(filepath.Join(dir, "appendonlydir", "appendonly.aof.manifest"))
+	if err != nil {
+		t.Fatalf("Failed to read the manifest: %v", err)
+	}
+	expected := "file appendonly.aof.2.base.rdb seq 2 type b\nfile appendonly.aof.2.incr.aof seq 2 type i\n"
+	if string(manifest) != expected {
+		t.Errorf("Unexpected manifest %q", manifest)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "appendonlydir", "appendonly.aof.1.incr.aof")); !os.IsNotExist(err) {
+		t.Errorf("Expected the superseded incremental file to be deleted, got %v", err)
+	}
+
+	port := startTestServer(t, config)
+	client = dialTestClient(t, port)
+	if reply := client.do("GET", "counter"); reply.Str != "19" {
+		t.Errorf("Expected counter=19, got %+v", reply)
+	}
+	if reply := client.do("GET", "after"); reply.Str != "rewrite" {
+		t.Errorf("Expected after=rewrite, got %+v", reply)
+	}
+	if reply := client.do("EXISTS", "gone"); reply.Int != 0 {
+		t.Errorf("Expected gone to be absent, got %+v", reply)
+	}
+}
+
+// TestDumpRestore tests copying a key with DUMP and RESTORE, including
+// expiry and its survival across an append-only restart
+func TestDumpRestore(t *testing.T) {
+	dir := t.TempDir()
+	config := &server.ServerConfig{
+		Port:         0,
+		MaxClients:   10,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		Dir:          dir,
+		AppendOnly:   true,
+		AppendFsync:  aof.FsyncAlways,
+	}
+
+	srv := server.NewServer(config)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	client := dialTestClient(t, srv.GetListener().Addr().(*net.TCPAddr).Port)
+	client.do("SET", "source", "binary\x00\r\nvalue")
+	payload := client.do("DUMP", "source")
+	if payload.Type != resp2.BulkString {
+		t.Fatalf("Unexpected DUMP reply: %+v", payload)
+	}
+
+	if reply := client.do("RESTORE", "short", "150", payload.Str); reply.Str != "OK" {
+		t.Fatalf("Unexpected RESTORE reply: %+v", reply)
+	}
+	client.do("RESTORE", "long", "600000", payload.Str)
+	if reply := client.do("GET", "short"); reply.Str != "binary\x00\r\nvalue" {
+		t.Errorf("Expected the restored value, got %+v", reply)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if reply := client.do("GET", "short"); !reply.Null {
+		t.Errorf("Expected short to have expired, got %+v", reply)
+	}
+	srv.Stop()
+
+	port := startTestServer(t, config)
+	client = dialTestClient(t, port)
+	if reply := client.do("GET", "long"); reply.Str != "binary\x00\r\nvalue" {
+		t.Errorf("Expected long to survive the restart, got %+v", reply)
+	}
+	if reply := client.do("EXISTS", "short"); reply.Int != 0 {
+		t.Errorf("Expected short to stay expired after the restart, got %+v", reply)
+	}
+}
+
+// TestPointInTimeRecovery tests rebuilding the dataset up to an offset of a
+// timestamped append-only file, both offline and at startup
+func TestPointInTimeRecovery(t *testing.T) {
+	dir := t.TempDir()
+	config := &server.ServerConfig{
+		Port:                0,
+		MaxClients:          10,
+		ReadTimeout:         5 * time.Second,
+		WriteTimeout:        5 * time.Second,
+		Dir:                 dir,
+		DBFilename:          "dump.rdb",
+		AppendOnly:          true,
+		AppendFsync:         aof.FsyncAlways,
+		AOFTimestampEnabled: true,
+	}
+	incrPath := filepath.Join(dir, "appendonlydir", "appendonly.aof.1.incr.aof")
+
+	srv := server.NewServer(config)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	client := dialTestClient(t, srv.GetListener().Addr().(*net.TCPAddr).Port)
+	client.do("SET", "kept", "1")
+	info, err := os.Stat(incrPath)
+	if err != nil {
+		t.Fatalf("Failed to stat the incremental file: %v", err)
+	}
+	target := &aof.Target{Offset: info.Size()}
+	client.do("SET", "lost", "2")
+	client.do("DEL", "kept")
+	srv.Stop()
+
+	if data, _ := os.ReadFile(incrPath); !strings.HasPrefix(string(data), "#TS:") {
+		t.Errorf("Expected a timestamp annotation, got %q", data)
+	}
+
+	// Offline recovery leaves the append-only file alone
+	if _, err := server.RecoverToFile(config, target, filepath.Join(dir, "offline.rdb")); err != nil {
+		t.Fatalf("RecoverToFile failed: %v", err)
+	}
+	port := startTestServer(t, &server.ServerConfig{
+		Port:         0,
+		MaxClients:   10,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		Dir:          dir,
+		DBFilename:   "offline.rdb",
+	})
+	client = dialTestClient(t, port)
+	if reply := client.do("GET", "kept"); reply.Str != "1" {
+		t.Errorf("Expected kept=1 in the offline recovery, got %+v", reply)
+	}
+	if reply := client.do("EXISTS", "lost"); reply.Int != 0 {
+		t.Errorf("Expected lost to be absent from the offline recovery, got %+v", reply)
+	}
+
+	recovering := *config
+	recovering.RecoveryTarget = target
+	srv = server.NewServer(&recovering)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Failed to start the recovering server: %v", err)
+	}
+	srv.Stop()
+	if aside, _ := filepath.Glob(filepath.Join(dir, "appendonlydir.before-recovery-*")); len(aside) != 1 {
+		t.Errorf("Expected the original append only directory to be kept, got %v", aside)
+	}
+
+	// A normal restart continues from the recovered dataset
+	port = startTestServer(t, config)
+	client = dialTestClient(t, port)
+	if reply := client.do("GET", "kept"); reply.Str != "1" {
+		t.Errorf("Expected kept=1 after recovery, got %+v", reply)
+	}
+	if reply := client.do("EXISTS", "lost"); reply.Int != 0 {
+		t.Errorf("Expected lost to be absent after recovery, got %+v", reply)
+	}
+}
+
+// TestEncryptionAtRest tests that snapshots and append-only files are
+// encrypted, that a wrong key stops the server from starting and that
+// adding a new key re-encrypts every file under it
+func TestEncryptionAtRest(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, _ := crypt.NewKey([]byte(strings.Repeat("o", crypt.KeySize)))
+	newKey, _ := crypt.NewKey([]byte(strings.Repeat("n", crypt.KeySize)))
+	config := &server.ServerConfig{
+		Port:         0,
+		MaxClients:   10,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		Dir:          dir,
+		DBFilename:   "dump.rdb",
+		AppendOnly:   true,
+		AppendFsync:  aof.FsyncAlways,
+		Encryption:   crypt.NewKeyring(oldKey),
+	}
+	withKeyring := func(keyring *crypt.Keyring) *server.ServerConfig {
+		copied := *config
+		copied.Encryption = keyring
+		return &copied
+	}
+	persisted := func() []string {
+		files, _ := filepath.Glob(filepath.Join(dir, "appendonlydir", "*.aof"))
+		return append(files, filepath.Join(dir, "dump.rdb"))
+	}
+
+	srv := server.NewServer(config)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	client := dialTestClient(t, srv.GetListener().Addr().(*net.TCPAddr).Port)
+	client.do("SET", "snapshotted", "secret-one")
+	if reply := client.do("SAVE"); reply.Str != "OK" {
+		t.Fatalf("SAVE failed: %+v", reply)
+	}
+	client.do("SET", "logged", "secret-two")
+	srv.Stop()
+
+	for _, path := range persisted() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", path, err)
+		}
+		if !crypt.IsEncrypted(data) || strings.Contains(string(data), "secret") {
+			t.Errorf("Expected %s to be encrypted, got %q", filepath.Base(path), data)
+		}
+	}
+
+	// Without the key, or with another one, the server refuses to start
+	for _, keyring := range []*crypt.Keyring{nil, crypt.NewKeyring(newKey)} {
+		srv = server.NewServer(withKeyring(keyring))
+		err := srv.Start()
+		if err == nil {
+			srv.Stop()
+		}
+		if !errors.Is(err, crypt.ErrNoKey) && !errors.Is(err, crypt.ErrUnknownKey) {
+			t.Errorf("Expected a key error starting with %v, got %v", keyring.Current(), err)
+		}
+	}
+
+	// Rotating keeps the old key for reading and re-encrypts every file
+	rotated := withKeyring(crypt.NewKeyring(newKey, oldKey))
+	port := startTestServer(t, rotated)
+	client = dialTestClient(t, port)
+	for key, want := range map[string]string{"snapshotted": "secret-one", "logged": "secret-two"} {
+		if reply := client.do("GET", key); reply.Str != want {
+			t.Errorf("Expected %s=%s after rotation, got %+v", key, want, reply)
+		}
+	}
+	for _, path := range persisted() {
+		if id, err := crypt.FileKeyID(path); err != nil || id != newKey.ID() {
+			t.Errorf("Expected %s to use the new key, got %q, %v", filepath.Base(path), id, err)
+		}
+	}
+}
+
+// TestDiskStorageEngine tests that the disk storage engine keeps the
+// dataset across restarts without snapshots or an append-only file
+func TestDiskStorageEngine(t *testing.T) {
+	dir := t.TempDir()
+	config := &server.ServerConfig{
+		Port:          0,
+		MaxClients:    10,
+		ReadTimeout:   5 * time.Second,
+		WriteTimeout:  5 * time.Second,
+		Dir:           dir,
+		StorageEngine: "disk",
+	}
+	large := strings.Repeat("v", 1<<20)
+
+	srv := server.NewServer(config)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	client := dialTestClient(t, srv.GetListener().Addr().(*net.TCPAddr).Port)
+	client.do("SET", "large", large)
+	client.do("SET", "deleted", "value")
+	client.do("DEL", "deleted")
+	if reply := client.do("CONFIG", "GET", "storage-engine"); len(reply.Array) != 2 || reply.Array[1].Str != "disk" {
+		t.Errorf("Expected storage-engine disk, got %+v", reply)
+	}
+	srv.Stop()
+
+	if segments, _ := filepath.Glob(filepath.Join(dir, "storage", "*.seg")); len(segments) == 0 {
+		t.Fatal("Expected segment files in the storage directory")
+	}
+
+	port := startTestServer(t, config)
+	client = dialTestClient(t, port)
+	if reply := client.do("GET", "large"); reply.Str != large {
+		t.Errorf("Expected the large value after a restart, got %d bytes", len(reply.Str))
+	}
+	if reply := client.do("EXISTS", "deleted"); reply.Int != 0 {
+		t.Errorf("Expected deleted to stay deleted, got %+v", reply)
+	}
+
+	// Unknown engines are refused
+	unknown := *config
+	unknown.StorageEngine = "tape"
+	if err := server.NewServer(&unknown).Start(); err == nil || !strings.Contains(err.Error(), "unknown storage engine") {
+		t.Errorf("Expected an unknown storage engine error, got %v", err)
+	}
+}
+
+func TestTieredStorageEngine(t *testing.T) {
+	dir := t.TempDir()
+	config := &server.ServerConfig{
+		Port:              0,
+		MaxClients:        10,
+		ReadTimeout:       5 * time.Second,
+		WriteTimeout:      5 * time.Second,
+		Dir:               dir,
+		AppendOnly:        true,
+		AppendFsync:       aof.FsyncAlways,
+		StorageEngine:     "tiered",
+		TieredMemoryLimit: 1000,
+		TieredPolicy:      "lru",
+	}
+	value := func(i int) string { return fmt.Sprintf("%03d", i) + strings.Repeat("v", 97) }
+
+	srv := server.NewServer(config)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	client := dialTestClient(t, srv.GetListener().Addr().(*net.TCPAddr).Port)
+	for i := 0; i < 50; i++ {
+		client.do("SET", fmt.Sprintf("key%d", i), value(i))
+	}
+	for i := 0; i < 50; i++ {
+		if reply := client.do("GET", fmt.Sprintf("key%d", i)); reply.Str != value(i) {
+			t.Errorf("Expected key%d to read back, got %q", i, reply.Str)
+		}
+	}
+	info := client.do("INFO", "storage").Str
+	for _, field := range []string{"storage_engine:tiered", "tiered_policy:lru", "tiered_memory_limit:1000"} {
+		if !strings.Contains(info, field) {
+			t.Errorf("Expected %s in INFO storage, got %q", field, info)
+		}
+	}
+	if strings.Contains(info, "tiered_disk_hits:0\r\n") || strings.Contains(info, "tiered_cold_keys:0\r\n") {
+		t.Errorf("Expected values served from disk, got %q", info)
+	}
+	if reply := client.do("CONFIG", "GET", "tiered-memory-limit"); len(reply.Array) != 2 || reply.Array[1].Str != "1000" {
+		t.Errorf("Expected tiered-memory-limit 1000, got %+v", reply)
+	}
+	srv.Stop()
+
+	// The spilled values are scratch space; the dataset comes back from the
+	// append-only file
+	if _, err := os.Stat(filepath.Join(dir, "storage", "spill")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the spill directory to be removed on shutdown, got %v", err)
+	}
+	client = dialTestClient(t, startTestServer(t, config))
+	if reply := client.do("GET", "key7"); reply.Str != value(7) {
+		t.Errorf("Expected key7 after a restart, got %q", reply.Str)
+	}
+}
+
+func TestJSONLImportExport(t *testing.T) {
+	dir := t.TempDir()
+	fixture := filepath.Join(dir, "fixture.jsonl")
+	os.WriteFile(fixture, []byte(`{"key":"user:1","type":"string","value":"alice"}
+{"key":"session","type":"string","value":"token","ttl":3600000}
+`), 0644)
+	config := &server.ServerConfig{
+		Port:         0,
+		MaxClients:   10,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		Dir:          dir,
+		DBFilename:   "dump.rdb",
+		AppendOnly:   true,
+		AppendFsync:  aof.FsyncAlways,
+		ImportJSONL:  fixture,
+	}
+
+	srv := server.NewServer(config)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	client := dialTestClient(t, srv.GetListener().Addr().(*net.TCPAddr).Port)
+	if reply := client.do("GET", "user:1"); reply.Str != "alice" {
+		t.Errorf("Expected the imported user:1, got %+v", reply)
+	}
+	client.do("SET", "user:1", "changed")
+	client.do("SAVE")
+	srv.Stop()
+
+	// Importing again conflicts with the imported keys and refuses to start
+	if err := server.NewServer(config).Start(); err == nil || !strings.Contains(err.Error(), "already exist") {
+		t.Errorf("Expected an import conflict, got %v", err)
+	}
+
+	// The replace policy overwrites them, and the result is persisted
+	config.ImportConflict = jsonl.ConflictReplace
+	srv = server.NewServer(config)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	srv.Stop()
+	config.ImportJSONL = ""
+	client = dialTestClient(t, startTestServer(t, config))
+	if reply := client.do("GET", "user:1"); reply.Str != "alice" {
+		t.Errorf("Expected the replaced user:1 after a restart, got %+v", reply)
+	}
+
+	// Exporting a snapshot and importing it into a fresh one round trips
+	var exported strings.Builder
+	if keys, err := server.ExportSnapshot(filepath.Join(dir, "dump.rdb"), nil, &exported); err != nil || keys != 2 {
+		t.Fatalf("ExportSnapshot wrote %d keys: %v", keys, err)
+	}
+	if !strings.Contains(exported.String(), `"key":"session"`) || !strings.Contains(exported.String(), `"ttl":`) {
+		t.Errorf("Expected the session key with its ttl, got %q", exported.String())
+	}
+	output := filepath.Join(dir, "imported.rdb")
+	result, err := server.ImportToFile(strings.NewReader(exported.String()), "", jsonl.ConflictFail, nil, output)
+	if err != nil || result.Imported != 2 {
+		t.Fatalf("ImportToFile imported %d keys: %v", result.Imported, err)
+	}
+	if report, err := server.CheckSnapshot(output, nil); err != nil || report.Keys != 2 || report.Expires != 1 {
+		t.Errorf("Unexpected imported snapshot %+v: %v", report, err)
+	}
+}
+
+// eventually polls condition until it holds or five seconds passed
+func eventually(condition func() bool) bool {
+	return eventuallyWithin(5*time.Second, condition)
+}
+
+// eventuallyWithin polls condition until it holds or timeout expires
+func eventuallyWithin(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return false
+}
+
+// infoField returns a field of an INFO section
+func infoField(client *testClient, section, field string) string {
+	for _, line := range strings.Split(client.do("INFO", section).Str, "\r\n") {
+		if value, found := strings.CutPrefix(line, field+":"); found {
+			return value
+		}
+	}
+	return ""
+}
+
+// testProxy forwards connections to a server and can cut them all, to
+// simulate a network failure
+type testProxy struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	conns    []net.Conn
+}
+
+// startTestProxy starts a proxy to the server on port
+func startTestProxy(t *testing.T, port int) *testProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	proxy := &testProxy{listener: listener}
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+			if err != nil {
+				client.Close()
+				continue
+			}
+			proxy.mutex.Lock()
+			proxy.conns = append(proxy.conns, client, upstream)
+			proxy.mutex.Unlock()
+			go func() { io.Copy(upstream, client); upstream.Close() }()
+			go func() { io.Copy(client, upstream); client.Close() }()
+		}
+	}()
+	return proxy
+}
+
+// port returns the port the proxy listens on
+func (p *testProxy) port() int {
+	return p.listener.Addr().(*net.TCPAddr).Port
+}
+
+// cut closes every proxied connection
+func (p *testProxy) cut() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+func TestReplication(t *testing.T) {
+	config := func() *server.ServerConfig {
+		return &server.ServerConfig{
+			Port:         0,
+			MaxClients:   10,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 5 * time.Second,
+			Dir:          t.TempDir(),
+		}
+	}
+	masterPort := startTestServer(t, config())
+	master := dialTestClient(t, masterPort)
+	master.do("SET", "before", "sync")
+	proxy := startTestProxy(t, masterPort)
+
+	replicaConfig := config()
+	replicaConfig.ReplicaOf = fmt.Sprintf("127.0.0.1 %d", proxy.port())
+	replicaPort := startTestServer(t, replicaConfig)
+	replica := dialTestClient(t, replicaPort)
+	replica.do("SET", "stale", "value")
+
+	// The full sync replaces the replica's dataset with the master's
+	if !eventually(func() bool { return infoField(replica, "replication", "master_link_status") == "up" }) {
+		t.Fatalf("Expected the replica to connect, got %q", replica.do("INFO", "replication").Str)
+	}
+	if reply := replica.do("GET", "before"); reply.Str != "sync" || replica.do("EXISTS", "stale").Int != 0 {
+		t.Errorf("Expected the master's dataset after the full sync, got %+v", reply)
+	}
+	master.do("SET", "after", "stream")
+	master.do("DEL", "before")
+	if !eventually(func() bool { return replica.do("GET", "after").Str == "stream" && replica.do("EXISTS", "before").Int == 0 }) {
+		t.Error("Expected writes to stream to the replica")
+	}
+
+	if role := master.do("ROLE"); len(role.Array) != 3 || role.Array[0].Str != "master" || len(role.Array[2].Array) != 1 ||
+		role.Array[2].Array[0].Array[1].Str != strconv.Itoa(replicaPort) {
+		t.Errorf("Unexpected master ROLE %+v", role)
+	}
+	if role := replica.do("ROLE"); len(role.Array) != 5 || role.Array[0].Str != "slave" || role.Array[3].Str != "connected" {
+		t.Errorf("Unexpected replica ROLE %+v", role)
+	}
+	masterID := infoField(master, "replication", "master_replid")
+	if infoField(replica, "replication", "master_replid") != masterID {
+		t.Error("Expected the replica to adopt the master's replication ID")
+	}
+	if !eventually(func() bool {
+		return infoField(replica, "replication", "master_repl_offset") == infoField(master, "replication", "master_repl_offset")
+	}) {
+		t.Error("Expected the replica to reach the master's offset")
+	}
+
+	// A short disconnect resumes from the backlog
+	proxy.cut()
+	master.do("SET", "during", "outage")
+	if !eventually(func() bool { return replica.do("GET", "during").Str == "outage" }) {
+		t.Fatal("Expected the replica to catch up after reconnecting")
+	}
+	if full, partial := infoField(master, "stats", "sync_full"), infoField(master, "stats", "sync_partial_ok"); full != "1" || partial != "1" {
+		t.Errorf("Expected one full and one partial sync, got %s and %s", full, partial)
+	}
+
+	// A promoted replica keeps the dataset under a new history
+	if reply := replica.do("REPLICAOF", "NO", "ONE"); reply.Str != "OK" {
+		t.Fatalf("REPLICAOF NO ONE failed: %+v", reply)
+	}
+	if infoField(replica, "replication", "role") != "master" || infoField(replica, "replication", "master_replid2") != masterID {
+		t.Errorf("Unexpected promoted replica %q", replica.do("INFO", "replication").Str)
+	}
+	if reply := replica.do("GET", "after"); reply.Str != "stream" {
+		t.Errorf("Expected the promoted replica to keep its data, got %+v", reply)
+	}
+	if reply := replica.do("REPLICAOF", "localhost", "not-a-port"); reply.Type != resp2.Error {
+		t.Errorf("Expected an invalid port to be rejected, got %+v", reply)
+	}
+}
+
+func TestReplicaDurability(t *testing.T) {
+	config := func() *server.ServerConfig {
+		return &server.ServerConfig{
+			Port:              0,
+			MaxClients:        10,
+			ReadTimeout:       5 * time.Second,
+			WriteTimeout:      5 * time.Second,
+			Dir:               t.TempDir(),
+			ReplicaReadOnly:   true,
+			MinReplicasMaxLag: 10,
+		}
+	}
+	masterPort := startTestServer(t, config())
+	master := dialTestClient(t, masterPort)
+	replicaConfig := config()
+	replicaConfig.ReplicaOf = fmt.Sprintf("127.0.0.1 %d", masterPort)
+	replica := dialTestClient(t, startTestServer(t, replicaConfig))
+	if !eventually(func() bool { return infoField(replica, "replication", "master_link_status") == "up" }) {
+		t.Fatalf("Expected the replica to connect, got %q", replica.do("INFO", "replication").Str)
+	}
+
+	// A read-only replica refuses its clients' writes unless configured
+	// otherwise
+	if reply := replica.do("SET", "key", "value"); reply.Type != resp2.Error || !strings.HasPrefix(reply.Str, "READONLY") {
+		t.Errorf("Expected a READONLY error, got %+v", reply)
+	}
+	if infoField(replica, "replication", "slave_read_only") != "1" {
+		t.Error("Expected the replica to report being read-only")
+	}
+	replica.do("CONFIG", "SET", "replica-read-only", "no")
+	if reply := replica.do("SET", "local", "value"); reply.Str != "OK" {
+		t.Errorf("Expected a writable replica to accept writes, got %+v", reply)
+	}
+	if reply := replica.do("WAIT", "0", "0"); reply.Type != resp2.Error {
+		t.Errorf("Expected WAIT to be refused on a replica, got %+v", reply)
+	}
+
+	// WAIT returns once the replica acknowledged the write, or with the
+	// replicas that did when the timeout expires
+	master.do("SET", "key", "value")
+	if reply := master.do("WAIT", "1", "5000"); reply.Type != resp2.Integer || reply.Int != 1 {
+		t.Errorf("Expected WAIT to report 1 replica, got %+v", reply)
+	}
+	if replica.do("GET", "key").Str != "value" {
+		t.Error("Expected the acknowledged write on the replica")
+	}
+	start := time.Now()
+	if reply := master.do("WAIT", "2", "200"); reply.Int != 1 || time.Since(start) < 200*time.Millisecond {
+		t.Errorf("Expected WAIT to time out with 1 replica, got %+v after %v", reply, time.Since(start))
+	}
+	if slave := infoField(master, "replication", "slave0"); !strings.Contains(slave, ",lag=") {
+		t.Errorf("Expected the replica lag in INFO, got %q", slave)
+	}
+
+	// A master refuses writes without enough good replicas
+	master.do("CONFIG", "SET", "min-replicas-to-write", "2")
+	if reply := master.do("SET", "key", "refused"); reply.Type != resp2.Error || !strings.HasPrefix(reply.Str, "NOREPLICAS") {
+		t.Errorf("Expected a NOREPLICAS error, got %+v", reply)
+	}
+	if good := infoField(master, "replication", "min_slaves_good_slaves"); good != "1" {
+		t.Errorf("Expected 1 good replica, got %q", good)
+	}
+	master.do("CONFIG", "SET", "min-replicas-to-write", "1")
+	if reply := master.do("SET", "key", "accepted"); reply.Str != "OK" {
+		t.Errorf("Expected the write to be accepted, got %+v", reply)
+	}
+	if reply := master.do("CONFIG", "GET", "min-replicas-*"); len(reply.Array) != 4 || reply.Array[1].Str != "10" || reply.Array[3].Str != "1" {
+		t.Errorf("Unexpected CONFIG GET reply %+v", reply)
+	}
+}
+
+// clusterInfoField returns a field of CLUSTER INFO
+func clusterInfoField(client *testClient, field string) string {
+	for _, line := range strings.Split(client.do("CLUSTER", "INFO").Str, "\r\n") {
+		if value, found := strings.CutPrefix(line, field+":"); found {
+			return value
+		}
+	}
+	return ""
+}
+
+// clusterBusPort returns the cluster bus port of a node from its own line
+// of CLUSTER NODES
+func clusterBusPort(t *testing.T, client *testClient) string {
+	t.Helper()
+	for _, line := range strings.Split(client.do("CLUSTER", "NODES").Str, "\n") {
+		if fields := strings.Fields(line); len(fields) > 2 && strings.Contains(fields[2], "myself") {
+			_, port, _ := strings.Cut(fields[1], "@")
+			return port
+		}
+	}
+	t.Fatal("No node is myself in CLUSTER NODES")
+	return ""
+}
+
+// startTestCluster starts nodes cluster nodes in dirs, splits the slots
+// evenly between them and waits until every node sees the whole cluster
+func startTestCluster(t *testing.T, dirs []string) ([]int, []*testClient) {
+	t.Helper()
+	starts := make([]int, len(dirs))
+	for i := range starts {
+		starts[i] = i * 16384 / len(dirs)
+	}
+	return startTestClusterWithSlots(t, dirs, starts)
+}
+
+// startTestClusterWithSlots starts a cluster whose node i serves the slots
+// from starts[i] up to the start of the next node
+func startTestClusterWithSlots(t *testing.T, dirs []string, starts []int) ([]int, []*testClient) {
+	t.Helper()
+	ports := make([]int, len(dirs))
+	clients := make([]*testClient, len(dirs))
+	for i, dir := range dirs {
+		ports[i] = startTestServer(t, &server.ServerConfig{
+			Port:           0,
+			MaxClients:     10,
+			ReadTimeout:    5 * time.Second,
+			WriteTimeout:   5 * time.Second,
+			Dir:            dir,
+			ClusterEnabled: true,
+		})
+		clients[i] = dialTestClient(t, ports[i])
+		start, end := starts[i], 16383
+		if i+1 < len(starts) {
+			end = starts[i+1] - 1
+		}
+		if reply := clients[i].do("CLUSTER", "ADDSLOTSRANGE", strconv.Itoa(start), strconv.Itoa(end)); reply.Str != "OK" {
+			t.Fatalf("CLUSTER ADDSLOTSRANGE failed: %+v", reply)
+		}
+	}
+	for i := 1; i < len(dirs); i++ {
+		if reply := clients[i].do("CLUSTER", "MEET", "127.0.0.1", strconv.Itoa(ports[0]), clusterBusPort(t, clients[0])); reply.Str != "OK" {
+			t.Fatalf("CLUSTER MEET failed: %+v", reply)
+		}
+	}
+	for i, client := range clients {
+		if !eventually(func() bool {
+			return clusterInfoField(client, "cluster_state") == "ok" && clusterInfoField(client, "cluster_known_nodes") == strconv.Itoa(len(dirs))
+		}) {
+			t.Fatalf("Node %d did not join the cluster: %q", i, client.do("CLUSTER", "INFO").Str)
+		}
+	}
+	return ports, clients
+}
+
+func TestCluster(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir(), t.TempDir()}
+	ports, clients := startTestCluster(t, dirs)
+
+	// Every node redirects keys it does not serve to the node that does
+	slot := clients[0].do("CLUSTER", "KEYSLOT", "{user1000}.following").Int
+	if other := clients[0].do("CLUSTER", "KEYSLOT", "user1000").Int; slot != other || slot != 3443 {
+		t.Errorf("Expected hash tags to share slot 3443, got %d and %d", slot, other)
+	}
+	owner := int(slot) * 3 / 16384
+	for i, client := range clients {
+		reply := client.do("SET", "{user1000}.following", "alice")
+		if i == owner {
+			if reply.Str != "OK" {
+				t.Errorf("Expected the owner to accept the write, got %+v", reply)
+			}
+			continue
+		}
+		if want := fmt.Sprintf("MOVED %d 127.0.0.1:%d", slot, ports[owner]); reply.Type != resp2.Error || reply.Str != want {
+			t.Errorf("Expected %q from node %d, got %+v", want, i, reply)
+		}
+	}
+	if reply := clients[owner].do("GET", "{user1000}.following"); reply.Str != "alice" {
+		t.Errorf("Unexpected value %+v", reply)
+	}
+	if reply := clients[owner].do("DEL", "{user1000}.following", "{user1000}.followers"); reply.Int != 1 {
+		t.Errorf("Expected keys sharing a hash tag to be deleted together, got %+v", reply)
+	}
+	if reply := clients[owner].do("DEL", "{user1000}.following", "user2000"); reply.Type != resp2.Error || !strings.HasPrefix(reply.Str, "CROSSSLOT") {
+		t.Errorf("Expected a CROSSSLOT error, got %+v", reply)
+	}
+	if reply := clients[owner].do("PING"); reply.Str != "PONG" {
+		t.Errorf("Expected commands without keys to run anywhere, got %+v", reply)
+	}
+
+	// CLUSTER SLOTS and SHARDS describe the same layout from every node
+	for i, client := range clients {
+		slots := client.do("CLUSTER", "SLOTS")
+		if len(slots.Array) != 3 {
+			t.Fatalf("Expected 3 slot ranges from node %d, got %+v", i, slots)
+		}
+		for j, r := range slots.Array {
+			node := r.Array[2].Array
+			if r.Array[0].Int != int64(j*16384/3) || node[0].Str != "127.0.0.1" || node[1].Int != int64(ports[j]) {
+				t.Errorf("Unexpected range %d from node %d: %+v", j, i, r)
+			}
+		}
+		if shards := client.do("CLUSTER", "SHARDS"); len(shards.Array) != 3 || shards.Array[1].Array[1].Array[0].Int != 5461 {
+			t.Errorf("Unexpected CLUSTER SHARDS from node %d: %+v", i, shards)
+		}
+	}
+	if size := clusterInfoField(clients[1], "cluster_size"); size != "3" {
+		t.Errorf("Expected a cluster of 3 masters, got %s", size)
+	}
+	if infoField(clients[0], "cluster", "cluster_enabled") != "1" {
+		t.Error("Expected INFO to report cluster mode")
+	}
+
+	// Slots are assigned once
+	if reply := clients[0].do("CLUSTER", "ADDSLOTS", "5461"); reply.Type != resp2.Error || reply.Str != "ERR Slot 5461 is already busy" {
+		t.Errorf("Expected a busy slot to be rejected, got %+v", reply)
+	}
+	if reply := clients[0].do("CLUSTER", "ADDSLOTS", "16384"); reply.Type != resp2.Error {
+		t.Errorf("Expected an invalid slot to be rejected, got %+v", reply)
+	}
+	if reply := clients[0].do("REPLICAOF", "127.0.0.1", strconv.Itoa(ports[1])); reply.Type != resp2.Error {
+		t.Errorf("Expected REPLICAOF to be refused in cluster mode, got %+v", reply)
+	}
+
+	// Each node keeps its view of the cluster in its configuration file
+	myID := clients[2].do("CLUSTER", "MYID").Str
+	data, err := os.ReadFile(filepath.Join(dirs[2], "nodes.conf"))
+	if err != nil || !strings.Contains(string(data), myID+" 127.0.0.1:") || strings.Count(string(data), "\n") != 4 {
+		t.Errorf("Unexpected nodes.conf %q, %v", data, err)
+	}
+}
+
+func TestClusterDisabled(t *testing.T) {
+	client := dialTestClient(t, startTestServer(t, &server.ServerConfig{
+		Port:         0,
+		MaxClients:   10,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		Dir:          t.TempDir(),
+	}))
+	if reply := client.do("CLUSTER", "INFO"); reply.Type != resp2.Error || !strings.Contains(reply.Str, "cluster support disabled") {
+		t.Errorf("Expected CLUSTER to be refused, got %+v", reply)
+	}
+}
+
+func TestClusterSlotMigration(t *testing.T) {
+	ports, clients := startTestCluster(t, []string{t.TempDir(), t.TempDir()})
+	ids := []string{clients[0].do("CLUSTER", "MYID").Str, clients[1].do("CLUSTER", "MYID").Str}
+	source, target := clients[1], clients[0]
+	ask := fmt.Sprintf("ASK 12182 127.0.0.1:%d", ports[0])
+
+	// {foo}a and {foo}b hash to slot 12182, served by the second node
+	if reply := source.do("SET", "{foo}a", "1"); reply.Str != "OK" {
+		t.Fatalf("SET failed: %+v", reply)
+	}
+	if reply := target.do("CLUSTER", "SETSLOT", "12182", "MIGRATING", ids[1]); reply.Type != resp2.Error {
+		t.Errorf("Expected a node to refuse migrating a slot it does not serve, got %+v", reply)
+	}
+	for _, step := range []struct {
+		client *testClient
+		args   []string
+	}{
+		{target, []string{"CLUSTER", "SETSLOT", "12182", "IMPORTING", ids[1]}},
+		{source, []string{"CLUSTER", "SETSLOT", "12182", "MIGRATING", ids[0]}},
+	} {
+		if reply := step.client.do(step.args...); reply.Str != "OK" {
+			t.Fatalf("%v failed: %+v", step.args, reply)
+		}
+	}
+	if nodes := source.do("CLUSTER", "NODES").Str; !strings.Contains(nodes, "[12182->-"+ids[0]+"]") {
+		t.Errorf("Expected CLUSTER NODES to show the migrating slot, got %q", nodes)
+	}
+
+	// The source serves the keys it still holds and asks for the others
+	if reply := source.do("GET", "{foo}a"); reply.Str != "1" {
+		t.Errorf("Expected the source to serve a key it holds, got %+v", reply)
+	}
+	if reply := source.do("GET", "{foo}b"); reply.Type != resp2.Error || reply.Str != ask {
+		t.Errorf("Expected %q, got %+v", ask, reply)
+	}
+	if reply := source.do("EXISTS", "{foo}a", "{foo}b"); reply.Type != resp2.Error || !strings.HasPrefix(reply.Str, "TRYAGAIN") {
+		t.Errorf("Expected TRYAGAIN for keys split between nodes, got %+v", reply)
+	}
+	if reply := target.do("GET", "{foo}b"); reply.Type != resp2.Error || !strings.HasPrefix(reply.Str, "MOVED 12182") {
+		t.Errorf("Expected the target to redirect clients that did not send ASKING, got %+v", reply)
+	}
+	target.do("ASKING")
+	if reply := target.do("SET", "{foo}b", "2"); reply.Str != "OK" {
+		t.Errorf("Expected the target to accept a write after ASKING, got %+v", reply)
+	}
+	if reply := target.do("GET", "{foo}b"); reply.Type != resp2.Error {
+		t.Errorf("Expected ASKING to hold for one command only, got %+v", reply)
+	}
+
+	// Keys move with MIGRATE, after which the slot can change owner
+	if reply := source.do("CLUSTER", "COUNTKEYSINSLOT", "12182"); reply.Int != 1 {
+		t.Errorf("Expected 1 key in the slot, got %+v", reply)
+	}
+	if reply := source.do("CLUSTER", "GETKEYSINSLOT", "12182", "10"); len(reply.Array) != 1 || reply.Array[0].Str != "{foo}a" {
+		t.Errorf("Unexpected keys in the slot: %+v", reply)
+	}
+	if reply := source.do("CLUSTER", "SETSLOT", "12182", "NODE", ids[0]); reply.Type != resp2.Error || !strings.Contains(reply.Str, "still hold keys") {
+		t.Errorf("Expected the slot to stay while it holds keys, got %+v", reply)
+	}
+	if reply := source.do("MIGRATE", "127.0.0.1", strconv.Itoa(ports[0]), "", "0", "5000", "KEYS", "{foo}a"); reply.Str != "OK" {
+		t.Fatalf("MIGRATE failed: %+v", reply)
+	}
+	if reply := source.do("MIGRATE", "127.0.0.1", strconv.Itoa(ports[0]), "{foo}a", "0", "5000"); reply.Str != "NOKEY" {
+		t.Errorf("Expected NOKEY for a migrated key, got %+v", reply)
+	}
+	if reply := source.do("GET", "{foo}a"); reply.Str != ask {
+		t.Errorf("Expected a migrated key to be asked for, got %+v", reply)
+	}
+	for _, c := range []*testClient{target, source} {
+		if reply := c.do("CLUSTER", "SETSLOT", "12182", "NODE", ids[0]); reply.Str != "OK" {
+			t.Fatalf("CLUSTER SETSLOT NODE failed: %+v", reply)
+		}
+	}
+	if reply := target.do("GET", "{foo}a"); reply.Str != "1" {
+		t.Errorf("Expected the new owner to serve the key, got %+v", reply)
+	}
+	if reply := source.do("GET", "{foo}a"); reply.Str != fmt.Sprintf("MOVED 12182 127.0.0.1:%d", ports[0]) {
+		t.Errorf("Expected the old owner to redirect, got %+v", reply)
+	}
+	if epoch := clusterInfoField(target, "cluster_my_epoch"); epoch == "0" {
+		t.Error("Expected the new owner to take a new config epoch")
+	}
+}
+
+// clusterTestClient sends commands to a cluster, following redirects the
+// way cluster-aware clients do
+type clusterTestClient struct {
+	addr    string
+	conns   map[string]*client.Client
+	asks    int
+	retries int
+}
+
+// do sends a command to the node serving its keys
+func (c *clusterTestClient) do(args ...string) (*resp2.RESPValue, error) {
+	asking := false
+	for attempt := 0; attempt < 100; attempt++ {
+		conn, exists := c.conns[c.addr]
+		if !exists {
+			var err error
+			if conn, err = client.Dial(c.addr, 5*time.Second); err != nil {
+				return nil, err
+			}
+			c.conns[c.addr] = conn
+		}
+		if asking {
+			if _, err := conn.Do("ASKING"); err != nil {
+				return nil, err
+			}
+		}
+		reply, err := conn.Do(args[0], args[1:]...)
+		var replyErr client.ReplyError
+		if !errors.As(err, &replyErr) {
+			return reply, err
+		}
+		fields := strings.Fields(reply.Str)
+		switch fields[0] {
+		case "MOVED":
+			c.addr, asking = fields[2], false
+			continue
+		case "ASK":
+			// ASK holds for one command; the slot still belongs to this node
+			conn, err := client.Dial(fields[2], 5*time.Second)
+			if err != nil {
+				return nil, err
+			}
+			conn.Do("ASKING")
+			reply, err = conn.Do(args[0], args[1:]...)
+			conn.Close()
+			c.asks++
+			if reply != nil && strings.HasPrefix(reply.Str, "TRYAGAIN") {
+				break
+			}
+			return reply, err
+		case "TRYAGAIN":
+		default:
+			return reply, err
+		}
+		c.retries++
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("%v still redirected after 100 attempts", args)
+}
+
+// close closes the connections to the nodes
+func (c *clusterTestClient) close() {
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+}
+
+// slotMapClient routes commands the way redis-cli -c and the common cluster
+// client libraries do, speaking RESP over its own connections: it loads the
+// slot map with CLUSTER SLOTS, sends each command to the node serving the
+// slot of its key, repoints the slot on MOVED and, on ASK, pipelines ASKING
+// with the command to the named node without touching the map
+type slotMapClient struct {
+	slots [cluster.SlotCount]string
+	conns map[string]*slotMapConn
+	moved int
+	asked int
+}
+
+// slotMapConn is a connection of a slotMapClient to one node
+type slotMapConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// newSlotMapClient loads the slot map from the seed node
+func newSlotMapClient(t *testing.T, seed string) *slotMapClient {
+	t.Helper()
+	c := &slotMapClient{conns: make(map[string]*slotMapConn)}
+	t.Cleanup(func() {
+		for _, conn := range c.conns {
+			conn.conn.Close()
+		}
+	})
+	replies, err := c.roundTrip(seed, []string{"CLUSTER", "SLOTS"})
+	if err != nil {
+		t.Fatalf("CLUSTER SLOTS failed: %v", err)
+	}
+	for _, r := range replies[0].Array {
+		node := r.Array[2].Array
+		addr := net.JoinHostPort(node[0].Str, strconv.FormatInt(node[1].Int, 10))
+		for slot := r.Array[0].Int; slot <= r.Array[1].Int; slot++ {
+			c.slots[slot] = addr
+		}
+	}
+	return c
+}
+
+// roundTrip writes commands to a node in one go and reads their replies
+func (c *slotMapClient) roundTrip(addr string, commands ...[]string) ([]*resp2.RESPValue, error) {
+	conn, exists := c.conns[addr]
+	if !exists {
+		netConn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		conn = &slotMapConn{conn: netConn, reader: bufio.NewReader(netConn)}
+		c.conns[addr] = conn
+	}
+	parser := resp2.NewRESP2Parser()
+	var request []byte
+	for _, command := range commands {
+		request = append(request, parser.Serialize(resp2.NewCommandValue(command[0], command[1:]))...)
+	}
+	conn.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.conn.Write(request); err != nil {
+		return nil, err
+	}
+	replies := make([]*resp2.RESPValue, len(commands))
+	for i := range replies {
+		reply, err := parser.Parse(conn.reader)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// do sends a command whose first argument is its key, following redirects
+func (c *slotMapClient) do(args ...string) (*resp2.RESPValue, error) {
+	slot := cluster.KeySlot(args[1])
+	for attempt := 0; attempt < 5; attempt++ {
+		replies, err := c.roundTrip(c.slots[slot], args)
+		if err != nil {
+			return nil, err
+		}
+		reply := replies[0]
+		if reply.Type != resp2.Error {
+			return reply, nil
+		}
+		fields := strings.Fields(reply.Str)
+		switch fields[0] {
+		case "MOVED":
+			c.moved++
+			c.slots[slot] = fields[2]
+		case "ASK":
+			c.asked++
+			if replies, err = c.roundTrip(fields[2], []string{"ASKING"}, args); err != nil {
+				return nil, err
+			}
+			if replies[0].Str != "OK" {
+				return replies[0], nil
+			}
+			return replies[1], nil
+		case "TRYAGAIN":
+			time.Sleep(10 * time.Millisecond)
+		default:
+			return reply, nil
+		}
+	}
+	return nil, fmt.Errorf("%v still redirected after 5 attempts", args)
+}
+
+func TestClusterClientRedirects(t *testing.T) {
+	ports, clients := startTestCluster(t, []string{t.TempDir(), t.TempDir()})
+	ids := []string{clients[0].do("CLUSTER", "MYID").Str, clients[1].do("CLUSTER", "MYID").Str}
+	addrs := []string{fmt.Sprintf("127.0.0.1:%d", ports[0]), fmt.Sprintf("127.0.0.1:%d", ports[1])}
+	source, target := clients[1], clients[0]
+
+	// With the slot map loaded, every key goes straight to its node
+	c := newSlotMapClient(t, addrs[0])
+	for i := 0; i < 100; i++ {
+		key := "key:" + strconv.Itoa(i)
+		if reply, err := c.do("SET", key, strconv.Itoa(i)); err != nil || reply.Str != "OK" {
+			t.Fatalf("SET %s = %+v, %v", key, reply, err)
+		}
+		if reply, err := c.do("GET", key); err != nil || reply.Str != strconv.Itoa(i) {
+			t.Fatalf("GET %s = %+v, %v", key, reply, err)
+		}
+	}
+	if c.moved+c.asked != 0 {
+		t.Errorf("Expected no redirects with a fresh slot map, got %d MOVED and %d ASK", c.moved, c.asked)
+	}
+
+	// {foo}a and {foo}b hash to slot 12182, moving from the second node to
+	// the first; the client follows ASK for the keys already moved and keeps
+	// its map
+	if reply, err := c.do("SET", "{foo}a", "1"); err != nil || reply.Str != "OK" {
+		t.Fatalf("SET {foo}a = %+v, %v", reply, err)
+	}
+	for _, step := range []struct {
+		client *testClient
+		args   []string
+	}{
+		{target, []string{"CLUSTER", "SETSLOT", "12182", "IMPORTING", ids[1]}},
+		{source, []string{"CLUSTER", "SETSLOT", "12182", "MIGRATING", ids[0]}},
+		{source, []string{"MIGRATE", "127.0.0.1", strconv.Itoa(ports[0]), "{foo}a", "0", "5000"}},
+	} {
+		if reply := step.client.do(step.args...); reply.Str != "OK" {
+			t.Fatalf("%v failed: %+v", step.args, reply)
+		}
+	}
+	if reply, err := c.do("GET", "{foo}a"); err != nil || reply.Str != "1" {
+		t.Errorf("GET of a migrated key = %+v, %v", reply, err)
+	}
+	if reply, err := c.do("SET", "{foo}b", "2"); err != nil || reply.Str != "OK" {
+		t.Errorf("SET of a new key in a migrating slot = %+v, %v", reply, err)
+	}
+	if c.asked != 2 || c.moved != 0 || c.slots[12182] != addrs[1] {
+		t.Errorf("Expected 2 ASK keeping the slot on %s, got %d ASK, %d MOVED and the slot on %s", addrs[1], c.asked, c.moved, c.slots[12182])
+	}
+
+	// Once the slot changed owner, MOVED repoints it and later commands go
+	// straight to the new owner
+	for _, node := range []*testClient{target, source} {
+		if reply := node.do("CLUSTER", "SETSLOT", "12182", "NODE", ids[0]); reply.Str != "OK" {
+			t.Fatalf("CLUSTER SETSLOT NODE failed: %+v", reply)
+		}
+	}
+	for _, want := range []struct{ key, value string }{{"{foo}b", "2"}, {"{foo}a", "1"}} {
+		if reply, err := c.do("GET", want.key); err != nil || reply.Str != want.value {
+			t.Errorf("GET %s after the move = %+v, %v", want.key, reply, err)
+		}
+	}
+	if c.moved != 1 || c.slots[12182] != addrs[0] {
+		t.Errorf("Expected 1 MOVED repointing the slot to %s, got %d and the slot on %s", addrs[0], c.moved, c.slots[12182])
+	}
+}
+
+// TestGoRedisClusterClient tests that go-redis, a widely used client,
+// completes its handshake with the nodes and routes keys by their slot map
+func TestGoRedisClusterClient(t *testing.T) {
+	ports, clients := startTestCluster(t, []string{t.TempDir(), t.TempDir(), t.TempDir()})
+
+	// go-redis asks for RESP3 and falls back to RESP2 on NOPROTO
+	if reply := clients[0].do("HELLO", "3"); reply.Type != resp2.Error || !strings.HasPrefix(reply.Str, "NOPROTO") {
+		t.Errorf("HELLO 3 = %+v, want a NOPROTO error", reply)
+	}
+	if reply := clients[0].do("HELLO", "2"); reply.Type != resp2.Array || len(reply.Array) < 6 || reply.Array[5].Int != 2 {
+		t.Errorf("HELLO 2 = %+v, want the server properties with proto 2", reply)
+	}
+	if reply := clients[0].do("CLIENT", "SETINFO", "LIB-NAME", "go-redis"); reply.Str != "OK" {
+		t.Errorf("CLIENT SETINFO = %+v", reply)
+	}
+
+	addrs := make([]string, len(ports))
+	for i, port := range ports {
+		addrs[i] = fmt.Sprintf("127.0.0.1:%d", port)
+	}
+	// Knowing one node is enough, and a redirect fails the command
+	rdb := redis.NewClusterClient(&redis.ClusterOptions{Addrs: addrs[:1], MaxRedirects: -1})
+	defer rdb.Close()
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		key := "key:" + strconv.Itoa(i)
+		if err := rdb.Set(ctx, key, strconv.Itoa(i), 0).Err(); err != nil {
+			t.Fatalf("SET %s failed: %v", key, err)
+		}
+		if value, err := rdb.Get(ctx, key).Result(); err != nil || value != strconv.Itoa(i) {
+			t.Fatalf("GET %s = %q, %v", key, value, err)
+		}
+	}
+
+	// The keys are spread over the nodes
+	for i, client := range clients {
+		held := 0
+		for j := 0; j < 100; j++ {
+			held += int(client.do("EXISTS", "key:"+strconv.Itoa(j)).Int)
+		}
+		if held == 0 {
+			t.Errorf("Node %d holds none of the keys", i)
+		}
+	}
+}
+
+func TestClusterRebalance(t *testing.T) {
+	// The first node serves 300 slots too many, the second 300 too few
+	dirs := []string{t.TempDir(), t.TempDir(), t.TempDir()}
+	ports, _ := startTestClusterWithSlots(t, dirs, []int{0, 5761, 10922})
+
+	// Load generators keep writing and reading back their own keys while
+	// the slots move, following MOVED, ASK and TRYAGAIN
+	const keys = 400
+	stop := make(chan struct{})
+	results := make(chan string, 2)
+	var asks, operations int
+	var statsMutex sync.Mutex
+	for worker := 0; worker < 2; worker++ {
+		go func(worker int) {
+			c := &clusterTestClient{addr: fmt.Sprintf("127.0.0.1:%d", ports[worker]), conns: make(map[string]*client.Client)}
+			defer c.close()
+			values := make(map[string]string)
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					statsMutex.Lock()
+					asks, operations = asks+c.asks, operations+n
+					statsMutex.Unlock()
+					for key, value := range values {
+						if reply, err := c.do("GET", key); err != nil || reply.Str != value {
+							results <- fmt.Sprintf("GET %s after the rebalance returned %+v, %v, want %q", key, reply, err, value)
+							return
+						}
+					}
+					results <- ""
+					return
+				default:
+				}
+				key := fmt.Sprintf("worker%d:key%d", worker, n%keys)
+				value := fmt.Sprintf("value%d", n)
+				if reply, err := c.do("SET", key, value); err != nil || reply.Str != "OK" {
+					results <- fmt.Sprintf("SET %s returned %+v, %v", key, reply, err)
+					return
+				}
+				values[key] = value
+				if reply, err := c.do("GET", key); err != nil || reply.Str != value {
+					results <- fmt.Sprintf("GET %s returned %+v, %v, want %q", key, reply, err, value)
+					return
+				}
+			}
+		}(worker)
+	}
+
+	moved := 0
+	err := reshard.Rebalance(fmt.Sprintf("127.0.0.1:%d", ports[0]), reshard.Options{
+		Timeout: 10 * time.Second,
+		Batch:   10,
+		Log:     func(reshard.Move, int) { moved++ },
+	})
+	close(stop)
+	for i := 0; i < 2; i++ {
+		if failure := <-results; failure != "" {
+			t.Error(failure)
+		}
+	}
+	if err != nil {
+		t.Fatalf("Rebalance failed: %v", err)
+	}
+	t.Logf("Moved %d slots during %d operations, %d of them asked for", moved, operations, asks)
+
+	if moved != 300 {
+		t.Errorf("Expected 300 slots to move, got %d", moved)
+	}
+	for i, port := range ports {
+		c := dialTestClient(t, port)
+		if assigned := clusterInfoField(c, "cluster_slots_assigned"); assigned != "16384" {
+			t.Errorf("Node %d sees %s slots assigned", i, assigned)
+		}
+		shards := c.do("CLUSTER", "SHARDS")
+		for _, shard := range shards.Array {
+			slots := shard.Array[1].Array
+			count := int64(0)
+			for j := 0; j < len(slots); j += 2 {
+				count += slots[j+1].Int - slots[j].Int + 1
+			}
+			if count != 5461 && count != 5462 {
+				t.Errorf("Node %d sees a shard of %d slots", i, count)
+			}
+		}
+	}
+}
+
+// clusterMyself returns the fields of a node's own line of CLUSTER NODES
+func clusterMyself(t *testing.T, client *testClient) []string {
+	t.Helper()
+	for _, line := range strings.Split(client.do("CLUSTER", "NODES").Str, "\n") {
+		if fields := strings.Fields(line); len(fields) > 2 && strings.Contains(fields[2], "myself") {
+			return fields
+		}
+	}
+	t.Fatal("No node is myself in CLUSTER NODES")
+	return nil
+}
+
+func TestClusterFailover(t *testing.T) {
+	ports, clients := startTestCluster(t, []string{t.TempDir(), t.TempDir(), t.TempDir()})
+	ids := make([]string, len(clients))
+	for i, c := range clients {
+		ids[i] = c.do("CLUSTER", "MYID").Str
+		if reply := c.do("CONFIG", "SET", "cluster-node-timeout", "1000"); reply.Str != "OK" {
+			t.Fatalf("CONFIG SET failed: %+v", reply)
+		}
+	}
+
+	// The fourth node is stopped and restarted, on the same ports
+	dir := t.TempDir()
+	startNode := func(port, busPort int) (*server.Server, *testClient) {
+		srv := server.NewServer(&server.ServerConfig{
+			Port:               port,
+			MaxClients:         10,
+			ReadTimeout:        5 * time.Second,
+			WriteTimeout:       5 * time.Second,
+			Dir:                dir,
+			ClusterEnabled:     true,
+			ClusterPort:        busPort,
+			ClusterNodeTimeout: time.Second,
+		})
+		if err := srv.Start(); err != nil {
+			t.Fatalf("Failed to start server: %v", err)
+		}
+		return srv, dialTestClient(t, srv.GetListener().Addr().(*net.TCPAddr).Port)
+	}
+	replicaServer, replica := startNode(0, 0)
+	replicaID := replica.do("CLUSTER", "MYID").Str
+	replicaPort, replicaBusPort := replicaServer.GetListener().Addr().(*net.TCPAddr).Port, clusterBusPort(t, replica)
+	replica.do("CLUSTER", "MEET", "127.0.0.1", strconv.Itoa(ports[0]), clusterBusPort(t, clients[0]))
+
+	if reply := clients[2].do("CLUSTER", "REPLICATE", ids[1]); reply.Str != "ERR To set a master the node must be empty and without assigned slots." {
+		t.Errorf("Expected a master serving slots not to become a replica, got %+v", reply)
+	}
+	if reply := clients[2].do("CLUSTER", "FAILOVER"); reply.Str != "ERR You should send CLUSTER FAILOVER to a replica" {
+		t.Errorf("Expected a master to refuse CLUSTER FAILOVER, got %+v", reply)
+	}
+	if !eventually(func() bool { return clusterInfoField(replica, "cluster_known_nodes") == "4" }) {
+		t.Fatal("The fourth node did not join the cluster")
+	}
+	if reply := replica.do("CLUSTER", "REPLICATE", ids[2]); reply.Str != "OK" {
+		t.Fatalf("CLUSTER REPLICATE failed: %+v", reply)
+	}
+	if !eventually(func() bool {
+		return infoField(replica, "replication", "master_link_status") == "up" &&
+			len(clients[0].do("CLUSTER", "REPLICAS", ids[2]).Array) == 1
+	}) {
+		t.Fatalf("The replica did not attach to its master: %q", replica.do("CLUSTER", "NODES").Str)
+	}
+
+	// The replica follows the third node, whose slots include 12182, and
+	// sends its own clients there
+	for i := 0; i < 10; i++ {
+		clients[2].do("SET", fmt.Sprintf("{foo}%d", i), strconv.Itoa(i))
+	}
+	if reply := clients[2].do("WAIT", "1", "5000"); reply.Int != 1 {
+		t.Fatalf("Expected the replica to acknowledge the writes, got %+v", reply)
+	}
+	if reply := replica.do("SET", "{foo}0", "x"); reply.Str != fmt.Sprintf("MOVED 12182 127.0.0.1:%d", ports[2]) {
+		t.Errorf("Expected the replica to redirect writes to its master, got %+v", reply)
+	}
+	if slots := clients[0].do("CLUSTER", "SLOTS"); len(slots.Array[2].Array) != 4 || slots.Array[2].Array[3].Array[2].Str != replicaID {
+		t.Errorf("Expected CLUSTER SLOTS to list the replica, got %+v", slots.Array[2])
+	}
+	if nodes := clients[0].do("CLUSTER", "SHARDS").Array[2].Array[3].Array; len(nodes) != 2 || nodes[1].Array[9].Str != "replica" {
+		t.Errorf("Expected CLUSTER SHARDS to list the replica, got %+v", nodes)
+	}
+
+	// A manual failover swaps the master and its replica without losing a
+	// write
+	if reply := replica.do("CLUSTER", "FAILOVER"); reply.Str != "OK" {
+		t.Fatalf("CLUSTER FAILOVER failed: %+v", reply)
+	}
+	if !eventually(func() bool {
+		return clusterMyself(t, replica)[2] == "myself,master" && clusterMyself(t, clients[2])[3] == replicaID &&
+			infoField(clients[2], "replication", "master_link_status") == "up"
+	}) {
+		t.Fatalf("The manual failover did not complete: %q", replica.do("CLUSTER", "NODES").Str)
+	}
+	if reply := replica.do("GET", "{foo}9"); reply.Str != "9" {
+		t.Errorf("Expected the new master to serve the data, got %+v", reply)
+	}
+	if reply := clients[0].do("GET", "{foo}9"); reply.Str != fmt.Sprintf("MOVED 12182 127.0.0.1:%d", replicaPort) {
+		t.Errorf("Expected clients to be sent to the new master, got %+v", reply)
+	}
+	if reply := replica.do("SET", "{foo}10", "10"); reply.Str != "OK" {
+		t.Errorf("Expected the new master to accept writes, got %+v", reply)
+	}
+	if reply := replica.do("WAIT", "1", "5000"); reply.Int != 1 {
+		t.Errorf("Expected the old master to acknowledge the write, got %+v", reply)
+	}
+
+	// When the new master dies, the masters agree it failed and its replica,
+	// the old master, is elected to take its slots back
+	replicaServer.Stop()
+	if !eventuallyWithin(20*time.Second, func() bool {
+		return clusterMyself(t, clients[2])[2] == "myself,master" && clusterInfoField(clients[0], "cluster_state") == "ok"
+	}) {
+		t.Fatalf("The replica did not take over from its failed master: %q", clients[0].do("CLUSTER", "NODES").Str)
+	}
+	if nodes := clients[0].do("CLUSTER", "NODES").Str; !strings.Contains(nodes, "master,fail") {
+		t.Errorf("Expected the dead master to be flagged as failed, got %q", nodes)
+	}
+	if reply := clients[2].do("GET", "{foo}10"); reply.Str != "10" {
+		t.Errorf("Expected the promoted replica to hold every acknowledged write, got %+v", reply)
+	}
+
+	// Restarted, the old master finds its slots taken and becomes a
+	// replica, and it can take them over again without an election
+	busPort, _ := strconv.Atoi(replicaBusPort)
+	replicaServer, replica = startNode(replicaPort, busPort)
+	t.Cleanup(func() { replicaServer.Stop() })
+	if !eventually(func() bool {
+		return clusterMyself(t, replica)[3] == ids[2] && infoField(replica, "replication", "master_link_status") == "up" &&
+			!strings.Contains(clients[0].do("CLUSTER", "NODES").Str, "fail")
+	}) {
+		t.Fatalf("The restarted master did not become a replica: %q", replica.do("CLUSTER", "NODES").Str)
+	}
+	if reply := replica.do("CLUSTER", "FAILOVER", "TAKEOVER"); reply.Str != "OK" {
+		t.Fatalf("CLUSTER FAILOVER TAKEOVER failed: %+v", reply)
+	}
+	if !eventually(func() bool {
+		return clusterMyself(t, clients[2])[3] == replicaID
+	}) {
+		t.Fatalf("The takeover did not complete: %q", clients[2].do("CLUSTER", "NODES").Str)
+	}
+	if reply := replica.do("GET", "{foo}10"); reply.Str != "10" {
+		t.Errorf("Expected the node taking over to serve the data, got %+v", reply)
+	}
+}
+
+// sentinelField returns a field of a flat list of names and values, as
+// SENTINEL MASTER replies
+func sentinelField(reply *resp2.RESPValue, name string) string {
+	for i := 0; i+1 < len(reply.Array); i += 2 {
+		if reply.Array[i].Str == name {
+			return reply.Array[i+1].Str
+		}
+	}
+	return ""
+}
+
+func TestSentinel(t *testing.T) {
+	config := func(port int) *server.ServerConfig {
+		return &server.ServerConfig{
+			Port:         port,
+			MaxClients:   10,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 5 * time.Second,
+			Dir:          t.TempDir(),
+		}
+	}
+
+	// The master is stopped and restarted, on the same port
+	startMaster := func(port int) (*server.Server, int) {
+		srv := server.NewServer(config(port))
+		if err := srv.Start(); err != nil {
+			t.Fatalf("Failed to start server: %v", err)
+		}
+		return srv, srv.GetListener().Addr().(*net.TCPAddr).Port
+	}
+	masterServer, masterPort := startMaster(0)
+	master := dialTestClient(t, masterPort)
+	replicaPorts := make([]int, 2)
+	for i := range replicaPorts {
+		replicaConfig := config(0)
+		replicaConfig.ReplicaOf = fmt.Sprintf("127.0.0.1 %d", masterPort)
+		replicaPorts[i] = startTestServer(t, replicaConfig)
+	}
+
+	sentinels := make([]*testClient, 3)
+	sentinelPorts := make([]int, len(sentinels))
+	for i := range sentinels {
+		sentinelConfig := config(0)
+		sentinelConfig.Sentinel = true
+		sentinelConfig.SentinelMonitor = []string{fmt.Sprintf("mymaster 127.0.0.1 %d 2", masterPort)}
+		sentinelConfig.SentinelDownAfter = time.Second
+		sentinelConfig.SentinelFailoverTimeout = 3 * time.Second
+		sentinelPorts[i] = startTestServer(t, sentinelConfig)
+		sentinels[i] = dialTestClient(t, sentinelPorts[i])
+	}
+
+	// The sentinels find the replicas through the master and each other
+	// through its hello channel
+	if !eventually(func() bool {
+		for _, s := range sentinels {
+			reply := s.do("SENTINEL", "MASTER", "mymaster")
+			if sentinelField(reply, "num-slaves") != "2" || sentinelField(reply, "num-other-sentinels") != "2" {
+				return false
+			}
+			for _, replica := range s.do("SENTINEL", "REPLICAS", "mymaster").Array {
+				if sentinelField(&replica, "master-link-status") != "ok" {
+					return false
+				}
+			}
+		}
+		return true
+	}) {
+		t.Fatalf("The sentinels did not discover the deployment: %+v", sentinels[0].do("SENTINEL", "MASTER", "mymaster"))
+	}
+	if reply := sentinels[0].do("SENTINEL", "GET-MASTER-ADDR-BY-NAME", "mymaster"); len(reply.Array) != 2 ||
+		reply.Array[0].Str != "127.0.0.1" || reply.Array[1].Str != strconv.Itoa(masterPort) {
+		t.Errorf("Unexpected master address %+v", reply)
+	}
+	if reply := sentinels[0].do("SENTINEL", "GET-MASTER-ADDR-BY-NAME", "unknown"); !reply.Null {
+		t.Errorf("Expected no address for an unknown master, got %+v", reply)
+	}
+	if reply := sentinels[0].do("SENTINEL", "CKQUORUM", "mymaster"); !strings.HasPrefix(reply.Str, "OK 3 usable Sentinels") {
+		t.Errorf("Unexpected CKQUORUM reply %+v", reply)
+	}
+	if reply := sentinels[0].do("SENTINEL", "REPLICAS", "mymaster"); len(reply.Array) != 2 ||
+		sentinelField(&reply.Array[0], "master-port") != strconv.Itoa(masterPort) {
+		t.Errorf("Unexpected replicas %+v", reply)
+	}
+	if reply := sentinels[0].do("ROLE"); len(reply.Array) != 2 || reply.Array[0].Str != "sentinel" || reply.Array[1].Array[0].Str != "mymaster" {
+		t.Errorf("Unexpected sentinel ROLE %+v", reply)
+	}
+	if reply := sentinels[0].do("GET", "key"); reply.Str != "ERR unknown command 'GET'" {
+		t.Errorf("Expected a sentinel to serve no dataset, got %+v", reply)
+	}
+	if status := infoField(sentinels[0], "sentinel", "master0"); !strings.Contains(status, "status=ok") {
+		t.Errorf("Unexpected sentinel INFO %q", status)
+	}
+
+	events := dialTestClient(t, sentinelPorts[1])
+	events.do("SUBSCRIBE", "+switch-master")
+	master.do("SET", "before", "failover")
+	if reply := master.do("WAIT", "2", "5000"); reply.Int != 2 {
+		t.Fatalf("Expected the replicas to acknowledge the write, got %+v", reply)
+	}
+
+	// Once the master is down, the sentinels promote a replica and point
+	// the other one at it
+	masterServer.Stop()
+	newPort := 0
+	if !eventuallyWithin(20*time.Second, func() bool {
+		for _, s := range sentinels {
+			reply := s.do("SENTINEL", "GET-MASTER-ADDR-BY-NAME", "mymaster")
+			if len(reply.Array) != 2 || reply.Array[1].Str == strconv.Itoa(masterPort) {
+				return false
+			}
+			newPort, _ = strconv.Atoi(reply.Array[1].Str)
+		}
+		return true
+	}) {
+		t.Fatalf("The sentinels did not fail the master over: %+v", sentinels[0].do("SENTINEL", "MASTER", "mymaster"))
+	}
+	if newPort != replicaPorts[0] && newPort != replicaPorts[1] {
+		t.Fatalf("Expected a replica to be promoted, got port %d", newPort)
+	}
+	if message := events.read(); len(message.Array) != 3 ||
+		message.Array[2].Str != fmt.Sprintf("mymaster 127.0.0.1 %d 127.0.0.1 %d", masterPort, newPort) {
+		t.Errorf("Unexpected +switch-master event %+v", message)
+	}
+	newMaster := dialTestClient(t, newPort)
+	if reply := newMaster.do("GET", "before"); reply.Str != "failover" {
+		t.Errorf("Expected the promoted replica to keep the data, got %+v", reply)
+	}
+	newMaster.do("SET", "after", "failover")
+	otherPort := replicaPorts[0]
+	if newPort == otherPort {
+		otherPort = replicaPorts[1]
+	}
+	replica := dialTestClient(t, otherPort)
+	if !eventually(func() bool { return replica.do("GET", "after").Str == "failover" }) {
+		t.Errorf("Expected the other replica to follow the new master: %+v", replica.do("ROLE"))
+	}
+
+	// The old master comes back as a replica of the new one
+	masterServer, _ = startMaster(masterPort)
+	t.Cleanup(func() { masterServer.Stop() })
+	master = dialTestClient(t, masterPort)
+	if !eventuallyWithin(20*time.Second, func() bool {
+		role := master.do("ROLE")
+		return len(role.Array) == 5 && role.Array[2].Int == int64(newPort) && role.Array[3].Str == "connected"
+	}) {
+		t.Fatalf("Expected the old master to become a replica, got %+v", master.do("ROLE"))
+	}
+	if reply := master.do("GET", "after"); reply.Str != "failover" {
+		t.Errorf("Expected the old master to sync from the new one, got %+v", reply)
+	}
+}
+
+// freePort returns a port nothing listens on, for servers that must know
+// each other's ports before they start
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestActiveActive(t *testing.T) {
+	ports := []int{freePort(t), freePort(t)}
+	dirs := []string{t.TempDir(), t.TempDir()}
+	start := func(i int) *server.Server {
+		srv := server.NewServer(&server.ServerConfig{
+			Port:              ports[i],
+			MaxClients:        10,
+			ReadTimeout:       5 * time.Second,
+			WriteTimeout:      5 * time.Second,
+			Dir:               dirs[i],
+			ActiveActive:      true,
+			ActiveActivePeers: []string{fmt.Sprintf("127.0.0.1:%d", ports[1-i])},
+		})
+		if err := srv.Start(); err != nil {
+			t.Fatalf("Failed to start server: %v", err)
+		}
+		return srv
+	}
+	a := start(0)
+	t.Cleanup(func() { a.Stop() })
+	b := start(1)
+	clientA, clientB := dialTestClient(t, ports[0]), dialTestClient(t, ports[1])
+	if !eventually(func() bool {
+		return infoField(clientA, "activeactive", "connected_peers") == "1" && infoField(clientB, "activeactive", "connected_peers") == "1"
+	}) {
+		t.Fatalf("The instances did not connect: %s", clientA.do("INFO", "activeactive").Str)
+	}
+
+	// Writes on either side reach the other
+	clientA.do("SET", "from-a", "1")
+	clientB.do("SET", "from-b", "2")
+	clientB.do("SET", "deleted", "3")
+	if !eventually(func() bool { return clientA.do("GET", "deleted").Str == "3" }) {
+		t.Fatal("Expected the write on B to reach A")
+	}
+	clientA.do("DEL", "deleted")
+	if !eventually(func() bool {
+		return clientB.do("GET", "from-a").Str == "1" && clientA.do("GET", "from-b").Str == "2" && clientB.do("GET", "deleted").Null
+	}) {
+		t.Fatalf("Expected the writes to be exchanged: %+v %+v", clientB.do("GET", "from-a"), clientB.do("GET", "deleted"))
+	}
+
+	// Concurrent writes to a key converge to the same value
+	for i := 0; i < 20; i++ {
+		clientA.send("SET", "conflict", fmt.Sprintf("a%d", i))
+		clientB.send("SET", "conflict", fmt.Sprintf("b%d", i))
+	}
+	for i := 0; i < 20; i++ {
+		clientA.read()
+		clientB.read()
+	}
+	if !eventually(func() bool {
+		valueA, valueB := clientA.do("GET", "conflict"), clientB.do("GET", "conflict")
+		return valueA.Str != "" && valueA.Str == valueB.Str
+	}) {
+		t.Errorf("Expected the instances to converge, got %+v and %+v", clientA.do("GET", "conflict"), clientB.do("GET", "conflict"))
+	}
+
+	// An instance that was down catches up on the writes it missed, and the
+	// other on those made meanwhile
+	b.Stop()
+	clientA = dialTestClient(t, ports[0])
+	clientA.do("SET", "while-down", "4")
+	clientA.do("DEL", "from-b")
+	b = start(1)
+	t.Cleanup(func() { b.Stop() })
+	clientB = dialTestClient(t, ports[1])
+	clientB.do("SET", "after-restart", "5")
+	if !eventually(func() bool {
+		return clientB.do("GET", "while-down").Str == "4" && clientB.do("GET", "from-b").Null &&
+			clientA.do("GET", "after-restart").Str == "5"
+	}) {
+		t.Errorf("Expected the restarted instance to catch up: %s", clientB.do("INFO", "activeactive").Str)
+	}
+	if reply := clientB.do("GET", "from-a"); reply.Str != "1" {
+		t.Errorf("Expected the restarted instance to keep its data, got %+v", reply)
+	}
+
+	// Once both instances reported clocks covering the deletions, their
+	// tombstones are dropped and only the live keys remain
+	if !eventually(func() bool {
+		return infoField(clientA, "activeactive", "active_active_keys") == "4" && infoField(clientB, "activeactive", "active_active_keys") == "4"
+	}) {
+		t.Errorf("Expected the tombstones to be dropped: %s %s", clientA.do("INFO", "activeactive").Str, clientB.do("INFO", "activeactive").Str)
+	}
+	if known := infoField(clientB, "activeactive", "active_active_known_peers"); known != "1" {
+		t.Errorf("Expected 1 known peer, got %s", known)
+	}
+	if reply := clientB.do("REPLICAOF", "127.0.0.1", strconv.Itoa(ports[0])); reply.Type != resp2.Error {
+		t.Errorf("Expected REPLICAOF to be refused, got %+v", reply)
+	}
+}
+
+func TestRaft(t *testing.T) {
+	ports := []int{freePort(t), freePort(t), freePort(t), freePort(t)}
+	dirs := []string{t.TempDir(), t.TempDir(), t.TempDir(), t.TempDir()}
+	servers := make([]*server.Server, len(ports))
+	start := func(i int, join string) {
+		servers[i] = server.NewServer(&server.ServerConfig{
+			Port:         ports[i],
+			MaxClients:   20,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 5 * time.Second,
+			Dir:          dirs[i],
+			Raft:         true,
+			RaftJoin:     join,
+		})
+		if err := servers[i].Start(); err != nil {
+			t.Fatalf("Failed to start server: %v", err)
+		}
+	}
+	t.Cleanup(func() {
+		for _, srv := range servers {
+			if srv != nil {
+				srv.Stop()
+			}
+		}
+	})
+	addr := func(i int) string { return fmt.Sprintf("127.0.0.1:%d", ports[i]) }
+	index := func(client *testClient, field string) int {
+		value, _ := strconv.Atoi(infoField(client, "raft", field))
+		return value
+	}
+
+	// The first instance starts the group and the others join it
+	start(0, "")
+	start(1, addr(0))
+	start(2, addr(1))
+	clients := []*testClient{dialTestClient(t, ports[0]), dialTestClient(t, ports[1]), dialTestClient(t, ports[2])}
+	if !eventuallyWithin(10*time.Second, func() bool { return infoField(clients[0], "raft", "raft_members") == "3" }) {
+		t.Fatalf("The instances did not join: %s", clients[0].do("INFO", "raft").Str)
+	}
+	if role := infoField(clients[0], "raft", "raft_role"); role != "leader" {
+		t.Fatalf("Expected the first instance to lead, got %s", role)
+	}
+
+	// Writes are acknowledged by the leader once committed, and followers
+	// redirect their clients to it
+	if reply := clients[0].do("SET", "balance", "100"); reply.Str != "OK" {
+		t.Fatalf("Expected SET to succeed, got %+v", reply)
+	}
+	if reply := clients[0].do("GET", "balance"); reply.Str != "100" {
+		t.Errorf("Expected the write to be read back, got %+v", reply)
+	}
+	if reply := clients[1].do("GET", "balance"); reply.Type != resp2.Error || reply.Str != "NOTLEADER "+addr(0) {
+		t.Errorf("Expected a redirect to the leader, got %+v", reply)
+	}
+	if reply := clients[2].do("REPLICAOF", "127.0.0.1", strconv.Itoa(ports[0])); reply.Type != resp2.Error {
+		t.Errorf("Expected REPLICAOF to be refused, got %+v", reply)
+	}
+
+	// Enough writes compact the log into a snapshot, which a late member
+	// is sent instead of the entries it covers
+	for i := 0; i < 1100; i++ {
+		clients[0].send("SET", fmt.Sprintf("key:%d", i), strconv.Itoa(i))
+	}
+	for i := 0; i < 1100; i++ {
+		if reply := clients[0].read(); reply.Str != "OK" {
+			t.Fatalf("Expected SET to succeed, got %+v", reply)
+		}
+	}
+	if !eventually(func() bool { return index(clients[0], "raft_snapshot_index") > 0 }) {
+		t.Fatalf("Expected the log to be compacted: %s", clients[0].do("INFO", "raft").Str)
+	}
+	start(3, addr(2))
+	clients = append(clients, dialTestClient(t, ports[3]))
+	commit := index(clients[0], "raft_commit_index")
+	if !eventuallyWithin(10*time.Second, func() bool {
+		return index(clients[3], "raft_applied_index") >= commit && infoField(clients[0], "raft", "raft_members") == "4"
+	}) {
+		t.Fatalf("The late member did not catch up: %s", clients[3].do("INFO", "raft").Str)
+	}
+
+	// When the leader fails the others elect a new one, which has every
+	// acknowledged write
+	servers[0].Stop()
+	servers[0] = nil
+	// Clients left idle past the read timeout are dropped
+	for i := 1; i < len(clients); i++ {
+		clients[i] = dialTestClient(t, ports[i])
+	}
+	leader := -1
+	if !eventuallyWithin(10*time.Second, func() bool {
+		for i := 1; i < len(clients); i++ {
+			if infoField(clients[i], "raft", "raft_role") == "leader" {
+				leader = i
+				return true
+			}
+		}
+		return false
+	}) {
+		t.Fatal("No new leader was elected")
+	}
+	if reply := clients[leader].do("GET", "balance"); reply.Str != "100" {
+		t.Errorf("Expected the new leader to have the write, got %+v", reply)
+	}
+	if reply := clients[leader].do("GET", "key:1099"); reply.Str != "1099" {
+		t.Errorf("Expected the new leader to have the last write, got %+v", reply)
+	}
+	if reply := clients[leader].do("SET", "balance", "50"); reply.Str != "OK" {
+		t.Errorf("Expected the new leader to accept writes, got %+v", reply)
+	}
+
+	// The old leader comes back as a follower and catches up from its log
+	start(0, "")
+	clients[0] = dialTestClient(t, ports[0])
+	commit = index(clients[leader], "raft_commit_index")
+	if !eventuallyWithin(10*time.Second, func() bool {
+		return infoField(clients[0], "raft", "raft_role") == "follower" && index(clients[0], "raft_applied_index") >= commit
+	}) {
+		t.Errorf("The old leader did not catch up: %s", clients[0].do("INFO", "raft").Str)
+	}
+	if reply := clients[0].do("SET", "balance", "0"); reply.Str != "NOTLEADER "+addr(leader) {
+		t.Errorf("Expected a redirect to the new leader, got %+v", reply)
+	}
+
+	// A member can be removed
+	clients[leader], clients[3] = dialTestClient(t, ports[leader]), dialTestClient(t, ports[3])
+	if reply := clients[leader].do("RAFT.REMOVE", infoField(clients[3], "raft", "raft_id")); reply.Str != "OK" {
+		t.Errorf("Expected RAFT.REMOVE to succeed, got %+v", reply)
+	}
+	if members := infoField(clients[leader], "raft", "raft_members"); members != "3" {
+		t.Errorf("Expected 3 members, got %s", members)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	var servers []*server.Server
+	var backends []string
+	for i := 0; i < 3; i++ {
+		srv := server.NewServer(&server.ServerConfig{
+			Port:         0,
+			MaxClients:   10,
+			ReadTimeout:  30 * time.Second,
+			WriteTimeout: 5 * time.Second,
+			Dir:          t.TempDir(),
+		})
+		if err := srv.Start(); err != nil {
+			t.Fatalf("Failed to start server: %v", err)
+		}
+		servers = append(servers, srv)
+		backends = append(backends, fmt.Sprintf("127.0.0.1:%d", srv.GetListener().Addr().(*net.TCPAddr).Port))
+	}
+	stopped := make([]bool, len(servers))
+	t.Cleanup(func() {
+		for i, srv := range servers {
+			if !stopped[i] {
+				srv.Stop()
+			}
+		}
+	})
+	p, err := proxy.New(proxy.Config{
+		Backends:       backends,
+		EjectAfter:     1,
+		Timeout:        time.Second,
+		HealthInterval: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(listener)
+	t.Cleanup(func() { p.Close() })
+	c := dialTestClient(t, listener.Addr().(*net.TCPAddr).Port)
+
+	// A pipeline of writes is spread over the backends and answered in order
+	const keys = 300
+	for i := 0; i < keys; i++ {
+		c.send("SET", "key:"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	for i := 0; i < keys; i++ {
+		if reply := c.read(); reply.Str != "OK" {
+			t.Fatalf("Expected SET %d to succeed, got %+v", i, reply)
+		}
+	}
+	held := make([]int, len(servers))
+	holders := make(map[string]int)
+	for i, addr := range backends {
+		backend, err := client.Dial(addr, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k := 0; k < keys; k++ {
+			if reply, err := backend.Do("EXISTS", "key:"+strconv.Itoa(k)); err == nil && reply.Int == 1 {
+				held[i]++
+				holders["key:"+strconv.Itoa(k)] = i
+			}
+		}
+		backend.Close()
+	}
+	if held[0]+held[1]+held[2] != keys || held[0] == 0 || held[1] == 0 || held[2] == 0 {
+		t.Errorf("Expected the keys spread over every backend, got %v", held)
+	}
+
+	// Multi-key commands are split between the backends and merged
+	args := []string{"MGET"}
+	for i := 0; i < keys; i++ {
+		args = append(args, "key:"+strconv.Itoa(i))
+	}
+	reply := c.do(args...)
+	if len(reply.Array) != keys || reply.Array[0].Str != "0" || reply.Array[keys-1].Str != strconv.Itoa(keys-1) {
+		t.Fatalf("Expected MGET to return every value in order, got %d values", len(reply.Array))
+	}
+	args[0] = "EXISTS"
+	if reply := c.do(append(args, "missing")...); reply.Int != keys {
+		t.Errorf("Expected EXISTS to count %d keys, got %+v", keys, reply)
+	}
+	if reply := c.do("DEL", "key:0", "key:1", "key:2", "missing"); reply.Int != 3 {
+		t.Errorf("Expected DEL to delete 3 keys, got %+v", reply)
+	}
+	if reply := c.do("SET", "{user}.name", "ada"); reply.Str != "OK" {
+		t.Errorf("Expected SET to succeed, got %+v", reply)
+	}
+	if reply := c.do("DUMP", "{user}.name"); reply.Type != resp2.BulkString {
+		t.Errorf("Expected DUMP to be routed, got %+v", reply)
+	}
+
+	// A backend that stops is ejected and the others take its keys
+	servers[1].Stop()
+	stopped[1] = true
+	if !eventually(func() bool { return p.Backends()[backends[1]] }) {
+		t.Fatal("The stopped backend was not ejected")
+	}
+	for i := 0; i < keys; i++ {
+		c.send("SET", "after:"+strconv.Itoa(i), "1")
+	}
+	for i := 0; i < keys; i++ {
+		if reply := c.read(); reply.Str != "OK" {
+			t.Fatalf("Expected SET to succeed with a backend ejected, got %+v", reply)
+		}
+	}
+	for k := 3; k < keys; k++ {
+		if key := "key:" + strconv.Itoa(k); holders[key] != 1 {
+			if reply := c.do("GET", key); reply.Str != strconv.Itoa(k) {
+				t.Fatalf("Expected %s to be kept on its backend, got %+v", key, reply)
+			}
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	newConfig := func(port int) *server.ServerConfig {
+		return &server.ServerConfig{
+			Port:         port,
+			MaxClients:   10,
+			ReadTimeout:  30 * time.Second,
+			WriteTimeout: 5 * time.Second,
+			Dir:          t.TempDir(),
+		}
+	}
+	source := dialTestClient(t, startTestServer(t, newConfig(0)))
+	targetPort := freePort(t)
+	target := server.NewServer(newConfig(targetPort))
+	if err := target.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	targetClient := dialTestClient(t, targetPort)
+	port := strconv.Itoa(targetPort)
+
+	// A key moves and the connection is kept for the next MIGRATE
+	source.do("SET", "moved", "1")
+	if reply := source.do("MIGRATE", "127.0.0.1", port, "moved", "0", "5000"); reply.Str != "OK" {
+		t.Fatalf("MIGRATE failed: %+v", reply)
+	}
+	if !source.do("GET", "moved").Null || targetClient.do("GET", "moved").Str != "1" {
+		t.Error("Expected the key to move to the target")
+	}
+	if cached := infoField(source, "stats", "migrate_cached_sockets"); cached != "1" {
+		t.Errorf("Expected 1 cached connection, got %s", cached)
+	}
+
+	// COPY keeps the keys, and a key already on the target needs REPLACE
+	source.do("SET", "a", "1")
+	source.do("SET", "b", "2")
+	targetClient.do("SET", "b", "old")
+	reply := source.do("MIGRATE", "127.0.0.1", port, "", "0", "5000", "COPY", "KEYS", "a", "b")
+	if reply.Type != resp2.Error || !strings.Contains(reply.Str, "BUSYKEY") {
+		t.Errorf("Expected a BUSYKEY error, got %+v", reply)
+	}
+	if targetClient.do("GET", "a").Str != "1" || targetClient.do("GET", "b").Str != "old" {
+		t.Error("Expected the other keys to be migrated despite the error")
+	}
+	if source.do("GET", "a").Str != "1" || source.do("GET", "b").Str != "2" {
+		t.Error("Expected COPY to keep the keys")
+	}
+	if reply := source.do("MIGRATE", "127.0.0.1", port, "", "0", "5000", "REPLACE", "KEYS", "a", "b"); reply.Str != "OK" {
+		t.Fatalf("MIGRATE REPLACE failed: %+v", reply)
+	}
+	if targetClient.do("GET", "b").Str != "2" || source.do("EXISTS", "a", "b").Int != 0 {
+		t.Error("Expected REPLACE to overwrite the key on the target")
+	}
+
+	// The target does not know AUTH, so the keys stay
+	source.do("SET", "secret", "1")
+	reply = source.do("MIGRATE", "127.0.0.1", port, "secret", "0", "5000", "AUTH2", "user", "pass")
+	if reply.Type != resp2.Error || !strings.HasPrefix(reply.Str, "ERR Target instance replied with error") {
+		t.Errorf("Expected the target to refuse AUTH, got %+v", reply)
+	}
+	if source.do("GET", "secret").Str != "1" {
+		t.Error("Expected a key whose migration failed to be kept")
+	}
+	if reply := source.do("MIGRATE", "127.0.0.1", port, "secret", "0", "5000", "AUTH"); reply.Str != "ERR syntax error" {
+		t.Errorf("Expected a syntax error for AUTH without a password, got %+v", reply)
+	}
+
+	// A cached connection the target closed is replaced
+	target.Stop()
+	target = server.NewServer(newConfig(targetPort))
+	if err := target.Start(); err != nil {
+		t.Fatalf("Failed to restart server: %v", err)
+	}
+	t.Cleanup(func() { target.Stop() })
+	if reply := source.do("MIGRATE", "127.0.0.1", port, "secret", "0", "5000"); reply.Str != "OK" {
+		t.Fatalf("Expected MIGRATE to reconnect to a restarted target, got %+v", reply)
+	}
+	if reply := dialTestClient(t, targetPort).do("GET", "secret"); reply.Str != "1" {
+		t.Errorf("Expected the key on the restarted target, got %+v", reply)
+	}
+
+	// Writes are refused as for any other write command
+	source.do("SET", "refused", "1")
+	source.do("CONFIG", "SET", "min-replicas-to-write", "1")
+	if reply := source.do("MIGRATE", "127.0.0.1", port, "refused", "0", "5000", "COPY"); !strings.HasPrefix(reply.Str, "NOREPLICAS") {
+		t.Errorf("Expected MIGRATE to be refused without replicas, got %+v", reply)
+	}
+	source.do("CONFIG", "SET", "min-replicas-to-write", "0")
+	if source.do("GET", "refused").Str != "1" || !dialTestClient(t, targetPort).do("GET", "refused").Null {
+		t.Error("Expected a refused MIGRATE to leave both sides unchanged")
+	}
+
+	// Without a target the key stays
+	source.do("SET", "stays", "1")
+	reply = source.do("MIGRATE", "127.0.0.1", strconv.Itoa(freePort(t)), "stays", "0", "1000")
+	if reply.Type != resp2.Error || !strings.HasPrefix(reply.Str, "IOERR") || source.do("GET", "stays").Str != "1" {
+		t.Errorf("Expected an IOERR keeping the key, got %+v", reply)
+	}
+}
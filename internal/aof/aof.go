@@ -0,0 +1,466 @@
+// Package aof implements the append-only file used to log write commands
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"redis-like-server/internal/crypt"
+	"redis-like-server/internal/resp2"
+)
+
+// FsyncPolicy controls how often the append-only file is flushed to disk
+type FsyncPolicy int32
+
+const (
+	// FsyncAlways fsyncs after every write command, before the client is answered
+	FsyncAlways FsyncPolicy = iota
+	// FsyncEverySec fsyncs once per second in the background
+	FsyncEverySec
+	// FsyncNo leaves flushing to the operating system
+	FsyncNo
+)
+
+// ParseFsyncPolicy parses an appendfsync setting
+func ParseFsyncPolicy(value string) (FsyncPolicy, error) {
+	switch value {
+	case "always":
+		return FsyncAlways, nil
+	case "everysec":
+		return FsyncEverySec, nil
+	case "no":
+		return FsyncNo, nil
+	default:
+		return 0, fmt.Errorf("invalid appendfsync policy %q: expected always, everysec or no", value)
+	}
+}
+
+// String returns the appendfsync setting name of the policy
+func (p FsyncPolicy) String() string {
+	switch p {
+	case FsyncAlways:
+		return "always"
+	case FsyncEverySec:
+		return "everysec"
+	default:
+		return "no"
+	}
+}
+
+// AppendOnlyFile appends write commands to a file in RESP format
+type AppendOnlyFile struct {
+	file       *os.File
+	parser     resp2.RESP2Parser
+	policy     atomic.Int32
+	timestamps atomic.Bool
+	mutex      sync.Mutex
+	size       int64
+	// lastTimestamp is the second of the last timestamp annotation written
+	lastTimestamp int64
+	// sealer encrypts appended commands, one chunk per command, when the
+	// file is encrypted
+	sealer   *crypt.Sealer
+	unsynced bool
+	// pending holds the commands whose write failed, unencrypted; they are
+	// written ahead of the next command, or retried once per second
+	pending      []byte
+	lastWriteErr error
+	lastFsyncErr error
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+// Open opens (creating if needed) an append-only file for appending and
+// starts the background fsync loop
+func Open(path string, policy FsyncPolicy) (*AppendOnlyFile, error) {
+	return open(path, policy, nil)
+}
+
+// open is Open encrypting appended commands with key, unless key is nil. An
+// existing file must already be encrypted with that same key, or not be
+// encrypted at all when key is nil.
+func open(path string, policy FsyncPolicy, key *crypt.Key) (*AppendOnlyFile, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open append only file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat append only file: %w", err)
+	}
+
+	a := &AppendOnlyFile{
+		file:   file,
+		parser: resp2.NewRESP2Parser(),
+		size:   info.Size(),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if err := a.initEncryption(key); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open append only file %s: %w", filepath.Base(path), err)
+	}
+	a.policy.Store(int32(policy))
+	go a.fsyncLoop()
+	return a, nil
+}
+
+// initEncryption writes the encryption header of a new file or resumes the
+// chunk chain of an existing one
+func (a *AppendOnlyFile) initEncryption(key *crypt.Key) error {
+	if key == nil {
+		prefix := make([]byte, crypt.HeaderSize)
+		n, _ := a.file.ReadAt(prefix, 0)
+		if crypt.IsEncrypted(prefix[:n]) {
+			return crypt.ErrNoKey
+		}
+		return nil
+	}
+	if a.size > 0 {
+		sealer, err := crypt.ResumeSealer(a.file, a.size, key)
+		a.sealer = sealer
+		return err
+	}
+
+	header, sealer, err := crypt.NewSealer(key)
+	if err != nil {
+		return err
+	}
+	if _, err := a.file.Write(header); err != nil {
+		a.file.Truncate(0)
+		return err
+	}
+	a.size = int64(len(header))
+	a.sealer = sealer
+	return nil
+}
+
+// SetPolicy changes the fsync policy
+func (a *AppendOnlyFile) SetPolicy(policy FsyncPolicy) {
+	a.policy.Store(int32(policy))
+}
+
+// Policy returns the current fsync policy
+func (a *AppendOnlyFile) Policy() FsyncPolicy {
+	return FsyncPolicy(a.policy.Load())
+}
+
+// SetTimestamps turns timestamp annotations on or off. When on, a
+// "#TS:<unix seconds>" line precedes the first command logged in each
+// second, which is what point-in-time recovery uses to find where to stop.
+func (a *AppendOnlyFile) SetTimestamps(enabled bool) {
+	a.timestamps.Store(enabled)
+}
+
+// Append logs a command. With the always policy the data is on disk when
+// Append returns. A failed write is truncated away so the file never ends
+// with a partial command written by this process, and the command is kept
+// to be written again: LastError reports the failure until it is.
+func (a *AppendOnlyFile) Append(cmd *resp2.Command) error {
+	data := a.parser.Serialize(resp2.NewCommandValue(cmd.Name, cmd.Args))
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var timestamp int64
+	if a.timestamps.Load() {
+		if now := time.Now().Unix(); now != a.lastTimestamp {
+			timestamp = now
+			data = append(timestampAnnotation(now), data...)
+		}
+	}
+
+	if err := a.write(append(a.pending, data...)); err != nil {
+		return fmt.Errorf("failed to write to append only file: %w", err)
+	}
+	if timestamp != 0 {
+		a.lastTimestamp = timestamp
+	}
+
+	if a.Policy() == FsyncAlways {
+		if err := a.file.Sync(); err != nil {
+			a.lastFsyncErr = err
+			return fmt.Errorf("failed to fsync append only file: %w", err)
+		}
+		a.lastFsyncErr = nil
+		return nil
+	}
+	a.unsynced = true
+	return nil
+}
+
+// write writes data, the pending commands first, keeping it pending when
+// the write fails; the caller must hold the mutex
+func (a *AppendOnlyFile) write(data []byte) error {
+	sealed := data
+	if a.sealer != nil {
+		sealed = a.sealer.Seal(data)
+	}
+	n, err := a.file.Write(sealed)
+	if err != nil {
+		if n > 0 {
+			a.file.Truncate(a.size)
+		}
+		a.pending = data
+		a.lastWriteErr = err
+		return err
+	}
+	a.size += int64(n)
+	a.pending = nil
+	a.lastWriteErr = nil
+	if a.sealer != nil {
+		a.sealer.Commit(sealed)
+	}
+	return nil
+}
+
+// movePending hands the commands whose write failed over to the file
+// replacing this one
+func (a *AppendOnlyFile) movePending(to *AppendOnlyFile) {
+	a.mutex.Lock()
+	pending, err := a.pending, a.lastWriteErr
+	a.pending = nil
+	a.mutex.Unlock()
+	if pending == nil {
+		return
+	}
+	to.mutex.Lock()
+	to.pending, to.lastWriteErr = pending, err
+	to.mutex.Unlock()
+}
+
+// fsyncLoop fsyncs pending writes once per second under the everysec
+// policy, and retries the writes and fsyncs that failed under any policy
+func (a *AppendOnlyFile) fsyncLoop() {
+	defer close(a.done)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+		}
+		a.mutex.Lock()
+		if a.pending != nil {
+			if err := a.write(a.pending); err != nil {
+				a.mutex.Unlock()
+				continue
+			}
+			fmt.Println("Append only file writes recovered")
+			a.unsynced = true
+		}
+		sync := a.lastFsyncErr != nil || (a.unsynced && a.Policy() != FsyncNo)
+		if sync {
+			a.unsynced = false
+		}
+		file := a.file
+		a.mutex.Unlock()
+		if !sync {
+			continue
+		}
+
+		// Sync outside the lock so appends are not blocked by a slow disk
+		err := file.Sync()
+		a.mutex.Lock()
+		a.lastFsyncErr = err
+		if err != nil {
+			a.unsynced = true
+		}
+		a.mutex.Unlock()
+		if err != nil {
+			fmt.Printf("Error fsyncing append only file: %v\n", err)
+		}
+	}
+}
+
+// Size returns the current file size in bytes
+func (a *AppendOnlyFile) Size() int64 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.size
+}
+
+// LastError returns the most recent write or fsync error, or nil if the
+// last operations succeeded
+func (a *AppendOnlyFile) LastError() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.lastWriteErr != nil {
+		return a.lastWriteErr
+	}
+	return a.lastFsyncErr
+}
+
+// Close stops the fsync loop, fsyncs and closes the file
+func (a *AppendOnlyFile) Close() error {
+	close(a.stop)
+	<-a.done
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.file.Sync()
+	return a.file.Close()
+}
+
+// LoadResult describes the outcome of replaying an append-only file
+type LoadResult struct {
+	Commands int
+	// Truncated is set when an incomplete final command was discarded
+	Truncated bool
+	// ValidSize is the length of the file prefix holding complete commands.
+	// For a multi-part file it is the total over the command logs replayed,
+	// the offset recovery targets are measured in.
+	ValidSize int64
+	// Reached is set when replay stopped at a recovery target, leaving the
+	// rest of the log unapplied
+	Reached bool
+	// Timestamp is the last timestamp annotation replayed, in Unix seconds,
+	// or 0 if there was none
+	Timestamp int64
+}
+
+// ErrTruncated is returned when the file ends with an incomplete command and
+// truncated files are not accepted
+var ErrTruncated = errors.New("append only file ends with an incomplete command")
+
+// Load replays every command in the file through apply. A file whose last
+// command is incomplete, as left behind by a crash mid-write, is accepted
+// when allowTruncated is set: the partial command is cut off the file and
+// the result reports the truncation. Any other malformed data is an error.
+func Load(path string, apply func(*resp2.Command) error, allowTruncated bool) (LoadResult, error) {
+	return loadFile(path, apply, allowTruncated, true, &replayState{}, nil)
+}
+
+// loadFile is Load with a recovery state, decrypting the file with keyring
+// if it is encrypted. Without repair a tolerated incomplete command is
+// skipped but left in the file. Offsets in the result count plaintext.
+func loadFile(path string, apply func(*resp2.Command) error, allowTruncated, repair bool, state *replayState, keyring *crypt.Keyring) (LoadResult, error) {
+	flags := os.O_RDONLY
+	if repair {
+		flags = os.O_RDWR
+	}
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return LoadResult{}, err
+	}
+	defer file.Close()
+
+	source, decrypted, err := crypt.Plaintext(file, keyring)
+	if err != nil {
+		return LoadResult{}, err
+	}
+	result, err := replay(source, apply, state)
+	if errors.Is(err, ErrTruncated) && allowTruncated {
+		validSize, ok := fileValidSize(result, decrypted)
+		if !ok {
+			return result, fmt.Errorf("%w inside an encrypted chunk", ErrTruncated)
+		}
+		if repair {
+			if err := file.Truncate(validSize); err != nil {
+				return result, fmt.Errorf("failed to truncate append only file: %w", err)
+			}
+		}
+		result.Truncated = true
+		return result, nil
+	}
+	return result, err
+}
+
+// fileValidSize maps the valid plaintext of a replay back to a length of
+// the file, which for an encrypted file must fall on a chunk boundary
+func fileValidSize(result LoadResult, decrypted *crypt.Reader) (int64, bool) {
+	if decrypted == nil {
+		return result.ValidSize, true
+	}
+	return decrypted.ValidSize(), result.ValidSize == decrypted.PlainSize()
+}
+
+// Replay decodes commands from r and passes them to apply, stopping at the
+// first error. Annotation lines starting with '#' are skipped. The result's
+// ValidSize always reports how many bytes held complete commands.
+func Replay(r io.Reader, apply func(*resp2.Command) error) (LoadResult, error) {
+	return replay(r, apply, &replayState{})
+}
+
+// replay is Replay stopping early once state's recovery target is reached
+func replay(r io.Reader, apply func(*resp2.Command) error, state *replayState) (LoadResult, error) {
+	counter := &countingReader{r: r}
+	reader := bufio.NewReader(counter)
+	parser := resp2.NewRESP2Parser()
+
+	var result LoadResult
+	for {
+		// A clean end of file can only happen between commands
+		next, err := reader.Peek(1)
+		if err == io.EOF {
+			return result, nil
+		}
+
+		if err == nil && next[0] == '#' {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					return result, ErrTruncated
+				}
+				return result, fmt.Errorf("bad file format at offset %d: %w", result.ValidSize, err)
+			}
+			end := counter.n - int64(reader.Buffered())
+			timestamp, ok := parseTimestampAnnotation(line)
+			if state.pastOffset(end) || (ok && state.pastTime(timestamp)) {
+				result.Reached = true
+				return result, nil
+			}
+			if ok {
+				result.Timestamp = timestamp
+			}
+			result.ValidSize = end
+			continue
+		}
+
+		value, err := parser.Parse(reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return result, ErrTruncated
+			}
+			return result, fmt.Errorf("bad file format at offset %d: %w", result.ValidSize, err)
+		}
+		cmd, err := parser.ParseCommand(value)
+		if err != nil {
+			return result, fmt.Errorf("bad file format at offset %d: %w", result.ValidSize, err)
+		}
+		end := counter.n - int64(reader.Buffered())
+		if state.pastOffset(end) {
+			result.Reached = true
+			return result, nil
+		}
+		if err := apply(cmd); err != nil {
+			return result, fmt.Errorf("failed to replay command at offset %d: %w", result.ValidSize, err)
+		}
+
+		result.Commands++
+		result.ValidSize = end
+	}
+}
+
+// countingReader counts the bytes read from the underlying reader
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
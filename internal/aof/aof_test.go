@@ -0,0 +1,605 @@
+package aof
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"redis-like-server/internal/crypt"
+	"redis-like-server/internal/resp2"
+
+	"github.com/leanovate/gopter"
+	"github.com/leanovate/gopter/gen"
+	"github.com/leanovate/gopter/prop"
+)
+
+// writeCommands appends one SET command per key and returns the file path
+func writeCommands(t *testing.T, keys []string) string {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	file, err := Open(path, FsyncAlways)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for _, key := range keys {
+		if err := file.Append(&resp2.Command{Name: "SET", Args: []string{key, "value:" + key}}); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	file.Close()
+	return path
+}
+
+// Property-based test setup for AOF round trips
+func TestAOFRoundTrip(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	// For any sequence of commands, replaying the file should yield exactly
+	// the commands that were appended, in order
+	properties.Property("append then load returns the same commands", prop.ForAll(
+		func(keys []string) bool {
+			path := writeCommands(t, keys)
+
+			var replayed []string
+			result, err := Load(path, func(cmd *resp2.Command) error {
+				replayed = append(replayed, cmd.Args[0])
+				return nil
+			}, false)
+			if err != nil || result.Truncated || result.Commands != len(keys) {
+				return false
+			}
+			for i := range keys {
+				if replayed[i] != keys[i] {
+					return false
+				}
+			}
+			return true
+		},
+		gen.SliceOf(gen.AnyString()),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
+
+func TestAOFWriteErrorRetried(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	a, err := Open(path, FsyncEverySec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if err := a.Append(&resp2.Command{Name: "SET", Args: []string{"a", "1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed append is reported and kept
+	a.mutex.Lock()
+	a.file.Close()
+	a.mutex.Unlock()
+	if err := a.Append(&resp2.Command{Name: "SET", Args: []string{"b", "2"}}); err == nil || a.LastError() == nil {
+		t.Fatalf("Expected the append to fail, got %v", err)
+	}
+
+	// Once the file can be written again, the retry clears the error
+	a.mutex.Lock()
+	a.file, _ = os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	a.mutex.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for a.LastError() != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the write to be retried, got %v", a.LastError())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err := a.Append(&resp2.Command{Name: "SET", Args: []string{"c", "3"}}); err != nil {
+		t.Fatal(err)
+	}
+	var replayed []string
+	if _, err := Load(path, func(cmd *resp2.Command) error {
+		replayed = append(replayed, cmd.Args[0])
+		return nil
+	}, false); err != nil || strings.Join(replayed, "") != "abc" {
+		t.Errorf("Expected every command in order, got %v, %v", replayed, err)
+	}
+}
+
+// Property-based test setup for truncated AOF handling
+func TestAOFLoadTruncated(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	// For any cut inside the final command, loading should keep every complete
+	// command, trim the file when allowed and refuse it otherwise
+	properties.Property("truncated final command is tolerated only when allowed", prop.ForAll(
+		func(keys []string, cut int64) bool {
+			path := writeCommands(t, keys)
+			info, _ := os.Stat(path)
+			last := keys[len(keys)-1]
+			lastSize := int64(len(resp2.NewRESP2Parser().Serialize(resp2.NewCommandValue("SET", []string{last, "value:" + last}))))
+			validSize := info.Size() - lastSize
+			// Keep between 1 and lastSize-1 bytes of the final command
+			os.Truncate(path, validSize+1+cut%(lastSize-1))
+
+			noop := func(*resp2.Command) error { return nil }
+			if _, err := Load(path, noop, false); !errors.Is(err, ErrTruncated) {
+				return false
+			}
+
+			result, err := Load(path, noop, true)
+			if err != nil || !result.Truncated || result.Commands != len(keys)-1 {
+				return false
+			}
+			info, _ = os.Stat(path)
+			return info.Size() == validSize
+		},
+		gen.SliceOfN(3, gen.AlphaString()),
+		gen.Int64Range(0, 1000),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
+
+func TestAOFLoadRejectsCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	os.WriteFile(path, []byte("*2\r\n$3\r\nDEL\r\n$1\r\nk\r\ngarbage\r\n"), 0644)
+
+	result, err := Load(path, func(*resp2.Command) error { return nil }, true)
+	if err == nil || errors.Is(err, ErrTruncated) {
+		t.Fatalf("Expected a format error, got %v", err)
+	}
+	if result.Commands != 1 || result.ValidSize != 20 {
+		t.Errorf("Expected 1 valid command in 20 bytes, got %+v", result)
+	}
+}
+
+// Property-based test setup for manifest encoding
+func TestManifestRoundTrip(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	// For any set of incremental sequence numbers, encoding and parsing the
+	// manifest should give back the same files with incrs ordered by seq
+	properties.Property("parse inverts String", prop.ForAll(
+		func(seqs []int64) bool {
+			manifest := &Manifest{Base: &FileInfo{Name: "appendonly.aof.1.base.rdb", Seq: 1, Type: FileBase}}
+			for i := len(seqs) - 1; i >= 0; i-- {
+				name := "appendonly.aof." + strconv.FormatInt(seqs[i], 10) + ".incr.aof"
+				manifest.Incrs = append(manifest.Incrs, FileInfo{Name: name, Seq: seqs[i], Type: FileIncr})
+			}
+
+			parsed, err := ParseManifest(manifest.String())
+			if err != nil || parsed.Base == nil || *parsed.Base != *manifest.Base || len(parsed.Incrs) != len(seqs) {
+				return false
+			}
+			for i := 1; i < len(parsed.Incrs); i++ {
+				if parsed.Incrs[i-1].Seq > parsed.Incrs[i].Seq {
+					return false
+				}
+			}
+			return true
+		},
+		gen.SliceOf(gen.Int64Range(1, 1000)),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
+
+// TestParseManifestRejectsInvalid tests that malformed manifests are refused
+func TestParseManifestRejectsInvalid(t *testing.T) {
+	for _, data := range []string{
+		"file a seq 1 type b\nfile b seq 2 type b\n",
+		"file a seq x type i\n",
+		"file a seq 1 type z\n",
+		"file ../a seq 1 type i\n",
+		"file a seq 1 type\n",
+	} {
+		if _, err := ParseManifest(data); err == nil {
+			t.Errorf("Expected %q to be rejected", data)
+		}
+	}
+}
+
+// replayKeys loads a multi-part file and returns the final value of each key
+func replayKeys(t *testing.T, m *MultiPartAOF) map[string]string {
+	data := make(map[string]string)
+	_, err := m.Load(func(string) error {
+		return errors.New("unexpected RDB base")
+	}, func(cmd *resp2.Command) error {
+		data[cmd.Args[0]] = cmd.Args[1]
+		return nil
+	}, false)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	return data
+}
+
+// Property-based test setup for multi-part rewrites
+func TestMultiPartRewrite(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	// For any writes before, during and after a rewrite, reopening the files
+	// should rebuild the same dataset while only the new base and the
+	// incremental files opened since the rewrite remain
+	properties.Property("rewrite preserves the dataset", prop.ForAll(
+		func(before, during []string) bool {
+			dir := t.TempDir()
+			m, err := OpenMultiPart(dir, "appendonly.aof", FsyncNo, "")
+			if err != nil {
+				return false
+			}
+
+			expected := make(map[string]string)
+			set := func(key string) {
+				expected[key] = "value:" + key
+				m.Append(&resp2.Command{Name: "SET", Args: []string{key, expected[key]}})
+			}
+
+			// The first rewrite creates the initial base and incr
+			rewrite, err := m.BeginRewrite()
+			if err != nil || os.WriteFile(rewrite.TempPath(), nil, 0644) != nil || m.CompleteRewrite(rewrite) != nil {
+				return false
+			}
+			for _, key := range before {
+				set(key)
+			}
+
+			rewrite, err = m.BeginRewrite()
+			if err != nil {
+				return false
+			}
+			var base []byte
+			parser := resp2.NewRESP2Parser()
+			for key, value := range expected {
+				base = append(base, parser.Serialize(resp2.NewCommandValue("SET", []string{key, value}))...)
+			}
+			for _, key := range during {
+				set(key)
+			}
+			if os.WriteFile(rewrite.TempPath(), base, 0644) != nil || m.CompleteRewrite(rewrite) != nil {
+				return false
+			}
+			m.Close()
+
+			entries, _ := os.ReadDir(dir)
+			if len(entries) != 3 {
+				return false
+			}
+
+			reopened, err := OpenMultiPart(dir, "appendonly.aof", FsyncNo, "")
+			if err != nil {
+				return false
+			}
+			data := replayKeys(t, reopened)
+			if len(data) != len(expected) {
+				return false
+			}
+			for key, value := range expected {
+				if data[key] != value {
+					return false
+				}
+			}
+			return true
+		},
+		gen.SliceOf(gen.AlphaString()),
+		gen.SliceOf(gen.AlphaString()),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
+
+// TestMultiPartAbortedRewrite tests that a failed rewrite keeps every write
+func TestMultiPartAbortedRewrite(t *testing.T) {
+	dir := t.TempDir()
+	legacy := writeCommands(t, []string{"a", "b"})
+	m, err := OpenMultiPart(dir, "appendonly.aof", FsyncAlways, legacy)
+	if err != nil {
+		t.Fatalf("OpenMultiPart failed: %v", err)
+	}
+	if len(replayKeys(t, m)) != 2 {
+		t.Fatal("Expected the upgraded legacy file to be loaded")
+	}
+	if err := m.OpenForAppend(); err != nil {
+		t.Fatalf("OpenForAppend failed: %v", err)
+	}
+
+	rewrite, err := m.BeginRewrite()
+	if err != nil {
+		t.Fatalf("BeginRewrite failed: %v", err)
+	}
+	m.Append(&resp2.Command{Name: "SET", Args: []string{"c", "value:c"}})
+	os.WriteFile(rewrite.TempPath(), []byte("partial"), 0644)
+	m.AbortRewrite(rewrite)
+	m.Close()
+
+	reopened, err := OpenMultiPart(dir, "appendonly.aof", FsyncAlways, legacy)
+	if err != nil {
+		t.Fatalf("OpenMultiPart failed: %v", err)
+	}
+	data := replayKeys(t, reopened)
+	if len(data) != 3 || data["c"] != "value:c" {
+		t.Errorf("Expected a, b and c after the aborted rewrite, got %v", data)
+	}
+}
+
+// TestTimestampAnnotations tests that timestamped files carry "#TS:" lines
+// that replay skips
+func TestTimestampAnnotations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	file, err := Open(path, FsyncAlways)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	file.SetTimestamps(true)
+	before := time.Now().Unix()
+	for _, key := range []string{"a", "b", "c"} {
+		file.Append(&resp2.Command{Name: "SET", Args: []string{key, "value:" + key}})
+	}
+	file.Close()
+
+	data, _ := os.ReadFile(path)
+	if !strings.HasPrefix(string(data), timestampPrefix) {
+		t.Fatalf("Expected the file to start with a timestamp annotation, got %q", data)
+	}
+	result, err := Load(path, func(*resp2.Command) error { return nil }, false)
+	if err != nil || result.Commands != 3 || result.Timestamp < before || result.ValidSize != int64(len(data)) {
+		t.Errorf("Unexpected load result %+v, %v", result, err)
+	}
+}
+
+// timedCommand is a SET logged in a given second
+type timedCommand struct {
+	key    string
+	second int64
+}
+
+// writeTimedLog writes commands with timestamp annotations into two
+// incremental files split at split, returning the offset each command ends at
+func writeTimedLog(t *testing.T, dir string, commands []timedCommand, split int) []int64 {
+	parser := resp2.NewRESP2Parser()
+	var files [2][]byte
+	var ends []int64
+	var offset, last int64
+	for i, cmd := range commands {
+		part := &files[0]
+		if i >= split {
+			part = &files[1]
+		}
+		if cmd.second != last {
+			annotation := timestampAnnotation(cmd.second)
+			*part = append(*part, annotation...)
+			offset += int64(len(annotation))
+			last = cmd.second
+		}
+		encoded := parser.Serialize(resp2.NewCommandValue("SET", []string{cmd.key, "value:" + cmd.key}))
+		*part = append(*part, encoded...)
+		offset += int64(len(encoded))
+		ends = append(ends, offset)
+	}
+
+	manifest := &Manifest{}
+	for i, data := range files {
+		name := "appendonly.aof." + strconv.Itoa(i+1) + ".incr.aof"
+		os.WriteFile(filepath.Join(dir, name), data, 0644)
+		manifest.Incrs = append(manifest.Incrs, FileInfo{Name: name, Seq: int64(i + 1), Type: FileIncr})
+	}
+	if err := writeManifest(filepath.Join(dir, "appendonly.aof.manifest"), manifest); err != nil {
+		t.Fatalf("writeManifest failed: %v", err)
+	}
+	return ends
+}
+
+// Property-based test setup for point-in-time recovery
+func TestLoadUntil(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	// For any timestamped log split across incremental files, recovering to
+	// a time or an offset should replay exactly the commands logged up to
+	// that second or ending within that offset
+	properties.Property("recovery replays exactly the commands before the target", prop.ForAll(
+		func(gaps []int64, split int, pick int64) bool {
+			commands := make([]timedCommand, len(gaps))
+			second := int64(1700000000)
+			for i, gap := range gaps {
+				second += gap
+				commands[i] = timedCommand{key: "k" + strconv.Itoa(i), second: second}
+			}
+			dir := t.TempDir()
+			ends := writeTimedLog(t, dir, commands, split%(len(commands)+1))
+
+			recover := func(target *Target) (int, LoadResult, error) {
+				m, err := OpenReadOnly(dir, "appendonly.aof")
+				if err != nil {
+					return 0, LoadResult{}, err
+				}
+				replayed := 0
+				result, err := m.LoadUntil(nil, func(cmd *resp2.Command) error {
+					if cmd.Args[0] != commands[replayed].key {
+						return errors.New("out of order")
+					}
+					replayed++
+					return nil
+				}, false, target)
+				return replayed, result, err
+			}
+
+			cutoff := commands[0].second - 1 + pick%(second-commands[0].second+2)
+			wantByTime := 0
+			for wantByTime < len(commands) && commands[wantByTime].second <= cutoff {
+				wantByTime++
+			}
+			replayed, result, err := recover(&Target{Time: time.Unix(cutoff, 0), Offset: NoOffset})
+			if err != nil || replayed != wantByTime || result.Reached != (wantByTime < len(commands)) {
+				return false
+			}
+
+			offset := pick % (ends[len(ends)-1] + 1)
+			wantByOffset := 0
+			for wantByOffset < len(ends) && ends[wantByOffset] <= offset {
+				wantByOffset++
+			}
+			replayed, result, err = recover(&Target{Offset: offset})
+			return err == nil && replayed == wantByOffset && result.ValidSize <= offset
+		},
+		gen.SliceOfN(8, gen.Int64Range(0, 2)).SuchThat(func(gaps []int64) bool { return gaps[0] > 0 }),
+		gen.IntRange(0, 8),
+		gen.Int64Range(0, 1<<20),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
+
+func TestParseTarget(t *testing.T) {
+	if target, err := ParseTarget("", ""); target != nil || err != nil {
+		t.Errorf("Expected no target, got %+v, %v", target, err)
+	}
+	target, err := ParseTarget("2024-05-01T14:02:59Z", "")
+	if err != nil || target.Time.Unix() != 1714572179 || target.Offset != NoOffset {
+		t.Errorf("Unexpected target %+v, %v", target, err)
+	}
+	target, err = ParseTarget("1714572179", "42")
+	if err != nil || target.Time.Unix() != 1714572179 || target.Offset != 42 {
+		t.Errorf("Unexpected target %+v, %v", target, err)
+	}
+	for _, spec := range [][2]string{{"yesterday", ""}, {"", "-1"}, {"", "x"}} {
+		if _, err := ParseTarget(spec[0], spec[1]); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+// TestLoadUntilWithoutTimestamps tests that recovering to a time needs
+// timestamp annotations
+func TestLoadUntilWithoutTimestamps(t *testing.T) {
+	dir := t.TempDir()
+	m, err := OpenMultiPart(dir, "appendonly.aof", FsyncAlways, writeCommands(t, []string{"a"}))
+	if err != nil {
+		t.Fatalf("OpenMultiPart failed: %v", err)
+	}
+	_, err = m.LoadUntil(nil, func(*resp2.Command) error { return nil }, false, &Target{Time: time.Now(), Offset: NoOffset})
+	if !errors.Is(err, ErrNoTimestamps) {
+		t.Errorf("Expected ErrNoTimestamps, got %v", err)
+	}
+}
+
+// TestChecker tests that checking reports where each file goes wrong
+// without modifying it
+func TestChecker(t *testing.T) {
+	dir := t.TempDir()
+	commands := []timedCommand{{"a", 1}, {"b", 1}, {"c", 2}}
+	ends := writeTimedLog(t, dir, commands, 2)
+	first := filepath.Join(dir, "appendonly.aof.1.incr.aof")
+	second := filepath.Join(dir, "appendonly.aof.2.incr.aof")
+
+	checker := Checker{CheckCommand: func(cmd *resp2.Command) error {
+		if cmd.Name != "SET" {
+			return errors.New("unexpected command")
+		}
+		return nil
+	}}
+	reports, err := checker.CheckManifest(filepath.Join(dir, "appendonly.aof.manifest"))
+	if err != nil || len(reports) != 2 || !reports[0].OK() || !reports[1].OK() || reports[0].Commands != 2 || !reports[1].Last {
+		t.Fatalf("Unexpected reports %+v, %v", reports, err)
+	}
+
+	// A command the server would refuse, then a partial command
+	f, _ := os.OpenFile(first, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("*1\r\n$4\r\nPING\r\n")
+	f.Close()
+	f, _ = os.OpenFile(second, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("*3\r\n$3\r\nSET")
+	f.Close()
+
+	reports, err = checker.CheckManifest(filepath.Join(dir, "appendonly.aof.manifest"))
+	if err != nil || len(reports) != 2 {
+		t.Fatalf("Unexpected reports %+v, %v", reports, err)
+	}
+	if reports[0].OK() || reports[0].ValidSize != ends[1] || reports[0].Last {
+		t.Errorf("Expected the first file to fail at %d, got %+v", ends[1], reports[0])
+	}
+	if !errors.Is(reports[1].Err, ErrTruncated) || reports[1].ValidSize != ends[2]-ends[1] || reports[1].Size != reports[1].ValidSize+11 {
+		t.Errorf("Expected the second file to be truncated, got %+v", reports[1])
+	}
+
+	before, after, err := Context(second, reports[1].ValidSize, 4)
+	if err != nil || before != ":c\r\n" || after != "*3\r\n" {
+		t.Errorf("Unexpected context %q, %q, %v", before, after, err)
+	}
+}
+
+func TestEncryptedMultiPart(t *testing.T) {
+	dir := t.TempDir()
+	key, _ := crypt.NewKey([]byte(strings.Repeat("k", crypt.KeySize)))
+	keyring := crypt.NewKeyring(key)
+
+	m, _ := OpenMultiPart(dir, "appendonly.aof", FsyncAlways, "")
+	m.SetKeyring(keyring)
+	rewrite, err := m.BeginRewrite()
+	if err != nil {
+		t.Fatalf("BeginRewrite failed: %v", err)
+	}
+	base, _ := os.Create(rewrite.TempPath())
+	writer, _ := crypt.NewWriter(base, key)
+	writer.Close()
+	base.Close()
+	if err := m.CompleteRewrite(rewrite); err != nil {
+		t.Fatalf("CompleteRewrite failed: %v", err)
+	}
+	for _, key := range []string{"alpha", "beta", "gamma"} {
+		if err := m.Append(&resp2.Command{Name: "SET", Args: []string{key, "secret-" + key}}); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	m.Close()
+
+	incr := filepath.Join(dir, "appendonly.aof.1.incr.aof")
+	data, _ := os.ReadFile(incr)
+	if strings.Contains(string(data), "secret") || !crypt.IsEncrypted(data) {
+		t.Fatalf("Expected an encrypted file, got %q", data)
+	}
+
+	// Without the key the files cannot be loaded, nor appended to
+	reopened, _ := OpenMultiPart(dir, "appendonly.aof", FsyncAlways, "")
+	if _, err := reopened.Load(nil, func(*resp2.Command) error { return nil }, false); !errors.Is(err, crypt.ErrNoKey) {
+		t.Errorf("Load without a key: err = %v, want ErrNoKey", err)
+	}
+	if stale, err := reopened.Stale(); err != nil || !stale {
+		t.Errorf("Stale without a key = %v, %v; want true", stale, err)
+	}
+
+	// A torn final chunk is dropped and appending resumes after the last
+	// whole chunk
+	os.Truncate(incr, int64(len(data)-5))
+	reopened.SetKeyring(keyring)
+	if stale, err := reopened.Stale(); err != nil || stale {
+		t.Errorf("Stale with the key = %v, %v; want false", stale, err)
+	}
+	result, err := reopened.Load(nil, func(*resp2.Command) error { return nil }, true)
+	if err != nil || !result.Truncated || result.Commands != 2 {
+		t.Fatalf("Load = %+v, %v; want 2 commands and a truncation", result, err)
+	}
+	if err := reopened.OpenForAppend(); err != nil {
+		t.Fatalf("OpenForAppend failed: %v", err)
+	}
+	reopened.Append(&resp2.Command{Name: "SET", Args: []string{"delta", "secret-delta"}})
+	reopened.Close()
+
+	reopened, _ = OpenMultiPart(dir, "appendonly.aof", FsyncAlways, "")
+	reopened.SetKeyring(keyring)
+	got := replayKeys(t, reopened)
+	if len(got) != 3 || got["alpha"] != "secret-alpha" || got["beta"] != "secret-beta" || got["delta"] != "secret-delta" {
+		t.Errorf("Unexpected data after repair %v", got)
+	}
+
+	// The checker reports a torn chunk as repairable only at its boundary
+	data, _ = os.ReadFile(incr)
+	os.Truncate(incr, int64(len(data)-5))
+	report := Checker{Keyring: keyring}.CheckFile(incr)
+	if !report.Encrypted || !report.Repairable() || report.Commands != 2 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if os.Truncate(incr, report.ValidSize) != nil || !(Checker{Keyring: keyring}).CheckFile(incr).OK() {
+		t.Errorf("Truncating to %d did not repair the file", report.ValidSize)
+	}
+}
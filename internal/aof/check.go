@@ -0,0 +1,160 @@
+package aof
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"redis-like-server/internal/crypt"
+	"redis-like-server/internal/resp2"
+)
+
+// Checker validates append-only files without modifying them
+type Checker struct {
+	// CheckRDB validates a base file in RDB format, returning the length of
+	// its valid prefix
+	CheckRDB func(path string) (int64, error)
+	// CheckCommand validates a logged command; nil accepts any command
+	CheckCommand func(*resp2.Command) error
+	// Keyring decrypts encrypted files
+	Keyring *crypt.Keyring
+}
+
+// CheckReport is the outcome of checking one file
+type CheckReport struct {
+	Path string
+	Type FileType
+	// RDB is set for a base file in RDB format
+	RDB      bool
+	Size     int64
+	Commands int
+	// ValidSize is the length of the prefix that loads cleanly; it equals
+	// Size when Err is nil. For an encrypted file it is where the chunk
+	// holding the problem starts.
+	ValidSize int64
+	Err       error
+	// Last is set for the final file of the log, the only one that can be
+	// repaired by truncating it to ValidSize
+	Last bool
+	// Encrypted is set for encrypted files
+	Encrypted bool
+	// aligned is set when truncating to ValidSize keeps only whole commands
+	aligned bool
+}
+
+// Repairable reports whether truncating the file to ValidSize leaves a
+// valid file: only the final command log can be cut short, and an
+// encrypted one only between chunks
+func (r CheckReport) Repairable() bool {
+	return !r.OK() && r.Last && !r.RDB && r.aligned
+}
+
+// OK reports whether the whole file is valid
+func (r CheckReport) OK() bool {
+	return r.Err == nil
+}
+
+// CheckManifest checks every file listed in a multi-part manifest, in the
+// order they would be loaded
+func (c Checker) CheckManifest(path string) ([]CheckReport, error) {
+	manifest, err := readManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("manifest %s does not exist", path)
+	}
+
+	files := make([]FileInfo, 0, len(manifest.Incrs)+1)
+	if manifest.Base != nil {
+		files = append(files, *manifest.Base)
+	}
+	files = append(files, manifest.Incrs...)
+
+	reports := make([]CheckReport, 0, len(files))
+	for i, info := range files {
+		report := c.check(filepath.Join(filepath.Dir(path), info.Name), info.Type)
+		report.Last = i == len(files)-1
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// CheckFile checks a single file, which may be a legacy append-only file
+// or an RDB-preamble base
+func (c Checker) CheckFile(path string) CheckReport {
+	report := c.check(path, FileIncr)
+	if report.RDB {
+		report.Type = FileBase
+	}
+	report.Last = true
+	return report
+}
+
+// check validates one file of the given type
+func (c Checker) check(path string, fileType FileType) CheckReport {
+	report := CheckReport{Path: path, Type: fileType}
+	size, err := fileSize(path)
+	if err != nil {
+		report.Err = err
+		return report
+	}
+	report.Size = size
+
+	if isRDBFile(path, c.Keyring) {
+		report.RDB = true
+		if c.CheckRDB == nil {
+			report.Err = errors.New("RDB files cannot be checked")
+			return report
+		}
+		report.ValidSize, report.Err = c.CheckRDB(path)
+		return report
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		report.Err = err
+		return report
+	}
+	defer file.Close()
+
+	source, decrypted, err := crypt.Plaintext(file, c.Keyring)
+	if err != nil {
+		report.Err = err
+		report.Encrypted = errors.Is(err, crypt.ErrNoKey) || errors.Is(err, crypt.ErrUnknownKey)
+		return report
+	}
+	result, err := Replay(source, func(cmd *resp2.Command) error {
+		if c.CheckCommand == nil {
+			return nil
+		}
+		return c.CheckCommand(cmd)
+	})
+	report.Commands = result.Commands
+	report.Encrypted = decrypted != nil
+	report.ValidSize, report.aligned = fileValidSize(result, decrypted)
+	report.Err = err
+	return report
+}
+
+// Context returns up to n bytes before and after offset in the file at
+// path, for showing where a file went wrong
+func Context(path string, offset int64, n int) (before, after string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	start := max(offset-int64(n), 0)
+	buf := make([]byte, offset-start+int64(n))
+	read, err := file.ReadAt(buf, start)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", "", err
+	}
+	buf = buf[:read]
+	split := min(int(offset-start), len(buf))
+	return string(buf[:split]), string(buf[split:]), nil
+}
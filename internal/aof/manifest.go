@@ -0,0 +1,168 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FileType identifies the role of a file listed in the manifest
+type FileType byte
+
+const (
+	// FileBase is the snapshot the incremental files apply on top of
+	FileBase FileType = 'b'
+	// FileIncr is an incremental file of commands logged after the base
+	FileIncr FileType = 'i'
+	// FileHistory is a file superseded by a rewrite, pending deletion
+	FileHistory FileType = 'h'
+)
+
+// FileInfo describes one file of a multi-part append-only file
+type FileInfo struct {
+	Name string
+	Seq  int64
+	Type FileType
+}
+
+// Manifest lists the files making up a multi-part append-only file, using
+// the same line format as Redis: "file <name> seq <n> type <b|i|h>"
+type Manifest struct {
+	Base    *FileInfo
+	Incrs   []FileInfo
+	History []FileInfo
+}
+
+// ParseManifest decodes a manifest file's contents
+func ParseManifest(data string) (*Manifest, error) {
+	manifest := &Manifest{}
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("invalid manifest line %d: %q", lineNumber, line)
+		}
+		var info FileInfo
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				info.Name = fields[i+1]
+			case "seq":
+				seq, err := strconv.ParseInt(fields[i+1], 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid manifest line %d: bad seq %q", lineNumber, fields[i+1])
+				}
+				info.Seq = seq
+			case "type":
+				if len(fields[i+1]) != 1 {
+					return nil, fmt.Errorf("invalid manifest line %d: bad type %q", lineNumber, fields[i+1])
+				}
+				info.Type = FileType(fields[i+1][0])
+			}
+		}
+		if info.Name == "" || strings.ContainsAny(info.Name, "/\\") {
+			return nil, fmt.Errorf("invalid manifest line %d: bad file name", lineNumber)
+		}
+
+		switch info.Type {
+		case FileBase:
+			if manifest.Base != nil {
+				return nil, fmt.Errorf("invalid manifest line %d: more than one base file", lineNumber)
+			}
+			base := info
+			manifest.Base = &base
+		case FileIncr:
+			manifest.Incrs = append(manifest.Incrs, info)
+		case FileHistory:
+			manifest.History = append(manifest.History, info)
+		default:
+			return nil, fmt.Errorf("invalid manifest line %d: unknown type %q", lineNumber, info.Type)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(manifest.Incrs, func(i, j int) bool { return manifest.Incrs[i].Seq < manifest.Incrs[j].Seq })
+	return manifest, nil
+}
+
+// String encodes the manifest in its file format
+func (m *Manifest) String() string {
+	var result strings.Builder
+	write := func(info FileInfo) {
+		fmt.Fprintf(&result, "file %s seq %d type %c\n", info.Name, info.Seq, info.Type)
+	}
+	if m.Base != nil {
+		write(*m.Base)
+	}
+	for _, info := range m.History {
+		write(info)
+	}
+	for _, info := range m.Incrs {
+		write(info)
+	}
+	return result.String()
+}
+
+// readManifest loads the manifest at path, returning nil if it does not exist
+func readManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	manifest, err := ParseManifest(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", path, err)
+	}
+	return manifest, nil
+}
+
+// writeManifest atomically replaces the manifest at path: the new contents
+// are written to a temporary file, fsynced, renamed into place and the
+// directory is fsynced so the switch survives a crash
+func writeManifest(path string, manifest *Manifest) error {
+	tempPath := filepath.Join(filepath.Dir(path), "temp-"+filepath.Base(path))
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("failed to create manifest: %w", err)
+	}
+	_, err = file.WriteString(manifest.String())
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir fsyncs a directory so renames and creations in it are durable
+func syncDir(dir string) error {
+	handle, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	return handle.Sync()
+}
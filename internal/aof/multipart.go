@@ -0,0 +1,537 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"redis-like-server/internal/crypt"
+	"redis-like-server/internal/resp2"
+)
+
+// MultiPartAOF is an append-only file split into a base snapshot plus
+// incremental command files, tied together by a manifest. Rewriting
+// produces a new base from the dataset while writes continue into a fresh
+// incremental file, so the log never has to grow without bound.
+type MultiPartAOF struct {
+	dir      string
+	basename string
+	policy   FsyncPolicy
+	mutex    sync.Mutex
+	manifest *Manifest
+	current  *AppendOnlyFile
+	// closedSize is the size of the base and all incremental files except the current one
+	closedSize int64
+	baseSize   int64
+	rewriting  bool
+	timestamps bool
+	// keyring encrypts new files with its current key and decrypts
+	// existing ones; nil disables encryption
+	keyring *crypt.Keyring
+	// readOnly is set for files opened only to be read, see OpenReadOnly
+	readOnly bool
+}
+
+// Rewrite is an in-progress rewrite started by BeginRewrite
+type Rewrite struct {
+	baseName string
+	baseSeq  int64
+	tempPath string
+	firstSeq int64
+}
+
+// TempPath returns where the new base file must be written
+func (r *Rewrite) TempPath() string {
+	return r.tempPath
+}
+
+// OpenMultiPart opens the multi-part append-only file stored in dir. When
+// no manifest exists but a single-file AOF is found at legacyPath, it is
+// moved into dir and adopted as the base, as Redis does when upgrading.
+func OpenMultiPart(dir, basename string, policy FsyncPolicy, legacyPath string) (*MultiPartAOF, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create append only directory: %w", err)
+	}
+
+	m := &MultiPartAOF{dir: dir, basename: basename, policy: policy}
+	manifest, err := readManifest(m.manifestPath())
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest == nil && legacyPath != "" {
+		if _, err := os.Stat(legacyPath); err == nil {
+			manifest = &Manifest{Base: &FileInfo{Name: basename, Seq: 1, Type: FileBase}}
+			if err := os.Rename(legacyPath, filepath.Join(dir, basename)); err != nil {
+				return nil, fmt.Errorf("failed to upgrade append only file: %w", err)
+			}
+			if err := writeManifest(m.manifestPath(), manifest); err != nil {
+				return nil, err
+			}
+		}
+	}
+	m.manifest = manifest
+
+	m.removeTempFiles()
+	if manifest != nil {
+		m.deleteHistory()
+	}
+	return m, nil
+}
+
+// OpenReadOnly opens the multi-part append-only file stored in dir for
+// reading only: nothing is created, upgraded, cleaned up or truncated, so a
+// server may keep writing to it meanwhile
+func OpenReadOnly(dir, basename string) (*MultiPartAOF, error) {
+	m := &MultiPartAOF{dir: dir, basename: basename, readOnly: true}
+	manifest, err := readManifest(m.manifestPath())
+	if err != nil {
+		return nil, err
+	}
+	m.manifest = manifest
+	return m, nil
+}
+
+// Empty reports whether no append-only file exists yet
+func (m *MultiPartAOF) Empty() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.manifest == nil
+}
+
+// manifestPath returns the path of the manifest file
+func (m *MultiPartAOF) manifestPath() string {
+	return filepath.Join(m.dir, m.basename+".manifest")
+}
+
+// Load replays the base file and then every incremental file in order. An
+// RDB base is handed to loadRDB; AOF-format files go through apply. Only
+// the final incremental file may end with an incomplete command, and only
+// when allowTruncated is set. Load must be called before Append.
+func (m *MultiPartAOF) Load(loadRDB func(path string) error, apply func(*resp2.Command) error, allowTruncated bool) (LoadResult, error) {
+	return m.LoadUntil(loadRDB, apply, allowTruncated, nil)
+}
+
+// LoadUntil is Load stopping at a point-in-time recovery target, or
+// replaying everything when target is nil. A time target needs timestamp
+// annotations in the log and cannot go back past the moment the base was
+// written, since older history was discarded by the rewrite.
+func (m *MultiPartAOF) LoadUntil(loadRDB func(path string) error, apply func(*resp2.Command) error, allowTruncated bool, target *Target) (LoadResult, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var total LoadResult
+	if m.manifest == nil {
+		return total, nil
+	}
+	state := &replayState{target: target}
+
+	files := make([]FileInfo, 0, len(m.manifest.Incrs)+1)
+	if m.manifest.Base != nil {
+		files = append(files, *m.manifest.Base)
+	}
+	files = append(files, m.manifest.Incrs...)
+
+	for i, info := range files {
+		path := filepath.Join(m.dir, info.Name)
+		isLast := i == len(files)-1
+
+		var result LoadResult
+		var err error
+		if info.Type == FileBase && isRDBFile(path, m.keyring) {
+			if err := checkBaseTime(path, target); err != nil {
+				return total, err
+			}
+			err = loadRDB(path)
+		} else {
+			state.base = total.ValidSize
+			result, err = loadFile(path, apply, allowTruncated && isLast, !m.readOnly, state, m.keyring)
+		}
+		if errors.Is(err, os.ErrNotExist) && info.Type == FileIncr && isLast {
+			// A crash right after the manifest listed a new incremental
+			// file but before it was created loses nothing
+			continue
+		}
+		total.Commands += result.Commands
+		total.Truncated = total.Truncated || result.Truncated
+		total.ValidSize += result.ValidSize
+		if result.Timestamp != 0 {
+			total.Timestamp = result.Timestamp
+		}
+		if err != nil {
+			return total, fmt.Errorf("%s: %w", info.Name, err)
+		}
+		if result.Reached {
+			total.Reached = true
+			return total, nil
+		}
+
+		if size, err := fileSize(path); err == nil {
+			if info.Type == FileBase {
+				m.baseSize = size
+			}
+			if !isLast || info.Type == FileBase {
+				m.closedSize += size
+			}
+		}
+	}
+	if target != nil && !target.Time.IsZero() && total.Timestamp == 0 && total.Commands > 0 {
+		return total, ErrNoTimestamps
+	}
+	return total, nil
+}
+
+// checkBaseTime fails if a recovery target time lies before the RDB base
+// at path was written
+func checkBaseTime(path string, target *Target) error {
+	if target == nil || target.Time.IsZero() {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if written := info.ModTime().Truncate(time.Second); target.Time.Before(written) {
+		return fmt.Errorf("base %s was written at %s, after the recovery target; older history is no longer available",
+			filepath.Base(path), written.Format(time.DateTime))
+	}
+	return nil
+}
+
+// OpenForAppend opens the latest incremental file for appending. It must
+// be called after Load when the manifest already exists.
+func (m *MultiPartAOF) OpenForAppend() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.readOnly {
+		return errors.New("append only file is open read-only")
+	}
+	if m.manifest == nil {
+		return errors.New("append only file has no manifest")
+	}
+	if len(m.manifest.Incrs) == 0 {
+		// An upgraded single file has no incremental part yet
+		next := FileInfo{Name: m.incrName(1), Seq: 1, Type: FileIncr}
+		m.manifest.Incrs = append(m.manifest.Incrs, next)
+		if err := writeManifest(m.manifestPath(), m.manifest); err != nil {
+			return err
+		}
+	}
+
+	last := m.manifest.Incrs[len(m.manifest.Incrs)-1]
+	file, err := open(filepath.Join(m.dir, last.Name), m.policy, m.keyring.Current())
+	if err != nil {
+		return err
+	}
+	file.SetTimestamps(m.timestamps)
+	m.current = file
+	return nil
+}
+
+// Append logs a command to the current incremental file
+func (m *MultiPartAOF) Append(cmd *resp2.Command) error {
+	m.mutex.Lock()
+	current := m.current
+	m.mutex.Unlock()
+
+	if current == nil {
+		return errors.New("append only file is not open")
+	}
+	return current.Append(cmd)
+}
+
+// BeginRewrite opens the next incremental file and redirects appends to it,
+// then persists a manifest that still lists the old base and incremental
+// files. Until CompleteRewrite succeeds a crash therefore recovers from the
+// old files plus the new incremental file. The caller must hold off writes
+// while BeginRewrite runs and capture the dataset at that same moment.
+func (m *MultiPartAOF) BeginRewrite() (*Rewrite, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.readOnly {
+		return nil, errors.New("append only file is open read-only")
+	}
+	if m.rewriting {
+		return nil, errors.New("rewrite already in progress")
+	}
+
+	manifest := m.manifest
+	if manifest == nil {
+		manifest = &Manifest{}
+	}
+	var nextIncrSeq int64 = 1
+	if n := len(manifest.Incrs); n > 0 {
+		nextIncrSeq = manifest.Incrs[n-1].Seq + 1
+	}
+	var nextBaseSeq int64 = 1
+	if manifest.Base != nil {
+		nextBaseSeq = manifest.Base.Seq + 1
+	}
+
+	incr := FileInfo{Name: m.incrName(nextIncrSeq), Seq: nextIncrSeq, Type: FileIncr}
+	file, err := open(filepath.Join(m.dir, incr.Name), m.policy, m.keyring.Current())
+	if err != nil {
+		return nil, err
+	}
+	file.SetTimestamps(m.timestamps)
+
+	updated := &Manifest{Base: manifest.Base, History: manifest.History}
+	updated.Incrs = append(append([]FileInfo(nil), manifest.Incrs...), incr)
+	if err := writeManifest(m.manifestPath(), updated); err != nil {
+		file.Close()
+		os.Remove(filepath.Join(m.dir, incr.Name))
+		return nil, err
+	}
+
+	if m.current != nil {
+		m.current.movePending(file)
+		m.closedSize += m.current.Size()
+		m.current.Close()
+	}
+	m.current = file
+	m.manifest = updated
+	m.rewriting = true
+
+	baseName := fmt.Sprintf("%s.%d.base.rdb", m.basename, nextBaseSeq)
+	return &Rewrite{
+		baseName: baseName,
+		baseSeq:  nextBaseSeq,
+		tempPath: filepath.Join(m.dir, "temp-"+baseName),
+		firstSeq: nextIncrSeq,
+	}, nil
+}
+
+// CompleteRewrite installs the base written to the rewrite's temp path: the
+// manifest is switched to the new base plus the incremental files opened
+// since the rewrite began, and the superseded files are deleted
+func (m *MultiPartAOF) CompleteRewrite(rewrite *Rewrite) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	defer func() { m.rewriting = false }()
+
+	basePath := filepath.Join(m.dir, rewrite.baseName)
+	if err := os.Rename(rewrite.tempPath, basePath); err != nil {
+		os.Remove(rewrite.tempPath)
+		return fmt.Errorf("failed to install rewritten base: %w", err)
+	}
+
+	updated := &Manifest{
+		Base:    &FileInfo{Name: rewrite.baseName, Seq: rewrite.baseSeq, Type: FileBase},
+		History: append([]FileInfo(nil), m.manifest.History...),
+	}
+	if m.manifest.Base != nil {
+		updated.History = append(updated.History, FileInfo{Name: m.manifest.Base.Name, Seq: m.manifest.Base.Seq, Type: FileHistory})
+	}
+	for _, incr := range m.manifest.Incrs {
+		if incr.Seq >= rewrite.firstSeq {
+			updated.Incrs = append(updated.Incrs, incr)
+		} else {
+			updated.History = append(updated.History, FileInfo{Name: incr.Name, Seq: incr.Seq, Type: FileHistory})
+		}
+	}
+
+	if err := writeManifest(m.manifestPath(), updated); err != nil {
+		os.Remove(basePath)
+		return err
+	}
+	m.manifest = updated
+
+	m.baseSize, _ = fileSize(basePath)
+	m.closedSize = m.baseSize
+	for _, incr := range updated.Incrs[:len(updated.Incrs)-1] {
+		if size, err := fileSize(filepath.Join(m.dir, incr.Name)); err == nil {
+			m.closedSize += size
+		}
+	}
+	m.deleteHistory()
+	return nil
+}
+
+// AbortRewrite discards a failed rewrite. The manifest written by
+// BeginRewrite stays valid, so logging simply continues.
+func (m *MultiPartAOF) AbortRewrite(rewrite *Rewrite) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	os.Remove(rewrite.tempPath)
+	m.rewriting = false
+}
+
+// deleteHistory removes files superseded by a rewrite and drops them from
+// the manifest; the caller must hold the mutex or have exclusive access
+func (m *MultiPartAOF) deleteHistory() {
+	if len(m.manifest.History) == 0 {
+		return
+	}
+	for _, info := range m.manifest.History {
+		os.Remove(filepath.Join(m.dir, info.Name))
+	}
+	m.manifest.History = nil
+	if err := writeManifest(m.manifestPath(), m.manifest); err != nil {
+		fmt.Printf("Error removing history from the AOF manifest: %v\n", err)
+	}
+}
+
+// removeTempFiles deletes leftovers of rewrites interrupted by a crash
+func (m *MultiPartAOF) removeTempFiles() {
+	matches, _ := filepath.Glob(filepath.Join(m.dir, "temp-*"))
+	for _, match := range matches {
+		os.Remove(match)
+	}
+}
+
+// incrName returns the file name of the incremental file with the given sequence
+func (m *MultiPartAOF) incrName(seq int64) string {
+	return fmt.Sprintf("%s.%d.incr.aof", m.basename, seq)
+}
+
+// SetPolicy changes the fsync policy
+func (m *MultiPartAOF) SetPolicy(policy FsyncPolicy) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.policy = policy
+	if m.current != nil {
+		m.current.SetPolicy(policy)
+	}
+}
+
+// SetKeyring sets the keys used to decrypt the files and to encrypt the
+// ones created from now on; nil disables encryption. It must be called
+// before Load.
+func (m *MultiPartAOF) SetKeyring(keyring *crypt.Keyring) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.keyring = keyring
+}
+
+// Keyring returns the keys set by SetKeyring
+func (m *MultiPartAOF) Keyring() *crypt.Keyring {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.keyring
+}
+
+// Stale reports whether some file is not encrypted the way new files would
+// be, as after enabling encryption or switching to a new key. Logging must
+// then start over with a rewrite instead of appending to the old files.
+func (m *MultiPartAOF) Stale() (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.manifest == nil {
+		return false, nil
+	}
+
+	files := append([]FileInfo(nil), m.manifest.Incrs...)
+	if m.manifest.Base != nil {
+		files = append(files, *m.manifest.Base)
+	}
+	for _, info := range files {
+		current, err := m.keyring.CurrentFor(filepath.Join(m.dir, info.Name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if !current {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// SetTimestamps turns timestamp annotations on or off for the current and
+// future incremental files
+func (m *MultiPartAOF) SetTimestamps(enabled bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.timestamps = enabled
+	if m.current != nil {
+		m.current.SetTimestamps(enabled)
+	}
+}
+
+// Policy returns the current fsync policy
+func (m *MultiPartAOF) Policy() FsyncPolicy {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.policy
+}
+
+// Size returns the total size of the base and incremental files
+func (m *MultiPartAOF) Size() int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	size := m.closedSize
+	if m.current != nil {
+		size += m.current.Size()
+	}
+	return size
+}
+
+// BaseSize returns the size of the base file produced by the last rewrite
+func (m *MultiPartAOF) BaseSize() int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.baseSize
+}
+
+// Rewriting reports whether a rewrite is in progress
+func (m *MultiPartAOF) Rewriting() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.rewriting
+}
+
+// LastError returns the most recent write or fsync error of the current file
+func (m *MultiPartAOF) LastError() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.current == nil {
+		return nil
+	}
+	return m.current.LastError()
+}
+
+// Close closes the current incremental file
+func (m *MultiPartAOF) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.current == nil {
+		return nil
+	}
+	err := m.current.Close()
+	m.current = nil
+	return err
+}
+
+// isRDBFile reports whether a file's plaintext starts with the RDB magic,
+// which is how an RDB-preamble base is told apart from a command log
+func isRDBFile(path string, keyring *crypt.Keyring) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	plaintext, _, err := crypt.Plaintext(file, keyring)
+	if err != nil {
+		return false
+	}
+	magic, err := bufio.NewReader(plaintext).Peek(5)
+	return err == nil && strings.EqualFold(string(magic), "REDIS")
+}
+
+// fileSize returns the size of the file at path
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
@@ -0,0 +1,107 @@
+// Package client is a minimal client of the RESP protocol, for the tools
+// that drive running servers
+package client
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"time"
+
+	"redis-like-server/internal/resp2"
+)
+
+// ReplyError is an error reply of the server
+type ReplyError string
+
+// Error returns the reply as the server sent it
+func (e ReplyError) Error() string {
+	return string(e)
+}
+
+// Client is a connection to a server. It is not safe for concurrent use.
+type Client struct {
+	addr    string
+	conn    net.Conn
+	reader  *bufio.Reader
+	parser  resp2.RESP2Parser
+	timeout time.Duration
+}
+
+// Dial connects to the server at addr; timeout bounds the connection and
+// every command, 0 meaning no limit
+func Dial(addr string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		addr:    addr,
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		parser:  resp2.NewRESP2Parser(),
+		timeout: timeout,
+	}, nil
+}
+
+// Addr returns the address of the server
+func (c *Client) Addr() string {
+	return c.addr
+}
+
+// SetTimeout changes the limit of every command, 0 meaning no limit
+func (c *Client) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+// Idle reports whether the connection is still open with nothing unread,
+// as a connection kept for later should be; a server closing it, or
+// telling why first, makes it unusable
+func (c *Client) Idle() bool {
+	if c.reader.Buffered() > 0 {
+		return false
+	}
+	c.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := c.reader.Peek(1)
+	c.conn.SetReadDeadline(time.Time{})
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Do sends a command and returns its reply; an error reply is returned as
+// a ReplyError
+func (c *Client) Do(name string, args ...string) (*resp2.RESPValue, error) {
+	if c.timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	if _, err := c.conn.Write(c.parser.Serialize(resp2.NewCommandValue(name, args))); err != nil {
+		return nil, err
+	}
+	reply, err := c.parser.Parse(c.reader)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Type == resp2.Error {
+		return reply, ReplyError(reply.Str)
+	}
+	return reply, nil
+}
+
+// Receive reads the next message the server pushes to a subscribed
+// connection
+func (c *Client) Receive() (*resp2.RESPValue, error) {
+	if c.timeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+	return c.parser.Parse(c.reader)
+}
+
+// LocalAddr returns the local address of the connection
+func (c *Client) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
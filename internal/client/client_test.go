@@ -0,0 +1,83 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"redis-like-server/internal/resp2"
+)
+
+// serve answers every command on one connection with the next reply
+func serve(t *testing.T, replies ...*resp2.RESPValue) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		parser := resp2.NewRESP2Parser()
+		reader := bufio.NewReader(conn)
+		for _, reply := range replies {
+			if _, err := parser.Parse(reader); err != nil {
+				return
+			}
+			conn.Write(parser.Serialize(reply))
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestDo(t *testing.T) {
+	addr := serve(t,
+		&resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"},
+		&resp2.RESPValue{Type: resp2.Error, Str: "MOVED 42 127.0.0.1:7001"},
+	)
+	c, err := Dial(addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if reply, err := c.Do("SET", "key", "value"); err != nil || reply.Str != "OK" {
+		t.Errorf("Unexpected reply %+v, %v", reply, err)
+	}
+	var replyErr ReplyError
+	if _, err := c.Do("GET", "key"); !errors.As(err, &replyErr) || replyErr != "MOVED 42 127.0.0.1:7001" {
+		t.Errorf("Expected the error reply as an error, got %v", err)
+	}
+	if _, err := c.Do("GET", "key"); err == nil {
+		t.Error("Expected an error once the server closed the connection")
+	}
+}
+
+func TestIdle(t *testing.T) {
+	addr := serve(t, &resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"})
+	c, err := Dial(addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if !c.Idle() {
+		t.Error("Expected a fresh connection to be idle")
+	}
+	if _, err := c.Do("PING"); err != nil {
+		t.Fatal(err)
+	}
+	// The server closes the connection after its only reply
+	deadline := time.Now().Add(time.Second)
+	for c.Idle() {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a closed connection not to be idle")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,122 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// busSignature starts every message of the cluster bus
+const busSignature = "RCmb"
+
+// maxMessageSize bounds the messages read from the cluster bus
+const maxMessageSize = 1 << 20
+
+// MessageType is the type of a cluster bus message
+type MessageType string
+
+// Message types of the cluster bus
+const (
+	// MsgPing carries the state of its sender and asks for a pong
+	MsgPing MessageType = "ping"
+	// MsgPong answers a ping or a meet
+	MsgPong MessageType = "pong"
+	// MsgMeet is a ping that makes the receiver add its sender to the
+	// cluster
+	MsgMeet MessageType = "meet"
+	// MsgFail tells every node that the node Failing is down, as agreed by
+	// a majority of the masters
+	MsgFail MessageType = "fail"
+	// MsgAuthRequest asks the masters to vote for the sender, a replica
+	// whose master failed, to take over its slots
+	MsgAuthRequest MessageType = "auth-request"
+	// MsgAuthAck is the vote of a master for the replica that requested it
+	MsgAuthAck MessageType = "auth-ack"
+	// MsgMFStart asks the master of the sender to pause its clients for a
+	// manual failover
+	MsgMFStart MessageType = "mfstart"
+)
+
+// Header describes the sender of a message: who it is, where to reach it
+// and the slots it claims
+type Header struct {
+	ID           string     `json:"id"`
+	Host         string     `json:"host,omitempty"`
+	Port         int        `json:"port"`
+	BusPort      int        `json:"bus_port"`
+	ConfigEpoch  uint64     `json:"config_epoch"`
+	CurrentEpoch uint64     `json:"current_epoch"`
+	Slots        SlotBitmap `json:"slots"`
+	// MasterID is the master the sender replicates, empty for a master
+	MasterID string `json:"master_id,omitempty"`
+	// ReplOffset is the replication offset of the sender, and Paused
+	// reports that a master paused its clients for a manual failover
+	ReplOffset int64 `json:"repl_offset"`
+	Paused     bool  `json:"paused,omitempty"`
+}
+
+// Gossip tells the receiver of a message about another node, so every
+// node of the cluster ends up knowing every other
+type Gossip struct {
+	ID      string `json:"id"`
+	Host    string `json:"host"`
+	Port    int    `json:"port"`
+	BusPort int    `json:"bus_port"`
+	// PFail and Fail are the failure flags the sender sees on the node
+	PFail bool `json:"pfail,omitempty"`
+	Fail  bool `json:"fail,omitempty"`
+}
+
+// Message is a message of the cluster bus
+type Message struct {
+	Type   MessageType `json:"type"`
+	Sender Header      `json:"sender"`
+	Gossip []Gossip    `json:"gossip,omitempty"`
+	// Failing is the node a fail message is about
+	Failing string `json:"failing,omitempty"`
+	// Force makes the masters vote for a replica whose master did not fail,
+	// for a manual failover
+	Force bool `json:"force,omitempty"`
+}
+
+// WriteMessage writes a message to the cluster bus: the signature, the
+// length of the body as a big-endian 32-bit integer and the body in JSON
+func WriteMessage(w io.Writer, m *Message) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 0, len(busSignature)+4+len(body))
+	frame = append(frame, busSignature...)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(body)))
+	_, err = w.Write(append(frame, body...))
+	return err
+}
+
+// ReadMessage reads a message written by WriteMessage
+func ReadMessage(r io.Reader) (*Message, error) {
+	var header [len(busSignature) + 4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if string(header[:len(busSignature)]) != busSignature {
+		return nil, fmt.Errorf("invalid cluster bus message signature %q", header[:len(busSignature)])
+	}
+	size := binary.BigEndian.Uint32(header[len(busSignature):])
+	if size > maxMessageSize {
+		return nil, fmt.Errorf("cluster bus message of %d bytes is too large", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	var m Message
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, fmt.Errorf("invalid cluster bus message: %w", err)
+	}
+	if !validID(m.Sender.ID) {
+		return nil, fmt.Errorf("invalid cluster bus message sender %q", m.Sender.ID)
+	}
+	return &m, nil
+}
@@ -0,0 +1,451 @@
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"redis-like-server/internal/store"
+
+	"github.com/leanovate/gopter"
+	"github.com/leanovate/gopter/gen"
+	"github.com/leanovate/gopter/prop"
+)
+
+func TestKeySlot(t *testing.T) {
+	if crc := crc16("123456789"); crc != 0x31C3 {
+		t.Errorf("crc16(123456789) = %#x, want 0x31c3", crc)
+	}
+	for key, slot := range map[string]int{
+		"foo":                  12182,
+		"bar":                  5061,
+		"{user1000}.profile":   KeySlot("user1000"),
+		"{}.empty-tag":         KeySlot("{}.empty-tag"),
+		"foo{}{bar}":           KeySlot("foo{}{bar}"),
+		"foo{{bar}}zap":        KeySlot("{bar"),
+		"foo{bar}{zap}":        KeySlot("bar"),
+		"no tag {unfinished":   KeySlot("no tag {unfinished"),
+		"{user1000}.followers": KeySlot("{user1000}.following"),
+	} {
+		if got := KeySlot(key); got != slot {
+			t.Errorf("KeySlot(%q) = %d, want %d", key, got, slot)
+		}
+	}
+}
+
+// Property-based test setup for hash slots
+func TestSlotProperties(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	// For any tag, keys sharing it share the slot of the tag itself
+	properties.Property("keys with the same hash tag share a slot", prop.ForAll(
+		func(tag, prefix, suffix string) bool {
+			key := prefix + "{" + tag + "}" + suffix
+			slot := KeySlot(key)
+			return slot >= 0 && slot < SlotCount && slot == KeySlot(tag)
+		},
+		gen.AlphaString().SuchThat(func(s string) bool { return s != "" }),
+		gen.AlphaString(),
+		gen.AnyString(),
+	))
+
+	// For any set of slots, the ranges cover exactly the set and the
+	// bitmap holds it
+	properties.Property("ranges and bitmaps hold the slots", prop.ForAll(
+		func(slots []int) bool {
+			set := make(map[int]bool)
+			for _, slot := range slots {
+				set[slot] = true
+			}
+			sorted := make([]int, 0, len(set))
+			bitmap := NewSlotBitmap()
+			for slot := range set {
+				sorted = append(sorted, slot)
+				bitmap.Set(slot)
+			}
+			sort.Ints(sorted)
+
+			var covered []int
+			for i, r := range Ranges(sorted) {
+				if parsed, err := ParseSlotRange(r.String()); err != nil || parsed != r {
+					return false
+				}
+				if i > 0 && covered[len(covered)-1] >= r.Start-1 {
+					return false
+				}
+				for slot := r.Start; slot <= r.End; slot++ {
+					covered = append(covered, slot)
+				}
+			}
+			for slot := 0; slot < SlotCount; slot++ {
+				if bitmap.Has(slot) != set[slot] {
+					return false
+				}
+			}
+			return len(covered) == len(sorted) && (len(sorted) == 0 || reflect.DeepEqual(covered, sorted))
+		},
+		gen.SliceOf(gen.IntRange(0, SlotCount-1)),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
+
+func TestParseSlotRange(t *testing.T) {
+	for _, invalid := range []string{"", "-1", "16384", "10-5", "a-b", "1-16384"} {
+		if _, err := ParseSlotRange(invalid); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	state := NewState(Node{Host: "127.0.0.1", Port: 7000, BusPort: 17000})
+	if err := state.AddSlots([]int{0, 1, 2, 100}); err != nil {
+		t.Fatal(err)
+	}
+	state.AddNode(Node{ID: NewNodeID(), Host: "127.0.0.1", Port: 7001, BusPort: 17001})
+
+	var buf bytes.Buffer
+	sent := state.Ping(MsgPing, "")
+	if err := WriteMessage(&buf, sent); err != nil {
+		t.Fatal(err)
+	}
+	received, err := ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(received, sent) || len(received.Gossip) != 1 {
+		t.Errorf("Unexpected message after a round trip: %+v", received)
+	}
+
+	for _, invalid := range []string{"XXXX\x00\x00\x00\x02{}", "RCmb\x00\x00\x00\x02{}", "RCmb\xff\xff\xff\xff"} {
+		if _, err := ReadMessage(bytes.NewBufferString(invalid)); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestProcessMessages(t *testing.T) {
+	first := NewState(Node{Host: "127.0.0.1", Port: 7000, BusPort: 17000})
+	second := NewState(Node{Port: 7001, BusPort: 17001})
+	third := NewState(Node{Host: "127.0.0.1", Port: 7002, BusPort: 17002})
+	first.AddSlots([]int{0, 1})
+	second.AddSlots([]int{2})
+
+	// A ping from an unknown node is ignored; a meet adds it with the
+	// address it came from when it does not know its own
+	if second.Process(first.Ping(MsgPing, ""), "127.0.0.1") {
+		t.Error("Expected a ping from an unknown node to be ignored")
+	}
+	if !first.Process(second.Ping(MsgMeet, ""), "127.0.0.2") {
+		t.Fatal("Expected a meet to add its sender")
+	}
+	if n, known := first.Node(second.MyID()); !known || n.Host != "127.0.0.2" || n.Port != 7001 {
+		t.Errorf("Unexpected node after a meet: %+v", n)
+	}
+	if owner, _ := first.Owner(2); owner.ID != second.MyID() {
+		t.Errorf("Expected slot 2 to be served by the sender, got %q", owner.ID)
+	}
+
+	// Gossip spreads the nodes a known sender knows
+	third.Process(first.Ping(MsgMeet, ""), "127.0.0.1")
+	if _, known := third.Node(second.MyID()); !known {
+		t.Error("Expected gossip to add the second node")
+	}
+	if info := third.Info(); info.KnownNodes != 3 || info.SlotsAssigned != 2 || info.Size != 1 || info.OK {
+		t.Errorf("Unexpected info %+v", info)
+	}
+
+	// A claim with a greater config epoch takes over a served slot
+	if first.Process(second.Ping(MsgPong, ""), "127.0.0.2") {
+		t.Error("Expected an unchanged sender to change nothing")
+	}
+	if n, _ := first.Node(second.MyID()); n.PongReceived == 0 {
+		t.Error("Expected a pong to be recorded")
+	}
+	claim := second.Ping(MsgPing, "")
+	claim.Sender.ConfigEpoch, claim.Sender.CurrentEpoch = 1, 1
+	claim.Sender.Slots.Set(0)
+	first.Process(claim, "127.0.0.2")
+	if owner, _ := first.Owner(0); owner.ID != second.MyID() || first.Info().CurrentEpoch != 1 {
+		t.Errorf("Expected slot 0 to move to the node with the greater epoch, got %q", owner.ID)
+	}
+	if owner, _ := first.Owner(1); owner.ID != first.MyID() {
+		t.Error("Expected unclaimed slots to stay")
+	}
+}
+
+func TestAddSlots(t *testing.T) {
+	state := NewState(Node{})
+	if err := state.AddSlots([]int{5, 6}); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.AddSlots([]int{7, 6}); err == nil {
+		t.Error("Expected a busy slot to be rejected")
+	}
+	if _, served := state.Owner(7); served {
+		t.Error("Expected a rejected ADDSLOTS to assign nothing")
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	state := NewState(Node{Host: "127.0.0.1", Port: 7000, BusPort: 17000})
+	state.AddSlots([]int{0, 1, 2, 10, 16383})
+	other := NewState(Node{Host: "127.0.0.1", Port: 7001, BusPort: 17001})
+	other.AddSlots([]int{3})
+	pong := other.Ping(MsgMeet, "")
+	pong.Sender.CurrentEpoch = 7
+	state.Process(pong, "")
+
+	if err := state.SetMigrating(10, other.MyID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.SetImporting(3, other.MyID()); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Unmarshal(state.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, migrating := loaded.Migrating(10); !migrating || target.ID != other.MyID() || !loaded.Importing(3) {
+		t.Error("Expected the slots in transit to be kept")
+	}
+	if !bytes.Equal(loaded.Marshal(), state.Marshal()) || loaded.MyID() != state.MyID() {
+		t.Errorf("Unexpected state after a round trip:\n%s\nwant:\n%s", loaded.Marshal(), state.Marshal())
+	}
+	if loaded.Info().CurrentEpoch != 7 {
+		t.Error("Expected the current epoch to be kept")
+	}
+
+	for _, invalid := range []string{
+		"",
+		"not-an-id 127.0.0.1:7000@17000 myself,master - 0 0 0 connected\n",
+		state.FormatNodes() + state.FormatNodes(),
+		"vars currentEpoch x\n" + state.FormatNodes(),
+	} {
+		if _, err := Unmarshal([]byte(invalid)); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestMoveSlot(t *testing.T) {
+	source := NewState(Node{Host: "127.0.0.1", Port: 7000, BusPort: 17000})
+	source.AddSlots([]int{5})
+	target := NewState(Node{Host: "127.0.0.1", Port: 7001, BusPort: 17001})
+	source.Process(target.Ping(MsgMeet, ""), "")
+	target.Process(source.Ping(MsgMeet, ""), "")
+
+	if err := source.SetImporting(5, target.MyID()); err == nil {
+		t.Error("Expected the owner of a slot not to import it")
+	}
+	if err := target.SetMigrating(5, source.MyID()); err == nil {
+		t.Error("Expected a node not to migrate a slot it does not serve")
+	}
+	if err := target.SetImporting(5, NewNodeID()); err == nil {
+		t.Error("Expected an unknown node to be rejected")
+	}
+	if err := target.SetImporting(5, source.MyID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.SetMigrating(5, target.MyID()); err != nil {
+		t.Fatal(err)
+	}
+	if source.Stable(5) || target.Stable(5) {
+		t.Error("Expected the slot to be in transit")
+	}
+	if !strings.Contains(source.FormatNodes(), fmt.Sprintf("[5->-%s]", target.MyID())) ||
+		!strings.Contains(target.FormatNodes(), fmt.Sprintf("[5-<-%s]", source.MyID())) {
+		t.Errorf("Expected CLUSTER NODES to show the slot in transit:\n%s%s", source.FormatNodes(), target.FormatNodes())
+	}
+
+	// The new owner bumps its epoch, so its claim wins over the old one
+	if err := target.SetNode(5, target.MyID()); err != nil {
+		t.Fatal(err)
+	}
+	if target.Myself().ConfigEpoch == 0 || !target.Stable(5) {
+		t.Errorf("Expected the new owner to serve the slot with a new epoch, got epoch %d", target.Myself().ConfigEpoch)
+	}
+	source.Process(target.Ping(MsgPing, source.MyID()), "")
+	if owner, _ := source.Owner(5); owner.ID != target.MyID() {
+		t.Errorf("Expected the old owner to learn the new one, got %.8s", owner.ID)
+	}
+	if _, migrating := source.Migrating(5); migrating {
+		t.Error("Expected the old owner to stop migrating the slot")
+	}
+}
+
+// slotRange returns the slots from start to end
+func slotRange(start, end int) []int {
+	slots := make([]int, 0, end-start+1)
+	for slot := start; slot <= end; slot++ {
+		slots = append(slots, slot)
+	}
+	return slots
+}
+
+// introduce makes every state know every other one
+func introduce(states ...*State) {
+	for _, a := range states {
+		for _, b := range states {
+			a.Process(b.Ping(MsgMeet, ""), "127.0.0.1")
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	masters := make([]*State, 3)
+	for i := range masters {
+		masters[i] = NewState(Node{Host: "127.0.0.1", Port: 7000 + i, BusPort: 17000 + i})
+		masters[i].AddSlots(slotRange(i*SlotCount/3, (i+1)*SlotCount/3-1))
+	}
+	a, b, c := masters[0], masters[1], masters[2]
+	replica := NewState(Node{Host: "127.0.0.1", Port: 7003, BusPort: 17003})
+	introduce(a, b, c, replica)
+	if err := replica.SetMaster(c.MyID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetMaster(a.MyID()); err == nil {
+		t.Error("Expected a master serving slots not to become a replica")
+	}
+	introduce(a, b, c, replica)
+	if replicas, _ := a.Replicas(c.MyID()); len(replicas) != 1 || replicas[0].ID != replica.MyID() {
+		t.Fatalf("Expected the replica of c to be known, got %+v", replicas)
+	}
+	if !strings.Contains(a.FormatNodes(), replica.MyID()+" 127.0.0.1:7003@17003 slave "+c.MyID()) {
+		t.Errorf("Expected CLUSTER NODES to show the replica:\n%s", a.FormatNodes())
+	}
+
+	// A node silent for longer than the timeout is failing for whoever
+	// pinged it, and failed once a majority of the masters agree
+	timeout := time.Second
+	now := time.Now()
+	for _, m := range []*State{a, b} {
+		m.PingSent(c.MyID(), now.Add(-2*timeout))
+	}
+	if changed, failed := a.Cron(now, timeout); changed || len(failed) != 0 {
+		t.Error("Expected a single master not to reach the failure quorum")
+	}
+	if info := a.Info(); info.SlotsPFail != SlotCount/3+1 || !info.OK {
+		t.Errorf("Expected the slots of c to be failing, got %+v", info)
+	}
+	b.Cron(now, timeout)
+	a.Process(b.Ping(MsgPing, a.MyID()), "127.0.0.1")
+	if count, _ := a.CountFailureReports(c.MyID()); count != 1 {
+		t.Errorf("Expected one failure report, got %d", count)
+	}
+	if _, failed := a.Cron(now, timeout); len(failed) != 1 || failed[0] != c.MyID() {
+		t.Fatalf("Expected c to fail, got %v", failed)
+	}
+	if info := a.Info(); info.SlotsFail != SlotCount/3+1 || info.OK {
+		t.Errorf("Expected the cluster to be down, got %+v", info)
+	}
+
+	// The replica learns, wins a majority of the votes and takes over
+	fail := a.Ping(MsgFail, "")
+	fail.Failing = c.MyID()
+	for _, n := range []*State{b, replica} {
+		n.Process(fail, "127.0.0.1")
+		if failed, _ := n.Node(c.MyID()); !failed.Fail {
+			t.Fatal("Expected a fail message to flag the node")
+		}
+	}
+	epoch := replica.StartElection()
+	request := replica.Ping(MsgAuthRequest, "")
+	votes := 0
+	for _, m := range masters {
+		m.Process(request, "127.0.0.1")
+		if m.Vote(request, now, timeout) {
+			votes++
+		}
+		if m.Vote(request, now, timeout) {
+			t.Error("Expected a master to vote once per epoch")
+		}
+	}
+	if votes != replica.VotesNeeded() {
+		t.Fatalf("Expected %d votes, got %d", replica.VotesNeeded(), votes)
+	}
+	if err := replica.Promote(epoch); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range masters {
+		n.Process(replica.Ping(MsgPing, n.MyID()), "127.0.0.1")
+	}
+	if owner, _ := a.Owner(SlotCount - 1); owner.ID != replica.MyID() || !a.OK() {
+		t.Errorf("Expected the replica to serve the slots of c, got %.8s", owner.ID)
+	}
+	if myself := c.Myself(); myself.MasterID != replica.MyID() {
+		t.Error("Expected the old master to become a replica of the new one")
+	}
+	if err := replica.Promote(epoch); err == nil {
+		t.Error("Expected a master not to be promoted")
+	}
+
+	loaded, err := Unmarshal(a.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old, _ := loaded.Node(c.MyID()); !old.Fail {
+		t.Error("Expected the failure of a node to be kept")
+	}
+	if owner, _ := loaded.Owner(SlotCount - 1); owner.ID != replica.MyID() || !owner.IsMaster() {
+		t.Error("Expected the promoted replica to be kept")
+	}
+	loaded, err = Unmarshal(c.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if myself := loaded.Myself(); myself.MasterID != replica.MyID() {
+		t.Error("Expected the role of a replica to be kept")
+	}
+}
+
+// Property-based test setup for the slot index
+func TestIndexedStore(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	// For any writes, the keys listed for a slot are the live keys of the
+	// store in that slot
+	properties.Property("index lists the live keys of each slot", prop.ForAll(
+		func(initial, set, deleted []string) bool {
+			kv := store.NewInMemoryStore()
+			for _, key := range initial {
+				kv.Set(key, "value")
+			}
+			index, err := NewIndexedStore(kv)
+			if err != nil {
+				return false
+			}
+			for _, key := range set {
+				index.Set(key, "value")
+			}
+			index.SetWithExpiry("expired", "value", 1)
+			index.Delete("")
+			index.DeleteMultiple(deleted)
+
+			want := make(map[int][]string)
+			for key := range kv.Snapshot() {
+				want[KeySlot(key)] = append(want[KeySlot(key)], key)
+			}
+			for slot, keys := range want {
+				sort.Strings(keys)
+				if !reflect.DeepEqual(index.KeysInSlot(slot, len(keys)+1), keys) ||
+					index.CountKeysInSlot(slot) != len(keys) ||
+					len(index.KeysInSlot(slot, 1)) != 1 {
+					return false
+				}
+			}
+			return index.CountKeysInSlot(KeySlot("expired")) == len(want[KeySlot("expired")])
+		},
+		gen.SliceOf(gen.OneConstOf("a", "b", "c", "{a}b", "{a}c", "foo", "bar")),
+		gen.SliceOf(gen.OneConstOf("a", "d", "{a}d", "{b}a", "baz")),
+		gen.SliceOf(gen.OneConstOf("a", "b", "{a}b", "baz", "missing")),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
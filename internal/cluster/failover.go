@@ -0,0 +1,216 @@
+package cluster
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Failure detection works as in Redis. A node that has not answered a ping
+// for longer than the node timeout is flagged PFAIL by whoever pinged it.
+// Masters gossip the flags they see, and once a majority of the masters
+// serving slots flag the same node, it is FAIL: the node that noticed
+// tells every other one, and the replicas of a failed master run an
+// election to take over its slots.
+
+// Cron flags the nodes that have not answered a ping within timeout and
+// the ones a majority of the masters agree are down, and clears the flags
+// of nodes that are back. It returns whether the configuration changed and
+// the nodes newly found to have failed, which every node must be told
+// about.
+func (s *State) Cron(now time.Time, timeout time.Duration) (bool, []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	nowMs, timeoutMs := now.UnixMilli(), timeout.Milliseconds()
+	changed := false
+	var failed []string
+	for id, n := range s.nodes {
+		if id == s.myself {
+			continue
+		}
+		if n.PingSent != 0 && nowMs-n.PingSent > timeoutMs {
+			n.PFail = true
+		}
+		for reporter, at := range s.reports[id] {
+			if nowMs-at > 2*timeoutMs {
+				delete(s.reports[id], reporter)
+			}
+		}
+
+		switch {
+		case n.PFail && !n.Fail && s.failureReports(id) >= s.quorum():
+			n.Fail, n.PFail, n.FailTime = true, false, nowMs
+			failed = append(failed, id)
+			changed = true
+		case n.Fail && !n.PFail && n.PongReceived > n.FailTime:
+			// A master serving slots stays failed for a while, leaving its
+			// replicas time to take over
+			if !n.IsMaster() || s.owned[id] == 0 || nowMs-n.FailTime > 2*timeoutMs {
+				n.Fail, n.FailTime = false, 0
+				changed = true
+			}
+		}
+	}
+	sort.Strings(failed)
+	return changed, failed
+}
+
+// failureReports counts the masters that flag a node as failing, this one
+// included; the caller must hold the mutex
+func (s *State) failureReports(id string) int {
+	count := len(s.reports[id])
+	if s.nodes[s.myself].IsMaster() && s.nodes[id].PFail {
+		count++
+	}
+	return count
+}
+
+// CountFailureReports returns how many other masters flag a node as
+// failing
+func (s *State) CountFailureReports(id string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, known := s.nodes[id]; !known {
+		return 0, fmt.Errorf("Unknown node %s", id)
+	}
+	return len(s.reports[id]), nil
+}
+
+// Replicas returns the nodes replicating a master, ordered by ID
+func (s *State) Replicas(id string) ([]Node, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	master, known := s.nodes[id]
+	if !known {
+		return nil, fmt.Errorf("Unknown node %s", id)
+	}
+	if !master.IsMaster() {
+		return nil, fmt.Errorf("The specified node is not a master")
+	}
+	var replicas []Node
+	for _, n := range s.nodes {
+		if n.MasterID == id {
+			replicas = append(replicas, *n)
+		}
+	}
+	sort.Slice(replicas, func(i, j int) bool { return replicas[i].ID < replicas[j].ID })
+	return replicas, nil
+}
+
+// SetMaster makes this node a replica of the master with the given ID.
+// Only a master serving no slots can become a replica.
+func (s *State) SetMaster(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.checkOtherNode(id); err != nil {
+		return err
+	}
+	if !s.nodes[id].IsMaster() {
+		return fmt.Errorf("I can only replicate a master, not a replica.")
+	}
+	myself := s.nodes[s.myself]
+	if myself.IsMaster() && s.owned[s.myself] > 0 {
+		return fmt.Errorf("To set a master the node must be empty and without assigned slots.")
+	}
+	myself.MasterID = id
+	s.migrating, s.importing = new([SlotCount]string), new([SlotCount]string)
+	return nil
+}
+
+// StartElection moves this node to a new epoch to be elected in, and
+// returns it
+func (s *State) StartElection() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.currentEpoch++
+	return s.currentEpoch
+}
+
+// VotesNeeded returns how many masters must vote for a replica to take
+// over from its master: a majority of the masters serving slots
+func (s *State) VotesNeeded() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.quorum()
+}
+
+// Rank returns how many replicas of this node's master announced a greater
+// replication offset than offset, this node's own: the replica with the
+// most data runs its election first
+func (s *State) Rank(offset int64) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	master := s.nodes[s.myself].MasterID
+	rank := 0
+	for id, n := range s.nodes {
+		if id != s.myself && master != "" && n.MasterID == master && n.ReplOffset > offset {
+			rank++
+		}
+	}
+	return rank
+}
+
+// Vote decides whether this node votes for the replica that sent an
+// election request, already processed. A master serving slots votes once
+// per epoch, for a replica of a failed master, or of any master when the
+// request is forced, and not again for a replica of the same master within
+// twice the node timeout, so a failed election is not immediately
+// followed by a competing one.
+func (s *State) Vote(request *Message, now time.Time, timeout time.Duration) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.nodes[s.myself].IsMaster() || s.owned[s.myself] == 0 {
+		return false
+	}
+	if request.Sender.CurrentEpoch < s.currentEpoch || s.lastVoteEpoch == s.currentEpoch {
+		return false
+	}
+	requester, known := s.nodes[request.Sender.ID]
+	if !known || requester.IsMaster() {
+		return false
+	}
+	master, known := s.nodes[requester.MasterID]
+	if !known || s.owned[master.ID] == 0 || !master.Fail && !request.Force {
+		return false
+	}
+	if at, voted := s.voted[master.ID]; voted && now.UnixMilli()-at < 2*timeout.Milliseconds() {
+		return false
+	}
+	s.lastVoteEpoch = s.currentEpoch
+	s.voted[master.ID] = now.UnixMilli()
+	return true
+}
+
+// Promote makes this node, a replica, a master taking over every slot of
+// its master with the config epoch it was elected in. The claim wins over
+// the old master's, which becomes a replica of this node once it learns.
+func (s *State) Promote(epoch uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.promote(epoch)
+}
+
+// TakeOver makes this node, a replica, a master taking over the slots of
+// its master without an election, in a new epoch of its own
+func (s *State) TakeOver() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.currentEpoch++
+	return s.promote(s.currentEpoch)
+}
+
+// promote implements Promote; the caller must hold the mutex
+func (s *State) promote(epoch uint64) error {
+	myself := s.nodes[s.myself]
+	if myself.IsMaster() {
+		return fmt.Errorf("I'm already a master")
+	}
+	for slot, owner := range s.slots {
+		if owner == myself.MasterID {
+			s.setOwner(slot, s.myself)
+		}
+	}
+	myself.MasterID = ""
+	myself.ConfigEpoch = max(myself.ConfigEpoch, epoch)
+	return nil
+}
@@ -0,0 +1,129 @@
+package cluster
+
+import (
+	"sort"
+	"sync"
+
+	"redis-like-server/internal/store"
+)
+
+// IndexedStore is a store that also indexes its keys by hash slot, so the
+// keys of a slot can be listed when the slot moves to another node without
+// scanning the whole keyspace
+type IndexedStore struct {
+	store.KeyValueStore
+
+	mutex sync.Mutex
+	slots [SlotCount]map[string]struct{}
+}
+
+// NewIndexedStore indexes the keys kv already holds and returns it wrapped
+func NewIndexedStore(kv store.KeyValueStore) (*IndexedStore, error) {
+	s := &IndexedStore{KeyValueStore: kv}
+	view := kv.View()
+	defer view.Release()
+	view.Range(func(key string, _ store.Item) bool {
+		s.add(key)
+		return true
+	})
+	if err := view.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// add indexes a key
+func (s *IndexedStore) add(key string) {
+	slot := KeySlot(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.slots[slot] == nil {
+		s.slots[slot] = make(map[string]struct{})
+	}
+	s.slots[slot][key] = struct{}{}
+}
+
+// remove drops a key from the index
+func (s *IndexedStore) remove(key string) {
+	slot := KeySlot(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.slots[slot], key)
+}
+
+// Set stores a key-value pair, clearing any expiry, and reports whether it
+// created the key
+func (s *IndexedStore) Set(key, value string) bool {
+	created := s.KeyValueStore.Set(key, value)
+	s.add(key)
+	return created
+}
+
+// SetWithExpiry stores a key-value pair that expires at expireAt
+func (s *IndexedStore) SetWithExpiry(key, value string, expireAt int64) {
+	s.KeyValueStore.SetWithExpiry(key, value, expireAt)
+	s.add(key)
+}
+
+// Delete removes a key, reporting whether it existed
+func (s *IndexedStore) Delete(key string) bool {
+	s.remove(key)
+	return s.KeyValueStore.Delete(key)
+}
+
+// DeleteMultiple removes keys, returning how many existed
+func (s *IndexedStore) DeleteMultiple(keys []string) int {
+	for _, key := range keys {
+		s.remove(key)
+	}
+	return s.KeyValueStore.DeleteMultiple(keys)
+}
+
+// KeysInSlot returns up to count live keys of a slot in order
+func (s *IndexedStore) KeysInSlot(slot, count int) []string {
+	keys := s.liveKeys(slot)
+	sort.Strings(keys)
+	if len(keys) > count {
+		keys = keys[:count]
+	}
+	return keys
+}
+
+// CountKeysInSlot returns the number of live keys of a slot
+func (s *IndexedStore) CountKeysInSlot(slot int) int {
+	return len(s.liveKeys(slot))
+}
+
+// liveKeys returns the keys of a slot that did not expire, dropping the
+// others from the index
+func (s *IndexedStore) liveKeys(slot int) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	keys := make([]string, 0, len(s.slots[slot]))
+	for key := range s.slots[slot] {
+		// A key set meanwhile exists by the time it would be indexed again,
+		// as stores are written before the index
+		if !s.Exists(key) {
+			delete(s.slots[slot], key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// LastError passes on the write error of the wrapped store
+func (s *IndexedStore) LastError() error {
+	if reporter, ok := s.KeyValueStore.(store.ErrorReporter); ok {
+		return reporter.LastError()
+	}
+	return nil
+}
+
+// Info passes on the statistics of the wrapped store
+func (s *IndexedStore) Info() []string {
+	if reporter, ok := s.KeyValueStore.(store.Reporter); ok {
+		return reporter.Info()
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package cluster
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// IDLength is the length of a node ID in hexadecimal characters
+const IDLength = 40
+
+// BusPortOffset is the distance between a node's client port and its
+// cluster bus port unless configured otherwise
+const BusPortOffset = 10000
+
+// NewNodeID returns a random node ID
+func NewNodeID() string {
+	id := make([]byte, IDLength/2)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// validID reports whether id looks like a node ID
+func validID(id string) bool {
+	if len(id) != IDLength {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// Node is a node of the cluster as known by this one
+type Node struct {
+	ID      string
+	Host    string
+	Port    int
+	BusPort int
+	// ConfigEpoch orders the claims of nodes on slots: the claim with the
+	// greater epoch wins
+	ConfigEpoch uint64
+	// PingSent is when the last unanswered ping was sent and PongReceived
+	// when the last pong arrived, in Unix milliseconds, 0 for never
+	PingSent     int64
+	PongReceived int64
+	// Connected reports whether the bus link to the node is up
+	Connected bool
+	// MasterID is the ID of the master the node replicates, empty for a
+	// master
+	MasterID string
+	// PFail reports that this node has had no pong from the node for longer
+	// than the node timeout, and Fail that a majority of the masters agreed
+	// it is down, since FailTime in Unix milliseconds
+	PFail    bool
+	Fail     bool
+	FailTime int64
+	// ReplOffset is the replication offset the node last announced
+	ReplOffset int64
+}
+
+// IsMaster reports whether the node is a master
+func (n Node) IsMaster() bool {
+	return n.MasterID == ""
+}
+
+// Addr returns the address clients reach the node at
+func (n Node) Addr() string {
+	return net.JoinHostPort(n.Host, strconv.Itoa(n.Port))
+}
+
+// BusAddr returns the address of the node's cluster bus
+func (n Node) BusAddr() string {
+	return net.JoinHostPort(n.Host, strconv.Itoa(n.BusPort))
+}
+
+// linkState renders Connected as in CLUSTER NODES
+func (n Node) linkState() string {
+	if n.Connected {
+		return "connected"
+	}
+	return "disconnected"
+}
+
+// NodeLine is a node as described by a line of CLUSTER NODES
+type NodeLine struct {
+	Node   Node
+	Myself bool
+	Ranges []SlotRange
+	// Migrating and Importing map the slots the node is moving out and in
+	// to the node on the other end; only a node's own line lists them
+	Migrating map[int]string
+	Importing map[int]string
+}
+
+// String renders the line as in CLUSTER NODES
+func (l NodeLine) String() string {
+	n := l.Node
+	var flags []string
+	if l.Myself {
+		flags = append(flags, "myself")
+	}
+	master := "-"
+	if n.IsMaster() {
+		flags = append(flags, "master")
+	} else {
+		flags = append(flags, "slave")
+		master = n.MasterID
+	}
+	switch {
+	case n.Fail:
+		flags = append(flags, "fail")
+	case n.PFail:
+		flags = append(flags, "fail?")
+	}
+	fields := []string{
+		n.ID,
+		fmt.Sprintf("%s:%d@%d", n.Host, n.Port, n.BusPort),
+		strings.Join(flags, ","),
+		master,
+		strconv.FormatInt(n.PingSent, 10),
+		strconv.FormatInt(n.PongReceived, 10),
+		strconv.FormatUint(n.ConfigEpoch, 10),
+		n.linkState(),
+	}
+	for _, r := range l.Ranges {
+		fields = append(fields, r.String())
+	}
+	for _, slot := range sortedSlots(l.Migrating) {
+		fields = append(fields, fmt.Sprintf("[%d->-%s]", slot, l.Migrating[slot]))
+	}
+	for _, slot := range sortedSlots(l.Importing) {
+		fields = append(fields, fmt.Sprintf("[%d-<-%s]", slot, l.Importing[slot]))
+	}
+	return strings.Join(fields, " ")
+}
+
+// sortedSlots returns the slots of a map in order
+func sortedSlots(slots map[int]string) []int {
+	sorted := make([]int, 0, len(slots))
+	for slot := range slots {
+		sorted = append(sorted, slot)
+	}
+	sort.Ints(sorted)
+	return sorted
+}
+
+// ParseNode parses a line of CLUSTER NODES. The ping and link fields and
+// the fail? flag are not kept, as they only make sense on the node that
+// wrote the line and at that time.
+func ParseNode(line string) (NodeLine, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 8 {
+		return NodeLine{}, fmt.Errorf("expected at least 8 fields, got %d", len(fields))
+	}
+	if !validID(fields[0]) {
+		return NodeLine{}, fmt.Errorf("invalid node ID %q", fields[0])
+	}
+	l := NodeLine{Node: Node{ID: fields[0]}}
+
+	addr, busPort, found := strings.Cut(fields[1], "@")
+	colon := strings.LastIndexByte(addr, ':')
+	if !found || colon < 0 {
+		return NodeLine{}, fmt.Errorf("invalid node address %q", fields[1])
+	}
+	l.Node.Host = strings.Trim(addr[:colon], "[]")
+	var err error
+	if l.Node.Port, err = strconv.Atoi(addr[colon+1:]); err != nil {
+		return NodeLine{}, fmt.Errorf("invalid node address %q", fields[1])
+	}
+	if l.Node.BusPort, err = strconv.Atoi(busPort); err != nil {
+		return NodeLine{}, fmt.Errorf("invalid node address %q", fields[1])
+	}
+	if l.Node.ConfigEpoch, err = strconv.ParseUint(fields[6], 10, 64); err != nil {
+		return NodeLine{}, fmt.Errorf("invalid config epoch %q", fields[6])
+	}
+	for _, flag := range strings.Split(fields[2], ",") {
+		switch flag {
+		case "myself":
+			l.Myself = true
+		case "slave":
+			if !validID(fields[3]) {
+				return NodeLine{}, fmt.Errorf("invalid master ID %q", fields[3])
+			}
+			l.Node.MasterID = fields[3]
+		case "fail":
+			l.Node.Fail = true
+		}
+	}
+
+	for _, field := range fields[8:] {
+		if transfer, found := strings.CutPrefix(field, "["); found {
+			if err := l.parseTransfer(strings.TrimSuffix(transfer, "]")); err != nil {
+				return NodeLine{}, err
+			}
+			continue
+		}
+		r, err := ParseSlotRange(field)
+		if err != nil {
+			return NodeLine{}, err
+		}
+		l.Ranges = append(l.Ranges, r)
+	}
+	return l, nil
+}
+
+// parseTransfer parses a slot being moved, "slot->-id" or "slot-<-id"
+func (l *NodeLine) parseTransfer(transfer string) error {
+	target := &l.Migrating
+	slot, id, found := strings.Cut(transfer, "->-")
+	if !found {
+		target = &l.Importing
+		slot, id, found = strings.Cut(transfer, "-<-")
+	}
+	parsed, err := ParseSlot(slot)
+	if !found || err != nil || !validID(id) {
+		return fmt.Errorf("invalid slot transfer %q", transfer)
+	}
+	if *target == nil {
+		*target = make(map[int]string)
+	}
+	(*target)[parsed] = id
+	return nil
+}
@@ -0,0 +1,132 @@
+// Package cluster holds the parts of cluster mode that do not depend on the
+// server: hash slots, the nodes of the cluster and which slots they serve,
+// the nodes configuration file and the messages of the cluster bus
+package cluster
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SlotCount is the number of hash slots the keyspace is split into
+const SlotCount = 16384
+
+// crc16Table is the table of the CRC16-CCITT (XMODEM) checksum Redis uses
+// to map keys to slots
+var crc16Table = func() [256]uint16 {
+	var table [256]uint16
+	for i := range table {
+		crc := uint16(i) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc16 returns the CRC16-CCITT (XMODEM) checksum of data
+func crc16(data string) uint16 {
+	var crc uint16
+	for i := 0; i < len(data); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^data[i]]
+	}
+	return crc
+}
+
+// KeySlot returns the hash slot of key. When the key holds a non-empty
+// hash tag, the part between the first "{" and the next "}", only the tag
+// is hashed, so keys sharing a tag share a slot.
+func KeySlot(key string) int {
+	return int(crc16(HashTag(key)) % SlotCount)
+}
+
+// HashTag returns the part of key that is hashed: its non-empty hash tag,
+// or the whole key when it has none
+func HashTag(key string) string {
+	if open := strings.IndexByte(key, '{'); open >= 0 {
+		if length := strings.IndexByte(key[open+1:], '}'); length > 0 {
+			return key[open+1 : open+1+length]
+		}
+	}
+	return key
+}
+
+// ParseSlot parses a slot number
+func ParseSlot(value string) (int, error) {
+	slot, err := strconv.Atoi(value)
+	if err != nil || slot < 0 || slot >= SlotCount {
+		return 0, fmt.Errorf("invalid or out of range slot %q", value)
+	}
+	return slot, nil
+}
+
+// SlotRange is a range of slots from Start to End inclusive
+type SlotRange struct {
+	Start int
+	End   int
+}
+
+// String renders the range as in CLUSTER NODES: a single slot or
+// "start-end"
+func (r SlotRange) String() string {
+	if r.Start == r.End {
+		return strconv.Itoa(r.Start)
+	}
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+// ParseSlotRange parses a single slot or a "start-end" range
+func ParseSlotRange(value string) (SlotRange, error) {
+	start, end, isRange := strings.Cut(value, "-")
+	first, err := ParseSlot(start)
+	if err != nil {
+		return SlotRange{}, err
+	}
+	last := first
+	if isRange {
+		if last, err = ParseSlot(end); err != nil {
+			return SlotRange{}, err
+		}
+	}
+	if last < first {
+		return SlotRange{}, fmt.Errorf("invalid slot range %q", value)
+	}
+	return SlotRange{Start: first, End: last}, nil
+}
+
+// Ranges groups sorted slots into contiguous ranges
+func Ranges(slots []int) []SlotRange {
+	var ranges []SlotRange
+	for _, slot := range slots {
+		if n := len(ranges); n > 0 && ranges[n-1].End == slot-1 {
+			ranges[n-1].End = slot
+			continue
+		}
+		ranges = append(ranges, SlotRange{Start: slot, End: slot})
+	}
+	return ranges
+}
+
+// SlotBitmap is a set of slots, as sent on the cluster bus
+type SlotBitmap []byte
+
+// NewSlotBitmap returns an empty set of slots
+func NewSlotBitmap() SlotBitmap {
+	return make(SlotBitmap, SlotCount/8)
+}
+
+// Set adds slot to the set
+func (b SlotBitmap) Set(slot int) {
+	b[slot/8] |= 1 << (slot % 8)
+}
+
+// Has reports whether slot is in the set; a malformed bitmap holds nothing
+func (b SlotBitmap) Has(slot int) bool {
+	return len(b) == SlotCount/8 && b[slot/8]&(1<<(slot%8)) != 0
+}
@@ -0,0 +1,684 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shard is a node with the slots it serves
+type Shard struct {
+	Node   Node
+	Ranges []SlotRange
+}
+
+// Info summarizes the state of the cluster as in CLUSTER INFO
+type Info struct {
+	// OK reports whether every slot is served by a node that did not fail
+	OK            bool
+	SlotsAssigned int
+	// SlotsPFail and SlotsFail count the slots served by nodes flagged as
+	// failing and failed
+	SlotsPFail int
+	SlotsFail  int
+	KnownNodes int
+	// Size is the number of nodes serving slots
+	Size         int
+	CurrentEpoch uint64
+	MyEpoch      uint64
+}
+
+// State is the view this node has of the cluster: the nodes it knows and
+// the node serving each slot. It is safe for concurrent use; Node values
+// it returns are copies.
+type State struct {
+	mutex        sync.Mutex
+	myself       string
+	nodes        map[string]*Node
+	slots        [SlotCount]string
+	assigned     int
+	currentEpoch uint64
+	// owned counts the slots served by each node serving any
+	owned map[string]int
+	// migrating and importing hold, for the slots this node is moving out
+	// or in, the node on the other end
+	migrating *[SlotCount]string
+	importing *[SlotCount]string
+	// reports holds, for each node flagged as failing by masters, when
+	// each of them last said so, in Unix milliseconds
+	reports map[string]map[string]int64
+	// lastVoteEpoch is the last epoch this node voted in, and voted when it
+	// last voted for a replica of each master, in Unix milliseconds
+	lastVoteEpoch uint64
+	voted         map[string]int64
+}
+
+// NewState returns the state of a new node alone in its cluster
+func NewState(myself Node) *State {
+	if myself.ID == "" {
+		myself.ID = NewNodeID()
+	}
+	myself.Connected = true
+	s := newState()
+	s.myself, s.nodes[myself.ID] = myself.ID, &myself
+	return s
+}
+
+// newState returns a state without any node
+func newState() *State {
+	return &State{
+		nodes:     make(map[string]*Node),
+		owned:     make(map[string]int),
+		migrating: new([SlotCount]string),
+		importing: new([SlotCount]string),
+		reports:   make(map[string]map[string]int64),
+		voted:     make(map[string]int64),
+	}
+}
+
+// setOwner makes a node serve a slot, or nobody for an empty ID; the
+// caller must hold the mutex
+func (s *State) setOwner(slot int, id string) {
+	if old := s.slots[slot]; old != "" {
+		if s.owned[old]--; s.owned[old] == 0 {
+			delete(s.owned, old)
+		}
+		s.assigned--
+	}
+	if id != "" {
+		s.owned[id]++
+		s.assigned++
+	}
+	s.slots[slot] = id
+}
+
+// MyID returns the ID of this node
+func (s *State) MyID() string {
+	return s.myself
+}
+
+// Myself returns this node
+func (s *State) Myself() Node {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return *s.nodes[s.myself]
+}
+
+// SetMyPorts updates the client and bus ports this node announces,
+// reporting whether they changed
+func (s *State) SetMyPorts(port, busPort int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	myself := s.nodes[s.myself]
+	changed := myself.Port != port || myself.BusPort != busPort
+	myself.Port, myself.BusPort = port, busPort
+	return changed
+}
+
+// LearnMyHost sets the host this node announces, as seen by a node that
+// reached it, unless it is already known
+func (s *State) LearnMyHost(host string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	myself := s.nodes[s.myself]
+	if myself.Host != "" || host == "" {
+		return false
+	}
+	myself.Host = host
+	return true
+}
+
+// Node returns the node with the given ID
+func (s *State) Node(id string) (Node, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n, known := s.nodes[id]
+	if !known {
+		return Node{}, false
+	}
+	return *n, true
+}
+
+// Nodes returns every known node, this one included, ordered by ID
+func (s *State) Nodes() []Node {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	nodes := make([]Node, 0, len(s.nodes))
+	for _, n := range s.nodes {
+		nodes = append(nodes, *n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes
+}
+
+// AddNode adds a node to the cluster, reporting false when it was already
+// known
+func (s *State) AddNode(n Node) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, known := s.nodes[n.ID]; known || !validID(n.ID) {
+		return false
+	}
+	n.Connected, n.PingSent, n.PongReceived = false, 0, 0
+	s.nodes[n.ID] = &n
+	return true
+}
+
+// SetConnected records whether the bus link to a node is up
+func (s *State) SetConnected(id string, connected bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if n, known := s.nodes[id]; known && id != s.myself {
+		n.Connected = connected
+	}
+}
+
+// PingSent records that a ping was sent to a node, unless one is already
+// waiting for its pong
+func (s *State) PingSent(id string, now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if n, known := s.nodes[id]; known && n.PingSent == 0 {
+		n.PingSent = now.UnixMilli()
+	}
+}
+
+// Owner returns the node serving slot
+func (s *State) Owner(slot int) (Node, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.slots[slot] == "" {
+		return Node{}, false
+	}
+	return *s.nodes[s.slots[slot]], true
+}
+
+// AddSlots makes this node serve slots, none of which may be served
+// already
+func (s *State) AddSlots(slots []int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, slot := range slots {
+		if s.slots[slot] != "" {
+			return fmt.Errorf("Slot %d is already busy", slot)
+		}
+	}
+	if !s.nodes[s.myself].IsMaster() {
+		return fmt.Errorf("Only masters can serve slots")
+	}
+	for _, slot := range slots {
+		s.setOwner(slot, s.myself)
+	}
+	return nil
+}
+
+// Migrating returns the node a slot served here is moving to
+func (s *State) Migrating(slot int) (Node, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.migrating[slot] == "" {
+		return Node{}, false
+	}
+	return *s.nodes[s.migrating[slot]], true
+}
+
+// Importing reports whether a slot is moving to this node
+func (s *State) Importing(slot int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.importing[slot] != ""
+}
+
+// Stable reports whether this node serves a slot that is not moving out
+// or in, so which keys exist does not decide where commands run
+func (s *State) Stable(slot int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.slots[slot] == s.myself && s.migrating[slot] == "" && s.importing[slot] == ""
+}
+
+// checkOtherNode fails unless id is a known node other than this one;
+// the caller must hold the mutex
+func (s *State) checkOtherNode(id string) error {
+	if _, known := s.nodes[id]; !known {
+		return fmt.Errorf("I don't know about node %s", id)
+	}
+	if id == s.myself {
+		return fmt.Errorf("I'm the node %s", id)
+	}
+	return nil
+}
+
+// SetMigrating starts moving a slot this node serves to another node
+func (s *State) SetMigrating(slot int, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.slots[slot] != s.myself {
+		return fmt.Errorf("I'm not the owner of hash slot %d", slot)
+	}
+	if err := s.checkOtherNode(id); err != nil {
+		return err
+	}
+	s.migrating[slot] = id
+	return nil
+}
+
+// SetImporting starts moving a slot served by another node to this one
+func (s *State) SetImporting(slot int, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.slots[slot] == s.myself {
+		return fmt.Errorf("I'm already the owner of hash slot %d", slot)
+	}
+	if err := s.checkOtherNode(id); err != nil {
+		return err
+	}
+	s.importing[slot] = id
+	return nil
+}
+
+// SetStable stops moving a slot in or out
+func (s *State) SetStable(slot int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.migrating[slot], s.importing[slot] = "", ""
+}
+
+// SetNode assigns a slot to a node, ending its move. A node taking a slot
+// it was importing bumps its config epoch, so its claim wins over the
+// claim of the node that served it.
+func (s *State) SetNode(slot int, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, known := s.nodes[id]; !known {
+		return fmt.Errorf("I don't know about node %s", id)
+	}
+	if !s.nodes[id].IsMaster() {
+		return fmt.Errorf("Target node is not a master")
+	}
+	if id == s.myself && s.importing[slot] != "" {
+		s.currentEpoch++
+		s.nodes[s.myself].ConfigEpoch = s.currentEpoch
+	}
+	s.setOwner(slot, id)
+	s.migrating[slot], s.importing[slot] = "", ""
+	return nil
+}
+
+// OK reports whether the cluster serves every slot: each is assigned to a
+// node that did not fail and, for a master, a majority of the masters
+// serving slots is reachable, so a master cut off in a minority stops
+// taking writes its replicas may be promoted over
+func (s *State) OK() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.ok()
+}
+
+// ok implements OK; the caller must hold the mutex
+func (s *State) ok() bool {
+	if s.assigned != SlotCount {
+		return false
+	}
+	reachable := 0
+	for id := range s.owned {
+		n := s.nodes[id]
+		if n.Fail {
+			return false
+		}
+		if id == s.myself || !n.PFail {
+			reachable++
+		}
+	}
+	return !s.nodes[s.myself].IsMaster() || reachable >= s.quorum()
+}
+
+// quorum returns the majority of the masters serving slots; the caller
+// must hold the mutex
+func (s *State) quorum() int {
+	return len(s.owned)/2 + 1
+}
+
+// ranges returns the slots served by a node; the caller must hold the
+// mutex
+func (s *State) ranges(id string) []SlotRange {
+	var slots []int
+	for slot, owner := range s.slots {
+		if owner == id {
+			slots = append(slots, slot)
+		}
+	}
+	return Ranges(slots)
+}
+
+// Shards returns every node with the slots it serves, the nodes serving
+// slots first in slot order
+func (s *State) Shards() []Shard {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	shards := make([]Shard, 0, len(s.nodes))
+	for id, n := range s.nodes {
+		shards = append(shards, Shard{Node: *n, Ranges: s.ranges(id)})
+	}
+	sort.Slice(shards, func(i, j int) bool {
+		a, b := shards[i], shards[j]
+		if len(a.Ranges) == 0 || len(b.Ranges) == 0 {
+			if len(a.Ranges) != len(b.Ranges) {
+				return len(b.Ranges) == 0
+			}
+			return a.Node.ID < b.Node.ID
+		}
+		return a.Ranges[0].Start < b.Ranges[0].Start
+	})
+	return shards
+}
+
+// Info summarizes the state of the cluster
+func (s *State) Info() Info {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	info := Info{
+		OK:            s.ok(),
+		SlotsAssigned: s.assigned,
+		KnownNodes:    len(s.nodes),
+		Size:          len(s.owned),
+		CurrentEpoch:  s.currentEpoch,
+		MyEpoch:       s.nodes[s.myself].ConfigEpoch,
+	}
+	for id, count := range s.owned {
+		switch n := s.nodes[id]; {
+		case n.Fail:
+			info.SlotsFail += count
+		case n.PFail:
+			info.SlotsPFail += count
+		}
+	}
+	return info
+}
+
+// Ping returns a message of the given type describing this node, with
+// gossip about every other node but the receiver
+func (s *State) Ping(kind MessageType, receiver string) *Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	myself := s.nodes[s.myself]
+	slots := NewSlotBitmap()
+	for slot, owner := range s.slots {
+		if owner == s.myself {
+			slots.Set(slot)
+		}
+	}
+	m := &Message{Type: kind, Sender: Header{
+		ID:           myself.ID,
+		Host:         myself.Host,
+		Port:         myself.Port,
+		BusPort:      myself.BusPort,
+		ConfigEpoch:  myself.ConfigEpoch,
+		CurrentEpoch: s.currentEpoch,
+		Slots:        slots,
+		MasterID:     myself.MasterID,
+	}}
+	for id, n := range s.nodes {
+		if id != s.myself && id != receiver {
+			m.Gossip = append(m.Gossip, Gossip{
+				ID:      n.ID,
+				Host:    n.Host,
+				Port:    n.Port,
+				BusPort: n.BusPort,
+				PFail:   n.PFail,
+				Fail:    n.Fail,
+			})
+		}
+	}
+	return m
+}
+
+// Process applies a message received on the cluster bus from remoteHost,
+// reporting whether the configuration changed. Messages from unknown nodes
+// are ignored unless they are a meet, which adds the sender; messages from
+// known nodes update its address, role and slots, add the nodes it gossips
+// about and, from a master, count as its reports of failing nodes.
+func (s *State) Process(m *Message, remoteHost string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	header := m.Sender
+	if header.ID == s.myself {
+		return false
+	}
+	host := header.Host
+	if host == "" {
+		host = remoteHost
+	}
+
+	changed := false
+	sender, known := s.nodes[header.ID]
+	if !known {
+		if m.Type != MsgMeet {
+			return false
+		}
+		sender = &Node{ID: header.ID}
+		s.nodes[header.ID] = sender
+		changed = true
+	}
+	if sender.Host != host || sender.Port != header.Port || sender.BusPort != header.BusPort {
+		sender.Host, sender.Port, sender.BusPort = host, header.Port, header.BusPort
+		changed = true
+	}
+	if m.Type == MsgPong {
+		sender.PingSent, sender.PongReceived = 0, time.Now().UnixMilli()
+		sender.PFail = false
+	}
+	if header.MasterID != sender.MasterID {
+		sender.MasterID = header.MasterID
+		changed = true
+	}
+	sender.ReplOffset = header.ReplOffset
+	if header.CurrentEpoch > s.currentEpoch {
+		s.currentEpoch = header.CurrentEpoch
+		changed = true
+	}
+	if header.ConfigEpoch != sender.ConfigEpoch {
+		sender.ConfigEpoch = header.ConfigEpoch
+		changed = true
+	}
+	myself := s.nodes[s.myself]
+	// Two masters sharing a config epoch could both win a slot; the one
+	// with the smaller ID moves on to a new epoch. Nodes that never took a
+	// slot over share epoch 0 and claim distinct slots, so they are left be.
+	if sender.IsMaster() && myself.IsMaster() && sender.ConfigEpoch == myself.ConfigEpoch &&
+		myself.ConfigEpoch != 0 && s.myself < sender.ID {
+		s.currentEpoch++
+		myself.ConfigEpoch = s.currentEpoch
+		changed = true
+	}
+
+	if sender.IsMaster() && s.claim(sender, header.Slots) {
+		changed = true
+	}
+
+	for _, g := range m.Gossip {
+		if g.ID == s.myself || !validID(g.ID) {
+			continue
+		}
+		if _, known := s.nodes[g.ID]; !known {
+			s.nodes[g.ID] = &Node{ID: g.ID, Host: g.Host, Port: g.Port, BusPort: g.BusPort}
+			changed = true
+		}
+		if sender.IsMaster() {
+			s.report(g.ID, sender.ID, g.PFail || g.Fail)
+		}
+	}
+
+	if m.Type == MsgFail {
+		if failing, known := s.nodes[m.Failing]; known && m.Failing != s.myself && !failing.Fail {
+			failing.Fail, failing.PFail, failing.FailTime = true, false, time.Now().UnixMilli()
+			changed = true
+		}
+	}
+	return changed
+}
+
+// claim applies the claim of a master on slots: it wins over an unserved
+// slot and over the claim of a node with a smaller config epoch. A master
+// losing its last slot this way, as when a replica took over from it,
+// becomes a replica of the winner, and so do the replicas of a master that
+// lost its last slot. The caller must hold the mutex.
+func (s *State) claim(sender *Node, slots SlotBitmap) bool {
+	changed := false
+	myself := s.nodes[s.myself]
+	lostMine, lostMaster := false, false
+	for slot := range s.slots {
+		if !slots.Has(slot) || s.slots[slot] == sender.ID {
+			continue
+		}
+		owner := s.slots[slot]
+		if owner != "" && s.nodes[owner].ConfigEpoch >= sender.ConfigEpoch {
+			continue
+		}
+		if owner == s.myself {
+			s.migrating[slot] = ""
+			lostMine = true
+		}
+		if owner != "" && owner == myself.MasterID {
+			lostMaster = true
+		}
+		s.setOwner(slot, sender.ID)
+		changed = true
+	}
+	if lostMine && s.owned[s.myself] == 0 || lostMaster && s.owned[myself.MasterID] == 0 {
+		myself.MasterID = sender.ID
+		s.migrating, s.importing = new([SlotCount]string), new([SlotCount]string)
+	}
+	return changed
+}
+
+// report records whether a master flags a node as failing; the caller
+// must hold the mutex
+func (s *State) report(id, reporter string, failing bool) {
+	if !failing {
+		delete(s.reports[id], reporter)
+		return
+	}
+	if s.reports[id] == nil {
+		s.reports[id] = make(map[string]int64)
+	}
+	s.reports[id][reporter] = time.Now().UnixMilli()
+}
+
+// FormatNodes renders the nodes as CLUSTER NODES does, one line each
+func (s *State) FormatNodes() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.formatNodes()
+}
+
+// formatNodes renders the nodes ordered by ID; the caller must hold the
+// mutex
+func (s *State) formatNodes() string {
+	ids := make([]string, 0, len(s.nodes))
+	for id := range s.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var b strings.Builder
+	for _, id := range ids {
+		line := NodeLine{Node: *s.nodes[id], Myself: id == s.myself, Ranges: s.ranges(id)}
+		if line.Myself {
+			line.Migrating, line.Importing = transfers(s.migrating), transfers(s.importing)
+		}
+		b.WriteString(line.String())
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// transfers returns the slots being moved and the node on the other end
+func transfers(slots *[SlotCount]string) map[int]string {
+	moving := make(map[int]string)
+	for slot, id := range slots {
+		if id != "" {
+			moving[slot] = id
+		}
+	}
+	return moving
+}
+
+// Marshal renders the state as a nodes configuration file: the lines of
+// CLUSTER NODES followed by the epochs
+func (s *State) Marshal() []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return []byte(s.formatNodes() + fmt.Sprintf("vars currentEpoch %d lastVoteEpoch %d\n", s.currentEpoch, s.lastVoteEpoch))
+}
+
+// Unmarshal parses a nodes configuration file written by Marshal. Links
+// start disconnected, as after a restart.
+func Unmarshal(data []byte) (*State, error) {
+	s := newState()
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "vars ") {
+			fields := strings.Fields(line)[1:]
+			for i := 0; i+1 < len(fields); i += 2 {
+				var epoch *uint64
+				switch fields[i] {
+				case "currentEpoch":
+					epoch = &s.currentEpoch
+				case "lastVoteEpoch":
+					epoch = &s.lastVoteEpoch
+				default:
+					continue
+				}
+				value, err := strconv.ParseUint(fields[i+1], 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid %s %q", number, fields[i], fields[i+1])
+				}
+				*epoch = value
+			}
+			continue
+		}
+		parsed, err := ParseNode(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", number, err)
+		}
+		n := parsed.Node
+		if _, duplicate := s.nodes[n.ID]; duplicate {
+			return nil, fmt.Errorf("line %d: duplicate node %s", number, n.ID)
+		}
+		if parsed.Myself {
+			if s.myself != "" {
+				return nil, fmt.Errorf("line %d: more than one node is myself", number)
+			}
+			s.myself = n.ID
+			n.Connected = true
+			for slot, id := range parsed.Migrating {
+				s.migrating[slot] = id
+			}
+			for slot, id := range parsed.Importing {
+				s.importing[slot] = id
+			}
+		}
+		s.nodes[n.ID] = &n
+		for _, r := range parsed.Ranges {
+			for slot := r.Start; slot <= r.End; slot++ {
+				s.setOwner(slot, n.ID)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if s.myself == "" {
+		return nil, fmt.Errorf("no node is myself")
+	}
+	return s, nil
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,15 +18,41 @@ type ConnectionManager interface {
 	GetActiveCount() int
 	CleanupStaleConnections()
 	CloseAllConnections()
+	GetPubSub() PubSubRegistry
 }
 
 // ClientConnection wraps a network connection with additional metadata
 type ClientConnection struct {
-	conn       net.Conn
-	id         string
-	lastActive time.Time
-	reader     *bufio.Reader
-	writer     *bufio.Writer
+	conn         net.Conn
+	id           string
+	lastActive   time.Time
+	reader       *bufio.Reader
+	writer       *bufio.Writer
+	writeMutex   sync.Mutex
+	writeTimeout time.Duration
+
+	// Pub/sub channel and pattern subscriptions, guarded by subMutex
+	subMutex sync.RWMutex
+	channels map[string]struct{}
+	patterns map[string]struct{}
+
+	// Published messages waiting to be written, guarded by queueMutex; a
+	// goroutine started by the first one writes them in order
+	queueMutex  sync.Mutex
+	queue       [][]byte
+	queuedBytes int
+	draining    bool
+
+	// failed is set once a published message could not be written or the
+	// client fell too far behind; nothing more is delivered to it
+	failed atomic.Bool
+
+	// replica is set once the client turned into a replica with PSYNC
+	replica atomic.Bool
+
+	// asking is set by ASKING and lets the next command reach a slot this
+	// node is importing
+	asking atomic.Bool
 }
 
 // GetID returns the connection ID
@@ -58,19 +85,46 @@ func (cc *ClientConnection) GetLastActive() time.Time {
 	return cc.lastActive
 }
 
-// Close closes the connection and flushes any pending writes
+// SetWriteTimeout sets the deadline applied to every write on the connection
+func (cc *ClientConnection) SetWriteTimeout(timeout time.Duration) {
+	cc.writeMutex.Lock()
+	defer cc.writeMutex.Unlock()
+	cc.writeTimeout = timeout
+}
+
+// Close closes the connection and flushes any pending writes. A write in
+// progress, possibly stuck on a client not reading, is not waited for:
+// closing the underlying connection makes it fail.
 func (cc *ClientConnection) Close() error {
-	// Flush any pending writes
-	if cc.writer != nil {
-		cc.writer.Flush()
+	if cc.writeMutex.TryLock() {
+		// Flush any pending writes
+		if cc.writer != nil {
+			cc.writer.Flush()
+		}
+		cc.writeMutex.Unlock()
 	}
 	// Close the underlying connection
 	return cc.conn.Close()
 }
 
-// Write writes data to the connection and flushes
+// Write writes data to the connection and flushes, after any published
+// messages still queued for the client.
+// It is safe to call from multiple goroutines, e.g. a command reply racing a published message.
 func (cc *ClientConnection) Write(data []byte) error {
+	cc.writeMutex.Lock()
+	defer cc.writeMutex.Unlock()
+	if err := cc.writeQueuedLocked(); err != nil {
+		return err
+	}
+	return cc.writeLocked(data)
+}
+
+// writeLocked writes and flushes data; the caller must hold writeMutex
+func (cc *ClientConnection) writeLocked(data []byte) error {
 	cc.UpdateLastActive()
+	if cc.writeTimeout > 0 {
+		cc.conn.SetWriteDeadline(time.Now().Add(cc.writeTimeout))
+	}
 	_, err := cc.writer.Write(data)
 	if err != nil {
 		return err
@@ -78,6 +132,39 @@ func (cc *ClientConnection) Write(data []byte) error {
 	return cc.writer.Flush()
 }
 
+// SubscriptionCount returns the number of channels and patterns the client is subscribed to
+func (cc *ClientConnection) SubscriptionCount() int {
+	cc.subMutex.RLock()
+	defer cc.subMutex.RUnlock()
+	return len(cc.channels) + len(cc.patterns)
+}
+
+// IsSubscriber reports whether the client is in subscriber mode
+func (cc *ClientConnection) IsSubscriber() bool {
+	return cc.SubscriptionCount() > 0
+}
+
+// SetReplica marks the client as a replica receiving the replication stream
+func (cc *ClientConnection) SetReplica() {
+	cc.replica.Store(true)
+}
+
+// IsReplica reports whether the client is a replica
+func (cc *ClientConnection) IsReplica() bool {
+	return cc.replica.Load()
+}
+
+// SetAsking lets the next command of the client reach a slot being imported
+func (cc *ClientConnection) SetAsking() {
+	cc.asking.Store(true)
+}
+
+// TakeAsking reports whether ASKING preceded the current command, clearing
+// the flag as it only holds for one command
+func (cc *ClientConnection) TakeAsking() bool {
+	return cc.asking.Swap(false)
+}
+
 // IsStale checks if the connection is stale based on timeout
 func (cc *ClientConnection) IsStale(timeout time.Duration) bool {
 	return time.Since(cc.lastActive) > timeout
@@ -88,6 +175,7 @@ type DefaultConnectionManager struct {
 	connections map[string]*ClientConnection
 	mutex       sync.RWMutex
 	maxClients  int
+	pubsub      PubSubRegistry
 }
 
 // NewConnectionManager creates a new connection manager
@@ -95,9 +183,15 @@ func NewConnectionManager(maxClients int) ConnectionManager {
 	return &DefaultConnectionManager{
 		connections: make(map[string]*ClientConnection),
 		maxClients:  maxClients,
+		pubsub:      NewPubSubRegistry(),
 	}
 }
 
+// GetPubSub returns the pub/sub registry shared by all managed connections
+func (cm *DefaultConnectionManager) GetPubSub() PubSubRegistry {
+	return cm.pubsub
+}
+
 // AddConnection adds a new client connection
 func (cm *DefaultConnectionManager) AddConnection(conn net.Conn) *ClientConnection {
 	cm.mutex.Lock()
@@ -129,14 +223,20 @@ func (cm *DefaultConnectionManager) AddConnection(conn net.Conn) *ClientConnecti
 // RemoveConnection removes a client connection
 func (cm *DefaultConnectionManager) RemoveConnection(id string) {
 	cm.mutex.Lock()
-	defer cm.mutex.Unlock()
-	
-	if clientConn, exists := cm.connections[id]; exists {
-		// Close the client connection (which handles flushing and closing)
-		clientConn.Close()
+	clientConn, exists := cm.connections[id]
+	if exists {
+		// Drop any pub/sub subscriptions so publishers stop writing to it
+		cm.pubsub.RemoveClient(clientConn)
 		// Remove from connections map
 		delete(cm.connections, id)
 	}
+	cm.mutex.Unlock()
+	
+	// Close the client connection (which handles flushing and closing)
+	// outside the lock, so a slow client cannot hold up the others
+	if exists {
+		clientConn.Close()
+	}
 }
 
 // GetConnection retrieves a connection by ID
@@ -160,7 +260,6 @@ func (cm *DefaultConnectionManager) GetActiveCount() int {
 // CleanupStaleConnections removes stale connections
 func (cm *DefaultConnectionManager) CleanupStaleConnections() {
 	cm.mutex.Lock()
-	defer cm.mutex.Unlock()
 	
 	staleTimeout := 5 * time.Minute // Connections inactive for 5 minutes are considered stale
 	
@@ -174,23 +273,39 @@ func (cm *DefaultConnectionManager) CleanupStaleConnections() {
 	}
 	
 	// Remove stale connections
+	var stale []*ClientConnection
 	for _, id := range staleIDs {
 		if clientConn, exists := cm.connections[id]; exists {
-			clientConn.Close()
+			cm.pubsub.RemoveClient(clientConn)
+			stale = append(stale, clientConn)
 			delete(cm.connections, id)
 		}
 	}
+	cm.mutex.Unlock()
+	
+	closeConnections(stale)
 }
 
 // CloseAllConnections closes all active connections
 func (cm *DefaultConnectionManager) CloseAllConnections() {
 	cm.mutex.Lock()
-	defer cm.mutex.Unlock()
+	var all []*ClientConnection
+	for id, clientConn := range cm.connections {
+		cm.pubsub.RemoveClient(clientConn)
+		all = append(all, clientConn)
+		delete(cm.connections, id)
+	}
+	cm.mutex.Unlock()
 	
 	// Close all connections
-	for id, clientConn := range cm.connections {
+	closeConnections(all)
+}
+
+// closeConnections closes connections already removed from the manager,
+// after its lock is released so a client stuck in a write holds up no one
+func closeConnections(conns []*ClientConnection) {
+	for _, clientConn := range conns {
 		clientConn.Close()
-		delete(cm.connections, id)
 	}
 }
 
@@ -1,8 +1,14 @@
 package connection
 
 import (
+	"bufio"
 	"net"
+	"strings"
 	"testing"
+	"time"
+
+	"redis-like-server/internal/glob"
+	"redis-like-server/internal/resp2"
 
 	"github.com/leanovate/gopter"
 	"github.com/leanovate/gopter/gen"
@@ -200,4 +206,220 @@ func TestConnectionCleanupOnUnexpectedDisconnection(t *testing.T) {
 	))
 
 	properties.TestingRun(t, gopter.ConsoleReporter(false))
-}
\ No newline at end of file
+}
+
+// Property-based test setup for pub/sub message delivery
+func TestPubSubMessageDelivery(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	// For any number of subscribers, PUBLISH should deliver the message to every
+	// subscriber and report the receiver count, and removing a connection
+	// should drop its subscriptions
+	properties.Property("publish reaches every subscriber", prop.ForAll(
+		func(subscriberCount int, message string) bool {
+			cm := NewConnectionManager(subscriberCount + 5)
+			registry := cm.GetPubSub()
+
+			clients := make([]*ClientConnection, subscriberCount)
+			readers := make([]*bufio.Reader, subscriberCount)
+			for i := 0; i < subscriberCount; i++ {
+				server, client := net.Pipe()
+				defer client.Close()
+				clients[i] = cm.AddConnection(server)
+				readers[i] = bufio.NewReader(client)
+
+				// net.Pipe is synchronous, so read the confirmation while subscribing
+				done := make(chan error, 1)
+				go func(cc *ClientConnection) { done <- registry.Subscribe(cc, []string{"news"}) }(clients[i])
+				if _, err := readRESP(readers[i]); err != nil || <-done != nil {
+					return false
+				}
+			}
+
+			if registry.NumSub("news") != subscriberCount {
+				return false
+			}
+
+			received := make(chan bool, subscriberCount)
+			for i := 0; i < subscriberCount; i++ {
+				go func(reader *bufio.Reader) {
+					value, err := readRESP(reader)
+					received <- err == nil && len(value.Array) == 3 &&
+						value.Array[0].Str == "message" && value.Array[1].Str == "news" && value.Array[2].Str == message
+				}(readers[i])
+			}
+
+			if registry.Publish("news", message) != subscriberCount {
+				return false
+			}
+			for i := 0; i < subscriberCount; i++ {
+				if !<-received {
+					return false
+				}
+			}
+
+			for _, cc := range clients {
+				cm.RemoveConnection(cc.GetID())
+			}
+			return registry.NumSub("news") == 0 && len(registry.Channels("")) == 0
+		},
+		gen.IntRange(1, 5),
+		gen.AlphaString(),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
+
+// subscribe subscribes a new piped connection to channel, returning it with
+// the client end of the pipe and a reader over it
+func subscribe(t *testing.T, cm ConnectionManager, channel string) (*ClientConnection, net.Conn, *bufio.Reader) {
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	cc := cm.AddConnection(server)
+	reader := bufio.NewReader(client)
+	done := make(chan error, 1)
+	go func() { done <- cm.GetPubSub().Subscribe(cc, []string{channel}) }()
+	if _, err := readRESP(reader); err != nil || <-done != nil {
+		t.Fatalf("SUBSCRIBE %s failed: %v", channel, err)
+	}
+	return cc, client, reader
+}
+
+func TestPublishDoesNotWaitForSubscribers(t *testing.T) {
+	cm := NewConnectionManager(10)
+	registry := cm.GetPubSub()
+
+	// The first subscriber never reads, and net.Pipe writes block until read
+	subscribe(t, cm, "news")
+	_, _, reader := subscribe(t, cm, "news")
+
+	published := make(chan int, 1)
+	go func() { published <- registry.Publish("news", "first") + registry.Publish("news", "second") }()
+	select {
+	case receivers := <-published:
+		if receivers != 4 {
+			t.Errorf("PUBLISH counted %d receivers, want 4", receivers)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("PUBLISH waited for a subscriber that does not read")
+	}
+	for _, want := range []string{"first", "second"} {
+		if value, err := readRESP(reader); err != nil || value.Array[2].Str != want {
+			t.Fatalf("The reading subscriber got %v, %v, want %q", value, err, want)
+		}
+	}
+}
+
+func TestPublishCountsOnlyDeliveries(t *testing.T) {
+	cm := NewConnectionManager(10)
+	registry := cm.GetPubSub()
+	_, gone, _ := subscribe(t, cm, "news")
+	_, _, reader := subscribe(t, cm, "news")
+	go func() {
+		for {
+			if _, err := readRESP(reader); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Once writing to the subscriber that went away fails, it is no longer
+	// counted
+	gone.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for registry.Publish("news", "hello") != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("PUBLISH kept counting a subscriber whose connection failed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A subscriber falling too far behind is dropped as well
+	slow, _, _ := subscribe(t, cm, "slow")
+	message := strings.Repeat("x", 1<<20)
+	for i := 0; registry.Publish("slow", message) == 1; i++ {
+		if i > 2*maxQueuedBytes/len(message) {
+			t.Fatal("A subscriber that does not read was never dropped")
+		}
+	}
+	if !slow.failed.Load() {
+		t.Error("The subscriber that fell behind was not failed")
+	}
+}
+
+func TestClosingStuckSubscriberDoesNotBlock(t *testing.T) {
+	cm := NewConnectionManager(10)
+	registry := cm.GetPubSub()
+
+	// The subscriber never reads, so the write of the message blocks
+	stuck, _, _ := subscribe(t, cm, "news")
+	server, client := net.Pipe()
+	defer client.Close()
+	other := cm.AddConnection(server)
+	registry.Publish("news", "hello")
+
+	removed := make(chan struct{})
+	go func() {
+		cm.RemoveConnection(stuck.GetID())
+		cm.CloseAllConnections()
+		close(removed)
+	}()
+	select {
+	case <-removed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Closing a subscriber stuck in a write blocked")
+	}
+	if cm.GetConnection(other.GetID()) != nil || cm.GetActiveCount() != 0 {
+		t.Error("Connections were left after closing them all")
+	}
+}
+
+// readRESP reads a single RESP2 value written to a client connection
+func readRESP(reader *bufio.Reader) (*resp2.RESPValue, error) {
+	return resp2.NewRESP2Parser().Parse(reader)
+}
+
+// Property-based test setup for the pattern subscription index
+func TestPatternIndexMatchesGlob(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	// For any set of patterns and channel, the prefix index should find exactly
+	// the patterns a linear glob scan would find, and be empty after removal
+	properties.Property("pattern index agrees with linear scan", prop.ForAll(
+		func(prefixes []string, wildcards []int, channel string) bool {
+			idx := newPatternIndex()
+			client := &ClientConnection{id: "client"}
+
+			suffixes := []string{"*", "?", "", "[a-c]*", "*x"}
+			patterns := make(map[string]bool)
+			for i, prefix := range prefixes {
+				pattern := prefix + suffixes[wildcards[i%len(wildcards)]]
+				patterns[pattern] = true
+				idx.add(pattern, client)
+			}
+			if idx.count != len(patterns) {
+				return false
+			}
+
+			found := make(map[string]bool)
+			for _, match := range idx.match(channel) {
+				found[match.pattern] = true
+			}
+			for pattern := range patterns {
+				if found[pattern] != glob.Match(pattern, channel) {
+					return false
+				}
+			}
+
+			for pattern := range patterns {
+				idx.remove(pattern, client)
+			}
+			return idx.count == 0 && len(idx.root.children) == 0 && len(idx.root.patterns) == 0
+		},
+		gen.SliceOf(gen.OneConstOf("", "a", "ab", "abc", "b", "news.")),
+		gen.SliceOfN(3, gen.IntRange(0, 4)),
+		gen.OneConstOf("", "a", "ab", "abc", "abcx", "news.sport", "bx"),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
@@ -0,0 +1,129 @@
+package connection
+
+import "redis-like-server/internal/glob"
+
+// patternIndex indexes glob pattern subscriptions by their literal prefix.
+// Publishing walks the trie along the channel name, so only patterns whose
+// literal prefix is a prefix of the channel are glob-matched; patterns that
+// start with a wildcard live at the root and are always checked.
+type patternIndex struct {
+	root  *patternNode
+	count int
+}
+
+// patternNode is a trie node holding the patterns whose literal prefix ends here
+type patternNode struct {
+	children map[byte]*patternNode
+	patterns map[string]map[string]*ClientConnection
+}
+
+// newPatternIndex creates an empty pattern index
+func newPatternIndex() *patternIndex {
+	return &patternIndex{root: &patternNode{}}
+}
+
+// add subscribes the client to the pattern
+func (idx *patternIndex) add(pattern string, client *ClientConnection) {
+	node := idx.root
+	prefix := literalPrefix(pattern)
+	for i := 0; i < len(prefix); i++ {
+		if node.children == nil {
+			node.children = make(map[byte]*patternNode)
+		}
+		child, exists := node.children[prefix[i]]
+		if !exists {
+			child = &patternNode{}
+			node.children[prefix[i]] = child
+		}
+		node = child
+	}
+
+	if node.patterns == nil {
+		node.patterns = make(map[string]map[string]*ClientConnection)
+	}
+	subscribers, exists := node.patterns[pattern]
+	if !exists {
+		subscribers = make(map[string]*ClientConnection)
+		node.patterns[pattern] = subscribers
+		idx.count++
+	}
+	subscribers[client.id] = client
+}
+
+// remove unsubscribes the client from the pattern, pruning empty trie nodes
+func (idx *patternIndex) remove(pattern string, client *ClientConnection) {
+	prefix := literalPrefix(pattern)
+	path := make([]*patternNode, 0, len(prefix)+1)
+	node := idx.root
+	path = append(path, node)
+	for i := 0; i < len(prefix); i++ {
+		child, exists := node.children[prefix[i]]
+		if !exists {
+			return
+		}
+		node = child
+		path = append(path, node)
+	}
+
+	subscribers, exists := node.patterns[pattern]
+	if !exists {
+		return
+	}
+	delete(subscribers, client.id)
+	if len(subscribers) > 0 {
+		return
+	}
+	delete(node.patterns, pattern)
+	idx.count--
+
+	// Walk back up removing nodes that no longer lead to any pattern
+	for i := len(path) - 1; i > 0; i-- {
+		current := path[i]
+		if len(current.patterns) > 0 || len(current.children) > 0 {
+			break
+		}
+		delete(path[i-1].children, prefix[i-1])
+	}
+}
+
+// patternMatch is a pattern subscriber that matched a published channel
+type patternMatch struct {
+	pattern string
+	client  *ClientConnection
+}
+
+// match returns every (pattern, subscriber) pair whose pattern matches the channel
+func (idx *patternIndex) match(channel string) []patternMatch {
+	var matches []patternMatch
+	node := idx.root
+	for i := 0; ; i++ {
+		for pattern, subscribers := range node.patterns {
+			if !glob.Match(pattern, channel) {
+				continue
+			}
+			for _, client := range subscribers {
+				matches = append(matches, patternMatch{pattern: pattern, client: client})
+			}
+		}
+		if i == len(channel) {
+			break
+		}
+		child, exists := node.children[channel[i]]
+		if !exists {
+			break
+		}
+		node = child
+	}
+	return matches
+}
+
+// literalPrefix returns the part of a glob pattern before its first special character
+func literalPrefix(pattern string) string {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?', '[', '\\':
+			return pattern[:i]
+		}
+	}
+	return pattern
+}
@@ -0,0 +1,431 @@
+package connection
+
+import (
+	"net"
+	"sort"
+	"sync"
+
+	"redis-like-server/internal/glob"
+	"redis-like-server/internal/resp2"
+)
+
+// PubSubRegistry tracks channel subscriptions and delivers published messages to subscribers
+type PubSubRegistry interface {
+	Subscribe(client *ClientConnection, channels []string) error
+	Unsubscribe(client *ClientConnection, channels []string) error
+	PSubscribe(client *ClientConnection, patterns []string) error
+	PUnsubscribe(client *ClientConnection, patterns []string) error
+	Publish(channel, message string) int
+	Channels(pattern string) []string
+	NumSub(channel string) int
+	NumPat() int
+	RemoveClient(client *ClientConnection)
+}
+
+// DefaultPubSubRegistry is the default implementation of PubSubRegistry
+type DefaultPubSubRegistry struct {
+	channels map[string]map[string]*ClientConnection
+	patterns *patternIndex
+	mutex    sync.RWMutex
+	parser   resp2.RESP2Parser
+}
+
+// NewPubSubRegistry creates a new pub/sub registry
+func NewPubSubRegistry() PubSubRegistry {
+	return &DefaultPubSubRegistry{
+		channels: make(map[string]map[string]*ClientConnection),
+		patterns: newPatternIndex(),
+		parser:   resp2.NewRESP2Parser(),
+	}
+}
+
+// Subscribe subscribes the client to the given channels and writes one
+// confirmation reply per channel. The client's write lock is held for the
+// whole operation so that no published message can overtake a confirmation.
+func (r *DefaultPubSubRegistry) Subscribe(client *ClientConnection, channels []string) error {
+	client.writeMutex.Lock()
+	defer client.writeMutex.Unlock()
+
+	for _, channel := range channels {
+		r.mutex.Lock()
+		subscribers, exists := r.channels[channel]
+		if !exists {
+			subscribers = make(map[string]*ClientConnection)
+			r.channels[channel] = subscribers
+		}
+		subscribers[client.id] = client
+		count := client.addChannel(channel)
+		r.mutex.Unlock()
+
+		if err := client.writeLocked(r.parser.Serialize(pubSubReply("subscribe", channel, count))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unsubscribe removes the client from the given channels, or from every
+// channel it is subscribed to when none are given, writing one reply per channel
+func (r *DefaultPubSubRegistry) Unsubscribe(client *ClientConnection, channels []string) error {
+	client.writeMutex.Lock()
+	defer client.writeMutex.Unlock()
+
+	if len(channels) == 0 {
+		channels = client.subscribedChannels()
+		if len(channels) == 0 {
+			// Redis still replies when there was nothing to unsubscribe from
+			return client.writeLocked(r.parser.Serialize(emptyUnsubscribeReply("unsubscribe", client.SubscriptionCount())))
+		}
+	}
+
+	// Messages published before the unsubscription go out before its reply
+	if err := client.writeQueuedLocked(); err != nil {
+		return err
+	}
+	for _, channel := range channels {
+		r.mutex.Lock()
+		r.removeSubscriber(channel, client)
+		count := client.removeChannel(channel)
+		r.mutex.Unlock()
+
+		if err := client.writeLocked(r.parser.Serialize(pubSubReply("unsubscribe", channel, count))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PSubscribe subscribes the client to the given glob patterns and writes one
+// confirmation reply per pattern
+func (r *DefaultPubSubRegistry) PSubscribe(client *ClientConnection, patterns []string) error {
+	client.writeMutex.Lock()
+	defer client.writeMutex.Unlock()
+
+	for _, pattern := range patterns {
+		r.mutex.Lock()
+		r.patterns.add(pattern, client)
+		count := client.addPattern(pattern)
+		r.mutex.Unlock()
+
+		if err := client.writeLocked(r.parser.Serialize(pubSubReply("psubscribe", pattern, count))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PUnsubscribe removes the client from the given patterns, or from every
+// pattern it is subscribed to when none are given, writing one reply per pattern
+func (r *DefaultPubSubRegistry) PUnsubscribe(client *ClientConnection, patterns []string) error {
+	client.writeMutex.Lock()
+	defer client.writeMutex.Unlock()
+
+	if len(patterns) == 0 {
+		patterns = client.subscribedPatterns()
+		if len(patterns) == 0 {
+			return client.writeLocked(r.parser.Serialize(emptyUnsubscribeReply("punsubscribe", client.SubscriptionCount())))
+		}
+	}
+
+	if err := client.writeQueuedLocked(); err != nil {
+		return err
+	}
+	for _, pattern := range patterns {
+		r.mutex.Lock()
+		r.patterns.remove(pattern, client)
+		count := client.removePattern(pattern)
+		r.mutex.Unlock()
+
+		if err := client.writeLocked(r.parser.Serialize(pubSubReply("punsubscribe", pattern, count))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxQueuedBytes bounds the published messages waiting for one subscriber.
+// A subscriber falling further behind is disconnected, as Redis does past its
+// pub/sub output buffer limit.
+const maxQueuedBytes = 32 << 20
+
+// Publish queues a message for every subscriber of the channel and every
+// client with a matching pattern subscription, returning the number of
+// deliveries queued. Subscribers whose connection failed are not counted, and
+// a slow one never holds up the publisher.
+func (r *DefaultPubSubRegistry) Publish(channel, message string) int {
+	r.mutex.RLock()
+	subscribers := make([]*ClientConnection, 0, len(r.channels[channel]))
+	for _, client := range r.channels[channel] {
+		subscribers = append(subscribers, client)
+	}
+	matches := r.patterns.match(channel)
+	r.mutex.RUnlock()
+
+	// Queue outside the registry lock so a full queue closing its client
+	// cannot stall (un)subscriptions
+	receivers := 0
+	if len(subscribers) > 0 {
+		payload := r.parser.Serialize(&resp2.RESPValue{
+			Type: resp2.Array,
+			Array: []resp2.RESPValue{
+				{Type: resp2.BulkString, Str: "message"},
+				{Type: resp2.BulkString, Str: channel},
+				{Type: resp2.BulkString, Str: message},
+			},
+		})
+		for _, client := range subscribers {
+			if client.deliver(payload) {
+				receivers++
+			}
+		}
+	}
+
+	for _, match := range matches {
+		payload := r.parser.Serialize(&resp2.RESPValue{
+			Type: resp2.Array,
+			Array: []resp2.RESPValue{
+				{Type: resp2.BulkString, Str: "pmessage"},
+				{Type: resp2.BulkString, Str: match.pattern},
+				{Type: resp2.BulkString, Str: channel},
+				{Type: resp2.BulkString, Str: message},
+			},
+		})
+		if match.client.deliver(payload) {
+			receivers++
+		}
+	}
+
+	return receivers
+}
+
+// Channels returns the active channels matching the glob pattern, or all
+// active channels when the pattern is empty
+func (r *DefaultPubSubRegistry) Channels(pattern string) []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	result := make([]string, 0, len(r.channels))
+	for channel := range r.channels {
+		if pattern == "" || glob.Match(pattern, channel) {
+			result = append(result, channel)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// NumSub returns the number of subscribers of a channel
+func (r *DefaultPubSubRegistry) NumSub(channel string) int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return len(r.channels[channel])
+}
+
+// NumPat returns the number of unique patterns subscribed to by all clients
+func (r *DefaultPubSubRegistry) NumPat() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.patterns.count
+}
+
+// RemoveClient drops every subscription held by the client
+func (r *DefaultPubSubRegistry) RemoveClient(client *ClientConnection) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, channel := range client.subscribedChannels() {
+		r.removeSubscriber(channel, client)
+		client.removeChannel(channel)
+	}
+	for _, pattern := range client.subscribedPatterns() {
+		r.patterns.remove(pattern, client)
+		client.removePattern(pattern)
+	}
+}
+
+// removeSubscriber removes the client from a channel; the caller must hold the registry lock
+func (r *DefaultPubSubRegistry) removeSubscriber(channel string, client *ClientConnection) {
+	subscribers, exists := r.channels[channel]
+	if !exists {
+		return
+	}
+	delete(subscribers, client.id)
+	if len(subscribers) == 0 {
+		delete(r.channels, channel)
+	}
+}
+
+// pubSubReply builds a (un)subscribe confirmation reply
+func pubSubReply(kind, name string, count int) *resp2.RESPValue {
+	return &resp2.RESPValue{
+		Type: resp2.Array,
+		Array: []resp2.RESPValue{
+			{Type: resp2.BulkString, Str: kind},
+			{Type: resp2.BulkString, Str: name},
+			{Type: resp2.Integer, Int: int64(count)},
+		},
+	}
+}
+
+// emptyUnsubscribeReply builds the reply sent when a client unsubscribes
+// from everything while holding no subscriptions of that kind
+func emptyUnsubscribeReply(kind string, count int) *resp2.RESPValue {
+	return &resp2.RESPValue{
+		Type: resp2.Array,
+		Array: []resp2.RESPValue{
+			{Type: resp2.BulkString, Str: kind},
+			{Type: resp2.NullBulkString, Null: true},
+			{Type: resp2.Integer, Int: int64(count)},
+		},
+	}
+}
+
+// deliver queues a published message for the client, reporting whether it
+// was queued. A client whose queue would outgrow maxQueuedBytes is closed.
+func (cc *ClientConnection) deliver(data []byte) bool {
+	if cc.failed.Load() {
+		return false
+	}
+	cc.queueMutex.Lock()
+	if cc.queuedBytes+len(data) > maxQueuedBytes {
+		cc.queueMutex.Unlock()
+		cc.fail()
+		return false
+	}
+	cc.queue = append(cc.queue, data)
+	cc.queuedBytes += len(data)
+	start := !cc.draining
+	cc.draining = true
+	cc.queueMutex.Unlock()
+
+	if start {
+		go cc.drain()
+	}
+	return true
+}
+
+// takeQueued removes and returns the queued messages; when there are none
+// and stop is set, the draining goroutine is marked as gone
+func (cc *ClientConnection) takeQueued(stop bool) [][]byte {
+	cc.queueMutex.Lock()
+	defer cc.queueMutex.Unlock()
+	queue := cc.queue
+	if len(queue) == 0 && stop {
+		cc.draining = false
+	}
+	cc.queue, cc.queuedBytes = nil, 0
+	return queue
+}
+
+// drain writes queued messages until none are left
+func (cc *ClientConnection) drain() {
+	for {
+		cc.writeMutex.Lock()
+		queue := cc.takeQueued(true)
+		if len(queue) == 0 {
+			cc.writeMutex.Unlock()
+			return
+		}
+		cc.writeQueue(queue)
+		cc.writeMutex.Unlock()
+	}
+}
+
+// writeQueuedLocked writes the messages queued so far, so that what is
+// written next follows them; the caller must hold writeMutex
+func (cc *ClientConnection) writeQueuedLocked() error {
+	return cc.writeQueue(cc.takeQueued(false))
+}
+
+// writeQueue writes messages taken from the queue, failing the client on
+// error; the caller must hold writeMutex
+func (cc *ClientConnection) writeQueue(queue [][]byte) error {
+	if len(queue) == 0 {
+		return nil
+	}
+	if cc.failed.Load() {
+		return net.ErrClosed
+	}
+	for _, data := range queue {
+		if err := cc.writeLocked(data); err != nil {
+			cc.fail()
+			return err
+		}
+	}
+	return nil
+}
+
+// fail stops deliveries to the client and closes its connection, which ends
+// its read loop and so removes it. Only the network connection is closed, as
+// a writer may be stuck holding writeMutex.
+func (cc *ClientConnection) fail() {
+	if !cc.failed.CompareAndSwap(false, true) {
+		return
+	}
+	cc.queueMutex.Lock()
+	cc.queue, cc.queuedBytes = nil, 0
+	cc.queueMutex.Unlock()
+	cc.conn.Close()
+}
+
+// addChannel records a channel subscription and returns the new subscription count
+func (cc *ClientConnection) addChannel(channel string) int {
+	cc.subMutex.Lock()
+	defer cc.subMutex.Unlock()
+	if cc.channels == nil {
+		cc.channels = make(map[string]struct{})
+	}
+	cc.channels[channel] = struct{}{}
+	return len(cc.channels) + len(cc.patterns)
+}
+
+// removeChannel forgets a channel subscription and returns the new subscription count
+func (cc *ClientConnection) removeChannel(channel string) int {
+	cc.subMutex.Lock()
+	defer cc.subMutex.Unlock()
+	delete(cc.channels, channel)
+	return len(cc.channels) + len(cc.patterns)
+}
+
+// addPattern records a pattern subscription and returns the new subscription count
+func (cc *ClientConnection) addPattern(pattern string) int {
+	cc.subMutex.Lock()
+	defer cc.subMutex.Unlock()
+	if cc.patterns == nil {
+		cc.patterns = make(map[string]struct{})
+	}
+	cc.patterns[pattern] = struct{}{}
+	return len(cc.channels) + len(cc.patterns)
+}
+
+// removePattern forgets a pattern subscription and returns the new subscription count
+func (cc *ClientConnection) removePattern(pattern string) int {
+	cc.subMutex.Lock()
+	defer cc.subMutex.Unlock()
+	delete(cc.patterns, pattern)
+	return len(cc.channels) + len(cc.patterns)
+}
+
+// subscribedChannels returns the channels the client is subscribed to, sorted
+func (cc *ClientConnection) subscribedChannels() []string {
+	cc.subMutex.RLock()
+	defer cc.subMutex.RUnlock()
+	channels := make([]string, 0, len(cc.channels))
+	for channel := range cc.channels {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// subscribedPatterns returns the patterns the client is subscribed to, sorted
+func (cc *ClientConnection) subscribedPatterns() []string {
+	cc.subMutex.RLock()
+	defer cc.subMutex.RUnlock()
+	patterns := make([]string, 0, len(cc.patterns))
+	for pattern := range cc.patterns {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	return patterns
+}
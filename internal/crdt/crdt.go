@@ -0,0 +1,496 @@
+// Package crdt implements the conflict-free replicated state behind the
+// active-active mode, where several instances accept writes and exchange
+// them as operations until they all hold the same dataset.
+//
+// The server only holds strings, so every key is a last-writer-wins
+// register: each write is stamped with a time and the replica that made
+// it, and the greatest stamp wins wherever and in whatever order the
+// operations are applied. Deletions are kept as tombstones so a late write
+// cannot bring back a key deleted after it, until every known peer reported
+// a clock covering them. The add-wins sets, PN counters and observed-remove
+// hashes of types.go are the merges of the other types.
+//
+// Every replica numbers its own operations; a vector clock records, for
+// each replica, the greatest number up to which every operation that still
+// matters was received, so a peer that reconnects is only sent the
+// operations its clock does not cover. Only the winning operation of each
+// key is kept and sent, so a replica's numbers arrive with gaps and out of
+// order across links: the clock is raised by the clock a peer sends after
+// its operations, never by the operations themselves.
+package crdt
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clock is a vector clock: for each replica, the operation number up to
+// which its operations were all received
+type Clock map[string]uint64
+
+// Covers reports whether the clock already includes op
+func (c Clock) Covers(op Op) bool {
+	return c[op.Replica] >= op.Seq
+}
+
+// Merge raises the clock to include other
+func (c Clock) Merge(other Clock) {
+	for id, seq := range other {
+		c[id] = max(c[id], seq)
+	}
+}
+
+// String renders the clock as "replica:seq" pairs separated by commas,
+// sorted by replica; an empty clock renders as "-"
+func (c Clock) String() string {
+	if len(c) == 0 {
+		return "-"
+	}
+	ids := make([]string, 0, len(c))
+	for id := range c {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	pairs := make([]string, len(ids))
+	for i, id := range ids {
+		pairs[i] = fmt.Sprintf("%s:%d", id, c[id])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// ParseClock parses a clock rendered by String
+func ParseClock(s string) (Clock, error) {
+	c := make(Clock)
+	if s == "-" {
+		return c, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		id, seq, found := strings.Cut(pair, ":")
+		if !found || id == "" {
+			return nil, fmt.Errorf("invalid clock entry %q", pair)
+		}
+		n, err := strconv.ParseUint(seq, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid clock entry %q", pair)
+		}
+		c[id] = max(c[id], n)
+	}
+	return c, nil
+}
+
+// OpKind is what an operation does to its key
+type OpKind string
+
+// Kinds of operations
+const (
+	OpSet    OpKind = "set"
+	OpDelete OpKind = "del"
+)
+
+// Op is a write made by a replica: the Seq-th of its operations, stamped
+// with Time in Unix milliseconds
+type Op struct {
+	Replica string
+	Seq     uint64
+	Time    int64
+	Kind    OpKind
+	Key     string
+	// Value and ExpireAt, in Unix milliseconds or 0 for no expiry, are
+	// those of a set
+	Value    string
+	ExpireAt int64
+}
+
+// Wins reports whether op overrides other on the same key: the later time
+// wins, and the greater replica ID breaks ties
+func (op Op) Wins(other Op) bool {
+	if op.Time != other.Time {
+		return op.Time > other.Time
+	}
+	return op.Replica > other.Replica
+}
+
+// Args renders the operation as the arguments of a command
+func (op Op) Args() []string {
+	args := []string{op.Replica, strconv.FormatUint(op.Seq, 10), strconv.FormatInt(op.Time, 10), string(op.Kind), op.Key}
+	if op.Kind == OpSet {
+		args = append(args, op.Value, strconv.FormatInt(op.ExpireAt, 10))
+	}
+	return args
+}
+
+// ParseOp parses the arguments rendered by Args
+func ParseOp(args []string) (Op, error) {
+	if len(args) < 5 {
+		return Op{}, fmt.Errorf("expected at least 5 fields, got %d", len(args))
+	}
+	op := Op{Replica: args[0], Kind: OpKind(args[3]), Key: args[4]}
+	var err error
+	if op.Seq, err = strconv.ParseUint(args[1], 10, 64); err != nil || op.Seq == 0 {
+		return Op{}, fmt.Errorf("invalid sequence number %q", args[1])
+	}
+	if op.Time, err = strconv.ParseInt(args[2], 10, 64); err != nil {
+		return Op{}, fmt.Errorf("invalid time %q", args[2])
+	}
+	switch {
+	case op.Replica == "":
+		return Op{}, fmt.Errorf("missing replica ID")
+	case op.Kind == OpSet && len(args) == 7:
+		op.Value = args[5]
+		if op.ExpireAt, err = strconv.ParseInt(args[6], 10, 64); err != nil || op.ExpireAt < 0 {
+			return Op{}, fmt.Errorf("invalid expiry %q", args[6])
+		}
+	case op.Kind == OpDelete && len(args) == 5:
+	default:
+		return Op{}, fmt.Errorf("invalid %s operation with %d fields", op.Kind, len(args))
+	}
+	return op, nil
+}
+
+// Line renders the operation as a line of the state file
+func (op Op) Line() string {
+	fields := op.Args()
+	fields[4] = strconv.Quote(op.Key)
+	if op.Kind == OpSet {
+		fields[5] = strconv.Quote(op.Value)
+	}
+	return "op " + strings.Join(fields, " ") + "\n"
+}
+
+// parseOpLine parses the fields of a line rendered by Line, after "op "
+func parseOpLine(rest string) (Op, error) {
+	var fields []string
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimSpace(rest) {
+		field := rest
+		if rest[0] == '"' {
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				return Op{}, err
+			}
+			if field, err = strconv.Unquote(quoted); err != nil {
+				return Op{}, err
+			}
+			rest = rest[len(quoted):]
+		} else if i := strings.IndexByte(rest, ' '); i >= 0 {
+			field, rest = rest[:i], rest[i:]
+		} else {
+			rest = ""
+		}
+		fields = append(fields, field)
+	}
+	return ParseOp(fields)
+}
+
+// State is the replicated state of an instance: its clock and, for every
+// key, the operation that won it, which is all a peer needs to catch up.
+// It is safe for concurrent use.
+type State struct {
+	mutex sync.Mutex
+	myID  string
+	clock Clock
+	// last is the greatest time stamped or seen, so a local write always
+	// wins over the writes it follows
+	last int64
+	ops  map[string]Op
+	// peers holds the clock each peer last reported, by replica ID
+	peers map[string]Clock
+}
+
+// NewState creates the state of a replica that saw no operation yet
+func NewState(myID string) *State {
+	return &State{myID: myID, clock: make(Clock), ops: make(map[string]Op), peers: make(map[string]Clock)}
+}
+
+// MyID returns the ID of this replica
+func (s *State) MyID() string {
+	return s.myID
+}
+
+// Clock returns a copy of the clock
+func (s *State) Clock() Clock {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c := make(Clock, len(s.clock))
+	c.Merge(s.clock)
+	return c
+}
+
+// MergeClock raises the clock to include the one of a peer whose
+// operations were all received
+func (s *State) MergeClock(c Clock) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	changed := false
+	for id, seq := range c {
+		if seq > s.clock[id] {
+			s.clock[id] = seq
+			changed = true
+		}
+	}
+	return changed
+}
+
+// SetPeerClock records the clock a peer reported, reporting whether it
+// changed. A peer known once is waited for by Collect until it is
+// forgotten with ForgetPeer.
+func (s *State) SetPeerClock(id string, c Clock) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if id == s.myID {
+		return false
+	}
+	if current, exists := s.peers[id]; exists && reflect.DeepEqual(current, c) {
+		return false
+	}
+	s.peers[id] = make(Clock, len(c))
+	s.peers[id].Merge(c)
+	return true
+}
+
+// ForgetPeer stops waiting for a peer that left for good before dropping
+// tombstones
+func (s *State) ForgetPeer(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.peers, id)
+}
+
+// Peers returns the clock each known peer last reported
+func (s *State) Peers() map[string]Clock {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	peers := make(map[string]Clock, len(s.peers))
+	for id, c := range s.peers {
+		peers[id] = make(Clock, len(c))
+		peers[id].Merge(c)
+	}
+	return peers
+}
+
+// Collect drops the tombstones no replica needs any more, returning how
+// many: those every known peer's clock covers, once this replica received
+// every operation those clocks cover, so no write a peer made before seeing
+// the deletion is still on its way to bring the key back
+func (s *State) Collect() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.collect()
+}
+
+// collect drops the tombstones no replica needs; the caller must hold the
+// mutex unless the state is still being loaded
+func (s *State) collect() int {
+	for _, peer := range s.peers {
+		for id, seq := range peer {
+			if s.clock[id] < seq {
+				return 0
+			}
+		}
+	}
+	dropped := 0
+	for key, op := range s.ops {
+		if op.Kind != OpDelete || !s.clock.Covers(op) {
+			continue
+		}
+		stable := true
+		for _, peer := range s.peers {
+			if !peer.Covers(op) {
+				stable = false
+				break
+			}
+		}
+		if stable {
+			delete(s.ops, key)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// Len returns the number of keys with an operation, deleted ones included
+func (s *State) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.ops)
+}
+
+// Local records a write made on this replica and returns its operation
+func (s *State) Local(kind OpKind, key, value string, expireAt int64, now time.Time) Op {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.last = max(s.last+1, now.UnixMilli())
+	s.clock[s.myID]++
+	op := Op{Replica: s.myID, Seq: s.clock[s.myID], Time: s.last, Kind: kind, Key: key}
+	if kind == OpSet {
+		op.Value, op.ExpireAt = value, expireAt
+	}
+	s.ops[key] = op
+	return op
+}
+
+// Apply records an operation received from a peer. It returns whether the
+// operation is new, and whether it won its key and must be applied to the
+// dataset. The clock is left as is: the operations of a catch-up cut short
+// would otherwise make it cover the ones that were never sent.
+func (s *State) Apply(op Op) (fresh, wins bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.clock.Covers(op) {
+		return false, false
+	}
+	if current, exists := s.ops[op.Key]; exists && current.Replica == op.Replica && current.Seq == op.Seq {
+		return false, false
+	}
+	return true, s.record(op)
+}
+
+// record keeps an operation when it wins its key, which it reports; the
+// caller must hold the mutex unless the state is still being loaded. Only
+// the operations of this replica count in the clock.
+func (s *State) record(op Op) bool {
+	if op.Replica == s.myID {
+		s.clock[op.Replica] = max(s.clock[op.Replica], op.Seq)
+	}
+	s.last = max(s.last, op.Time)
+	if current, exists := s.ops[op.Key]; exists && !op.Wins(current) {
+		return false
+	}
+	s.ops[op.Key] = op
+	return true
+}
+
+// Missing returns the operations a peer with clock c has not seen, in the
+// order each replica made them
+func (s *State) Missing(c Clock) []Op {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var missing []Op
+	for _, op := range s.ops {
+		if !c.Covers(op) {
+			missing = append(missing, op)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool {
+		if missing[i].Replica != missing[j].Replica {
+			return missing[i].Replica < missing[j].Replica
+		}
+		return missing[i].Seq < missing[j].Seq
+	})
+	return missing
+}
+
+// ClockLine renders a clock as a line of the state file
+func ClockLine(c Clock) string {
+	return "clock " + c.String() + "\n"
+}
+
+// PeerLine renders the clock a peer reported as a line of the state file
+func PeerLine(id string, c Clock) string {
+	return "peer " + id + " " + c.String() + "\n"
+}
+
+// Marshal renders the state as a state file: the replica ID, the clock, the
+// clocks of the peers and the winning operations. Lines added later with Line and ClockLine are
+// replayed on top by Unmarshal.
+func (s *State) Marshal() []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "myself %s\n", s.myID)
+	b.WriteString(ClockLine(s.clock))
+	ids := make([]string, 0, len(s.peers))
+	for id := range s.peers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		b.WriteString(PeerLine(id, s.peers[id]))
+	}
+	keys := make([]string, 0, len(s.ops))
+	for key := range s.ops {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		b.WriteString(s.ops[key].Line())
+	}
+	return b.Bytes()
+}
+
+// Unmarshal parses a state file written by Marshal and appended to
+func Unmarshal(data []byte) (*State, error) {
+	var s *State
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<30)
+	for number := 1; scanner.Scan(); number++ {
+		kind, rest, _ := strings.Cut(scanner.Text(), " ")
+		if kind == "" {
+			continue
+		}
+		if kind == "myself" {
+			if s != nil {
+				return nil, fmt.Errorf("line %d: more than one replica ID", number)
+			}
+			if rest == "" {
+				return nil, fmt.Errorf("line %d: missing replica ID", number)
+			}
+			s = NewState(rest)
+			continue
+		}
+		if s == nil {
+			return nil, fmt.Errorf("line %d: expected the replica ID first", number)
+		}
+		switch kind {
+		case "clock":
+			c, err := ParseClock(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", number, err)
+			}
+			s.MergeClock(c)
+		case "peer":
+			id, clock, _ := strings.Cut(rest, " ")
+			c, err := ParseClock(clock)
+			if err != nil || id == "" {
+				return nil, fmt.Errorf("line %d: invalid peer clock %q", number, rest)
+			}
+			s.SetPeerClock(id, c)
+		case "op":
+			op, err := parseOpLine(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", number, err)
+			}
+			s.record(op)
+		default:
+			return nil, fmt.Errorf("line %d: unknown line %q", number, kind)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, fmt.Errorf("missing replica ID")
+	}
+	// Tombstones dropped since the file was rewritten are replayed above
+	s.collect()
+	return s, nil
+}
+
+// Winners returns the operation that won each key, sorted by key: the
+// dataset every replica converges to, deleted keys included
+func (s *State) Winners() []Op {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ops := make([]Op, 0, len(s.ops))
+	for _, op := range s.ops {
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Key < ops[j].Key })
+	return ops
+}
@@ -0,0 +1,266 @@
+package crdt
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/leanovate/gopter"
+	"github.com/leanovate/gopter/gen"
+	"github.com/leanovate/gopter/prop"
+)
+
+// write is a write made on one of the replicas of a test
+type write struct {
+	replica int
+	delete  bool
+	key     string
+	value   string
+}
+
+// genWrite generates writes on 3 replicas and a few keys, so they conflict
+func genWrite() gopter.Gen {
+	return gopter.CombineGens(
+		gen.IntRange(0, 2),
+		gen.Bool(),
+		gen.OneConstOf("a", "b", "c"),
+		gen.AnyString(),
+	).Map(func(values []interface{}) write {
+		return write{replica: values[0].(int), delete: values[1].(bool), key: values[2].(string), value: values[3].(string)}
+	})
+}
+
+// Property-based test setup for replicated states
+func TestStateProperties(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+	now := time.Unix(1700000000, 0)
+
+	// However the operations of the replicas interleave on the way, every
+	// replica ends up with the same winners
+	properties.Property("replicas converge", prop.ForAll(
+		func(writes []write, seed int64) bool {
+			replicas := []*State{NewState("a"), NewState("b"), NewState("c")}
+			var ops []Op
+			for i, w := range writes {
+				kind := OpSet
+				if w.delete {
+					kind = OpDelete
+				}
+				ops = append(ops, replicas[w.replica].Local(kind, w.key, w.value, 0, now.Add(time.Duration(i%4)*time.Millisecond)))
+			}
+			random := rand.New(rand.NewSource(seed))
+			for _, replica := range replicas {
+				shuffled := append([]Op(nil), ops...)
+				random.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+				// Links deliver the operations of each replica in order
+				next := make(map[string]int)
+				for i, op := range shuffled {
+					for next[op.Replica] < len(ops) && ops[next[op.Replica]].Replica != op.Replica {
+						next[op.Replica]++
+					}
+					shuffled[i] = ops[next[op.Replica]]
+					next[op.Replica]++
+				}
+				for _, op := range shuffled {
+					if op.Replica != replica.MyID() {
+						replica.Apply(op)
+					}
+				}
+			}
+			return reflect.DeepEqual(replicas[0].Winners(), replicas[1].Winners()) &&
+				reflect.DeepEqual(replicas[1].Winners(), replicas[2].Winners())
+		},
+		gen.SliceOf(genWrite()),
+		gen.Int64(),
+	))
+
+	// A replica that missed operations catches up with those its clock
+	// does not cover
+	properties.Property("catching up", prop.ForAll(
+		func(writes []write, seen int) bool {
+			a, b := NewState("a"), NewState("b")
+			for i, w := range writes {
+				op := a.Local(OpSet, w.key, w.value, 0, now)
+				if i < seen {
+					b.Apply(op)
+				}
+			}
+			for _, op := range a.Missing(b.Clock()) {
+				b.Apply(op)
+			}
+			b.MergeClock(a.Clock())
+			return reflect.DeepEqual(a.Winners(), b.Winners()) && reflect.DeepEqual(a.Clock(), b.Clock())
+		},
+		gen.SliceOf(genWrite()),
+		gen.IntRange(0, 20),
+	))
+
+	// A replica whose catch-up from one peer was cut short, while live
+	// operations arrived from another, catches up from the other peer
+	properties.Property("catching up after a cut stream", prop.ForAll(
+		func(writes []write, cut int, seed int64) bool {
+			origin, p, q, f := NewState("a"), NewState("p"), NewState("q"), NewState("f")
+			for _, w := range writes {
+				kind := OpSet
+				if w.delete {
+					kind = OpDelete
+				}
+				op := origin.Local(kind, w.key, w.value, 0, now)
+				p.Apply(op)
+				q.Apply(op)
+			}
+			p.MergeClock(origin.Clock())
+			q.MergeClock(origin.Clock())
+
+			// Some of q's operations arrive live, then p's catch-up stops
+			// before its clock is sent
+			random := rand.New(rand.NewSource(seed))
+			for _, op := range q.Missing(f.Clock()) {
+				if random.Intn(2) == 0 {
+					f.Apply(op)
+				}
+			}
+			for i, op := range p.Missing(f.Clock()) {
+				if i >= cut {
+					break
+				}
+				f.Apply(op)
+			}
+
+			for _, op := range q.Missing(f.Clock()) {
+				f.Apply(op)
+			}
+			f.MergeClock(q.Clock())
+			return reflect.DeepEqual(origin.Winners(), f.Winners()) && reflect.DeepEqual(origin.Clock(), f.Clock())
+		},
+		gen.SliceOf(genWrite()),
+		gen.IntRange(0, 5),
+		gen.Int64(),
+	))
+
+	// The state file gives the state back, with appended lines replayed
+	properties.Property("state files round-trip", prop.ForAll(
+		func(writes []write, split int) bool {
+			a, b := NewState("a"), NewState("b")
+			base := a.Marshal()
+			var appended string
+			for i, w := range writes {
+				kind := OpSet
+				if w.delete {
+					kind = OpDelete
+				}
+				op := b.Local(kind, w.key, w.value, int64(i), now)
+				a.Apply(op)
+				if i < split {
+					base = a.Marshal()
+				} else {
+					appended += op.Line()
+				}
+			}
+			loaded, err := Unmarshal(append(base, appended...))
+			return err == nil && loaded.MyID() == "a" &&
+				reflect.DeepEqual(loaded.Winners(), a.Winners()) && reflect.DeepEqual(loaded.Clock(), a.Clock())
+		},
+		gen.SliceOf(genWrite()),
+		gen.IntRange(0, 20),
+	))
+
+	properties.TestingRun(t)
+}
+
+func TestLocalWriteWinsOverSeenWrites(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	a, b := NewState("a"), NewState("b")
+	// b's clock runs ahead, but a write made on a after seeing b's must win
+	a.Apply(b.Local(OpSet, "key", "from b", 0, now.Add(time.Minute)))
+	op := a.Local(OpDelete, "key", "", 0, now)
+	if fresh, wins := b.Apply(op); !fresh || !wins {
+		t.Fatalf("delete made after the set: fresh %v, wins %v", fresh, wins)
+	}
+	if fresh, _ := b.Apply(op); fresh {
+		t.Error("an operation applied twice is fresh")
+	}
+	if winners := b.Winners(); len(winners) != 1 || winners[0].Kind != OpDelete {
+		t.Errorf("winners %+v", winners)
+	}
+}
+
+func TestCollectTombstones(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	a, b, c := NewState("a"), NewState("b"), NewState("c")
+	a.SetPeerClock("b", b.Clock())
+	a.SetPeerClock("c", c.Clock())
+	for _, replica := range []*State{b, c} {
+		replica.Apply(a.Local(OpSet, "key", "value", 0, now))
+	}
+	deletion := a.Local(OpDelete, "key", "", 0, now)
+
+	// The tombstone stays until every peer reports a clock covering it
+	b.Apply(deletion)
+	b.MergeClock(a.Clock())
+	a.SetPeerClock("b", b.Clock())
+	if dropped := a.Collect(); dropped != 0 || a.Len() != 1 {
+		t.Fatalf("Collect dropped %d tombstones before c saw the deletion", dropped)
+	}
+	cWrite := c.Local(OpSet, "other", "value", 0, now)
+	c.Apply(deletion)
+	c.MergeClock(a.Clock())
+	a.SetPeerClock("c", c.Clock())
+	if dropped := a.Collect(); dropped != 0 {
+		t.Fatalf("Collect dropped %d tombstones while c's write was still on its way", dropped)
+	}
+	a.Apply(cWrite)
+	a.MergeClock(c.Clock())
+	if dropped := a.Collect(); dropped != 1 || a.Len() != 1 {
+		t.Fatalf("Collect dropped %d tombstones, leaving %d keys, want 1 and 1", dropped, a.Len())
+	}
+
+	// Peer clocks are kept in the state file, and a tombstone dropped
+	// before the file was rewritten is dropped again when it is loaded
+	data := append(NewState("a").Marshal(), deletion.Line()...)
+	loaded, err := Unmarshal(append(data, a.Marshal()[len("myself a\n"):]...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.Peers(), a.Peers()) || !reflect.DeepEqual(loaded.Winners(), a.Winners()) {
+		t.Errorf("Loaded peers %v and winners %v, want %v and %v", loaded.Peers(), loaded.Winners(), a.Peers(), a.Winners())
+	}
+
+	// A peer forgotten is no longer waited for
+	a.Local(OpDelete, "other", "", 0, now)
+	a.ForgetPeer("b")
+	a.ForgetPeer("c")
+	if dropped := a.Collect(); dropped != 1 || a.Len() != 0 {
+		t.Errorf("Collect dropped %d tombstones with no peer left, want 1", dropped)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{"a", "1", "0", "set", "key"},
+		{"a", "0", "0", "del", "key"},
+		{"a", "1", "time", "del", "key"},
+		{"", "1", "0", "del", "key"},
+		{"a", "1", "0", "incr", "key"},
+		{"a", "1", "0", "set", "key", "value", "-1"},
+	} {
+		if _, err := ParseOp(args); err == nil {
+			t.Errorf("ParseOp(%q) succeeded", args)
+		}
+	}
+	for _, clock := range []string{"", "a", "a:b", ":1", "a:1,b"} {
+		if _, err := ParseClock(clock); err == nil {
+			t.Errorf("ParseClock(%q) succeeded", clock)
+		}
+	}
+	for _, data := range []string{"", "clock -\n", "myself a\npeer b\n", "myself a\nmyself b\n", "myself a\nop a 1 0 del\n", "myself a\nsomething\n"} {
+		if _, err := Unmarshal([]byte(data)); err == nil {
+			t.Errorf("Unmarshal(%q) succeeded", data)
+		}
+	}
+	if c, err := ParseClock(Clock{"a": 3, "b": 1}.String()); err != nil || fmt.Sprint(c) != fmt.Sprint(Clock{"a": 3, "b": 1}) {
+		t.Errorf("clock %v, %v", c, err)
+	}
+}
@@ -0,0 +1,215 @@
+package crdt
+
+// Dot identifies one write to a counter, set or hash: the replica that
+// made it and its number among that replica's writes to the value
+type Dot struct {
+	Replica string
+	Seq     uint64
+}
+
+// PNCounter is a counter every replica increments and decrements, as with
+// INCR and DECR. Each replica only raises its own totals of increments and
+// decrements, and merging keeps the greatest of each, so concurrent changes
+// all count and none is counted twice.
+type PNCounter struct {
+	p map[string]int64
+	n map[string]int64
+}
+
+// NewPNCounter creates a counter at zero
+func NewPNCounter() *PNCounter {
+	return &PNCounter{p: make(map[string]int64), n: make(map[string]int64)}
+}
+
+// Add changes the counter by delta on behalf of replica
+func (c *PNCounter) Add(replica string, delta int64) {
+	if delta >= 0 {
+		c.p[replica] += delta
+	} else {
+		c.n[replica] -= delta
+	}
+}
+
+// Value returns the sum of the changes of every replica
+func (c *PNCounter) Value() int64 {
+	var value int64
+	for _, p := range c.p {
+		value += p
+	}
+	for _, n := range c.n {
+		value -= n
+	}
+	return value
+}
+
+// Merge takes in the changes other has seen
+func (c *PNCounter) Merge(other *PNCounter) {
+	for replica, p := range other.p {
+		c.p[replica] = max(c.p[replica], p)
+	}
+	for replica, n := range other.n {
+		c.n[replica] = max(c.n[replica], n)
+	}
+}
+
+// Clone returns a copy of the counter
+func (c *PNCounter) Clone() *PNCounter {
+	clone := NewPNCounter()
+	clone.Merge(c)
+	return clone
+}
+
+// AWSet is an add-wins set: an element is in the set while an addition of
+// it survives, and a removal only cancels the additions its replica had
+// seen, so an addition concurrent with a removal wins
+type AWSet struct {
+	elements map[string]map[Dot]struct{}
+	// seen holds the dots of every addition seen, removed ones included
+	seen Clock
+}
+
+// NewAWSet creates an empty set
+func NewAWSet() *AWSet {
+	return &AWSet{elements: make(map[string]map[Dot]struct{}), seen: make(Clock)}
+}
+
+// Add adds an element on behalf of replica
+func (s *AWSet) Add(replica, element string) {
+	s.elements[element] = map[Dot]struct{}{nextDot(s.seen, replica): {}}
+}
+
+// Remove removes an element, cancelling the additions seen so far
+func (s *AWSet) Remove(element string) {
+	delete(s.elements, element)
+}
+
+// Contains reports whether element is in the set
+func (s *AWSet) Contains(element string) bool {
+	_, exists := s.elements[element]
+	return exists
+}
+
+// Members returns the elements of the set
+func (s *AWSet) Members() []string {
+	members := make([]string, 0, len(s.elements))
+	for element := range s.elements {
+		members = append(members, element)
+	}
+	return members
+}
+
+// Merge takes in the additions and removals other has seen
+func (s *AWSet) Merge(other *AWSet) {
+	mergeDotted(s.elements, other.elements, s.seen, other.seen)
+	s.seen.Merge(other.seen)
+}
+
+// Clone returns a copy of the set
+func (s *AWSet) Clone() *AWSet {
+	clone := NewAWSet()
+	clone.Merge(s)
+	return clone
+}
+
+// HashValue is the value of a hash field with the time it was written, in
+// Unix milliseconds
+type HashValue struct {
+	Value string
+	Time  int64
+}
+
+// ORHash is an observed-remove hash: a field exists while a write of it
+// survives, a deletion only cancels the writes its replica had seen, and of
+// concurrent writes of a field the later one, then the greater replica,
+// gives its value
+type ORHash struct {
+	fields map[string]map[Dot]HashValue
+	// seen holds the dots of every write seen, deleted ones included
+	seen Clock
+}
+
+// NewORHash creates an empty hash
+func NewORHash() *ORHash {
+	return &ORHash{fields: make(map[string]map[Dot]HashValue), seen: make(Clock)}
+}
+
+// Set writes a field on behalf of replica at time, in Unix milliseconds
+func (h *ORHash) Set(replica, field, value string, time int64) {
+	h.fields[field] = map[Dot]HashValue{nextDot(h.seen, replica): {Value: value, Time: time}}
+}
+
+// Delete deletes a field, cancelling the writes seen so far
+func (h *ORHash) Delete(field string) {
+	delete(h.fields, field)
+}
+
+// Get returns the value of a field
+func (h *ORHash) Get(field string) (string, bool) {
+	writes, exists := h.fields[field]
+	if !exists {
+		return "", false
+	}
+	var winner Dot
+	var value HashValue
+	for dot, write := range writes {
+		if winner.Replica == "" || write.Time > value.Time || (write.Time == value.Time && dot.Replica > winner.Replica) {
+			winner, value = dot, write
+		}
+	}
+	return value.Value, true
+}
+
+// Fields returns the value of every field
+func (h *ORHash) Fields() map[string]string {
+	fields := make(map[string]string, len(h.fields))
+	for field := range h.fields {
+		fields[field], _ = h.Get(field)
+	}
+	return fields
+}
+
+// Merge takes in the writes and deletions other has seen
+func (h *ORHash) Merge(other *ORHash) {
+	mergeDotted(h.fields, other.fields, h.seen, other.seen)
+	h.seen.Merge(other.seen)
+}
+
+// Clone returns a copy of the hash
+func (h *ORHash) Clone() *ORHash {
+	clone := NewORHash()
+	clone.Merge(h)
+	return clone
+}
+
+// nextDot numbers a new write of replica, recording it as seen
+func nextDot(seen Clock, replica string) Dot {
+	seen[replica]++
+	return Dot{Replica: replica, Seq: seen[replica]}
+}
+
+// mergeDotted merges the surviving writes of theirs into mine, by key. A
+// write one side holds and the other does not survives unless the other
+// saw it, in which case the other removed it.
+func mergeDotted[V any](mine, theirs map[string]map[Dot]V, mySeen, theirSeen Clock) {
+	for key, dots := range mine {
+		for dot := range dots {
+			if _, kept := theirs[key][dot]; !kept && theirSeen[dot.Replica] >= dot.Seq {
+				delete(dots, dot)
+			}
+		}
+		if len(dots) == 0 {
+			delete(mine, key)
+		}
+	}
+	for key, dots := range theirs {
+		for dot, value := range dots {
+			if _, kept := mine[key][dot]; kept || mySeen[dot.Replica] >= dot.Seq {
+				continue
+			}
+			if mine[key] == nil {
+				mine[key] = make(map[Dot]V)
+			}
+			mine[key][dot] = value
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package crdt
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/leanovate/gopter"
+	"github.com/leanovate/gopter/gen"
+	"github.com/leanovate/gopter/prop"
+)
+
+// step is a change made on one of the replicas of a test, followed by a
+// merge from another one
+type step struct {
+	replica int
+	action  int
+	element string
+	delta   int64
+	from    int
+}
+
+// genStep generates changes on 3 replicas and a few elements, so they
+// conflict
+func genStep() gopter.Gen {
+	return gopter.CombineGens(
+		gen.IntRange(0, 2),
+		gen.IntRange(0, 2),
+		gen.OneConstOf("x", "y", "z"),
+		gen.Int64Range(-100, 100),
+		gen.IntRange(0, 2),
+	).Map(func(values []interface{}) step {
+		return step{replica: values[0].(int), action: values[1].(int), element: values[2].(string), delta: values[3].(int64), from: values[4].(int)}
+	})
+}
+
+var replicaIDs = []string{"a", "b", "c"}
+
+// syncAll merges every replica into every other, twice so each ends up
+// with what all the others saw
+func syncAll(merge func(into, from int)) {
+	for round := 0; round < 2; round++ {
+		for i := range replicaIDs {
+			for j := range replicaIDs {
+				if i != j {
+					merge(i, j)
+				}
+			}
+		}
+	}
+}
+
+// Property-based test setup for the counter, set and hash types
+func TestTypeProperties(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	// However changes and merges interleave, the counters converge to the
+	// sum of every change
+	properties.Property("counters converge to the sum of the changes", prop.ForAll(
+		func(steps []step) bool {
+			counters := []*PNCounter{NewPNCounter(), NewPNCounter(), NewPNCounter()}
+			var sum int64
+			for _, s := range steps {
+				counters[s.replica].Add(replicaIDs[s.replica], s.delta)
+				sum += s.delta
+				counters[s.replica].Merge(counters[s.from].Clone())
+			}
+			syncAll(func(into, from int) { counters[into].Merge(counters[from]) })
+			for _, c := range counters {
+				if c.Value() != sum {
+					return false
+				}
+			}
+			return true
+		},
+		gen.SliceOf(genStep()),
+	))
+
+	// However changes and merges interleave, the sets converge, and merging
+	// again changes nothing
+	properties.Property("sets converge", prop.ForAll(
+		func(steps []step) bool {
+			sets := []*AWSet{NewAWSet(), NewAWSet(), NewAWSet()}
+			for _, s := range steps {
+				if s.action == 0 {
+					sets[s.replica].Remove(s.element)
+				} else {
+					sets[s.replica].Add(replicaIDs[s.replica], s.element)
+				}
+				sets[s.replica].Merge(sets[s.from].Clone())
+			}
+			syncAll(func(into, from int) { sets[into].Merge(sets[from]) })
+			members := sortedMembers(sets[0])
+			again := sets[0].Clone()
+			again.Merge(sets[1])
+			return reflect.DeepEqual(members, sortedMembers(sets[1])) &&
+				reflect.DeepEqual(members, sortedMembers(sets[2])) &&
+				reflect.DeepEqual(members, sortedMembers(again))
+		},
+		gen.SliceOf(genStep()),
+	))
+
+	// However changes and merges interleave, the hashes converge, and
+	// merging again changes nothing
+	properties.Property("hashes converge", prop.ForAll(
+		func(steps []step) bool {
+			hashes := []*ORHash{NewORHash(), NewORHash(), NewORHash()}
+			for i, s := range steps {
+				if s.action == 0 {
+					hashes[s.replica].Delete(s.element)
+				} else {
+					hashes[s.replica].Set(replicaIDs[s.replica], s.element, replicaIDs[s.replica], int64(i%4))
+				}
+				hashes[s.replica].Merge(hashes[s.from].Clone())
+			}
+			syncAll(func(into, from int) { hashes[into].Merge(hashes[from]) })
+			fields := hashes[0].Fields()
+			again := hashes[0].Clone()
+			again.Merge(hashes[2])
+			return reflect.DeepEqual(fields, hashes[1].Fields()) &&
+				reflect.DeepEqual(fields, hashes[2].Fields()) &&
+				reflect.DeepEqual(fields, again.Fields())
+		},
+		gen.SliceOf(genStep()),
+	))
+
+	properties.TestingRun(t)
+}
+
+// sortedMembers returns the members of a set in order
+func sortedMembers(s *AWSet) []string {
+	members := s.Members()
+	sort.Strings(members)
+	return members
+}
+
+func TestAWSetAddWins(t *testing.T) {
+	a, b := NewAWSet(), NewAWSet()
+	a.Add("a", "x")
+	b.Merge(a)
+
+	// A removal only cancels the additions it saw
+	a.Add("a", "x")
+	b.Remove("x")
+	a.Merge(b)
+	b.Merge(a)
+	if !a.Contains("x") || !b.Contains("x") {
+		t.Error("A removal cancelled a concurrent addition")
+	}
+
+	b.Remove("x")
+	a.Merge(b)
+	if a.Contains("x") {
+		t.Error("A removal of every addition seen left the element")
+	}
+}
+
+func TestORHashObservedRemove(t *testing.T) {
+	a, b := NewORHash(), NewORHash()
+	a.Set("a", "field", "one", 1)
+	b.Merge(a)
+
+	// A deletion only cancels the writes it saw
+	a.Set("a", "field", "two", 2)
+	b.Delete("field")
+	b.Merge(a)
+	if value, exists := b.Get("field"); !exists || value != "two" {
+		t.Errorf("Field after a write concurrent with its deletion = %q, %v, want two", value, exists)
+	}
+
+	// Of concurrent writes, the later one gives the value wherever merged
+	a.Set("a", "field", "early", 3)
+	b.Set("b", "field", "late", 4)
+	a.Merge(b)
+	b.Merge(a)
+	for _, h := range []*ORHash{a, b} {
+		if value, _ := h.Get("field"); value != "late" {
+			t.Errorf("Field after concurrent writes = %q, want late", value)
+		}
+	}
+
+	a.Delete("field")
+	b.Merge(a)
+	if _, exists := b.Get("field"); exists {
+		t.Error("A deletion of every write seen left the field")
+	}
+}
+
+func TestPNCounterMerge(t *testing.T) {
+	a, b := NewPNCounter(), NewPNCounter()
+	a.Add("a", 5)
+	b.Add("b", -2)
+	b.Add("b", 10)
+	a.Merge(b)
+	a.Merge(b)
+	b.Merge(a)
+	if a.Value() != 13 || b.Value() != 13 {
+		t.Errorf("Counters after merging = %d and %d, want 13", a.Value(), b.Value())
+	}
+}
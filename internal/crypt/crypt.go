@@ -0,0 +1,277 @@
+// Package crypt implements authenticated encryption at rest for the
+// persistence files.
+//
+// An encrypted file is a header followed by chunks. The header holds a
+// magic string, the format version, the ID of the key that encrypted the
+// file and a random file ID. Every chunk is sealed with AES-256-GCM under a
+// key derived from the master key and the file ID, so nonces never repeat
+// across files. A chunk is laid out as
+//
+//	length (4 bytes, big endian) | counter (8 bytes, big endian) | ciphertext and tag
+//
+// where the counter forms the nonce and the additional data is the tag of
+// the previous chunk, or the header for the first one. Reordering, altering
+// or dropping chunks therefore fails authentication; only losing chunks at
+// the tail goes unnoticed, which is indistinguishable from a crash while
+// appending. Appending one chunk per write keeps AOF appends cheap.
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeySize is the size of a master key: AES-256
+const KeySize = 32
+
+// EnvKey is the environment variable holding the current key when no key
+// file is given, hex or base64 encoded
+const EnvKey = "REDIS_LIKE_ENCRYPTION_KEY"
+
+const (
+	magic         = "RLSCRYPT"
+	formatVersion = 1
+	keyIDSize     = 8
+	fileIDSize    = 16
+	// HeaderSize is the size of the header of an encrypted file
+	HeaderSize = len(magic) + 1 + keyIDSize + fileIDSize
+
+	chunkHeaderSize = 12
+	tagSize         = 16
+	// maxChunkSize bounds the ciphertext of a chunk so a corrupt length
+	// cannot make readers allocate arbitrary amounts of memory
+	maxChunkSize = 64 << 20
+)
+
+var (
+	// ErrNoKey is returned when reading an encrypted file without a key
+	ErrNoKey = errors.New("file is encrypted but no encryption key is configured")
+	// ErrUnknownKey is returned when a file was encrypted with a key that is
+	// not configured
+	ErrUnknownKey = errors.New("file is encrypted with a key that is not configured")
+	// ErrCorrupt is returned for chunks that fail authentication
+	ErrCorrupt = errors.New("encrypted data failed authentication")
+)
+
+// Key is a master encryption key
+type Key struct {
+	id     [keyIDSize]byte
+	secret []byte
+}
+
+// NewKey creates a key from KeySize secret bytes
+func NewKey(secret []byte) (*Key, error) {
+	if len(secret) != KeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", KeySize, len(secret))
+	}
+	key := &Key{secret: append([]byte(nil), secret...)}
+	sum := sha256.Sum256(append([]byte("redis-like-server key id:"), secret...))
+	copy(key.id[:], sum[:])
+	return key, nil
+}
+
+// ParseKey decodes a key written as hex or base64
+func ParseKey(encoded string) (*Key, error) {
+	encoded = strings.TrimSpace(encoded)
+	if secret, err := hex.DecodeString(encoded); err == nil && len(secret) == KeySize {
+		return NewKey(secret)
+	}
+	if secret, err := base64.StdEncoding.DecodeString(encoded); err == nil && len(secret) == KeySize {
+		return NewKey(secret)
+	}
+	return nil, fmt.Errorf("encryption key must be %d bytes encoded as hex or base64", KeySize)
+}
+
+// LoadKeyFile reads a key file holding a hex or base64 encoded key
+func LoadKeyFile(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption key: %w", err)
+	}
+	key, err := ParseKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+// ID returns the key's identifier as stored in file headers, in hex
+func (k *Key) ID() string {
+	return hex.EncodeToString(k.id[:])
+}
+
+// fileAEAD derives the cipher for one file from the master key
+func (k *Key) fileAEAD(fileID []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write([]byte("redis-like-server file key:"))
+	mac.Write(fileID)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Keyring holds the key new files are encrypted with plus older keys that
+// files may still be encrypted with
+type Keyring struct {
+	current *Key
+	keys    map[[keyIDSize]byte]*Key
+}
+
+// NewKeyring creates a keyring encrypting with current and able to read
+// files encrypted with any of the keys
+func NewKeyring(current *Key, old ...*Key) *Keyring {
+	keyring := &Keyring{current: current, keys: make(map[[keyIDSize]byte]*Key)}
+	for _, key := range append(old, current) {
+		keyring.keys[key.id] = key
+	}
+	return keyring
+}
+
+// LoadKeyring builds a keyring from a current key file, falling back to the
+// EnvKey environment variable, and a comma-separated list of older key
+// files used only for reading. It returns nil when no current key is
+// configured.
+func LoadKeyring(keyFile, oldKeyFiles string) (*Keyring, error) {
+	var current *Key
+	var err error
+	switch {
+	case keyFile != "":
+		current, err = LoadKeyFile(keyFile)
+	case os.Getenv(EnvKey) != "":
+		current, err = ParseKey(os.Getenv(EnvKey))
+		if err != nil {
+			err = fmt.Errorf("%s: %w", EnvKey, err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var old []*Key
+	for _, path := range strings.Split(oldKeyFiles, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		key, err := LoadKeyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		old = append(old, key)
+	}
+	if current == nil {
+		if len(old) > 0 {
+			return nil, errors.New("old encryption keys need a current key")
+		}
+		return nil, nil
+	}
+	return NewKeyring(current, old...), nil
+}
+
+// Current returns the key new files are encrypted with, or nil for a nil
+// keyring, which means encryption is disabled
+func (r *Keyring) Current() *Key {
+	if r == nil {
+		return nil
+	}
+	return r.current
+}
+
+// lookup finds the key with the given ID
+func (r *Keyring) lookup(id []byte) (*Key, error) {
+	if r == nil {
+		return nil, ErrNoKey
+	}
+	var keyID [keyIDSize]byte
+	copy(keyID[:], id)
+	key, exists := r.keys[keyID]
+	if !exists {
+		return nil, fmt.Errorf("%w (key ID %x)", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// IsEncrypted reports whether data starts like an encrypted file
+func IsEncrypted(prefix []byte) bool {
+	return len(prefix) >= len(magic) && string(prefix[:len(magic)]) == magic
+}
+
+// FileKeyID returns the ID of the key that encrypted the file at path, or
+// "" if the file is not encrypted
+func FileKeyID(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	header := make([]byte, HeaderSize)
+	n, _ := file.Read(header)
+	if !IsEncrypted(header[:n]) {
+		return "", nil
+	}
+	if n < HeaderSize {
+		return "", fmt.Errorf("%s: truncated encryption header", path)
+	}
+	return hex.EncodeToString(header[len(magic)+1 : len(magic)+1+keyIDSize]), nil
+}
+
+// CurrentFor reports whether the file at path is encrypted the way keyring
+// would write it: with its current key, or not at all when keyring is nil
+func (r *Keyring) CurrentFor(path string) (bool, error) {
+	id, err := FileKeyID(path)
+	if err != nil {
+		return false, err
+	}
+	if current := r.Current(); current != nil {
+		return id == current.ID(), nil
+	}
+	return id == "", nil
+}
+
+// newHeader builds the header of a new file encrypted with key
+func newHeader(key *Key) ([]byte, error) {
+	header := make([]byte, 0, HeaderSize)
+	header = append(header, magic...)
+	header = append(header, formatVersion)
+	header = append(header, key.id[:]...)
+	fileID := make([]byte, fileIDSize)
+	if _, err := rand.Read(fileID); err != nil {
+		return nil, fmt.Errorf("failed to generate file ID: %w", err)
+	}
+	return append(header, fileID...), nil
+}
+
+// parseHeader validates a header and returns the cipher for the file
+func parseHeader(header []byte, keyring *Keyring) (cipher.AEAD, error) {
+	if !IsEncrypted(header) {
+		return nil, errors.New("not an encrypted file")
+	}
+	if header[len(magic)] != formatVersion {
+		return nil, fmt.Errorf("unsupported encryption format version %d", header[len(magic)])
+	}
+	idStart := len(magic) + 1
+	key, err := keyring.lookup(header[idStart : idStart+keyIDSize])
+	if err != nil {
+		return nil, err
+	}
+	return key.fileAEAD(header[idStart+keyIDSize:])
+}
+
+// chunkNonce returns the GCM nonce for a chunk counter
+func chunkNonce(counter uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
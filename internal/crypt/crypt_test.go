@@ -0,0 +1,267 @@
+package crypt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/leanovate/gopter"
+	"github.com/leanovate/gopter/gen"
+	"github.com/leanovate/gopter/prop"
+)
+
+// testKey derives a deterministic key from a seed byte
+func testKey(t *testing.T, seed byte) *Key {
+	key, err := NewKey(bytes.Repeat([]byte{seed}, KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// sealChunks encrypts each part as its own chunk, as AOF appends do
+func sealChunks(t *testing.T, key *Key, parts []string) []byte {
+	header, sealer, err := NewSealer(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := header
+	for _, part := range parts {
+		chunk := sealer.Seal([]byte(part))
+		sealer.Commit(chunk)
+		file = append(file, chunk...)
+	}
+	return file
+}
+
+// decrypt reads a whole encrypted file
+func decrypt(data []byte, keyring *Keyring) ([]byte, error) {
+	reader, err := NewReader(bytes.NewReader(data), keyring)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+// chunkOffsets returns where each chunk of an encrypted file starts
+func chunkOffsets(data []byte) []int {
+	var offsets []int
+	for offset := HeaderSize; offset < len(data); {
+		offsets = append(offsets, offset)
+		offset += chunkHeaderSize + int(binary.BigEndian.Uint32(data[offset:]))
+	}
+	return offsets
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := testKey(t, 1)
+	properties := gopter.NewProperties(nil)
+
+	// For any data and any split into writes, Writer followed by Reader
+	// should return the data unchanged
+	properties.Property("Writer then Reader returns the data", prop.ForAll(
+		func(data []byte, split int) bool {
+			var buf bytes.Buffer
+			writer, err := NewWriter(&buf, key)
+			if err != nil {
+				return false
+			}
+			split = min(split, len(data))
+			writer.Write(data[:split])
+			writer.Write(data[split:])
+			if writer.Close() != nil || (len(data) > 16 && bytes.Contains(buf.Bytes(), data)) {
+				return false
+			}
+			decrypted, err := decrypt(buf.Bytes(), NewKeyring(key))
+			return err == nil && bytes.Equal(decrypted, data)
+		},
+		gen.SliceOf(gen.UInt8()),
+		gen.IntRange(0, 1000),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+
+	// Data spanning several chunks round trips as well
+	large := bytes.Repeat([]byte("0123456789"), ChunkSize/4)
+	var buf bytes.Buffer
+	writer, _ := NewWriter(&buf, key)
+	writer.Write(large)
+	writer.Close()
+	if decrypted, err := decrypt(buf.Bytes(), NewKeyring(key)); err != nil || !bytes.Equal(decrypted, large) {
+		t.Fatalf("multi-chunk round trip failed: %v", err)
+	}
+}
+
+func TestTamperingDetected(t *testing.T) {
+	key := testKey(t, 2)
+	keyring := NewKeyring(key)
+	properties := gopter.NewProperties(nil)
+
+	// Flipping any bit of the header or a chunk, dropping a chunk other than
+	// the last or swapping two chunks must fail rather than return
+	// different plaintext
+	properties.Property("modified files fail to decrypt", prop.ForAll(
+		func(parts []string, position int, mode int) bool {
+			data := sealChunks(t, key, parts)
+			offsets := chunkOffsets(data)
+			var modified []byte
+			switch mode {
+			case 0:
+				modified = append([]byte(nil), data...)
+				modified[position%len(modified)] ^= 0x01
+			case 1:
+				i := position % (len(offsets) - 1)
+				modified = append(append([]byte(nil), data[:offsets[i]]...), data[offsets[i+1]:]...)
+			default:
+				i := position % (len(offsets) - 1)
+				first, second := data[offsets[i]:offsets[i+1]], data[offsets[i+1]:]
+				if i+2 < len(offsets) {
+					second = data[offsets[i+1]:offsets[i+2]]
+				}
+				modified = append(append([]byte(nil), data[:offsets[i]]...), second...)
+				modified = append(modified, first...)
+				modified = append(modified, data[offsets[i]+len(first)+len(second):]...)
+			}
+			_, err := decrypt(modified, keyring)
+			return err != nil
+		},
+		gen.SliceOfN(4, gen.AlphaString().SuchThat(func(s string) bool { return s != "" })).
+			SuchThat(func(parts []string) bool { return len(parts) >= 2 }),
+		gen.IntRange(0, 1<<20),
+		gen.IntRange(0, 2),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
+
+func TestTruncatedTail(t *testing.T) {
+	key := testKey(t, 3)
+	data := sealChunks(t, key, []string{"first", "second", "third"})
+	offsets := chunkOffsets(data)
+
+	// Cutting inside the last chunk keeps the earlier ones readable
+	reader, err := NewReader(bytes.NewReader(data[:len(data)-3]), NewKeyring(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := io.ReadAll(reader)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("err = %v, want io.ErrUnexpectedEOF", err)
+	}
+	if string(plaintext) != "firstsecond" {
+		t.Errorf("plaintext = %q, want %q", plaintext, "firstsecond")
+	}
+	if reader.ValidSize() != int64(offsets[2]) || reader.PlainSize() != int64(len("firstsecond")) {
+		t.Errorf("ValidSize = %d, PlainSize = %d, want %d and %d",
+			reader.ValidSize(), reader.PlainSize(), offsets[2], len("firstsecond"))
+	}
+
+	// Cutting on a chunk boundary is indistinguishable from a shorter file
+	if plaintext, err := decrypt(data[:offsets[2]], NewKeyring(key)); err != nil || string(plaintext) != "firstsecond" {
+		t.Errorf("decrypt = %q, %v; want %q", plaintext, err, "firstsecond")
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	data := sealChunks(t, testKey(t, 4), []string{"secret"})
+
+	if _, err := decrypt(data, NewKeyring(testKey(t, 5))); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("decrypt with another key: err = %v, want ErrUnknownKey", err)
+	}
+	if _, err := decrypt(data, nil); !errors.Is(err, ErrNoKey) {
+		t.Errorf("decrypt without a key: err = %v, want ErrNoKey", err)
+	}
+	// An old key in the keyring still decrypts the file
+	if plaintext, err := decrypt(data, NewKeyring(testKey(t, 5), testKey(t, 4))); err != nil || string(plaintext) != "secret" {
+		t.Errorf("decrypt with an old key = %q, %v", plaintext, err)
+	}
+}
+
+func TestResumeSealer(t *testing.T) {
+	key := testKey(t, 6)
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, sealChunks(t, key, []string{"one", "two"}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Appending after reopening continues the chain
+	for _, part := range []string{"three", "four"} {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, _ := file.Stat()
+		sealer, err := ResumeSealer(file, info.Size(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunk := sealer.Seal([]byte(part))
+		if _, err := file.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+		sealer.Commit(chunk)
+		file.Close()
+	}
+
+	data, _ := os.ReadFile(path)
+	if plaintext, err := decrypt(data, NewKeyring(key)); err != nil || string(plaintext) != "onetwothreefour" {
+		t.Errorf("decrypt = %q, %v; want %q", plaintext, err, "onetwothreefour")
+	}
+
+	// Resuming requires the key the file was written with
+	file, _ := os.Open(path)
+	defer file.Close()
+	if _, err := ResumeSealer(file, int64(len(data)), testKey(t, 7)); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("ResumeSealer with another key: err = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	secret := bytes.Repeat([]byte{0xab}, KeySize)
+	want := testKey(t, 0xab).ID()
+
+	for _, encoded := range []string{
+		hex.EncodeToString(secret),
+		base64.StdEncoding.EncodeToString(secret) + "\n",
+	} {
+		key, err := ParseKey(encoded)
+		if err != nil || key.ID() != want {
+			t.Errorf("ParseKey(%q) = %v, %v", encoded, key, err)
+		}
+	}
+	for _, encoded := range []string{"", "abcd", hex.EncodeToString(secret[:16])} {
+		if _, err := ParseKey(encoded); err == nil {
+			t.Errorf("ParseKey(%q) succeeded, want error", encoded)
+		}
+	}
+}
+
+func TestCurrentFor(t *testing.T) {
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "plain")
+	encrypted := filepath.Join(dir, "encrypted")
+	os.WriteFile(plain, []byte("REDIS0011"), 0644)
+	os.WriteFile(encrypted, sealChunks(t, testKey(t, 8), []string{"data"}), 0644)
+
+	for _, test := range []struct {
+		keyring *Keyring
+		path    string
+		want    bool
+	}{
+		{nil, plain, true},
+		{nil, encrypted, false},
+		{NewKeyring(testKey(t, 8)), plain, false},
+		{NewKeyring(testKey(t, 8)), encrypted, true},
+		{NewKeyring(testKey(t, 9), testKey(t, 8)), encrypted, false},
+	} {
+		if got, err := test.keyring.CurrentFor(test.path); err != nil || got != test.want {
+			t.Errorf("CurrentFor(%s) with %v = %v, %v; want %v", filepath.Base(test.path), test.keyring.Current(), got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package crypt
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ChunkSize is how much plaintext Writer seals per chunk
+const ChunkSize = 64 << 10
+
+// Sealer seals the chunks of one file. Each Seal uses a fresh counter, so
+// a chunk whose write failed is never sealed again under the same nonce.
+type Sealer struct {
+	aead    cipher.AEAD
+	counter uint64
+	// chain is the additional data for the next chunk: the tag of the last
+	// committed chunk, or the header
+	chain []byte
+}
+
+// NewSealer starts a new file encrypted with key, returning its header
+// along with the sealer for its chunks
+func NewSealer(key *Key) ([]byte, *Sealer, error) {
+	header, err := newHeader(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := key.fileAEAD(header[HeaderSize-fileIDSize:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, &Sealer{aead: aead, chain: header}, nil
+}
+
+// ResumeSealer continues an existing encrypted file of the given size so
+// more chunks can be appended. The file must be encrypted with key and end
+// on a chunk boundary; the chunks are walked but not decrypted.
+func ResumeSealer(file io.ReaderAt, size int64, key *Key) (*Sealer, error) {
+	header := make([]byte, HeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("failed to read encryption header: %w", err)
+	}
+	aead, err := parseHeader(header, NewKeyring(key))
+	if err != nil {
+		return nil, err
+	}
+
+	sealer := &Sealer{aead: aead, chain: header}
+	offset := int64(HeaderSize)
+	chunkHeader := make([]byte, chunkHeaderSize)
+	for offset < size {
+		if _, err := file.ReadAt(chunkHeader, offset); err != nil {
+			return nil, fmt.Errorf("incomplete chunk at offset %d", offset)
+		}
+		length := int64(binary.BigEndian.Uint32(chunkHeader))
+		end := offset + chunkHeaderSize + length
+		if length < tagSize || end > size {
+			return nil, fmt.Errorf("incomplete chunk at offset %d", offset)
+		}
+		tag := make([]byte, tagSize)
+		if _, err := file.ReadAt(tag, end-tagSize); err != nil {
+			return nil, err
+		}
+		sealer.counter = binary.BigEndian.Uint64(chunkHeader[4:])
+		sealer.chain = tag
+		offset = end
+	}
+	return sealer, nil
+}
+
+// Seal encrypts plaintext as the next chunk. The chunk only becomes part of
+// the chain once Commit is called after it was written.
+func (s *Sealer) Seal(plaintext []byte) []byte {
+	s.counter++
+	chunk := make([]byte, chunkHeaderSize, chunkHeaderSize+len(plaintext)+tagSize)
+	binary.BigEndian.PutUint32(chunk, uint32(len(plaintext)+tagSize))
+	binary.BigEndian.PutUint64(chunk[4:], s.counter)
+	return s.aead.Seal(chunk, chunkNonce(s.counter), plaintext, s.chain)
+}
+
+// Commit records a sealed chunk as written
+func (s *Sealer) Commit(chunk []byte) {
+	s.chain = append([]byte(nil), chunk[len(chunk)-tagSize:]...)
+}
+
+// Writer encrypts everything written to it into an underlying writer,
+// ChunkSize bytes of plaintext per chunk. Close seals the final chunk.
+type Writer struct {
+	w      io.Writer
+	sealer *Sealer
+	buf    []byte
+	err    error
+}
+
+// NewWriter starts an encrypted file in w, writing its header
+func NewWriter(w io.Writer, key *Key) (*Writer, error) {
+	header, sealer, err := NewSealer(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, sealer: sealer, buf: make([]byte, 0, ChunkSize)}, nil
+}
+
+// Write buffers p, sealing a chunk whenever ChunkSize bytes are pending
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 && w.err == nil {
+		n := min(len(p), ChunkSize-len(w.buf))
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(w.buf) == ChunkSize {
+			w.flush()
+		}
+	}
+	return written, w.err
+}
+
+// flush seals and writes the pending plaintext
+func (w *Writer) flush() {
+	if w.err != nil || len(w.buf) == 0 {
+		return
+	}
+	chunk := w.sealer.Seal(w.buf)
+	if _, w.err = w.w.Write(chunk); w.err == nil {
+		w.sealer.Commit(chunk)
+	}
+	w.buf = w.buf[:0]
+}
+
+// Close seals the remaining plaintext; it does not close the underlying writer
+func (w *Writer) Close() error {
+	w.flush()
+	return w.err
+}
+
+// Reader decrypts an encrypted file, verifying every chunk before any of
+// its plaintext is returned
+type Reader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	chain   []byte
+	counter uint64
+	keyID   string
+	pending []byte
+	err     error
+	// valid and plain are the encrypted and plaintext sizes of the chunks
+	// verified so far
+	valid int64
+	plain int64
+}
+
+// NewReader starts decrypting an encrypted file from r, picking the key
+// named in its header from keyring
+func NewReader(r io.Reader, keyring *Keyring) (*Reader, error) {
+	reader := &Reader{r: bufio.NewReader(r)}
+	header := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(reader.r, header); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("failed to read encryption header: %w", err)
+	}
+	aead, err := parseHeader(header, keyring)
+	if err != nil {
+		return nil, err
+	}
+	reader.aead = aead
+	reader.chain = header
+	reader.valid = int64(HeaderSize)
+	reader.keyID = fmt.Sprintf("%x", header[len(magic)+1:len(magic)+1+keyIDSize])
+	return reader, nil
+}
+
+// KeyID returns the ID of the key the file is encrypted with
+func (r *Reader) KeyID() string {
+	return r.keyID
+}
+
+// ValidSize returns how many bytes of the file, header included, were
+// verified: the offset of the first chunk not read yet or found bad
+func (r *Reader) ValidSize() int64 {
+	return r.valid
+}
+
+// PlainSize returns how much plaintext the verified chunks held
+func (r *Reader) PlainSize() int64 {
+	return r.plain
+}
+
+// Read returns decrypted plaintext. A chunk cut short yields
+// io.ErrUnexpectedEOF and a chunk failing authentication ErrCorrupt.
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.pending, r.err = r.nextChunk()
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// nextChunk reads and opens the next chunk
+func (r *Reader) nextChunk() ([]byte, error) {
+	chunkHeader := make([]byte, chunkHeaderSize)
+	if _, err := io.ReadFull(r.r, chunkHeader); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, io.ErrUnexpectedEOF
+	}
+	length := binary.BigEndian.Uint32(chunkHeader)
+	counter := binary.BigEndian.Uint64(chunkHeader[4:])
+	if length < tagSize || length > maxChunkSize || counter <= r.counter {
+		return nil, fmt.Errorf("%w: bad chunk header at offset %d", ErrCorrupt, r.valid)
+	}
+
+	ciphertext := make([]byte, length)
+	if _, err := io.ReadFull(r.r, ciphertext); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	plaintext, err := r.aead.Open(nil, chunkNonce(counter), ciphertext, r.chain)
+	if err != nil {
+		return nil, fmt.Errorf("%w: chunk at offset %d", ErrCorrupt, r.valid)
+	}
+
+	r.counter = counter
+	r.chain = ciphertext[len(ciphertext)-tagSize:]
+	r.valid += chunkHeaderSize + int64(length)
+	r.plain += int64(len(plaintext))
+	return plaintext, nil
+}
+
+// Plaintext returns a reader of the plaintext of r, which may or may not be
+// encrypted. For an encrypted file the decrypting Reader is returned too.
+func Plaintext(r io.Reader, keyring *Keyring) (io.Reader, *Reader, error) {
+	buffered := bufio.NewReader(r)
+	prefix, err := buffered.Peek(len(magic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, nil, err
+	}
+	if !IsEncrypted(prefix) {
+		return buffered, nil, nil
+	}
+	decrypted, err := NewReader(buffered, keyring)
+	if err != nil {
+		return nil, nil, err
+	}
+	return decrypted, decrypted, nil
+}
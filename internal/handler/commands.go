@@ -0,0 +1,66 @@
+package handler
+
+import "redis-like-server/internal/resp2"
+
+// Command flags describing how a command interacts with the keyspace
+const (
+	// FlagWrite marks commands that may modify the keyspace
+	FlagWrite = 1 << iota
+	// FlagReadOnly marks commands that only read the keyspace
+	FlagReadOnly
+)
+
+// CommandSpec describes a command executed by the command handler. The
+// keys are found the way Redis specifies them: FirstKey is the position of
+// the first key in the command, counting the name as 0 and 0 meaning no
+// keys; LastKey is the position of the last one, negative positions
+// counting from the end; KeyStep is the distance between keys.
+type CommandSpec struct {
+	Name     string
+	Flags    int
+	FirstKey int
+	LastKey  int
+	KeyStep  int
+}
+
+// commandTable lists the commands implemented by the command handler
+var commandTable = map[string]CommandSpec{
+	"PING":    {Name: "PING"},
+	"SET":     {Name: "SET", Flags: FlagWrite, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"GET":     {Name: "GET", Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"EXISTS":  {Name: "EXISTS", Flags: FlagReadOnly, FirstKey: 1, LastKey: -1, KeyStep: 1},
+	"DEL":     {Name: "DEL", Flags: FlagWrite, FirstKey: 1, LastKey: -1, KeyStep: 1},
+	"DUMP":    {Name: "DUMP", Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1},
+	"RESTORE": {Name: "RESTORE", Flags: FlagWrite, FirstKey: 1, LastKey: 1, KeyStep: 1},
+}
+
+// LookupCommand returns the specification of a handler command
+func LookupCommand(name string) (CommandSpec, bool) {
+	spec, exists := commandTable[name]
+	return spec, exists
+}
+
+// IsWriteCommand reports whether the named command may modify the keyspace
+func IsWriteCommand(name string) bool {
+	spec, exists := commandTable[name]
+	return exists && spec.Flags&FlagWrite != 0
+}
+
+// CommandKeys returns the keys a command refers to, or nil for commands
+// without keys and unknown commands. Keys missing from a command with too
+// few arguments are left out; the command itself reports the error.
+func CommandKeys(cmd *resp2.Command) []string {
+	spec, exists := commandTable[cmd.Name]
+	if !exists || spec.FirstKey == 0 {
+		return nil
+	}
+	last := spec.LastKey
+	if last < 0 {
+		last += len(cmd.Args) + 1
+	}
+	var keys []string
+	for i := spec.FirstKey; i <= last && i <= len(cmd.Args); i += spec.KeyStep {
+		keys = append(keys, cmd.Args[i-1])
+	}
+	return keys
+}
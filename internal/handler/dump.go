@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"redis-like-server/internal/rdb"
+	"redis-like-server/internal/resp2"
+)
+
+// handleDump handles DUMP commands
+func (h *DefaultCommandHandler) handleDump(args []string) *resp2.RESPValue {
+	if len(args) != 1 {
+		return &resp2.RESPValue{
+			Type: resp2.Error,
+			Str:  "ERR wrong number of arguments for 'DUMP' command",
+		}
+	}
+
+	value, exists := h.store.Get(args[0])
+	if !exists {
+		return &resp2.RESPValue{Type: resp2.NullBulkString, Null: true}
+	}
+	payload, err := rdb.Dump(rdb.Entry{Type: rdb.TypeString, Value: value})
+	if err != nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: fmt.Sprintf("ERR %v", err)}
+	}
+	return &resp2.RESPValue{Type: resp2.BulkString, Str: string(payload)}
+}
+
+// restoreOptions holds the parsed arguments of a RESTORE command
+type restoreOptions struct {
+	key      string
+	ttl      int64
+	payload  string
+	replace  bool
+	absTTL   bool
+	idleTime int64
+	freq     int64
+}
+
+// parseRestore parses RESTORE key ttl serialized-value [REPLACE] [ABSTTL]
+// [IDLETIME seconds] [FREQ frequency], returning the error reply Redis
+// would give for invalid arguments
+func parseRestore(args []string) (*restoreOptions, *resp2.RESPValue) {
+	if len(args) < 3 {
+		return nil, &resp2.RESPValue{
+			Type: resp2.Error,
+			Str:  "ERR wrong number of arguments for 'RESTORE' command",
+		}
+	}
+
+	opts := &restoreOptions{key: args[0], payload: args[2], idleTime: -1, freq: -1}
+	for i := 3; i < len(args); i++ {
+		additional := len(args) - i - 1
+		switch option := strings.ToUpper(args[i]); {
+		case option == "REPLACE":
+			opts.replace = true
+		case option == "ABSTTL":
+			opts.absTTL = true
+		case option == "IDLETIME" && additional >= 1 && opts.freq == -1:
+			idle, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return nil, notAnInteger()
+			}
+			if idle < 0 {
+				return nil, &resp2.RESPValue{Type: resp2.Error, Str: "ERR Invalid IDLETIME value, must be >= 0"}
+			}
+			opts.idleTime = idle
+			i++
+		case option == "FREQ" && additional >= 1 && opts.idleTime == -1:
+			freq, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return nil, notAnInteger()
+			}
+			if freq < 0 || freq > 255 {
+				return nil, &resp2.RESPValue{Type: resp2.Error, Str: "ERR Invalid FREQ value, must be >= 0 and <= 255"}
+			}
+			opts.freq = freq
+			i++
+		default:
+			return nil, &resp2.RESPValue{Type: resp2.Error, Str: "ERR syntax error"}
+		}
+	}
+	return opts, nil
+}
+
+// handleRestore handles RESTORE commands. IDLETIME and FREQ are validated
+// but otherwise ignored, since the store keeps no access statistics.
+func (h *DefaultCommandHandler) handleRestore(args []string) *resp2.RESPValue {
+	opts, errReply := parseRestore(args)
+	if errReply != nil {
+		return errReply
+	}
+
+	ttl, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return notAnInteger()
+	}
+	if ttl < 0 {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR Invalid TTL value, must be >= 0"}
+	}
+
+	entry, err := rdb.Restore([]byte(opts.payload))
+	if errors.Is(err, rdb.ErrDumpPayload) {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR DUMP payload version or checksum are wrong"}
+	}
+	if err != nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR Bad data format"}
+	}
+	if entry.Type != rdb.TypeString {
+		return &resp2.RESPValue{
+			Type: resp2.Error,
+			Str:  fmt.Sprintf("ERR DUMP payload holds a %s, only strings are supported", entry.Type),
+		}
+	}
+	// The key is only checked once the arguments are known to be valid
+	if !opts.replace && h.store.Exists(opts.key) {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "BUSYKEY Target key name already exists."}
+	}
+
+	deleted := opts.replace && h.store.Delete(opts.key)
+
+	expireAt := ttl
+	if ttl > 0 && !opts.absTTL {
+		expireAt = time.Now().UnixMilli() + ttl
+	}
+	// A key restored with an expiry in the past is not created at all
+	if ttl > 0 && expireAt <= time.Now().UnixMilli() {
+		if deleted {
+			h.notifier.Notify(NotifyGeneric, "del", opts.key)
+		}
+		return &resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"}
+	}
+
+	h.store.SetWithExpiry(opts.key, entry.Value, expireAt)
+	h.notifier.Notify(NotifyGeneric, "restore", opts.key)
+	return &resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"}
+}
+
+// PropagationForm returns the command to log in place of cmd so that
+// replaying it later has the same effect. RESTORE with a relative TTL is
+// rewritten to use ABSTTL, as Redis does; other commands are unchanged.
+func PropagationForm(cmd *resp2.Command) *resp2.Command {
+	if cmd.Name != "RESTORE" {
+		return cmd
+	}
+	opts, errReply := parseRestore(cmd.Args)
+	if errReply != nil || opts.absTTL {
+		return cmd
+	}
+	ttl, err := strconv.ParseInt(cmd.Args[1], 10, 64)
+	if err != nil || ttl <= 0 {
+		return cmd
+	}
+
+	args := append([]string{cmd.Args[0], strconv.FormatInt(time.Now().UnixMilli()+ttl, 10)}, cmd.Args[2:]...)
+	return &resp2.Command{Name: cmd.Name, Args: append(args, "ABSTTL")}
+}
+
+// notAnInteger is the error reply for arguments that must be integers
+func notAnInteger() *resp2.RESPValue {
+	return &resp2.RESPValue{Type: resp2.Error, Str: "ERR value is not an integer or out of range"}
+}
@@ -13,7 +13,8 @@ type CommandHandler interface {
 
 // DefaultCommandHandler is the default implementation of CommandHandler
 type DefaultCommandHandler struct {
-	store store.KeyValueStore
+	store    store.KeyValueStore
+	notifier *KeyspaceNotifier
 }
 
 // NewCommandHandler creates a new command handler
@@ -23,6 +24,15 @@ func NewCommandHandler(store store.KeyValueStore) CommandHandler {
 	}
 }
 
+// NewCommandHandlerWithNotifier creates a command handler that publishes
+// keyspace notifications for every key it changes
+func NewCommandHandlerWithNotifier(store store.KeyValueStore, notifier *KeyspaceNotifier) CommandHandler {
+	return &DefaultCommandHandler{
+		store:    store,
+		notifier: notifier,
+	}
+}
+
 // Execute processes and executes a command
 func (h *DefaultCommandHandler) Execute(cmd *resp2.Command) *resp2.RESPValue {
 	if cmd == nil {
@@ -43,6 +53,10 @@ func (h *DefaultCommandHandler) Execute(cmd *resp2.Command) *resp2.RESPValue {
 		return h.handleExists(cmd.Args)
 	case "DEL":
 		return h.handleDel(cmd.Args)
+	case "DUMP":
+		return h.handleDump(cmd.Args)
+	case "RESTORE":
+		return h.handleRestore(cmd.Args)
 	default:
 		return &resp2.RESPValue{
 			Type: resp2.Error,
@@ -86,8 +100,15 @@ func (h *DefaultCommandHandler) handleSet(args []string) *resp2.RESPValue {
 	key := args[0]
 	value := args[1]
 	
-	// Store the key-value pair
-	h.store.Set(key, value)
+	// Store the key-value pair; the store tells whether it created the key
+	// under the same lock as the write, so concurrent SETs of a new key
+	// announce it once
+	isNew := h.store.Set(key, value)
+	
+	if isNew {
+		h.notifier.Notify(NotifyNew, "new", key)
+	}
+	h.notifier.Notify(NotifyString, "set", key)
 	
 	// Return OK response
 	return &resp2.RESPValue{
@@ -117,6 +138,7 @@ func (h *DefaultCommandHandler) handleGet(args []string) *resp2.RESPValue {
 			Str:  value,
 		}
 	} else {
+		h.notifier.Notify(NotifyKeyMiss, "keymiss", key)
 		// Return null bulk string for non-existing keys
 		return &resp2.RESPValue{
 			Type: resp2.NullBulkString,
@@ -161,7 +183,15 @@ func (h *DefaultCommandHandler) handleDel(args []string) *resp2.RESPValue {
 	
 	var deletedCount int64
 	
-	if len(args) == 1 {
+	if h.notifier.Enabled(NotifyGeneric) {
+		// Delete key by key so each removal can be announced
+		for _, key := range args {
+			if h.store.Delete(key) {
+				deletedCount++
+				h.notifier.Notify(NotifyGeneric, "del", key)
+			}
+		}
+	} else if len(args) == 1 {
 		// Single key deletion
 		if h.store.Delete(args[0]) {
 			deletedCount = 1
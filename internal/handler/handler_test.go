@@ -1,9 +1,12 @@
 package handler
 
 import (
+	"sync"
 	"testing"
+	"time"
 
 	"redis-like-server/internal/resp2"
+	"redis-like-server/internal/store"
 
 	"github.com/leanovate/gopter"
 	"github.com/leanovate/gopter/gen"
@@ -96,7 +99,13 @@ func newMockStore() *mockStore {
 	}
 }
 
-func (s *mockStore) Set(key, value string) {
+func (s *mockStore) Set(key, value string) bool {
+	_, exists := s.data[key]
+	s.data[key] = value
+	return !exists
+}
+
+func (s *mockStore) SetWithExpiry(key, value string, expireAt int64) {
 	s.data[key] = value
 }
 
@@ -110,6 +119,19 @@ func (s *mockStore) Exists(key string) bool {
 	return exists
 }
 
+func (s *mockStore) ExpireAt(key string) (int64, bool) {
+	_, exists := s.data[key]
+	return 0, exists
+}
+
+func (s *mockStore) Expired(key string) bool {
+	return false
+}
+
+func (s *mockStore) ExpiredKeys(sample int) []string {
+	return nil
+}
+
 func (s *mockStore) Delete(key string) bool {
 	_, exists := s.data[key]
 	if exists {
@@ -129,6 +151,37 @@ func (s *mockStore) DeleteMultiple(keys []string) int {
 	return deletedCount
 }
 
+func (s *mockStore) Snapshot() map[string]store.Item {
+	snapshot := make(map[string]store.Item, len(s.data))
+	for key, value := range s.data {
+		snapshot[key] = store.Item{Value: value}
+	}
+	return snapshot
+}
+
+func (s *mockStore) View() store.View {
+	return mockView(s.Snapshot())
+}
+
+func (s *mockStore) Close() error {
+	return nil
+}
+
+// mockView is a view over a copied map
+type mockView map[string]store.Item
+
+func (v mockView) Range(fn func(key string, item store.Item) bool) {
+	for key, item := range v {
+		if !fn(key, item) {
+			return
+		}
+	}
+}
+
+func (v mockView) Err() error { return nil }
+
+func (v mockView) Release() {}
+
 // Property-based test setup for error handling robustness
 func TestErrorHandlingRobustness(t *testing.T) {
 	properties := gopter.NewProperties(nil)
@@ -167,7 +220,7 @@ func TestErrorHandlingRobustness(t *testing.T) {
 			// Exclude valid commands
 			validCommands := map[string]bool{
 				"PING": true, "SET": true, "GET": true, 
-				"EXISTS": true, "DEL": true,
+				"EXISTS": true, "DEL": true, "DUMP": true, "RESTORE": true,
 			}
 			return !validCommands[s]
 		}),
@@ -204,4 +257,239 @@ func TestErrorHandlingRobustness(t *testing.T) {
 	))
 
 	properties.TestingRun(t, gopter.ConsoleReporter(false))
-}
\ No newline at end of file
+}
+
+// recordingPublisher records published notifications for inspection
+type recordingPublisher struct {
+	messages []string
+}
+
+func (p *recordingPublisher) Publish(channel, message string) int {
+	p.messages = append(p.messages, channel+" "+message)
+	return 0
+}
+
+// Property-based test setup for keyspace notifications
+func TestKeyspaceNotifications(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	// For any key, SET and DEL should publish keyspace and keyevent
+	// notifications when their classes are enabled, and nothing otherwise
+	properties.Property("mutations publish notifications for enabled classes", prop.ForAll(
+		func(key string, flags string) bool {
+			classes, err := ParseKeyspaceEvents(flags)
+			if err != nil {
+				return false
+			}
+			publisher := &recordingPublisher{}
+			handler := NewCommandHandlerWithNotifier(newMockStore(), NewKeyspaceNotifier(publisher, classes))
+
+			handler.Execute(&resp2.Command{Name: "SET", Args: []string{key, "value"}})
+			handler.Execute(&resp2.Command{Name: "DEL", Args: []string{key, key}})
+
+			var expected []string
+			emit := func(class int, event string) {
+				if classes&class == 0 {
+					return
+				}
+				if classes&NotifyKeyspace != 0 {
+					expected = append(expected, "__keyspace@0__:"+key+" "+event)
+				}
+				if classes&NotifyKeyevent != 0 {
+					expected = append(expected, "__keyevent@0__:"+event+" "+key)
+				}
+			}
+			emit(NotifyNew, "new")
+			emit(NotifyString, "set")
+			emit(NotifyGeneric, "del")
+
+			if len(publisher.messages) != len(expected) {
+				return false
+			}
+			for i := range expected {
+				if publisher.messages[i] != expected[i] {
+					return false
+				}
+			}
+			return true
+		},
+		gen.AlphaString(),
+		gen.OneConstOf("", "K", "E", "KEA", "Kg", "E$", "KEn", "Ag", "K$g"),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
+
+// countingPublisher counts the messages published, safe for concurrent use
+type countingPublisher struct {
+	mutex    sync.Mutex
+	messages map[string]int
+}
+
+func (p *countingPublisher) Publish(channel, message string) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.messages[channel+" "+message]++
+	return 0
+}
+
+// slowExistsStore is a store whose existence checks take a while, widening
+// any gap between checking for a key and writing it
+type slowExistsStore struct {
+	store.KeyValueStore
+}
+
+func (s slowExistsStore) Exists(key string) bool {
+	exists := s.KeyValueStore.Exists(key)
+	time.Sleep(time.Millisecond)
+	return exists
+}
+
+func TestConcurrentSetAnnouncesNewKeyOnce(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		publisher := &countingPublisher{messages: make(map[string]int)}
+		kv := slowExistsStore{store.NewInMemoryStore()}
+		handler := NewCommandHandlerWithNotifier(kv, NewKeyspaceNotifier(publisher, NotifyKeyevent|NotifyNew))
+
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				handler.Execute(&resp2.Command{Name: "SET", Args: []string{"key", "value"}})
+			}()
+		}
+		close(start)
+		wg.Wait()
+		if got := publisher.messages["__keyevent@0__:new key"]; got != 1 {
+			t.Fatalf("round %d: concurrent SETs of a new key announced it %d times, want 1", round, got)
+		}
+	}
+}
+
+func TestParseKeyspaceEvents(t *testing.T) {
+	tests := []struct {
+		flags     string
+		canonical string
+	}{
+		{"", ""},
+		{"KEA", "AKE"},
+		{"Ex", "xE"},
+		{"g$lshzxetKE", "AKE"},
+		{"AKEmn", "AmnKE"},
+	}
+
+	for _, tt := range tests {
+		classes, err := ParseKeyspaceEvents(tt.flags)
+		if err != nil {
+			t.Fatalf("ParseKeyspaceEvents(%q) returned error: %v", tt.flags, err)
+		}
+		if got := KeyspaceEventsString(classes); got != tt.canonical {
+			t.Errorf("KeyspaceEventsString(%q) = %q, want %q", tt.flags, got, tt.canonical)
+		}
+	}
+
+	if _, err := ParseKeyspaceEvents("KQ"); err == nil {
+		t.Error("Expected error for invalid flag")
+	}
+}
+
+// Property-based test setup for DUMP and RESTORE
+func TestDumpRestore(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	// For any value, restoring a DUMP payload under another key recreates the
+	// value, and restoring over an existing key requires REPLACE
+	properties.Property("RESTORE recreates a DUMPed value", prop.ForAll(
+		func(value string) bool {
+			handler := NewCommandHandler(store.NewInMemoryStore())
+			handler.Execute(&resp2.Command{Name: "SET", Args: []string{"source", value}})
+
+			dump := handler.Execute(&resp2.Command{Name: "DUMP", Args: []string{"source"}})
+			if dump.Type != resp2.BulkString {
+				return false
+			}
+
+			restore := handler.Execute(&resp2.Command{Name: "RESTORE", Args: []string{"copy", "0", dump.Str}})
+			got := handler.Execute(&resp2.Command{Name: "GET", Args: []string{"copy"}})
+			if restore.Str != "OK" || got.Str != value {
+				return false
+			}
+
+			busy := handler.Execute(&resp2.Command{Name: "RESTORE", Args: []string{"copy", "0", dump.Str}})
+			replaced := handler.Execute(&resp2.Command{Name: "RESTORE", Args: []string{"copy", "60000", dump.Str, "REPLACE"}})
+			return busy.Str == "BUSYKEY Target key name already exists." && replaced.Str == "OK"
+		},
+		gen.AnyString(),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
+
+func TestRestoreErrors(t *testing.T) {
+	handler := NewCommandHandler(store.NewInMemoryStore())
+	handler.Execute(&resp2.Command{Name: "SET", Args: []string{"source", "value"}})
+	payload := handler.Execute(&resp2.Command{Name: "DUMP", Args: []string{"source"}}).Str
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"k", "-1", payload}, "ERR Invalid TTL value, must be >= 0"},
+		{[]string{"k", "abc", payload}, "ERR value is not an integer or out of range"},
+		{[]string{"k", "0", payload[:len(payload)-1] + "x"}, "ERR DUMP payload version or checksum are wrong"},
+		{[]string{"k", "0", payload, "IDLETIME", "-1"}, "ERR Invalid IDLETIME value, must be >= 0"},
+		{[]string{"k", "0", payload, "FREQ", "256"}, "ERR Invalid FREQ value, must be >= 0 and <= 255"},
+		{[]string{"k", "0", payload, "IDLETIME", "1", "FREQ", "1"}, "ERR syntax error"},
+		{[]string{"k", "0", payload, "BOGUS"}, "ERR syntax error"},
+		{[]string{"source", "-1", payload}, "ERR Invalid TTL value, must be >= 0"},
+		{[]string{"source", "0", payload[:len(payload)-1] + "x"}, "ERR DUMP payload version or checksum are wrong"},
+		{[]string{"source", "0", payload}, "BUSYKEY Target key name already exists."},
+		{[]string{"k", "0", payload, "IDLETIME", "10", "ABSTTL"}, "OK"},
+		{[]string{"gone", "1", payload, "ABSTTL"}, "OK"},
+	}
+	for _, tt := range tests {
+		if got := handler.Execute(&resp2.Command{Name: "RESTORE", Args: tt.args}); got.Str != tt.expected {
+			t.Errorf("RESTORE %q = %q, want %q", tt.args[1:], got.Str, tt.expected)
+		}
+	}
+
+	// An absolute TTL in the past does not create the key
+	if exists := handler.Execute(&resp2.Command{Name: "EXISTS", Args: []string{"gone"}}); exists.Int != 0 {
+		t.Error("Expected a key restored with an expired ABSTTL to be absent")
+	}
+
+	// A relative TTL is logged as an absolute one
+	logged := PropagationForm(&resp2.Command{Name: "RESTORE", Args: []string{"k", "5000", payload, "REPLACE"}})
+	if len(logged.Args) != 5 || logged.Args[4] != "ABSTTL" || logged.Args[3] != "REPLACE" || logged.Args[1] == "5000" {
+		t.Errorf("Unexpected propagated form %q", logged.Args)
+	}
+}
+
+func TestCommandKeys(t *testing.T) {
+	tests := []struct {
+		cmd  resp2.Command
+		keys []string
+	}{
+		{resp2.Command{Name: "SET", Args: []string{"k", "v", "EX", "10"}}, []string{"k"}},
+		{resp2.Command{Name: "DEL", Args: []string{"a", "b", "c"}}, []string{"a", "b", "c"}},
+		{resp2.Command{Name: "EXISTS"}, nil},
+		{resp2.Command{Name: "RESTORE", Args: []string{"k", "0", "payload"}}, []string{"k"}},
+		{resp2.Command{Name: "PING", Args: []string{"k"}}, nil},
+		{resp2.Command{Name: "UNKNOWN", Args: []string{"k"}}, nil},
+	}
+	for _, tt := range tests {
+		keys := CommandKeys(&tt.cmd)
+		if len(keys) != len(tt.keys) {
+			t.Errorf("CommandKeys(%s %q) = %q, want %q", tt.cmd.Name, tt.cmd.Args, keys, tt.keys)
+			continue
+		}
+		for i := range keys {
+			if keys[i] != tt.keys[i] {
+				t.Errorf("CommandKeys(%s %q) = %q, want %q", tt.cmd.Name, tt.cmd.Args, keys, tt.keys)
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// Keyspace notification classes, one per notify-keyspace-events flag character
+const (
+	NotifyKeyspace = 1 << iota // K: publish on __keyspace@<db>__:<key>
+	NotifyKeyevent             // E: publish on __keyevent@<db>__:<event>
+	NotifyGeneric              // g: generic commands such as DEL
+	NotifyString               // $: string commands
+	NotifyList                 // l: list commands
+	NotifySet                  // s: set commands
+	NotifyHash                 // h: hash commands
+	NotifyZSet                 // z: sorted set commands
+	NotifyExpired              // x: key expired
+	NotifyEvicted              // e: key evicted; nothing is ever evicted, so it never fires
+	NotifyStream               // t: stream commands
+	NotifyKeyMiss              // m: key accessed but missing
+	NotifyNew                  // n: new key added
+
+	// NotifyAll is the 'A' alias; like Redis it excludes the m and n classes
+	NotifyAll = NotifyGeneric | NotifyString | NotifyList | NotifySet | NotifyHash |
+		NotifyZSet | NotifyExpired | NotifyEvicted | NotifyStream
+)
+
+// notifyFlagChars maps each flag character to its class, in Redis' canonical output order
+var notifyFlagChars = []struct {
+	char  byte
+	class int
+}{
+	{'g', NotifyGeneric},
+	{'$', NotifyString},
+	{'l', NotifyList},
+	{'s', NotifySet},
+	{'h', NotifyHash},
+	{'z', NotifyZSet},
+	{'x', NotifyExpired},
+	{'e', NotifyEvicted},
+	{'t', NotifyStream},
+	{'m', NotifyKeyMiss},
+	{'n', NotifyNew},
+	{'K', NotifyKeyspace},
+	{'E', NotifyKeyevent},
+}
+
+// ParseKeyspaceEvents converts a notify-keyspace-events flag string into a class bitmask
+func ParseKeyspaceEvents(flags string) (int, error) {
+	classes := 0
+	for i := 0; i < len(flags); i++ {
+		if flags[i] == 'A' {
+			classes |= NotifyAll
+			continue
+		}
+		found := false
+		for _, flag := range notifyFlagChars {
+			if flag.char == flags[i] {
+				classes |= flag.class
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("invalid notify-keyspace-events flag '%c'", flags[i])
+		}
+	}
+	return classes, nil
+}
+
+// KeyspaceEventsString converts a class bitmask back into its flag string,
+// using 'A' when every class it covers is enabled
+func KeyspaceEventsString(classes int) string {
+	var result strings.Builder
+	if classes&NotifyAll == NotifyAll {
+		result.WriteByte('A')
+	}
+	for _, flag := range notifyFlagChars {
+		if flag.class&NotifyAll != 0 && classes&NotifyAll == NotifyAll {
+			continue
+		}
+		if classes&flag.class != 0 {
+			result.WriteByte(flag.char)
+		}
+	}
+	return result.String()
+}
+
+// Publisher delivers a message on a pub/sub channel
+type Publisher interface {
+	Publish(channel, message string) int
+}
+
+// KeyspaceNotifier publishes keyspace and keyevent notifications for key changes
+type KeyspaceNotifier struct {
+	publisher Publisher
+	classes   atomic.Int64
+}
+
+// NewKeyspaceNotifier creates a notifier publishing through the given publisher
+func NewKeyspaceNotifier(publisher Publisher, classes int) *KeyspaceNotifier {
+	notifier := &KeyspaceNotifier{publisher: publisher}
+	notifier.SetClasses(classes)
+	return notifier
+}
+
+// SetClasses replaces the enabled notification classes
+func (n *KeyspaceNotifier) SetClasses(classes int) {
+	n.classes.Store(int64(classes))
+}
+
+// Classes returns the enabled notification classes
+func (n *KeyspaceNotifier) Classes() int {
+	return int(n.classes.Load())
+}
+
+// Enabled reports whether events of the given class would be published
+func (n *KeyspaceNotifier) Enabled(class int) bool {
+	if n == nil {
+		return false
+	}
+	classes := n.Classes()
+	return classes&class != 0 && classes&(NotifyKeyspace|NotifyKeyevent) != 0
+}
+
+// Notify publishes an event of the given class for a key. It is a no-op on a
+// nil notifier or when the class is disabled.
+func (n *KeyspaceNotifier) Notify(class int, event, key string) {
+	if !n.Enabled(class) {
+		return
+	}
+	classes := n.Classes()
+	if classes&NotifyKeyspace != 0 {
+		n.publisher.Publish("__keyspace@0__:"+key, event)
+	}
+	if classes&NotifyKeyevent != 0 {
+		n.publisher.Publish("__keyevent@0__:"+event, key)
+	}
+}
@@ -0,0 +1,243 @@
+// Package jsonl exports and imports the keyspace as JSON Lines: one JSON
+// object per key holding its type, value and time to live, which is easy to
+// read, diff and edit for test fixtures and migrations
+package jsonl
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"redis-like-server/internal/store"
+)
+
+// TypeString is the type of string keys, the only type the store holds
+const TypeString = "string"
+
+// EncodingBase64 marks a record whose key and value are base64 encoded
+// because they are not valid UTF-8, which JSON strings cannot carry
+const EncodingBase64 = "base64"
+
+// maxLineSize bounds the length of one record when decoding
+const maxLineSize = 512 << 20
+
+// ErrConflict is returned when importing with ConflictFail finds keys that
+// already exist
+var ErrConflict = errors.New("keys already exist")
+
+// Record is one key as written on a line
+type Record struct {
+	Key      string `json:"key"`
+	Type     string `json:"type"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"`
+	// TTL is the time to live in milliseconds; 0 means no expiry
+	TTL int64 `json:"ttl,omitempty"`
+}
+
+// NewRecord builds the record of a key read at now, base64 encoding it when
+// the key or value is not valid UTF-8
+func NewRecord(key string, item store.Item, now int64) Record {
+	record := Record{Key: key, Type: TypeString, Value: item.Value}
+	if !utf8.ValidString(key) || !utf8.ValidString(item.Value) {
+		record.Key = base64.StdEncoding.EncodeToString([]byte(key))
+		record.Value = base64.StdEncoding.EncodeToString([]byte(item.Value))
+		record.Encoding = EncodingBase64
+	}
+	if item.ExpireAt != 0 {
+		record.TTL = max(item.ExpireAt-now, 1)
+	}
+	return record
+}
+
+// Item validates the record and returns its key and item as of now
+func (r Record) Item(now int64) (string, store.Item, error) {
+	if r.Type != TypeString {
+		return "", store.Item{}, fmt.Errorf("key %q holds a %s, only strings are supported", r.Key, r.Type)
+	}
+	if r.TTL < 0 {
+		return "", store.Item{}, fmt.Errorf("key %q has a negative ttl %d", r.Key, r.TTL)
+	}
+	key, value := r.Key, r.Value
+	switch r.Encoding {
+	case "":
+	case EncodingBase64:
+		decodedKey, err := base64.StdEncoding.DecodeString(r.Key)
+		if err != nil {
+			return "", store.Item{}, fmt.Errorf("invalid base64 key %q: %w", r.Key, err)
+		}
+		decodedValue, err := base64.StdEncoding.DecodeString(r.Value)
+		if err != nil {
+			return "", store.Item{}, fmt.Errorf("invalid base64 value of key %q: %w", r.Key, err)
+		}
+		key, value = string(decodedKey), string(decodedValue)
+	default:
+		return "", store.Item{}, fmt.Errorf("key %q has an unknown encoding %q", r.Key, r.Encoding)
+	}
+	item := store.Item{Value: value}
+	if r.TTL != 0 {
+		item.ExpireAt = now + r.TTL
+	}
+	return key, item, nil
+}
+
+// Write writes every key of a frozen view that is live at now as one line,
+// returning how many keys were written
+func Write(w io.Writer, view store.View, now int64) (int, error) {
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	encoder.SetEscapeHTML(false)
+	keys := 0
+	var err error
+	view.Range(func(key string, item store.Item) bool {
+		if item.ExpireAt != 0 && item.ExpireAt <= now {
+			return true
+		}
+		if err = encoder.Encode(NewRecord(key, item, now)); err != nil {
+			return false
+		}
+		keys++
+		return true
+	})
+	if err != nil {
+		return keys, err
+	}
+	if err := view.Err(); err != nil {
+		return keys, err
+	}
+	return keys, buffered.Flush()
+}
+
+// Read decodes every line of r as of now, rejecting the whole input at the
+// first invalid line or duplicate key. Blank lines are ignored.
+func Read(r io.Reader, now int64) (map[string]store.Item, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxLineSize)
+	items := make(map[string]store.Item)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		decoder := json.NewDecoder(strings.NewReader(text))
+		decoder.DisallowUnknownFields()
+		var record Record
+		if err := decoder.Decode(&record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if decoder.More() {
+			return nil, fmt.Errorf("line %d: unexpected data after the record", line)
+		}
+		key, item, err := record.Item(now)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if _, exists := items[key]; exists {
+			return nil, fmt.Errorf("line %d: key %q appears more than once", line, key)
+		}
+		items[key] = item
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read records: %w", err)
+	}
+	return items, nil
+}
+
+// ConflictPolicy decides what an import does with keys that already exist
+type ConflictPolicy int
+
+const (
+	// ConflictFail aborts the import before writing anything
+	ConflictFail ConflictPolicy = iota
+	// ConflictSkip keeps the existing value
+	ConflictSkip
+	// ConflictReplace overwrites the existing value
+	ConflictReplace
+)
+
+// ParseConflictPolicy parses a conflict policy name
+func ParseConflictPolicy(value string) (ConflictPolicy, error) {
+	switch strings.ToLower(value) {
+	case "skip":
+		return ConflictSkip, nil
+	case "replace":
+		return ConflictReplace, nil
+	case "fail":
+		return ConflictFail, nil
+	default:
+		return 0, fmt.Errorf("invalid conflict policy %q: expected skip, replace or fail", value)
+	}
+}
+
+// String returns the name of the policy
+func (p ConflictPolicy) String() string {
+	switch p {
+	case ConflictSkip:
+		return "skip"
+	case ConflictReplace:
+		return "replace"
+	default:
+		return "fail"
+	}
+}
+
+// ImportResult counts what an import did
+type ImportResult struct {
+	// Imported counts the keys written, Replaced those of them that
+	// overwrote an existing key and Skipped the keys left alone because
+	// they existed
+	Imported int
+	Replaced int
+	Skipped  int
+}
+
+// Import loads JSON Lines into kv as of now. The input is read and
+// validated in full, and conflicts checked, before anything is written, so
+// an invalid file or a conflict under ConflictFail leaves kv untouched. The
+// caller must keep other writers away from kv for the import to be atomic.
+func Import(kv store.KeyValueStore, r io.Reader, policy ConflictPolicy, now int64) (ImportResult, error) {
+	var result ImportResult
+	items, err := Read(r, now)
+	if err != nil {
+		return result, err
+	}
+
+	existing := make(map[string]bool)
+	for key := range items {
+		if kv.Exists(key) {
+			existing[key] = true
+		}
+	}
+	if policy == ConflictFail && len(existing) > 0 {
+		return result, fmt.Errorf("%w: %d of the imported keys, such as %q", ErrConflict, len(existing), firstKey(existing))
+	}
+
+	for key, item := range items {
+		if existing[key] {
+			if policy == ConflictSkip {
+				result.Skipped++
+				continue
+			}
+			result.Replaced++
+		}
+		kv.SetWithExpiry(key, item.Value, item.ExpireAt)
+		result.Imported++
+	}
+	return result, nil
+}
+
+// firstKey returns the smallest key of a non-empty set
+func firstKey(keys map[string]bool) string {
+	first, found := "", false
+	for key := range keys {
+		if !found || key < first {
+			first, found = key, true
+		}
+	}
+	return first
+}
@@ -0,0 +1,145 @@
+package jsonl
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leanovate/gopter"
+	"github.com/leanovate/gopter/gen"
+	"github.com/leanovate/gopter/prop"
+
+	"redis-like-server/internal/store"
+)
+
+// export writes the keys of a store as JSON Lines
+func export(t *testing.T, kv store.KeyValueStore, now int64) string {
+	var buf bytes.Buffer
+	view := kv.View()
+	defer view.Release()
+	if _, err := Write(&buf, view, now); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	return buf.String()
+}
+
+// Property-based test setup for JSON Lines round trips
+func TestExportImportRoundTrip(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	// For any keys and values, including ones that are not valid UTF-8,
+	// exporting then importing into an empty store gives the same dataset
+	properties.Property("export then import returns the same keys", prop.ForAll(
+		func(keys []string, values []string, binary bool) bool {
+			now := time.Now().UnixMilli()
+			source := store.NewInMemoryStore()
+			for i, key := range keys {
+				value := values[i%len(values)]
+				if binary && i%2 == 0 {
+					key += "\xff"
+				}
+				source.SetWithExpiry(key, value, int64(i%3)*(now+60000))
+			}
+			source.SetWithExpiry("expired", "value", now-1)
+
+			target := store.NewInMemoryStore()
+			result, err := Import(target, strings.NewReader(export(t, source, now)), ConflictFail, now)
+			if err != nil || result.Imported != len(target.Snapshot()) {
+				return false
+			}
+			return reflect.DeepEqual(target.Snapshot(), source.Snapshot())
+		},
+		gen.SliceOf(gen.AnyString()),
+		gen.SliceOfN(4, gen.AnyString()),
+		gen.Bool(),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
+
+func TestWriteFormat(t *testing.T) {
+	now := time.Now().UnixMilli()
+	kv := store.NewInMemoryStore()
+	kv.SetWithExpiry("session", "<token>", now+500)
+	kv.Set("bytes", "\x00\xff")
+	lines := strings.Split(strings.TrimSpace(export(t, kv, now)), "\n")
+	want := map[string]bool{
+		`{"key":"session","type":"string","value":"<token>","ttl":500}`:         true,
+		`{"key":"Ynl0ZXM=","type":"string","value":"AP8=","encoding":"base64"}`: true,
+	}
+	if len(lines) != 2 || !want[lines[0]] || !want[lines[1]] {
+		t.Errorf("Unexpected export %q", lines)
+	}
+}
+
+func TestImportConflicts(t *testing.T) {
+	input := `{"key":"existing","type":"string","value":"imported"}
+{"key":"new","type":"string","value":"imported","ttl":60000}
+`
+	for _, test := range []struct {
+		policy   ConflictPolicy
+		existing string
+		result   ImportResult
+	}{
+		{ConflictSkip, "original", ImportResult{Imported: 1, Skipped: 1}},
+		{ConflictReplace, "imported", ImportResult{Imported: 2, Replaced: 1}},
+	} {
+		kv := store.NewInMemoryStore()
+		kv.Set("existing", "original")
+		result, err := Import(kv, strings.NewReader(input), test.policy, time.Now().UnixMilli())
+		if err != nil || result != test.result {
+			t.Errorf("%s: unexpected result %+v, %v", test.policy, result, err)
+		}
+		if value, _ := kv.Get("existing"); value != test.existing || !kv.Exists("new") {
+			t.Errorf("%s: unexpected existing value %q", test.policy, value)
+		}
+	}
+
+	// A conflict under the fail policy writes nothing
+	kv := store.NewInMemoryStore()
+	kv.Set("existing", "original")
+	if _, err := Import(kv, strings.NewReader(input), ConflictFail, time.Now().UnixMilli()); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected a conflict error, got %v", err)
+	}
+	if kv.Exists("new") {
+		t.Error("Expected a failed import to leave the store untouched")
+	}
+}
+
+func TestImportRejectsInvalidInput(t *testing.T) {
+	valid := `{"key":"first","type":"string","value":"value"}` + "\n"
+	for _, invalid := range []string{
+		`{"key":"list","type":"list","value":"value"}`,
+		`{"key":"negative","type":"string","value":"value","ttl":-1}`,
+		`{"key":"unknown","type":"string","value":"value","extra":true}`,
+		`{"key":"encoding","type":"string","value":"value","encoding":"hex"}`,
+		`{"key":"!!","type":"string","value":"value","encoding":"base64"}`,
+		`{"key":"first","type":"string","value":"duplicate"}`,
+		`{"key":"trailing","type":"string","value":"value"} {}`,
+		`not json`,
+	} {
+		kv := store.NewInMemoryStore()
+		_, err := Import(kv, strings.NewReader(valid+"\n"+invalid), ConflictReplace, time.Now().UnixMilli())
+		if err == nil || !strings.HasPrefix(err.Error(), "line 3:") {
+			t.Errorf("Expected %s to be rejected on line 3, got %v", invalid, err)
+		}
+		if kv.Exists("first") {
+			t.Errorf("Expected %s to leave the store untouched", invalid)
+		}
+	}
+}
+
+func TestParseConflictPolicy(t *testing.T) {
+	for _, name := range []string{"skip", "replace", "fail"} {
+		policy, err := ParseConflictPolicy(name)
+		if err != nil || policy.String() != name {
+			t.Errorf("ParseConflictPolicy(%q) = %v, %v", name, policy, err)
+		}
+	}
+	if _, err := ParseConflictPolicy("merge"); err == nil {
+		t.Error("Expected an unknown policy to be rejected")
+	}
+}
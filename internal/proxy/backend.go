@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"redis-like-server/internal/resp2"
+)
+
+// backendQueue bounds the requests queued on a backend connection; a
+// client sending more waits for room
+const backendQueue = 1024
+
+// request is a command sent to a backend and, once done is closed, its
+// reply or the error that lost it
+type request struct {
+	backend *backend
+	data    []byte
+	reply   *resp2.RESPValue
+	err     error
+	done    chan struct{}
+}
+
+// finish completes a request
+func (r *request) finish(reply *resp2.RESPValue, err error) {
+	r.reply, r.err = reply, err
+	close(r.done)
+}
+
+// backend is a server keys are routed to. Its requests are spread over a
+// pool of connections, each pipelining the requests of the clients pinned
+// to it, so the commands of a client run in the order it sent them.
+type backend struct {
+	addr    string
+	timeout time.Duration
+	parser  resp2.RESP2Parser
+	// onHealth is called when the backend is ejected or back up
+	onHealth func()
+
+	mutex sync.Mutex
+	conns []*backendConn
+	// failures counts the failures since the last success; ejectAfter of
+	// them eject the backend until a health check succeeds
+	failures   int
+	ejectAfter int
+	ejected    bool
+}
+
+// newBackend returns a backend with an empty pool of poolSize connections
+func newBackend(addr string, config Config, onHealth func()) *backend {
+	return &backend{
+		addr:       addr,
+		timeout:    config.Timeout,
+		parser:     resp2.NewRESP2Parser(),
+		onHealth:   onHealth,
+		conns:      make([]*backendConn, config.PoolSize),
+		ejectAfter: config.EjectAfter,
+	}
+}
+
+// send sends a command on the connection of the pool a client is pinned
+// to, dialing it when needed, and returns the request to wait on
+func (b *backend) send(pool int, name string, args []string) *request {
+	r := &request{backend: b, data: b.parser.Serialize(resp2.NewCommandValue(name, args)), done: make(chan struct{})}
+	b.mutex.Lock()
+	i := pool % len(b.conns)
+	conn := b.conns[i]
+	if conn == nil || conn.isDead() {
+		var err error
+		if conn, err = dialBackend(b); err != nil {
+			b.mutex.Unlock()
+			b.failed()
+			r.finish(nil, err)
+			return r
+		}
+		b.conns[i] = conn
+	}
+	b.mutex.Unlock()
+	conn.send(r)
+	return r
+}
+
+// isEjected reports whether the backend is ejected
+func (b *backend) isEjected() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.ejected
+}
+
+// succeeded records a reply of the backend
+func (b *backend) succeeded() {
+	b.mutex.Lock()
+	b.failures = 0
+	b.mutex.Unlock()
+}
+
+// failed records a failure of the backend, ejecting it after enough of
+// them in a row
+func (b *backend) failed() {
+	b.mutex.Lock()
+	b.failures++
+	eject := !b.ejected && b.ejectAfter > 0 && b.failures >= b.ejectAfter
+	if eject {
+		b.ejected = true
+	}
+	b.mutex.Unlock()
+	if eject {
+		b.onHealth()
+	}
+}
+
+// restore brings an ejected backend back
+func (b *backend) restore() {
+	b.mutex.Lock()
+	restored := b.ejected
+	b.ejected, b.failures = false, 0
+	b.mutex.Unlock()
+	if restored {
+		b.onHealth()
+	}
+}
+
+// close closes the connections of the pool
+func (b *backend) close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, conn := range b.conns {
+		if conn != nil {
+			conn.fail(net.ErrClosed)
+		}
+	}
+}
+
+// backendConn is a connection to a backend. Its writer sends the queued
+// requests in order and its reader matches the replies to them in the
+// same order.
+type backendConn struct {
+	backend  *backend
+	conn     net.Conn
+	queue    chan *request
+	inflight chan *request
+
+	// sending is held while a request is queued, so none is queued once
+	// the writer drained the queue of a failed connection
+	sending sync.Mutex
+	failure sync.Once
+	err     error
+	closed  chan struct{}
+}
+
+// dialBackend connects to a backend and starts the goroutines of the
+// connection
+func dialBackend(b *backend) (*backendConn, error) {
+	conn, err := net.DialTimeout("tcp", b.addr, b.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &backendConn{
+		backend:  b,
+		conn:     conn,
+		queue:    make(chan *request, backendQueue),
+		inflight: make(chan *request, backendQueue),
+		closed:   make(chan struct{}),
+	}
+	go c.writeLoop()
+	go c.readLoop()
+	return c, nil
+}
+
+// isDead reports whether the connection failed
+func (c *backendConn) isDead() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// send queues a request, failing it when the connection failed
+func (c *backendConn) send(r *request) {
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	if c.isDead() {
+		r.finish(nil, c.err)
+		return
+	}
+	select {
+	case c.queue <- r:
+	case <-c.closed:
+		r.finish(nil, c.err)
+	}
+}
+
+// fail closes the connection; the requests queued or waiting for a reply
+// fail with err
+func (c *backendConn) fail(err error) {
+	c.failure.Do(func() {
+		c.err = err
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+// writeLoop writes the queued requests, flushing once the queue is empty
+// so a pipeline goes out in as few writes as possible
+func (c *backendConn) writeLoop() {
+	defer close(c.inflight)
+	writer := bufio.NewWriter(c.conn)
+	for {
+		var r *request
+		select {
+		case <-c.closed:
+			c.sending.Lock()
+			defer c.sending.Unlock()
+			for {
+				select {
+				case r := <-c.queue:
+					r.finish(nil, c.err)
+				default:
+					return
+				}
+			}
+		case r = <-c.queue:
+		}
+		c.inflight <- r
+		c.conn.SetWriteDeadline(time.Now().Add(c.backend.timeout))
+		_, err := writer.Write(r.data)
+		if err == nil && len(c.queue) == 0 {
+			err = writer.Flush()
+		}
+		if err != nil {
+			c.fail(err)
+			c.backend.failed()
+		}
+	}
+}
+
+// readLoop reads the reply of each request sent, in order
+func (c *backendConn) readLoop() {
+	reader := bufio.NewReader(c.conn)
+	for r := range c.inflight {
+		if c.isDead() {
+			r.finish(nil, c.err)
+			continue
+		}
+		c.conn.SetReadDeadline(time.Now().Add(c.backend.timeout))
+		reply, err := c.backend.parser.Parse(reader)
+		if err != nil {
+			c.fail(err)
+			c.backend.failed()
+			r.finish(nil, err)
+			continue
+		}
+		c.backend.succeeded()
+		r.finish(reply, nil)
+	}
+}
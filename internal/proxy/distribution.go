@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"crypto/md5"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"redis-like-server/internal/cluster"
+)
+
+// Key distributions
+const (
+	// DistributionKetama places the backends on a ring of points, as
+	// libketama does, so a backend leaving or coming back only moves its
+	// own keys
+	DistributionKetama = "ketama"
+	// DistributionSlots splits the hash slots of cluster mode evenly
+	// between the backends; the slots of a backend that is down go to the
+	// next one up
+	DistributionSlots = "slots"
+)
+
+// ketamaHashes is how many MD5 hashes place each backend on the ring, each
+// giving 4 points
+const ketamaHashes = 40
+
+// Distribution maps keys to backends. Only the hash tag of a key is
+// hashed, so keys sharing a tag go to the same backend.
+type Distribution interface {
+	// Pick returns the index of the backend serving key, or -1 when none
+	// is up
+	Pick(key string) int
+}
+
+// NewDistribution builds the distribution of that kind over the backends
+// named names, of which only those up serve keys
+func NewDistribution(kind string, names []string, up []bool) (Distribution, error) {
+	switch kind {
+	case DistributionKetama:
+		return newKetama(names, up), nil
+	case DistributionSlots:
+		return newSlots(up), nil
+	}
+	return nil, fmt.Errorf("unknown distribution %q, expected %s or %s", kind, DistributionKetama, DistributionSlots)
+}
+
+// ketamaPoint is a point of the ring and the backend it belongs to
+type ketamaPoint struct {
+	hash    uint32
+	backend int
+}
+
+// ketama is a ring of points, a key going to the backend of the first
+// point at or after its hash
+type ketama []ketamaPoint
+
+// newKetama places the backends that are up on a ring
+func newKetama(names []string, up []bool) ketama {
+	var ring ketama
+	for backend, name := range names {
+		if !up[backend] {
+			continue
+		}
+		for i := 0; i < ketamaHashes; i++ {
+			digest := md5.Sum([]byte(name + "-" + strconv.Itoa(i)))
+			for h := 0; h < 4; h++ {
+				ring = append(ring, ketamaPoint{hash: ketamaPointHash(digest, h), backend: backend})
+			}
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+// ketamaPointHash returns the h-th point of a digest, read little-endian
+func ketamaPointHash(digest [md5.Size]byte, h int) uint32 {
+	return uint32(digest[3+h*4])<<24 | uint32(digest[2+h*4])<<16 | uint32(digest[1+h*4])<<8 | uint32(digest[h*4])
+}
+
+// Pick implements Distribution
+func (k ketama) Pick(key string) int {
+	if len(k) == 0 {
+		return -1
+	}
+	hash := ketamaPointHash(md5.Sum([]byte(cluster.HashTag(key))), 0)
+	i := sort.Search(len(k), func(i int) bool { return k[i].hash >= hash })
+	if i == len(k) {
+		i = 0
+	}
+	return k[i].backend
+}
+
+// slots gives each slot to a backend, falling back to the following ones
+// when it is down
+type slots []int
+
+// newSlots assigns the slots to the backends that are up
+func newSlots(up []bool) slots {
+	owners := make(slots, cluster.SlotCount)
+	for slot := range owners {
+		owners[slot] = -1
+		for i := 0; i < len(up); i++ {
+			backend := (slot*len(up)/cluster.SlotCount + i) % len(up)
+			if up[backend] {
+				owners[slot] = backend
+				break
+			}
+		}
+	}
+	return owners
+}
+
+// Pick implements Distribution
+func (s slots) Pick(key string) int {
+	return s[cluster.KeySlot(key)]
+}
@@ -0,0 +1,432 @@
+// Package proxy is a sharding proxy for clients that are not cluster
+// aware: it speaks RESP to them and routes each command to the backend
+// serving its keys, splitting the commands whose keys live on several
+// backends and merging their replies. The commands of every client are
+// pipelined over a small pool of connections to each backend, and a
+// backend that keeps failing is ejected from the distribution until its
+// health checks pass again.
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"redis-like-server/internal/handler"
+	"redis-like-server/internal/resp2"
+)
+
+// Defaults of the configuration
+const (
+	DefaultPoolSize       = 4
+	DefaultTimeout        = 5 * time.Second
+	DefaultEjectAfter     = 3
+	DefaultHealthInterval = time.Second
+)
+
+// clientQueue bounds the replies a client pipelines before the proxy stops
+// reading its commands
+const clientQueue = 1024
+
+// Config configures a proxy
+type Config struct {
+	// Backends are the "host:port" addresses of the backends
+	Backends []string
+	// Distribution is how keys are mapped to backends, DistributionKetama
+	// or DistributionSlots
+	Distribution string
+	// PoolSize is how many connections each backend is sent commands on
+	PoolSize int
+	// Timeout bounds connecting to a backend and each of its replies
+	Timeout time.Duration
+	// EjectAfter is how many failures in a row eject a backend, 0 never
+	// ejecting any; HealthInterval is how often backends are pinged, which
+	// brings the ejected ones back
+	EjectAfter     int
+	HealthInterval time.Duration
+}
+
+// Proxy routes the commands of its clients to the backends
+type Proxy struct {
+	config   Config
+	backends []*backend
+	parser   resp2.RESP2Parser
+
+	mutex        sync.RWMutex
+	distribution Distribution
+
+	// nextPool is the pooled connection the next client is pinned to
+	nextPool atomic.Uint64
+
+	listener net.Listener
+	clients  map[net.Conn]struct{}
+	closed   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// New returns a proxy to the backends of config, applying the defaults to
+// the fields left zero
+func New(config Config) (*Proxy, error) {
+	if len(config.Backends) == 0 {
+		return nil, errors.New("no backends")
+	}
+	if config.Distribution == "" {
+		config.Distribution = DistributionKetama
+	}
+	if config.PoolSize <= 0 {
+		config.PoolSize = DefaultPoolSize
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.HealthInterval <= 0 {
+		config.HealthInterval = DefaultHealthInterval
+	}
+	p := &Proxy{
+		config:  config,
+		parser:  resp2.NewRESP2Parser(),
+		clients: make(map[net.Conn]struct{}),
+		closed:  make(chan struct{}),
+	}
+	for _, addr := range config.Backends {
+		p.backends = append(p.backends, newBackend(strings.TrimSpace(addr), config, func() { p.redistribute() }))
+	}
+	if err := p.redistribute(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// redistribute rebuilds the distribution over the backends that are not
+// ejected
+func (p *Proxy) redistribute() error {
+	names := make([]string, len(p.backends))
+	up := make([]bool, len(p.backends))
+	var ejected []string
+	for i, b := range p.backends {
+		names[i], up[i] = b.addr, !b.isEjected()
+		if !up[i] {
+			ejected = append(ejected, b.addr)
+		}
+	}
+	distribution, err := NewDistribution(p.config.Distribution, names, up)
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	had := p.distribution != nil
+	p.distribution = distribution
+	p.mutex.Unlock()
+	if had {
+		fmt.Printf("Backends ejected: %d of %d %v\n", len(ejected), len(p.backends), ejected)
+	}
+	return nil
+}
+
+// Backends returns the addresses of the backends and whether each is
+// ejected
+func (p *Proxy) Backends() map[string]bool {
+	backends := make(map[string]bool, len(p.backends))
+	for _, b := range p.backends {
+		backends[b.addr] = b.isEjected()
+	}
+	return backends
+}
+
+// Serve accepts clients on listener until the proxy is closed
+func (p *Proxy) Serve(listener net.Listener) error {
+	p.mutex.Lock()
+	p.listener = listener
+	p.mutex.Unlock()
+	p.wg.Add(1)
+	go p.healthChecks()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-p.closed:
+				return nil
+			default:
+				return err
+			}
+		}
+		p.mutex.Lock()
+		p.clients[conn] = struct{}{}
+		p.mutex.Unlock()
+		p.wg.Add(1)
+		go p.serveClient(conn)
+	}
+}
+
+// Close stops accepting clients, disconnects those connected and closes
+// the backend connections
+func (p *Proxy) Close() error {
+	p.mutex.Lock()
+	select {
+	case <-p.closed:
+		p.mutex.Unlock()
+		return nil
+	default:
+	}
+	close(p.closed)
+	if p.listener != nil {
+		p.listener.Close()
+	}
+	for conn := range p.clients {
+		conn.Close()
+	}
+	p.mutex.Unlock()
+	p.wg.Wait()
+	for _, b := range p.backends {
+		b.close()
+	}
+	return nil
+}
+
+// healthChecks pings every backend periodically: an ejected backend is
+// brought back once it answers, and the pooled connections of the others
+// are kept from going idle
+func (p *Proxy) healthChecks() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.config.HealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-ticker.C:
+		}
+		for _, b := range p.backends {
+			if b.isEjected() {
+				go p.checkEjected(b)
+				continue
+			}
+			for pool := range b.conns {
+				b.send(pool, "PING", nil)
+			}
+		}
+	}
+}
+
+// checkEjected restores an ejected backend when it answers a PING
+func (p *Proxy) checkEjected(b *backend) {
+	conn, err := dialBackend(b)
+	if err != nil {
+		return
+	}
+	defer conn.fail(net.ErrClosed)
+	r := &request{backend: b, data: b.parser.Serialize(resp2.NewCommandValue("PING", nil)), done: make(chan struct{})}
+	conn.send(r)
+	<-r.done
+	if r.err == nil && r.reply.Type != resp2.Error {
+		b.restore()
+	}
+}
+
+// pendingReply is the reply to a command of a client: the requests sent
+// to the backends for it and how their replies are merged, or a reply
+// known at once
+type pendingReply struct {
+	requests []*request
+	merge    func(replies []*resp2.RESPValue) *resp2.RESPValue
+	reply    *resp2.RESPValue
+}
+
+// wait waits for the replies of the backends and merges them; the first
+// error is the reply
+func (r *pendingReply) wait() *resp2.RESPValue {
+	if r.reply != nil {
+		return r.reply
+	}
+	replies := make([]*resp2.RESPValue, len(r.requests))
+	for i, request := range r.requests {
+		<-request.done
+		if request.err != nil {
+			return proxyError("backend %s failed: %v", request.backend.addr, request.err)
+		}
+		if request.reply.Type == resp2.Error {
+			return request.reply
+		}
+		replies[i] = request.reply
+	}
+	return r.merge(replies)
+}
+
+// serveClient reads the commands of a client and sends them on to the
+// backends as they come, while its replies are written back in order. The
+// client is pinned to one pooled connection of each backend, so its
+// commands on the same backend run in order.
+func (p *Proxy) serveClient(conn net.Conn) {
+	defer p.wg.Done()
+	pool := int(p.nextPool.Add(1) % uint64(p.config.PoolSize))
+	defer func() {
+		p.mutex.Lock()
+		delete(p.clients, conn)
+		p.mutex.Unlock()
+		conn.Close()
+	}()
+
+	replies := make(chan *pendingReply, clientQueue)
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		writer := bufio.NewWriter(conn)
+		failed := false
+		for reply := range replies {
+			if failed {
+				continue
+			}
+			writer.Write(p.parser.Serialize(reply.wait()))
+			if len(replies) == 0 && writer.Flush() != nil {
+				failed = true
+				conn.Close()
+			}
+		}
+		writer.Flush()
+	}()
+	defer func() {
+		close(replies)
+		<-written
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		value, err := p.parser.Parse(reader)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) && err.Error() != "EOF" {
+				replies <- &pendingReply{reply: &resp2.RESPValue{Type: resp2.Error, Str: fmt.Sprintf("ERR Protocol error: %v", err)}}
+			}
+			return
+		}
+		cmd, err := p.parser.ParseCommand(value)
+		if err != nil {
+			replies <- &pendingReply{reply: &resp2.RESPValue{Type: resp2.Error, Str: fmt.Sprintf("ERR Protocol error: %v", err)}}
+			continue
+		}
+		if cmd.Name == "QUIT" {
+			replies <- &pendingReply{reply: &resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"}}
+			return
+		}
+		replies <- p.dispatch(pool, cmd)
+	}
+}
+
+// dispatch sends a command to the backends serving its keys, on the
+// pooled connections of pool
+func (p *Proxy) dispatch(pool int, cmd *resp2.Command) *pendingReply {
+	switch cmd.Name {
+	case "PING":
+		if len(cmd.Args) > 1 {
+			return &pendingReply{reply: wrongArgs(cmd.Name)}
+		}
+		if len(cmd.Args) == 1 {
+			return &pendingReply{reply: &resp2.RESPValue{Type: resp2.BulkString, Str: cmd.Args[0]}}
+		}
+		return &pendingReply{reply: &resp2.RESPValue{Type: resp2.SimpleString, Str: "PONG"}}
+	case "MGET":
+		return p.dispatchMget(pool, cmd)
+	case "DEL", "EXISTS":
+		return p.dispatchCounting(pool, cmd)
+	}
+
+	keys := handler.CommandKeys(cmd)
+	if len(keys) == 0 {
+		return &pendingReply{reply: &resp2.RESPValue{Type: resp2.Error, Str: fmt.Sprintf("ERR unknown command '%s' or not supported by the proxy", strings.ToLower(cmd.Name))}}
+	}
+	b, reply := p.route(keys[0])
+	if reply != nil {
+		return &pendingReply{reply: reply}
+	}
+	for _, key := range keys[1:] {
+		if other, _ := p.route(key); other != b {
+			return &pendingReply{reply: proxyError("keys of '%s' are on different backends", strings.ToLower(cmd.Name))}
+		}
+	}
+	return &pendingReply{
+		requests: []*request{b.send(pool, cmd.Name, cmd.Args)},
+		merge:    func(replies []*resp2.RESPValue) *resp2.RESPValue { return replies[0] },
+	}
+}
+
+// dispatchMget sends MGET as a GET of each key, which every backend
+// serves, and replies with their values in order
+func (p *Proxy) dispatchMget(pool int, cmd *resp2.Command) *pendingReply {
+	if len(cmd.Args) == 0 {
+		return &pendingReply{reply: wrongArgs(cmd.Name)}
+	}
+	pending := &pendingReply{merge: func(replies []*resp2.RESPValue) *resp2.RESPValue {
+		values := &resp2.RESPValue{Type: resp2.Array, Array: make([]resp2.RESPValue, len(replies))}
+		for i, reply := range replies {
+			values.Array[i] = *reply
+		}
+		return values
+	}}
+	for _, key := range cmd.Args {
+		b, reply := p.route(key)
+		if reply != nil {
+			return &pendingReply{reply: reply}
+		}
+		pending.requests = append(pending.requests, b.send(pool, "GET", []string{key}))
+	}
+	return pending
+}
+
+// dispatchCounting splits a command counting its keys, as DEL and EXISTS
+// do, into one command per backend with the keys it serves, and replies
+// with the sum of their counts
+func (p *Proxy) dispatchCounting(pool int, cmd *resp2.Command) *pendingReply {
+	if len(cmd.Args) == 0 {
+		return &pendingReply{reply: wrongArgs(cmd.Name)}
+	}
+	var order []*backend
+	keys := make(map[*backend][]string)
+	for _, key := range cmd.Args {
+		b, reply := p.route(key)
+		if reply != nil {
+			return &pendingReply{reply: reply}
+		}
+		if _, seen := keys[b]; !seen {
+			order = append(order, b)
+		}
+		keys[b] = append(keys[b], key)
+	}
+	pending := &pendingReply{merge: func(replies []*resp2.RESPValue) *resp2.RESPValue {
+		count := &resp2.RESPValue{Type: resp2.Integer}
+		for _, reply := range replies {
+			count.Int += reply.Int
+		}
+		return count
+	}}
+	for _, b := range order {
+		pending.requests = append(pending.requests, b.send(pool, cmd.Name, keys[b]))
+	}
+	return pending
+}
+
+// route returns the backend serving key, or the error reply when none is
+// up
+func (p *Proxy) route(key string) (*backend, *resp2.RESPValue) {
+	p.mutex.RLock()
+	i := p.distribution.Pick(key)
+	p.mutex.RUnlock()
+	if i < 0 {
+		return nil, proxyError("no backend available")
+	}
+	return p.backends[i], nil
+}
+
+// proxyError returns an error reply of the proxy itself
+func proxyError(format string, args ...interface{}) *resp2.RESPValue {
+	return &resp2.RESPValue{Type: resp2.Error, Str: "ERR PROXY " + fmt.Sprintf(format, args...)}
+}
+
+// wrongArgs returns the error reply for a command given the wrong number
+// of arguments
+func wrongArgs(command string) *resp2.RESPValue {
+	return &resp2.RESPValue{Type: resp2.Error, Str: fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command))}
+}
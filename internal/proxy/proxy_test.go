@@ -0,0 +1,364 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"redis-like-server/internal/client"
+	"redis-like-server/internal/cluster"
+	"redis-like-server/internal/resp2"
+
+	"github.com/leanovate/gopter"
+	"github.com/leanovate/gopter/gen"
+	"github.com/leanovate/gopter/prop"
+)
+
+// Property-based test setup for the distributions
+func TestDistributionProperties(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+	names := []string{"10.0.0.1:6379", "10.0.0.2:6379", "10.0.0.3:6379", "10.0.0.4:6379", "10.0.0.5:6379"}
+	allUp := []bool{true, true, true, true, true}
+
+	// For any key and backend going down, only the keys of that backend
+	// move, whatever the distribution
+	properties.Property("a backend going down only moves its keys", prop.ForAll(
+		func(key string, down int) bool {
+			up := append([]bool(nil), allUp...)
+			up[down] = false
+			for _, kind := range []string{DistributionKetama, DistributionSlots} {
+				before, _ := NewDistribution(kind, names, allUp)
+				after, _ := NewDistribution(kind, names, up)
+				was, is := before.Pick(key), after.Pick(key)
+				if is == down || is < 0 || (was != down && was != is) {
+					return false
+				}
+			}
+			return true
+		},
+		gen.AnyString(),
+		gen.IntRange(0, len(names)-1),
+	))
+
+	// For any tag, keys sharing it go to the same backend
+	properties.Property("keys with the same hash tag share a backend", prop.ForAll(
+		func(tag, prefix, suffix string) bool {
+			key := prefix + "{" + tag + "}" + suffix
+			for _, kind := range []string{DistributionKetama, DistributionSlots} {
+				d, _ := NewDistribution(kind, names, allUp)
+				if d.Pick(key) != d.Pick(tag) {
+					return false
+				}
+			}
+			return true
+		},
+		gen.AlphaString().SuchThat(func(s string) bool { return s != "" }),
+		gen.AlphaString(),
+		gen.AnyString(),
+	))
+
+	properties.TestingRun(t)
+}
+
+func TestDistribution(t *testing.T) {
+	names := []string{"a:1", "b:1", "c:1"}
+	if _, err := NewDistribution("modula", names, []bool{true, true, true}); err == nil {
+		t.Error("NewDistribution accepted an unknown kind")
+	}
+	for _, kind := range []string{DistributionKetama, DistributionSlots} {
+		d, _ := NewDistribution(kind, names, []bool{false, false, false})
+		if got := d.Pick("foo"); got != -1 {
+			t.Errorf("%s picked %d with every backend down, want -1", kind, got)
+		}
+
+		// Every backend gets a fair share of the keys
+		d, _ = NewDistribution(kind, names, []bool{true, true, true})
+		counts := make([]int, len(names))
+		for i := 0; i < 30000; i++ {
+			counts[d.Pick("key:"+strconv.Itoa(i))]++
+		}
+		for backend, count := range counts {
+			if count < 7000 || count > 13000 {
+				t.Errorf("%s gave %d of 30000 keys to backend %d", kind, count, backend)
+			}
+		}
+	}
+
+	// The slots of a backend that is down go to the next one
+	d, _ := NewDistribution(DistributionSlots, names, []bool{true, false, true})
+	if got := d.Pick(keyInSlot(t, cluster.SlotCount/2)); got != 2 {
+		t.Errorf("slot %d went to backend %d, want 2", cluster.SlotCount/2, got)
+	}
+}
+
+// keyInSlot returns a key hashing to slot
+func keyInSlot(t *testing.T, slot int) string {
+	for i := 0; ; i++ {
+		if key := "key:" + strconv.Itoa(i); cluster.KeySlot(key) == slot {
+			return key
+		}
+		if i > 1000000 {
+			t.Fatalf("no key found in slot %d", slot)
+		}
+	}
+}
+
+// fakeBackend is a server keeping strings in a map, answering the
+// commands the proxy sends
+type fakeBackend struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	data     map[string]string
+	commands int
+}
+
+func startFakeBackend(t *testing.T) *fakeBackend {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeBackend{listener: listener, data: make(map[string]string)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeBackend) serve(conn net.Conn) {
+	defer conn.Close()
+	parser := resp2.NewRESP2Parser()
+	reader := bufio.NewReader(conn)
+	for {
+		value, err := parser.Parse(reader)
+		if err != nil {
+			return
+		}
+		cmd, err := parser.ParseCommand(value)
+		if err != nil {
+			return
+		}
+		f.mutex.Lock()
+		f.commands++
+		reply := resp2.RESPValue{Type: resp2.Error, Str: "ERR unknown command"}
+		switch cmd.Name {
+		case "PING":
+			reply = resp2.RESPValue{Type: resp2.SimpleString, Str: "PONG"}
+		case "SET":
+			f.data[cmd.Args[0]] = cmd.Args[1]
+			reply = resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"}
+		case "GET":
+			reply = resp2.RESPValue{Type: resp2.NullBulkString, Null: true}
+			if value, ok := f.data[cmd.Args[0]]; ok {
+				reply = resp2.RESPValue{Type: resp2.BulkString, Str: value}
+			}
+		case "DEL", "EXISTS":
+			reply = resp2.RESPValue{Type: resp2.Integer}
+			for _, key := range cmd.Args {
+				if _, ok := f.data[key]; ok {
+					reply.Int++
+					if cmd.Name == "DEL" {
+						delete(f.data, key)
+					}
+				}
+			}
+		}
+		f.mutex.Unlock()
+		if _, err := conn.Write(parser.Serialize(&reply)); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeBackend) keys() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.data)
+}
+
+// startProxy starts a proxy to backends and returns its address
+func startProxy(t *testing.T, config Config) (*Proxy, string) {
+	p, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(listener)
+	t.Cleanup(func() { p.Close() })
+	return p, listener.Addr().String()
+}
+
+func TestProxySplitsCommands(t *testing.T) {
+	backends := []*fakeBackend{startFakeBackend(t), startFakeBackend(t), startFakeBackend(t)}
+	var addrs []string
+	for _, b := range backends {
+		addrs = append(addrs, b.listener.Addr().String())
+	}
+	_, addr := startProxy(t, Config{Backends: addrs, PoolSize: 2})
+	c, err := client.Dial(addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	const keys = 60
+	args := make([]string, 0, keys)
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		if reply, err := c.Do("SET", key, "value:"+strconv.Itoa(i)); err != nil || reply.Str != "OK" {
+			t.Fatalf("SET %s = %v, %v", key, reply, err)
+		}
+		args = append(args, key)
+	}
+	for i, b := range backends {
+		if b.keys() == 0 {
+			t.Errorf("backend %d got no keys", i)
+		}
+	}
+
+	reply, err := c.Do("MGET", append(args, "missing")...)
+	if err != nil || len(reply.Array) != keys+1 {
+		t.Fatalf("MGET = %v, %v", reply, err)
+	}
+	for i := 0; i < keys; i++ {
+		if want := "value:" + strconv.Itoa(i); reply.Array[i].Str != want {
+			t.Errorf("MGET value %d = %q, want %q", i, reply.Array[i].Str, want)
+		}
+	}
+	if !reply.Array[keys].Null {
+		t.Errorf("MGET of a missing key = %v, want nil", reply.Array[keys])
+	}
+	if reply, err := c.Do("EXISTS", append(args, "missing")...); err != nil || reply.Int != keys {
+		t.Errorf("EXISTS = %v, %v, want %d", reply, err, keys)
+	}
+	if reply, err := c.Do("DEL", args[:keys/2]...); err != nil || reply.Int != keys/2 {
+		t.Errorf("DEL = %v, %v, want %d", reply, err, keys/2)
+	}
+	if reply, err := c.Do("PING", "hello"); err != nil || reply.Str != "hello" {
+		t.Errorf("PING hello = %v, %v", reply, err)
+	}
+	if _, err := c.Do("FLUSHALL"); err == nil {
+		t.Error("FLUSHALL went through the proxy")
+	}
+}
+
+func TestProxyEjectsBackends(t *testing.T) {
+	up := startFakeBackend(t)
+	down := startFakeBackend(t)
+	downAddr := down.listener.Addr().String()
+	down.listener.Close()
+	p, addr := startProxy(t, Config{
+		Backends:       []string{up.listener.Addr().String(), downAddr},
+		EjectAfter:     1,
+		Timeout:        time.Second,
+		HealthInterval: 50 * time.Millisecond,
+	})
+	c, err := client.Dial(addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Once the backend that is down is ejected, every key goes to the other
+	deadline := time.Now().Add(5 * time.Second)
+	for !p.Backends()[downAddr] {
+		if time.Now().After(deadline) {
+			t.Fatal("the backend that is down was not ejected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 20; i++ {
+		if reply, err := c.Do("SET", "key:"+strconv.Itoa(i), "value"); err != nil || reply.Str != "OK" {
+			t.Fatalf("SET with a backend ejected = %v, %v", reply, err)
+		}
+	}
+	if up.keys() != 20 {
+		t.Errorf("the backend up holds %d keys, want 20", up.keys())
+	}
+
+	// It is restored once it answers again
+	listener, err := net.Listen("tcp", downAddr)
+	if err != nil {
+		t.Skipf("cannot listen on %s again: %v", downAddr, err)
+	}
+	down.listener = listener
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go down.serve(conn)
+		}
+	}()
+	deadline = time.Now().Add(5 * time.Second)
+	for p.Backends()[downAddr] {
+		if time.Now().After(deadline) {
+			t.Fatal("the backend was not restored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProxyPipelines(t *testing.T) {
+	backend := startFakeBackend(t)
+	_, addr := startProxy(t, Config{Backends: []string{backend.listener.Addr().String()}})
+
+	// Other clients keep the other pooled connections busy meanwhile
+	for i := 0; i < DefaultPoolSize; i++ {
+		other, err := client.Dial(addr, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer other.Close()
+		go func() {
+			for j := 0; j < 200; j++ {
+				if _, err := other.Do("SET", "other", strconv.Itoa(j)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A pipeline of commands is answered in order, each seeing the writes
+	// sent before it
+	parser := resp2.NewRESP2Parser()
+	const commands = 500
+	var pipeline []byte
+	for i := 0; i < commands; i++ {
+		pipeline = append(pipeline, parser.Serialize(resp2.NewCommandValue("SET", []string{"key", strconv.Itoa(i)}))...)
+		pipeline = append(pipeline, parser.Serialize(resp2.NewCommandValue("GET", []string{"key"}))...)
+	}
+	if _, err := conn.Write(pipeline); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	for i := 0; i < commands; i++ {
+		if reply, err := parser.Parse(reader); err != nil || reply.Str != "OK" {
+			t.Fatalf("SET %d = %v, %v", i, reply, err)
+		}
+		if reply, err := parser.Parse(reader); err != nil || reply.Str != strconv.Itoa(i) {
+			t.Fatalf("GET after SET %d = %v, %v", i, reply, err)
+		}
+	}
+}
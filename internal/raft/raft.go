@@ -0,0 +1,877 @@
+// Package raft implements the Raft consensus algorithm behind the
+// strongly consistent mode, where a group of instances agree on a log of
+// commands and apply it in the same order.
+//
+// A Node holds the state of one member of the group. It does no I/O of its
+// own besides its Storage: the caller delivers the messages it receives to
+// Step, calls Tick periodically, sends the messages both return to the
+// members they name, and applies the committed entries returned by Apply.
+// Membership changes add or remove one member at a time, each taking effect
+// as soon as it is in the log, and the log is compacted into snapshots of
+// the state it produced.
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Role is the part a node plays in the group
+type Role int
+
+// Roles of a node
+const (
+	Follower Role = iota
+	Candidate
+	Leader
+)
+
+// String names the role as shown by INFO
+func (r Role) String() string {
+	switch r {
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return "follower"
+}
+
+// Member is a member of the group: its node ID and the address clients and
+// the other members reach it at
+type Member struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// EntryKind is what a log entry holds
+type EntryKind string
+
+// Kinds of log entries
+const (
+	// EntryCommand holds a command to apply
+	EntryCommand EntryKind = "command"
+	// EntryMembers holds the members of the group from then on
+	EntryMembers EntryKind = "members"
+	// EntryNoop is appended by a new leader to commit the entries of the
+	// terms before its own
+	EntryNoop EntryKind = "noop"
+)
+
+// Entry is an entry of the log
+type Entry struct {
+	Index   uint64    `json:"index"`
+	Term    uint64    `json:"term"`
+	Kind    EntryKind `json:"kind"`
+	Command []string  `json:"command,omitempty"`
+	Members []Member  `json:"members,omitempty"`
+}
+
+// Snapshot is the state produced by the log up to Index, replacing the
+// entries it covers. Data is the caller's own encoding of that state.
+type Snapshot struct {
+	Index   uint64   `json:"index"`
+	Term    uint64   `json:"term"`
+	Members []Member `json:"members,omitempty"`
+	Data    []byte   `json:"data,omitempty"`
+}
+
+// MessageKind is the kind of a message between members
+type MessageKind string
+
+// Kinds of messages
+const (
+	MsgVote          MessageKind = "vote"
+	MsgVoteReply     MessageKind = "vote_reply"
+	MsgAppend        MessageKind = "append"
+	MsgAppendReply   MessageKind = "append_reply"
+	MsgSnapshot      MessageKind = "snapshot"
+	MsgSnapshotReply MessageKind = "snapshot_reply"
+)
+
+// Message is a message between members. Vote requests carry the last
+// entry of the candidate; appends the entry before Entries and the
+// leader's commit index; replies whether they succeeded and, for appends
+// and snapshots, the last index the follower holds or a hint where to
+// resume from.
+type Message struct {
+	Kind      MessageKind `json:"kind"`
+	From      string      `json:"from"`
+	To        string      `json:"to"`
+	Term      uint64      `json:"term"`
+	LastIndex uint64      `json:"last_index,omitempty"`
+	LastTerm  uint64      `json:"last_term,omitempty"`
+	PrevIndex uint64      `json:"prev_index,omitempty"`
+	PrevTerm  uint64      `json:"prev_term,omitempty"`
+	Entries   []Entry     `json:"entries,omitempty"`
+	Commit    uint64      `json:"commit,omitempty"`
+	Success   bool        `json:"success,omitempty"`
+	Match     uint64      `json:"match,omitempty"`
+	Snapshot  *Snapshot   `json:"snapshot,omitempty"`
+}
+
+// HardState is what a node must remember across restarts besides its log
+type HardState struct {
+	ID   string `json:"id"`
+	Term uint64 `json:"term"`
+	Vote string `json:"vote,omitempty"`
+}
+
+// Config tunes the timing of a node
+type Config struct {
+	// ElectionTimeout is how long a follower waits without hearing from a
+	// leader before standing for election, randomized up to twice as long
+	ElectionTimeout time.Duration
+	// HeartbeatPeriod is how often a leader sends appends to its followers
+	HeartbeatPeriod time.Duration
+	// MaxEntries bounds the entries sent in one append
+	MaxEntries int
+}
+
+// Default timing of a node
+const (
+	DefaultElectionTimeout = time.Second
+	DefaultHeartbeatPeriod = 100 * time.Millisecond
+	DefaultMaxEntries      = 64
+)
+
+// Errors of proposals
+var (
+	ErrNotLeader       = errors.New("not the leader")
+	ErrMembersChanging = errors.New("a membership change is in progress")
+	ErrUnknownMember   = errors.New("no such member")
+	ErrBootstrapped    = errors.New("the node already has a log")
+)
+
+// Status describes a node, as shown by INFO
+type Status struct {
+	ID            string
+	Role          Role
+	Term          uint64
+	Leader        Member
+	Members       []Member
+	LastIndex     uint64
+	Commit        uint64
+	Applied       uint64
+	SnapshotIndex uint64
+}
+
+// Node is a member of a group, or a node waiting to be added to one. It is
+// safe for concurrent use.
+type Node struct {
+	mutex   sync.Mutex
+	config  Config
+	storage Storage
+	random  *rand.Rand
+
+	id     string
+	term   uint64
+	vote   string
+	role   Role
+	leader string
+
+	// log holds the entries after the snapshot
+	snapshot Snapshot
+	log      []Entry
+	// members is the latest membership, from the log or the snapshot
+	members []Member
+	commit  uint64
+	applied uint64
+	// install is a snapshot received from the leader, to hand to Apply
+	install bool
+
+	electionDeadline time.Time
+	heartbeatDue     time.Time
+	// heard is when a leader was last heard from
+	heard time.Time
+
+	// Candidate and leader state
+	votes   map[string]bool
+	next    map[string]uint64
+	match   map[string]uint64
+	lastAck map[string]time.Time
+}
+
+// Open loads a node from its storage, naming it id when the storage is new
+func Open(id string, storage Storage, config Config, now time.Time) (*Node, error) {
+	if config.ElectionTimeout <= 0 {
+		config.ElectionTimeout = DefaultElectionTimeout
+	}
+	if config.HeartbeatPeriod <= 0 {
+		config.HeartbeatPeriod = DefaultHeartbeatPeriod
+	}
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = DefaultMaxEntries
+	}
+	hard, snapshot, entries, err := storage.Load()
+	if err != nil {
+		return nil, err
+	}
+	// Nodes started together must not time out together
+	seed := fnv.New64a()
+	seed.Write([]byte(id))
+	n := &Node{
+		config:   config,
+		storage:  storage,
+		random:   rand.New(rand.NewSource(now.UnixNano() ^ int64(seed.Sum64()))),
+		id:       hard.ID,
+		term:     hard.Term,
+		vote:     hard.Vote,
+		snapshot: snapshot,
+		log:      entries,
+		members:  snapshot.Members,
+		commit:   snapshot.Index,
+		applied:  snapshot.Index,
+		install:  snapshot.Index > 0,
+	}
+	for _, entry := range entries {
+		if entry.Kind == EntryMembers {
+			n.members = entry.Members
+		}
+	}
+	if n.id == "" {
+		n.id = id
+		if err := n.saveHardState(); err != nil {
+			return nil, err
+		}
+	}
+	n.resetElection(now)
+	return n, nil
+}
+
+// Bootstrap starts a new group with the node as its only member
+func (n *Node) Bootstrap(self Member) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.lastIndex() > 0 {
+		return ErrBootstrapped
+	}
+	self.ID = n.id
+	n.term = 1
+	if err := n.saveHardState(); err != nil {
+		return err
+	}
+	if err := n.append([]Entry{{Index: 1, Term: 1, Kind: EntryMembers, Members: []Member{self}}}); err != nil {
+		return err
+	}
+	// Alone in its group, the node need not wait to lead it
+	n.electionDeadline = time.Time{}
+	return nil
+}
+
+// ID returns the node ID
+func (n *Node) ID() string {
+	return n.id
+}
+
+// Leader returns the leader the node knows of
+func (n *Node) Leader() (Member, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.member(n.leader)
+}
+
+// IsMember reports whether the node is a member of a group
+func (n *Node) IsMember() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	_, member := n.member(n.id)
+	return member
+}
+
+// Member returns the member with the given ID
+func (n *Node) Member(id string) (Member, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.member(id)
+}
+
+// Status describes the node
+func (n *Node) Status() Status {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	leader, _ := n.member(n.leader)
+	return Status{
+		ID:            n.id,
+		Role:          n.role,
+		Term:          n.term,
+		Leader:        leader,
+		Members:       append([]Member(nil), n.members...),
+		LastIndex:     n.lastIndex(),
+		Commit:        n.commit,
+		Applied:       n.applied,
+		SnapshotIndex: n.snapshot.Index,
+	}
+}
+
+// LogSize returns the number of entries after the snapshot
+func (n *Node) LogSize() int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return len(n.log)
+}
+
+// Tick lets time pass: a follower that has not heard from a leader stands
+// for election, and a leader sends heartbeats or steps down when it lost
+// touch with the majority
+func (n *Node) Tick(now time.Time) []Message {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.role == Leader {
+		if _, member := n.member(n.id); !member && n.commit >= n.membersIndex() {
+			// The leader removed itself
+			n.becomeFollower(n.term, "", now)
+			return nil
+		}
+		if !n.quorumActive(now) {
+			n.becomeFollower(n.term, "", now)
+			return nil
+		}
+		if now.Before(n.heartbeatDue) {
+			return nil
+		}
+		n.heartbeatDue = now.Add(n.config.HeartbeatPeriod)
+		return n.broadcastAppend()
+	}
+	if now.Before(n.electionDeadline) {
+		return nil
+	}
+	if _, member := n.member(n.id); !member {
+		n.resetElection(now)
+		return nil
+	}
+	return n.campaign(now)
+}
+
+// Step handles a message from another member and returns the messages to
+// send in response
+func (n *Node) Step(m Message, now time.Time) []Message {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	// A node that leads or heard from a leader recently ignores
+	// candidates, so a removed or partitioned member cannot disrupt the
+	// group
+	if m.Kind == MsgVote && (n.role == Leader || n.leader != "" && now.Sub(n.heard) < n.config.ElectionTimeout) {
+		return nil
+	}
+	if m.Term > n.term {
+		switch {
+		case m.Kind == MsgAppend || m.Kind == MsgSnapshot:
+			n.becomeFollower(m.Term, m.From, now)
+		case m.Kind == MsgVote && n.role != Leader:
+			// Only a granted vote delays the next election, or a candidate
+			// with a stale log could keep the others from standing
+			n.role, n.term, n.vote, n.leader = Follower, m.Term, "", ""
+			if err := n.saveHardState(); err != nil {
+				return nil
+			}
+		default:
+			n.becomeFollower(m.Term, "", now)
+		}
+	}
+	if m.Term < n.term {
+		switch m.Kind {
+		case MsgVote:
+			return []Message{n.message(MsgVoteReply, m.From)}
+		case MsgAppend, MsgSnapshot:
+			return []Message{n.message(MsgAppendReply, m.From)}
+		}
+		return nil
+	}
+
+	switch m.Kind {
+	case MsgVote:
+		return n.handleVote(m, now)
+	case MsgVoteReply:
+		if n.role == Candidate && m.Success {
+			n.votes[m.From] = true
+			if n.countVotes() {
+				return n.becomeLeader(now)
+			}
+		}
+	case MsgAppend:
+		return n.handleAppend(m, now)
+	case MsgSnapshot:
+		return n.handleSnapshot(m, now)
+	case MsgAppendReply, MsgSnapshotReply:
+		return n.handleAppendReply(m, now)
+	}
+	return nil
+}
+
+// Propose appends a command to the log of the leader and returns its
+// entry, with the messages replicating it
+func (n *Node) Propose(command []string) (Entry, []Message, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.propose(Entry{Kind: EntryCommand, Command: command})
+}
+
+// AddMember proposes to add a member to the group. The change takes
+// effect once appended; another one can only be proposed once it is
+// committed.
+func (n *Node) AddMember(m Member) (Entry, []Message, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	members := append([]Member(nil), n.members...)
+	replaced := false
+	for i := range members {
+		if members[i].ID == m.ID {
+			members[i], replaced = m, true
+		}
+	}
+	if !replaced {
+		members = append(members, m)
+	}
+	return n.proposeMembers(members)
+}
+
+// RemoveMember proposes to remove a member from the group
+func (n *Node) RemoveMember(id string) (Entry, []Message, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	var members []Member
+	for _, m := range n.members {
+		if m.ID != id {
+			members = append(members, m)
+		}
+	}
+	if len(members) == len(n.members) {
+		return Entry{}, nil, ErrUnknownMember
+	}
+	return n.proposeMembers(members)
+}
+
+// proposeMembers proposes a new membership; the caller must hold the mutex
+func (n *Node) proposeMembers(members []Member) (Entry, []Message, error) {
+	if n.role == Leader && n.membersIndex() > n.commit {
+		return Entry{}, nil, ErrMembersChanging
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return n.propose(Entry{Kind: EntryMembers, Members: members})
+}
+
+// propose appends an entry of the leader's term; the caller must hold the
+// mutex
+func (n *Node) propose(entry Entry) (Entry, []Message, error) {
+	if n.role != Leader {
+		return Entry{}, nil, ErrNotLeader
+	}
+	entry.Index, entry.Term = n.lastIndex()+1, n.term
+	if err := n.append([]Entry{entry}); err != nil {
+		return Entry{}, nil, err
+	}
+	n.match[n.id] = entry.Index
+	n.advanceCommit()
+	return entry, n.broadcastAppend(), nil
+}
+
+// Apply returns what the caller must apply to its state: the snapshot
+// received from the leader, if any, and then the committed entries not
+// applied yet
+func (n *Node) Apply() (*Snapshot, []Entry) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	var snapshot *Snapshot
+	if n.install {
+		n.install = false
+		s := n.snapshot
+		snapshot = &s
+	}
+	if n.commit <= n.applied {
+		return snapshot, nil
+	}
+	first := n.applied + 1 - n.snapshot.Index - 1
+	last := n.commit - n.snapshot.Index
+	entries := append([]Entry(nil), n.log[first:last]...)
+	n.applied = n.commit
+	return snapshot, entries
+}
+
+// Compact replaces the log up to index, which must be applied, with a
+// snapshot of the state it produced
+func (n *Node) Compact(index uint64, data []byte) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if index <= n.snapshot.Index {
+		return nil
+	}
+	if index > n.applied {
+		return fmt.Errorf("cannot compact the log up to %d, only %d is applied", index, n.applied)
+	}
+	snapshot := Snapshot{Index: index, Term: n.termAt(index), Members: n.snapshot.Members, Data: data}
+	for _, entry := range n.log[:index-n.snapshot.Index] {
+		if entry.Kind == EntryMembers {
+			snapshot.Members = entry.Members
+		}
+	}
+	log := append([]Entry(nil), n.log[index-n.snapshot.Index:]...)
+	if err := n.storage.Replace(snapshot, log); err != nil {
+		return err
+	}
+	n.snapshot, n.log = snapshot, log
+	return nil
+}
+
+// handleVote answers a candidate, granting the vote of this term to the
+// first one whose log is at least as up to date; the caller must hold the
+// mutex
+func (n *Node) handleVote(m Message, now time.Time) []Message {
+	reply := n.message(MsgVoteReply, m.From)
+	upToDate := m.LastTerm > n.lastTerm() || (m.LastTerm == n.lastTerm() && m.LastIndex >= n.lastIndex())
+	if (n.vote == "" || n.vote == m.From) && upToDate {
+		n.vote = m.From
+		if err := n.saveHardState(); err != nil {
+			return nil
+		}
+		n.resetElection(now)
+		reply.Success = true
+	}
+	return []Message{reply}
+}
+
+// handleAppend appends the entries of the leader that follow the ones this
+// node holds; the caller must hold the mutex
+func (n *Node) handleAppend(m Message, now time.Time) []Message {
+	n.becomeFollower(n.term, m.From, now)
+	reply := n.message(MsgAppendReply, m.From)
+	switch {
+	case m.PrevIndex > n.lastIndex():
+		reply.Match = n.lastIndex()
+		return []Message{reply}
+	case m.PrevIndex >= n.snapshot.Index && n.termAt(m.PrevIndex) != m.PrevTerm:
+		// Back off below the conflicting term, but not below what is known
+		// to be committed
+		hint := m.PrevIndex - 1
+		for term := n.termAt(m.PrevIndex); hint > n.commit && n.termAt(hint) == term; hint-- {
+		}
+		reply.Match = max(hint, n.commit)
+		return []Message{reply}
+	}
+
+	var fresh []Entry
+	for i, entry := range m.Entries {
+		if entry.Index <= n.snapshot.Index {
+			continue
+		}
+		if entry.Index > n.lastIndex() {
+			fresh = m.Entries[i:]
+			break
+		}
+		if n.termAt(entry.Index) != entry.Term {
+			if err := n.truncate(entry.Index); err != nil {
+				return nil
+			}
+			fresh = m.Entries[i:]
+			break
+		}
+	}
+	if err := n.append(fresh); err != nil {
+		return nil
+	}
+	last := m.PrevIndex + uint64(len(m.Entries))
+	n.commit = max(n.commit, min(m.Commit, last))
+	reply.Success, reply.Match = true, max(last, n.snapshot.Index)
+	return []Message{reply}
+}
+
+// handleSnapshot replaces the log with the leader's snapshot when it is
+// ahead of it; the caller must hold the mutex
+func (n *Node) handleSnapshot(m Message, now time.Time) []Message {
+	n.becomeFollower(n.term, m.From, now)
+	reply := n.message(MsgSnapshotReply, m.From)
+	s := m.Snapshot
+	if s == nil || s.Index <= n.commit {
+		reply.Success, reply.Match = true, n.commit
+		return []Message{reply}
+	}
+	var log []Entry
+	if s.Index < n.lastIndex() && n.termAt(s.Index) == s.Term {
+		log = append(log, n.log[s.Index-n.snapshot.Index:]...)
+	}
+	if err := n.storage.Replace(*s, log); err != nil {
+		return nil
+	}
+	n.snapshot, n.log = *s, log
+	n.members = s.Members
+	for _, entry := range log {
+		if entry.Kind == EntryMembers {
+			n.members = entry.Members
+		}
+	}
+	n.commit, n.applied, n.install = s.Index, s.Index, true
+	reply.Success, reply.Match = true, s.Index
+	return []Message{reply}
+}
+
+// handleAppendReply moves a follower's progress and the commit index on,
+// or backs off to where its log agrees with the leader's; the caller must
+// hold the mutex
+func (n *Node) handleAppendReply(m Message, now time.Time) []Message {
+	if n.role != Leader {
+		return nil
+	}
+	if _, member := n.member(m.From); !member {
+		return nil
+	}
+	n.lastAck[m.From] = now
+	if m.Success {
+		if m.Match > n.match[m.From] {
+			n.match[m.From] = m.Match
+			n.advanceCommit()
+		}
+		n.next[m.From] = max(n.next[m.From], m.Match+1)
+		if n.next[m.From] > n.lastIndex() {
+			return nil
+		}
+	} else {
+		n.next[m.From] = max(1, min(n.next[m.From]-1, m.Match+1))
+	}
+	return []Message{n.appendTo(m.From)}
+}
+
+// campaign starts an election in a new term; the caller must hold the
+// mutex
+func (n *Node) campaign(now time.Time) []Message {
+	n.role, n.leader = Candidate, ""
+	n.term++
+	n.vote = n.id
+	if err := n.saveHardState(); err != nil {
+		return nil
+	}
+	n.resetElection(now)
+	n.votes = map[string]bool{n.id: true}
+	if n.countVotes() {
+		return n.becomeLeader(now)
+	}
+	var messages []Message
+	for _, m := range n.members {
+		if m.ID != n.id {
+			request := n.message(MsgVote, m.ID)
+			request.LastIndex, request.LastTerm = n.lastIndex(), n.lastTerm()
+			messages = append(messages, request)
+		}
+	}
+	return messages
+}
+
+// countVotes reports whether a majority of the members voted for this
+// node; the caller must hold the mutex
+func (n *Node) countVotes() bool {
+	granted := 0
+	for _, m := range n.members {
+		if n.votes[m.ID] {
+			granted++
+		}
+	}
+	return granted > len(n.members)/2
+}
+
+// becomeLeader takes the lead of the group and appends an entry of its
+// term, which commits the entries of the terms before it; the caller must
+// hold the mutex
+func (n *Node) becomeLeader(now time.Time) []Message {
+	n.role, n.leader = Leader, n.id
+	n.next = make(map[string]uint64)
+	n.match = make(map[string]uint64)
+	n.lastAck = make(map[string]time.Time)
+	for _, m := range n.members {
+		n.next[m.ID] = n.lastIndex() + 1
+		n.lastAck[m.ID] = now
+	}
+	n.heartbeatDue = now.Add(n.config.HeartbeatPeriod)
+	_, messages, err := n.propose(Entry{Kind: EntryNoop})
+	if err != nil {
+		n.becomeFollower(n.term, "", now)
+		return nil
+	}
+	return messages
+}
+
+// becomeFollower follows leader, or no one yet, in term; the caller must
+// hold the mutex
+func (n *Node) becomeFollower(term uint64, leader string, now time.Time) {
+	if term > n.term {
+		n.term, n.vote = term, ""
+		n.saveHardState()
+	}
+	n.role, n.leader = Follower, leader
+	if leader != "" {
+		n.heard = now
+	}
+	n.resetElection(now)
+}
+
+// quorumActive reports whether a majority of the members answered the
+// leader within an election timeout, counting from when they were added
+// for new members; the caller must hold the mutex
+func (n *Node) quorumActive(now time.Time) bool {
+	active := 0
+	for _, m := range n.members {
+		ack, known := n.lastAck[m.ID]
+		if !known {
+			n.lastAck[m.ID], ack = now, now
+		}
+		if m.ID == n.id || now.Sub(ack) < n.config.ElectionTimeout {
+			active++
+		}
+	}
+	return active > len(n.members)/2
+}
+
+// advanceCommit commits the latest entry of the leader's term that a
+// majority of the members hold; the caller must hold the mutex
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commit && n.termAt(index) == n.term; index-- {
+		held := 0
+		for _, m := range n.members {
+			if n.match[m.ID] >= index {
+				held++
+			}
+		}
+		if held > len(n.members)/2 {
+			n.commit = index
+			return
+		}
+	}
+}
+
+// broadcastAppend sends every follower the entries it misses, or a
+// heartbeat; the caller must hold the mutex
+func (n *Node) broadcastAppend() []Message {
+	var messages []Message
+	for _, m := range n.members {
+		if m.ID != n.id {
+			if _, known := n.next[m.ID]; !known {
+				n.next[m.ID] = n.lastIndex() + 1
+			}
+			messages = append(messages, n.appendTo(m.ID))
+		}
+	}
+	return messages
+}
+
+// appendTo returns the append, or the snapshot when the entries it needs
+// were compacted, that brings a follower up to date; the caller must hold
+// the mutex
+func (n *Node) appendTo(id string) Message {
+	next := n.next[id]
+	if next <= n.snapshot.Index {
+		m := n.message(MsgSnapshot, id)
+		snapshot := n.snapshot
+		m.Snapshot = &snapshot
+		return m
+	}
+	m := n.message(MsgAppend, id)
+	m.PrevIndex, m.PrevTerm = next-1, n.termAt(next-1)
+	last := min(n.lastIndex(), next-1+uint64(n.config.MaxEntries))
+	m.Entries = append([]Entry(nil), n.log[next-1-n.snapshot.Index:last-n.snapshot.Index]...)
+	m.Commit = n.commit
+	return m
+}
+
+// message returns a message of this node's term; the caller must hold the
+// mutex
+func (n *Node) message(kind MessageKind, to string) Message {
+	return Message{Kind: kind, From: n.id, To: to, Term: n.term}
+}
+
+// append adds entries to the end of the log; the caller must hold the
+// mutex
+func (n *Node) append(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := n.storage.Append(entries); err != nil {
+		return err
+	}
+	n.log = append(n.log, entries...)
+	for _, entry := range entries {
+		if entry.Kind == EntryMembers {
+			n.members = entry.Members
+		}
+	}
+	return nil
+}
+
+// truncate drops the entries from index on, which conflict with the
+// leader's; the caller must hold the mutex
+func (n *Node) truncate(index uint64) error {
+	log := n.log[:index-n.snapshot.Index-1]
+	if err := n.storage.Replace(n.snapshot, log); err != nil {
+		return err
+	}
+	n.log = log
+	n.members = n.snapshot.Members
+	for _, entry := range log {
+		if entry.Kind == EntryMembers {
+			n.members = entry.Members
+		}
+	}
+	return nil
+}
+
+// lastIndex returns the index of the last entry; the caller must hold the
+// mutex
+func (n *Node) lastIndex() uint64 {
+	return n.snapshot.Index + uint64(len(n.log))
+}
+
+// lastTerm returns the term of the last entry; the caller must hold the
+// mutex
+func (n *Node) lastTerm() uint64 {
+	return n.termAt(n.lastIndex())
+}
+
+// termAt returns the term of the entry at index, which must not be before
+// the snapshot; the caller must hold the mutex
+func (n *Node) termAt(index uint64) uint64 {
+	if index <= n.snapshot.Index {
+		return n.snapshot.Term
+	}
+	if index > n.lastIndex() {
+		return 0
+	}
+	return n.log[index-n.snapshot.Index-1].Term
+}
+
+// membersIndex returns the index of the latest membership entry, or of the
+// snapshot holding it; the caller must hold the mutex
+func (n *Node) membersIndex() uint64 {
+	for i := len(n.log) - 1; i >= 0; i-- {
+		if n.log[i].Kind == EntryMembers {
+			return n.log[i].Index
+		}
+	}
+	return n.snapshot.Index
+}
+
+// member returns the member with the given ID; the caller must hold the
+// mutex
+func (n *Node) member(id string) (Member, bool) {
+	for _, m := range n.members {
+		if m.ID == id {
+			return m, true
+		}
+	}
+	return Member{}, false
+}
+
+// resetElection picks a new random election deadline; the caller must
+// hold the mutex
+func (n *Node) resetElection(now time.Time) {
+	timeout := n.config.ElectionTimeout
+	n.electionDeadline = now.Add(timeout + time.Duration(n.random.Int63n(int64(timeout))))
+}
+
+// saveHardState persists the term and vote; the caller must hold the
+// mutex
+func (n *Node) saveHardState() error {
+	return n.storage.SaveHardState(HardState{ID: n.id, Term: n.term, Vote: n.vote})
+}
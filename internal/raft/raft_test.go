@@ -0,0 +1,416 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/leanovate/gopter"
+	"github.com/leanovate/gopter/gen"
+	"github.com/leanovate/gopter/prop"
+)
+
+// network is a group of nodes exchanging messages in memory, with nodes
+// that can be cut off from the others, restarted and compacted
+type network struct {
+	t        *testing.T
+	now      time.Time
+	nodes    map[string]*Node
+	storages map[string]*MemoryStorage
+	down     map[string]bool
+	queue    []Message
+	// state is what each node applied: the commands, in order
+	state map[string][]string
+}
+
+// newNetwork starts a group of count nodes named a, b, c... with a as its
+// first member and the others added one at a time
+func newNetwork(t *testing.T, count int) *network {
+	n := &network{
+		t:        t,
+		now:      time.Unix(1700000000, 0),
+		nodes:    make(map[string]*Node),
+		storages: make(map[string]*MemoryStorage),
+		down:     make(map[string]bool),
+		state:    make(map[string][]string),
+	}
+	for i := 0; i < count; i++ {
+		n.start(string(rune('a' + i)))
+	}
+	if err := n.nodes["a"].Bootstrap(Member{Addr: "a:6379"}); err != nil {
+		t.Fatal(err)
+	}
+	n.tick(time.Millisecond)
+	for i := 1; i < count; i++ {
+		id := string(rune('a' + i))
+		_, messages, err := n.nodes["a"].AddMember(Member{ID: id, Addr: id + ":6379"})
+		if err != nil {
+			t.Fatalf("adding %s: %v", id, err)
+		}
+		n.send(messages)
+		n.settle()
+	}
+	return n
+}
+
+// start opens a node on its storage, as after a restart
+func (n *network) start(id string) {
+	if n.storages[id] == nil {
+		n.storages[id] = NewMemoryStorage()
+	}
+	node, err := Open(id, n.storages[id], Config{}, n.now)
+	if err != nil {
+		n.t.Fatal(err)
+	}
+	n.nodes[id] = node
+	n.state[id] = nil
+}
+
+// send queues messages, losing those from or to a node that is cut off
+func (n *network) send(messages []Message) {
+	for _, m := range messages {
+		if !n.down[m.From] && !n.down[m.To] {
+			n.queue = append(n.queue, m)
+		}
+	}
+}
+
+// deliver delivers the queued messages and those they lead to, then lets
+// every node apply what it committed
+func (n *network) deliver() {
+	for len(n.queue) > 0 {
+		m := n.queue[0]
+		n.queue = n.queue[1:]
+		if !n.down[m.To] {
+			// A round trip through JSON, as on the wire
+			data, _ := json.Marshal(m)
+			var received Message
+			json.Unmarshal(data, &received)
+			n.send(n.nodes[m.To].Step(received, n.now))
+		}
+	}
+	for id, node := range n.nodes {
+		snapshot, entries := node.Apply()
+		if snapshot != nil {
+			var state []string
+			json.Unmarshal(snapshot.Data, &state)
+			n.state[id] = state
+		}
+		for _, entry := range entries {
+			if entry.Kind == EntryCommand {
+				n.state[id] = append(n.state[id], entry.Command[0])
+			}
+		}
+		n.checkSafety()
+	}
+}
+
+// tick lets time pass on every node, those cut off included
+func (n *network) tick(d time.Duration) {
+	n.now = n.now.Add(d)
+	for _, node := range n.nodes {
+		n.send(node.Tick(n.now))
+	}
+	n.deliver()
+}
+
+// settle ticks until the group had time to elect a leader and replicate
+func (n *network) settle() {
+	for i := 0; i < 40; i++ {
+		n.tick(100 * time.Millisecond)
+	}
+}
+
+// leader returns the node leading the group among those up, if any
+func (n *network) leader() (string, *Node) {
+	for id, node := range n.nodes {
+		if !n.down[id] && node.Status().Role == Leader {
+			return id, node
+		}
+	}
+	return "", nil
+}
+
+// propose proposes a command on the leader, if there is one
+func (n *network) propose(command string) bool {
+	_, leader := n.leader()
+	if leader == nil {
+		return false
+	}
+	_, messages, err := leader.Propose([]string{command})
+	if err != nil {
+		return false
+	}
+	n.send(messages)
+	n.deliver()
+	return true
+}
+
+// compact replaces the applied log of a node with a snapshot of its state
+func (n *network) compact(id string) {
+	data, _ := json.Marshal(n.state[id])
+	if err := n.nodes[id].Compact(n.nodes[id].Status().Applied, data); err != nil {
+		n.t.Fatal(err)
+	}
+}
+
+// checkSafety fails when two nodes applied different commands at the same
+// position
+func (n *network) checkSafety() {
+	for a, stateA := range n.state {
+		for b, stateB := range n.state {
+			for i := 0; i < len(stateA) && i < len(stateB); i++ {
+				if stateA[i] != stateB[i] {
+					n.t.Fatalf("%s applied %q and %s applied %q at %d", a, stateA[i], b, stateB[i], i)
+				}
+			}
+		}
+	}
+}
+
+// converged reports whether every node applied the same commands
+func (n *network) converged() bool {
+	for _, state := range n.state {
+		if !reflect.DeepEqual(state, n.state["a"]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestElectionAndReplication(t *testing.T) {
+	n := newNetwork(t, 3)
+	id, leader := n.leader()
+	if id != "a" {
+		t.Fatalf("leader %q", id)
+	}
+	if members := leader.Status().Members; len(members) != 3 {
+		t.Fatalf("members %v", members)
+	}
+	for i := 0; i < 10; i++ {
+		if !n.propose(fmt.Sprint(i)) {
+			t.Fatal("no leader to propose to")
+		}
+	}
+	n.settle()
+	if !n.converged() || len(n.state["c"]) != 10 {
+		t.Fatalf("states %v", n.state)
+	}
+	if _, _, err := n.nodes["b"].Propose([]string{"x"}); err != ErrNotLeader {
+		t.Errorf("follower accepted a proposal: %v", err)
+	}
+	if leader, _ := n.nodes["b"].Leader(); leader.ID != "a" || leader.Addr != "a:6379" {
+		t.Errorf("b follows %+v", leader)
+	}
+
+	// The leader fails: the others elect one of them and go on
+	n.down["a"] = true
+	n.settle()
+	id, _ = n.leader()
+	if id == "" || id == "a" {
+		t.Fatalf("leader %q", id)
+	}
+	n.propose("after")
+	n.settle()
+
+	// The old leader comes back as a follower and catches up
+	n.down["a"] = false
+	n.settle()
+	if !n.converged() || n.state["a"][len(n.state["a"])-1] != "after" {
+		t.Fatalf("states %v", n.state)
+	}
+	if n.nodes["a"].Status().Role != Follower {
+		t.Error("the old leader did not step down")
+	}
+}
+
+func TestLeaderWithoutQuorum(t *testing.T) {
+	n := newNetwork(t, 3)
+	n.down["b"], n.down["c"] = true, true
+	// Proposals cannot commit without a majority, and the leader steps down
+	n.propose("lost")
+	n.settle()
+	if len(n.state["a"]) != 0 {
+		t.Fatalf("committed without a majority: %v", n.state["a"])
+	}
+	if n.nodes["a"].Status().Role == Leader {
+		t.Error("the leader did not step down")
+	}
+}
+
+func TestMembershipChanges(t *testing.T) {
+	n := newNetwork(t, 3)
+	_, leader := n.leader()
+	_, messages, err := leader.RemoveMember("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := leader.AddMember(Member{ID: "d"}); err != ErrMembersChanging {
+		t.Errorf("a second change was accepted: %v", err)
+	}
+	n.send(messages)
+	n.settle()
+	if len(leader.Status().Members) != 2 || !n.nodes["b"].IsMember() {
+		t.Fatalf("members %v", leader.Status().Members)
+	}
+	if _, _, err := leader.RemoveMember("c"); err != ErrUnknownMember {
+		t.Errorf("removed an unknown member: %v", err)
+	}
+
+	// The removed node no longer stands for election
+	n.down["a"] = true
+	n.settle()
+	if id, _ := n.leader(); id != "" {
+		t.Errorf("%s leads without a majority of the members", id)
+	}
+
+	// The leader can remove itself, and steps down once that committed
+	n.down["a"] = false
+	n.settle()
+	id, leader := n.leader()
+	_, messages, _ = leader.RemoveMember(id)
+	n.send(messages)
+	n.settle()
+	if next, _ := n.leader(); next == "" || next == id {
+		t.Errorf("leader %q after %s removed itself", next, id)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	n := newNetwork(t, 3)
+	for i := 0; i < 100; i++ {
+		n.propose(fmt.Sprint(i))
+	}
+	n.settle()
+	for id := range n.nodes {
+		n.compact(id)
+		if size := n.nodes[id].LogSize(); size != 0 {
+			t.Errorf("%s kept %d entries", id, size)
+		}
+	}
+
+	// A new node is sent the snapshot it cannot get from the log
+	n.start("d")
+	_, leader := n.leader()
+	_, messages, err := leader.AddMember(Member{ID: "d", Addr: "d:6379"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.send(messages)
+	n.propose("after")
+	n.settle()
+	if !n.converged() || len(n.state["d"]) != 101 {
+		t.Fatalf("d applied %v", n.state["d"])
+	}
+
+	// A restarted node starts from its snapshot
+	n.start("b")
+	n.settle()
+	if !n.converged() {
+		t.Fatalf("b applied %v after a restart", n.state["b"])
+	}
+}
+
+// Property-based test setup for groups of nodes
+func TestRaftProperties(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	// However nodes fail, restart and compact their logs, no two apply
+	// different commands at the same position, and once they all run again
+	// they apply the same commands
+	properties.Property("nodes agree", prop.ForAll(
+		func(actions []int) bool {
+			n := newNetwork(t, 3)
+			for i, action := range actions {
+				id := string(rune('a' + action%3))
+				switch action / 3 {
+				case 0:
+					n.down[id] = !n.down[id]
+				case 1:
+					n.start(id)
+				case 2:
+					n.compact(id)
+				default:
+					n.propose(fmt.Sprint(i))
+				}
+				n.tick(time.Duration(100+action*37) * time.Millisecond)
+			}
+			for id := range n.down {
+				n.down[id] = false
+			}
+			// Elections may split, but one eventually succeeds
+			for i := 0; i < 10 && !n.propose("last"); i++ {
+				n.settle()
+			}
+			n.settle()
+			last := len(n.state["a"]) - 1
+			return n.converged() && last >= 0 && n.state["a"][last] == "last"
+		},
+		gen.SliceOf(gen.IntRange(0, 20)),
+	))
+
+	properties.TestingRun(t)
+}
+
+func TestFileStorage(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, entries, err := storage.Load(); err != nil || len(entries) != 0 {
+		t.Fatalf("new storage: %v, %v", entries, err)
+	}
+	hard := HardState{ID: "a", Term: 3, Vote: "b"}
+	entries := []Entry{
+		{Index: 1, Term: 1, Kind: EntryMembers, Members: []Member{{ID: "a", Addr: "a:6379"}}},
+		{Index: 2, Term: 2, Kind: EntryCommand, Command: []string{"SET", "key", "value\n"}},
+		{Index: 3, Term: 3, Kind: EntryNoop},
+	}
+	if err := storage.SaveHardState(hard); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Append(entries[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Append(entries[2:]); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	// A crash in the middle of an append leaves a partial line
+	file, _ := os.OpenFile(filepath.Join(dir, logFile), os.O_WRONLY|os.O_APPEND, 0644)
+	file.WriteString(`{"index":4,"te`)
+	file.Close()
+	storage, _ = OpenFileStorage(dir)
+	loadedHard, snapshot, loaded, err := storage.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loadedHard != hard || snapshot.Index != 0 || !reflect.DeepEqual(loaded, entries) {
+		t.Fatalf("loaded %+v %+v %+v", loadedHard, snapshot, loaded)
+	}
+
+	// Compaction keeps the snapshot and the entries after it
+	snap := Snapshot{Index: 2, Term: 2, Members: entries[0].Members, Data: []byte("state\nwith lines")}
+	if err := storage.Replace(snap, entries[2:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Append([]Entry{{Index: 4, Term: 3, Kind: EntryNoop}}); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+	storage, _ = OpenFileStorage(dir)
+	_, snapshot, loaded, err = storage.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(snapshot, snap) || len(loaded) != 2 || loaded[0].Index != 3 || loaded[1].Index != 4 {
+		t.Fatalf("loaded %+v %+v", snapshot, loaded)
+	}
+	storage.Close()
+}
@@ -0,0 +1,263 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Storage keeps what a node must not forget across restarts: its term and
+// vote, its snapshot and its log. Every method returns only once the data
+// is durable.
+type Storage interface {
+	// Load returns what was saved, zero values for a new node
+	Load() (HardState, Snapshot, []Entry, error)
+	// SaveHardState replaces the term and vote
+	SaveHardState(state HardState) error
+	// Append adds entries after those saved
+	Append(entries []Entry) error
+	// Replace replaces the snapshot and the entries that follow it
+	Replace(snapshot Snapshot, entries []Entry) error
+}
+
+// MemoryStorage keeps the state in memory, for tests
+type MemoryStorage struct {
+	mutex    sync.Mutex
+	hard     HardState
+	snapshot Snapshot
+	entries  []Entry
+}
+
+// NewMemoryStorage returns an empty in-memory storage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+// Load implements Storage
+func (m *MemoryStorage) Load() (HardState, Snapshot, []Entry, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.hard, m.snapshot, append([]Entry(nil), m.entries...), nil
+}
+
+// SaveHardState implements Storage
+func (m *MemoryStorage) SaveHardState(state HardState) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.hard = state
+	return nil
+}
+
+// Append implements Storage
+func (m *MemoryStorage) Append(entries []Entry) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.entries = append(m.entries, entries...)
+	return nil
+}
+
+// Replace implements Storage
+func (m *MemoryStorage) Replace(snapshot Snapshot, entries []Entry) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.snapshot, m.entries = snapshot, append([]Entry(nil), entries...)
+	return nil
+}
+
+// Files of a FileStorage directory
+const (
+	stateFile    = "state.json"
+	snapshotFile = "snapshot"
+	logFile      = "log.jsonl"
+)
+
+// FileStorage keeps the state in a directory: the term and vote in a JSON
+// file, the snapshot as a JSON header line followed by its data, and the
+// log as one JSON entry per line, fsynced as it is appended
+type FileStorage struct {
+	dir           string
+	log           *os.File
+	snapshotIndex uint64
+	snapshotTerm  uint64
+}
+
+// OpenFileStorage opens the storage kept in dir, creating the directory
+// when needed
+func OpenFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStorage{dir: dir}, nil
+}
+
+// Load implements Storage. A last log line cut short by a crash is
+// dropped, as the entry was never acknowledged.
+func (f *FileStorage) Load() (HardState, Snapshot, []Entry, error) {
+	var hard HardState
+	var snapshot Snapshot
+	data, err := os.ReadFile(filepath.Join(f.dir, stateFile))
+	if err == nil {
+		err = json.Unmarshal(data, &hard)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return hard, snapshot, nil, fmt.Errorf("invalid Raft state: %w", err)
+	}
+
+	data, err = os.ReadFile(filepath.Join(f.dir, snapshotFile))
+	if err == nil {
+		header, rest, _ := bytes.Cut(data, []byte("\n"))
+		err = json.Unmarshal(header, &snapshot)
+		snapshot.Data = rest
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return hard, snapshot, nil, fmt.Errorf("invalid Raft snapshot: %w", err)
+	}
+	f.snapshotIndex, f.snapshotTerm = snapshot.Index, snapshot.Term
+
+	var entries []Entry
+	data, err = os.ReadFile(filepath.Join(f.dir, logFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return hard, snapshot, nil, err
+	}
+	valid := 0
+	for line, rest, complete := bytes.Cut(data, []byte("\n")); complete; line, rest, complete = bytes.Cut(rest, []byte("\n")) {
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return hard, snapshot, nil, fmt.Errorf("invalid Raft log entry: %w", err)
+		}
+		valid += len(line) + 1
+		// Entries the snapshot covers may remain after a crash between the
+		// two writes of Replace
+		if entry.Index <= snapshot.Index {
+			continue
+		}
+		if entry.Index != snapshot.Index+uint64(len(entries))+1 {
+			return hard, snapshot, nil, fmt.Errorf("the Raft log jumps to index %d after %d", entry.Index, snapshot.Index+uint64(len(entries)))
+		}
+		entries = append(entries, entry)
+	}
+	if valid < len(data) {
+		if err := os.Truncate(filepath.Join(f.dir, logFile), int64(valid)); err != nil {
+			return hard, snapshot, nil, err
+		}
+	}
+	if f.log, err = os.OpenFile(filepath.Join(f.dir, logFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+		return hard, snapshot, nil, err
+	}
+	return hard, snapshot, entries, nil
+}
+
+// SaveHardState implements Storage
+func (f *FileStorage) SaveHardState(state HardState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return f.writeAtomic(stateFile, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// Append implements Storage
+func (f *FileStorage) Append(entries []Entry) error {
+	var b bytes.Buffer
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		b.Write(append(line, '\n'))
+	}
+	if _, err := f.log.Write(b.Bytes()); err != nil {
+		return err
+	}
+	return f.log.Sync()
+}
+
+// Replace implements Storage. The snapshot is only rewritten when it
+// changed, and before the log, so a crash in between leaves a log that
+// still follows it.
+func (f *FileStorage) Replace(snapshot Snapshot, entries []Entry) error {
+	if snapshot.Index != f.snapshotIndex || snapshot.Term != f.snapshotTerm {
+		header := snapshot
+		header.Data = nil
+		line, err := json.Marshal(header)
+		if err != nil {
+			return err
+		}
+		if err := f.writeAtomic(snapshotFile, func(w io.Writer) error {
+			if _, err := w.Write(append(line, '\n')); err != nil {
+				return err
+			}
+			_, err := w.Write(snapshot.Data)
+			return err
+		}); err != nil {
+			return err
+		}
+		f.snapshotIndex, f.snapshotTerm = snapshot.Index, snapshot.Term
+	}
+
+	if err := f.writeAtomic(logFile, func(w io.Writer) error {
+		buffered := bufio.NewWriter(w)
+		encoder := json.NewEncoder(buffered)
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return buffered.Flush()
+	}); err != nil {
+		return err
+	}
+	log, err := os.OpenFile(filepath.Join(f.dir, logFile), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	f.log.Close()
+	f.log = log
+	return nil
+}
+
+// Close closes the log
+func (f *FileStorage) Close() error {
+	if f.log == nil {
+		return nil
+	}
+	return f.log.Close()
+}
+
+// writeAtomic writes a file of the directory via a temporary file, fsynced
+// and renamed over it
+func (f *FileStorage) writeAtomic(name string, write func(io.Writer) error) error {
+	path := filepath.Join(f.dir, name)
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if dir, err := os.Open(f.dir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// dumpFooterSize is the 2 byte RDB version plus the 8 byte CRC64 that end
+// every DUMP payload
+const dumpFooterSize = 10
+
+// ErrDumpPayload is returned for DUMP payloads written by a newer RDB
+// version or whose checksum does not match
+var ErrDumpPayload = errors.New("DUMP payload version or checksum are wrong")
+
+// Dump serializes a value in the format of the DUMP command: the type byte
+// and value encoding used in RDB files, followed by the RDB version and a
+// CRC64 of everything before it, both little endian. The entry's key and
+// expiry are not part of the payload.
+func Dump(entry Entry) ([]byte, error) {
+	valueType, err := encodingType(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.write([]byte{valueType})
+	w.writeValue(valueType, entry)
+	var version [2]byte
+	binary.LittleEndian.PutUint16(version[:], Version)
+	w.write(version[:])
+
+	var crc [8]byte
+	binary.LittleEndian.PutUint64(crc[:], w.crc)
+	if w.err == nil {
+		_, w.err = w.w.Write(crc[:])
+	}
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	return buf.Bytes(), w.err
+}
+
+// Restore decodes a DUMP payload into an entry holding the value. It fails
+// with ErrDumpPayload when the payload comes from a newer RDB version or
+// its checksum is wrong, and with a decoding error for malformed values.
+func Restore(payload []byte) (Entry, error) {
+	if len(payload) < dumpFooterSize+1 {
+		return Entry{}, ErrDumpPayload
+	}
+	footer := payload[len(payload)-dumpFooterSize:]
+	version := binary.LittleEndian.Uint16(footer)
+	if version > Version {
+		return Entry{}, ErrDumpPayload
+	}
+	if binary.LittleEndian.Uint64(footer[2:]) != Checksum(payload[:len(payload)-8]) {
+		return Entry{}, ErrDumpPayload
+	}
+
+	body := payload[:len(payload)-dumpFooterSize]
+	r := NewReader(bytes.NewReader(body))
+	r.version = int(version)
+
+	var entry Entry
+	valueType, err := r.readByte()
+	if err != nil {
+		return Entry{}, r.wrap(err)
+	}
+	if err := r.readValue(valueType, &entry); err != nil {
+		return Entry{}, r.wrap(err)
+	}
+	if r.offset != int64(len(body)) {
+		return Entry{}, fmt.Errorf("rdb: %d trailing bytes after the value", int64(len(body))-r.offset)
+	}
+	return entry, nil
+}
@@ -0,0 +1,236 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Listpack layout: a 4 byte total size and a 2 byte element count, both
+// little endian, then the elements and a 0xFF terminator. Each element is an
+// encoding byte, its data, and a back-length used to walk the list backwards.
+const (
+	listpackHeaderSize   = 6
+	listpackEnd          = 0xFF
+	listpackUnknownCount = 0xFFFF
+)
+
+// Listpack element encodings
+const (
+	lpEncoding7BitUint = 0x00
+	lpEncoding6BitStr  = 0x80
+	lpEncoding13BitInt = 0xC0
+	lpEncoding12BitStr = 0xE0
+	lpEncoding32BitStr = 0xF0
+	lpEncoding16BitInt = 0xF1
+	lpEncoding24BitInt = 0xF2
+	lpEncoding32BitInt = 0xF3
+	lpEncoding64BitInt = 0xF4
+)
+
+// errListpack is returned for listpacks whose structure is inconsistent
+var errListpack = errors.New("invalid listpack")
+
+// decodeListpack returns the elements of a listpack, rendering integer
+// elements as decimal strings
+func decodeListpack(data []byte) ([]string, error) {
+	if len(data) < listpackHeaderSize+1 || int(binary.LittleEndian.Uint32(data)) != len(data) || data[len(data)-1] != listpackEnd {
+		return nil, errListpack
+	}
+	count := int(binary.LittleEndian.Uint16(data[4:]))
+
+	var elements []string
+	p := listpackHeaderSize
+	for data[p] != listpackEnd {
+		value, size, err := decodeListpackElement(data[p : len(data)-1])
+		if err != nil {
+			return nil, err
+		}
+		p += size + listpackBacklenSize(size)
+		if p >= len(data) {
+			return nil, errListpack
+		}
+		elements = append(elements, value)
+	}
+
+	if p != len(data)-1 || (count != listpackUnknownCount && count != len(elements)) {
+		return nil, errListpack
+	}
+	return elements, nil
+}
+
+// decodeListpackElement decodes the element at the start of data, returning
+// its value and the size of its encoding byte(s) and data
+func decodeListpackElement(data []byte) (string, int, error) {
+	need := func(n int) error {
+		if n > len(data) {
+			return errListpack
+		}
+		return nil
+	}
+
+	b := data[0]
+	switch {
+	case b&0x80 == lpEncoding7BitUint:
+		return strconv.Itoa(int(b & 0x7F)), 1, nil
+	case b&0xC0 == lpEncoding6BitStr:
+		n := int(b & 0x3F)
+		if err := need(1 + n); err != nil {
+			return "", 0, err
+		}
+		return string(data[1 : 1+n]), 1 + n, nil
+	case b&0xE0 == lpEncoding13BitInt:
+		if err := need(2); err != nil {
+			return "", 0, err
+		}
+		v := int64(b&0x1F)<<8 | int64(data[1])
+		return strconv.FormatInt(signExtend(v, 13), 10), 2, nil
+	case b&0xF0 == lpEncoding12BitStr:
+		if err := need(2); err != nil {
+			return "", 0, err
+		}
+		n := int(b&0x0F)<<8 | int(data[1])
+		if err := need(2 + n); err != nil {
+			return "", 0, err
+		}
+		return string(data[2 : 2+n]), 2 + n, nil
+	}
+
+	switch b {
+	case lpEncoding32BitStr:
+		if err := need(5); err != nil {
+			return "", 0, err
+		}
+		n := int(binary.LittleEndian.Uint32(data[1:]))
+		if n < 0 || n > len(data)-5 {
+			return "", 0, errListpack
+		}
+		return string(data[5 : 5+n]), 5 + n, nil
+	case lpEncoding16BitInt, lpEncoding24BitInt, lpEncoding32BitInt, lpEncoding64BitInt:
+		width := map[byte]int{lpEncoding16BitInt: 2, lpEncoding24BitInt: 3, lpEncoding32BitInt: 4, lpEncoding64BitInt: 8}[b]
+		if err := need(1 + width); err != nil {
+			return "", 0, err
+		}
+		var v uint64
+		for i := width; i >= 1; i-- {
+			v = v<<8 | uint64(data[i])
+		}
+		return strconv.FormatInt(signExtend(int64(v), 8*width), 10), 1 + width, nil
+	default:
+		return "", 0, fmt.Errorf("%w: unknown element encoding 0x%02x", errListpack, b)
+	}
+}
+
+// signExtend interprets the low bits of v as a two's complement number
+func signExtend(v int64, bits int) int64 {
+	if bits >= 64 {
+		return v
+	}
+	shift := 64 - bits
+	return v << shift >> shift
+}
+
+// listpackBacklenSize returns how many bytes the back-length of an element
+// of the given encoded size occupies
+func listpackBacklenSize(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// encodeListpack builds a listpack holding elements, storing canonical
+// integers in the integer encodings as Redis does
+func encodeListpack(elements []string) []byte {
+	data := make([]byte, listpackHeaderSize, 64)
+	for _, element := range elements {
+		start := len(data)
+		data = appendListpackElement(data, element)
+		data = appendListpackBacklen(data, len(data)-start)
+	}
+	data = append(data, listpackEnd)
+
+	count := len(elements)
+	if count >= listpackUnknownCount {
+		count = listpackUnknownCount
+	}
+	binary.LittleEndian.PutUint32(data, uint32(len(data)))
+	binary.LittleEndian.PutUint16(data[4:], uint16(count))
+	return data
+}
+
+// appendListpackElement appends the encoding byte(s) and data of an element
+func appendListpackElement(data []byte, element string) []byte {
+	if v, ok := canonicalInt(element); ok {
+		switch {
+		case v >= 0 && v <= 127:
+			return append(data, byte(v))
+		case v >= -(1<<12) && v < 1<<12:
+			return append(data, lpEncoding13BitInt|byte(uint64(v)>>8&0x1F), byte(v))
+		case v >= -(1<<15) && v < 1<<15:
+			return appendLittleEndian(append(data, lpEncoding16BitInt), uint64(v), 2)
+		case v >= -(1<<23) && v < 1<<23:
+			return appendLittleEndian(append(data, lpEncoding24BitInt), uint64(v), 3)
+		case v >= -(1<<31) && v < 1<<31:
+			return appendLittleEndian(append(data, lpEncoding32BitInt), uint64(v), 4)
+		default:
+			return appendLittleEndian(append(data, lpEncoding64BitInt), uint64(v), 8)
+		}
+	}
+
+	n := len(element)
+	switch {
+	case n < 64:
+		data = append(data, lpEncoding6BitStr|byte(n))
+	case n < 4096:
+		data = append(data, lpEncoding12BitStr|byte(n>>8), byte(n))
+	default:
+		data = appendLittleEndian(append(data, lpEncoding32BitStr), uint64(n), 4)
+	}
+	return append(data, element...)
+}
+
+// appendListpackBacklen appends the back-length of an element: the size in
+// 7 bit groups, most significant first, with the high bit set on every byte
+// but the first so the list can be decoded from its tail
+func appendListpackBacklen(data []byte, size int) []byte {
+	n := listpackBacklenSize(size)
+	for i := n - 1; i >= 0; i-- {
+		b := byte(size >> (7 * i) & 0x7F)
+		if i != n-1 {
+			b |= 0x80
+		}
+		data = append(data, b)
+	}
+	return data
+}
+
+// appendLittleEndian appends the low width bytes of v in little endian order
+func appendLittleEndian(data []byte, v uint64, width int) []byte {
+	for i := 0; i < width; i++ {
+		data = append(data, byte(v>>(8*i)))
+	}
+	return data
+}
+
+// canonicalInt parses s as an integer only if formatting the result gives s
+// back, so values round-trip exactly through the integer encodings
+func canonicalInt(s string) (int64, bool) {
+	if len(s) == 0 || len(s) > 20 {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || strconv.FormatInt(v, 10) != s {
+		return 0, false
+	}
+	return v, true
+}
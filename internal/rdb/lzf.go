@@ -0,0 +1,120 @@
+package rdb
+
+import "errors"
+
+// errLZF is returned for compressed data that does not decode to the
+// announced length
+var errLZF = errors.New("invalid LZF compressed data")
+
+// LZF back references reach at most 8 KiB back and copy at most 264 bytes
+const (
+	lzfMaxOffset  = 1 << 13
+	lzfMaxLiteral = 32
+	lzfMaxMatch   = 7 + 255 + 2
+	lzfHashBits   = 14
+)
+
+// lzfDecompress expands LZF data as produced by liblzf into exactly
+// length bytes
+func lzfDecompress(in []byte, length int) ([]byte, error) {
+	out := make([]byte, 0, length)
+	for ip := 0; ip < len(in); {
+		ctrl := int(in[ip])
+		ip++
+
+		if ctrl < 1<<5 {
+			// Literal run of ctrl+1 bytes
+			n := ctrl + 1
+			if ip+n > len(in) || len(out)+n > length {
+				return nil, errLZF
+			}
+			out = append(out, in[ip:ip+n]...)
+			ip += n
+			continue
+		}
+
+		// Back reference
+		n := ctrl >> 5
+		if n == 7 {
+			if ip >= len(in) {
+				return nil, errLZF
+			}
+			n += int(in[ip])
+			ip++
+		}
+		n += 2
+		if ip >= len(in) {
+			return nil, errLZF
+		}
+		ref := len(out) - (ctrl&0x1F)<<8 - int(in[ip]) - 1
+		ip++
+		if ref < 0 || len(out)+n > length {
+			return nil, errLZF
+		}
+		// Copy byte by byte: the reference may overlap the bytes being written
+		for i := 0; i < n; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+
+	if len(out) != length {
+		return nil, errLZF
+	}
+	return out, nil
+}
+
+// lzfCompress compresses data in the LZF format understood by liblzf. It
+// returns nil when the result would not be smaller than maxLength bytes.
+func lzfCompress(in []byte, maxLength int) []byte {
+	out := make([]byte, 0, maxLength)
+	var table [1 << lzfHashBits]int
+
+	literalStart := 0
+	emitLiterals := func(end int) {
+		for literalStart < end {
+			n := min(end-literalStart, lzfMaxLiteral)
+			out = append(out, byte(n-1))
+			out = append(out, in[literalStart:literalStart+n]...)
+			literalStart += n
+		}
+	}
+
+	for ip := 0; ip+2 < len(in); {
+		h := (uint32(in[ip])<<16 | uint32(in[ip+1])<<8 | uint32(in[ip+2])) * 2654435761 >> (32 - lzfHashBits)
+		// Table slots hold position+1 so that zero means empty
+		ref := table[h] - 1
+		table[h] = ip + 1
+
+		offset := ip - ref - 1
+		if ref < 0 || offset >= lzfMaxOffset || in[ref] != in[ip] || in[ref+1] != in[ip+1] || in[ref+2] != in[ip+2] {
+			ip++
+			continue
+		}
+
+		n := 3
+		limit := min(len(in)-ip, lzfMaxMatch)
+		for n < limit && in[ref+n] == in[ip+n] {
+			n++
+		}
+
+		emitLiterals(ip)
+		if n-2 < 7 {
+			out = append(out, byte((n-2)<<5|offset>>8))
+		} else {
+			out = append(out, byte(7<<5|offset>>8), byte(n-2-7))
+		}
+		out = append(out, byte(offset))
+		ip += n
+		literalStart = ip
+
+		if len(out) >= maxLength {
+			return nil
+		}
+	}
+	emitLiterals(len(in))
+
+	if len(out) >= maxLength {
+		return nil
+	}
+	return out
+}
@@ -0,0 +1,468 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/leanovate/gopter"
+	"github.com/leanovate/gopter/gen"
+	"github.com/leanovate/gopter/prop"
+)
+
+func TestChecksum(t *testing.T) {
+	// Check value of CRC-64/Jones as used by Redis
+	if got := Checksum([]byte("123456789")); got != 0xe9c6d914c4b8d9ca {
+		t.Errorf("Checksum = %x, want e9c6d914c4b8d9ca", got)
+	}
+}
+
+// writeEntries encodes entries as a complete RDB file
+func writeEntries(entries []Entry) []byte {
+	var buf bytes.Buffer
+	writer := NewWriter(&buf)
+	writer.WriteHeader()
+	writer.WriteAux("redis-ver", "7.2.0")
+	writer.WriteSelectDB(0)
+	writer.WriteResizeDB(len(entries), 0)
+	for _, entry := range entries {
+		writer.WriteEntry(entry)
+	}
+	writer.WriteEOF()
+	return buf.Bytes()
+}
+
+// Property-based test setup for RDB round trips
+func TestRDBRoundTrip(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	// For any set of string entries, writing then reading an RDB file should
+	// yield the same entries in the same order
+	properties.Property("write then read returns the same entries", prop.ForAll(
+		func(keys []string, values []string, expiry int64) bool {
+			entries := make([]Entry, len(keys))
+			for i, key := range keys {
+				entries[i] = Entry{Key: key, Value: values[i%len(values)]}
+				if i%3 == 0 {
+					entries[i].ExpireAt = expiry
+				}
+			}
+
+			var loaded []Entry
+			err := NewReader(bytes.NewReader(writeEntries(entries))).Load(func(entry Entry) error {
+				loaded = append(loaded, entry)
+				return nil
+			})
+			if err != nil || len(loaded) != len(entries) {
+				return false
+			}
+			return len(loaded) == len(entries) && (len(entries) == 0 || reflect.DeepEqual(loaded, entries))
+		},
+		gen.SliceOf(gen.AnyString()),
+		gen.SliceOfN(4, gen.OneGenOf(gen.AnyString(), gen.Int64().Map(func(n int64) string {
+			return string(rune('0' + n%10))
+		}), gen.Const("-129"), gen.Const("40000"), gen.Const("007"), gen.Const("12345678901"))),
+		gen.Int64Range(1, 1<<50),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
+
+func TestReaderDetectsCorruption(t *testing.T) {
+	data := writeEntries([]Entry{{Key: "key", Value: "value"}})
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		corrupt := append([]byte(nil), data...)
+		corrupt[len(corrupt)-12] ^= 0xFF // flip a byte of the value
+		err := NewReader(bytes.NewReader(corrupt)).Load(func(Entry) error { return nil })
+		if !errors.Is(err, ErrChecksum) {
+			t.Errorf("Expected checksum error, got %v", err)
+		}
+	})
+
+	t.Run("truncated file", func(t *testing.T) {
+		err := NewReader(bytes.NewReader(data[:len(data)-15])).Load(func(Entry) error { return nil })
+		if err == nil {
+			t.Error("Expected error for truncated file")
+		}
+	})
+
+	t.Run("bad magic", func(t *testing.T) {
+		err := NewReader(bytes.NewReader([]byte("NOTREDIS0011"))).Load(func(Entry) error { return nil })
+		if err == nil {
+			t.Error("Expected error for bad magic")
+		}
+	})
+}
+
+// Property-based test setup for locating corruption
+func TestReaderValidSize(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	// For any cut inside the last key, decoding should fail and report the
+	// start of that key's record as the end of the valid prefix
+	properties.Property("valid size stops before the broken record", prop.ForAll(
+		func(key, value string, cut int) bool {
+			prefix := len(writeEntries(nil)) - 9 // without the EOF opcode and checksum
+			data := writeEntries([]Entry{{Key: key, Value: value}})
+			record := len(data) - 9 - prefix
+
+			reader := NewReader(bytes.NewReader(data[:prefix+cut%record]))
+			err := reader.Load(func(Entry) error { return nil })
+			return err != nil && reader.ValidSize() == int64(prefix) &&
+				reader.Version() == Version && reader.Aux()["redis-ver"] == "7.2.0"
+		},
+		gen.AnyString(),
+		gen.AnyString(),
+		gen.IntRange(0, 1000),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
+
+// normalize sorts the parts of a value whose order the encodings may change
+func normalize(entry Entry) Entry {
+	entry.Set = append([]string(nil), entry.Set...)
+	sort.Strings(entry.Set)
+	entry.ZSet = append([]ZSetMember(nil), entry.ZSet...)
+	sort.Slice(entry.ZSet, func(i, j int) bool { return entry.ZSet[i].Member < entry.ZSet[j].Member })
+	return entry
+}
+
+// genElements generates distinct collection elements, mixing integers,
+// short strings and strings too long for the compact encodings
+func genElements() gopter.Gen {
+	element := gen.OneGenOf(
+		gen.Int64().Map(func(n int64) string { return strconv.FormatInt(n, 10) }),
+		gen.Int64Range(-200, 200).Map(func(n int64) string { return strconv.FormatInt(n, 10) }),
+		gen.AlphaString(),
+		gen.AlphaString().Map(func(s string) string { return strings.Repeat("x", 60) + s }),
+	)
+	return gen.SliceOf(element).Map(func(elements []string) []string {
+		seen := make(map[string]bool)
+		var distinct []string
+		for _, element := range elements {
+			if !seen[element] {
+				seen[element] = true
+				distinct = append(distinct, element)
+			}
+		}
+		return distinct
+	})
+}
+
+// Property-based test setup for RDB round trips of every value type
+func TestRDBRoundTripAllTypes(t *testing.T) {
+	parameters := gopter.DefaultTestParameters()
+	parameters.MinSuccessfulTests = 50
+	properties := gopter.NewProperties(parameters)
+
+	// For any collections, small enough for the listpack and intset
+	// encodings or not, writing then reading should give back the same values
+	properties.Property("collections survive a round trip", prop.ForAll(
+		func(elements []string, repeat int) bool {
+			// Repeating the elements pushes some values past the size limits
+			var many []string
+			for i := 0; i < repeat; i++ {
+				for _, element := range elements {
+					many = append(many, element+strings.Repeat("-", i))
+				}
+			}
+
+			hash := make(map[string]string)
+			var zset []ZSetMember
+			for i, element := range many {
+				hash[element] = strconv.Itoa(i)
+				zset = append(zset, ZSetMember{Member: element, Score: float64(i%7) / 4})
+			}
+			if len(zset) > 0 {
+				zset[0].Score = math.Inf(-1)
+			}
+
+			entries := []Entry{
+				{Key: "list", Type: TypeList, List: append(many, many...)},
+				{Key: "set", Type: TypeSet, Set: many},
+				{Key: "intset", Type: TypeSet, Set: []string{"3", "-70000", "1", "5000000000"}},
+				{Key: "hash", Type: TypeHash, Hash: hash},
+				{Key: "zset", Type: TypeZSet, ZSet: zset},
+				{Key: "long", Type: TypeString, Value: strings.Repeat("compressible ", 50)},
+			}
+			var loaded []Entry
+			err := NewReader(bytes.NewReader(writeEntries(entries))).Load(func(entry Entry) error {
+				loaded = append(loaded, normalize(entry))
+				return nil
+			})
+			if err != nil || len(loaded) != len(entries) {
+				return false
+			}
+			for i := range entries {
+				expected := normalize(entries[i])
+				if len(expected.List) == 0 && len(loaded[i].List) == 0 {
+					expected.List = loaded[i].List
+				}
+				if len(expected.Set) == 0 && len(loaded[i].Set) == 0 {
+					expected.Set = loaded[i].Set
+				}
+				if len(expected.ZSet) == 0 && len(loaded[i].ZSet) == 0 {
+					expected.ZSet = loaded[i].ZSet
+				}
+				if !reflect.DeepEqual(loaded[i], expected) {
+					return false
+				}
+			}
+			return true
+		},
+		genElements(),
+		gen.IntRange(1, 4),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
+
+// Property-based test setup for stream round trips
+func TestRDBStreamRoundTrip(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	// For any entries, spread over several listpack nodes and mixing entries
+	// that share the master fields with ones that do not, the stream and its
+	// consumer groups should survive a round trip
+	properties.Property("streams survive a round trip", prop.ForAll(
+		func(count int, extra []string) bool {
+			stream := &Stream{EntriesAdded: uint64(count + 3), MaxDeletedID: StreamID{Ms: 1, Seq: 0}}
+			for i := 0; i < count; i++ {
+				id := StreamID{Ms: 1000 + uint64(i/3), Seq: uint64(i % 3)}
+				fields := []string{"temperature", strconv.Itoa(i), "unit", "C"}
+				if len(extra) > 0 && i%5 == 0 {
+					fields = append(fields, extra[i%len(extra)], "1")
+				}
+				stream.Entries = append(stream.Entries, StreamEntry{ID: id, Fields: fields})
+			}
+			if count > 0 {
+				stream.FirstID = stream.Entries[0].ID
+				stream.LastID = stream.Entries[count-1].ID
+				pending := stream.Entries[count-1].ID
+				stream.Groups = []StreamGroup{{
+					Name:        "readers",
+					LastID:      pending,
+					EntriesRead: int64(count),
+					Pending:     []StreamPending{{ID: pending, DeliveryTime: 1700000000000, DeliveryCount: 2}},
+					Consumers: []StreamConsumer{{
+						Name: "alice", SeenTime: 1700000000001, ActiveTime: 1700000000000, Pending: []StreamID{pending},
+					}},
+				}, {Name: "idle", EntriesRead: -1}}
+			}
+
+			var loaded []Entry
+			data := writeEntries([]Entry{{Key: "events", Type: TypeStream, Stream: stream}})
+			err := NewReader(bytes.NewReader(data)).Load(func(entry Entry) error {
+				loaded = append(loaded, entry)
+				return nil
+			})
+			return err == nil && len(loaded) == 1 && reflect.DeepEqual(loaded[0].Stream, stream)
+		},
+		gen.IntRange(0, 350),
+		gen.SliceOf(gen.AlphaString()),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
+
+// Property-based test setup for LZF compression
+func TestLZFRoundTrip(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	// For any data, compressing then decompressing returns the data, and
+	// compression only succeeds when it saves space
+	properties.Property("decompress inverts compress", prop.ForAll(
+		func(chunks []string, repeat int) bool {
+			data := []byte(strings.Repeat(strings.Join(chunks, ""), repeat))
+			compressed := lzfCompress(data, len(data))
+			if compressed == nil {
+				return true
+			}
+			if len(compressed) >= len(data) {
+				return false
+			}
+			decompressed, err := lzfDecompress(compressed, len(data))
+			return err == nil && bytes.Equal(decompressed, data)
+		},
+		gen.SliceOf(gen.AnyString()),
+		gen.IntRange(1, 50),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
+
+func TestLZFDecompress(t *testing.T) {
+	// A literal "a" followed by a back reference copying it 24 more times
+	data, err := lzfDecompress([]byte{0x00, 'a', 0xE0, 0x0F, 0x00}, 25)
+	if err != nil || string(data) != strings.Repeat("a", 25) {
+		t.Errorf("lzfDecompress = %q, %v", data, err)
+	}
+	if _, err := lzfDecompress([]byte{0x00, 'a', 0x20, 0x05}, 4); err == nil {
+		t.Error("Expected an error for a reference before the start of the output")
+	}
+}
+
+// mustHex decodes a hex fixture, ignoring spaces
+func mustHex(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatalf("bad fixture %q: %v", s, err)
+	}
+	return data
+}
+
+func TestCompactEncodings(t *testing.T) {
+	tests := []struct {
+		name     string
+		decode   func([]byte) ([]string, error)
+		data     string
+		expected []string
+	}{
+		// The examples from the ziplist.c documentation
+		{"ziplist", decodeZiplist, "0f000000 0c000000 0200 00f3 02f6 ff", []string{"2", "5"}},
+		{"ziplist with string", decodeZiplist,
+			"1c000000 0e000000 0300 00f3 02f6 020b 48656c6c6f20576f726c64 ff", []string{"2", "5", "Hello World"}},
+		{"ziplist integers", decodeZiplist,
+			"18000000 10000000 0300 00fe 85 03c0 1027 04d0 a0860100 ff", []string{"-123", "10000", "100000"}},
+		{"intset", decodeIntset, "02000000 03000000 0100 0200 0300", []string{"1", "2", "3"}},
+		{"intset 64 bit", decodeIntset, "08000000 01000000 00f2052a01000000", []string{"5000000000"}},
+		// The example from the zipmap.c documentation
+		{"zipmap", decodeZipmap, "02 03 666f6f 03 00 626172 05 68656c6c6f 05 00 776f726c64 ff",
+			[]string{"foo", "bar", "hello", "world"}},
+		{"listpack", decodeListpack, "11000000 0200 85 68656c6c6f 06 c400 02 ff", []string{"hello", "1024"}},
+		{"listpack negative", decodeListpack, "0e000000 0200 dfff 02 f1 00 80 03 ff", []string{"-1", "-32768"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.decode(mustHex(t, tt.data))
+			if err != nil || !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("decode = %q, %v; want %q", got, err, tt.expected)
+			}
+		})
+	}
+
+	if got := hex.EncodeToString(encodeListpack([]string{"hello", "1024"})); got != "1100000002008568656c6c6f06c40002ff" {
+		t.Errorf("encodeListpack = %s", got)
+	}
+	if got := hex.EncodeToString(encodeIntset([]int64{3, 1, 2})); got != "0200000003000000010002000300" {
+		t.Errorf("encodeIntset = %s", got)
+	}
+}
+
+// rawRDB frames hand-encoded records as a complete RDB file of the given
+// version, appending the checksum Redis would write
+func rawRDB(t *testing.T, version int, records ...string) []byte {
+	data := []byte(fmt.Sprintf("REDIS%04d", version))
+	for _, record := range records {
+		data = append(data, mustHex(t, record)...)
+	}
+	data = append(data, opEOF)
+	return binary.LittleEndian.AppendUint64(data, Checksum(data))
+}
+
+func TestReaderLegacyEncodings(t *testing.T) {
+	// Records as written by Redis 5 and 6 (RDB 9): a ziplist hash, an intset,
+	// a quicklist of ziplists, a zset with string scores and an LZF string
+	data := rawRDB(t, 9,
+		"fa 09 72656469732d766572 05 362e322e36",
+		"fe 00 fb 05 01",
+		"fc 00e40b5402000000 0d 01 68 0f 0f000000 0c000000 0200 00f3 02f6 ff",
+		"0b 01 73 0e 02000000 03000000 0100 0200 0300",
+		"0e 01 6c 01 0f 0f000000 0c000000 0200 00f3 02f6 ff",
+		"03 01 7a 02 01 61 03 312e35 01 62 fe",
+		"00 01 63 c3 05 19 00 61 e0 0f 00",
+		"f8 05 f9 07 00 01 6b 01 76",
+	)
+
+	var loaded []Entry
+	if err := NewReader(bytes.NewReader(data)).Load(func(entry Entry) error {
+		loaded = append(loaded, entry)
+		return nil
+	}); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	expected := []Entry{
+		{Key: "h", Type: TypeHash, Hash: map[string]string{"2": "5"}, ExpireAt: 10000000000},
+		{Key: "s", Type: TypeSet, Set: []string{"1", "2", "3"}},
+		{Key: "l", Type: TypeList, List: []string{"2", "5"}},
+		{Key: "z", Type: TypeZSet, ZSet: []ZSetMember{{Member: "a", Score: 1.5}, {Member: "b", Score: math.Inf(1)}}},
+		{Key: "c", Type: TypeString, Value: strings.Repeat("a", 25)},
+		{Key: "k", Type: TypeString, Value: "v"},
+	}
+	if !reflect.DeepEqual(loaded, expected) {
+		t.Errorf("Loaded %+v, want %+v", loaded, expected)
+	}
+}
+
+func TestRestoreRedisPayload(t *testing.T) {
+	// DUMP of the value 10 as documented for Redis 5 (RDB 9)
+	payload := []byte("\x00\xc0\n\t\x00\xbem\x06\x89Z(\x00\n")
+	entry, err := Restore(payload)
+	if err != nil || entry.Type != TypeString || entry.Value != "10" {
+		t.Fatalf("Restore = %+v, %v", entry, err)
+	}
+
+	corrupt := append([]byte(nil), payload...)
+	corrupt[2] ^= 1
+	if _, err := Restore(corrupt); !errors.Is(err, ErrDumpPayload) {
+		t.Errorf("Expected ErrDumpPayload for a bad checksum, got %v", err)
+	}
+
+	// A payload from a newer RDB version is refused even with a valid checksum
+	newer := append([]byte{0x00, 0xc0, 0x0a}, 0xFF, 0x00)
+	newer = binary.LittleEndian.AppendUint64(newer, Checksum(newer))
+	if _, err := Restore(newer); !errors.Is(err, ErrDumpPayload) {
+		t.Errorf("Expected ErrDumpPayload for a newer version, got %v", err)
+	}
+
+	// A well-formed footer around garbage is a decoding error
+	garbage := append([]byte{0x00, 0x05, 'a'}, 0x0b, 0x00)
+	garbage = binary.LittleEndian.AppendUint64(garbage, Checksum(garbage))
+	if _, err := Restore(garbage); err == nil || errors.Is(err, ErrDumpPayload) {
+		t.Errorf("Expected a decoding error for a short value, got %v", err)
+	}
+}
+
+// Property-based test setup for DUMP payloads
+func TestDumpRoundTrip(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	// For any value, restoring its DUMP payload gives back the same value
+	properties.Property("restore inverts dump", prop.ForAll(
+		func(elements []string, value string) bool {
+			entries := []Entry{{Type: TypeString, Value: value}}
+			if len(elements) > 0 {
+				entries = append(entries,
+					Entry{Type: TypeList, List: elements},
+					Entry{Type: TypeSet, Set: elements},
+				)
+			}
+			for _, entry := range entries {
+				payload, err := Dump(entry)
+				if err != nil {
+					return false
+				}
+				restored, err := Restore(payload)
+				if err != nil || !reflect.DeepEqual(normalize(restored), normalize(entry)) {
+					return false
+				}
+			}
+			return true
+		},
+		genElements(),
+		gen.AnyString(),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
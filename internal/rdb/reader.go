@@ -0,0 +1,743 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Reader decodes an RDB file, verifying its checksum
+type Reader struct {
+	r       *bufio.Reader
+	crc     uint64
+	offset  int64
+	version int
+	// valid is the offset just past the last complete record
+	valid int64
+	aux   map[string]string
+}
+
+// NewReader creates a reader decoding RDB data from r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Offset returns the number of bytes consumed so far
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+// ValidSize returns the length of the prefix made of complete records,
+// which is where decoding went wrong when Load fails
+func (r *Reader) ValidSize() int64 {
+	return r.valid
+}
+
+// Version returns the RDB version from the header, once it has been read
+func (r *Reader) Version() int {
+	return r.version
+}
+
+// Aux returns the auxiliary fields read so far, such as redis-ver and ctime
+func (r *Reader) Aux() map[string]string {
+	return r.aux
+}
+
+// Load decodes the whole file, calling fn for every key in order. It fails
+// on malformed data, module values and checksum mismatches. Auxiliary
+// fields are collected for Aux; functions and eviction hints are skipped.
+func (r *Reader) Load(fn func(Entry) error) error {
+	header := make([]byte, 9)
+	if err := r.readFull(header); err != nil {
+		return fmt.Errorf("rdb: reading header: %w", err)
+	}
+	if string(header[:5]) != "REDIS" {
+		return fmt.Errorf("rdb: invalid magic %q", header[:5])
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < minVersion || version > Version {
+		return fmt.Errorf("rdb: unsupported version %q", header[5:])
+	}
+	r.version = version
+
+	db := 0
+	var expireAt int64
+	r.aux = make(map[string]string)
+	for {
+		r.valid = r.offset
+		opcode, err := r.readByte()
+		if err != nil {
+			return r.wrap(err)
+		}
+
+		switch opcode {
+		case opEOF:
+			return r.verifyChecksum()
+		case opSelectDB:
+			n, err := r.readLength()
+			if err != nil {
+				return r.wrap(err)
+			}
+			db = int(n)
+		case opResizeDB:
+			if _, err := r.readLength(); err != nil {
+				return r.wrap(err)
+			}
+			if _, err := r.readLength(); err != nil {
+				return r.wrap(err)
+			}
+		case opAux:
+			key, err := r.readString()
+			if err != nil {
+				return r.wrap(err)
+			}
+			value, err := r.readString()
+			if err != nil {
+				return r.wrap(err)
+			}
+			r.aux[key] = value
+		case opExpireTimeMs:
+			buf := make([]byte, 8)
+			if err := r.readFull(buf); err != nil {
+				return r.wrap(err)
+			}
+			expireAt = int64(binary.LittleEndian.Uint64(buf))
+		case opExpireTime:
+			buf := make([]byte, 4)
+			if err := r.readFull(buf); err != nil {
+				return r.wrap(err)
+			}
+			expireAt = int64(binary.LittleEndian.Uint32(buf)) * 1000
+		case opIdle:
+			if _, err := r.readLength(); err != nil {
+				return r.wrap(err)
+			}
+		case opFreq:
+			if _, err := r.readByte(); err != nil {
+				return r.wrap(err)
+			}
+		case opSlotInfo:
+			for i := 0; i < 3; i++ {
+				if _, err := r.readLength(); err != nil {
+					return r.wrap(err)
+				}
+			}
+		case opFunction2:
+			if _, err := r.readString(); err != nil {
+				return r.wrap(err)
+			}
+		case opModuleAux:
+			if err := r.skipModuleAux(); err != nil {
+				return r.wrap(err)
+			}
+		case opFunctionPre:
+			return fmt.Errorf("rdb: pre-release function format at offset %d is not supported", r.offset-1)
+		default:
+			entry := Entry{DB: db, ExpireAt: expireAt}
+			key, err := r.readString()
+			if err != nil {
+				return r.wrap(err)
+			}
+			entry.Key = key
+			if err := r.readValue(opcode, &entry); err != nil {
+				return r.wrap(fmt.Errorf("key %q: %w", key, err))
+			}
+			if err := fn(entry); err != nil {
+				return err
+			}
+			expireAt = 0
+		}
+	}
+}
+
+// readValue decodes a value stored with the given type byte into entry
+func (r *Reader) readValue(valueType byte, entry *Entry) error {
+	switch valueType {
+	case typeString:
+		value, err := r.readString()
+		entry.Type, entry.Value = TypeString, value
+		return err
+	case typeList:
+		list, err := r.readStrings(1)
+		entry.Type, entry.List = TypeList, list
+		return err
+	case typeListZiplist:
+		list, err := r.readEncoded(decodeZiplist)
+		entry.Type, entry.List = TypeList, list
+		return err
+	case typeListQuicklist, typeListQuicklist2:
+		list, err := r.readQuicklist(valueType == typeListQuicklist2)
+		entry.Type, entry.List = TypeList, list
+		return err
+	case typeSet:
+		set, err := r.readStrings(1)
+		entry.Type, entry.Set = TypeSet, set
+		return err
+	case typeSetIntset:
+		set, err := r.readEncoded(decodeIntset)
+		entry.Type, entry.Set = TypeSet, set
+		return err
+	case typeSetListpack:
+		set, err := r.readEncoded(decodeListpack)
+		entry.Type, entry.Set = TypeSet, set
+		return err
+	case typeHash:
+		pairs, err := r.readStrings(2)
+		if err != nil {
+			return err
+		}
+		return setHash(entry, pairs)
+	case typeHashZipmap, typeHashZiplist, typeHashListpack:
+		decode := map[byte]func([]byte) ([]string, error){
+			typeHashZipmap:   decodeZipmap,
+			typeHashZiplist:  decodeZiplist,
+			typeHashListpack: decodeListpack,
+		}[valueType]
+		pairs, err := r.readEncoded(decode)
+		if err != nil {
+			return err
+		}
+		return setHash(entry, pairs)
+	case typeZSet, typeZSet2:
+		n, err := r.readLength()
+		if err != nil {
+			return err
+		}
+		entry.Type = TypeZSet
+		for i := uint64(0); i < n; i++ {
+			member, err := r.readString()
+			if err != nil {
+				return err
+			}
+			var score float64
+			if valueType == typeZSet2 {
+				score, err = r.readBinaryDouble()
+			} else {
+				score, err = r.readDoubleString()
+			}
+			if err != nil {
+				return err
+			}
+			entry.ZSet = append(entry.ZSet, ZSetMember{Member: member, Score: score})
+		}
+		return nil
+	case typeZSetZiplist, typeZSetListpack:
+		decode := decodeZiplist
+		if valueType == typeZSetListpack {
+			decode = decodeListpack
+		}
+		pairs, err := r.readEncoded(decode)
+		if err != nil {
+			return err
+		}
+		if len(pairs)%2 != 0 {
+			return fmt.Errorf("sorted set has an odd number of elements")
+		}
+		entry.Type = TypeZSet
+		for i := 0; i < len(pairs); i += 2 {
+			score, err := strconv.ParseFloat(pairs[i+1], 64)
+			if err != nil {
+				return fmt.Errorf("invalid sorted set score %q", pairs[i+1])
+			}
+			entry.ZSet = append(entry.ZSet, ZSetMember{Member: pairs[i], Score: score})
+		}
+		return nil
+	case typeStreamListpacks, typeStreamListpacks2, typeStreamListpacks3:
+		stream, err := r.readStream(valueType)
+		entry.Type, entry.Stream = TypeStream, stream
+		return err
+	case typeModule, typeModule2:
+		return fmt.Errorf("module values are not supported")
+	default:
+		return fmt.Errorf("unknown value type %d", valueType)
+	}
+}
+
+// setHash stores alternating fields and values as the entry's hash
+func setHash(entry *Entry, pairs []string) error {
+	if len(pairs)%2 != 0 {
+		return fmt.Errorf("hash has an odd number of elements")
+	}
+	entry.Type = TypeHash
+	entry.Hash = make(map[string]string, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		if _, exists := entry.Hash[pairs[i]]; exists {
+			return fmt.Errorf("duplicate hash field %q", pairs[i])
+		}
+		entry.Hash[pairs[i]] = pairs[i+1]
+	}
+	return nil
+}
+
+// readStrings reads a count followed by count*per strings
+func (r *Reader) readStrings(per uint64) ([]string, error) {
+	n, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for i := uint64(0); i < n*per; i++ {
+		value, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// readEncoded reads a string blob and decodes it with decode
+func (r *Reader) readEncoded(decode func([]byte) ([]string, error)) ([]string, error) {
+	blob, err := r.readString()
+	if err != nil {
+		return nil, err
+	}
+	return decode([]byte(blob))
+}
+
+// readQuicklist reads a list stored as a sequence of ziplist nodes or, in
+// the second version, of plain elements and listpack nodes
+func (r *Reader) readQuicklist(v2 bool) ([]string, error) {
+	n, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	var list []string
+	for i := uint64(0); i < n; i++ {
+		container := uint64(quicklistNodePacked)
+		if v2 {
+			if container, err = r.readLength(); err != nil {
+				return nil, err
+			}
+		}
+		blob, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case container == quicklistNodePlain:
+			list = append(list, blob)
+		case container != quicklistNodePacked:
+			return nil, fmt.Errorf("unknown quicklist container %d", container)
+		default:
+			decode := decodeZiplist
+			if v2 {
+				decode = decodeListpack
+			}
+			elements, err := decode([]byte(blob))
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, elements...)
+		}
+	}
+	return list, nil
+}
+
+// readStream reads a stream stored with one of the listpack stream types
+func (r *Reader) readStream(valueType byte) (*Stream, error) {
+	stream := &Stream{}
+
+	nodes, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < nodes; i++ {
+		key, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		master, err := decodeStreamID([]byte(key))
+		if err != nil {
+			return nil, err
+		}
+		node, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		entries, err := decodeStreamNode(master, []byte(node))
+		if err != nil {
+			return nil, err
+		}
+		stream.Entries = append(stream.Entries, entries...)
+	}
+
+	length, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if length != uint64(len(stream.Entries)) {
+		return nil, fmt.Errorf("stream length %d does not match its %d entries", length, len(stream.Entries))
+	}
+	if stream.LastID, err = r.readStreamIDLengths(); err != nil {
+		return nil, err
+	}
+
+	if valueType >= typeStreamListpacks2 {
+		if stream.FirstID, err = r.readStreamIDLengths(); err != nil {
+			return nil, err
+		}
+		if stream.MaxDeletedID, err = r.readStreamIDLengths(); err != nil {
+			return nil, err
+		}
+		if stream.EntriesAdded, err = r.readLength(); err != nil {
+			return nil, err
+		}
+	} else {
+		// Older files lack these fields; derive them as Redis does
+		stream.EntriesAdded = length
+		if len(stream.Entries) > 0 {
+			stream.FirstID = stream.Entries[0].ID
+		}
+	}
+
+	groups, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < groups; i++ {
+		group, err := r.readStreamGroup(valueType)
+		if err != nil {
+			return nil, err
+		}
+		stream.Groups = append(stream.Groups, group)
+	}
+	return stream, nil
+}
+
+// readStreamGroup reads a consumer group with its pending entries and consumers
+func (r *Reader) readStreamGroup(valueType byte) (StreamGroup, error) {
+	group := StreamGroup{EntriesRead: -1}
+	var err error
+	if group.Name, err = r.readString(); err != nil {
+		return group, err
+	}
+	if group.LastID, err = r.readStreamIDLengths(); err != nil {
+		return group, err
+	}
+	if valueType >= typeStreamListpacks2 {
+		entriesRead, err := r.readLength()
+		if err != nil {
+			return group, err
+		}
+		group.EntriesRead = int64(entriesRead)
+	}
+
+	pending, err := r.readLength()
+	if err != nil {
+		return group, err
+	}
+	for i := uint64(0); i < pending; i++ {
+		var entry StreamPending
+		if entry.ID, err = r.readRawStreamID(); err != nil {
+			return group, err
+		}
+		if entry.DeliveryTime, err = r.readMillis(); err != nil {
+			return group, err
+		}
+		if entry.DeliveryCount, err = r.readLength(); err != nil {
+			return group, err
+		}
+		group.Pending = append(group.Pending, entry)
+	}
+
+	consumers, err := r.readLength()
+	if err != nil {
+		return group, err
+	}
+	for i := uint64(0); i < consumers; i++ {
+		var consumer StreamConsumer
+		if consumer.Name, err = r.readString(); err != nil {
+			return group, err
+		}
+		if consumer.SeenTime, err = r.readMillis(); err != nil {
+			return group, err
+		}
+		consumer.ActiveTime = consumer.SeenTime
+		if valueType >= typeStreamListpacks3 {
+			if consumer.ActiveTime, err = r.readMillis(); err != nil {
+				return group, err
+			}
+		}
+		n, err := r.readLength()
+		if err != nil {
+			return group, err
+		}
+		for j := uint64(0); j < n; j++ {
+			id, err := r.readRawStreamID()
+			if err != nil {
+				return group, err
+			}
+			consumer.Pending = append(consumer.Pending, id)
+		}
+		group.Consumers = append(group.Consumers, consumer)
+	}
+	return group, nil
+}
+
+// readStreamIDLengths reads an ID stored as two lengths
+func (r *Reader) readStreamIDLengths() (StreamID, error) {
+	ms, err := r.readLength()
+	if err != nil {
+		return StreamID{}, err
+	}
+	seq, err := r.readLength()
+	return StreamID{Ms: ms, Seq: seq}, err
+}
+
+// readRawStreamID reads an ID stored as 16 raw big endian bytes
+func (r *Reader) readRawStreamID() (StreamID, error) {
+	buf := make([]byte, 16)
+	if err := r.readFull(buf); err != nil {
+		return StreamID{}, err
+	}
+	return decodeStreamID(buf)
+}
+
+// readMillis reads a little endian millisecond timestamp
+func (r *Reader) readMillis() (int64, error) {
+	buf := make([]byte, 8)
+	if err := r.readFull(buf); err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(buf)), nil
+}
+
+// readBinaryDouble reads a little endian IEEE 754 double
+func (r *Reader) readBinaryDouble() (float64, error) {
+	buf := make([]byte, 8)
+	if err := r.readFull(buf); err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(buf)), nil
+}
+
+// readDoubleString reads a double stored as a length-prefixed decimal
+// string, with reserved lengths for NaN and the infinities
+func (r *Reader) readDoubleString() (float64, error) {
+	n, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	buf := make([]byte, n)
+	if err := r.readFull(buf); err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseFloat(string(buf), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid double %q", buf)
+	}
+	return value, nil
+}
+
+// skipModuleAux skips module auxiliary data, which is made of typed
+// opcodes terminated by an EOF opcode
+func (r *Reader) skipModuleAux() error {
+	// Module ID, then the "when" opcode and value
+	for i := 0; i < 3; i++ {
+		if _, err := r.readLength(); err != nil {
+			return err
+		}
+	}
+	for {
+		opcode, err := r.readLength()
+		if err != nil {
+			return err
+		}
+		switch opcode {
+		case moduleOpEOF:
+			return nil
+		case moduleOpSInt, moduleOpUInt:
+			_, err = r.readLength()
+		case moduleOpFloat:
+			err = r.readFull(make([]byte, 4))
+		case moduleOpDouble:
+			err = r.readFull(make([]byte, 8))
+		case moduleOpString:
+			_, err = r.readString()
+		default:
+			return fmt.Errorf("unknown module opcode %d", opcode)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// verifyChecksum reads the CRC64 footer and compares it with the data read
+func (r *Reader) verifyChecksum() error {
+	if r.version < 5 {
+		return nil
+	}
+	expected := r.crc
+	buf := make([]byte, 8)
+	if err := r.readFull(buf); err != nil {
+		return r.wrap(err)
+	}
+	checksum := binary.LittleEndian.Uint64(buf)
+	// A zero checksum means the writer had checksums disabled
+	if checksum != 0 && checksum != expected {
+		return ErrChecksum
+	}
+	return nil
+}
+
+// wrap annotates a decoding error with the current offset
+func (r *Reader) wrap(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("rdb: at offset %d: %w", r.offset, err)
+}
+
+// readByte reads one byte, updating the checksum and offset
+func (r *Reader) readByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	r.crc = crc64Update(r.crc, []byte{b})
+	r.offset++
+	return b, nil
+}
+
+// readFull fills buf, updating the checksum and offset
+func (r *Reader) readFull(buf []byte) error {
+	n, err := io.ReadFull(r.r, buf)
+	r.crc = crc64Update(r.crc, buf[:n])
+	r.offset += int64(n)
+	return err
+}
+
+// readLengthOrEncoding reads a length, reporting whether it is instead a
+// special string encoding marker
+func (r *Reader) readLengthOrEncoding() (uint64, bool, error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch b >> 6 {
+	case len6Bit:
+		return uint64(b & 0x3F), false, nil
+	case len14Bit:
+		next, err := r.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3F)<<8 | uint64(next), false, nil
+	case lenEncVal:
+		return uint64(b & 0x3F), true, nil
+	}
+
+	switch b {
+	case len32Bit:
+		buf := make([]byte, 4)
+		if err := r.readFull(buf); err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(buf)), false, nil
+	case len64Bit:
+		buf := make([]byte, 8)
+		if err := r.readFull(buf); err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(buf), false, nil
+	default:
+		return 0, false, fmt.Errorf("invalid length encoding 0x%02x", b)
+	}
+}
+
+// readLength reads a plain length
+func (r *Reader) readLength() (uint64, error) {
+	length, encoded, err := r.readLengthOrEncoding()
+	if err != nil {
+		return 0, err
+	}
+	if encoded {
+		return 0, fmt.Errorf("unexpected string encoding %d where a length was expected", length)
+	}
+	return length, nil
+}
+
+// readString reads a length-prefixed or integer-encoded string
+func (r *Reader) readString() (string, error) {
+	length, encoded, err := r.readLengthOrEncoding()
+	if err != nil {
+		return "", err
+	}
+
+	if encoded {
+		switch length {
+		case encInt8:
+			b, err := r.readByte()
+			if err != nil {
+				return "", err
+			}
+			return strconv.Itoa(int(int8(b))), nil
+		case encInt16:
+			buf := make([]byte, 2)
+			if err := r.readFull(buf); err != nil {
+				return "", err
+			}
+			return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(buf)))), nil
+		case encInt32:
+			buf := make([]byte, 4)
+			if err := r.readFull(buf); err != nil {
+				return "", err
+			}
+			return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(buf)))), nil
+		case encLZF:
+			return r.readLZFString()
+		default:
+			return "", fmt.Errorf("unsupported string encoding %d", length)
+		}
+	}
+
+	if length > maxStringLength {
+		return "", fmt.Errorf("string length %d exceeds the %d byte limit", length, maxStringLength)
+	}
+	buf := make([]byte, length)
+	if err := r.readFull(buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// readLZFString reads an LZF compressed string: the compressed and
+// uncompressed lengths followed by the compressed data
+func (r *Reader) readLZFString() (string, error) {
+	compressed, err := r.readLength()
+	if err != nil {
+		return "", err
+	}
+	length, err := r.readLength()
+	if err != nil {
+		return "", err
+	}
+	if compressed > maxStringLength || length > maxStringLength {
+		return "", fmt.Errorf("compressed string length exceeds the %d byte limit", maxStringLength)
+	}
+	buf := make([]byte, compressed)
+	if err := r.readFull(buf); err != nil {
+		return "", err
+	}
+	data, err := lzfDecompress(buf, int(length))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
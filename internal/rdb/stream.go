@@ -0,0 +1,227 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// StreamID identifies a stream entry
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+// String renders the ID in the <ms>-<seq> form used by stream commands
+func (id StreamID) String() string {
+	return fmt.Sprintf("%d-%d", id.Ms, id.Seq)
+}
+
+// Less reports whether id sorts before other
+func (id StreamID) Less(other StreamID) bool {
+	return id.Ms < other.Ms || (id.Ms == other.Ms && id.Seq < other.Seq)
+}
+
+// Stream is the content of a stream key
+type Stream struct {
+	Entries      []StreamEntry
+	LastID       StreamID
+	FirstID      StreamID
+	MaxDeletedID StreamID
+	EntriesAdded uint64
+	Groups       []StreamGroup
+}
+
+// StreamEntry is a stream entry with its field-value pairs
+type StreamEntry struct {
+	ID     StreamID
+	Fields []string // alternating fields and values
+}
+
+// StreamGroup is a consumer group with its pending entries
+type StreamGroup struct {
+	Name   string
+	LastID StreamID
+	// EntriesRead is the logical read counter, or -1 when unknown
+	EntriesRead int64
+	Pending     []StreamPending
+	Consumers   []StreamConsumer
+}
+
+// StreamPending is an entry delivered to a consumer but not yet acknowledged
+type StreamPending struct {
+	ID            StreamID
+	DeliveryTime  int64 // Unix milliseconds
+	DeliveryCount uint64
+}
+
+// StreamConsumer is a consumer of a group and the IDs pending for it
+type StreamConsumer struct {
+	Name       string
+	SeenTime   int64 // Unix milliseconds
+	ActiveTime int64 // Unix milliseconds
+	Pending    []StreamID
+}
+
+// Stream entry flags stored in listpack nodes
+const (
+	streamItemDeleted    = 1
+	streamItemSameFields = 2
+)
+
+var errStreamNode = errors.New("invalid stream listpack")
+
+// decodeStreamID decodes the 16 byte big endian form of an ID
+func decodeStreamID(data []byte) (StreamID, error) {
+	if len(data) != 16 {
+		return StreamID{}, fmt.Errorf("invalid stream ID of %d bytes", len(data))
+	}
+	return StreamID{Ms: binary.BigEndian.Uint64(data), Seq: binary.BigEndian.Uint64(data[8:])}, nil
+}
+
+// encodeStreamID encodes an ID in its 16 byte big endian form
+func encodeStreamID(id StreamID) []byte {
+	data := make([]byte, 16)
+	binary.BigEndian.PutUint64(data, id.Ms)
+	binary.BigEndian.PutUint64(data[8:], id.Seq)
+	return data
+}
+
+// decodeStreamNode returns the live entries of a stream listpack node. A
+// node starts with a master entry listing the fields of its first entry;
+// entries store their ID as a delta from the node's master ID and omit the
+// field names when they match the master fields.
+func decodeStreamNode(master StreamID, data []byte) ([]StreamEntry, error) {
+	elements, err := decodeListpack(data)
+	if err != nil {
+		return nil, err
+	}
+
+	p := 0
+	next := func() (string, error) {
+		if p >= len(elements) {
+			return "", errStreamNode
+		}
+		p++
+		return elements[p-1], nil
+	}
+	nextInt := func() (int64, error) {
+		element, err := next()
+		if err != nil {
+			return 0, err
+		}
+		v, err := strconv.ParseInt(element, 10, 64)
+		if err != nil {
+			return 0, errStreamNode
+		}
+		return v, nil
+	}
+
+	// Master entry: count, deleted, number of master fields, the fields and a 0
+	if _, err := nextInt(); err != nil {
+		return nil, err
+	}
+	if _, err := nextInt(); err != nil {
+		return nil, err
+	}
+	numMaster, err := nextInt()
+	if err != nil || numMaster < 0 || int(numMaster) > len(elements) {
+		return nil, errStreamNode
+	}
+	masterFields := make([]string, numMaster)
+	for i := range masterFields {
+		if masterFields[i], err = next(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := nextInt(); err != nil {
+		return nil, err
+	}
+
+	var entries []StreamEntry
+	for p < len(elements) {
+		flags, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		msDiff, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		seqDiff, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		entry := StreamEntry{ID: StreamID{Ms: master.Ms + uint64(msDiff), Seq: master.Seq + uint64(seqDiff)}}
+
+		if flags&streamItemSameFields != 0 {
+			for _, field := range masterFields {
+				value, err := next()
+				if err != nil {
+					return nil, err
+				}
+				entry.Fields = append(entry.Fields, field, value)
+			}
+		} else {
+			numFields, err := nextInt()
+			if err != nil || numFields < 0 || int(numFields) > len(elements) {
+				return nil, errStreamNode
+			}
+			for i := 0; i < 2*int(numFields); i++ {
+				element, err := next()
+				if err != nil {
+					return nil, err
+				}
+				entry.Fields = append(entry.Fields, element)
+			}
+		}
+		// lp-count lets readers walk the node backwards
+		if _, err := nextInt(); err != nil {
+			return nil, err
+		}
+
+		if flags&streamItemDeleted == 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// encodeStreamNode encodes entries as a stream listpack node whose master ID
+// is the first entry's ID
+func encodeStreamNode(entries []StreamEntry) []byte {
+	master := entries[0].ID
+	var masterFields []string
+	for i := 0; i < len(entries[0].Fields); i += 2 {
+		masterFields = append(masterFields, entries[0].Fields[i])
+	}
+
+	itoa := func(v int64) string { return strconv.FormatInt(v, 10) }
+	elements := []string{itoa(int64(len(entries))), "0", itoa(int64(len(masterFields)))}
+	elements = append(elements, masterFields...)
+	elements = append(elements, "0")
+
+	for _, entry := range entries {
+		sameFields := len(entry.Fields) == 2*len(masterFields)
+		for i := 0; sameFields && i < len(masterFields); i++ {
+			sameFields = entry.Fields[2*i] == masterFields[i]
+		}
+
+		numFields := len(entry.Fields) / 2
+		msDiff := itoa(int64(entry.ID.Ms - master.Ms))
+		seqDiff := itoa(int64(entry.ID.Seq - master.Seq))
+		if sameFields {
+			elements = append(elements, itoa(streamItemSameFields), msDiff, seqDiff)
+			for i := 1; i < len(entry.Fields); i += 2 {
+				elements = append(elements, entry.Fields[i])
+			}
+			elements = append(elements, itoa(int64(numFields+3)))
+		} else {
+			elements = append(elements, "0", msDiff, seqDiff, itoa(int64(numFields)))
+			elements = append(elements, entry.Fields...)
+			elements = append(elements, itoa(int64(2*numFields+4)))
+		}
+	}
+	return encodeListpack(elements)
+}
@@ -0,0 +1,396 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Writer encodes an RDB file, tracking the running checksum
+type Writer struct {
+	w   *bufio.Writer
+	crc uint64
+	err error
+}
+
+// NewWriter creates a writer emitting RDB data to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// write appends raw bytes, remembering the first error
+func (w *Writer) write(data []byte) {
+	if w.err != nil {
+		return
+	}
+	w.crc = crc64Update(w.crc, data)
+	_, w.err = w.w.Write(data)
+}
+
+// WriteHeader writes the REDIS magic and format version
+func (w *Writer) WriteHeader() error {
+	w.write([]byte(fmt.Sprintf("REDIS%04d", Version)))
+	return w.err
+}
+
+// WriteAux writes an auxiliary field such as redis-ver or ctime
+func (w *Writer) WriteAux(key, value string) error {
+	w.write([]byte{opAux})
+	w.writeString(key)
+	w.writeString(value)
+	return w.err
+}
+
+// WriteSelectDB starts the keys of a database
+func (w *Writer) WriteSelectDB(db int) error {
+	w.write([]byte{opSelectDB})
+	w.writeLength(uint64(db))
+	return w.err
+}
+
+// WriteResizeDB records the key and expiry counts of the current database
+func (w *Writer) WriteResizeDB(keys, expires int) error {
+	w.write([]byte{opResizeDB})
+	w.writeLength(uint64(keys))
+	w.writeLength(uint64(expires))
+	return w.err
+}
+
+// WriteEntry writes a key with its optional expiry. Values are stored with
+// the encoding Redis would pick for them under its default size limits.
+func (w *Writer) WriteEntry(entry Entry) error {
+	if entry.ExpireAt > 0 {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], uint64(entry.ExpireAt))
+		w.write([]byte{opExpireTimeMs})
+		w.write(buf[:])
+	}
+
+	valueType, err := encodingType(entry)
+	if err != nil {
+		if w.err == nil {
+			w.err = err
+		}
+		return w.err
+	}
+	w.write([]byte{valueType})
+	w.writeString(entry.Key)
+	w.writeValue(valueType, entry)
+	return w.err
+}
+
+// encodingType picks the type byte an entry's value is written with
+func encodingType(entry Entry) (byte, error) {
+	switch entry.Type {
+	case TypeString:
+		return typeString, nil
+	case TypeList:
+		return typeListQuicklist2, nil
+	case TypeSet:
+		if len(entry.Set) <= maxIntsetEntries {
+			if _, ok := intsetMembers(entry.Set); ok {
+				return typeSetIntset, nil
+			}
+		}
+		if fitsListpack(entry.Set, 1) {
+			return typeSetListpack, nil
+		}
+		return typeSet, nil
+	case TypeHash:
+		pairs := make([]string, 0, 2*len(entry.Hash))
+		for field, value := range entry.Hash {
+			pairs = append(pairs, field, value)
+		}
+		if fitsListpack(pairs, 2) {
+			return typeHashListpack, nil
+		}
+		return typeHash, nil
+	case TypeZSet:
+		members := make([]string, len(entry.ZSet))
+		for i, member := range entry.ZSet {
+			if math.IsNaN(member.Score) {
+				return 0, fmt.Errorf("rdb: sorted set %q has a NaN score", entry.Key)
+			}
+			members[i] = member.Member
+		}
+		if fitsListpack(members, 1) {
+			return typeZSetListpack, nil
+		}
+		return typeZSet2, nil
+	case TypeStream:
+		if entry.Stream == nil {
+			return 0, fmt.Errorf("rdb: stream %q has no content", entry.Key)
+		}
+		return typeStreamListpacks3, nil
+	default:
+		return 0, fmt.Errorf("rdb: unknown value type %d for key %q", entry.Type, entry.Key)
+	}
+}
+
+// fitsListpack reports whether a collection of elements grouped per entry
+// is small enough for Redis to keep it listpack encoded
+func fitsListpack(elements []string, per int) bool {
+	if len(elements)/per > maxListpackEntries {
+		return false
+	}
+	for _, element := range elements {
+		if len(element) > maxListpackValue {
+			return false
+		}
+	}
+	return true
+}
+
+// intsetMembers parses set members as integers, reporting whether they all
+// are canonical integers
+func intsetMembers(members []string) ([]int64, bool) {
+	values := make([]int64, len(members))
+	for i, member := range members {
+		v, ok := canonicalInt(member)
+		if !ok {
+			return nil, false
+		}
+		values[i] = v
+	}
+	return values, true
+}
+
+// writeValue writes an entry's value in the encoding named by valueType
+func (w *Writer) writeValue(valueType byte, entry Entry) {
+	switch valueType {
+	case typeString:
+		w.writeString(entry.Value)
+	case typeListQuicklist2:
+		w.writeQuicklist(entry.List)
+	case typeSetIntset:
+		values, _ := intsetMembers(entry.Set)
+		w.writeString(string(encodeIntset(values)))
+	case typeSetListpack:
+		w.writeString(string(encodeListpack(entry.Set)))
+	case typeSet:
+		w.writeLength(uint64(len(entry.Set)))
+		for _, member := range entry.Set {
+			w.writeString(member)
+		}
+	case typeHashListpack:
+		pairs := make([]string, 0, 2*len(entry.Hash))
+		for _, field := range sortedKeys(entry.Hash) {
+			pairs = append(pairs, field, entry.Hash[field])
+		}
+		w.writeString(string(encodeListpack(pairs)))
+	case typeHash:
+		w.writeLength(uint64(len(entry.Hash)))
+		for _, field := range sortedKeys(entry.Hash) {
+			w.writeString(field)
+			w.writeString(entry.Hash[field])
+		}
+	case typeZSetListpack:
+		// Listpack sorted sets must be ordered by score, then member
+		members := append([]ZSetMember(nil), entry.ZSet...)
+		sort.Slice(members, func(i, j int) bool {
+			if members[i].Score != members[j].Score {
+				return members[i].Score < members[j].Score
+			}
+			return members[i].Member < members[j].Member
+		})
+		pairs := make([]string, 0, 2*len(members))
+		for _, member := range members {
+			pairs = append(pairs, member.Member, formatScore(member.Score))
+		}
+		w.writeString(string(encodeListpack(pairs)))
+	case typeZSet2:
+		w.writeLength(uint64(len(entry.ZSet)))
+		for _, member := range entry.ZSet {
+			w.writeString(member.Member)
+			var buf [8]byte
+			binary.LittleEndian.PutUint64(buf[:], math.Float64bits(member.Score))
+			w.write(buf[:])
+		}
+	case typeStreamListpacks3:
+		w.writeStream(entry.Stream)
+	}
+}
+
+// writeQuicklist writes a list as listpack nodes of about 8 KiB each
+func (w *Writer) writeQuicklist(list []string) {
+	var nodes [][]string
+	start, size := 0, 0
+	for i, element := range list {
+		// Approximate the encoded size: the element plus its overhead
+		elementSize := len(element) + 11
+		if i > start && size+elementSize > maxQuicklistNode {
+			nodes = append(nodes, list[start:i])
+			start, size = i, 0
+		}
+		size += elementSize
+	}
+	if start < len(list) {
+		nodes = append(nodes, list[start:])
+	}
+
+	w.writeLength(uint64(len(nodes)))
+	for _, node := range nodes {
+		w.writeLength(quicklistNodePacked)
+		w.writeString(string(encodeListpack(node)))
+	}
+}
+
+// writeStream writes a stream in the third listpack stream format
+func (w *Writer) writeStream(stream *Stream) {
+	var nodes [][]StreamEntry
+	for start := 0; start < len(stream.Entries); start += maxStreamNodeItems {
+		nodes = append(nodes, stream.Entries[start:min(start+maxStreamNodeItems, len(stream.Entries))])
+	}
+
+	w.writeLength(uint64(len(nodes)))
+	for _, node := range nodes {
+		w.writeString(string(encodeStreamID(node[0].ID)))
+		w.writeString(string(encodeStreamNode(node)))
+	}
+
+	w.writeLength(uint64(len(stream.Entries)))
+	w.writeStreamIDLengths(stream.LastID)
+	w.writeStreamIDLengths(stream.FirstID)
+	w.writeStreamIDLengths(stream.MaxDeletedID)
+	w.writeLength(stream.EntriesAdded)
+
+	w.writeLength(uint64(len(stream.Groups)))
+	for _, group := range stream.Groups {
+		w.writeString(group.Name)
+		w.writeStreamIDLengths(group.LastID)
+		w.writeLength(uint64(group.EntriesRead))
+		w.writeLength(uint64(len(group.Pending)))
+		for _, pending := range group.Pending {
+			w.write(encodeStreamID(pending.ID))
+			w.writeMillis(pending.DeliveryTime)
+			w.writeLength(pending.DeliveryCount)
+		}
+		w.writeLength(uint64(len(group.Consumers)))
+		for _, consumer := range group.Consumers {
+			w.writeString(consumer.Name)
+			w.writeMillis(consumer.SeenTime)
+			w.writeMillis(consumer.ActiveTime)
+			w.writeLength(uint64(len(consumer.Pending)))
+			for _, id := range consumer.Pending {
+				w.write(encodeStreamID(id))
+			}
+		}
+	}
+}
+
+// writeStreamIDLengths writes an ID as two lengths
+func (w *Writer) writeStreamIDLengths(id StreamID) {
+	w.writeLength(id.Ms)
+	w.writeLength(id.Seq)
+}
+
+// writeMillis writes a little endian millisecond timestamp
+func (w *Writer) writeMillis(ms int64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(ms))
+	w.write(buf[:])
+}
+
+// formatScore renders a score the way Redis stores it in listpacks:
+// integral values as integers, others in the shortest exact form
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	case score == math.Trunc(score) && math.Abs(score) < 1<<53:
+		return strconv.FormatInt(int64(score), 10)
+	default:
+		return strconv.FormatFloat(score, 'g', -1, 64)
+	}
+}
+
+// sortedKeys returns the keys of a map in order, so output is deterministic
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteEOF writes the end-of-file marker and the CRC64 footer, then flushes
+func (w *Writer) WriteEOF() error {
+	w.write([]byte{opEOF})
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], w.crc)
+	if w.err == nil {
+		_, w.err = w.w.Write(buf[:])
+	}
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	return w.err
+}
+
+// writeLength writes a length using the smallest RDB length encoding
+func (w *Writer) writeLength(length uint64) {
+	switch {
+	case length < 1<<6:
+		w.write([]byte{byte(length)})
+	case length < 1<<14:
+		w.write([]byte{byte(len14Bit<<6 | length>>8), byte(length)})
+	case length <= 0xFFFFFFFF:
+		var buf [5]byte
+		buf[0] = len32Bit
+		binary.BigEndian.PutUint32(buf[1:], uint32(length))
+		w.write(buf[:])
+	default:
+		var buf [9]byte
+		buf[0] = len64Bit
+		binary.BigEndian.PutUint64(buf[1:], length)
+		w.write(buf[:])
+	}
+}
+
+// writeString writes a string, using the integer encoding when the value is
+// a canonical integer that fits in 32 bits and LZF compression for longer
+// strings that shrink, as Redis does
+func (w *Writer) writeString(s string) {
+	if len(s) <= 11 {
+		if n, err := strconv.ParseInt(s, 10, 32); err == nil && strconv.FormatInt(n, 10) == s {
+			w.writeInt(n)
+			return
+		}
+	}
+	if len(s) > 20 {
+		if compressed := lzfCompress([]byte(s), len(s)-4); compressed != nil {
+			w.write([]byte{lenEncVal<<6 | encLZF})
+			w.writeLength(uint64(len(compressed)))
+			w.writeLength(uint64(len(s)))
+			w.write(compressed)
+			return
+		}
+	}
+	w.writeLength(uint64(len(s)))
+	w.write([]byte(s))
+}
+
+// writeInt writes an integer-encoded string
+func (w *Writer) writeInt(n int64) {
+	switch {
+	case n >= -(1<<7) && n < 1<<7:
+		w.write([]byte{lenEncVal<<6 | encInt8, byte(int8(n))})
+	case n >= -(1<<15) && n < 1<<15:
+		var buf [3]byte
+		buf[0] = lenEncVal<<6 | encInt16
+		binary.LittleEndian.PutUint16(buf[1:], uint16(int16(n)))
+		w.write(buf[:])
+	default:
+		var buf [5]byte
+		buf[0] = lenEncVal<<6 | encInt32
+		binary.LittleEndian.PutUint32(buf[1:], uint32(int32(n)))
+		w.write(buf[:])
+	}
+}
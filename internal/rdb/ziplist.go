@@ -0,0 +1,229 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strconv"
+)
+
+// Ziplist layout: 4 byte total size, 4 byte tail offset and 2 byte element
+// count, little endian, then the elements and a 0xFF terminator. Ziplists
+// are only found in files written by Redis before 7.0, so they are read but
+// never written.
+const (
+	ziplistHeaderSize = 10
+	ziplistEnd        = 0xFF
+	ziplistBigPrevLen = 0xFE
+)
+
+// Ziplist element encodings
+const (
+	zipStr06B = 0x00
+	zipStr14B = 0x40
+	zipStr32B = 0x80
+	zipInt16B = 0xC0
+	zipInt32B = 0xD0
+	zipInt64B = 0xE0
+	zipInt24B = 0xF0
+	zipInt8B  = 0xFE
+)
+
+var (
+	errZiplist = errors.New("invalid ziplist")
+	errIntset  = errors.New("invalid intset")
+	errZipmap  = errors.New("invalid zipmap")
+)
+
+// decodeZiplist returns the elements of a ziplist, rendering integer
+// elements as decimal strings
+func decodeZiplist(data []byte) ([]string, error) {
+	if len(data) < ziplistHeaderSize+1 || int(binary.LittleEndian.Uint32(data)) != len(data) || data[len(data)-1] != ziplistEnd {
+		return nil, errZiplist
+	}
+
+	var elements []string
+	p := ziplistHeaderSize
+	for data[p] != ziplistEnd {
+		// Skip the length of the previous element
+		if data[p] == ziplistBigPrevLen {
+			p += 5
+		} else {
+			p++
+		}
+		if p >= len(data)-1 {
+			return nil, errZiplist
+		}
+
+		value, size, err := decodeZiplistElement(data[p : len(data)-1])
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, value)
+		p += size
+	}
+	return elements, nil
+}
+
+// decodeZiplistElement decodes the encoding and data of the element at the
+// start of data, returning its value and encoded size
+func decodeZiplistElement(data []byte) (string, int, error) {
+	b := data[0]
+	var header, n int
+	switch b & 0xC0 {
+	case zipStr06B:
+		header, n = 1, int(b&0x3F)
+	case zipStr14B:
+		if len(data) < 2 {
+			return "", 0, errZiplist
+		}
+		header, n = 2, int(b&0x3F)<<8|int(data[1])
+	case zipStr32B:
+		if len(data) < 5 {
+			return "", 0, errZiplist
+		}
+		header, n = 5, int(binary.BigEndian.Uint32(data[1:]))
+	}
+	if header > 0 {
+		if n < 0 || header+n > len(data) {
+			return "", 0, errZiplist
+		}
+		return string(data[header : header+n]), header + n, nil
+	}
+
+	var width int
+	switch b {
+	case zipInt8B:
+		width = 1
+	case zipInt16B:
+		width = 2
+	case zipInt24B:
+		width = 3
+	case zipInt32B:
+		width = 4
+	case zipInt64B:
+		width = 8
+	default:
+		// 1111xxxx holds an immediate value from 0 to 12 as xxxx-1
+		if b&0xF0 == 0xF0 && b&0x0F >= 1 && b&0x0F <= 13 {
+			return strconv.Itoa(int(b&0x0F) - 1), 1, nil
+		}
+		return "", 0, errZiplist
+	}
+	if 1+width > len(data) {
+		return "", 0, errZiplist
+	}
+	var v uint64
+	for i := width; i >= 1; i-- {
+		v = v<<8 | uint64(data[i])
+	}
+	return strconv.FormatInt(signExtend(int64(v), 8*width), 10), 1 + width, nil
+}
+
+// decodeIntset returns the members of an intset: a 4 byte integer width and
+// 4 byte count, little endian, followed by the sorted integers
+func decodeIntset(data []byte) ([]string, error) {
+	if len(data) < 8 {
+		return nil, errIntset
+	}
+	width := int(binary.LittleEndian.Uint32(data))
+	count := int(binary.LittleEndian.Uint32(data[4:]))
+	if (width != 2 && width != 4 && width != 8) || count < 0 || len(data) != 8+width*count {
+		return nil, errIntset
+	}
+
+	members := make([]string, count)
+	for i := range members {
+		item := data[8+i*width:]
+		var v int64
+		switch width {
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(item)))
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(item)))
+		default:
+			v = int64(binary.LittleEndian.Uint64(item))
+		}
+		members[i] = strconv.FormatInt(v, 10)
+	}
+	return members, nil
+}
+
+// encodeIntset builds an intset from integer members using the narrowest
+// width that holds them all
+func encodeIntset(values []int64) []byte {
+	sorted := append([]int64(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	width := 2
+	for _, v := range sorted {
+		if v < -(1<<31) || v >= 1<<31 {
+			width = 8
+			break
+		}
+		if v < -(1<<15) || v >= 1<<15 {
+			width = 4
+		}
+	}
+
+	data := make([]byte, 8, 8+width*len(sorted))
+	binary.LittleEndian.PutUint32(data, uint32(width))
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(sorted)))
+	for _, v := range sorted {
+		data = appendLittleEndian(data, uint64(v), width)
+	}
+	return data
+}
+
+// decodeZipmap returns the alternating fields and values of a zipmap, the
+// hash encoding used by Redis before 2.6
+func decodeZipmap(data []byte) ([]string, error) {
+	if len(data) < 2 {
+		return nil, errZipmap
+	}
+
+	var elements []string
+	p := 1
+	readLength := func() (int, bool) {
+		if p >= len(data) {
+			return 0, false
+		}
+		b := data[p]
+		if b < 254 {
+			p++
+			return int(b), true
+		}
+		if b == 254 && p+5 <= len(data) {
+			n := int(binary.LittleEndian.Uint32(data[p+1:]))
+			p += 5
+			return n, true
+		}
+		return 0, false
+	}
+
+	for p < len(data) && data[p] != 0xFF {
+		n, ok := readLength()
+		if !ok || n < 0 || p+n > len(data) {
+			return nil, errZipmap
+		}
+		field := string(data[p : p+n])
+		p += n
+
+		n, ok = readLength()
+		if !ok || p >= len(data) {
+			return nil, errZipmap
+		}
+		// A free byte counts unused trailing space after the value
+		free := int(data[p])
+		p++
+		if n < 0 || p+n+free > len(data) {
+			return nil, errZipmap
+		}
+		elements = append(elements, field, string(data[p:p+n]))
+		p += n + free
+	}
+	if p != len(data)-1 {
+		return nil, errZipmap
+	}
+	return elements, nil
+}
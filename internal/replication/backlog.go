@@ -0,0 +1,106 @@
+// Package replication holds the parts of master-replica replication that do
+// not depend on the server: replication IDs and the backlog of the command
+// stream that lets a replica resume after a short disconnect
+package replication
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// DefaultBacklogSize is the size of the replication backlog unless
+// configured otherwise
+const DefaultBacklogSize = 1 << 20
+
+// IDLength is the length of a replication ID in hexadecimal characters
+const IDLength = 40
+
+// NoID is the replication ID of a history that does not exist
+const NoID = "0000000000000000000000000000000000000000"
+
+// NewID returns a random replication ID, naming a new history of the
+// dataset
+func NewID() string {
+	id := make([]byte, IDLength/2)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// Backlog keeps the most recent bytes of the replication stream in a
+// circular buffer. Offsets count the bytes of the stream since its
+// history started, the first byte being at offset 1 as in Redis, so a
+// replica that processed up to offset n asks for the stream from n+1.
+// It is not safe for concurrent use; callers provide the locking.
+type Backlog struct {
+	buf    []byte
+	start  int
+	length int
+	offset int64
+}
+
+// NewBacklog creates an empty backlog of size bytes whose next byte will be
+// at offset+1
+func NewBacklog(size int, offset int64) *Backlog {
+	return &Backlog{buf: make([]byte, max(size, 1)), offset: offset}
+}
+
+// Write appends data to the stream, dropping the oldest bytes that no
+// longer fit
+func (b *Backlog) Write(data []byte) {
+	b.offset += int64(len(data))
+	if len(data) >= len(b.buf) {
+		copy(b.buf, data[len(data)-len(b.buf):])
+		b.start, b.length = 0, len(b.buf)
+		return
+	}
+	end := (b.start + b.length) % len(b.buf)
+	copied := copy(b.buf[end:], data)
+	copy(b.buf, data[copied:])
+	if b.length += len(data); b.length > len(b.buf) {
+		b.start = (b.start + b.length - len(b.buf)) % len(b.buf)
+		b.length = len(b.buf)
+	}
+}
+
+// Offset returns the offset of the last byte written
+func (b *Backlog) Offset() int64 {
+	return b.offset
+}
+
+// FirstOffset returns the offset of the oldest byte held; with nothing
+// held it is one past Offset
+func (b *Backlog) FirstOffset() int64 {
+	return b.offset - int64(b.length) + 1
+}
+
+// Len returns how many bytes the backlog holds
+func (b *Backlog) Len() int {
+	return b.length
+}
+
+// Size returns the capacity of the backlog
+func (b *Backlog) Size() int {
+	return len(b.buf)
+}
+
+// ReadFrom returns a copy of the stream from offset to the end, reporting
+// false when the bytes starting at offset are no longer, or not yet, held
+func (b *Backlog) ReadFrom(offset int64) ([]byte, bool) {
+	if offset < b.FirstOffset() || offset > b.offset+1 {
+		return nil, false
+	}
+	skip := int(offset - b.FirstOffset())
+	data := make([]byte, b.length-skip)
+	from := (b.start + skip) % len(b.buf)
+	copied := copy(data, b.buf[from:min(from+len(data), len(b.buf))])
+	copy(data[copied:], b.buf)
+	return data, true
+}
+
+// Reset empties the backlog for a new history whose next byte will be at
+// offset+1
+func (b *Backlog) Reset(offset int64) {
+	b.start, b.length, b.offset = 0, 0, offset
+}
@@ -0,0 +1,65 @@
+package replication
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/leanovate/gopter"
+	"github.com/leanovate/gopter/gen"
+	"github.com/leanovate/gopter/prop"
+)
+
+// Property-based test setup for the replication backlog
+func TestBacklogMatchesStream(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	// For any writes, the backlog holds the tail of the stream that fits
+	// and returns it from any offset it still holds
+	properties.Property("backlog returns the tail of the stream", prop.ForAll(
+		func(size int, start int64, writes [][]byte) bool {
+			backlog := NewBacklog(size, start)
+			var stream []byte
+			for _, data := range writes {
+				backlog.Write(data)
+				stream = append(stream, data...)
+			}
+			held := min(len(stream), size)
+			if backlog.Offset() != start+int64(len(stream)) || backlog.Len() != held {
+				return false
+			}
+			for offset := backlog.FirstOffset(); offset <= backlog.Offset()+1; offset++ {
+				data, ok := backlog.ReadFrom(offset)
+				if !ok || !bytes.Equal(data, stream[len(stream)-int(backlog.Offset()-offset+1):]) {
+					return false
+				}
+			}
+			_, before := backlog.ReadFrom(backlog.FirstOffset() - 1)
+			_, after := backlog.ReadFrom(backlog.Offset() + 2)
+			return !before && !after
+		},
+		gen.IntRange(1, 64),
+		gen.Int64Range(0, 1<<40),
+		gen.SliceOf(gen.SliceOf(gen.UInt8())),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
+
+func TestBacklogReset(t *testing.T) {
+	backlog := NewBacklog(16, 0)
+	backlog.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+	backlog.Reset(100)
+	if backlog.Len() != 0 || backlog.FirstOffset() != 101 || backlog.Offset() != 100 {
+		t.Errorf("Unexpected backlog after reset: first %d, offset %d", backlog.FirstOffset(), backlog.Offset())
+	}
+	if data, ok := backlog.ReadFrom(101); !ok || len(data) != 0 {
+		t.Errorf("Expected an empty stream from the next offset, got %q, %v", data, ok)
+	}
+}
+
+func TestNewID(t *testing.T) {
+	first, second := NewID(), NewID()
+	if len(first) != IDLength || first == second || first == NoID {
+		t.Errorf("Unexpected replication IDs %q and %q", first, second)
+	}
+}
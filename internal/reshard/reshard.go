@@ -0,0 +1,256 @@
+// Package reshard moves hash slots between the nodes of a running cluster
+// without downtime. A slot moves the way Redis moves it: the receiving
+// node is set to import it and the serving node to migrate it, its keys
+// are copied over with MIGRATE in batches while clients are sent to
+// whichever node holds the key they ask for, and finally every node is
+// told the slot's new owner.
+package reshard
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"redis-like-server/internal/client"
+	"redis-like-server/internal/cluster"
+)
+
+// Move is the move of one slot from the node with ID From to the node with
+// ID To
+type Move struct {
+	Slot int
+	From string
+	To   string
+}
+
+// Options tunes a rebalance
+type Options struct {
+	// Timeout bounds every command sent to a node, MIGRATE's transfers and
+	// the wait for the nodes to agree on the new owners
+	Timeout time.Duration
+	// Batch is how many keys each MIGRATE moves
+	Batch int
+	// Log, when set, is called after every slot moved
+	Log func(move Move, keys int)
+}
+
+// LoadNodes returns the nodes of the cluster as the node c is connected to
+// sees them. A node that does not know its own host yet is reached at the
+// host c connected to.
+func LoadNodes(c *client.Client) ([]cluster.NodeLine, error) {
+	reply, err := c.Do("CLUSTER", "NODES")
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(c.Addr())
+	if err != nil {
+		return nil, err
+	}
+	var nodes []cluster.NodeLine
+	for _, text := range strings.Split(strings.TrimSpace(reply.Str), "\n") {
+		line, err := cluster.ParseNode(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CLUSTER NODES line %q: %w", text, err)
+		}
+		if line.Node.Host == "" {
+			line.Node.Host = host
+		}
+		nodes = append(nodes, line)
+	}
+	return nodes, nil
+}
+
+// Plan returns the moves that leave every node serving the same number of
+// slots, give or take one, moving as few slots as possible. The nodes that
+// already serve the most keep the spare slots, and donors give away their
+// highest slots, so the plan only depends on who serves what.
+func Plan(nodes []cluster.NodeLine) []Move {
+	type share struct {
+		id     string
+		slots  []int
+		target int
+	}
+	shares := make([]*share, len(nodes))
+	total := 0
+	for i, line := range nodes {
+		shares[i] = &share{id: line.Node.ID}
+		for _, r := range line.Ranges {
+			for slot := r.Start; slot <= r.End; slot++ {
+				shares[i].slots = append(shares[i].slots, slot)
+			}
+		}
+		sort.Ints(shares[i].slots)
+		total += len(shares[i].slots)
+	}
+	if len(shares) == 0 {
+		return nil
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		if len(shares[i].slots) != len(shares[j].slots) {
+			return len(shares[i].slots) > len(shares[j].slots)
+		}
+		return shares[i].id < shares[j].id
+	})
+	for i, s := range shares {
+		s.target = total / len(shares)
+		if i < total%len(shares) {
+			s.target++
+		}
+	}
+
+	var moves []Move
+	receiver := 0
+	for _, donor := range shares {
+		for len(donor.slots) > donor.target {
+			for len(shares[receiver].slots) >= shares[receiver].target {
+				receiver++
+			}
+			to := shares[receiver]
+			slot := donor.slots[len(donor.slots)-1]
+			donor.slots = donor.slots[:len(donor.slots)-1]
+			to.slots = append(to.slots, slot)
+			moves = append(moves, Move{Slot: slot, From: donor.id, To: to.id})
+		}
+	}
+	return moves
+}
+
+// Rebalance evens out the slots of the cluster the node at seed belongs
+// to, then waits until every node agrees on the new owners
+func Rebalance(seed string, opts Options) error {
+	if opts.Batch <= 0 {
+		opts.Batch = 100
+	}
+	c, err := client.Dial(seed, opts.Timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	nodes, err := LoadNodes(c)
+	if err != nil {
+		return err
+	}
+	for _, line := range nodes {
+		if len(line.Migrating) > 0 || len(line.Importing) > 0 {
+			return fmt.Errorf("node %s is already moving slots", line.Node.Addr())
+		}
+	}
+
+	clients := make(map[string]*client.Client)
+	for _, line := range nodes {
+		node, err := client.Dial(line.Node.Addr(), opts.Timeout)
+		if err != nil {
+			return fmt.Errorf("cannot connect to %s: %w", line.Node.Addr(), err)
+		}
+		defer node.Close()
+		clients[line.Node.ID] = node
+	}
+	for _, move := range Plan(nodes) {
+		keys, err := MoveSlot(clients, move, opts)
+		if err != nil {
+			return fmt.Errorf("moving slot %d: %w", move.Slot, err)
+		}
+		if opts.Log != nil {
+			opts.Log(move, keys)
+		}
+	}
+	return WaitForAgreement(clients, opts.Timeout)
+}
+
+// MoveSlot moves a slot and its keys, returning how many keys moved.
+// clients holds a connection to every node of the cluster by ID.
+func MoveSlot(clients map[string]*client.Client, move Move, opts Options) (int, error) {
+	source, target := clients[move.From], clients[move.To]
+	if source == nil || target == nil {
+		return 0, fmt.Errorf("no connection to node %s or %s", move.From, move.To)
+	}
+	slot := strconv.Itoa(move.Slot)
+	if _, err := target.Do("CLUSTER", "SETSLOT", slot, "IMPORTING", move.From); err != nil {
+		return 0, fmt.Errorf("%s: %w", target.Addr(), err)
+	}
+	if _, err := source.Do("CLUSTER", "SETSLOT", slot, "MIGRATING", move.To); err != nil {
+		return 0, fmt.Errorf("%s: %w", source.Addr(), err)
+	}
+
+	host, port, err := net.SplitHostPort(target.Addr())
+	if err != nil {
+		return 0, err
+	}
+	timeout := strconv.FormatInt(opts.Timeout.Milliseconds(), 10)
+	moved := 0
+	for {
+		reply, err := source.Do("CLUSTER", "GETKEYSINSLOT", slot, strconv.Itoa(opts.Batch))
+		if err != nil {
+			return moved, fmt.Errorf("%s: %w", source.Addr(), err)
+		}
+		if len(reply.Array) == 0 {
+			break
+		}
+		args := []string{host, port, "", "0", timeout, "KEYS"}
+		for _, key := range reply.Array {
+			args = append(args, key.Str)
+		}
+		if _, err := source.Do("MIGRATE", args...); err != nil {
+			return moved, fmt.Errorf("%s: %w", source.Addr(), err)
+		}
+		moved += len(reply.Array)
+	}
+
+	// The new owner learns first, so the keys stay reachable: until the old
+	// owner learns too, it keeps asking clients to go there
+	order := []*client.Client{target, source}
+	for id, c := range clients {
+		if id != move.From && id != move.To {
+			order = append(order, c)
+		}
+	}
+	for _, c := range order {
+		if _, err := c.Do("CLUSTER", "SETSLOT", slot, "NODE", move.To); err != nil {
+			return moved, fmt.Errorf("%s: %w", c.Addr(), err)
+		}
+	}
+	return moved, nil
+}
+
+// WaitForAgreement waits until every node sees the same owner for every
+// slot, or fails after timeout
+func WaitForAgreement(clients map[string]*client.Client, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		agreed, err := agree(clients)
+		if err != nil || agreed {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the nodes did not agree on the slots within %v", timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// agree reports whether every node sees the same owner for every slot
+func agree(clients map[string]*client.Client) (bool, error) {
+	var first map[string][]cluster.SlotRange
+	for _, c := range clients {
+		nodes, err := LoadNodes(c)
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", c.Addr(), err)
+		}
+		owners := make(map[string][]cluster.SlotRange)
+		for _, line := range nodes {
+			owners[line.Node.ID] = line.Ranges
+		}
+		if first == nil {
+			first = owners
+			continue
+		}
+		if !reflect.DeepEqual(owners, first) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,101 @@
+package reshard
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"redis-like-server/internal/cluster"
+
+	"github.com/leanovate/gopter"
+	"github.com/leanovate/gopter/gen"
+	"github.com/leanovate/gopter/prop"
+)
+
+// nodesOwning returns one node per share, serving the slots assigned to it
+func nodesOwning(owners []int, shares int) []cluster.NodeLine {
+	slots := make([][]int, shares)
+	for slot, owner := range owners {
+		if owner < shares {
+			slots[owner] = append(slots[owner], slot)
+		}
+	}
+	nodes := make([]cluster.NodeLine, shares)
+	for i := range nodes {
+		nodes[i] = cluster.NodeLine{
+			Node:   cluster.Node{ID: fmt.Sprintf("%040d", i)},
+			Ranges: cluster.Ranges(slots[i]),
+		}
+	}
+	return nodes
+}
+
+// Property-based test setup for rebalance plans
+func TestPlan(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	// For any assignment of slots, applying the plan leaves every node
+	// within one slot of the others, keeps every assigned slot assigned and
+	// moves no slot twice nor more slots than needed
+	properties.Property("plan evens out slots with few moves", prop.ForAll(
+		func(owners []int, shares int) bool {
+			nodes := nodesOwning(owners, shares)
+			moves := Plan(nodes)
+			if !reflect.DeepEqual(Plan(nodes), moves) {
+				return false
+			}
+
+			owner := make(map[int]string)
+			count := make(map[string]int)
+			for _, line := range nodes {
+				count[line.Node.ID] += 0
+				for _, r := range line.Ranges {
+					for slot := r.Start; slot <= r.End; slot++ {
+						owner[slot] = line.Node.ID
+						count[line.Node.ID]++
+					}
+				}
+			}
+			assigned := len(owner)
+			surplus := 0
+			for _, c := range count {
+				if excess := c - (assigned+shares-1)/shares; excess > 0 {
+					surplus += excess
+				}
+			}
+
+			moved := make(map[int]bool)
+			for _, move := range moves {
+				if moved[move.Slot] || owner[move.Slot] != move.From || move.From == move.To {
+					return false
+				}
+				moved[move.Slot] = true
+				owner[move.Slot] = move.To
+				count[move.From]--
+				count[move.To]++
+			}
+			low, high := assigned, 0
+			for _, c := range count {
+				low, high = min(low, c), max(high, c)
+			}
+			return len(owner) == assigned && high-low <= 1 && len(moves) <= surplus+shares
+		},
+		gen.SliceOfN(200, gen.IntRange(0, 5)),
+		gen.IntRange(1, 5),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
+
+func TestPlanBalancedCluster(t *testing.T) {
+	owners := make([]int, cluster.SlotCount)
+	for slot := range owners {
+		owners[slot] = slot * 3 / cluster.SlotCount
+	}
+	if moves := Plan(nodesOwning(owners, 3)); len(moves) != 0 {
+		t.Errorf("Expected no moves in a balanced cluster, got %d", len(moves))
+	}
+	if moves := Plan(nodesOwning(owners, 4)); len(moves) != cluster.SlotCount/4 {
+		t.Errorf("Expected a new node to receive %d slots, got %d", cluster.SlotCount/4, len(moves))
+	}
+}
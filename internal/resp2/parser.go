@@ -257,4 +257,14 @@ func (p *DefaultRESP2Parser) ParseCommand(value *RESPValue) (*Command, error) {
 	}
 	
 	return cmd, nil
-}
\ No newline at end of file
+}
+// NewCommandValue builds the RESP2 array used to send a command: the command
+// name followed by its arguments, all as bulk strings
+func NewCommandValue(name string, args []string) *RESPValue {
+	elements := make([]RESPValue, 0, len(args)+1)
+	elements = append(elements, RESPValue{Type: BulkString, Str: name})
+	for _, arg := range args {
+		elements = append(elements, RESPValue{Type: BulkString, Str: arg})
+	}
+	return &RESPValue{Type: Array, Array: elements}
+}
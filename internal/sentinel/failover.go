@@ -0,0 +1,486 @@
+package sentinel
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A master that does not answer pings for its down after period is
+// subjectively down to the sentinel that pings it. That sentinel asks the
+// others whether they agree, and once at least the quorum of them do the
+// master is objectively down: the sentinel starts a failover in a new
+// epoch and asks the others for their vote. The sentinel voted for by a
+// majority of the sentinels, and by at least the quorum, promotes the best
+// replica, tells the other replicas to replicate it and announces the new
+// master with the epoch it was elected in; the other sentinels follow the
+// announcement with the greatest epoch.
+
+const (
+	// maxDesync is how much a sentinel randomly delays failovers, so
+	// sentinels that agree a master is down do not all try at once
+	maxDesync = 1000
+	// maxElectionTimeout bounds how long a sentinel waits to be elected
+	maxElectionTimeout = 10 * time.Second
+	// reconfigureDelay is how long a replica must report a wrong master
+	// before it is told the right one, leaving time for the announcement
+	// of a new master to spread
+	reconfigureDelay = 4 * HelloPeriod
+)
+
+// ActionKind is what an action asks the server to do
+type ActionKind int
+
+const (
+	// ActionAsk asks the sentinel Target, with SENTINEL
+	// IS-MASTER-DOWN-BY-ADDR, whether it sees the master down and, unless
+	// RunID is "*", for its vote to fail it over in Epoch
+	ActionAsk ActionKind = iota
+	// ActionPromote turns the replica Target into a master
+	ActionPromote
+	// ActionReplicate makes Target a replica of MasterAddr
+	ActionReplicate
+)
+
+// Action is a command for the server to send to an instance
+type Action struct {
+	Kind       ActionKind
+	MasterName string
+	MasterAddr Addr
+	Target     Addr
+	// SentinelID is the run ID of the sentinel asked, and RunID the one
+	// of the sentinel to vote for or "*"
+	SentinelID string
+	RunID      string
+	Epoch      uint64
+}
+
+// Cron flags the instances that are down, agrees with the other sentinels
+// whether the masters are, and moves failovers forward. It returns what
+// the server must send the instances.
+func (s *State) Cron(now time.Time) []Action {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	nowMs := now.UnixMilli()
+	var actions []Action
+	for _, m := range s.sortedMasters() {
+		downAfter := m.DownAfter.Milliseconds()
+		s.checkDown(&m.Instance, m, nowMs, downAfter)
+		for _, r := range m.replicas {
+			s.checkDown(r, m, nowMs, downAfter)
+		}
+		for _, r := range m.sentinels {
+			s.checkDown(r, m, nowMs, downAfter)
+		}
+		s.checkObjectivelyDown(m, nowMs)
+
+		if m.SDown && nowMs-m.lastAsk >= PingPeriod.Milliseconds() {
+			m.lastAsk = nowMs
+			runID, epoch := "*", s.currentEpoch
+			if m.Failover != FailoverNone {
+				runID, epoch = s.myID, m.FailoverEpoch
+			}
+			for _, r := range m.sentinels {
+				actions = append(actions, Action{
+					Kind:       ActionAsk,
+					MasterName: m.Name,
+					MasterAddr: m.Addr,
+					Target:     r.Addr,
+					SentinelID: r.RunID,
+					RunID:      runID,
+					Epoch:      epoch,
+				})
+			}
+		}
+		actions = append(actions, s.failoverStep(m, nowMs)...)
+		if m.Failover == FailoverNone && !m.SDown {
+			actions = append(actions, s.fixReplicas(m, nowMs)...)
+		}
+	}
+	return actions
+}
+
+// sortedMasters returns the masters ordered by name; the caller must hold
+// the mutex
+func (s *State) sortedMasters() []*master {
+	masters := make([]*master, 0, len(s.masters))
+	for _, m := range s.masters {
+		masters = append(masters, m)
+	}
+	sort.Slice(masters, func(i, j int) bool { return masters[i].Name < masters[j].Name })
+	return masters
+}
+
+// checkDown flags an instance of a master as subjectively down when its
+// oldest unanswered ping is older than the down after period, and clears
+// the flag once it answers
+func (s *State) checkDown(i *Instance, m *master, nowMs, downAfter int64) {
+	down := i.PingSent != 0 && nowMs-i.PingSent > downAfter
+	if down == i.SDown {
+		return
+	}
+	i.SDown = down
+	kind := "+sdown"
+	if !down {
+		kind = "-sdown"
+	}
+	switch {
+	case i == &m.Instance:
+		s.event(kind, m.describe())
+	case i.RunID != "":
+		s.event(kind, describeSentinel(i, m))
+	default:
+		s.event(kind, describeReplica(i.Addr, m))
+	}
+}
+
+// checkObjectivelyDown flags a master as objectively down while at least
+// the quorum of sentinels, this one included, recently said it is down
+func (s *State) checkObjectivelyDown(m *master, nowMs int64) {
+	down := false
+	if m.SDown {
+		count := 1
+		for _, r := range m.sentinels {
+			if r.DownReported && nowMs-r.RepliedAt <= 5*PingPeriod.Milliseconds() {
+				count++
+			}
+		}
+		down = count >= m.Quorum
+		if down && !m.ODown {
+			s.event("+odown", m.describe(), fmt.Sprintf("#quorum %d/%d", count, m.Quorum))
+			// Sentinels that see the master down at once would all vote for
+			// themselves: the first to try a failover gets the others' votes
+			m.odownSince = nowMs + rand.Int63n(maxDesync)
+		}
+	}
+	if !down && m.ODown {
+		s.event("-odown", m.describe())
+	}
+	m.ODown = down
+}
+
+// DownReply records the reply of a sentinel asked about a master: whether
+// it sees it down and the sentinel it voted for
+func (s *State) DownReply(name, sentinelID string, down bool, leader string, leaderEpoch uint64, now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m, known := s.masters[name]
+	if !known {
+		return
+	}
+	r, known := m.sentinels[sentinelID]
+	if !known {
+		return
+	}
+	r.DownReported, r.RepliedAt = down, now.UnixMilli()
+	if leader != "*" {
+		r.Leader, r.LeaderEpoch = leader, leaderEpoch
+	}
+}
+
+// IsMasterDownByAddr answers another sentinel asking about the master at
+// an address: whether this sentinel sees it down and, when runID is not
+// "*", the sentinel it votes for to fail it over in epoch. A sentinel
+// votes once per epoch, for the first sentinel that asks.
+func (s *State) IsMasterDownByAddr(addr Addr, epoch uint64, runID string, now time.Time) (bool, string, uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, m := range s.sortedMasters() {
+		if m.Addr != addr {
+			continue
+		}
+		if runID == "*" {
+			return m.SDown, "*", 0
+		}
+		leader, leaderEpoch := s.vote(m, epoch, runID, now.UnixMilli())
+		return m.SDown, leader, leaderEpoch
+	}
+	return false, "*", 0
+}
+
+// vote votes for a sentinel to fail a master over in epoch unless this
+// sentinel already voted in it, and returns the vote it holds; the caller
+// must hold the mutex
+func (s *State) vote(m *master, epoch uint64, runID string, nowMs int64) (string, uint64) {
+	s.updateEpoch(epoch)
+	if m.LeaderEpoch < epoch && s.currentEpoch <= epoch {
+		m.Leader, m.LeaderEpoch = runID, s.currentEpoch
+		s.event("+vote-for-leader", runID, strconv.FormatUint(s.currentEpoch, 10))
+		// Leave the other sentinel time to fail the master over
+		if runID != s.myID {
+			m.failoverStart = nowMs + rand.Int63n(maxDesync)
+		}
+	}
+	return m.Leader, m.LeaderEpoch
+}
+
+// leader returns the sentinel elected to fail a master over in epoch, or
+// "" while none has the votes of a majority of the sentinels and of at
+// least the quorum. This sentinel votes for the one most voted for, or
+// for itself. The caller must hold the mutex.
+func (s *State) leader(m *master, epoch uint64, nowMs int64) string {
+	votes := make(map[string]int)
+	for _, r := range m.sentinels {
+		if r.Leader != "" && r.LeaderEpoch == epoch {
+			votes[r.Leader]++
+		}
+	}
+	candidate := s.myID
+	if winner, _ := mostVoted(votes); winner != "" {
+		candidate = winner
+	}
+	if myVote, voteEpoch := s.vote(m, epoch, candidate, nowMs); voteEpoch == epoch {
+		votes[myVote]++
+	}
+
+	winner, count := mostVoted(votes)
+	voters := len(m.sentinels) + 1
+	if count < voters/2+1 || count < m.Quorum {
+		return ""
+	}
+	return winner
+}
+
+// mostVoted returns the sentinel with the most votes and its votes, the
+// smallest run ID winning ties
+func mostVoted(votes map[string]int) (string, int) {
+	winner, most := "", 0
+	for id, count := range votes {
+		if count > most || count == most && id < winner {
+			winner, most = id, count
+		}
+	}
+	return winner, most
+}
+
+// failoverStep moves the failover of a master forward; the caller must
+// hold the mutex
+func (s *State) failoverStep(m *master, nowMs int64) []Action {
+	timeout := m.FailoverTimeout.Milliseconds()
+	elapsed := nowMs - m.stateChanged
+	switch m.Failover {
+	case FailoverNone:
+		if !m.ODown || nowMs < m.odownSince || nowMs < m.failoverStart+2*timeout {
+			return nil
+		}
+		s.currentEpoch++
+		s.event("+new-epoch", strconv.FormatUint(s.currentEpoch, 10))
+		s.event("+try-failover", m.describe())
+		m.FailoverEpoch = s.currentEpoch
+		m.failoverStart = nowMs + rand.Int63n(maxDesync)
+		m.lastAsk = 0
+		s.setFailover(m, FailoverWaitStart, nowMs)
+
+	case FailoverWaitStart:
+		leader := s.myID
+		if !m.forced {
+			leader = s.leader(m, m.FailoverEpoch, nowMs)
+		}
+		if leader == s.myID {
+			s.event("+elected-leader", m.describe())
+			s.setFailover(m, FailoverSelectReplica, nowMs)
+			return s.failoverStep(m, nowMs)
+		}
+		if elapsed > min(maxElectionTimeout.Milliseconds(), timeout) {
+			s.abortFailover(m, "-failover-abort-not-elected")
+		}
+
+	case FailoverSelectReplica:
+		replica := s.selectReplica(m, nowMs)
+		if replica == nil {
+			s.abortFailover(m, "-failover-abort-no-good-slave")
+			return nil
+		}
+		m.promoted = replica.String()
+		s.event("+selected-slave", describeReplica(replica.Addr, m))
+		s.event("+failover-state-send-slaveof-noone", describeReplica(replica.Addr, m))
+		s.setFailover(m, FailoverWaitPromotion, nowMs)
+		return []Action{{Kind: ActionPromote, MasterName: m.Name, MasterAddr: m.Addr, Target: replica.Addr}}
+
+	case FailoverWaitPromotion:
+		promoted := m.replicas[m.promoted]
+		if promoted != nil && promoted.Role.Master && promoted.RoleAt > m.stateChanged {
+			m.ConfigEpoch = m.FailoverEpoch
+			s.event("+promoted-slave", describeReplica(promoted.Addr, m))
+			s.event("+failover-state-reconf-slaves", m.describe())
+			s.setFailover(m, FailoverReconfigReplicas, nowMs)
+			return s.failoverStep(m, nowMs)
+		}
+		if promoted == nil || elapsed > timeout {
+			s.abortFailover(m, "-failover-abort-slave-timeout")
+		}
+
+	case FailoverReconfigReplicas:
+		promoted := m.replicas[m.promoted].Addr
+		var actions []Action
+		done := true
+		for _, r := range m.sortedReplicas() {
+			if r.Addr == promoted || r.SDown {
+				continue
+			}
+			if !r.Role.Master && r.Role.MasterAddr == promoted && r.RoleAt > m.stateChanged {
+				continue
+			}
+			done = false
+			if r.reconfSent < m.stateChanged {
+				r.reconfSent = nowMs
+				s.event("+slave-reconf-sent", describeReplica(r.Addr, m))
+				actions = append(actions, Action{Kind: ActionReplicate, MasterName: m.Name, MasterAddr: promoted, Target: r.Addr})
+			}
+		}
+		if done || elapsed > timeout {
+			if done {
+				s.event("+failover-end", m.describe())
+			} else {
+				s.event("+failover-end-for-timeout", m.describe())
+			}
+			s.switchMaster(m, promoted, nowMs)
+		}
+		return actions
+	}
+	return nil
+}
+
+// setFailover moves a failover to a step; the caller must hold the mutex
+func (s *State) setFailover(m *master, state FailoverState, nowMs int64) {
+	m.Failover, m.stateChanged = state, nowMs
+}
+
+// abortFailover gives a failover up; the caller must hold the mutex
+func (s *State) abortFailover(m *master, kind string) {
+	s.event(kind, m.describe())
+	m.Failover, m.forced, m.promoted = FailoverNone, false, ""
+}
+
+// selectReplica returns the replica of a master to promote, or nil when
+// none is fit: among the replicas that answer and report being a replica,
+// the one with the greatest replication offset, the smallest address
+// winning ties. The caller must hold the mutex.
+func (s *State) selectReplica(m *master, nowMs int64) *Instance {
+	recent := 5 * PingPeriod.Milliseconds()
+	var best *Instance
+	for _, r := range m.sortedReplicas() {
+		if r.SDown || r.RoleAt == 0 || r.Role.Master || nowMs-r.LastPong > recent || nowMs-r.RoleAt > recent {
+			continue
+		}
+		if best == nil || r.Role.Offset > best.Role.Offset {
+			best = r
+		}
+	}
+	return best
+}
+
+// sortedReplicas returns the replicas of a master ordered by address
+func (m *master) sortedReplicas() []*Instance {
+	replicas := make([]*Instance, 0, len(m.replicas))
+	for _, r := range m.replicas {
+		replicas = append(replicas, r)
+	}
+	sort.Slice(replicas, func(i, j int) bool { return replicas[i].String() < replicas[j].String() })
+	return replicas
+}
+
+// switchMaster makes the instance at addr the master monitored under the
+// name, the previous master and its other replicas becoming its replicas.
+// The caller must hold the mutex.
+func (s *State) switchMaster(m *master, addr Addr, nowMs int64) {
+	old := m.Addr
+	s.event("+switch-master", m.Name, old.Host, strconv.Itoa(old.Port), addr.Host, strconv.Itoa(addr.Port))
+
+	replicas := make(map[string]*Instance)
+	for _, r := range m.replicas {
+		if r.Addr != addr {
+			replicas[r.String()] = &Instance{Addr: r.Addr}
+		}
+	}
+	if old != addr {
+		replicas[old.String()] = &Instance{Addr: old}
+	}
+	m.replicas = replicas
+	m.Instance = Instance{Addr: addr, LastPong: nowMs}
+	m.ODown, m.forced, m.promoted = false, false, ""
+	m.Failover = FailoverNone
+	for _, r := range m.sentinels {
+		r.DownReported = false
+	}
+	for _, r := range m.sortedReplicas() {
+		s.event("+slave", describeReplica(r.Addr, m))
+	}
+}
+
+// fixReplicas tells the replicas of a healthy master that report being a
+// master or replicating another one to replicate it, once they have done
+// so for long enough to rule out a failover this sentinel has not heard
+// of yet; the caller must hold the mutex
+func (s *State) fixReplicas(m *master, nowMs int64) []Action {
+	delay := reconfigureDelay.Milliseconds()
+	var actions []Action
+	for _, r := range m.sortedReplicas() {
+		if r.SDown || r.RoleAt == 0 || !r.Role.Master && r.Role.MasterAddr == m.Addr {
+			continue
+		}
+		if nowMs-r.RoleSince < delay || nowMs-r.reconfSent < delay {
+			continue
+		}
+		r.reconfSent = nowMs
+		if r.Role.Master {
+			s.event("+convert-to-slave", describeReplica(r.Addr, m))
+		} else {
+			s.event("+fix-slave-config", describeReplica(r.Addr, m))
+		}
+		actions = append(actions, Action{Kind: ActionReplicate, MasterName: m.Name, MasterAddr: m.Addr, Target: r.Addr})
+	}
+	return actions
+}
+
+// Failover starts failing a master over at once, without asking the other
+// sentinels, as SENTINEL FAILOVER does
+func (s *State) Failover(name string, now time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m, known := s.masters[name]
+	if !known {
+		return errNoMaster
+	}
+	if m.Failover != FailoverNone {
+		return fmt.Errorf("INPROG Failover already in progress")
+	}
+	nowMs := now.UnixMilli()
+	if s.selectReplica(m, nowMs) == nil {
+		return fmt.Errorf("NOGOODSLAVE No suitable replica to promote")
+	}
+	s.currentEpoch++
+	s.event("+new-epoch", strconv.FormatUint(s.currentEpoch, 10))
+	s.event("+try-failover", m.describe())
+	m.FailoverEpoch, m.forced, m.failoverStart = s.currentEpoch, true, nowMs
+	s.setFailover(m, FailoverWaitStart, nowMs)
+	return nil
+}
+
+// CheckQuorum reports whether enough sentinels monitoring a master answer
+// to agree it is down and elect one of them to fail it over, returning how
+// many do, this one included
+func (s *State) CheckQuorum(name string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m, known := s.masters[name]
+	if !known {
+		return 0, errNoMaster
+	}
+	usable := 1
+	for _, r := range m.sentinels {
+		if !r.SDown {
+			usable++
+		}
+	}
+	voters := len(m.sentinels) + 1
+	if usable < m.Quorum {
+		return usable, fmt.Errorf("NOQUORUM %d usable Sentinels. Not enough available Sentinels to reach the specified quorum for this master", usable)
+	}
+	if usable < voters/2+1 {
+		return usable, fmt.Errorf("NOQUORUM %d usable Sentinels. Not enough available Sentinels to reach the majority and authorize a failover", usable)
+	}
+	return usable, nil
+}
@@ -0,0 +1,563 @@
+// Package sentinel holds the view a sentinel has of the masters it
+// monitors, their replicas and the other sentinels monitoring them, and
+// decides, as Redis Sentinel does, when a master is down and how to fail
+// it over. It does no I/O: the server probes the instances, reports what
+// they answer and carries out the actions Cron returns.
+package sentinel
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// PingPeriod is how often a sentinel pings every instance it knows and
+	// asks masters and replicas for their role
+	PingPeriod = time.Second
+	// HelloPeriod is how often a sentinel announces itself and its view of
+	// a master on the hello channel of the master and its replicas
+	HelloPeriod = 2 * time.Second
+	// HelloChannel is the channel sentinels announce themselves on
+	HelloChannel = "__sentinel__:hello"
+)
+
+// Addr is the address of an instance
+type Addr struct {
+	Host string
+	Port int
+}
+
+// String returns the address as host:port
+func (a Addr) String() string {
+	return net.JoinHostPort(a.Host, strconv.Itoa(a.Port))
+}
+
+// ParseAddr parses a host and a port
+func ParseAddr(host, port string) (Addr, error) {
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 65535 {
+		return Addr{}, fmt.Errorf("invalid port %q", port)
+	}
+	return Addr{Host: host, Port: p}, nil
+}
+
+// Role is what a master or replica reports of its role in ROLE
+type Role struct {
+	Master bool
+	// Replicas are the replicas a master is feeding
+	Replicas []Addr
+	// MasterAddr is the master a replica replicates, and LinkUp whether it
+	// is connected to it
+	MasterAddr Addr
+	LinkUp     bool
+	Offset     int64
+}
+
+// Instance is a master, replica or sentinel as seen by this sentinel
+type Instance struct {
+	Addr
+	// RunID identifies a sentinel
+	RunID string
+	// PingSent is when the oldest unanswered ping was sent and LastPong
+	// when the instance last answered one, in Unix milliseconds
+	PingSent int64
+	LastPong int64
+	// SDown is set while the instance does not answer within the down
+	// after period of its master: subjectively down, to this sentinel
+	SDown bool
+
+	// Role is the role a master or replica reported last, at RoleAt, and
+	// RoleSince when it started reporting that one; RoleAt is 0 until
+	// it reported any
+	Role      Role
+	RoleAt    int64
+	RoleSince int64
+
+	// DownReported is whether a sentinel replied that it sees the master
+	// down, at RepliedAt, and Leader the sentinel it voted for to fail it
+	// over in LeaderEpoch
+	DownReported bool
+	RepliedAt    int64
+	Leader       string
+	LeaderEpoch  uint64
+
+	// reconfSent is when this sentinel last told a replica which master
+	// to replicate
+	reconfSent int64
+}
+
+// FailoverState is the step a failover of a master is at
+type FailoverState string
+
+// The steps of a failover, named as in Redis
+const (
+	FailoverNone             FailoverState = "none"
+	FailoverWaitStart        FailoverState = "wait_start"
+	FailoverSelectReplica    FailoverState = "select_slave"
+	FailoverWaitPromotion    FailoverState = "wait_promotion"
+	FailoverReconfigReplicas FailoverState = "reconf_slaves"
+)
+
+// Master is a monitored master with its replicas and the other sentinels
+// monitoring it
+type Master struct {
+	Instance
+	Name            string
+	Quorum          int
+	DownAfter       time.Duration
+	FailoverTimeout time.Duration
+	// ConfigEpoch is the epoch of the failover that made the instance the
+	// master, 0 for the one configured
+	ConfigEpoch uint64
+	// ODown is set while at least Quorum sentinels see the master down:
+	// objectively down
+	ODown bool
+
+	Failover      FailoverState
+	FailoverEpoch uint64
+	// Leader is the sentinel this one voted for in LeaderEpoch to fail the
+	// master over
+	Leader      string
+	LeaderEpoch uint64
+
+	// Replicas are ordered by address and Sentinels by run ID
+	Replicas  []Instance
+	Sentinels []Instance
+}
+
+// Event is a change a sentinel publishes on the channel named after Type,
+// as in Redis
+type Event struct {
+	Type    string
+	Message string
+}
+
+// master is the state of a monitored master
+type master struct {
+	Master
+	replicas  map[string]*Instance
+	sentinels map[string]*Instance
+
+	// forced is set for a failover started by SENTINEL FAILOVER, which
+	// needs no agreement; promoted is the address of the replica being
+	// promoted
+	forced   bool
+	promoted string
+	// failoverStart is when the last failover attempt started, or was
+	// left to another sentinel, and stateChanged when it reached its
+	// current step, in Unix milliseconds; lastAsk is when the other
+	// sentinels were last asked about the master, and odownSince when it
+	// was found objectively down, randomly delayed
+	failoverStart int64
+	stateChanged  int64
+	lastAsk       int64
+	odownSince    int64
+}
+
+// State is the view a sentinel has of the masters it monitors. It is safe
+// for concurrent use; Master values it returns are copies.
+type State struct {
+	mutex        sync.Mutex
+	myID         string
+	currentEpoch uint64
+	masters      map[string]*master
+	events       []Event
+}
+
+// NewState returns the state of a sentinel with the given run ID,
+// monitoring nothing yet
+func NewState(myID string) *State {
+	return &State{myID: myID, masters: make(map[string]*master)}
+}
+
+// MyID returns the run ID of this sentinel
+func (s *State) MyID() string {
+	return s.myID
+}
+
+// CurrentEpoch returns the greatest epoch this sentinel knows of
+func (s *State) CurrentEpoch() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.currentEpoch
+}
+
+// Monitor starts monitoring a master under a name
+func (s *State) Monitor(name string, addr Addr, quorum int, downAfter, failoverTimeout time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, known := s.masters[name]; known {
+		return fmt.Errorf("Duplicated master name")
+	}
+	if quorum <= 0 {
+		return fmt.Errorf("Quorum must be 1 or greater.")
+	}
+	if downAfter <= 0 || failoverTimeout <= 0 {
+		return fmt.Errorf("Invalid timeout")
+	}
+	m := &master{
+		Master: Master{
+			Instance:        Instance{Addr: addr},
+			Name:            name,
+			Quorum:          quorum,
+			DownAfter:       downAfter,
+			FailoverTimeout: failoverTimeout,
+			Failover:        FailoverNone,
+		},
+		replicas:  make(map[string]*Instance),
+		sentinels: make(map[string]*Instance),
+	}
+	s.masters[name] = m
+	s.event("+monitor", m.describe(), "quorum", strconv.Itoa(quorum))
+	return nil
+}
+
+// Remove stops monitoring a master
+func (s *State) Remove(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m, known := s.masters[name]
+	if !known {
+		return errNoMaster
+	}
+	delete(s.masters, name)
+	s.event("-monitor", m.describe())
+	return nil
+}
+
+// Set changes an option of a monitored master: quorum,
+// down-after-milliseconds or failover-timeout
+func (s *State) Set(name, option, value string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m, known := s.masters[name]
+	if !known {
+		return errNoMaster
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("Invalid argument '%s' for SENTINEL SET '%s'", value, option)
+	}
+	switch strings.ToLower(option) {
+	case "quorum":
+		m.Quorum = n
+	case "down-after-milliseconds":
+		m.DownAfter = time.Duration(n) * time.Millisecond
+	case "failover-timeout":
+		m.FailoverTimeout = time.Duration(n) * time.Millisecond
+	default:
+		return fmt.Errorf("Invalid argument '%s' to SENTINEL SET", option)
+	}
+	return nil
+}
+
+// errNoMaster is the error for a master this sentinel does not monitor
+var errNoMaster = fmt.Errorf("No such master with that name")
+
+// Master returns the master monitored under a name
+func (s *State) Master(name string) (Master, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m, known := s.masters[name]
+	if !known {
+		return Master{}, errNoMaster
+	}
+	return m.snapshot(), nil
+}
+
+// Masters returns every monitored master, ordered by name
+func (s *State) Masters() []Master {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	masters := make([]Master, 0, len(s.masters))
+	for _, m := range s.masters {
+		masters = append(masters, m.snapshot())
+	}
+	sort.Slice(masters, func(i, j int) bool { return masters[i].Name < masters[j].Name })
+	return masters
+}
+
+// snapshot returns a copy of the master with its replicas and sentinels
+func (m *master) snapshot() Master {
+	snapshot := m.Master
+	snapshot.Replicas = make([]Instance, 0, len(m.replicas))
+	for _, r := range m.replicas {
+		snapshot.Replicas = append(snapshot.Replicas, *r)
+	}
+	sort.Slice(snapshot.Replicas, func(i, j int) bool {
+		return snapshot.Replicas[i].String() < snapshot.Replicas[j].String()
+	})
+	snapshot.Sentinels = make([]Instance, 0, len(m.sentinels))
+	for _, r := range m.sentinels {
+		snapshot.Sentinels = append(snapshot.Sentinels, *r)
+	}
+	sort.Slice(snapshot.Sentinels, func(i, j int) bool {
+		return snapshot.Sentinels[i].RunID < snapshot.Sentinels[j].RunID
+	})
+	return snapshot
+}
+
+// Target is an instance the server keeps probing
+type Target struct {
+	Addr
+	// Sentinel is set for other sentinels, which are only pinged
+	Sentinel bool
+}
+
+// Targets returns every instance to probe, ordered by address
+func (s *State) Targets() []Target {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	seen := make(map[Addr]bool)
+	var targets []Target
+	add := func(addr Addr, sentinel bool) {
+		if !seen[addr] {
+			seen[addr] = true
+			targets = append(targets, Target{Addr: addr, Sentinel: sentinel})
+		}
+	}
+	for _, m := range s.masters {
+		add(m.Addr, false)
+		for _, r := range m.replicas {
+			add(r.Addr, false)
+		}
+	}
+	for _, m := range s.masters {
+		for _, r := range m.sentinels {
+			add(r.Addr, true)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].String() < targets[j].String() })
+	return targets
+}
+
+// Monitors reports whether an instance is still to be probed
+func (s *State) Monitors(target Target) bool {
+	for _, t := range s.Targets() {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+// instances calls f for every instance at an address; the caller must
+// hold the mutex
+func (s *State) instances(addr Addr, f func(m *master, i *Instance)) {
+	for _, m := range s.masters {
+		if m.Addr == addr {
+			f(m, &m.Instance)
+		}
+		for _, r := range m.replicas {
+			if r.Addr == addr {
+				f(m, r)
+			}
+		}
+		for _, r := range m.sentinels {
+			if r.Addr == addr {
+				f(m, r)
+			}
+		}
+	}
+}
+
+// PingSent records that an instance was pinged; an instance is down once
+// its oldest unanswered ping is too old
+func (s *State) PingSent(addr Addr, now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.instances(addr, func(m *master, i *Instance) {
+		if i.PingSent == 0 {
+			i.PingSent = now.UnixMilli()
+		}
+	})
+}
+
+// Pong records that an instance answered a ping
+func (s *State) Pong(addr Addr, now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.instances(addr, func(m *master, i *Instance) {
+		i.PingSent, i.LastPong = 0, now.UnixMilli()
+	})
+}
+
+// SetRole records the role a master or replica reported. A master's
+// replicas join the ones this sentinel knows.
+func (s *State) SetRole(addr Addr, role Role, now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	nowMs := now.UnixMilli()
+	s.instances(addr, func(m *master, i *Instance) {
+		if i.RunID != "" {
+			return
+		}
+		if i.RoleAt == 0 || i.Role.Master != role.Master || i.Role.MasterAddr != role.MasterAddr {
+			i.RoleSince = nowMs
+		}
+		i.Role, i.RoleAt = role, nowMs
+		if i != &m.Instance || !role.Master {
+			return
+		}
+		for _, replica := range role.Replicas {
+			if _, known := m.replicas[replica.String()]; !known && replica != m.Addr {
+				m.replicas[replica.String()] = &Instance{Addr: replica}
+				s.event("+slave", describeReplica(replica, m))
+			}
+		}
+	})
+}
+
+// Hello is the announcement a sentinel publishes on the hello channel of
+// a master and its replicas: its own address and run ID, and the address
+// of the master with the epoch of its configuration
+type Hello struct {
+	Addr
+	RunID        string
+	CurrentEpoch uint64
+	MasterName   string
+	MasterAddr   Addr
+	ConfigEpoch  uint64
+}
+
+// String returns the announcement as published
+func (h Hello) String() string {
+	return strings.Join([]string{
+		h.Host, strconv.Itoa(h.Port), h.RunID, strconv.FormatUint(h.CurrentEpoch, 10),
+		h.MasterName, h.MasterAddr.Host, strconv.Itoa(h.MasterAddr.Port), strconv.FormatUint(h.ConfigEpoch, 10),
+	}, ",")
+}
+
+// ParseHello parses an announcement
+func ParseHello(message string) (Hello, error) {
+	fields := strings.Split(message, ",")
+	if len(fields) != 8 {
+		return Hello{}, fmt.Errorf("invalid hello message %q", message)
+	}
+	addr, err := ParseAddr(fields[0], fields[1])
+	if err != nil {
+		return Hello{}, err
+	}
+	masterAddr, err := ParseAddr(fields[5], fields[6])
+	if err != nil {
+		return Hello{}, err
+	}
+	currentEpoch, err := strconv.ParseUint(fields[3], 10, 64)
+	if err != nil {
+		return Hello{}, fmt.Errorf("invalid epoch %q", fields[3])
+	}
+	configEpoch, err := strconv.ParseUint(fields[7], 10, 64)
+	if err != nil {
+		return Hello{}, fmt.Errorf("invalid epoch %q", fields[7])
+	}
+	return Hello{
+		Addr:         addr,
+		RunID:        fields[2],
+		CurrentEpoch: currentEpoch,
+		MasterName:   fields[4],
+		MasterAddr:   masterAddr,
+		ConfigEpoch:  configEpoch,
+	}, nil
+}
+
+// Hellos returns the announcements of this sentinel to publish on an
+// instance, one per master it belongs to; the server fills in the address
+// of the sentinel
+func (s *State) Hellos(addr Addr) []Hello {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var hellos []Hello
+	for _, m := range s.masters {
+		if _, replica := m.replicas[addr.String()]; m.Addr != addr && !replica {
+			continue
+		}
+		hellos = append(hellos, Hello{
+			RunID:        s.myID,
+			CurrentEpoch: s.currentEpoch,
+			MasterName:   m.Name,
+			MasterAddr:   m.Addr,
+			ConfigEpoch:  m.ConfigEpoch,
+		})
+	}
+	sort.Slice(hellos, func(i, j int) bool { return hellos[i].MasterName < hellos[j].MasterName })
+	return hellos
+}
+
+// ProcessHello applies the announcement of a sentinel: the sentinel joins
+// the ones monitoring the master, and a configuration of the master newer
+// than this sentinel's replaces it, which is how the sentinels that did
+// not run a failover learn about the new master
+func (s *State) ProcessHello(hello Hello, now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m, known := s.masters[hello.MasterName]
+	if hello.RunID == s.myID || !known {
+		return
+	}
+
+	peer, known := m.sentinels[hello.RunID]
+	if !known {
+		// A sentinel restarted with a new run ID replaces the old one
+		for id, r := range m.sentinels {
+			if r.Addr == hello.Addr {
+				delete(m.sentinels, id)
+			}
+		}
+		peer = &Instance{Addr: hello.Addr, RunID: hello.RunID}
+		m.sentinels[hello.RunID] = peer
+		s.event("+sentinel", describeSentinel(peer, m))
+	}
+	peer.Addr = hello.Addr
+
+	s.updateEpoch(hello.CurrentEpoch)
+	if hello.ConfigEpoch > m.ConfigEpoch {
+		m.ConfigEpoch = hello.ConfigEpoch
+		if hello.MasterAddr != m.Addr {
+			s.event("+config-update-from", describeSentinel(peer, m))
+			s.switchMaster(m, hello.MasterAddr, now.UnixMilli())
+		}
+	}
+}
+
+// updateEpoch moves this sentinel to a greater epoch it heard of; the
+// caller must hold the mutex
+func (s *State) updateEpoch(epoch uint64) {
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+		s.event("+new-epoch", strconv.FormatUint(epoch, 10))
+	}
+}
+
+// Events returns the events that happened since the last call
+func (s *State) Events() []Event {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	events := s.events
+	s.events = nil
+	return events
+}
+
+// event records an event; the caller must hold the mutex
+func (s *State) event(kind string, fields ...string) {
+	s.events = append(s.events, Event{Type: kind, Message: strings.Join(fields, " ")})
+}
+
+// describe names the master in events
+func (m *master) describe() string {
+	return fmt.Sprintf("master %s %s %d", m.Name, m.Host, m.Port)
+}
+
+// describeReplica names a replica of a master in events
+func describeReplica(addr Addr, m *master) string {
+	return fmt.Sprintf("slave %s %s %d @ %s %s %d", addr, addr.Host, addr.Port, m.Name, m.Host, m.Port)
+}
+
+// describeSentinel names a sentinel monitoring a master in events
+func describeSentinel(r *Instance, m *master) string {
+	return fmt.Sprintf("sentinel %s %s %d @ %s %s %d", r.RunID, r.Host, r.Port, m.Name, m.Host, m.Port)
+}
@@ -0,0 +1,313 @@
+package sentinel
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leanovate/gopter"
+	"github.com/leanovate/gopter/gen"
+	"github.com/leanovate/gopter/prop"
+)
+
+// Property-based test setup for hello messages
+func TestHelloProperties(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	// For any announcement, parsing what is published gives it back
+	properties.Property("hello messages round-trip", prop.ForAll(
+		func(host, runID, name string, port, masterPort int, currentEpoch, configEpoch uint64) bool {
+			hello := Hello{
+				Addr:         Addr{Host: host, Port: port},
+				RunID:        runID,
+				CurrentEpoch: currentEpoch,
+				MasterName:   name,
+				MasterAddr:   Addr{Host: host, Port: masterPort},
+				ConfigEpoch:  configEpoch,
+			}
+			parsed, err := ParseHello(hello.String())
+			return err == nil && parsed == hello
+		},
+		gen.Identifier(),
+		gen.Identifier(),
+		gen.Identifier(),
+		gen.IntRange(1, 65535),
+		gen.IntRange(1, 65535),
+		gen.UInt64(),
+		gen.UInt64(),
+	))
+
+	properties.TestingRun(t)
+}
+
+func TestParseHelloErrors(t *testing.T) {
+	for _, message := range []string{
+		"",
+		"127.0.0.1,26379,id,0,mymaster,127.0.0.1,6379",
+		"127.0.0.1,port,id,0,mymaster,127.0.0.1,6379,0",
+		"127.0.0.1,26379,id,-1,mymaster,127.0.0.1,6379,0",
+		"127.0.0.1,26379,id,0,mymaster,127.0.0.1,0,0",
+		"127.0.0.1,26379,id,0,mymaster,127.0.0.1,6379,epoch",
+	} {
+		if _, err := ParseHello(message); err == nil {
+			t.Errorf("ParseHello(%q) succeeded", message)
+		}
+	}
+}
+
+var (
+	masterAddr = Addr{Host: "10.0.0.1", Port: 6379}
+	replicaA   = Addr{Host: "10.0.0.2", Port: 6379}
+	replicaB   = Addr{Host: "10.0.0.3", Port: 6379}
+)
+
+// newSentinels returns sentinels monitoring the same master that heard
+// each other's announcements
+func newSentinels(t *testing.T, count int, now time.Time) []*State {
+	sentinels := make([]*State, count)
+	for i := range sentinels {
+		sentinels[i] = NewState(strings.Repeat(string(rune('a'+i)), 40))
+		if err := sentinels[i].Monitor("mymaster", masterAddr, 2, time.Second, 3*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, s := range sentinels {
+		for i, other := range sentinels {
+			for _, hello := range other.Hellos(masterAddr) {
+				hello.Addr = Addr{Host: "10.0.1.1", Port: 26379 + i}
+				s.ProcessHello(hello, now)
+			}
+		}
+	}
+	return sentinels
+}
+
+// deliver carries the questions of a sentinel to the others and their
+// replies back, returning the other actions
+func deliver(from *State, actions []Action, sentinels []*State, now time.Time) []Action {
+	var rest []Action
+	for _, action := range actions {
+		if action.Kind != ActionAsk {
+			rest = append(rest, action)
+			continue
+		}
+		for _, to := range sentinels {
+			if to.MyID() == action.SentinelID {
+				down, leader, epoch := to.IsMasterDownByAddr(action.MasterAddr, action.Epoch, action.RunID, now)
+				from.DownReply(action.MasterName, action.SentinelID, down, leader, epoch, now)
+			}
+		}
+	}
+	return rest
+}
+
+// hasEvent reports whether events hold one of the given type and message
+func hasEvent(events []Event, kind, message string) bool {
+	for _, event := range events {
+		if event.Type == kind && event.Message == message {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFailover(t *testing.T) {
+	t0 := time.Unix(1700000000, 0)
+	at := func(ms int) time.Time { return t0.Add(time.Duration(ms) * time.Millisecond) }
+	sentinels := newSentinels(t, 3, t0)
+	a, b, c := sentinels[0], sentinels[1], sentinels[2]
+
+	// Every sentinel learns about the replicas from the master
+	for _, s := range sentinels {
+		for _, addr := range []Addr{masterAddr, replicaA, replicaB} {
+			s.PingSent(addr, t0)
+			s.Pong(addr, t0)
+		}
+		s.SetRole(masterAddr, Role{Master: true, Replicas: []Addr{replicaA, replicaB}}, t0)
+		s.SetRole(replicaA, Role{MasterAddr: masterAddr, LinkUp: true, Offset: 100}, t0)
+		s.SetRole(replicaB, Role{MasterAddr: masterAddr, LinkUp: true, Offset: 200}, t0)
+		master, err := s.Master("mymaster")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(master.Replicas) != 2 || len(master.Sentinels) != 2 {
+			t.Fatalf("replicas %v, sentinels %v", master.Replicas, master.Sentinels)
+		}
+		if _, err := s.CheckQuorum("mymaster"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !hasEvent(a.Events(), "+slave", "slave 10.0.0.3:6379 10.0.0.3 6379 @ mymaster 10.0.0.1 6379") {
+		t.Error("missing +slave event")
+	}
+
+	// The master stops answering while the replicas keep going
+	probe := func(ms int) {
+		for _, s := range sentinels {
+			for _, addr := range []Addr{masterAddr, replicaA, replicaB} {
+				s.PingSent(addr, at(ms))
+			}
+			for _, addr := range []Addr{replicaA, replicaB} {
+				s.Pong(addr, at(ms))
+			}
+		}
+	}
+	probe(500)
+	if actions := a.Cron(at(1400)); len(actions) != 0 {
+		t.Fatalf("actions before the master is down: %v", actions)
+	}
+	probe(1600)
+	b.Cron(at(1600))
+	c.Cron(at(1600))
+	deliver(a, a.Cron(at(1600)), sentinels, at(1600))
+	master, _ := a.Master("mymaster")
+	if !master.SDown || master.ODown {
+		t.Fatalf("sdown %v odown %v", master.SDown, master.ODown)
+	}
+
+	// Two sentinels agree, which is the quorum. After a random delay that
+	// keeps sentinels from starting together, the first to try a failover
+	// gets elected
+	deliver(a, a.Cron(at(1700)), sentinels, at(1700))
+	if master, _ = a.Master("mymaster"); !master.ODown {
+		t.Fatal("master not objectively down")
+	}
+	deliver(a, a.Cron(at(2700)), sentinels, at(2700))
+	if master, _ = a.Master("mymaster"); !master.ODown || master.Failover != FailoverWaitStart || master.FailoverEpoch != 1 {
+		t.Fatalf("odown %v, failover %s in epoch %d", master.ODown, master.Failover, master.FailoverEpoch)
+	}
+	deliver(a, a.Cron(at(2800)), sentinels, at(2800))
+	if master, _ = b.Master("mymaster"); master.Leader != a.MyID() || master.LeaderEpoch != 1 {
+		t.Fatalf("b voted for %q in %d", master.Leader, master.LeaderEpoch)
+	}
+	// A sentinel votes once per epoch
+	if _, leader, _ := b.IsMasterDownByAddr(masterAddr, 1, c.MyID(), at(2800)); leader != a.MyID() {
+		t.Fatalf("b changed its vote to %q", leader)
+	}
+
+	// The elected sentinel promotes the replica with the most data
+	actions := a.Cron(at(2900))
+	if want := []Action{{Kind: ActionPromote, MasterName: "mymaster", MasterAddr: masterAddr, Target: replicaB}}; !reflect.DeepEqual(actions, want) {
+		t.Fatalf("actions %+v, want %+v", actions, want)
+	}
+	a.Pong(replicaB, at(3000))
+	a.SetRole(replicaB, Role{Master: true}, at(3000))
+	actions = a.Cron(at(3000))
+	if want := []Action{{Kind: ActionReplicate, MasterName: "mymaster", MasterAddr: replicaB, Target: replicaA}}; !reflect.DeepEqual(actions, want) {
+		t.Fatalf("actions %+v, want %+v", actions, want)
+	}
+	a.SetRole(replicaA, Role{MasterAddr: replicaB, LinkUp: true, Offset: 200}, at(3100))
+	a.Cron(at(3100))
+	master, _ = a.Master("mymaster")
+	if master.Addr != replicaB || master.ConfigEpoch != 1 || master.Failover != FailoverNone {
+		t.Fatalf("master %s in epoch %d, failover %s", master.Addr, master.ConfigEpoch, master.Failover)
+	}
+	if len(master.Replicas) != 2 || master.Replicas[0].Addr != masterAddr || master.Replicas[1].Addr != replicaA {
+		t.Fatalf("replicas %v", master.Replicas)
+	}
+	if !hasEvent(a.Events(), "+switch-master", "mymaster 10.0.0.1 6379 10.0.0.3 6379") {
+		t.Error("missing +switch-master event")
+	}
+
+	// The other sentinels follow the announcement of the new master
+	for _, hello := range a.Hellos(replicaB) {
+		hello.Addr = Addr{Host: "10.0.1.1", Port: 26379}
+		b.ProcessHello(hello, at(3200))
+	}
+	if master, _ = b.Master("mymaster"); master.Addr != replicaB || master.ConfigEpoch != 1 {
+		t.Fatalf("b follows %s in epoch %d", master.Addr, master.ConfigEpoch)
+	}
+	if b.CurrentEpoch() != 1 {
+		t.Errorf("b is in epoch %d", b.CurrentEpoch())
+	}
+
+	// The old master comes back as a master and is turned into a replica
+	// once it had time to hear of the failover
+	a.PingSent(masterAddr, at(4000))
+	a.Pong(masterAddr, at(4000))
+	a.SetRole(masterAddr, Role{Master: true}, at(4000))
+	for _, action := range a.Cron(at(4100)) {
+		if action.Kind == ActionReplicate {
+			t.Fatalf("old master reconfigured too early: %+v", action)
+		}
+	}
+	ms := 4000 + int(reconfigureDelay.Milliseconds()) + 100
+	a.PingSent(replicaB, at(ms))
+	a.Pong(replicaB, at(ms))
+	a.PingSent(replicaA, at(ms))
+	a.Pong(replicaA, at(ms))
+	a.PingSent(masterAddr, at(ms))
+	a.Pong(masterAddr, at(ms))
+	actions = a.Cron(at(ms))
+	if want := []Action{{Kind: ActionReplicate, MasterName: "mymaster", MasterAddr: replicaB, Target: masterAddr}}; !reflect.DeepEqual(actions, want) {
+		t.Fatalf("actions %+v, want %+v", actions, want)
+	}
+}
+
+func TestFailoverNotElected(t *testing.T) {
+	t0 := time.Unix(1700000000, 0)
+	sentinels := newSentinels(t, 3, t0)
+	a := sentinels[0]
+	a.PingSent(masterAddr, t0)
+
+	// Alone in seeing the master down, a sentinel below the quorum does not
+	// try a failover
+	now := t0.Add(1500 * time.Millisecond)
+	deliver(a, a.Cron(now), sentinels, now)
+	deliver(a, a.Cron(now.Add(100*time.Millisecond)), sentinels, now)
+	master, _ := a.Master("mymaster")
+	if !master.SDown || master.ODown || master.Failover != FailoverNone {
+		t.Fatalf("sdown %v odown %v failover %s", master.SDown, master.ODown, master.Failover)
+	}
+
+	// With a quorum of 1 it tries, but the other sentinels cannot be
+	// reached to make a majority
+	if err := a.Set("mymaster", "quorum", "1"); err != nil {
+		t.Fatal(err)
+	}
+	a.Cron(now.Add(200 * time.Millisecond))
+	a.Cron(now.Add(1200 * time.Millisecond))
+	if master, _ = a.Master("mymaster"); master.Failover != FailoverWaitStart {
+		t.Fatalf("failover %s", master.Failover)
+	}
+	a.Cron(now.Add(2300 * time.Millisecond))
+	a.Cron(now.Add(5 * time.Second))
+	if master, _ = a.Master("mymaster"); master.Failover != FailoverNone {
+		t.Fatalf("failover %s", master.Failover)
+	}
+	if !hasEvent(a.Events(), "-failover-abort-not-elected", "master mymaster 10.0.0.1 6379") {
+		t.Error("missing -failover-abort-not-elected event")
+	}
+}
+
+func TestMonitorErrors(t *testing.T) {
+	s := NewState(strings.Repeat("a", 40))
+	if err := s.Monitor("mymaster", masterAddr, 2, time.Second, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Monitor("mymaster", replicaA, 2, time.Second, time.Second); err == nil {
+		t.Error("monitored the same name twice")
+	}
+	if err := s.Monitor("other", replicaA, 0, time.Second, time.Second); err == nil {
+		t.Error("monitored with a quorum of 0")
+	}
+	if err := s.Set("mymaster", "down-after-milliseconds", "500"); err != nil {
+		t.Error(err)
+	}
+	if err := s.Set("mymaster", "parallel-syncs", "1"); err == nil {
+		t.Error("set an unknown option")
+	}
+	if err := s.Failover("mymaster", time.Now()); err == nil || !strings.HasPrefix(err.Error(), "NOGOODSLAVE") {
+		t.Errorf("failover without replicas: %v", err)
+	}
+	if _, err := s.CheckQuorum("mymaster"); err == nil {
+		t.Error("quorum of 2 reached alone")
+	}
+	if err := s.Remove("mymaster"); err != nil {
+		t.Error(err)
+	}
+	if _, err := s.Master("mymaster"); err == nil {
+		t.Error("removed master still monitored")
+	}
+}
@@ -0,0 +1,475 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"redis-like-server/internal/connection"
+	"redis-like-server/internal/crdt"
+	"redis-like-server/internal/handler"
+	"redis-like-server/internal/rdb"
+	"redis-like-server/internal/replication"
+	"redis-like-server/internal/resp2"
+	"redis-like-server/internal/store"
+)
+
+const (
+	// peerPingPeriod is how often an active-active instance sends its
+	// clock to the peers following it, which also tells them the link is
+	// alive
+	peerPingPeriod = time.Second
+	// peerTimeout is how long an instance waits on a silent peer before
+	// dropping the link
+	peerTimeout = 10 * time.Second
+	// crdtRewriteMinOps is how many operations are appended to the state
+	// file before it is worth rewriting
+	crdtRewriteMinOps = 1000
+)
+
+// peerLinks holds the links of an active-active instance. Every instance
+// dials each of its peers and is sent the operations it misses, then every
+// new one; the operations are queued on the links of the peers following
+// this instance by the writes, under writeMutex.
+type peerLinks struct {
+	mutex sync.Mutex
+	// following are the peers that dialed this instance, and status the
+	// state of the links this instance dialed, by peer address
+	following map[*peerLink]struct{}
+	status    map[string]string
+
+	// file is the state file, appended to under writeMutex; appended
+	// counts the operations added since it was last rewritten
+	file     *os.File
+	appended int
+}
+
+// peerLink is a peer following this instance's operations. The stream is
+// queued on a replica link, written by its own goroutine.
+type peerLink struct {
+	id   string
+	link *replicaLink
+}
+
+// crdtFilePath returns the path of the active-active state file
+func (s *Server) crdtFilePath() string {
+	file := s.config.ActiveActiveFile
+	if file == "" {
+		file = "crdt.conf"
+	}
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(s.config.Dir, file)
+}
+
+// loadActiveActive loads the replicated state, or starts a new replica
+// when there is none, and brings the dataset in line with it. Keys the
+// state does not know about, as when a dataset is turned active-active,
+// are recorded as writes of this instance so the peers get them too.
+func (s *Server) loadActiveActive() error {
+	data, err := os.ReadFile(s.crdtFilePath())
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		s.crdt = crdt.NewState(replication.NewID())
+		fmt.Printf("No active-active state found, I'm %s\n", s.crdt.MyID())
+	case err != nil:
+		return err
+	default:
+		if s.crdt, err = crdt.Unmarshal(data); err != nil {
+			return fmt.Errorf("invalid active-active state %s: %w", s.crdtFilePath(), err)
+		}
+		fmt.Printf("Active-active state loaded, I'm %s\n", s.crdt.MyID())
+	}
+
+	s.peers = &peerLinks{following: make(map[*peerLink]struct{}), status: make(map[string]string)}
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	known := make(map[string]bool)
+	for _, op := range s.crdt.Winners() {
+		known[op.Key] = true
+		s.applyOp(op)
+	}
+	view := s.store.View()
+	view.Range(func(key string, item store.Item) bool {
+		if !known[key] {
+			s.crdt.Local(crdt.OpSet, key, item.Value, item.ExpireAt, time.Now())
+		}
+		return true
+	})
+	err = view.Err()
+	view.Release()
+	if err != nil {
+		return err
+	}
+	return s.rewriteCrdtFile()
+}
+
+// rewriteCrdtFile compacts the state file down to the state and reopens
+// it for appending; the caller must hold writeMutex
+func (s *Server) rewriteCrdtFile() error {
+	path := s.crdtFilePath()
+	data := s.crdt.Marshal()
+	if err := writeFileAtomic(path+".tmp", path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if s.peers.file != nil {
+		s.peers.file.Close()
+	}
+	s.peers.file, s.peers.appended = file, 0
+	return nil
+}
+
+// appendCrdtFile adds a line to the state file; the caller must hold
+// writeMutex
+func (s *Server) appendCrdtFile(line string) {
+	if _, err := s.peers.file.WriteString(line); err != nil {
+		fmt.Printf("Error writing the active-active state: %v\n", err)
+	}
+	s.peers.appended++
+}
+
+// startActiveActive dials the peers once the client listener is up
+func (s *Server) startActiveActive() {
+	for _, addr := range s.config.ActiveActivePeers {
+		s.wg.Add(1)
+		go s.runPeerLink(strings.TrimSpace(addr))
+	}
+	s.wg.Add(1)
+	go s.activeActiveCron()
+}
+
+// activeActiveCron sends the clock to the peers following this instance,
+// drops the tombstones every peer saw and compacts the state file once it
+// grew enough
+func (s *Server) activeActiveCron() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(peerPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.writeMutex.Lock()
+		clock := s.parser.Serialize(resp2.NewCommandValue("CRDT.CLOCK", []string{s.crdt.Clock().String()}))
+		s.peers.mutex.Lock()
+		for peer := range s.peers.following {
+			peer.link.send(clock)
+		}
+		s.peers.mutex.Unlock()
+		s.crdt.Collect()
+		if s.peers.appended >= max(crdtRewriteMinOps, s.crdt.Len()) {
+			if err := s.rewriteCrdtFile(); err != nil {
+				fmt.Printf("Error rewriting the active-active state: %v\n", err)
+			}
+		}
+		s.writeMutex.Unlock()
+	}
+}
+
+// recordWrite records the keys a write command changed as operations of
+// this instance and sends them to the peers; the caller must hold
+// writeMutex
+func (s *Server) recordWrite(cmd *resp2.Command) {
+	for _, key := range handler.CommandKeys(cmd) {
+		var op crdt.Op
+		if value, exists := s.store.Get(key); exists {
+			expireAt, _ := s.store.ExpireAt(key)
+			op = s.crdt.Local(crdt.OpSet, key, value, expireAt, time.Now())
+		} else {
+			op = s.crdt.Local(crdt.OpDelete, key, "", 0, time.Now())
+		}
+		s.appendCrdtFile(op.Line())
+		s.feedPeers(op, "")
+	}
+}
+
+// recordPeerClock records the clock a peer reported, which tombstones wait
+// for; the caller must hold writeMutex
+func (s *Server) recordPeerClock(id string, clock crdt.Clock) {
+	if s.crdt.SetPeerClock(id, clock) {
+		s.appendCrdtFile(crdt.PeerLine(id, clock))
+	}
+}
+
+// applyPeerOp applies an operation received from the peer with ID from,
+// passing it on to the other peers when it wins its key
+func (s *Server) applyPeerOp(op crdt.Op, from string) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	fresh, wins := s.crdt.Apply(op)
+	if !fresh {
+		return
+	}
+	s.appendCrdtFile(op.Line())
+	if wins {
+		s.applyOp(op)
+		s.feedPeers(op, from)
+	}
+}
+
+// applyOp makes the dataset agree with an operation that won its key,
+// logging and replicating the change like any write; the caller must hold
+// writeMutex
+func (s *Server) applyOp(op crdt.Op) {
+	value, exists := s.store.Get(op.Key)
+	expireAt, _ := s.store.ExpireAt(op.Key)
+	var cmd *resp2.Command
+	switch {
+	case op.Kind == crdt.OpDelete && !exists:
+		return
+	case op.Kind == crdt.OpDelete:
+		cmd = &resp2.Command{Name: "DEL", Args: []string{op.Key}}
+	case exists && value == op.Value && expireAt == op.ExpireAt:
+		return
+	case op.ExpireAt == 0:
+		cmd = &resp2.Command{Name: "SET", Args: []string{op.Key, op.Value}}
+	default:
+		payload, err := rdb.Dump(rdb.Entry{Type: rdb.TypeString, Value: op.Value})
+		if err != nil {
+			fmt.Printf("Error applying the operation of peer %s on %q: %v\n", op.Replica, op.Key, err)
+			return
+		}
+		cmd = &resp2.Command{Name: "RESTORE", Args: []string{op.Key, strconv.FormatInt(op.ExpireAt, 10), string(payload), "REPLACE", "ABSTTL"}}
+	}
+	if response := s.handler.Execute(cmd); response.Type == resp2.Error {
+		fmt.Printf("Error applying %s from peer %s: %s\n", cmd.Name, op.Replica, response.Str)
+		return
+	}
+	s.propagate(cmd)
+}
+
+// feedPeers queues an operation on the links of the peers following this
+// instance, except the one it came from and the one that made it; the
+// caller must hold writeMutex
+func (s *Server) feedPeers(op crdt.Op, from string) {
+	data := s.parser.Serialize(resp2.NewCommandValue("CRDT.OP", op.Args()))
+	s.peers.mutex.Lock()
+	defer s.peers.mutex.Unlock()
+	for peer := range s.peers.following {
+		if peer.id != from && peer.id != op.Replica {
+			peer.link.send(data)
+		}
+	}
+}
+
+// handleCrdtSync handles CRDT.SYNC id clock, with which a peer starts
+// following this instance: it is sent the operations its clock does not
+// cover, then this instance's clock, then every new operation
+func (s *Server) handleCrdtSync(clientConn *connection.ClientConnection, args []string) *resp2.RESPValue {
+	if s.crdt == nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR This instance has active-active mode disabled"}
+	}
+	if len(args) != 2 {
+		return wrongArgs("CRDT.SYNC")
+	}
+	clock, err := crdt.ParseClock(args[1])
+	if err != nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: fmt.Sprintf("ERR Invalid clock: %v", err)}
+	}
+	if clientConn.IsReplica() {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR Peer already synchronizing"}
+	}
+	// Like a replica, a peer stays silent while it is sent the stream
+	clientConn.SetReplica()
+
+	// The missing operations and the clock are taken together under
+	// writeMutex, and every later operation is queued after them
+	s.writeMutex.Lock()
+	s.recordPeerClock(args[0], clock)
+	peer := &peerLink{id: args[0], link: newReplicaLink(clientConn, 0, replicaOnline, 0)}
+	peer.link.send(s.parser.Serialize(&resp2.RESPValue{Type: resp2.SimpleString, Str: s.crdt.MyID()}))
+	missing := s.crdt.Missing(clock)
+	for _, op := range missing {
+		peer.link.send(s.parser.Serialize(resp2.NewCommandValue("CRDT.OP", op.Args())))
+	}
+	peer.link.send(s.parser.Serialize(resp2.NewCommandValue("CRDT.CLOCK", []string{s.crdt.Clock().String()})))
+	s.peers.mutex.Lock()
+	s.peers.following[peer] = struct{}{}
+	s.peers.mutex.Unlock()
+	s.writeMutex.Unlock()
+
+	fmt.Printf("Peer %s is following, sending %d operations\n", peer.id, len(missing))
+	s.wg.Add(1)
+	go s.servePeer(peer)
+	return nil
+}
+
+// servePeer writes the operations queued for a peer until its link closes
+func (s *Server) servePeer(peer *peerLink) {
+	defer s.wg.Done()
+	defer s.removePeer(peer.link.conn)
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-peer.link.wake:
+		}
+		data, closed := peer.link.take()
+		if closed {
+			return
+		}
+		if len(data) > 0 && peer.link.conn.Write(data) != nil {
+			peer.link.conn.GetConn().Close()
+			return
+		}
+	}
+}
+
+// removePeer forgets a peer that disconnected
+func (s *Server) removePeer(clientConn *connection.ClientConnection) {
+	if s.peers == nil {
+		return
+	}
+	s.peers.mutex.Lock()
+	defer s.peers.mutex.Unlock()
+	for peer := range s.peers.following {
+		if peer.link.conn == clientConn {
+			delete(s.peers.following, peer)
+			peer.link.close()
+		}
+	}
+}
+
+// setPeerStatus records the state of the link dialed to a peer
+func (s *Server) setPeerStatus(addr, status string) {
+	s.peers.mutex.Lock()
+	defer s.peers.mutex.Unlock()
+	s.peers.status[addr] = status
+}
+
+// runPeerLink keeps this instance following the peer at addr,
+// reconnecting after failures until the server stops
+func (s *Server) runPeerLink(addr string) {
+	defer s.wg.Done()
+	for {
+		err := s.followPeer(addr)
+		if s.ctx.Err() != nil {
+			return
+		}
+		s.setPeerStatus(addr, "down")
+		fmt.Printf("Lost the link to peer %s: %v\n", addr, err)
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(replRetryDelay):
+		}
+	}
+}
+
+// followPeer connects to a peer, asks for the operations this instance
+// misses and applies them and the following ones until the connection
+// fails or the server stops
+func (s *Server) followPeer(addr string) error {
+	s.setPeerStatus(addr, "connecting")
+	dialer := net.Dialer{Timeout: peerTimeout}
+	conn, err := dialer.DialContext(s.ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(s.ctx, func() { conn.Close() })
+	defer stop()
+
+	reader := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(peerTimeout))
+	if _, err := conn.Write(s.parser.Serialize(resp2.NewCommandValue("CRDT.SYNC", []string{s.crdt.MyID(), s.crdt.Clock().String()}))); err != nil {
+		return err
+	}
+	reply, err := s.parser.Parse(reader)
+	if err != nil {
+		return err
+	}
+	if reply.Type != resp2.SimpleString {
+		return fmt.Errorf("CRDT.SYNC: %s", reply.Str)
+	}
+	peerID := reply.Str
+	if peerID == s.crdt.MyID() {
+		return fmt.Errorf("the peer is this instance")
+	}
+	s.setPeerStatus(addr, "up")
+	fmt.Printf("Following peer %s at %s\n", peerID, addr)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(peerTimeout))
+		value, err := s.parser.Parse(reader)
+		if err != nil {
+			return err
+		}
+		cmd, err := s.parser.ParseCommand(value)
+		if err != nil {
+			return fmt.Errorf("protocol error in the peer stream: %w", err)
+		}
+		switch {
+		case cmd.Name == "CRDT.OP":
+			op, err := crdt.ParseOp(cmd.Args)
+			if err != nil {
+				return fmt.Errorf("invalid operation from peer: %w", err)
+			}
+			s.applyPeerOp(op, peerID)
+		case cmd.Name == "CRDT.CLOCK" && len(cmd.Args) == 1:
+			// Only the clock the peer sends after its operations raises
+			// this instance's, so a stream cut short leaves it covering
+			// only what was received
+			clock, err := crdt.ParseClock(cmd.Args[0])
+			if err != nil {
+				return fmt.Errorf("invalid clock from peer: %w", err)
+			}
+			s.writeMutex.Lock()
+			if s.crdt.MergeClock(clock) {
+				s.appendCrdtFile(crdt.ClockLine(clock))
+			}
+			s.recordPeerClock(peerID, clock)
+			s.writeMutex.Unlock()
+		default:
+			return fmt.Errorf("unexpected %s in the peer stream", cmd.Name)
+		}
+	}
+}
+
+// infoActiveActive renders the ActiveActive section
+func (s *Server) infoActiveActive() []string {
+	if s.crdt == nil {
+		return []string{"active_active_enabled:0"}
+	}
+	lines := []string{
+		"active_active_enabled:1",
+		fmt.Sprintf("active_active_id:%s", s.crdt.MyID()),
+		fmt.Sprintf("active_active_clock:%s", s.crdt.Clock()),
+		fmt.Sprintf("active_active_keys:%d", s.crdt.Len()),
+		fmt.Sprintf("active_active_known_peers:%d", len(s.crdt.Peers())),
+	}
+	s.peers.mutex.Lock()
+	defer s.peers.mutex.Unlock()
+	lines = append(lines, fmt.Sprintf("connected_peers:%d", len(s.peers.following)))
+	addrs := make([]string, 0, len(s.peers.status))
+	for addr := range s.peers.status {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for i, addr := range addrs {
+		lines = append(lines, fmt.Sprintf("peer%d:addr=%s,link=%s", i, addr, s.peers.status[addr]))
+	}
+	return lines
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"redis-like-server/internal/resp2"
+)
+
+// handleHello handles HELLO [protover [AUTH username password] [SETNAME
+// clientname]], the handshake client libraries start with. Only RESP2 is
+// spoken, so asking for RESP3 gets NOPROTO and the client goes on in
+// RESP2, as with a server too old to know HELLO. There are no passwords, as
+// with Redis' default user, and client names are not kept.
+func (s *Server) handleHello(args []string) *resp2.RESPValue {
+	if len(args) > 0 {
+		version, err := strconv.Atoi(args[0])
+		if err != nil {
+			return &resp2.RESPValue{Type: resp2.Error, Str: "ERR Protocol version is not an integer or out of range"}
+		}
+		if version != 2 {
+			return &resp2.RESPValue{Type: resp2.Error, Str: "NOPROTO sorry, this protocol version is not supported."}
+		}
+		for i := 1; i < len(args); i++ {
+			switch option := strings.ToUpper(args[i]); {
+			case option == "AUTH" && i+2 < len(args):
+				i += 2
+			case option == "SETNAME" && i+1 < len(args):
+				i++
+			default:
+				return &resp2.RESPValue{Type: resp2.Error, Str: fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i])}
+			}
+		}
+	}
+
+	role := "master"
+	if s.isReplica() {
+		role = "replica"
+	}
+	fields := []resp2.RESPValue{
+		{Type: resp2.BulkString, Str: "server"}, {Type: resp2.BulkString, Str: "redis"},
+		{Type: resp2.BulkString, Str: "version"}, {Type: resp2.BulkString, Str: redisVersion},
+		{Type: resp2.BulkString, Str: "proto"}, {Type: resp2.Integer, Int: 2},
+		{Type: resp2.BulkString, Str: "mode"}, {Type: resp2.BulkString, Str: s.mode()},
+		{Type: resp2.BulkString, Str: "role"}, {Type: resp2.BulkString, Str: role},
+		{Type: resp2.BulkString, Str: "modules"}, {Type: resp2.Array, Array: []resp2.RESPValue{}},
+	}
+	return &resp2.RESPValue{Type: resp2.Array, Array: fields}
+}
+
+// handleClient handles CLIENT SETINFO LIB-NAME|LIB-VER value, which client
+// libraries send after the handshake; the library is accepted but not kept
+func (s *Server) handleClient(args []string) *resp2.RESPValue {
+	if len(args) == 0 {
+		return wrongArgs("CLIENT")
+	}
+	switch strings.ToUpper(args[0]) {
+	case "SETINFO":
+		if len(args) != 3 {
+			return wrongArgs("CLIENT|SETINFO")
+		}
+		attribute := strings.ToLower(args[1])
+		if attribute != "lib-name" && attribute != "lib-ver" {
+			return &resp2.RESPValue{Type: resp2.Error, Str: fmt.Sprintf("ERR Unrecognized option '%s'", args[1])}
+		}
+		if strings.ContainsAny(args[2], " \r\n") {
+			return &resp2.RESPValue{Type: resp2.Error, Str: fmt.Sprintf("ERR %s cannot contain spaces, newlines or special characters.", attribute)}
+		}
+		return &resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"}
+	default:
+		return &resp2.RESPValue{Type: resp2.Error, Str: fmt.Sprintf("ERR unknown subcommand '%s'. Try CLIENT HELP.", args[0])}
+	}
+}
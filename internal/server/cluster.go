@@ -0,0 +1,852 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"redis-like-server/internal/cluster"
+	"redis-like-server/internal/connection"
+	"redis-like-server/internal/handler"
+	"redis-like-server/internal/resp2"
+)
+
+const (
+	// clusterPingPeriod is how often a node pings every other node when
+	// nothing changed, unless half the node timeout is shorter
+	clusterPingPeriod = time.Second
+	// clusterCronPeriod is how often a node checks for nodes it has no
+	// link to yet, for failed nodes and for failovers to run
+	clusterCronPeriod = 100 * time.Millisecond
+	// DefaultClusterNodeTimeout is how long a node may stay silent on the
+	// cluster bus before it is flagged as failing
+	DefaultClusterNodeTimeout = 15 * time.Second
+	// clusterRetryDelay is how long a link waits before reconnecting
+	clusterRetryDelay = time.Second
+	// clusterOutboxSize bounds the messages other than pings queued on a
+	// link; more are dropped, as when the link is down
+	clusterOutboxSize = 16
+)
+
+// clusterBus is the cluster bus of a node: the listener other nodes
+// connect to and one outgoing link per known node
+type clusterBus struct {
+	listener net.Listener
+
+	mutex sync.Mutex
+	links map[string]*busLink
+
+	sent     atomic.Int64
+	received atomic.Int64
+}
+
+// busLink pings one node; wake makes it ping at once, so configuration
+// changes spread without waiting for the next period, and outbox holds the
+// other messages to send the node
+type busLink struct {
+	id     string
+	wake   chan struct{}
+	outbox chan *cluster.Message
+}
+
+// notify wakes the link
+func (l *busLink) notify() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// send queues a message for the node, dropping it when the queue is full
+func (l *busLink) send(message *cluster.Message) {
+	select {
+	case l.outbox <- message:
+	default:
+	}
+}
+
+// clusterConfigPath returns the path of the nodes configuration file
+func (s *Server) clusterConfigPath() string {
+	file := s.config.ClusterConfigFile
+	if file == "" {
+		file = "nodes.conf"
+	}
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(s.config.Dir, file)
+}
+
+// clusterBusPort returns the port the cluster bus listens on: the
+// configured one, or the client port plus 10000, or any free port when the
+// client port is itself picked at random
+func (s *Server) clusterBusPort() int {
+	if s.config.ClusterPort != 0 || s.config.Port == 0 {
+		return s.config.ClusterPort
+	}
+	return s.config.Port + cluster.BusPortOffset
+}
+
+// loadClusterConfig loads the nodes configuration file, or starts a new
+// node alone in its cluster when there is none
+func (s *Server) loadClusterConfig() error {
+	data, err := os.ReadFile(s.clusterConfigPath())
+	if errors.Is(err, os.ErrNotExist) {
+		s.cluster = cluster.NewState(cluster.Node{})
+		fmt.Printf("No cluster configuration found, I'm %s\n", s.cluster.MyID())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if s.cluster, err = cluster.Unmarshal(data); err != nil {
+		return fmt.Errorf("invalid cluster configuration %s: %w", s.clusterConfigPath(), err)
+	}
+	fmt.Printf("Node configuration loaded, I'm %s\n", s.cluster.MyID())
+	return nil
+}
+
+// saveClusterConfig writes the nodes configuration file
+func (s *Server) saveClusterConfig() {
+	s.clusterSaveMutex.Lock()
+	defer s.clusterSaveMutex.Unlock()
+	path := s.clusterConfigPath()
+	data := s.cluster.Marshal()
+	err := writeFileAtomic(path+".tmp", path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		fmt.Printf("Error saving the cluster configuration: %v\n", err)
+	}
+}
+
+// startCluster opens the cluster bus once the client listener is up
+func (s *Server) startCluster() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.clusterBusPort()))
+	if err != nil {
+		return fmt.Errorf("failed to start the cluster bus on port %d: %w", s.clusterBusPort(), err)
+	}
+	s.bus = &clusterBus{listener: listener, links: make(map[string]*busLink)}
+	s.cluster.SetMyPorts(s.listener.Addr().(*net.TCPAddr).Port, listener.Addr().(*net.TCPAddr).Port)
+	s.saveClusterConfig()
+
+	s.wg.Add(2)
+	go s.acceptBusConnections()
+	go s.clusterCron()
+	return nil
+}
+
+// clusterChanged saves the configuration and pings every node with it
+func (s *Server) clusterChanged() {
+	s.saveClusterConfig()
+	s.bus.mutex.Lock()
+	defer s.bus.mutex.Unlock()
+	for _, link := range s.bus.links {
+		link.notify()
+	}
+}
+
+// nodeTimeout returns how long a node may stay silent on the cluster bus
+func (s *Server) nodeTimeout() time.Duration {
+	return time.Duration(s.clusterNodeTimeout.Load()) * time.Millisecond
+}
+
+// pingPeriod returns how often every node is pinged: often enough for a
+// healthy node to answer twice within the node timeout
+func (s *Server) pingPeriod() time.Duration {
+	return min(clusterPingPeriod, s.nodeTimeout()/2)
+}
+
+// busMessage returns a message of the given type describing this node for
+// receiver, with its replication offset and whether it paused its clients
+// for a manual failover
+func (s *Server) busMessage(kind cluster.MessageType, receiver string) *cluster.Message {
+	message := s.cluster.Ping(kind, receiver)
+	message.Sender.ReplOffset = s.replOffset()
+	message.Sender.Paused = s.failover.paused.Load()
+	return message
+}
+
+// sendToNode queues a message for the node with the given ID
+func (s *Server) sendToNode(id string, message *cluster.Message) {
+	s.bus.mutex.Lock()
+	defer s.bus.mutex.Unlock()
+	if link, linked := s.bus.links[id]; linked {
+		link.send(message)
+	}
+}
+
+// wakeNode pings the node with the given ID at once
+func (s *Server) wakeNode(id string) {
+	s.bus.mutex.Lock()
+	defer s.bus.mutex.Unlock()
+	if link, linked := s.bus.links[id]; linked {
+		link.notify()
+	}
+}
+
+// broadcast queues a message for every node
+func (s *Server) broadcast(message *cluster.Message) {
+	s.bus.mutex.Lock()
+	defer s.bus.mutex.Unlock()
+	for _, link := range s.bus.links {
+		link.send(message)
+	}
+}
+
+// clusterCron starts a link to every node that has none, then runs failure
+// detection and failovers
+func (s *Server) clusterCron() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(clusterCronPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			s.bus.listener.Close()
+			return
+		case <-ticker.C:
+		}
+
+		for _, node := range s.cluster.Nodes() {
+			s.bus.mutex.Lock()
+			if _, linked := s.bus.links[node.ID]; !linked && node.ID != s.cluster.MyID() {
+				link := &busLink{
+					id:     node.ID,
+					wake:   make(chan struct{}, 1),
+					outbox: make(chan *cluster.Message, clusterOutboxSize),
+				}
+				s.bus.links[node.ID] = link
+				s.wg.Add(1)
+				go s.runBusLink(link)
+			}
+			s.bus.mutex.Unlock()
+		}
+		s.failoverCron(time.Now())
+	}
+}
+
+// acceptBusConnections accepts the links of other nodes
+func (s *Server) acceptBusConnections() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.bus.listener.Accept()
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return
+			}
+			fmt.Printf("Error accepting a cluster bus connection: %v\n", err)
+			continue
+		}
+		s.wg.Add(1)
+		go s.serveBusConnection(conn)
+	}
+}
+
+// serveBusConnection processes the messages of a link from another node,
+// answering pings and meets with a pong
+func (s *Server) serveBusConnection(conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+	stop := context.AfterFunc(s.ctx, func() { conn.Close() })
+	defer stop()
+
+	remoteHost, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	localHost, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.nodeTimeout()))
+		message, err := cluster.ReadMessage(reader)
+		if err != nil {
+			return
+		}
+		// A node does not know its own address until another one reaches it
+		if s.cluster.LearnMyHost(localHost) {
+			s.clusterChanged()
+		}
+		s.processBusMessage(message, remoteHost)
+		if message.Type == cluster.MsgPing || message.Type == cluster.MsgMeet {
+			conn.SetWriteDeadline(time.Now().Add(s.nodeTimeout()))
+			if err := s.sendBusMessage(conn, s.busMessage(cluster.MsgPong, message.Sender.ID)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// sendBusMessage writes a message to a bus connection
+func (s *Server) sendBusMessage(conn net.Conn, message *cluster.Message) error {
+	s.bus.sent.Add(1)
+	return cluster.WriteMessage(conn, message)
+}
+
+// processBusMessage applies a message from another node, then takes part
+// in the failovers it is about
+func (s *Server) processBusMessage(message *cluster.Message, remoteHost string) {
+	s.bus.received.Add(1)
+	if s.cluster.Process(message, remoteHost) {
+		s.clusterChanged()
+	}
+	s.processFailoverMessage(message)
+}
+
+// runBusLink keeps pinging a node, reconnecting after failures until the
+// server stops
+func (s *Server) runBusLink(link *busLink) {
+	defer s.wg.Done()
+	for {
+		err := s.pingNode(link)
+		s.cluster.SetConnected(link.id, false)
+		if s.ctx.Err() != nil {
+			return
+		}
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			fmt.Printf("Cluster bus link to %.8s failed: %v\n", link.id, err)
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(clusterRetryDelay):
+		}
+	}
+}
+
+// pingNode connects to a node and pings it every period, or at once when
+// woken, processing its pongs and sending the messages queued meanwhile.
+// A node that cannot be reached counts as not answering a ping.
+func (s *Server) pingNode(link *busLink) error {
+	node, known := s.cluster.Node(link.id)
+	if !known {
+		return fmt.Errorf("unknown node")
+	}
+	dialer := net.Dialer{Timeout: s.nodeTimeout()}
+	conn, err := dialer.DialContext(s.ctx, "tcp", node.BusAddr())
+	if err != nil {
+		s.cluster.PingSent(link.id, time.Now())
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(s.ctx, func() { conn.Close() })
+	defer stop()
+	s.cluster.SetConnected(link.id, true)
+
+	remoteHost, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	reader := bufio.NewReader(conn)
+	ticker := time.NewTicker(s.pingPeriod())
+	defer ticker.Stop()
+	for {
+		conn.SetDeadline(time.Now().Add(s.nodeTimeout()))
+		if err := s.sendBusMessage(conn, s.busMessage(cluster.MsgPing, link.id)); err != nil {
+			return err
+		}
+		s.cluster.PingSent(link.id, time.Now())
+		pong, err := cluster.ReadMessage(reader)
+		if err != nil {
+			return err
+		}
+		if pong.Sender.ID != link.id {
+			return fmt.Errorf("node at %s answered as %.8s", node.BusAddr(), pong.Sender.ID)
+		}
+		s.processBusMessage(pong, remoteHost)
+
+		for waiting := true; waiting; {
+			select {
+			case <-s.ctx.Done():
+				return nil
+			case <-ticker.C:
+				waiting = false
+			case <-link.wake:
+				waiting = false
+			case message := <-link.outbox:
+				conn.SetWriteDeadline(time.Now().Add(s.nodeTimeout()))
+				if err := s.sendBusMessage(conn, message); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// meetNode introduces this node to the node whose bus listens at host and
+// busPort, adding it to the cluster once it answers
+func (s *Server) meetNode(host string, busPort int) {
+	defer s.wg.Done()
+	addr := net.JoinHostPort(host, strconv.Itoa(busPort))
+	err := func() error {
+		dialer := net.Dialer{Timeout: s.nodeTimeout()}
+		conn, err := dialer.DialContext(s.ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(s.nodeTimeout()))
+		if err := s.sendBusMessage(conn, s.busMessage(cluster.MsgMeet, "")); err != nil {
+			return err
+		}
+		pong, err := cluster.ReadMessage(bufio.NewReader(conn))
+		if err != nil {
+			return err
+		}
+		sender := pong.Sender
+		if sender.Host == "" {
+			sender.Host = host
+		}
+		s.cluster.AddNode(cluster.Node{ID: sender.ID, Host: sender.Host, Port: sender.Port, BusPort: sender.BusPort})
+		s.processBusMessage(pong, host)
+		s.clusterChanged()
+		return nil
+	}()
+	if err != nil {
+		fmt.Printf("CLUSTER MEET %s failed: %v\n", addr, err)
+	}
+}
+
+// indexSlots wraps the store in an index of its keys by slot
+func (s *Server) indexSlots() error {
+	index, err := cluster.NewIndexedStore(s.store)
+	if err != nil {
+		s.store.Close()
+		return fmt.Errorf("failed to index the keys by slot: %w", err)
+	}
+	s.store, s.keyIndex = index, index
+	return nil
+}
+
+// executeInCluster executes a command of the command handler once this
+// node is found to serve its keys, redirecting the client otherwise. While
+// a slot moves, which of its keys are still here decides where commands
+// run, so the check and the command both run under writeMutex, like
+// MIGRATE and CLUSTER SETSLOT.
+func (s *Server) executeInCluster(cmd *resp2.Command, asking bool) *resp2.RESPValue {
+	keys := handler.CommandKeys(cmd)
+	if len(keys) == 0 {
+		return s.executeKeyspaceCommand(cmd)
+	}
+	slot := cluster.KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if cluster.KeySlot(key) != slot {
+			return &resp2.RESPValue{Type: resp2.Error, Str: "CROSSSLOT Keys in request don't hash to the same slot"}
+		}
+	}
+
+	write := handler.IsWriteCommand(cmd.Name)
+	if !write && s.cluster.OK() && s.cluster.Stable(slot) {
+		response := s.handler.Execute(cmd)
+		// Keys may only leave once the slot is migrating, so a read that
+		// still finds the slot stable saw all of them
+		if s.cluster.Stable(slot) {
+			return response
+		}
+	}
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	if redirect := s.routeSlot(slot, keys, asking); redirect != nil {
+		return redirect
+	}
+	if !write {
+		return s.handler.Execute(cmd)
+	}
+	// A replica serves no slot, so its clients were redirected to its
+	// master already and only min-replicas-to-write can refuse the write
+	if refusal := s.checkWritable(); refusal != nil {
+		return refusal
+	}
+	return s.executeWrite(cmd)
+}
+
+// routeSlot checks that this node serves the keys of a command, returning
+// the error reply redirecting the client otherwise; the caller must hold
+// writeMutex. Keys of a slot migrating away that are gone already are
+// asked for on the importing node, which serves them to clients that sent
+// ASKING first.
+func (s *Server) routeSlot(slot int, keys []string, asking bool) *resp2.RESPValue {
+	if !s.cluster.OK() {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "CLUSTERDOWN The cluster is down"}
+	}
+	owner, served := s.cluster.Owner(slot)
+	if !served {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "CLUSTERDOWN Hash slot not served"}
+	}
+	missing := func() int {
+		count := 0
+		for _, key := range keys {
+			if !s.store.Exists(key) {
+				count++
+			}
+		}
+		return count
+	}
+	tryAgain := &resp2.RESPValue{Type: resp2.Error, Str: "TRYAGAIN Multiple keys request during rehashing of slot"}
+
+	if owner.ID == s.cluster.MyID() {
+		target, migrating := s.cluster.Migrating(slot)
+		if !migrating {
+			return nil
+		}
+		switch missing() {
+		case 0:
+			return nil
+		case len(keys):
+			return &resp2.RESPValue{Type: resp2.Error, Str: fmt.Sprintf("ASK %d %s", slot, target.Addr())}
+		default:
+			return tryAgain
+		}
+	}
+	if asking && s.cluster.Importing(slot) {
+		if len(keys) > 1 && missing() > 0 {
+			return tryAgain
+		}
+		return nil
+	}
+	return &resp2.RESPValue{Type: resp2.Error, Str: fmt.Sprintf("MOVED %d %s", slot, owner.Addr())}
+}
+
+// handleAsking handles ASKING, which lets the next command reach a slot
+// this node is importing
+func (s *Server) handleAsking(clientConn *connection.ClientConnection, args []string) *resp2.RESPValue {
+	if len(args) != 0 {
+		return wrongArgs("ASKING")
+	}
+	if s.cluster == nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR This instance has cluster support disabled"}
+	}
+	clientConn.SetAsking()
+	return &resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"}
+}
+
+// nodeHost returns the host clients reach a node at; this node may not
+// know its own yet, in which case it is where the client reached it
+func nodeHost(clientConn *connection.ClientConnection, node cluster.Node) string {
+	if node.Host != "" {
+		return node.Host
+	}
+	host, _, _ := net.SplitHostPort(clientConn.GetConn().LocalAddr().String())
+	return host
+}
+
+// handleCluster handles the CLUSTER subcommands
+func (s *Server) handleCluster(clientConn *connection.ClientConnection, args []string) *resp2.RESPValue {
+	if s.cluster == nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR This instance has cluster support disabled"}
+	}
+	if len(args) == 0 {
+		return wrongArgs("CLUSTER")
+	}
+
+	name, args := args[0], args[1:]
+	subcommand := strings.ToUpper(name)
+	switch subcommand {
+	case "INFO":
+		return s.clusterInfo()
+	case "MYID":
+		return &resp2.RESPValue{Type: resp2.BulkString, Str: s.cluster.MyID()}
+	case "NODES":
+		return &resp2.RESPValue{Type: resp2.BulkString, Str: s.cluster.FormatNodes()}
+	case "SLOTS":
+		return s.clusterSlots(clientConn)
+	case "SHARDS":
+		return s.clusterShards(clientConn)
+	case "KEYSLOT":
+		if len(args) != 1 {
+			return wrongArgs("CLUSTER|KEYSLOT")
+		}
+		return &resp2.RESPValue{Type: resp2.Integer, Int: int64(cluster.KeySlot(args[0]))}
+	case "MEET":
+		return s.clusterMeet(args)
+	case "ADDSLOTS", "ADDSLOTSRANGE":
+		return s.clusterAddSlots(subcommand, args)
+	case "SETSLOT":
+		return s.clusterSetSlot(args)
+	case "GETKEYSINSLOT":
+		return s.clusterGetKeysInSlot(args)
+	case "COUNTKEYSINSLOT":
+		if len(args) != 1 {
+			return wrongArgs("CLUSTER|COUNTKEYSINSLOT")
+		}
+		slot, err := cluster.ParseSlot(args[0])
+		if err != nil {
+			return &resp2.RESPValue{Type: resp2.Error, Str: "ERR Invalid slot"}
+		}
+		return &resp2.RESPValue{Type: resp2.Integer, Int: int64(s.keyIndex.CountKeysInSlot(slot))}
+	case "REPLICATE":
+		return s.clusterReplicate(args)
+	case "REPLICAS", "SLAVES":
+		return s.clusterReplicas(subcommand, args)
+	case "FAILOVER":
+		return s.clusterFailover(args)
+	case "COUNT-FAILURE-REPORTS":
+		return s.clusterCountFailureReports(args)
+	default:
+		return &resp2.RESPValue{
+			Type: resp2.Error,
+			Str:  fmt.Sprintf("ERR unknown subcommand '%s'. Try CLUSTER HELP.", name),
+		}
+	}
+}
+
+// clusterInfo handles CLUSTER INFO
+func (s *Server) clusterInfo() *resp2.RESPValue {
+	info := s.cluster.Info()
+	state := "fail"
+	if info.OK {
+		state = "ok"
+	}
+	lines := []string{
+		"cluster_state:" + state,
+		fmt.Sprintf("cluster_slots_assigned:%d", info.SlotsAssigned),
+		fmt.Sprintf("cluster_slots_ok:%d", info.SlotsAssigned-info.SlotsPFail-info.SlotsFail),
+		fmt.Sprintf("cluster_slots_pfail:%d", info.SlotsPFail),
+		fmt.Sprintf("cluster_slots_fail:%d", info.SlotsFail),
+		fmt.Sprintf("cluster_known_nodes:%d", info.KnownNodes),
+		fmt.Sprintf("cluster_size:%d", info.Size),
+		fmt.Sprintf("cluster_current_epoch:%d", info.CurrentEpoch),
+		fmt.Sprintf("cluster_my_epoch:%d", info.MyEpoch),
+		fmt.Sprintf("cluster_stats_messages_sent:%d", s.bus.sent.Load()),
+		fmt.Sprintf("cluster_stats_messages_received:%d", s.bus.received.Load()),
+	}
+	return &resp2.RESPValue{Type: resp2.BulkString, Str: strings.Join(lines, "\r\n") + "\r\n"}
+}
+
+// clusterSlots handles CLUSTER SLOTS: every served slot range with the
+// address and ID of its master, then of its replicas that did not fail
+func (s *Server) clusterSlots(clientConn *connection.ClientConnection) *resp2.RESPValue {
+	endpoint := func(node cluster.Node) resp2.RESPValue {
+		return resp2.RESPValue{Type: resp2.Array, Array: []resp2.RESPValue{
+			{Type: resp2.BulkString, Str: nodeHost(clientConn, node)},
+			{Type: resp2.Integer, Int: int64(node.Port)},
+			{Type: resp2.BulkString, Str: node.ID},
+		}}
+	}
+	var ranges []resp2.RESPValue
+	for _, shard := range s.cluster.Shards() {
+		replicas, _ := s.cluster.Replicas(shard.Node.ID)
+		for _, r := range shard.Ranges {
+			entry := []resp2.RESPValue{
+				{Type: resp2.Integer, Int: int64(r.Start)},
+				{Type: resp2.Integer, Int: int64(r.End)},
+				endpoint(shard.Node),
+			}
+			for _, replica := range replicas {
+				if !replica.Fail {
+					entry = append(entry, endpoint(replica))
+				}
+			}
+			ranges = append(ranges, resp2.RESPValue{Type: resp2.Array, Array: entry})
+		}
+	}
+	return &resp2.RESPValue{Type: resp2.Array, Array: ranges}
+}
+
+// clusterShards handles CLUSTER SHARDS: every master with its slot ranges
+// and its replicas, each shard and node rendered as a flat list of names
+// and values
+func (s *Server) clusterShards(clientConn *connection.ClientConnection) *resp2.RESPValue {
+	bulk := func(str string) resp2.RESPValue { return resp2.RESPValue{Type: resp2.BulkString, Str: str} }
+	integer := func(i int64) resp2.RESPValue { return resp2.RESPValue{Type: resp2.Integer, Int: i} }
+	describe := func(n cluster.Node) resp2.RESPValue {
+		host := nodeHost(clientConn, n)
+		role, health, offset := "master", "online", n.ReplOffset
+		if !n.IsMaster() {
+			role = "replica"
+		}
+		if n.Fail {
+			health = "fail"
+		}
+		if n.ID == s.cluster.MyID() {
+			offset = s.replOffset()
+		}
+		return resp2.RESPValue{Type: resp2.Array, Array: []resp2.RESPValue{
+			bulk("id"), bulk(n.ID),
+			bulk("port"), integer(int64(n.Port)),
+			bulk("ip"), bulk(host),
+			bulk("endpoint"), bulk(host),
+			bulk("role"), bulk(role),
+			bulk("replication-offset"), integer(offset),
+			bulk("health"), bulk(health),
+		}}
+	}
+
+	var shards []resp2.RESPValue
+	for _, shard := range s.cluster.Shards() {
+		if !shard.Node.IsMaster() {
+			continue
+		}
+		slots := []resp2.RESPValue{}
+		for _, r := range shard.Ranges {
+			slots = append(slots, integer(int64(r.Start)), integer(int64(r.End)))
+		}
+		nodes := []resp2.RESPValue{describe(shard.Node)}
+		replicas, _ := s.cluster.Replicas(shard.Node.ID)
+		for _, replica := range replicas {
+			nodes = append(nodes, describe(replica))
+		}
+		shards = append(shards, resp2.RESPValue{Type: resp2.Array, Array: []resp2.RESPValue{
+			bulk("slots"), {Type: resp2.Array, Array: slots},
+			bulk("nodes"), {Type: resp2.Array, Array: nodes},
+		}})
+	}
+	return &resp2.RESPValue{Type: resp2.Array, Array: shards}
+}
+
+// clusterMeet handles CLUSTER MEET ip port [cluster-bus-port]. The
+// handshake runs in the background, as in Redis, so the reply only means
+// it started.
+func (s *Server) clusterMeet(args []string) *resp2.RESPValue {
+	if len(args) != 2 && len(args) != 3 {
+		return wrongArgs("CLUSTER|MEET")
+	}
+	port, err := strconv.Atoi(args[1])
+	busPort := port + cluster.BusPortOffset
+	if err == nil && len(args) == 3 {
+		busPort, err = strconv.Atoi(args[2])
+	}
+	if err != nil || port <= 0 || port > 65535 || busPort <= 0 || busPort > 65535 {
+		return &resp2.RESPValue{
+			Type: resp2.Error,
+			Str:  fmt.Sprintf("ERR Invalid node address specified: %s:%s", args[0], args[1]),
+		}
+	}
+	s.wg.Add(1)
+	go s.meetNode(args[0], busPort)
+	return &resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"}
+}
+
+// clusterAddSlots handles CLUSTER ADDSLOTS slot... and CLUSTER
+// ADDSLOTSRANGE start end...
+func (s *Server) clusterAddSlots(subcommand string, args []string) *resp2.RESPValue {
+	if len(args) == 0 || (subcommand == "ADDSLOTSRANGE" && len(args)%2 != 0) {
+		return wrongArgs("CLUSTER|" + subcommand)
+	}
+	var slots []int
+	seen := make(map[int]bool)
+	add := func(slot int) *resp2.RESPValue {
+		if seen[slot] {
+			return &resp2.RESPValue{Type: resp2.Error, Str: fmt.Sprintf("ERR Slot %d specified multiple times", slot)}
+		}
+		seen[slot] = true
+		slots = append(slots, slot)
+		return nil
+	}
+	invalid := &resp2.RESPValue{Type: resp2.Error, Str: "ERR Invalid or out of range slot"}
+
+	step := 1
+	if subcommand == "ADDSLOTSRANGE" {
+		step = 2
+	}
+	for i := 0; i < len(args); i += step {
+		start, err := cluster.ParseSlot(args[i])
+		if err != nil {
+			return invalid
+		}
+		end := start
+		if step == 2 {
+			if end, err = cluster.ParseSlot(args[i+1]); err != nil {
+				return invalid
+			}
+			if end < start {
+				return &resp2.RESPValue{
+					Type: resp2.Error,
+					Str:  fmt.Sprintf("ERR start slot number %d is greater than end slot number %d", start, end),
+				}
+			}
+		}
+		for slot := start; slot <= end; slot++ {
+			if reply := add(slot); reply != nil {
+				return reply
+			}
+		}
+	}
+	if err := s.cluster.AddSlots(slots); err != nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR " + err.Error()}
+	}
+	s.clusterChanged()
+	return &resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"}
+}
+
+// clusterSetSlot handles CLUSTER SETSLOT slot IMPORTING|MIGRATING|NODE
+// node-id and CLUSTER SETSLOT slot STABLE, which move a slot between nodes
+func (s *Server) clusterSetSlot(args []string) *resp2.RESPValue {
+	if len(args) < 2 {
+		return wrongArgs("CLUSTER|SETSLOT")
+	}
+	slot, err := cluster.ParseSlot(args[0])
+	if err != nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR Invalid or out of range slot"}
+	}
+	action := strings.ToUpper(args[1])
+	if (action == "STABLE") != (len(args) == 2) || len(args) > 3 {
+		return &resp2.RESPValue{
+			Type: resp2.Error,
+			Str:  "ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP",
+		}
+	}
+
+	if err := s.setSlot(slot, action, args[2:]); err != nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR " + err.Error()}
+	}
+	s.clusterChanged()
+	return &resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"}
+}
+
+// setSlot applies CLUSTER SETSLOT. Commands on a moving slot check its
+// state under writeMutex, so it changes under writeMutex too.
+func (s *Server) setSlot(slot int, action string, args []string) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	switch action {
+	case "STABLE":
+		s.cluster.SetStable(slot)
+		return nil
+	case "MIGRATING":
+		return s.cluster.SetMigrating(slot, args[0])
+	case "IMPORTING":
+		return s.cluster.SetImporting(slot, args[0])
+	case "NODE":
+		owner, served := s.cluster.Owner(slot)
+		mine := served && owner.ID == s.cluster.MyID()
+		if mine && args[0] != owner.ID && s.keyIndex.CountKeysInSlot(slot) > 0 {
+			return fmt.Errorf("Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot)
+		}
+		return s.cluster.SetNode(slot, args[0])
+	default:
+		return fmt.Errorf("Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+	}
+}
+
+// clusterGetKeysInSlot handles CLUSTER GETKEYSINSLOT slot count
+func (s *Server) clusterGetKeysInSlot(args []string) *resp2.RESPValue {
+	if len(args) != 2 {
+		return wrongArgs("CLUSTER|GETKEYSINSLOT")
+	}
+	slot, err := cluster.ParseSlot(args[0])
+	if err != nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR Invalid slot"}
+	}
+	count, err := strconv.Atoi(args[1])
+	if err != nil || count < 0 {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR Invalid number of keys"}
+	}
+	keys := s.keyIndex.KeysInSlot(slot, count)
+	reply := make([]resp2.RESPValue, len(keys))
+	for i, key := range keys {
+		reply[i] = resp2.RESPValue{Type: resp2.BulkString, Str: key}
+	}
+	return &resp2.RESPValue{Type: resp2.Array, Array: reply}
+}
+
+// infoCluster renders the Cluster section
+func (s *Server) infoCluster() []string {
+	return []string{fmt.Sprintf("cluster_enabled:%d", boolToInt(s.cluster != nil))}
+}
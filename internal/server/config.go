@@ -0,0 +1,285 @@
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"redis-like-server/internal/aof"
+	"redis-like-server/internal/glob"
+	"redis-like-server/internal/handler"
+	"redis-like-server/internal/resp2"
+)
+
+// configParameter describes a runtime parameter exposed through CONFIG GET/SET
+type configParameter struct {
+	get func(s *Server) string
+	set func(s *Server, value string) error
+}
+
+// configParameters lists the parameters supported by CONFIG GET/SET
+var configParameters = map[string]configParameter{
+	"dir": {
+		get: func(s *Server) string { return s.config.Dir },
+	},
+	"dbfilename": {
+		get: func(s *Server) string { return s.config.DBFilename },
+	},
+	"save": {
+		get: func(s *Server) string { return formatSaveRules(s.getSaveRules()) },
+		set: func(s *Server, value string) error {
+			rules, err := ParseSaveRules(value)
+			if err != nil {
+				return err
+			}
+			s.setSaveRules(rules)
+			return nil
+		},
+	},
+	"storage-engine": {
+		get: func(s *Server) string { return s.storageEngine() },
+	},
+	"storage-dir": {
+		get: func(s *Server) string { return s.storageDir() },
+	},
+	"tiered-memory-limit": {
+		get: func(s *Server) string { return strconv.FormatInt(s.tieredMemoryLimit(), 10) },
+	},
+	"tiered-policy": {
+		get: func(s *Server) string { return s.tieredPolicy() },
+	},
+	"replicaof": {
+		get: func(s *Server) string {
+			s.repl.mutex.Lock()
+			defer s.repl.mutex.Unlock()
+			if s.repl.master == nil {
+				return ""
+			}
+			return fmt.Sprintf("%s %d", s.repl.master.host, s.repl.master.port)
+		},
+	},
+	"repl-backlog-size": {
+		get: func(s *Server) string {
+			s.repl.mutex.Lock()
+			defer s.repl.mutex.Unlock()
+			return strconv.Itoa(s.repl.backlog.Size())
+		},
+	},
+	"replica-read-only": {
+		get: func(s *Server) string { return yesNo(s.replicaReadOnly.Load()) },
+		set: func(s *Server, value string) error {
+			readOnly, err := parseYesNo(value)
+			if err != nil {
+				return err
+			}
+			s.replicaReadOnly.Store(readOnly)
+			return nil
+		},
+	},
+	"min-replicas-to-write": {
+		get: func(s *Server) string { return strconv.FormatInt(s.minReplicasToWrite.Load(), 10) },
+		set: func(s *Server, value string) error {
+			count, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || count < 0 {
+				return fmt.Errorf("invalid number of replicas %q", value)
+			}
+			s.minReplicasToWrite.Store(count)
+			return nil
+		},
+	},
+	"min-replicas-max-lag": {
+		get: func(s *Server) string { return strconv.FormatInt(s.minReplicasMaxLag.Load(), 10) },
+		set: func(s *Server, value string) error {
+			lag, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || lag < 0 {
+				return fmt.Errorf("invalid lag %q", value)
+			}
+			s.minReplicasMaxLag.Store(lag)
+			return nil
+		},
+	},
+	"cluster-enabled": {
+		get: func(s *Server) string { return yesNo(s.config.ClusterEnabled) },
+	},
+	"cluster-config-file": {
+		get: func(s *Server) string {
+			if s.config.ClusterConfigFile == "" {
+				return "nodes.conf"
+			}
+			return s.config.ClusterConfigFile
+		},
+	},
+	"cluster-port": {
+		get: func(s *Server) string { return strconv.Itoa(s.clusterBusPort()) },
+	},
+	"cluster-node-timeout": {
+		get: func(s *Server) string { return strconv.FormatInt(s.clusterNodeTimeout.Load(), 10) },
+		set: func(s *Server, value string) error {
+			timeout, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || timeout <= 0 {
+				return fmt.Errorf("invalid node timeout %q", value)
+			}
+			s.clusterNodeTimeout.Store(timeout)
+			return nil
+		},
+	},
+	"appendonly": {
+		get: func(s *Server) string { return yesNo(s.config.AppendOnly) },
+	},
+	"appendfilename": {
+		get: func(s *Server) string { return filepath.Base(s.aofPath()) },
+	},
+	"appenddirname": {
+		get: func(s *Server) string { return filepath.Base(s.aofDir()) },
+	},
+	"appendfsync": {
+		get: func(s *Server) string {
+			if s.aof != nil {
+				return s.aof.Policy().String()
+			}
+			return s.config.AppendFsync.String()
+		},
+		set: func(s *Server, value string) error {
+			policy, err := aof.ParseFsyncPolicy(value)
+			if err != nil {
+				return err
+			}
+			if s.aof != nil {
+				s.aof.SetPolicy(policy)
+			}
+			return nil
+		},
+	},
+	"aof-load-truncated": {
+		get: func(s *Server) string { return yesNo(s.config.AOFLoadTruncated) },
+	},
+	"aof-timestamp-enabled": {
+		get: func(s *Server) string { return yesNo(s.aofTimestampEnabled.Load()) },
+		set: func(s *Server, value string) error {
+			enabled, err := parseYesNo(value)
+			if err != nil {
+				return err
+			}
+			s.aofTimestampEnabled.Store(enabled)
+			if s.aof != nil {
+				s.aof.SetTimestamps(enabled)
+			}
+			return nil
+		},
+	},
+	"auto-aof-rewrite-percentage": {
+		get: func(s *Server) string { return strconv.FormatInt(s.autoAOFRewritePercentage.Load(), 10) },
+		set: func(s *Server, value string) error {
+			percentage, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || percentage < 0 {
+				return fmt.Errorf("invalid percentage %q", value)
+			}
+			s.autoAOFRewritePercentage.Store(percentage)
+			return nil
+		},
+	},
+	"auto-aof-rewrite-min-size": {
+		get: func(s *Server) string { return strconv.FormatInt(s.autoAOFRewriteMinSize.Load(), 10) },
+		set: func(s *Server, value string) error {
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return fmt.Errorf("invalid size %q", value)
+			}
+			s.autoAOFRewriteMinSize.Store(size)
+			return nil
+		},
+	},
+	"notify-keyspace-events": {
+		get: func(s *Server) string {
+			return handler.KeyspaceEventsString(s.notifier.Classes())
+		},
+		set: func(s *Server, value string) error {
+			classes, err := handler.ParseKeyspaceEvents(value)
+			if err != nil {
+				return err
+			}
+			s.notifier.SetClasses(classes)
+			return nil
+		},
+	},
+}
+
+// handleConfig handles CONFIG GET and CONFIG SET
+func (s *Server) handleConfig(args []string) *resp2.RESPValue {
+	if len(args) == 0 {
+		return wrongArgs("CONFIG")
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		if len(args) < 2 {
+			return wrongArgs("CONFIG|GET")
+		}
+		names := make([]string, 0, len(configParameters))
+		for name := range configParameters {
+			for _, pattern := range args[1:] {
+				if glob.Match(strings.ToLower(pattern), name) {
+					names = append(names, name)
+					break
+				}
+			}
+		}
+		sort.Strings(names)
+
+		result := make([]resp2.RESPValue, 0, 2*len(names))
+		for _, name := range names {
+			result = append(result,
+				resp2.RESPValue{Type: resp2.BulkString, Str: name},
+				resp2.RESPValue{Type: resp2.BulkString, Str: configParameters[name].get(s)},
+			)
+		}
+		return &resp2.RESPValue{Type: resp2.Array, Array: result}
+	case "SET":
+		if len(args) < 3 || len(args)%2 == 0 {
+			return wrongArgs("CONFIG|SET")
+		}
+		for i := 1; i < len(args); i += 2 {
+			name := strings.ToLower(args[i])
+			param, exists := configParameters[name]
+			if !exists || param.set == nil {
+				return &resp2.RESPValue{
+					Type: resp2.Error,
+					Str:  fmt.Sprintf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", args[i]),
+				}
+			}
+			if err := param.set(s, args[i+1]); err != nil {
+				return &resp2.RESPValue{
+					Type: resp2.Error,
+					Str:  fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %v", args[i], err),
+				}
+			}
+		}
+		return &resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"}
+	default:
+		return &resp2.RESPValue{
+			Type: resp2.Error,
+			Str:  fmt.Sprintf("ERR unknown subcommand '%s'. Try CONFIG HELP.", args[0]),
+		}
+	}
+}
+
+// yesNo renders a boolean parameter the way Redis does
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// parseYesNo parses a boolean parameter the way Redis does
+func parseYesNo(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("argument must be 'yes' or 'no'")
+}
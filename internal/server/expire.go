@@ -0,0 +1,91 @@
+package server
+
+import (
+	"time"
+
+	"redis-like-server/internal/handler"
+	"redis-like-server/internal/resp2"
+)
+
+const (
+	// activeExpirePeriod is how often keys past their expiry are looked
+	// for, activeExpireSample how many keys with an expiry a round checks
+	// and activeExpireBudget how long the rounds of one period may take.
+	// Rounds repeat while more than a quarter of the sample expired, as in
+	// Redis.
+	activeExpirePeriod = 100 * time.Millisecond
+	activeExpireSample = 20
+	activeExpireBudget = 25 * time.Millisecond
+)
+
+// expiresKeys reports whether this instance deletes the keys past their
+// expiry. Replicas and Raft followers only hide them until the DEL of their
+// master or leader arrives, so the dataset never diverges.
+func (s *Server) expiresKeys() bool {
+	if s.raft != nil {
+		leader, known := s.raft.node.Leader()
+		return known && leader.ID == s.raft.node.ID()
+	}
+	return !s.isReplica()
+}
+
+// expireKeys deletes the keys of a command found past their expiry before
+// it runs, as Redis does when a command looks a key up
+func (s *Server) expireKeys(cmd *resp2.Command) {
+	for _, key := range handler.CommandKeys(cmd) {
+		if s.store.Expired(key) && s.expiresKeys() {
+			s.expireKey(key)
+		}
+	}
+}
+
+// expireKey deletes a key past its expiry like a DEL, so the deletion is
+// logged and reaches the replicas and peers, and notifies it as expired
+func (s *Server) expireKey(key string) {
+	del := &resp2.Command{Name: "DEL", Args: []string{key}}
+	if s.raft != nil {
+		if s.executeInRaft(del).Type != resp2.Error {
+			s.notifier.Notify(handler.NotifyExpired, "expired", key)
+		}
+		return
+	}
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	// Another command may have deleted or rewritten it meanwhile
+	if !s.store.Expired(key) {
+		return
+	}
+	if s.executeWrite(del).Type != resp2.Error {
+		s.notifier.Notify(handler.NotifyExpired, "expired", key)
+	}
+}
+
+// expireCron deletes the keys past their expiry that no command looked up
+func (s *Server) expireCron() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(activeExpirePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !s.expiresKeys() {
+			continue
+		}
+
+		deadline := time.Now().Add(activeExpireBudget)
+		for {
+			expired := s.store.ExpiredKeys(activeExpireSample)
+			for _, key := range expired {
+				s.expireKey(key)
+			}
+			if len(expired) <= activeExpireSample/4 || time.Now().After(deadline) {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"redis-like-server/internal/crypt"
+	"redis-like-server/internal/jsonl"
+	"redis-like-server/internal/rdb"
+	"redis-like-server/internal/store"
+)
+
+// importJSONL loads the JSON Lines file configured for startup into the
+// store before any client connects, then persists the result right away
+// so it does not depend on the save rules
+func (s *Server) importJSONL() error {
+	file, err := os.Open(s.config.ImportJSONL)
+	if err != nil {
+		return fmt.Errorf("failed to open import file: %w", err)
+	}
+	defer file.Close()
+
+	result, err := jsonl.Import(s.store, file, s.config.ImportConflict, time.Now().UnixMilli())
+	if err != nil {
+		return fmt.Errorf("failed to import %s: %w", s.config.ImportJSONL, err)
+	}
+	fmt.Printf("Imported %d keys from %s (%d replaced, %d skipped)\n", result.Imported, s.config.ImportJSONL, result.Replaced, result.Skipped)
+	if result.Imported == 0 {
+		return nil
+	}
+	s.dirty.Add(int64(result.Imported))
+
+	if s.aof != nil {
+		rewrite, view, err := s.beginAOFRewrite()
+		if err != nil {
+			return err
+		}
+		return s.finishAOFRewrite(rewrite, view)
+	}
+	if s.snapshotEnabled() {
+		return s.saveSnapshot()
+	}
+	return nil
+}
+
+// loadSnapshotInto reads an RDB file into a fresh in-memory store; a path
+// that does not exist gives an empty store
+func loadSnapshotInto(path string, keyring *crypt.Keyring) (store.KeyValueStore, error) {
+	kv := store.NewInMemoryStore()
+	if path == "" {
+		return kv, nil
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return kv, nil
+	}
+	report, err := readSnapshot(path, keyring, func(entry rdb.Entry) {
+		kv.SetWithExpiry(entry.Key, entry.Value, entry.ExpireAt)
+	})
+	// Standard output may be carrying the exported keys
+	if warning := report.SkippedWarning(); warning != "" && err == nil {
+		fmt.Fprintln(os.Stderr, warning)
+	}
+	return kv, err
+}
+
+// ExportSnapshot writes the keys of an RDB file, decrypted with keyring if
+// needed, to w as JSON Lines and returns how many it wrote
+func ExportSnapshot(path string, keyring *crypt.Keyring, w io.Writer) (int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	kv, err := loadSnapshotInto(path, keyring)
+	if err != nil {
+		return 0, err
+	}
+	view := kv.View()
+	defer view.Release()
+	return jsonl.Write(w, view, time.Now().UnixMilli())
+}
+
+// ImportToFile imports JSON Lines into the dataset of the RDB file base,
+// when it exists, and writes the result as an RDB file at output,
+// encrypted with the current key of keyring if any. Nothing is written
+// when the input is invalid or conflicts under jsonl.ConflictFail.
+func ImportToFile(input io.Reader, base string, policy jsonl.ConflictPolicy, keyring *crypt.Keyring, output string) (jsonl.ImportResult, error) {
+	kv, err := loadSnapshotInto(base, keyring)
+	if err != nil {
+		return jsonl.ImportResult{}, err
+	}
+	result, err := jsonl.Import(kv, input, policy, time.Now().UnixMilli())
+	if err != nil {
+		return result, err
+	}
+
+	s := NewServer(&ServerConfig{Encryption: keyring})
+	view := kv.View()
+	defer view.Release()
+	tempPath := filepath.Join(filepath.Dir(output), fmt.Sprintf("temp-%d-%s", os.Getpid(), filepath.Base(output)))
+	return result, writeFileAtomic(tempPath, output, func(w io.Writer) error {
+		return s.encodeSnapshot(w, view)
+	})
+}
@@ -0,0 +1,355 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"redis-like-server/internal/cluster"
+	"redis-like-server/internal/resp2"
+	"redis-like-server/internal/store"
+)
+
+const (
+	// clusterManualFailoverTimeout bounds a manual failover: how long a
+	// master pauses its clients and its replica waits to catch up
+	clusterManualFailoverTimeout = 5 * time.Second
+	// clusterMinAuthTimeout is the shortest time a replica waits for the
+	// votes of an election
+	clusterMinAuthTimeout = 2 * time.Second
+)
+
+// failoverState is the part of a cluster node taking part in failovers:
+// as a replica, the election it runs to take over from its master and the
+// manual failover it was asked for, and as a master, whether it paused its
+// clients for a manual failover
+type failoverState struct {
+	mutex sync.Mutex
+	// authTime is when the election starts; authEpoch is the epoch votes
+	// were requested in, zero until then, and votes the masters that voted
+	authTime  time.Time
+	authEpoch uint64
+	votes     map[string]bool
+	// manualEnd is when the manual failover in progress gives up, zero
+	// when there is none. A forced one runs its election at once; the
+	// others wait for the master to pause its clients at manualOffset and
+	// for this node to catch up with it.
+	manualEnd    time.Time
+	manualForce  bool
+	manualOffset int64
+
+	// pausing is set while a master pauses its clients, and paused once
+	// writes stopped
+	pausing atomic.Bool
+	paused  atomic.Bool
+}
+
+// replOffset returns the offset of the replication stream this server
+// holds, as a master or a replica
+func (s *Server) replOffset() int64 {
+	s.repl.mutex.Lock()
+	defer s.repl.mutex.Unlock()
+	return s.repl.backlog.Offset()
+}
+
+// failoverCron flags the nodes found down, follows the master the cluster
+// says this node replicates and, on a replica, runs the election to take
+// over from a failed master
+func (s *Server) failoverCron(now time.Time) {
+	changed, failed := s.cluster.Cron(now, s.nodeTimeout())
+	for _, id := range failed {
+		fmt.Printf("Marking node %.8s as failing (quorum reached).\n", id)
+		message := s.busMessage(cluster.MsgFail, "")
+		message.Failing = id
+		s.broadcast(message)
+	}
+	if changed {
+		s.clusterChanged()
+	}
+	s.syncClusterRole()
+	s.runElection(now)
+}
+
+// syncClusterRole makes replication agree with the role this node has in
+// the cluster: a master stops replicating, keeping its dataset as a new
+// history, and a replica replicates its master
+func (s *Server) syncClusterRole() {
+	myself := s.cluster.Myself()
+	s.repl.mutex.Lock()
+	current := s.repl.master
+	s.repl.mutex.Unlock()
+	if myself.IsMaster() {
+		if current != nil {
+			s.stopReplication()
+		}
+		return
+	}
+	master, known := s.cluster.Node(myself.MasterID)
+	if !known || master.Host == "" || master.Port == 0 {
+		return
+	}
+	if current == nil || current.host != master.Host || current.port != master.Port {
+		s.startReplication(master.Host, master.Port, true)
+	}
+}
+
+// runElection runs, on a replica whose master failed or that was asked
+// for a manual failover, the election making it a master. After a delay
+// leaving the failure time to spread, longer for replicas with less data,
+// the replica asks the masters for their votes in a new epoch and takes
+// over its master's slots once a majority voted. An election that did
+// not win in time is retried later in a new epoch.
+func (s *Server) runElection(now time.Time) {
+	f := s.failover
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	myself := s.cluster.Myself()
+	if myself.IsMaster() {
+		f.authTime, f.authEpoch, f.manualEnd = time.Time{}, 0, time.Time{}
+		return
+	}
+
+	manual := !f.manualEnd.IsZero()
+	if manual && now.After(f.manualEnd) {
+		fmt.Println("Manual failover timed out.")
+		f.manualEnd, manual = time.Time{}, false
+	}
+	master, known := s.cluster.Node(myself.MasterID)
+	ready := known && master.Fail
+	if manual {
+		ready = f.manualForce || f.manualOffset >= 0 && s.replOffset() >= f.manualOffset
+	}
+	if !ready {
+		return
+	}
+
+	authTimeout := max(2*s.nodeTimeout(), clusterMinAuthTimeout)
+	if f.authTime.IsZero() || now.Sub(f.authTime) > 2*authTimeout {
+		f.authTime, f.authEpoch, f.votes = now, 0, make(map[string]bool)
+		if !manual {
+			delay := 500*time.Millisecond + time.Duration(rand.Int63n(int64(500*time.Millisecond)))
+			rank := s.cluster.Rank(s.replOffset())
+			f.authTime = now.Add(delay + time.Duration(rank)*time.Second)
+			fmt.Printf("Start of election delayed for %v (rank #%d).\n", f.authTime.Sub(now).Round(time.Millisecond), rank)
+		}
+	}
+	if now.Before(f.authTime) || now.Sub(f.authTime) > authTimeout {
+		return
+	}
+
+	if f.authEpoch == 0 {
+		f.authEpoch = s.cluster.StartElection()
+		s.saveClusterConfig()
+		fmt.Printf("Starting a failover election for epoch %d.\n", f.authEpoch)
+		request := s.busMessage(cluster.MsgAuthRequest, "")
+		request.Force = manual
+		s.broadcast(request)
+		return
+	}
+	if len(f.votes) < s.cluster.VotesNeeded() {
+		return
+	}
+	epoch := f.authEpoch
+	if err := s.becomeMaster(func() error { return s.cluster.Promote(epoch) }); err != nil {
+		return
+	}
+	fmt.Printf("Failover election won for epoch %d, I'm the new master.\n", f.authEpoch)
+	f.authTime, f.authEpoch, f.manualEnd = time.Time{}, 0, time.Time{}
+	s.clusterChanged()
+}
+
+// becomeMaster promotes this replica and stops replicating together under
+// writeMutex, so no write is accepted as a master but left out of the
+// stream as a replica's
+func (s *Server) becomeMaster(promote func() error) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	if err := promote(); err != nil {
+		return err
+	}
+	s.stopReplication()
+	return nil
+}
+
+// processFailoverMessage takes part in the failovers a message from
+// another node is about: a master votes for the replicas asking for it and
+// pauses its clients when its replica starts a manual failover, and a
+// replica counts the votes it gets and learns where its paused master's
+// stream stops
+func (s *Server) processFailoverMessage(message *cluster.Message) {
+	sender := message.Sender
+	switch message.Type {
+	case cluster.MsgAuthRequest:
+		if s.cluster.Vote(message, time.Now(), s.nodeTimeout()) {
+			s.saveClusterConfig()
+			fmt.Printf("Failover auth granted to %.8s for epoch %d\n", sender.ID, sender.CurrentEpoch)
+			s.sendToNode(sender.ID, s.busMessage(cluster.MsgAuthAck, sender.ID))
+		}
+	case cluster.MsgAuthAck:
+		s.failover.mutex.Lock()
+		if f := s.failover; f.authEpoch != 0 && sender.CurrentEpoch >= f.authEpoch && sender.MasterID == "" {
+			f.votes[sender.ID] = true
+		}
+		s.failover.mutex.Unlock()
+	case cluster.MsgMFStart:
+		if node, known := s.cluster.Node(sender.ID); known && node.MasterID == s.cluster.MyID() {
+			fmt.Printf("Manual failover requested by replica %.8s.\n", sender.ID)
+			s.pauseForFailover(sender.ID)
+		}
+	}
+
+	if sender.Paused && sender.ID == s.cluster.Myself().MasterID {
+		f := s.failover
+		f.mutex.Lock()
+		if !f.manualEnd.IsZero() && f.manualOffset < 0 {
+			f.manualOffset = sender.ReplOffset
+			fmt.Printf("Received replication offset for paused master manual failover: %d\n", f.manualOffset)
+		}
+		f.mutex.Unlock()
+	}
+}
+
+// pauseForFailover pauses the writes of this master for a manual failover
+// by its replica, until the replica took over or the failover timed out.
+// Once paused, the replica is pinged at once, telling it where the stream
+// stops.
+func (s *Server) pauseForFailover(replica string) {
+	if !s.failover.pausing.CompareAndSwap(false, true) {
+		return
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.failover.pausing.Store(false)
+		s.writeMutex.Lock()
+		defer s.writeMutex.Unlock()
+		s.failover.paused.Store(true)
+		defer s.failover.paused.Store(false)
+		s.wakeNode(replica)
+
+		deadline := time.Now().Add(clusterManualFailoverTimeout)
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for time.Now().Before(deadline) && s.cluster.Myself().IsMaster() {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// clusterFailover handles CLUSTER FAILOVER [FORCE|TAKEOVER], run on a
+// replica to take over from its master. By default the master pauses its
+// clients, the replica catches up with its stream and is elected without
+// waiting for the master to fail; FORCE skips the master, for one that is
+// down, and TAKEOVER skips the election too, for when no majority of
+// masters is reachable.
+func (s *Server) clusterFailover(args []string) *resp2.RESPValue {
+	if len(args) > 1 {
+		return wrongArgs("CLUSTER|FAILOVER")
+	}
+	option := ""
+	if len(args) == 1 {
+		option = strings.ToUpper(args[0])
+		if option != "FORCE" && option != "TAKEOVER" {
+			return &resp2.RESPValue{Type: resp2.Error, Str: "ERR syntax error"}
+		}
+	}
+	myself := s.cluster.Myself()
+	if myself.IsMaster() {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR You should send CLUSTER FAILOVER to a replica"}
+	}
+	master, known := s.cluster.Node(myself.MasterID)
+	if !known {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR I'm a replica but my master is unknown to me"}
+	}
+	if option == "" && (master.Fail || !master.Connected) {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR Master is down or failed, please use CLUSTER FAILOVER FORCE"}
+	}
+
+	if option == "TAKEOVER" {
+		if err := s.becomeMaster(s.cluster.TakeOver); err != nil {
+			return &resp2.RESPValue{Type: resp2.Error, Str: "ERR " + err.Error()}
+		}
+		fmt.Println("Taking over the master (user request).")
+		s.clusterChanged()
+		return &resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"}
+	}
+	f := s.failover
+	f.mutex.Lock()
+	f.manualEnd = time.Now().Add(clusterManualFailoverTimeout)
+	f.manualForce, f.manualOffset = option == "FORCE", -1
+	f.authTime, f.authEpoch = time.Time{}, 0
+	f.mutex.Unlock()
+	if option == "FORCE" {
+		fmt.Println("Forced failover user request accepted.")
+	} else {
+		fmt.Println("Manual failover user request accepted.")
+		s.sendToNode(master.ID, s.busMessage(cluster.MsgMFStart, master.ID))
+	}
+	return &resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"}
+}
+
+// clusterReplicate handles CLUSTER REPLICATE node-id, which makes this
+// node a replica of a master. Only an empty master serving no slots can
+// become a replica, so no data is lost.
+func (s *Server) clusterReplicate(args []string) *resp2.RESPValue {
+	if len(args) != 1 {
+		return wrongArgs("CLUSTER|REPLICATE")
+	}
+	if s.cluster.Myself().IsMaster() && !s.keyspaceEmpty() {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR To set a master the node must be empty and without assigned slots."}
+	}
+	if err := s.cluster.SetMaster(args[0]); err != nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR " + err.Error()}
+	}
+	s.clusterChanged()
+	return &resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"}
+}
+
+// keyspaceEmpty reports whether the dataset holds no key
+func (s *Server) keyspaceEmpty() bool {
+	view := s.store.View()
+	defer view.Release()
+	empty := true
+	view.Range(func(string, store.Item) bool {
+		empty = false
+		return false
+	})
+	return empty
+}
+
+// clusterReplicas handles CLUSTER REPLICAS node-id, and its alias CLUSTER
+// SLAVES: the lines of CLUSTER NODES of the replicas of a master
+func (s *Server) clusterReplicas(subcommand string, args []string) *resp2.RESPValue {
+	if len(args) != 1 {
+		return wrongArgs("CLUSTER|" + subcommand)
+	}
+	replicas, err := s.cluster.Replicas(args[0])
+	if err != nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR " + err.Error()}
+	}
+	reply := make([]resp2.RESPValue, len(replicas))
+	for i, replica := range replicas {
+		line := cluster.NodeLine{Node: replica, Myself: replica.ID == s.cluster.MyID()}
+		reply[i] = resp2.RESPValue{Type: resp2.BulkString, Str: line.String()}
+	}
+	return &resp2.RESPValue{Type: resp2.Array, Array: reply}
+}
+
+// clusterCountFailureReports handles CLUSTER COUNT-FAILURE-REPORTS node-id
+func (s *Server) clusterCountFailureReports(args []string) *resp2.RESPValue {
+	if len(args) != 1 {
+		return wrongArgs("CLUSTER|COUNT-FAILURE-REPORTS")
+	}
+	count, err := s.cluster.CountFailureReports(args[0])
+	if err != nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR " + err.Error()}
+	}
+	return &resp2.RESPValue{Type: resp2.Integer, Int: int64(count)}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"redis-like-server/internal/resp2"
+	"redis-like-server/internal/store"
+)
+
+// redisVersion is the Redis version the server reports being compatible with
+const redisVersion = "7.2.0"
+
+// infoSection renders one section of the INFO reply as "field:value" lines
+type infoSection struct {
+	name   string
+	render func(s *Server) []string
+}
+
+// infoSections lists the INFO sections in output order
+var infoSections = []infoSection{
+	{name: "Server", render: (*Server).infoServer},
+	{name: "Clients", render: (*Server).infoClients},
+	{name: "Persistence", render: (*Server).infoPersistence},
+	{name: "Storage", render: (*Server).infoStorage},
+	{name: "Stats", render: (*Server).infoStats},
+	{name: "Replication", render: (*Server).infoReplication},
+	{name: "Cluster", render: (*Server).infoCluster},
+	{name: "ActiveActive", render: (*Server).infoActiveActive},
+	{name: "Raft", render: (*Server).infoRaft},
+}
+
+// sentinelInfoSections lists the INFO sections of a sentinel
+var sentinelInfoSections = []infoSection{
+	{name: "Server", render: (*Server).infoServer},
+	{name: "Clients", render: (*Server).infoClients},
+	{name: "Sentinel", render: (*Server).infoSentinel},
+}
+
+// handleInfo handles the INFO command
+func (s *Server) handleInfo(args []string) *resp2.RESPValue {
+	wanted := make(map[string]bool)
+	for _, arg := range args {
+		wanted[strings.ToLower(arg)] = true
+	}
+	all := len(wanted) == 0 || wanted["all"] || wanted["default"] || wanted["everything"]
+
+	available := infoSections
+	if s.sentinel != nil {
+		available = sentinelInfoSections
+	}
+	var sections []string
+	for _, section := range available {
+		if !all && !wanted[strings.ToLower(section.name)] {
+			continue
+		}
+		lines := append([]string{"# " + section.name}, section.render(s)...)
+		sections = append(sections, strings.Join(lines, "\r\n"))
+	}
+
+	return &resp2.RESPValue{
+		Type: resp2.BulkString,
+		Str:  strings.Join(sections, "\r\n\r\n") + "\r\n",
+	}
+}
+
+// infoServer renders the Server section
+func (s *Server) infoServer() []string {
+	return []string{
+		"redis_version:" + redisVersion,
+		fmt.Sprintf("redis_mode:%s", s.mode()),
+		fmt.Sprintf("process_id:%d", os.Getpid()),
+		fmt.Sprintf("tcp_port:%d", s.config.Port),
+		fmt.Sprintf("uptime_in_seconds:%d", int64(time.Since(s.startTime).Seconds())),
+	}
+}
+
+// mode names how the server runs: standalone, cluster or sentinel
+func (s *Server) mode() string {
+	switch {
+	case s.sentinel != nil:
+		return "sentinel"
+	case s.config.ClusterEnabled:
+		return "cluster"
+	}
+	return "standalone"
+}
+
+// infoClients renders the Clients section
+func (s *Server) infoClients() []string {
+	return []string{
+		fmt.Sprintf("connected_clients:%d", s.connManager.GetActiveCount()),
+		fmt.Sprintf("maxclients:%d", s.config.MaxClients),
+	}
+}
+
+// infoPersistence renders the Persistence section
+func (s *Server) infoPersistence() []string {
+	lines := []string{
+		"loading:0",
+		fmt.Sprintf("rdb_changes_since_last_save:%d", s.dirty.Load()),
+		fmt.Sprintf("rdb_bgsave_in_progress:%d", boolToInt(s.bgsaveInProgress.Load())),
+		fmt.Sprintf("rdb_last_save_time:%d", s.lastSave.Load()),
+		fmt.Sprintf("rdb_last_bgsave_status:%s", okOrErr(s.lastBgsaveOK.Load())),
+		fmt.Sprintf("aof_enabled:%d", boolToInt(s.aof != nil)),
+	}
+	if s.aof != nil {
+		lines = append(lines,
+			fmt.Sprintf("aof_last_write_status:%s", okOrErr(s.aof.LastError() == nil)),
+			fmt.Sprintf("aof_fsync_policy:%s", s.aof.Policy()),
+			fmt.Sprintf("aof_rewrite_in_progress:%d", boolToInt(s.aofRewriteInProgress.Load())),
+			fmt.Sprintf("aof_last_bgrewrite_status:%s", okOrErr(s.lastBgrewriteOK.Load())),
+			fmt.Sprintf("aof_current_size:%d", s.aof.Size()),
+			fmt.Sprintf("aof_base_size:%d", s.aof.BaseSize()),
+		)
+	}
+	return lines
+}
+
+// infoStorage renders the Storage section, with the write status and the
+// statistics of engines that report them
+func (s *Server) infoStorage() []string {
+	lines := []string{fmt.Sprintf("storage_engine:%s", s.storageEngine())}
+	lines = append(lines, fmt.Sprintf("storage_last_write_status:%s", okOrErr(s.storageError() == nil)))
+	if reporter, ok := s.store.(store.Reporter); ok {
+		lines = append(lines, reporter.Info()...)
+	}
+	return lines
+}
+
+// boolToInt renders a flag as 0 or 1
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// okOrErr renders a status as ok or err
+func okOrErr(ok bool) string {
+	if ok {
+		return "ok"
+	}
+	return "err"
+}
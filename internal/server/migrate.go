@@ -0,0 +1,327 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"redis-like-server/internal/client"
+	"redis-like-server/internal/rdb"
+	"redis-like-server/internal/resp2"
+)
+
+// migrateDefaultTimeout is the timeout of MIGRATE when given as 0
+const migrateDefaultTimeout = time.Second
+
+// Connections to MIGRATE targets are cached for the next MIGRATE, as Redis
+// does: at most migrateSocketsMax of them, each closed once idle for
+// migrateSocketTTL
+const (
+	migrateSocketsMax = 64
+	migrateSocketTTL  = 10 * time.Second
+)
+
+// migrateOptions holds the parsed arguments of a MIGRATE command
+type migrateOptions struct {
+	addr    string
+	timeout time.Duration
+	copy    bool
+	replace bool
+	// auth holds the arguments of the AUTH sent to the target first, if any
+	auth []string
+	keys []string
+}
+
+// parseMigrate parses MIGRATE host port key|"" destination-db timeout
+// [COPY] [REPLACE] [AUTH password | AUTH2 username password] [KEYS key...],
+// returning the error reply Redis would give for invalid arguments
+func parseMigrate(args []string) (*migrateOptions, *resp2.RESPValue) {
+	if len(args) < 5 {
+		return nil, wrongArgs("MIGRATE")
+	}
+	port, err := strconv.Atoi(args[1])
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, &resp2.RESPValue{Type: resp2.Error, Str: "ERR Invalid port"}
+	}
+	db, err := strconv.Atoi(args[3])
+	if err != nil {
+		return nil, &resp2.RESPValue{Type: resp2.Error, Str: "ERR value is not an integer or out of range"}
+	}
+	if db != 0 {
+		return nil, &resp2.RESPValue{Type: resp2.Error, Str: "ERR DB index is out of range"}
+	}
+	timeout, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil {
+		return nil, &resp2.RESPValue{Type: resp2.Error, Str: "ERR value is not an integer or out of range"}
+	}
+
+	opts := &migrateOptions{
+		addr:    net.JoinHostPort(args[0], args[1]),
+		timeout: time.Duration(timeout) * time.Millisecond,
+	}
+	if timeout <= 0 {
+		opts.timeout = migrateDefaultTimeout
+	}
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COPY":
+			opts.copy = true
+		case "REPLACE":
+			opts.replace = true
+		case "AUTH":
+			if i+1 >= len(args) {
+				return nil, &resp2.RESPValue{Type: resp2.Error, Str: "ERR syntax error"}
+			}
+			opts.auth = args[i+1 : i+2]
+			i++
+		case "AUTH2":
+			if i+2 >= len(args) {
+				return nil, &resp2.RESPValue{Type: resp2.Error, Str: "ERR syntax error"}
+			}
+			opts.auth = args[i+1 : i+3]
+			i += 2
+		case "KEYS":
+			if args[2] != "" {
+				return nil, &resp2.RESPValue{
+					Type: resp2.Error,
+					Str:  "ERR When using MIGRATE KEYS option, the key argument must be set to the empty string",
+				}
+			}
+			opts.keys = args[i+1:]
+			i = len(args)
+		default:
+			return nil, &resp2.RESPValue{Type: resp2.Error, Str: "ERR syntax error"}
+		}
+	}
+	if opts.keys == nil {
+		opts.keys = []string{args[2]}
+	}
+	return opts, nil
+}
+
+// migrateEntry is a key read for migration with its expiry
+type migrateEntry struct {
+	key      string
+	value    string
+	expireAt int64
+}
+
+// handleMigrate handles MIGRATE, which moves keys to another instance:
+// each key is sent as a RESTORE, or a RESTORE-ASKING in cluster mode so a
+// node importing the slot accepts it, and deleted here once restored
+// unless COPY is given. Writes wait meanwhile, so no key changes between
+// being sent and being deleted.
+func (s *Server) handleMigrate(args []string) *resp2.RESPValue {
+	opts, errReply := parseMigrate(args)
+	if errReply != nil {
+		return errReply
+	}
+	// Deleting the migrated keys would bypass the Raft log
+	if s.raft != nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR MIGRATE not allowed in Raft mode."}
+	}
+	// MIGRATE is a write even with COPY, as in Redis
+	if refusal := s.checkWritable(); refusal != nil {
+		return refusal
+	}
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	var entries []migrateEntry
+	for _, key := range opts.keys {
+		value, exists := s.store.Get(key)
+		expireAt, live := s.store.ExpireAt(key)
+		if exists && live {
+			entries = append(entries, migrateEntry{key: key, value: value, expireAt: expireAt})
+		}
+	}
+	if len(entries) == 0 {
+		return &resp2.RESPValue{Type: resp2.SimpleString, Str: "NOKEY"}
+	}
+
+	restored, err := s.migrateEntries(opts, entries)
+	if len(restored) > 0 && !opts.copy {
+		s.executeWrite(&resp2.Command{Name: "DEL", Args: restored})
+	}
+	var replyErr client.ReplyError
+	switch {
+	case errors.As(err, &replyErr):
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR Target instance replied with error: " + string(replyErr)}
+	case err != nil:
+		return &resp2.RESPValue{Type: resp2.Error, Str: fmt.Sprintf("IOERR error or timeout migrating to target instance: %v", err)}
+	}
+	return &resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"}
+}
+
+// migrateEntries restores entries on the target, returning the keys
+// restored. A key the target refuses is kept and the others still sent;
+// the error returned is the first one. A connection taken from the cache
+// may have been closed by the target meanwhile, so when it fails before
+// any reply the entries are sent again on a new connection.
+func (s *Server) migrateEntries(opts *migrateOptions, entries []migrateEntry) ([]string, error) {
+	for {
+		target, cached, err := s.migrateSockets.get(opts.addr, opts.timeout)
+		if err != nil {
+			return nil, err
+		}
+		restored, replied, err := s.restoreEntries(target, opts, entries)
+		var replyErr client.ReplyError
+		if err != nil && !errors.As(err, &replyErr) {
+			target.Close()
+			var netErr net.Error
+			if cached && !replied && !(errors.As(err, &netErr) && netErr.Timeout()) {
+				continue
+			}
+			return restored, err
+		}
+		s.migrateSockets.put(opts.addr, target)
+		return restored, err
+	}
+}
+
+// restoreEntries sends the AUTH of opts and a RESTORE of each entry to
+// target, returning the keys restored and whether the target replied at
+// all
+func (s *Server) restoreEntries(target *client.Client, opts *migrateOptions, entries []migrateEntry) ([]string, bool, error) {
+	if opts.auth != nil {
+		if _, err := target.Do("AUTH", opts.auth...); err != nil {
+			var replyErr client.ReplyError
+			return nil, errors.As(err, &replyErr), err
+		}
+	}
+
+	restore := "RESTORE"
+	if s.cluster != nil {
+		restore = "RESTORE-ASKING"
+	}
+	var restored []string
+	var firstErr error
+	replied := opts.auth != nil
+	for _, entry := range entries {
+		payload, err := rdb.Dump(rdb.Entry{Type: rdb.TypeString, Value: entry.value})
+		if err != nil {
+			return restored, replied, err
+		}
+		ttl := "0"
+		if entry.expireAt != 0 {
+			ttl = strconv.FormatInt(entry.expireAt, 10)
+		}
+		restoreArgs := []string{entry.key, ttl, string(payload), "ABSTTL"}
+		if opts.replace {
+			restoreArgs = append(restoreArgs, "REPLACE")
+		}
+		_, err = target.Do(restore, restoreArgs...)
+		var replyErr client.ReplyError
+		switch {
+		case errors.As(err, &replyErr):
+			if firstErr == nil {
+				firstErr = err
+			}
+		case err != nil:
+			return restored, replied, err
+		default:
+			restored = append(restored, entry.key)
+		}
+		replied = true
+	}
+	return restored, replied, firstErr
+}
+
+// migrateCache holds the idle connections to MIGRATE targets by address.
+// A connection is taken out while a MIGRATE uses it, so the cache only
+// ever closes idle ones.
+type migrateCache struct {
+	mutex sync.Mutex
+	conns map[string]*migrateSocket
+}
+
+// migrateSocket is a cached connection and when it was last used
+type migrateSocket struct {
+	client   *client.Client
+	lastUsed time.Time
+}
+
+// newMigrateCache returns an empty cache
+func newMigrateCache() *migrateCache {
+	return &migrateCache{conns: make(map[string]*migrateSocket)}
+}
+
+// get takes the cached connection to addr, or dials one when there is
+// none or the target closed it, and sets its timeout; cached reports
+// whether it was in the cache
+func (c *migrateCache) get(addr string, timeout time.Duration) (*client.Client, bool, error) {
+	c.mutex.Lock()
+	socket, cached := c.conns[addr]
+	delete(c.conns, addr)
+	c.mutex.Unlock()
+	if cached && socket.client.Idle() {
+		socket.client.SetTimeout(timeout)
+		return socket.client, true, nil
+	}
+	if cached {
+		socket.client.Close()
+	}
+	target, err := client.Dial(addr, timeout)
+	return target, false, err
+}
+
+// put caches the connection to addr once a MIGRATE is done with it,
+// making room by closing another when the cache is full
+func (c *migrateCache) put(addr string, target *client.Client) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if old, ok := c.conns[addr]; ok {
+		old.client.Close()
+		delete(c.conns, addr)
+	}
+	if len(c.conns) >= migrateSocketsMax {
+		for other, socket := range c.conns {
+			socket.client.Close()
+			delete(c.conns, other)
+			break
+		}
+	}
+	c.conns[addr] = &migrateSocket{client: target, lastUsed: time.Now()}
+}
+
+// closeIdle closes the connections unused for longer than ttl, or all of
+// them when ttl is 0
+func (c *migrateCache) closeIdle(ttl time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for addr, socket := range c.conns {
+		if ttl == 0 || time.Since(socket.lastUsed) > ttl {
+			socket.client.Close()
+			delete(c.conns, addr)
+		}
+	}
+}
+
+// size returns how many connections are cached
+func (c *migrateCache) size() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.conns)
+}
+
+// migrateCron closes the cached MIGRATE connections left idle
+func (s *Server) migrateCron() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			s.migrateSockets.closeIdle(0)
+			return
+		case <-ticker.C:
+			s.migrateSockets.closeIdle(migrateSocketTTL)
+		}
+	}
+}
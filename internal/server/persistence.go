@@ -0,0 +1,852 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"redis-like-server/internal/aof"
+	"redis-like-server/internal/crypt"
+	"redis-like-server/internal/handler"
+	"redis-like-server/internal/rdb"
+	"redis-like-server/internal/resp2"
+	"redis-like-server/internal/store"
+)
+
+// bgsaveRetryDelay is how long automatic saves wait after a failed attempt
+const bgsaveRetryDelay = 5 * time.Second
+
+// tempFileCounter makes temporary snapshot file names unique within the process
+var tempFileCounter atomic.Int64
+
+// SaveRule triggers a background save once Seconds have elapsed since the
+// last save and at least Changes writes have happened
+type SaveRule struct {
+	Seconds int
+	Changes int64
+}
+
+// ParseSaveRules parses a "<seconds> <changes> ..." specification; an empty
+// string disables automatic saving
+func ParseSaveRules(spec string) ([]SaveRule, error) {
+	fields := strings.Fields(spec)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid save rules %q: expected <seconds> <changes> pairs", spec)
+	}
+
+	rules := make([]SaveRule, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.Atoi(fields[i])
+		if err != nil || seconds < 1 {
+			return nil, fmt.Errorf("invalid save rules %q: bad seconds %q", spec, fields[i])
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes < 0 {
+			return nil, fmt.Errorf("invalid save rules %q: bad changes %q", spec, fields[i+1])
+		}
+		rules = append(rules, SaveRule{Seconds: seconds, Changes: changes})
+	}
+	return rules, nil
+}
+
+// formatSaveRules renders save rules in the CONFIG GET save format
+func formatSaveRules(rules []SaveRule) string {
+	parts := make([]string, 0, 2*len(rules))
+	for _, rule := range rules {
+		parts = append(parts, strconv.Itoa(rule.Seconds), strconv.FormatInt(rule.Changes, 10))
+	}
+	return strings.Join(parts, " ")
+}
+
+// snapshotEnabled reports whether a snapshot file is configured
+func (s *Server) snapshotEnabled() bool {
+	return s.config.DBFilename != ""
+}
+
+// snapshotPath returns the path of the snapshot file
+func (s *Server) snapshotPath() string {
+	return filepath.Join(s.config.Dir, s.config.DBFilename)
+}
+
+// loadSnapshot loads the snapshot file into the store, if one exists
+func (s *Server) loadSnapshot() error {
+	if !s.snapshotEnabled() {
+		return nil
+	}
+	if _, err := os.Stat(s.snapshotPath()); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return s.loadRDBFile(s.snapshotPath())
+}
+
+// loadRDBFile loads an RDB file into the store
+func (s *Server) loadRDBFile(path string) error {
+	report, err := readSnapshot(path, s.config.Encryption, func(entry rdb.Entry) {
+		s.store.SetWithExpiry(entry.Key, entry.Value, entry.ExpireAt)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Loaded %d keys from %s\n", report.Keys, path)
+	if warning := report.SkippedWarning(); warning != "" {
+		fmt.Println(warning)
+	}
+	return nil
+}
+
+// SnapshotReport summarizes an RDB file as the server would load it
+type SnapshotReport struct {
+	Version int
+	Aux     map[string]string
+	// Keys counts the keys that would be loaded, Expires those of them with
+	// an expiry and Expired the keys skipped because they already expired
+	Keys    int
+	Expires int
+	Expired int
+	// OtherTypes counts the keys skipped because they hold a type other
+	// than string, and OtherDBs those skipped because they are outside
+	// database 0: the server holds neither
+	OtherTypes int
+	OtherDBs   int
+	Size       int64
+	// ValidSize is the length of the prefix made of complete records; on
+	// failure it is where the problem starts. For an encrypted file it
+	// counts decrypted bytes.
+	ValidSize int64
+	Encrypted bool
+}
+
+// SkippedWarning returns the warning about the keys skipped because the
+// server cannot hold them, or "" when none was
+func (r SnapshotReport) SkippedWarning() string {
+	if r.OtherTypes == 0 && r.OtherDBs == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Warning: skipped %d keys of a type other than string and %d keys outside database 0", r.OtherTypes, r.OtherDBs)
+}
+
+// CheckSnapshot validates an RDB file without loading it, applying the same
+// rules as loading it at startup and decrypting it with keyring if needed
+func CheckSnapshot(path string, keyring *crypt.Keyring) (SnapshotReport, error) {
+	return readSnapshot(path, keyring, func(rdb.Entry) {})
+}
+
+// readSnapshot decodes an RDB file, decrypting it with keyring if it is
+// encrypted, and passes each key the server can load to load. Keys that
+// already expired are skipped, and so are keys outside database 0 or of a
+// type other than string, counted in the report.
+func readSnapshot(path string, keyring *crypt.Keyring, load func(rdb.Entry)) (SnapshotReport, error) {
+	var report SnapshotReport
+	file, err := os.Open(path)
+	if err != nil {
+		return report, fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer file.Close()
+	if info, err := file.Stat(); err == nil {
+		report.Size = info.Size()
+	}
+
+	source, decrypted, err := crypt.Plaintext(file, keyring)
+	if err != nil {
+		report.Encrypted = errors.Is(err, crypt.ErrNoKey) || errors.Is(err, crypt.ErrUnknownKey)
+		return report, fmt.Errorf("failed to load snapshot %s: %w", path, err)
+	}
+	report.Encrypted = decrypted != nil
+	if err := decodeSnapshot(source, &report, load); err != nil {
+		return report, fmt.Errorf("failed to load snapshot %s: %w", path, err)
+	}
+	return report, nil
+}
+
+// decodeSnapshot decodes a plaintext RDB stream into report under the rules
+// of readSnapshot, passing each key the server can load to load
+func decodeSnapshot(source io.Reader, report *SnapshotReport, load func(rdb.Entry)) error {
+	now := time.Now().UnixMilli()
+	reader := rdb.NewReader(source)
+	err := reader.Load(func(entry rdb.Entry) error {
+		if entry.DB != 0 {
+			report.OtherDBs++
+			return nil
+		}
+		if entry.ExpireAt != 0 && entry.ExpireAt <= now {
+			report.Expired++
+			return nil
+		}
+		if entry.Type != rdb.TypeString {
+			report.OtherTypes++
+			return nil
+		}
+		load(entry)
+		report.Keys++
+		if entry.ExpireAt != 0 {
+			report.Expires++
+		}
+		return nil
+	})
+	report.Version = reader.Version()
+	report.Aux = reader.Aux()
+	report.ValidSize = reader.ValidSize()
+	if err != nil {
+		return err
+	}
+	report.ValidSize = reader.Offset()
+	return nil
+}
+
+// saveSnapshot writes the current dataset to the snapshot file. The file is
+// written to a temporary name and renamed into place so a crash never leaves
+// a partially written snapshot behind.
+func (s *Server) saveSnapshot() error {
+	s.saveMutex.Lock()
+	defer s.saveMutex.Unlock()
+
+	// Writes keep going while the frozen view is written out
+	dirtyBefore := s.dirty.Load()
+	view := s.store.View()
+	defer view.Release()
+
+	tempPath := filepath.Join(s.config.Dir, fmt.Sprintf("temp-%d-%d.rdb", os.Getpid(), tempFileCounter.Add(1)))
+	if err := writeFileAtomic(tempPath, s.snapshotPath(), func(w io.Writer) error {
+		return s.encodeSnapshot(w, view)
+	}); err != nil {
+		return err
+	}
+
+	s.dirty.Add(-dirtyBefore)
+	s.lastSave.Store(time.Now().Unix())
+	return nil
+}
+
+// encodeSnapshot writes a frozen view of the dataset as an RDB file,
+// encrypted with the current key when encryption is enabled
+func (s *Server) encodeSnapshot(w io.Writer, view store.View) error {
+	key := s.config.Encryption.Current()
+	if key == nil {
+		return writeRDB(w, view)
+	}
+	encrypted, err := crypt.NewWriter(w, key)
+	if err != nil {
+		return err
+	}
+	if err := writeRDB(encrypted, view); err != nil {
+		return err
+	}
+	return encrypted.Close()
+}
+
+// writeRDB encodes a frozen view of the dataset as an RDB file
+func writeRDB(w io.Writer, view store.View) error {
+	// The resize hint needs the counts up front; the view cannot change
+	// between the two passes
+	keys, expires := 0, 0
+	view.Range(func(key string, item store.Item) bool {
+		keys++
+		if item.ExpireAt != 0 {
+			expires++
+		}
+		return true
+	})
+	if err := view.Err(); err != nil {
+		return err
+	}
+
+	writer := rdb.NewWriter(w)
+	writer.WriteHeader()
+	writer.WriteAux("redis-ver", "7.2.0")
+	writer.WriteAux("redis-bits", "64")
+	writer.WriteAux("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	writer.WriteSelectDB(0)
+	writer.WriteResizeDB(keys, expires)
+	var err error
+	view.Range(func(key string, item store.Item) bool {
+		err = writer.WriteEntry(rdb.Entry{Key: key, Value: item.Value, ExpireAt: item.ExpireAt})
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := view.Err(); err != nil {
+		return err
+	}
+	return writer.WriteEOF()
+}
+
+// writeFileAtomic writes a file via a temporary path, fsyncs it and renames it
+// over the final path, then fsyncs the directory so the rename is durable
+func writeFileAtomic(tempPath, finalPath string, write func(io.Writer) error) error {
+	err := writeFileSynced(tempPath, write)
+	if err == nil {
+		err = os.Rename(tempPath, finalPath)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write %s: %w", finalPath, err)
+	}
+
+	if dir, err := os.Open(filepath.Dir(finalPath)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// writeFileSynced creates a file, fills it through write and fsyncs it
+func writeFileSynced(path string, write func(io.Writer) error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+
+	err = write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// startBackgroundSave starts a snapshot in a background goroutine, returning
+// false if one is already running
+func (s *Server) startBackgroundSave() bool {
+	if !s.bgsaveInProgress.CompareAndSwap(false, true) {
+		return false
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.bgsaveInProgress.Store(false)
+
+		if err := s.saveSnapshot(); err != nil {
+			fmt.Printf("Background saving error: %v\n", err)
+			s.lastBgsaveOK.Store(false)
+			return
+		}
+		s.lastBgsaveOK.Store(true)
+	}()
+	return true
+}
+
+// persistenceCron triggers background saves when a save rule is satisfied
+// and background AOF rewrites when the append-only file has grown enough
+func (s *Server) persistenceCron() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var lastSaveAttempt, lastRewriteAttempt time.Time
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if s.snapshotEnabled() {
+			s.checkSaveRules(&lastSaveAttempt)
+		}
+		if s.aof != nil {
+			s.checkAOFRewrite(&lastRewriteAttempt)
+		}
+	}
+}
+
+// checkSaveRules starts a background save if a save rule is satisfied
+func (s *Server) checkSaveRules(lastAttempt *time.Time) {
+	if s.bgsaveInProgress.Load() {
+		return
+	}
+	// After a failure, wait before retrying so a full disk is not hammered
+	if !s.lastBgsaveOK.Load() && time.Since(*lastAttempt) < bgsaveRetryDelay {
+		return
+	}
+
+	elapsed := time.Now().Unix() - s.lastSave.Load()
+	dirty := s.dirty.Load()
+	for _, rule := range s.getSaveRules() {
+		if dirty >= rule.Changes && elapsed >= int64(rule.Seconds) {
+			fmt.Printf("%d changes in %d seconds. Saving...\n", rule.Changes, rule.Seconds)
+			*lastAttempt = time.Now()
+			s.startBackgroundSave()
+			return
+		}
+	}
+}
+
+// checkAOFRewrite starts a background rewrite once the append-only file has
+// grown by auto-aof-rewrite-percentage over its base and is at least
+// auto-aof-rewrite-min-size bytes
+func (s *Server) checkAOFRewrite(lastAttempt *time.Time) {
+	percentage := s.autoAOFRewritePercentage.Load()
+	if percentage == 0 || s.aofRewriteInProgress.Load() {
+		return
+	}
+	if !s.lastBgrewriteOK.Load() && time.Since(*lastAttempt) < bgsaveRetryDelay {
+		return
+	}
+
+	size := s.aof.Size()
+	if size < s.autoAOFRewriteMinSize.Load() {
+		return
+	}
+	base := s.aof.BaseSize()
+	if base == 0 {
+		base = 1
+	}
+	if growth := (size - base) * 100 / base; growth >= percentage {
+		fmt.Printf("Starting automatic rewriting of AOF on %d%% growth\n", growth)
+		*lastAttempt = time.Now()
+		s.startBackgroundRewrite()
+	}
+}
+
+// getSaveRules returns the active automatic save rules
+func (s *Server) getSaveRules() []SaveRule {
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
+	return s.saveRules
+}
+
+// setSaveRules replaces the active automatic save rules
+func (s *Server) setSaveRules(rules []SaveRule) {
+	s.configMutex.Lock()
+	defer s.configMutex.Unlock()
+	s.saveRules = rules
+}
+
+// handleSave handles the SAVE command
+func (s *Server) handleSave(args []string) *resp2.RESPValue {
+	if len(args) != 0 {
+		return wrongArgs("SAVE")
+	}
+	if !s.snapshotEnabled() {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR snapshotting is disabled: no dbfilename configured"}
+	}
+	if s.bgsaveInProgress.Load() {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR Background save already in progress"}
+	}
+	if err := s.saveSnapshot(); err != nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: fmt.Sprintf("ERR %v", err)}
+	}
+	return &resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"}
+}
+
+// handleBgsave handles the BGSAVE command
+func (s *Server) handleBgsave(args []string) *resp2.RESPValue {
+	if len(args) > 1 || (len(args) == 1 && strings.ToUpper(args[0]) != "SCHEDULE") {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR syntax error"}
+	}
+	if !s.snapshotEnabled() {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR snapshotting is disabled: no dbfilename configured"}
+	}
+	if !s.startBackgroundSave() {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR Background save already in progress"}
+	}
+	return &resp2.RESPValue{Type: resp2.SimpleString, Str: "Background saving started"}
+}
+
+// handleLastsave handles the LASTSAVE command
+func (s *Server) handleLastsave(args []string) *resp2.RESPValue {
+	if len(args) != 0 {
+		return wrongArgs("LASTSAVE")
+	}
+	return &resp2.RESPValue{Type: resp2.Integer, Int: s.lastSave.Load()}
+}
+
+// aofPath returns the path of the legacy single-file append-only file,
+// which is upgraded into the append-only directory on startup
+func (s *Server) aofPath() string {
+	return filepath.Join(s.config.Dir, s.aofBasename())
+}
+
+// aofBasename returns the base name shared by the append-only file parts
+func (s *Server) aofBasename() string {
+	if s.config.AppendFilename == "" {
+		return "appendonly.aof"
+	}
+	return s.config.AppendFilename
+}
+
+// aofDir returns the directory holding the multi-part append-only file
+func (s *Server) aofDir() string {
+	dirname := s.config.AppendDirname
+	if dirname == "" {
+		dirname = "appendonlydir"
+	}
+	return filepath.Join(s.config.Dir, dirname)
+}
+
+// loadData restores the dataset at startup. When the append-only file is
+// enabled and present it is the authoritative source; otherwise the
+// snapshot is loaded.
+func (s *Server) loadData() error {
+	if s.config.RecoveryTarget != nil {
+		return s.recoverData()
+	}
+	if s.config.AppendOnly {
+		if err := s.initAppendOnlyFile(); err != nil {
+			return err
+		}
+	}
+	// A persistent storage engine already holds the dataset
+	if keys := countKeys(s.store); keys > 0 {
+		fmt.Printf("Loaded %d keys from the %s storage engine\n", keys, s.storageEngine())
+		return s.reencryptSnapshot()
+	}
+	if s.config.AppendOnly && !s.aof.Empty() {
+		if err := s.loadAppendOnlyFile(); err != nil {
+			return err
+		}
+		return s.reencryptSnapshot()
+	}
+	if err := s.loadSnapshot(); err != nil {
+		return err
+	}
+	return s.reencryptSnapshot()
+}
+
+// countKeys counts the live keys of a store, without reading the values
+// when the engine can count them from its index
+func countKeys(kv store.KeyValueStore) int {
+	if counter, ok := kv.(interface{ Len() int }); ok {
+		return counter.Len()
+	}
+	view := kv.View()
+	defer view.Release()
+	keys := 0
+	view.Range(func(string, store.Item) bool {
+		keys++
+		return true
+	})
+	return keys
+}
+
+// storageEngine returns the name of the configured storage engine
+func (s *Server) storageEngine() string {
+	if s.config.StorageEngine == "" {
+		return store.EngineMemory
+	}
+	return strings.ToLower(s.config.StorageEngine)
+}
+
+// storageError returns the error of the last failed write of the storage
+// engine while it has not recovered, or nil
+func (s *Server) storageError() error {
+	if reporter, ok := s.store.(store.ErrorReporter); ok {
+		return reporter.LastError()
+	}
+	return nil
+}
+
+// storageDir returns the directory of a persistent storage engine
+func (s *Server) storageDir() string {
+	dir := s.config.StorageDir
+	if dir == "" {
+		dir = "storage"
+	}
+	if filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(s.config.Dir, dir)
+}
+
+// tieredMemoryLimit returns the memory limit of the tiered engine
+func (s *Server) tieredMemoryLimit() int64 {
+	if s.config.TieredMemoryLimit <= 0 {
+		return store.DefaultMemoryLimit
+	}
+	return s.config.TieredMemoryLimit
+}
+
+// tieredPolicy returns the tiering policy of the tiered engine
+func (s *Server) tieredPolicy() string {
+	if s.config.TieredPolicy == "" {
+		return store.PolicyLFU
+	}
+	return strings.ToLower(s.config.TieredPolicy)
+}
+
+// openStore opens the configured storage engine. When recovering to a point
+// in time, the recovered dataset replaces whatever the engine held, so its
+// directory is moved aside first.
+func (s *Server) openStore() (store.KeyValueStore, error) {
+	if s.config.RecoveryTarget != nil {
+		if _, err := os.Stat(s.storageDir()); err == nil {
+			aside := fmt.Sprintf("%s.before-recovery-%d", s.storageDir(), time.Now().Unix())
+			if err := os.Rename(s.storageDir(), aside); err != nil {
+				return nil, fmt.Errorf("failed to move the storage directory aside: %w", err)
+			}
+			s.storageAside = aside
+		}
+	}
+	kv, err := store.Open(s.storageEngine(), store.Options{
+		Dir:           s.storageDir(),
+		MemoryLimit:   s.config.TieredMemoryLimit,
+		TieringPolicy: s.config.TieredPolicy,
+	})
+	if err != nil {
+		s.restoreStorage()
+		return nil, err
+	}
+	return kv, nil
+}
+
+// restoreStorage puts back a storage directory moved aside for a recovery
+// that did not complete
+func (s *Server) restoreStorage() {
+	if s.storageAside == "" {
+		return
+	}
+	if s.store != nil {
+		s.store.Close()
+	}
+	os.RemoveAll(s.storageDir())
+	if err := os.Rename(s.storageAside, s.storageDir()); err != nil {
+		fmt.Printf("Failed to restore the storage directory from %s: %v\n", s.storageAside, err)
+		return
+	}
+	s.storageAside = ""
+}
+
+// reencryptSnapshot saves the loaded dataset over a snapshot file that is
+// not encrypted with the current key, so enabling encryption or rotating
+// the key leaves no data on disk under the old setting
+func (s *Server) reencryptSnapshot() error {
+	if !s.snapshotEnabled() {
+		return nil
+	}
+	current, err := s.config.Encryption.CurrentFor(s.snapshotPath())
+	if errors.Is(err, os.ErrNotExist) || (err == nil && current) {
+		return nil
+	}
+	fmt.Printf("Rewriting %s with the current encryption settings\n", s.snapshotPath())
+	return s.saveSnapshot()
+}
+
+// initAppendOnlyFile opens the multi-part append-only file for loading and
+// later appending
+func (s *Server) initAppendOnlyFile() error {
+	file, err := aof.OpenMultiPart(s.aofDir(), s.aofBasename(), s.config.AppendFsync, s.aofPath())
+	if err != nil {
+		return err
+	}
+	file.SetTimestamps(s.aofTimestampEnabled.Load())
+	file.SetKeyring(s.config.Encryption)
+	s.aof = file
+	return nil
+}
+
+// recoverData rebuilds the dataset from the append-only file up to the
+// recovery target. Replaying the log again would bring back what followed
+// the target, so the old append-only directory is moved aside and the
+// recovered dataset is saved as the snapshot and, with appendonly enabled,
+// as the base of a fresh append-only file.
+func (s *Server) recoverData() error {
+	if _, err := s.replayToTarget(s.config.RecoveryTarget, s.config.AOFLoadTruncated); err != nil {
+		s.restoreStorage()
+		return err
+	}
+	if s.storageAside != "" {
+		fmt.Printf("Moved the original storage directory to %s\n", s.storageAside)
+	}
+
+	aside := fmt.Sprintf("%s.before-recovery-%d", s.aofDir(), time.Now().Unix())
+	if err := os.Rename(s.aofDir(), aside); err != nil {
+		return fmt.Errorf("failed to move the recovered append only directory aside: %w", err)
+	}
+	fmt.Printf("Moved the original append only directory to %s\n", aside)
+
+	if s.snapshotEnabled() {
+		if err := s.saveSnapshot(); err != nil {
+			return fmt.Errorf("failed to save the recovered dataset: %w", err)
+		}
+	}
+	if s.config.AppendOnly {
+		return s.initAppendOnlyFile()
+	}
+	if !s.snapshotEnabled() && s.storageEngine() == store.EngineMemory {
+		fmt.Println("!!! Warning: neither snapshots nor the append only file are enabled, the recovered dataset only lives in memory")
+	}
+	return nil
+}
+
+// replayToTarget loads the append-only file into the store up to target
+// without modifying it
+func (s *Server) replayToTarget(target *aof.Target, allowTruncated bool) (aof.LoadResult, error) {
+	file, err := aof.OpenReadOnly(s.aofDir(), s.aofBasename())
+	if err != nil {
+		return aof.LoadResult{}, err
+	}
+	file.SetKeyring(s.config.Encryption)
+	if file.Empty() {
+		return aof.LoadResult{}, fmt.Errorf("point-in-time recovery needs an append only file in %s", s.aofDir())
+	}
+
+	result, err := file.LoadUntil(s.loadRDBFile, s.replayCommand, allowTruncated, target)
+	if err != nil {
+		return result, fmt.Errorf("failed to recover from %s to %s: %w", s.aofDir(), target, err)
+	}
+	fmt.Printf("Recovered to %s: replayed %d commands up to offset %d", target, result.Commands, result.ValidSize)
+	if result.Timestamp != 0 {
+		fmt.Printf(", last logged at %s", time.Unix(result.Timestamp, 0).Format(time.DateTime))
+	}
+	if !result.Reached {
+		fmt.Print(", the end of the log")
+	}
+	fmt.Println()
+	return result, nil
+}
+
+// RecoverToFile rebuilds the dataset from the append-only file described by
+// config up to target and writes it as an RDB file at output. The
+// append-only file is only read, so a server may keep using it meanwhile.
+func RecoverToFile(config *ServerConfig, target *aof.Target, output string) (aof.LoadResult, error) {
+	s := NewServer(config)
+	s.store = store.NewInMemoryStore()
+	s.handler = handler.NewCommandHandler(s.store)
+
+	result, err := s.replayToTarget(target, true)
+	if err != nil {
+		return result, err
+	}
+
+	view := s.store.View()
+	defer view.Release()
+	tempPath := filepath.Join(filepath.Dir(output), fmt.Sprintf("temp-%d-%s", os.Getpid(), filepath.Base(output)))
+	return result, writeFileAtomic(tempPath, output, func(w io.Writer) error {
+		return s.encodeSnapshot(w, view)
+	})
+}
+
+// loadAppendOnlyFile replays the base and incremental files into the store
+func (s *Server) loadAppendOnlyFile() error {
+	result, err := s.aof.Load(s.loadRDBFile, s.replayCommand, s.config.AOFLoadTruncated)
+	if err != nil {
+		if errors.Is(err, aof.ErrTruncated) {
+			return fmt.Errorf("failed to load append only file from %s: %w; enable aof-load-truncated or repair it with check-aof -fix", s.aofDir(), err)
+		}
+		return fmt.Errorf("failed to load append only file from %s: %w", s.aofDir(), err)
+	}
+	if result.Truncated {
+		fmt.Printf("!!! Warning: short read while loading the AOF file from %s!!!\n", s.aofDir())
+		fmt.Printf("AOF loaded anyway because aof-load-truncated is enabled\n")
+	}
+	fmt.Printf("Replayed %d commands from %s\n", result.Commands, s.aofDir())
+	return nil
+}
+
+// replayCommand applies a logged write command to the store
+func (s *Server) replayCommand(cmd *resp2.Command) error {
+	if !handler.IsWriteCommand(cmd.Name) {
+		return fmt.Errorf("unexpected command '%s'", cmd.Name)
+	}
+	if response := s.handler.Execute(cmd); response.Type == resp2.Error {
+		return errors.New(response.Str)
+	}
+	return nil
+}
+
+// openAppendOnlyFile starts logging to the append-only file. When none
+// existed yet, the current dataset is first written as its base so that
+// the append-only file alone is enough to rebuild the data on the next start.
+// The same happens when the existing files are not encrypted with the
+// current key, which then replaces them.
+func (s *Server) openAppendOnlyFile() error {
+	if !s.aof.Empty() {
+		stale, err := s.aof.Stale()
+		if err != nil {
+			return err
+		}
+		if !stale {
+			return s.aof.OpenForAppend()
+		}
+		fmt.Println("Rewriting the append only file with the current encryption settings")
+	}
+	rewrite, view, err := s.beginAOFRewrite()
+	if err != nil {
+		return err
+	}
+	return s.finishAOFRewrite(rewrite, view)
+}
+
+// beginAOFRewrite switches logging to a new incremental file and freezes a
+// view of the dataset the new base is built from. Both happen under
+// writeMutex so every write lands either in the view or in the new file.
+func (s *Server) beginAOFRewrite() (*aof.Rewrite, store.View, error) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	rewrite, err := s.aof.BeginRewrite()
+	if err != nil {
+		return nil, nil, err
+	}
+	return rewrite, s.store.View(), nil
+}
+
+// finishAOFRewrite writes the frozen view as the new base, installs it and
+// releases the view
+func (s *Server) finishAOFRewrite(rewrite *aof.Rewrite, view store.View) error {
+	defer view.Release()
+	err := writeFileSynced(rewrite.TempPath(), func(w io.Writer) error {
+		return s.encodeSnapshot(w, view)
+	})
+	if err != nil {
+		s.aof.AbortRewrite(rewrite)
+		return fmt.Errorf("failed to write rewritten append only file: %w", err)
+	}
+	return s.aof.CompleteRewrite(rewrite)
+}
+
+// startBackgroundRewrite starts an AOF rewrite in a background goroutine,
+// returning false if one is already running
+func (s *Server) startBackgroundRewrite() bool {
+	if !s.aofRewriteInProgress.CompareAndSwap(false, true) {
+		return false
+	}
+
+	rewrite, view, err := s.beginAOFRewrite()
+	if err != nil {
+		fmt.Printf("Background append only file rewriting error: %v\n", err)
+		s.lastBgrewriteOK.Store(false)
+		s.aofRewriteInProgress.Store(false)
+		return true
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.aofRewriteInProgress.Store(false)
+
+		if err := s.finishAOFRewrite(rewrite, view); err != nil {
+			fmt.Printf("Background append only file rewriting error: %v\n", err)
+			s.lastBgrewriteOK.Store(false)
+			return
+		}
+		fmt.Println("Background AOF rewrite finished successfully")
+		s.lastBgrewriteOK.Store(true)
+	}()
+	return true
+}
+
+// handleBgrewriteaof handles the BGREWRITEAOF command
+func (s *Server) handleBgrewriteaof(args []string) *resp2.RESPValue {
+	if len(args) != 0 {
+		return wrongArgs("BGREWRITEAOF")
+	}
+	if s.aof == nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR append only file is disabled: enable appendonly to rewrite it"}
+	}
+	if !s.startBackgroundRewrite() {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR Background append only file rewriting already in progress"}
+	}
+	return &resp2.RESPValue{Type: resp2.SimpleString, Str: "Background append only file rewriting started"}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"redis-like-server/internal/connection"
+	"redis-like-server/internal/resp2"
+)
+
+// subscriberCommands lists the commands a client may issue while in subscriber mode
+var subscriberCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"UNSUBSCRIBE":  true,
+	"PSUBSCRIBE":   true,
+	"PUNSUBSCRIBE": true,
+	"PING":         true,
+	"QUIT":         true,
+}
+
+// handleSubscribe handles SUBSCRIBE commands
+func (s *Server) handleSubscribe(clientConn *connection.ClientConnection, args []string) *resp2.RESPValue {
+	if len(args) == 0 {
+		return wrongArgs("SUBSCRIBE")
+	}
+	s.connManager.GetPubSub().Subscribe(clientConn, args)
+	// Confirmations were written by the registry
+	return nil
+}
+
+// handleUnsubscribe handles UNSUBSCRIBE commands
+func (s *Server) handleUnsubscribe(clientConn *connection.ClientConnection, args []string) *resp2.RESPValue {
+	s.connManager.GetPubSub().Unsubscribe(clientConn, args)
+	// Confirmations were written by the registry
+	return nil
+}
+
+// handlePSubscribe handles PSUBSCRIBE commands
+func (s *Server) handlePSubscribe(clientConn *connection.ClientConnection, args []string) *resp2.RESPValue {
+	if len(args) == 0 {
+		return wrongArgs("PSUBSCRIBE")
+	}
+	s.connManager.GetPubSub().PSubscribe(clientConn, args)
+	// Confirmations were written by the registry
+	return nil
+}
+
+// handlePUnsubscribe handles PUNSUBSCRIBE commands
+func (s *Server) handlePUnsubscribe(clientConn *connection.ClientConnection, args []string) *resp2.RESPValue {
+	s.connManager.GetPubSub().PUnsubscribe(clientConn, args)
+	// Confirmations were written by the registry
+	return nil
+}
+
+// handlePublish handles PUBLISH commands
+func (s *Server) handlePublish(args []string) *resp2.RESPValue {
+	if len(args) != 2 {
+		return wrongArgs("PUBLISH")
+	}
+	receivers := s.connManager.GetPubSub().Publish(args[0], args[1])
+	return &resp2.RESPValue{
+		Type: resp2.Integer,
+		Int:  int64(receivers),
+	}
+}
+
+// handlePubSub handles the PUBSUB introspection command
+func (s *Server) handlePubSub(args []string) *resp2.RESPValue {
+	if len(args) == 0 {
+		return wrongArgs("PUBSUB")
+	}
+
+	registry := s.connManager.GetPubSub()
+	switch strings.ToUpper(args[0]) {
+	case "CHANNELS":
+		if len(args) > 2 {
+			return wrongArgs("PUBSUB|CHANNELS")
+		}
+		pattern := ""
+		if len(args) == 2 {
+			pattern = args[1]
+		}
+		channels := registry.Channels(pattern)
+		result := make([]resp2.RESPValue, len(channels))
+		for i, channel := range channels {
+			result[i] = resp2.RESPValue{Type: resp2.BulkString, Str: channel}
+		}
+		return &resp2.RESPValue{Type: resp2.Array, Array: result}
+	case "NUMSUB":
+		result := make([]resp2.RESPValue, 0, 2*(len(args)-1))
+		for _, channel := range args[1:] {
+			result = append(result,
+				resp2.RESPValue{Type: resp2.BulkString, Str: channel},
+				resp2.RESPValue{Type: resp2.Integer, Int: int64(registry.NumSub(channel))},
+			)
+		}
+		return &resp2.RESPValue{Type: resp2.Array, Array: result}
+	case "NUMPAT":
+		if len(args) != 1 {
+			return wrongArgs("PUBSUB|NUMPAT")
+		}
+		return &resp2.RESPValue{Type: resp2.Integer, Int: int64(registry.NumPat())}
+	default:
+		return &resp2.RESPValue{
+			Type: resp2.Error,
+			Str:  fmt.Sprintf("ERR unknown subcommand '%s'. Try PUBSUB HELP.", args[0]),
+		}
+	}
+}
+
+// handleSubscriberPing handles PING for a client in subscriber mode, which
+// replies with a ["pong", message] array instead of a simple string
+func (s *Server) handleSubscriberPing(args []string) *resp2.RESPValue {
+	if len(args) > 1 {
+		return wrongArgs("PING")
+	}
+	message := ""
+	if len(args) == 1 {
+		message = args[0]
+	}
+	return &resp2.RESPValue{
+		Type: resp2.Array,
+		Array: []resp2.RESPValue{
+			{Type: resp2.BulkString, Str: "pong"},
+			{Type: resp2.BulkString, Str: message},
+		},
+	}
+}
+
+// wrongArgs builds the standard wrong number of arguments error
+func wrongArgs(command string) *resp2.RESPValue {
+	return &resp2.RESPValue{
+		Type: resp2.Error,
+		Str:  fmt.Sprintf("ERR wrong number of arguments for '%s' command", command),
+	}
+}
@@ -0,0 +1,549 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"redis-like-server/internal/handler"
+	"redis-like-server/internal/raft"
+	"redis-like-server/internal/rdb"
+	"redis-like-server/internal/replication"
+	"redis-like-server/internal/resp2"
+)
+
+const (
+	// raftTickPeriod is how often the Raft node is told the time, which
+	// paces its heartbeats and elections
+	raftTickPeriod = 20 * time.Millisecond
+	// raftCommitTimeout is how long a client waits for its command to be
+	// committed and applied
+	raftCommitTimeout = 5 * time.Second
+	// raftCompactEntries is how many entries the log holds before it is
+	// compacted into a snapshot of the dataset
+	raftCompactEntries = 1000
+	// raftLinkQueue bounds the messages queued for a member; Raft sends
+	// again what is lost
+	raftLinkQueue = 1024
+)
+
+// raftState holds the Raft mode state. The node is stepped, ticked and
+// applied under writeMutex, so the dataset changes in log order.
+type raftState struct {
+	node    *raft.Node
+	storage *raft.FileStorage
+	// waiters are the clients waiting for the entry at their index to be
+	// applied, under writeMutex
+	waiters    map[uint64]raftWaiter
+	compacting atomic.Bool
+
+	mutex sync.Mutex
+	// links are the connections to the other members, and addrs the
+	// addresses nodes gave in their messages, by node ID; a node joining
+	// the group learns of the leader from its messages before it knows
+	// the members
+	links map[string]*raftLink
+	addrs map[string]string
+}
+
+// raftWaiter is a client waiting for the entry it proposed in term
+type raftWaiter struct {
+	term  uint64
+	reply chan *resp2.RESPValue
+}
+
+// raftLink carries the messages for a member, written by its own goroutine
+type raftLink struct {
+	addr    string
+	cancel  context.CancelFunc
+	mutex   sync.Mutex
+	pending [][]byte
+	wake    chan struct{}
+}
+
+// raftDirPath returns the directory of the Raft log
+func (s *Server) raftDirPath() string {
+	dir := s.config.RaftDir
+	if dir == "" {
+		dir = "raft"
+	}
+	if filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(s.config.Dir, dir)
+}
+
+// raftAddr returns the address the other members and clients reach this
+// node at
+func (s *Server) raftAddr() string {
+	if s.config.RaftAddr != "" {
+		return s.config.RaftAddr
+	}
+	return fmt.Sprintf("127.0.0.1:%d", s.config.Port)
+}
+
+// openRaft opens the Raft log and rebuilds the dataset from its snapshot;
+// the entries after it are applied once the leader says they are
+// committed. A new node without a group to join starts its own.
+func (s *Server) openRaft() error {
+	storage, err := raft.OpenFileStorage(s.raftDirPath())
+	if err != nil {
+		return err
+	}
+	node, err := raft.Open(replication.NewID(), storage, raft.Config{}, time.Now())
+	if err != nil {
+		storage.Close()
+		return fmt.Errorf("invalid Raft log in %s: %w", s.raftDirPath(), err)
+	}
+	s.raft = &raftState{
+		node:    node,
+		storage: storage,
+		waiters: make(map[uint64]raftWaiter),
+		links:   make(map[string]*raftLink),
+		addrs:   make(map[string]string),
+	}
+
+	status := node.Status()
+	if status.LastIndex == 0 && s.config.RaftJoin == "" {
+		if err := node.Bootstrap(raft.Member{Addr: s.raftAddr()}); err != nil {
+			return err
+		}
+		fmt.Printf("Started a Raft group, I'm %s\n", node.ID())
+	} else {
+		fmt.Printf("Raft log loaded up to %d, I'm %s\n", status.LastIndex, node.ID())
+	}
+
+	// The log is the only source of the dataset
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	s.replaceDataset(nil)
+	s.raftApply()
+	return nil
+}
+
+// startRaft starts ticking the node once the client listener is up, and
+// asks the group to add it when it is not a member yet
+func (s *Server) startRaft() {
+	s.wg.Add(1)
+	go s.raftCron()
+	if s.config.RaftJoin != "" && !s.raft.node.IsMember() {
+		s.wg.Add(1)
+		go s.runRaftJoin(s.config.RaftJoin)
+	}
+}
+
+// raftCron ticks the node, sends what it has to send and applies what it
+// committed
+func (s *Server) raftCron() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(raftTickPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.writeMutex.Lock()
+		s.raftSend(s.raft.node.Tick(time.Now()))
+		s.raftApply()
+		s.writeMutex.Unlock()
+		s.dropRaftLinks()
+	}
+}
+
+// raftApply applies the snapshot and the entries the node committed,
+// answering the clients waiting for them, and compacts the log once it
+// grew enough; the caller must hold writeMutex
+func (s *Server) raftApply() {
+	snapshot, entries := s.raft.node.Apply()
+	if snapshot != nil {
+		s.installRaftSnapshot(snapshot)
+	}
+	for _, entry := range entries {
+		waiter, waiting := s.raft.waiters[entry.Index]
+		var response *resp2.RESPValue
+		switch {
+		case entry.Kind == raft.EntryCommand && len(entry.Command) > 0:
+			cmd := &resp2.Command{Name: entry.Command[0], Args: entry.Command[1:]}
+			// Reads only matter to the client that sent them
+			if !handler.IsWriteCommand(cmd.Name) && !waiting {
+				continue
+			}
+			response = s.handler.Execute(cmd)
+			if handler.IsWriteCommand(cmd.Name) && response.Type != resp2.Error {
+				s.logWrite(cmd)
+			}
+		default:
+			response = &resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"}
+		}
+		if !waiting {
+			continue
+		}
+		delete(s.raft.waiters, entry.Index)
+		if waiter.term != entry.Term {
+			// Another leader replaced the client's entry with its own
+			response = &resp2.RESPValue{Type: resp2.Error, Str: "ERR The Raft leader changed, the command was not applied"}
+		}
+		waiter.reply <- response
+	}
+
+	if s.raft.node.LogSize() >= raftCompactEntries && s.raft.compacting.CompareAndSwap(false, true) {
+		index := s.raft.node.Status().Applied
+		view := s.store.View()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.raft.compacting.Store(false)
+			defer view.Release()
+			var data bytes.Buffer
+			err := writeRDB(&data, view)
+			if err == nil {
+				err = s.raft.node.Compact(index, data.Bytes())
+			}
+			if err != nil {
+				fmt.Printf("Error compacting the Raft log: %v\n", err)
+			}
+		}()
+	}
+}
+
+// installRaftSnapshot replaces the dataset with a snapshot of the leader;
+// the caller must hold writeMutex
+func (s *Server) installRaftSnapshot(snapshot *raft.Snapshot) {
+	var entries []rdb.Entry
+	var report SnapshotReport
+	if len(snapshot.Data) > 0 {
+		if err := decodeSnapshot(bytes.NewReader(snapshot.Data), &report, func(entry rdb.Entry) {
+			entries = append(entries, entry)
+		}); err != nil {
+			fmt.Printf("Error loading the Raft snapshot at %d: %v\n", snapshot.Index, err)
+			return
+		}
+	}
+	s.replaceDataset(entries)
+	s.dirty.Add(int64(len(entries)))
+	fmt.Printf("Raft snapshot at %d loaded, %d keys\n", snapshot.Index, len(entries))
+	if warning := report.SkippedWarning(); warning != "" {
+		fmt.Println(warning)
+	}
+}
+
+// executeInRaft executes a command of the command handler in Raft mode:
+// reads and writes both go through the log, so every client sees the
+// writes acknowledged before, whichever member it asked
+func (s *Server) executeInRaft(cmd *resp2.Command) *resp2.RESPValue {
+	spec, exists := handler.LookupCommand(cmd.Name)
+	if !exists || spec.Flags&(handler.FlagWrite|handler.FlagReadOnly) == 0 {
+		return s.handler.Execute(cmd)
+	}
+	if spec.Flags&handler.FlagWrite != 0 {
+		cmd = handler.PropagationForm(cmd)
+	}
+	command := append([]string{cmd.Name}, cmd.Args...)
+	return s.raftPropose(func() (raft.Entry, []raft.Message, error) {
+		return s.raft.node.Propose(command)
+	})
+}
+
+// raftPropose appends an entry through propose and waits until it is
+// applied, replying what applying it replied
+func (s *Server) raftPropose(propose func() (raft.Entry, []raft.Message, error)) *resp2.RESPValue {
+	s.writeMutex.Lock()
+	entry, messages, err := propose()
+	if err != nil {
+		s.writeMutex.Unlock()
+		return s.raftError(err)
+	}
+	reply := make(chan *resp2.RESPValue, 1)
+	s.raft.waiters[entry.Index] = raftWaiter{term: entry.Term, reply: reply}
+	s.raftSend(messages)
+	// A group of one commits at once
+	s.raftApply()
+	s.writeMutex.Unlock()
+
+	timer := time.NewTimer(raftCommitTimeout)
+	defer timer.Stop()
+	select {
+	case response := <-reply:
+		return response
+	case <-timer.C:
+	case <-s.ctx.Done():
+	}
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	select {
+	case response := <-reply:
+		return response
+	default:
+	}
+	delete(s.raft.waiters, entry.Index)
+	return &resp2.RESPValue{Type: resp2.Error, Str: "TIMEOUT The command was not committed in time, it may still be applied"}
+}
+
+// raftError returns the error reply for a proposal the node refused,
+// redirecting clients of a follower to the leader
+func (s *Server) raftError(err error) *resp2.RESPValue {
+	if !errors.Is(err, raft.ErrNotLeader) {
+		return &resp2.RESPValue{Type: resp2.Error, Str: fmt.Sprintf("ERR %v", err)}
+	}
+	if leader, known := s.raft.node.Leader(); known && leader.ID != s.raft.node.ID() {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "NOTLEADER " + leader.Addr}
+	}
+	return &resp2.RESPValue{Type: resp2.Error, Str: "NOLEADER No Raft leader is elected"}
+}
+
+// raftSend queues messages on the links to the nodes they are for; the
+// caller must hold writeMutex
+func (s *Server) raftSend(messages []raft.Message) {
+	for _, m := range messages {
+		addr := ""
+		if member, known := s.raft.node.Member(m.To); known {
+			addr = member.Addr
+		}
+		s.raft.mutex.Lock()
+		if addr == "" {
+			addr = s.raft.addrs[m.To]
+		}
+		link := s.raft.links[m.To]
+		if link != nil && link.addr != addr {
+			link.cancel()
+			link = nil
+		}
+		if link == nil && addr != "" {
+			ctx, cancel := context.WithCancel(s.ctx)
+			link = &raftLink{addr: addr, cancel: cancel, wake: make(chan struct{}, 1)}
+			s.raft.links[m.To] = link
+			s.wg.Add(1)
+			go s.runRaftLink(ctx, link)
+		}
+		s.raft.mutex.Unlock()
+		if link == nil {
+			continue
+		}
+		data, err := json.Marshal(m)
+		if err != nil {
+			continue
+		}
+		link.queue(s.parser.Serialize(resp2.NewCommandValue("RAFT.MESSAGE", []string{s.raftAddr(), string(data)})))
+	}
+}
+
+// dropRaftLinks closes the links to nodes that are no longer members
+func (s *Server) dropRaftLinks() {
+	s.raft.mutex.Lock()
+	defer s.raft.mutex.Unlock()
+	for id, link := range s.raft.links {
+		if _, member := s.raft.node.Member(id); !member {
+			link.cancel()
+			delete(s.raft.links, id)
+		}
+	}
+}
+
+// queue adds a message to send, dropping it when too many are waiting
+func (l *raftLink) queue(data []byte) {
+	l.mutex.Lock()
+	if len(l.pending) < raftLinkQueue {
+		l.pending = append(l.pending, data)
+	}
+	l.mutex.Unlock()
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the queued messages and empties the queue
+func (l *raftLink) take() [][]byte {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	pending := l.pending
+	l.pending = nil
+	return pending
+}
+
+// runRaftLink sends the messages queued on a link until it is closed,
+// dialing the member again after failures; messages that could not be
+// sent are dropped
+func (s *Server) runRaftLink(ctx context.Context, link *raftLink) {
+	defer s.wg.Done()
+	var conn net.Conn
+	var reader *bufio.Reader
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-link.wake:
+		}
+		pending := link.take()
+		if conn == nil {
+			dialer := net.Dialer{Timeout: raft.DefaultElectionTimeout}
+			var err error
+			if conn, err = dialer.DialContext(ctx, "tcp", link.addr); err != nil {
+				conn = nil
+				continue
+			}
+			reader = bufio.NewReader(conn)
+		}
+		if err := s.sendRaftMessages(conn, reader, pending); err != nil {
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+// sendRaftMessages writes messages to a member and reads its replies
+func (s *Server) sendRaftMessages(conn net.Conn, reader *bufio.Reader, pending [][]byte) error {
+	conn.SetDeadline(time.Now().Add(raft.DefaultElectionTimeout))
+	if _, err := conn.Write(bytes.Join(pending, nil)); err != nil {
+		return err
+	}
+	for range pending {
+		reply, err := s.parser.Parse(reader)
+		if err != nil {
+			return err
+		}
+		if reply.Type == resp2.Error {
+			return fmt.Errorf("RAFT.MESSAGE: %s", reply.Str)
+		}
+	}
+	return nil
+}
+
+// handleRaftMessage handles RAFT.MESSAGE addr message, with which another
+// node at addr sends this one a Raft message
+func (s *Server) handleRaftMessage(args []string) *resp2.RESPValue {
+	if s.raft == nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR This instance has Raft mode disabled"}
+	}
+	if len(args) != 2 {
+		return wrongArgs("RAFT.MESSAGE")
+	}
+	var m raft.Message
+	if err := json.Unmarshal([]byte(args[1]), &m); err != nil || m.To != s.raft.node.ID() {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR Invalid Raft message"}
+	}
+	s.raft.mutex.Lock()
+	s.raft.addrs[m.From] = args[0]
+	s.raft.mutex.Unlock()
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	s.raftSend(s.raft.node.Step(m, time.Now()))
+	s.raftApply()
+	return &resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"}
+}
+
+// handleRaftJoin handles RAFT.JOIN id addr, with which a new node asks the
+// leader to add it to the group, replying once the change is committed
+func (s *Server) handleRaftJoin(args []string) *resp2.RESPValue {
+	if s.raft == nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR This instance has Raft mode disabled"}
+	}
+	if len(args) != 2 {
+		return wrongArgs("RAFT.JOIN")
+	}
+	member := raft.Member{ID: args[0], Addr: args[1]}
+	if current, known := s.raft.node.Member(member.ID); known && current == member {
+		return &resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"}
+	}
+	return s.raftPropose(func() (raft.Entry, []raft.Message, error) {
+		return s.raft.node.AddMember(member)
+	})
+}
+
+// handleRaftRemove handles RAFT.REMOVE id, removing a member from the
+// group once the change is committed
+func (s *Server) handleRaftRemove(args []string) *resp2.RESPValue {
+	if s.raft == nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR This instance has Raft mode disabled"}
+	}
+	if len(args) != 1 {
+		return wrongArgs("RAFT.REMOVE")
+	}
+	return s.raftPropose(func() (raft.Entry, []raft.Message, error) {
+		return s.raft.node.RemoveMember(args[0])
+	})
+}
+
+// runRaftJoin asks the group at addr to add this node, following the
+// redirects to its leader, until it is added or the server stops
+func (s *Server) runRaftJoin(addr string) {
+	defer s.wg.Done()
+	for !s.raft.node.IsMember() {
+		reply, err := s.requestRaftJoin(addr)
+		switch {
+		case err != nil:
+			fmt.Printf("Failed to join the Raft group at %s: %v\n", addr, err)
+		case reply.Type != resp2.Error:
+			fmt.Printf("Joined the Raft group at %s\n", addr)
+			return
+		case strings.HasPrefix(reply.Str, "NOTLEADER "):
+			addr = strings.TrimPrefix(reply.Str, "NOTLEADER ")
+			continue
+		default:
+			fmt.Printf("Failed to join the Raft group at %s: %s\n", addr, reply.Str)
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(replRetryDelay):
+		}
+	}
+}
+
+// requestRaftJoin sends RAFT.JOIN to the node at addr and returns its reply
+func (s *Server) requestRaftJoin(addr string) (*resp2.RESPValue, error) {
+	dialer := net.Dialer{Timeout: raftCommitTimeout}
+	conn, err := dialer.DialContext(s.ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * raftCommitTimeout))
+	if _, err := conn.Write(s.parser.Serialize(resp2.NewCommandValue("RAFT.JOIN", []string{s.raft.node.ID(), s.raftAddr()}))); err != nil {
+		return nil, err
+	}
+	return s.parser.Parse(bufio.NewReader(conn))
+}
+
+// infoRaft renders the Raft section
+func (s *Server) infoRaft() []string {
+	if s.raft == nil {
+		return []string{"raft_enabled:0"}
+	}
+	status := s.raft.node.Status()
+	lines := []string{
+		"raft_enabled:1",
+		fmt.Sprintf("raft_id:%s", status.ID),
+		fmt.Sprintf("raft_role:%s", status.Role),
+		fmt.Sprintf("raft_term:%d", status.Term),
+		fmt.Sprintf("raft_leader:%s", status.Leader.Addr),
+		fmt.Sprintf("raft_last_index:%d", status.LastIndex),
+		fmt.Sprintf("raft_commit_index:%d", status.Commit),
+		fmt.Sprintf("raft_applied_index:%d", status.Applied),
+		fmt.Sprintf("raft_snapshot_index:%d", status.SnapshotIndex),
+		fmt.Sprintf("raft_members:%d", len(status.Members)),
+	}
+	for i, member := range status.Members {
+		lines = append(lines, fmt.Sprintf("member%d:id=%s,addr=%s", i, member.ID, member.Addr))
+	}
+	return lines
+}
@@ -0,0 +1,1034 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"redis-like-server/internal/connection"
+	"redis-like-server/internal/handler"
+	"redis-like-server/internal/rdb"
+	"redis-like-server/internal/replication"
+	"redis-like-server/internal/resp2"
+	"redis-like-server/internal/store"
+)
+
+const (
+	// replPingPeriod is how often a master pings its replicas, so they can
+	// tell a quiet master from a lost link
+	replPingPeriod = 10 * time.Second
+	// replTimeout is how long a replica waits on a silent master before
+	// dropping the link
+	replTimeout = 60 * time.Second
+	// replRetryDelay is how long a replica waits before reconnecting
+	replRetryDelay = time.Second
+	// replicaBufferLimit bounds the stream queued for a replica; a replica
+	// falling further behind is disconnected and has to resynchronize
+	replicaBufferLimit = 256 << 20
+	// replChunkSize is how much of a snapshot a replica reads at once
+	replChunkSize = 64 << 10
+	// replAckPeriod is how often a replica acknowledges the offset it
+	// processed
+	replAckPeriod = time.Second
+)
+
+// States of a replica as seen by its master, as shown by INFO
+const (
+	replicaWaitBgsave = "wait_bgsave"
+	replicaSendBulk   = "send_bulk"
+	replicaOnline     = "online"
+)
+
+// States of a replica's link to its master, as shown by ROLE
+const (
+	linkConnect    = "connect"
+	linkConnecting = "connecting"
+	linkSync       = "sync"
+	linkConnected  = "connected"
+)
+
+// replState is the replication state of a server. The stream is only fed
+// under the server's writeMutex, so holding writeMutex keeps the dataset
+// and the replication offset in agreement.
+type replState struct {
+	mutex sync.Mutex
+	// id names the history of the dataset and the backlog holds its
+	// stream; id2 names the history it continues, valid up to
+	// secondOffset, after a replica was promoted or its master changed
+	// history
+	id           string
+	id2          string
+	secondOffset int64
+	backlog      *replication.Backlog
+
+	replicas  map[*replicaLink]struct{}
+	announced map[string]int
+	lastPing  time.Time
+	master    *masterLink
+	// acked is closed and replaced whenever a replica acknowledges an
+	// offset, waking the clients blocked in WAIT
+	acked chan struct{}
+
+	syncFull       int64
+	syncPartialOK  int64
+	syncPartialErr int64
+}
+
+// newReplState starts a new history with an empty backlog
+func newReplState(backlogSize int) *replState {
+	if backlogSize <= 0 {
+		backlogSize = replication.DefaultBacklogSize
+	}
+	return &replState{
+		id:           replication.NewID(),
+		id2:          replication.NoID,
+		secondOffset: -1,
+		backlog:      replication.NewBacklog(backlogSize, 0),
+		replicas:     make(map[*replicaLink]struct{}),
+		announced:    make(map[string]int),
+		acked:        make(chan struct{}),
+	}
+}
+
+// shiftID starts a new history continuing the current one, so replicas
+// that followed it can still resume; the caller must hold the mutex
+func (r *replState) shiftID(id string) {
+	r.id2, r.secondOffset = r.id, r.backlog.Offset()+1
+	r.id = id
+}
+
+// replicaLink is a replica connected to this server. The stream is queued
+// on it by the feed and written by its own goroutine, so a slow replica
+// never holds up writes.
+type replicaLink struct {
+	conn *connection.ClientConnection
+	addr string
+	port int
+
+	mutex   sync.Mutex
+	pending []byte
+	state   string
+	closed  bool
+	wake    chan struct{}
+	// ackOffset is the last offset the replica acknowledged, at ackTime
+	ackOffset int64
+	ackTime   time.Time
+}
+
+// newReplicaLink creates the link of a replica that announced port and
+// holds the stream up to offset
+func newReplicaLink(conn *connection.ClientConnection, port int, state string, offset int64) *replicaLink {
+	addr := conn.GetConn().RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return &replicaLink{
+		conn:      conn,
+		addr:      addr,
+		port:      port,
+		state:     state,
+		wake:      make(chan struct{}, 1),
+		ackOffset: offset,
+		ackTime:   time.Now(),
+	}
+}
+
+// name identifies the replica in log messages
+func (l *replicaLink) name() string {
+	return net.JoinHostPort(l.addr, strconv.Itoa(l.port))
+}
+
+// send queues part of the stream, disconnecting the replica when it fell
+// too far behind
+func (l *replicaLink) send(data []byte) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return
+	}
+	if len(l.pending)+len(data) > replicaBufferLimit {
+		fmt.Printf("!!! Warning: replica %s is over the output buffer limit, disconnecting it\n", l.name())
+		l.closed = true
+		l.conn.GetConn().Close()
+		return
+	}
+	l.pending = append(l.pending, data...)
+	l.notify()
+}
+
+// notify wakes the writer goroutine; the caller must hold the mutex
+func (l *replicaLink) notify() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// setState changes the state of the replica, waking the writer once it is
+// online
+func (l *replicaLink) setState(state string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.state = state
+	l.notify()
+}
+
+// take returns the queued stream once the replica is online, and whether
+// the link was closed
+func (l *replicaLink) take() ([]byte, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed || l.state != replicaOnline {
+		return nil, l.closed
+	}
+	data := l.pending
+	l.pending = nil
+	return data, false
+}
+
+// ack records an offset the replica acknowledged
+func (l *replicaLink) ack(offset int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.ackOffset = max(l.ackOffset, offset)
+	l.ackTime = time.Now()
+}
+
+// acked returns the last offset the replica acknowledged and how long ago
+func (l *replicaLink) acked() (int64, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.ackOffset, time.Since(l.ackTime)
+}
+
+// close stops the writer goroutine
+func (l *replicaLink) close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.closed = true
+	l.notify()
+}
+
+// masterLink is the connection of a replica to its master, kept up by its
+// own goroutine until cancelled
+type masterLink struct {
+	host   string
+	port   int
+	ctx    context.Context
+	cancel context.CancelFunc
+	// resume makes the first synchronization try to continue the server's
+	// own history, as when a master is turned into a replica
+	resume bool
+
+	mutex          sync.Mutex
+	state          string
+	syncInProgress bool
+	lastIO         atomic.Int64
+}
+
+// addr returns the address of the master
+func (m *masterLink) addr() string {
+	return net.JoinHostPort(m.host, strconv.Itoa(m.port))
+}
+
+// setState changes the link state
+func (m *masterLink) setState(state string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.state = state
+	m.syncInProgress = state == linkSync
+}
+
+// status returns the link state and whether a full sync is in progress
+func (m *masterLink) status() (string, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.state, m.syncInProgress
+}
+
+// ParseReplicaOf parses a "host port" master address
+func ParseReplicaOf(spec string) (string, int, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 2 {
+		return "", 0, fmt.Errorf("invalid master address %q: expected \"host port\"", spec)
+	}
+	port, err := strconv.Atoi(fields[1])
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid master port %q", fields[1])
+	}
+	return fields[0], port, nil
+}
+
+// isReplica reports whether the server replicates a master
+func (s *Server) isReplica() bool {
+	s.repl.mutex.Lock()
+	defer s.repl.mutex.Unlock()
+	return s.repl.master != nil
+}
+
+// replicationFeed appends data to the replication stream: the backlog and
+// every replica. The caller must hold writeMutex.
+func (s *Server) replicationFeed(data []byte) {
+	s.repl.mutex.Lock()
+	defer s.repl.mutex.Unlock()
+	s.repl.backlog.Write(data)
+	for link := range s.repl.replicas {
+		link.send(data)
+	}
+}
+
+// replicationCron pings the replicas of a master periodically
+func (s *Server) replicationCron() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	ping := s.parser.Serialize(resp2.NewCommandValue("PING", nil))
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.repl.mutex.Lock()
+		due := s.repl.master == nil && len(s.repl.replicas) > 0 && time.Since(s.repl.lastPing) >= replPingPeriod
+		s.repl.mutex.Unlock()
+		if due {
+			s.writeMutex.Lock()
+			s.replicationFeed(ping)
+			s.repl.mutex.Lock()
+			s.repl.lastPing = time.Now()
+			s.repl.mutex.Unlock()
+			s.writeMutex.Unlock()
+		}
+	}
+}
+
+// handleReplconf handles REPLCONF, which replicas use to describe
+// themselves before PSYNC and to acknowledge the offset they processed
+func (s *Server) handleReplconf(clientConn *connection.ClientConnection, args []string) *resp2.RESPValue {
+	if len(args)%2 != 0 {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR syntax error"}
+	}
+	for i := 0; i < len(args); i += 2 {
+		switch strings.ToLower(args[i]) {
+		case "ack":
+			// Acknowledgements are never answered, as they share the
+			// connection with the stream
+			if offset, err := strconv.ParseInt(args[i+1], 10, 64); err == nil && clientConn.IsReplica() {
+				s.replicaAck(clientConn, offset)
+			}
+			return nil
+		case "getack":
+			// Only meaningful in the stream of a master
+		case "listening-port":
+			port, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return notAnInteger()
+			}
+			s.repl.mutex.Lock()
+			s.repl.announced[clientConn.GetID()] = port
+			s.repl.mutex.Unlock()
+		case "ip-address", "capa":
+		default:
+			return &resp2.RESPValue{Type: resp2.Error, Str: fmt.Sprintf("ERR Unrecognized REPLCONF option: %s", args[i])}
+		}
+	}
+	return &resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"}
+}
+
+// replicaAck records the offset a replica acknowledged and wakes the
+// clients waiting for it
+func (s *Server) replicaAck(clientConn *connection.ClientConnection, offset int64) {
+	s.repl.mutex.Lock()
+	defer s.repl.mutex.Unlock()
+	for link := range s.repl.replicas {
+		if link.conn == clientConn {
+			link.ack(offset)
+		}
+	}
+	close(s.repl.acked)
+	s.repl.acked = make(chan struct{})
+}
+
+// countAcked returns how many replicas acknowledged offset; the caller
+// must hold the replication mutex
+func (s *Server) countAcked(offset int64) int {
+	count := 0
+	for link := range s.repl.replicas {
+		if acked, _ := link.acked(); acked >= offset {
+			count++
+		}
+	}
+	return count
+}
+
+// goodReplicas returns how many online replicas acknowledged the stream
+// within min-replicas-max-lag seconds; the caller must hold the
+// replication mutex
+func (s *Server) goodReplicas() int {
+	maxLag := time.Duration(s.minReplicasMaxLag.Load()) * time.Second
+	count := 0
+	for link := range s.repl.replicas {
+		link.mutex.Lock()
+		online := link.state == replicaOnline
+		link.mutex.Unlock()
+		if _, lag := link.acked(); online && lag <= maxLag {
+			count++
+		}
+	}
+	return count
+}
+
+// checkWritable returns the error reply refusing a write command, or nil
+// when the server accepts writes: writes are refused while the storage
+// engine or the append-only file fail to store them, a read-only replica
+// refuses its clients' writes, and a master refuses them without enough
+// good replicas
+func (s *Server) checkWritable() *resp2.RESPValue {
+	if err := s.storageError(); err != nil {
+		return storageErrorReply(err)
+	}
+	if s.aof != nil {
+		if err := s.aof.LastError(); err != nil {
+			return aofErrorReply(err)
+		}
+	}
+	if s.isReplica() {
+		if s.replicaReadOnly.Load() {
+			return &resp2.RESPValue{Type: resp2.Error, Str: "READONLY You can't write against a read only replica."}
+		}
+		return nil
+	}
+	needed := s.minReplicasToWrite.Load()
+	if needed <= 0 {
+		return nil
+	}
+	s.repl.mutex.Lock()
+	good := s.goodReplicas()
+	s.repl.mutex.Unlock()
+	if int64(good) < needed {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "NOREPLICAS Not enough good replicas to write."}
+	}
+	return nil
+}
+
+// storageErrorReply is the error reply for writes the storage engine
+// failed to store
+func storageErrorReply(err error) *resp2.RESPValue {
+	return &resp2.RESPValue{Type: resp2.Error, Str: fmt.Sprintf("MISCONF Errors writing to the storage engine: %v", err)}
+}
+
+// aofErrorReply is the error reply for writes the append-only file failed
+// to log
+func aofErrorReply(err error) *resp2.RESPValue {
+	return &resp2.RESPValue{Type: resp2.Error, Str: fmt.Sprintf("MISCONF Errors writing to the AOF file: %v", err)}
+}
+
+// handleWait handles WAIT numreplicas timeout, blocking until that many
+// replicas acknowledged every write made before it, or the timeout in
+// milliseconds expired, and replying with the number that did
+func (s *Server) handleWait(clientConn *connection.ClientConnection, args []string) *resp2.RESPValue {
+	if len(args) != 2 {
+		return wrongArgs("WAIT")
+	}
+	numReplicas, err := strconv.Atoi(args[0])
+	if err != nil {
+		return notAnInteger()
+	}
+	timeout, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR timeout is not an integer or out of range"}
+	}
+	if timeout < 0 {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR timeout is negative"}
+	}
+	if s.isReplica() {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR WAIT cannot be used with replica instances."}
+	}
+
+	// Ask the replicas for an acknowledgement rather than waiting for the
+	// next periodic one
+	s.writeMutex.Lock()
+	s.repl.mutex.Lock()
+	target := s.repl.backlog.Offset()
+	enough := s.countAcked(target) >= numReplicas
+	s.repl.mutex.Unlock()
+	if !enough {
+		s.replicationFeed(s.parser.Serialize(resp2.NewCommandValue("REPLCONF", []string{"GETACK", "*"})))
+	}
+	s.writeMutex.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		s.repl.mutex.Lock()
+		count, acked := s.countAcked(target), s.repl.acked
+		s.repl.mutex.Unlock()
+		if count >= numReplicas {
+			return &resp2.RESPValue{Type: resp2.Integer, Int: int64(count)}
+		}
+		select {
+		case <-acked:
+		case <-expired:
+			numReplicas = 0
+		case <-s.ctx.Done():
+			numReplicas = 0
+		}
+	}
+}
+
+// handlePsync handles PSYNC, turning the client into a replica. The stream
+// continues from the requested offset when the backlog still holds it;
+// otherwise the replica gets a full snapshot first.
+func (s *Server) handlePsync(clientConn *connection.ClientConnection, args []string) *resp2.RESPValue {
+	if len(args) != 2 {
+		return wrongArgs("PSYNC")
+	}
+	offset, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return notAnInteger()
+	}
+	if clientConn.IsReplica() {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR Replica already synchronizing"}
+	}
+	clientConn.SetReplica()
+	if !s.tryPartialResync(clientConn, args[0], offset) {
+		s.fullResync(clientConn)
+	}
+	// The replies were written along with the stream
+	return nil
+}
+
+// tryPartialResync continues the stream of a replica from offset when it
+// followed this server's history and the backlog still holds the offset
+func (s *Server) tryPartialResync(clientConn *connection.ClientConnection, id string, offset int64) bool {
+	s.repl.mutex.Lock()
+	defer s.repl.mutex.Unlock()
+	if id == "?" {
+		return false
+	}
+	known := id == s.repl.id || (id == s.repl.id2 && offset <= s.repl.secondOffset)
+	data, held := s.repl.backlog.ReadFrom(offset)
+	if !known || !held {
+		s.repl.syncPartialErr++
+		return false
+	}
+
+	link := newReplicaLink(clientConn, s.repl.announced[clientConn.GetID()], replicaOnline, offset-1)
+	if err := clientConn.Write([]byte(fmt.Sprintf("+CONTINUE %s\r\n", s.repl.id))); err != nil {
+		return true
+	}
+	link.send(data)
+	s.repl.replicas[link] = struct{}{}
+	s.repl.syncPartialOK++
+	fmt.Printf("Partial resynchronization of replica %s accepted, sending %d bytes of backlog\n", link.name(), len(data))
+	s.wg.Add(1)
+	go s.serveReplica(link)
+	return true
+}
+
+// fullResync sends a replica a snapshot of the dataset and then the stream
+// of the writes that followed it
+func (s *Server) fullResync(clientConn *connection.ClientConnection) {
+	// The view and the offset are taken together under writeMutex; every
+	// later write is queued on the link while the snapshot is sent
+	s.writeMutex.Lock()
+	view := s.store.View()
+	s.repl.mutex.Lock()
+	id, offset := s.repl.id, s.repl.backlog.Offset()
+	link := newReplicaLink(clientConn, s.repl.announced[clientConn.GetID()], replicaWaitBgsave, 0)
+	s.repl.replicas[link] = struct{}{}
+	s.repl.syncFull++
+	s.repl.mutex.Unlock()
+	s.writeMutex.Unlock()
+
+	fmt.Printf("Starting a full resynchronization of replica %s at offset %d\n", link.name(), offset)
+	s.wg.Add(1)
+	go s.serveReplica(link)
+
+	var payload bytes.Buffer
+	err := writeRDB(&payload, view)
+	view.Release()
+	if err == nil {
+		err = clientConn.Write([]byte(fmt.Sprintf("+FULLRESYNC %s %d\r\n", id, offset)))
+	}
+	if err == nil {
+		link.setState(replicaSendBulk)
+		err = clientConn.Write(append([]byte(fmt.Sprintf("$%d\r\n", payload.Len())), payload.Bytes()...))
+	}
+	if err != nil {
+		fmt.Printf("Full resynchronization of replica %s failed: %v\n", link.name(), err)
+		clientConn.GetConn().Close()
+		return
+	}
+	link.setState(replicaOnline)
+}
+
+// serveReplica writes the stream queued on a replica link until it closes
+func (s *Server) serveReplica(link *replicaLink) {
+	defer s.wg.Done()
+	defer s.removeReplica(link.conn)
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-link.wake:
+		}
+		data, closed := link.take()
+		if closed {
+			return
+		}
+		if len(data) > 0 && link.conn.Write(data) != nil {
+			link.conn.GetConn().Close()
+			return
+		}
+	}
+}
+
+// removeReplica forgets a client that disconnected or stopped being a
+// replica
+func (s *Server) removeReplica(clientConn *connection.ClientConnection) {
+	s.repl.mutex.Lock()
+	defer s.repl.mutex.Unlock()
+	delete(s.repl.announced, clientConn.GetID())
+	for link := range s.repl.replicas {
+		if link.conn == clientConn {
+			delete(s.repl.replicas, link)
+			link.close()
+		}
+	}
+}
+
+// dropReplicas disconnects every replica, whose history no longer matches
+// the dataset; the caller must hold the replication mutex
+func (s *Server) dropReplicas() {
+	for link := range s.repl.replicas {
+		delete(s.repl.replicas, link)
+		link.close()
+		link.conn.GetConn().Close()
+	}
+}
+
+// handleReplicaof handles REPLICAOF host port and REPLICAOF NO ONE
+func (s *Server) handleReplicaof(args []string) *resp2.RESPValue {
+	if len(args) != 2 {
+		return wrongArgs("REPLICAOF")
+	}
+	if s.cluster != nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR REPLICAOF not allowed in cluster mode."}
+	}
+	if s.crdt != nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR REPLICAOF not allowed in active-active mode."}
+	}
+	if s.raft != nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR REPLICAOF not allowed in Raft mode."}
+	}
+	if strings.EqualFold(args[0], "no") && strings.EqualFold(args[1], "one") {
+		s.stopReplication()
+		return &resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"}
+	}
+	host, port, err := ParseReplicaOf(args[0] + " " + args[1])
+	if err != nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR Invalid master port"}
+	}
+	s.repl.mutex.Lock()
+	current := s.repl.master
+	s.repl.mutex.Unlock()
+	if current != nil && current.host == host && current.port == port {
+		return &resp2.RESPValue{Type: resp2.SimpleString, Str: "OK Already connected to specified master"}
+	}
+	s.startReplication(host, port, true)
+	return &resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"}
+}
+
+// startReplication makes the server a replica of host:port, replacing any
+// previous master
+func (s *Server) startReplication(host string, port int, resume bool) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	link := &masterLink{host: host, port: port, ctx: ctx, cancel: cancel, resume: resume, state: linkConnect}
+
+	s.repl.mutex.Lock()
+	previous := s.repl.master
+	s.repl.master = link
+	s.repl.mutex.Unlock()
+	if previous != nil {
+		previous.cancel()
+	}
+	fmt.Printf("Connecting to MASTER %s\n", link.addr())
+
+	s.wg.Add(1)
+	go s.runMasterLink(link)
+}
+
+// stopReplication turns a replica into a master. The dataset is kept and
+// continues as a new history, so replicas that followed it can resume.
+func (s *Server) stopReplication() {
+	s.repl.mutex.Lock()
+	defer s.repl.mutex.Unlock()
+	if s.repl.master == nil {
+		return
+	}
+	s.repl.master.cancel()
+	s.repl.master = nil
+	s.repl.shiftID(replication.NewID())
+	fmt.Println("MASTER MODE enabled")
+}
+
+// runMasterLink keeps a replica connected to its master, reconnecting
+// after failures until the link is cancelled
+func (s *Server) runMasterLink(link *masterLink) {
+	defer s.wg.Done()
+	for {
+		err := s.syncWithMaster(link)
+		if link.ctx.Err() != nil {
+			return
+		}
+		fmt.Printf("Lost the link to MASTER %s: %v\n", link.addr(), err)
+		link.setState(linkConnect)
+		select {
+		case <-link.ctx.Done():
+			return
+		case <-time.After(replRetryDelay):
+		}
+	}
+}
+
+// syncWithMaster connects to the master, synchronizes with it and applies
+// its stream until the connection fails or the link is cancelled
+func (s *Server) syncWithMaster(link *masterLink) error {
+	link.setState(linkConnecting)
+	dialer := net.Dialer{Timeout: replTimeout}
+	conn, err := dialer.DialContext(link.ctx, "tcp", link.addr())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(link.ctx, func() { conn.Close() })
+	defer stop()
+	link.lastIO.Store(time.Now().Unix())
+
+	reader := bufio.NewReader(conn)
+	request := func(args ...string) (*resp2.RESPValue, error) {
+		conn.SetDeadline(time.Now().Add(replTimeout))
+		if _, err := conn.Write(s.parser.Serialize(resp2.NewCommandValue(args[0], args[1:]))); err != nil {
+			return nil, err
+		}
+		reply, err := s.parser.Parse(reader)
+		if err != nil {
+			return nil, err
+		}
+		if reply.Type == resp2.Error {
+			return nil, fmt.Errorf("%s: %s", args[0], reply.Str)
+		}
+		return reply, nil
+	}
+	if _, err := request("PING"); err != nil {
+		return err
+	}
+	if _, err := request("REPLCONF", "listening-port", strconv.Itoa(s.listener.Addr().(*net.TCPAddr).Port)); err != nil {
+		return err
+	}
+	if _, err := request("REPLCONF", "capa", "psync2"); err != nil {
+		return err
+	}
+
+	s.repl.mutex.Lock()
+	id, offset := "?", int64(-1)
+	if link.resume {
+		id, offset = s.repl.id, s.repl.backlog.Offset()+1
+	}
+	s.repl.mutex.Unlock()
+	reply, err := request("PSYNC", id, strconv.FormatInt(offset, 10))
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(reply.Str)
+	switch {
+	case len(fields) == 3 && fields[0] == "FULLRESYNC":
+		masterOffset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid FULLRESYNC offset %q", fields[2])
+		}
+		link.setState(linkSync)
+		if err := s.loadMasterSnapshot(conn, reader, fields[1], masterOffset); err != nil {
+			return err
+		}
+		fmt.Println("MASTER <-> REPLICA sync: Finished with success")
+	case len(fields) >= 1 && fields[0] == "CONTINUE":
+		s.repl.mutex.Lock()
+		if len(fields) == 2 && fields[1] != s.repl.id {
+			s.repl.shiftID(fields[1])
+		}
+		s.repl.mutex.Unlock()
+		fmt.Println("Successful partial resynchronization with master")
+	default:
+		return fmt.Errorf("unexpected PSYNC reply %q", reply.Str)
+	}
+	link.resume = true
+	link.setState(linkConnected)
+
+	// Acknowledgements are written alongside the requests the stream loop
+	// never makes, so only they need the lock
+	var ackMutex sync.Mutex
+	ack := func() {
+		s.repl.mutex.Lock()
+		processed := s.repl.backlog.Offset()
+		s.repl.mutex.Unlock()
+		ackMutex.Lock()
+		defer ackMutex.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(replTimeout))
+		conn.Write(s.parser.Serialize(resp2.NewCommandValue("REPLCONF", []string{"ACK", strconv.FormatInt(processed, 10)})))
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(replAckPeriod)
+		defer ticker.Stop()
+		for {
+			ack()
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(replTimeout))
+		value, err := s.parser.Parse(reader)
+		if err != nil {
+			return err
+		}
+		cmd, err := s.parser.ParseCommand(value)
+		if err != nil {
+			return fmt.Errorf("protocol error in the replication stream: %w", err)
+		}
+		link.lastIO.Store(time.Now().Unix())
+		s.applyReplicated(cmd)
+		if cmd.Name == "REPLCONF" && len(cmd.Args) > 0 && strings.EqualFold(cmd.Args[0], "GETACK") {
+			ack()
+		}
+	}
+}
+
+// loadMasterSnapshot reads the snapshot following FULLRESYNC and replaces
+// the dataset with it, starting the master's history at offset
+func (s *Server) loadMasterSnapshot(conn net.Conn, reader *bufio.Reader, id string, offset int64) error {
+	conn.SetReadDeadline(time.Now().Add(replTimeout))
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	size, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(header, "$"), "\r\n"))
+	if !strings.HasPrefix(header, "$") || err != nil || size < 0 {
+		return fmt.Errorf("invalid snapshot header %q", header)
+	}
+	fmt.Printf("MASTER <-> REPLICA sync: receiving %d bytes from master\n", size)
+
+	// Read it all before touching the dataset, so a failed transfer keeps
+	// the old data
+	payload := make([]byte, size)
+	for read := 0; read < size; {
+		conn.SetReadDeadline(time.Now().Add(replTimeout))
+		n, err := io.ReadFull(reader, payload[read:min(read+replChunkSize, size)])
+		if err != nil {
+			return fmt.Errorf("failed to read the snapshot from master: %w", err)
+		}
+		read += n
+	}
+	var entries []rdb.Entry
+	var report SnapshotReport
+	if err := decodeSnapshot(bytes.NewReader(payload), &report, func(entry rdb.Entry) {
+		entries = append(entries, entry)
+	}); err != nil {
+		return fmt.Errorf("failed to load the snapshot from master: %w", err)
+	}
+
+	s.writeMutex.Lock()
+	s.replaceDataset(entries)
+	s.repl.mutex.Lock()
+	s.repl.id, s.repl.id2, s.repl.secondOffset = id, replication.NoID, -1
+	s.repl.backlog.Reset(offset)
+	s.dropReplicas()
+	s.repl.mutex.Unlock()
+	s.dirty.Add(int64(len(entries)))
+	s.writeMutex.Unlock()
+	fmt.Printf("MASTER <-> REPLICA sync: loaded %d keys\n", len(entries))
+	if warning := report.SkippedWarning(); warning != "" {
+		fmt.Println(warning)
+	}
+
+	// The append-only file must describe the new dataset from scratch
+	if s.aof != nil {
+		rewrite, view, err := s.beginAOFRewrite()
+		if err != nil {
+			return err
+		}
+		return s.finishAOFRewrite(rewrite, view)
+	}
+	return nil
+}
+
+// replaceDataset makes entries the whole dataset; the caller must hold
+// writeMutex
+func (s *Server) replaceDataset(entries []rdb.Entry) {
+	keep := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		keep[entry.Key] = true
+	}
+	var stale []string
+	view := s.store.View()
+	view.Range(func(key string, _ store.Item) bool {
+		if !keep[key] {
+			stale = append(stale, key)
+		}
+		return true
+	})
+	view.Release()
+	s.store.DeleteMultiple(stale)
+	for _, entry := range entries {
+		s.store.SetWithExpiry(entry.Key, entry.Value, entry.ExpireAt)
+	}
+}
+
+// applyReplicated applies a command of the master's stream and passes it
+// on to this server's own replicas
+func (s *Server) applyReplicated(cmd *resp2.Command) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	if handler.IsWriteCommand(cmd.Name) {
+		if response := s.handler.Execute(cmd); response.Type == resp2.Error {
+			fmt.Printf("Error applying %s from master: %s\n", cmd.Name, response.Str)
+		}
+		s.logWrite(cmd)
+	}
+	s.replicationFeed(s.parser.Serialize(resp2.NewCommandValue(cmd.Name, cmd.Args)))
+}
+
+// handleRole handles the ROLE command
+func (s *Server) handleRole(args []string) *resp2.RESPValue {
+	if len(args) != 0 {
+		return wrongArgs("ROLE")
+	}
+	s.repl.mutex.Lock()
+	defer s.repl.mutex.Unlock()
+	offset := s.repl.backlog.Offset()
+	if master := s.repl.master; master != nil {
+		state, _ := master.status()
+		return &resp2.RESPValue{Type: resp2.Array, Array: []resp2.RESPValue{
+			{Type: resp2.BulkString, Str: "slave"},
+			{Type: resp2.BulkString, Str: master.host},
+			{Type: resp2.Integer, Int: int64(master.port)},
+			{Type: resp2.BulkString, Str: state},
+			{Type: resp2.Integer, Int: offset},
+		}}
+	}
+	replicas := make([]resp2.RESPValue, 0, len(s.repl.replicas))
+	for _, link := range s.sortedReplicas() {
+		acked, _ := link.acked()
+		replicas = append(replicas, resp2.RESPValue{Type: resp2.Array, Array: []resp2.RESPValue{
+			{Type: resp2.BulkString, Str: link.addr},
+			{Type: resp2.BulkString, Str: strconv.Itoa(link.port)},
+			{Type: resp2.BulkString, Str: strconv.FormatInt(acked, 10)},
+		}})
+	}
+	return &resp2.RESPValue{Type: resp2.Array, Array: []resp2.RESPValue{
+		{Type: resp2.BulkString, Str: "master"},
+		{Type: resp2.Integer, Int: offset},
+		{Type: resp2.Array, Array: replicas},
+	}}
+}
+
+// sortedReplicas returns the replicas ordered by address; the caller must
+// hold the replication mutex
+func (s *Server) sortedReplicas() []*replicaLink {
+	links := make([]*replicaLink, 0, len(s.repl.replicas))
+	for link := range s.repl.replicas {
+		links = append(links, link)
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].name() < links[j].name() })
+	return links
+}
+
+// infoReplication renders the Replication section
+func (s *Server) infoReplication() []string {
+	s.repl.mutex.Lock()
+	defer s.repl.mutex.Unlock()
+	var lines []string
+	if master := s.repl.master; master != nil {
+		state, syncing := master.status()
+		lines = append(lines,
+			"role:slave",
+			fmt.Sprintf("master_host:%s", master.host),
+			fmt.Sprintf("master_port:%d", master.port),
+			fmt.Sprintf("master_link_status:%s", upOrDown(state == linkConnected)),
+			fmt.Sprintf("master_last_io_seconds_ago:%d", time.Now().Unix()-master.lastIO.Load()),
+			fmt.Sprintf("master_sync_in_progress:%d", boolToInt(syncing)),
+			fmt.Sprintf("slave_repl_offset:%d", s.repl.backlog.Offset()),
+			fmt.Sprintf("slave_read_only:%d", boolToInt(s.replicaReadOnly.Load())),
+		)
+	} else {
+		lines = append(lines, "role:master")
+	}
+	lines = append(lines, fmt.Sprintf("connected_slaves:%d", len(s.repl.replicas)))
+	if s.repl.master == nil && s.minReplicasToWrite.Load() > 0 {
+		lines = append(lines, fmt.Sprintf("min_slaves_good_slaves:%d", s.goodReplicas()))
+	}
+	for i, link := range s.sortedReplicas() {
+		link.mutex.Lock()
+		lines = append(lines, fmt.Sprintf("slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d",
+			i, link.addr, link.port, link.state, link.ackOffset, int64(time.Since(link.ackTime).Seconds())))
+		link.mutex.Unlock()
+	}
+	return append(lines,
+		fmt.Sprintf("master_replid:%s", s.repl.id),
+		fmt.Sprintf("master_replid2:%s", s.repl.id2),
+		fmt.Sprintf("master_repl_offset:%d", s.repl.backlog.Offset()),
+		fmt.Sprintf("second_repl_offset:%d", s.repl.secondOffset),
+		"repl_backlog_active:1",
+		fmt.Sprintf("repl_backlog_size:%d", s.repl.backlog.Size()),
+		fmt.Sprintf("repl_backlog_first_byte_offset:%d", s.repl.backlog.FirstOffset()),
+		fmt.Sprintf("repl_backlog_histlen:%d", s.repl.backlog.Len()),
+	)
+}
+
+// infoStats renders the Stats section
+func (s *Server) infoStats() []string {
+	s.repl.mutex.Lock()
+	defer s.repl.mutex.Unlock()
+	return []string{
+		fmt.Sprintf("sync_full:%d", s.repl.syncFull),
+		fmt.Sprintf("sync_partial_ok:%d", s.repl.syncPartialOK),
+		fmt.Sprintf("sync_partial_err:%d", s.repl.syncPartialErr),
+		fmt.Sprintf("migrate_cached_sockets:%d", s.migrateSockets.size()),
+	}
+}
+
+// notAnInteger is the error reply for arguments that must be integers
+func notAnInteger() *resp2.RESPValue {
+	return &resp2.RESPValue{Type: resp2.Error, Str: "ERR value is not an integer or out of range"}
+}
+
+// upOrDown renders a link status
+func upOrDown(up bool) string {
+	if up {
+		return "up"
+	}
+	return "down"
+}
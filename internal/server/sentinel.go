@@ -0,0 +1,649 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"redis-like-server/internal/client"
+	"redis-like-server/internal/connection"
+	"redis-like-server/internal/replication"
+	"redis-like-server/internal/resp2"
+	"redis-like-server/internal/sentinel"
+)
+
+const (
+	// DefaultSentinelDownAfter is how long a monitored instance may stay
+	// silent before a sentinel sees it down
+	DefaultSentinelDownAfter = 30 * time.Second
+	// DefaultSentinelFailoverTimeout bounds each step of a failover, and
+	// twice it is how long a sentinel waits before failing the same master
+	// over again
+	DefaultSentinelFailoverTimeout = 3 * time.Minute
+	// sentinelCronPeriod is how often a sentinel starts probing instances
+	// it has no link to yet and moves failovers forward
+	sentinelCronPeriod = 100 * time.Millisecond
+	// sentinelTimeout bounds the connections and commands of a sentinel to
+	// the instances it monitors
+	sentinelTimeout = time.Second
+)
+
+// sentinelLinks tracks the goroutines probing each instance and reading
+// the hello channel of each master and replica
+type sentinelLinks struct {
+	mutex         sync.Mutex
+	probes        map[sentinel.Target]bool
+	subscriptions map[sentinel.Addr]bool
+}
+
+// ParseSentinelMonitor parses a "name host port quorum" master to monitor
+func ParseSentinelMonitor(spec string) (string, sentinel.Addr, int, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 4 {
+		return "", sentinel.Addr{}, 0, fmt.Errorf("invalid master to monitor %q: expected \"name host port quorum\"", spec)
+	}
+	addr, err := sentinel.ParseAddr(fields[1], fields[2])
+	if err != nil {
+		return "", sentinel.Addr{}, 0, fmt.Errorf("invalid master to monitor %q: %w", spec, err)
+	}
+	quorum, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return "", sentinel.Addr{}, 0, fmt.Errorf("invalid master to monitor %q: invalid quorum", spec)
+	}
+	return fields[0], addr, quorum, nil
+}
+
+// sentinelDownAfter returns the down after period of the masters given at
+// startup
+func (s *Server) sentinelDownAfter() time.Duration {
+	if s.config.SentinelDownAfter > 0 {
+		return s.config.SentinelDownAfter
+	}
+	return DefaultSentinelDownAfter
+}
+
+// sentinelFailoverTimeout returns the failover timeout of the masters
+// given at startup
+func (s *Server) sentinelFailoverTimeout() time.Duration {
+	if s.config.SentinelFailoverTimeout > 0 {
+		return s.config.SentinelFailoverTimeout
+	}
+	return DefaultSentinelFailoverTimeout
+}
+
+// startSentinel starts the server as a sentinel: instead of serving a
+// dataset it monitors the configured masters and answers sentinel commands
+func (s *Server) startSentinel() error {
+	if s.config.ClusterEnabled || s.config.ReplicaOf != "" {
+		return fmt.Errorf("sentinel mode does not allow cluster mode or replicaof")
+	}
+	s.sentinel = sentinel.NewState(replication.NewID())
+	for _, spec := range s.config.SentinelMonitor {
+		name, addr, quorum, err := ParseSentinelMonitor(spec)
+		if err != nil {
+			return err
+		}
+		if err := s.sentinel.Monitor(name, addr, quorum, s.sentinelDownAfter(), s.sentinelFailoverTimeout()); err != nil {
+			return fmt.Errorf("invalid master to monitor %q: %v", spec, err)
+		}
+	}
+	s.sentinelLinks = &sentinelLinks{
+		probes:        make(map[sentinel.Target]bool),
+		subscriptions: make(map[sentinel.Addr]bool),
+	}
+	s.parser = resp2.NewRESP2Parser()
+	s.connManager = connection.NewConnectionManager(s.config.MaxClients)
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.config.Port))
+	if err != nil {
+		return fmt.Errorf("failed to start server on port %d: %w", s.config.Port, err)
+	}
+	s.listener = listener
+	fmt.Printf("Sentinel ID is %s\n", s.sentinel.MyID())
+
+	s.setupSignalHandling()
+	s.wg.Add(2)
+	go s.acceptConnections()
+	go s.sentinelCron()
+	return nil
+}
+
+// sentinelCron starts probing every instance that has no link yet, then
+// runs failure detection and failovers, sending the instances what they
+// call for
+func (s *Server) sentinelCron() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(sentinelCronPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		links := s.sentinelLinks
+		for _, target := range s.sentinel.Targets() {
+			links.mutex.Lock()
+			if !links.probes[target] {
+				links.probes[target] = true
+				s.wg.Add(1)
+				go s.probeInstance(target)
+			}
+			if !target.Sentinel && !links.subscriptions[target.Addr] {
+				links.subscriptions[target.Addr] = true
+				s.wg.Add(1)
+				go s.subscribeHello(target.Addr)
+			}
+			links.mutex.Unlock()
+		}
+		for _, action := range s.sentinel.Cron(time.Now()) {
+			s.wg.Add(1)
+			go s.runSentinelAction(action)
+		}
+		s.publishSentinelEvents()
+	}
+}
+
+// publishSentinelEvents logs the events of the sentinel and publishes
+// each on the channel named after it, as Redis Sentinel does
+func (s *Server) publishSentinelEvents() {
+	for _, event := range s.sentinel.Events() {
+		fmt.Printf("%s %s\n", event.Type, event.Message)
+		s.connManager.GetPubSub().Publish(event.Type, event.Message)
+	}
+}
+
+// probeInstance pings an instance every period until it is no longer
+// monitored. Masters and replicas are also asked for their role, and hear
+// this sentinel announce itself on their hello channel.
+func (s *Server) probeInstance(target sentinel.Target) {
+	defer s.wg.Done()
+	defer func() {
+		s.sentinelLinks.mutex.Lock()
+		delete(s.sentinelLinks.probes, target)
+		s.sentinelLinks.mutex.Unlock()
+	}()
+
+	var conn *client.Client
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	var lastHello time.Time
+	ticker := time.NewTicker(sentinel.PingPeriod)
+	defer ticker.Stop()
+	for s.sentinel.Monitors(target) {
+		s.sentinel.PingSent(target.Addr, time.Now())
+		var err error
+		if conn == nil {
+			conn, err = client.Dial(target.String(), sentinelTimeout)
+		}
+		if err == nil {
+			announce := !target.Sentinel && time.Since(lastHello) >= sentinel.HelloPeriod
+			if err = s.probe(conn, target, announce); err == nil && announce {
+				lastHello = time.Now()
+			}
+		}
+		if err != nil && conn != nil {
+			conn.Close()
+			conn = nil
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe pings an instance and, for a master or replica, asks for its role
+// and, when announce is set, publishes this sentinel's hello messages
+func (s *Server) probe(conn *client.Client, target sentinel.Target, announce bool) error {
+	if _, err := conn.Do("PING"); err != nil {
+		return err
+	}
+	s.sentinel.Pong(target.Addr, time.Now())
+	if target.Sentinel {
+		return nil
+	}
+
+	reply, err := conn.Do("ROLE")
+	if err != nil {
+		return err
+	}
+	if role, ok := parseRole(reply); ok {
+		s.sentinel.SetRole(target.Addr, role, time.Now())
+	}
+	if !announce {
+		return nil
+	}
+	host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	for _, hello := range s.sentinel.Hellos(target.Addr) {
+		hello.Addr = sentinel.Addr{Host: host, Port: s.listener.Addr().(*net.TCPAddr).Port}
+		if _, err := conn.Do("PUBLISH", sentinel.HelloChannel, hello.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseRole parses the ROLE reply of a master or replica
+func parseRole(reply *resp2.RESPValue) (sentinel.Role, bool) {
+	if reply.Type != resp2.Array || len(reply.Array) == 0 {
+		return sentinel.Role{}, false
+	}
+	fields := reply.Array
+	switch fields[0].Str {
+	case "master":
+		if len(fields) != 3 {
+			return sentinel.Role{}, false
+		}
+		role := sentinel.Role{Master: true, Offset: fields[1].Int}
+		for _, replica := range fields[2].Array {
+			if len(replica.Array) < 2 {
+				continue
+			}
+			if addr, err := sentinel.ParseAddr(replica.Array[0].Str, replica.Array[1].Str); err == nil {
+				role.Replicas = append(role.Replicas, addr)
+			}
+		}
+		return role, true
+	case "slave":
+		if len(fields) != 5 {
+			return sentinel.Role{}, false
+		}
+		return sentinel.Role{
+			MasterAddr: sentinel.Addr{Host: fields[1].Str, Port: int(fields[2].Int)},
+			LinkUp:     fields[3].Str == linkConnected,
+			Offset:     fields[4].Int,
+		}, true
+	}
+	return sentinel.Role{}, false
+}
+
+// subscribeHello reads the hello channel of a master or replica until it
+// is no longer monitored, reconnecting after failures
+func (s *Server) subscribeHello(addr sentinel.Addr) {
+	defer s.wg.Done()
+	defer func() {
+		s.sentinelLinks.mutex.Lock()
+		delete(s.sentinelLinks.subscriptions, addr)
+		s.sentinelLinks.mutex.Unlock()
+	}()
+
+	target := sentinel.Target{Addr: addr}
+	for s.sentinel.Monitors(target) {
+		s.readHellos(target)
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(sentinelTimeout):
+		}
+	}
+}
+
+// readHellos subscribes to the hello channel of an instance and processes
+// the announcements of the sentinels. Every sentinel, this one included,
+// announces itself every hello period, so a silent channel means a broken
+// connection.
+func (s *Server) readHellos(target sentinel.Target) error {
+	conn, err := client.Dial(target.String(), 2*sentinel.HelloPeriod)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(s.ctx, func() { conn.Close() })
+	defer stop()
+
+	if _, err := conn.Do("SUBSCRIBE", sentinel.HelloChannel); err != nil {
+		return err
+	}
+	for s.sentinel.Monitors(target) {
+		message, err := conn.Receive()
+		if err != nil {
+			return err
+		}
+		if len(message.Array) != 3 || message.Array[0].Str != "message" {
+			continue
+		}
+		if hello, err := sentinel.ParseHello(message.Array[2].Str); err == nil {
+			s.sentinel.ProcessHello(hello, time.Now())
+		}
+	}
+	return nil
+}
+
+// runSentinelAction sends an instance the command an action calls for
+func (s *Server) runSentinelAction(action sentinel.Action) {
+	defer s.wg.Done()
+	conn, err := client.Dial(action.Target.String(), sentinelTimeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	switch action.Kind {
+	case sentinel.ActionAsk:
+		var reply *resp2.RESPValue
+		reply, err = conn.Do("SENTINEL", "IS-MASTER-DOWN-BY-ADDR", action.MasterAddr.Host, strconv.Itoa(action.MasterAddr.Port),
+			strconv.FormatUint(action.Epoch, 10), action.RunID)
+		if err == nil && len(reply.Array) == 3 {
+			down := reply.Array[0].Int == 1
+			s.sentinel.DownReply(action.MasterName, action.SentinelID, down, reply.Array[1].Str, uint64(reply.Array[2].Int), time.Now())
+		}
+	case sentinel.ActionPromote:
+		_, err = conn.Do("REPLICAOF", "NO", "ONE")
+	case sentinel.ActionReplicate:
+		_, err = conn.Do("REPLICAOF", action.MasterAddr.Host, strconv.Itoa(action.MasterAddr.Port))
+	}
+	if err != nil {
+		fmt.Printf("Error sending a command to %s: %v\n", action.Target, err)
+	}
+}
+
+// executeSentinelCommand executes a command in sentinel mode, where only
+// the commands about the monitored masters and Pub/Sub are served
+func (s *Server) executeSentinelCommand(clientConn *connection.ClientConnection, cmd *resp2.Command) *resp2.RESPValue {
+	switch cmd.Name {
+	case "SUBSCRIBE":
+		return s.handleSubscribe(clientConn, cmd.Args)
+	case "UNSUBSCRIBE":
+		return s.handleUnsubscribe(clientConn, cmd.Args)
+	case "PSUBSCRIBE":
+		return s.handlePSubscribe(clientConn, cmd.Args)
+	case "PUNSUBSCRIBE":
+		return s.handlePUnsubscribe(clientConn, cmd.Args)
+	case "PING":
+		if clientConn.IsSubscriber() {
+			return s.handleSubscriberPing(cmd.Args)
+		}
+		switch len(cmd.Args) {
+		case 0:
+			return &resp2.RESPValue{Type: resp2.SimpleString, Str: "PONG"}
+		case 1:
+			return &resp2.RESPValue{Type: resp2.BulkString, Str: cmd.Args[0]}
+		}
+		return wrongArgs("PING")
+	case "INFO":
+		return s.handleInfo(cmd.Args)
+	case "ROLE":
+		if len(cmd.Args) != 0 {
+			return wrongArgs("ROLE")
+		}
+		names := []resp2.RESPValue{}
+		for _, m := range s.sentinel.Masters() {
+			names = append(names, resp2.RESPValue{Type: resp2.BulkString, Str: m.Name})
+		}
+		return &resp2.RESPValue{Type: resp2.Array, Array: []resp2.RESPValue{
+			{Type: resp2.BulkString, Str: "sentinel"},
+			{Type: resp2.Array, Array: names},
+		}}
+	case "SENTINEL":
+		return s.handleSentinel(cmd.Args)
+	}
+	return &resp2.RESPValue{Type: resp2.Error, Str: fmt.Sprintf("ERR unknown command '%s'", cmd.Name)}
+}
+
+// handleSentinel handles the SENTINEL subcommands
+func (s *Server) handleSentinel(args []string) *resp2.RESPValue {
+	if len(args) == 0 {
+		return wrongArgs("SENTINEL")
+	}
+	name, args := args[0], args[1:]
+	subcommand := strings.ToUpper(name)
+	// Every subcommand but these few is about one master, named first
+	switch subcommand {
+	case "MASTERS":
+		if len(args) != 0 {
+			return wrongArgs("SENTINEL|MASTERS")
+		}
+		masters := []resp2.RESPValue{}
+		for _, m := range s.sentinel.Masters() {
+			masters = append(masters, describeMaster(m))
+		}
+		return &resp2.RESPValue{Type: resp2.Array, Array: masters}
+	case "MYID":
+		return &resp2.RESPValue{Type: resp2.BulkString, Str: s.sentinel.MyID()}
+	case "MONITOR":
+		return s.sentinelMonitor(args)
+	case "IS-MASTER-DOWN-BY-ADDR":
+		return s.sentinelIsMasterDownByAddr(args)
+	case "SET":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return wrongArgs("SENTINEL|SET")
+		}
+		for i := 1; i < len(args); i += 2 {
+			if err := s.sentinel.Set(args[0], args[i], args[i+1]); err != nil {
+				return &resp2.RESPValue{Type: resp2.Error, Str: "ERR " + err.Error()}
+			}
+		}
+		return &resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"}
+	case "MASTER", "GET-MASTER-ADDR-BY-NAME", "REPLICAS", "SLAVES", "SENTINELS", "REMOVE", "FAILOVER", "CKQUORUM":
+		if len(args) != 1 {
+			return wrongArgs("SENTINEL|" + subcommand)
+		}
+	default:
+		return &resp2.RESPValue{
+			Type: resp2.Error,
+			Str:  fmt.Sprintf("ERR unknown subcommand '%s'. Try SENTINEL HELP.", name),
+		}
+	}
+
+	if subcommand == "GET-MASTER-ADDR-BY-NAME" {
+		m, err := s.sentinel.Master(args[0])
+		if err != nil {
+			return &resp2.RESPValue{Type: resp2.NullBulkString, Null: true}
+		}
+		return &resp2.RESPValue{Type: resp2.Array, Array: []resp2.RESPValue{
+			{Type: resp2.BulkString, Str: m.Host},
+			{Type: resp2.BulkString, Str: strconv.Itoa(m.Port)},
+		}}
+	}
+	m, err := s.sentinel.Master(args[0])
+	if err != nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR " + err.Error()}
+	}
+	switch subcommand {
+	case "MASTER":
+		reply := describeMaster(m)
+		return &reply
+	case "REPLICAS", "SLAVES":
+		replicas := []resp2.RESPValue{}
+		for _, r := range m.Replicas {
+			replicas = append(replicas, describeReplica(r))
+		}
+		return &resp2.RESPValue{Type: resp2.Array, Array: replicas}
+	case "SENTINELS":
+		sentinels := []resp2.RESPValue{}
+		for _, r := range m.Sentinels {
+			sentinels = append(sentinels, describeSentinel(r))
+		}
+		return &resp2.RESPValue{Type: resp2.Array, Array: sentinels}
+	case "REMOVE":
+		s.sentinel.Remove(m.Name)
+	case "FAILOVER":
+		if err := s.sentinel.Failover(m.Name, time.Now()); err != nil {
+			return &resp2.RESPValue{Type: resp2.Error, Str: sentinelError(err)}
+		}
+	case "CKQUORUM":
+		usable, err := s.sentinel.CheckQuorum(m.Name)
+		if err != nil {
+			return &resp2.RESPValue{Type: resp2.Error, Str: sentinelError(err)}
+		}
+		return &resp2.RESPValue{
+			Type: resp2.SimpleString,
+			Str:  fmt.Sprintf("OK %d usable Sentinels. Quorum and failover authorization can be reached", usable),
+		}
+	}
+	return &resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"}
+}
+
+// sentinelError renders an error of the sentinel state as an error reply,
+// keeping the error codes it starts with
+func sentinelError(err error) string {
+	code, _, _ := strings.Cut(err.Error(), " ")
+	if code != "" && code == strings.ToUpper(code) {
+		return err.Error()
+	}
+	return "ERR " + err.Error()
+}
+
+// sentinelMonitor handles SENTINEL MONITOR name ip port quorum
+func (s *Server) sentinelMonitor(args []string) *resp2.RESPValue {
+	if len(args) != 4 {
+		return wrongArgs("SENTINEL|MONITOR")
+	}
+	addr, err := sentinel.ParseAddr(args[1], args[2])
+	if err != nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR Invalid port"}
+	}
+	quorum, err := strconv.Atoi(args[3])
+	if err != nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR Invalid quorum"}
+	}
+	if err := s.sentinel.Monitor(args[0], addr, quorum, s.sentinelDownAfter(), s.sentinelFailoverTimeout()); err != nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR " + err.Error()}
+	}
+	return &resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"}
+}
+
+// sentinelIsMasterDownByAddr handles SENTINEL IS-MASTER-DOWN-BY-ADDR ip
+// port current-epoch runid, by which sentinels agree a master is down and
+// elect the one to fail it over
+func (s *Server) sentinelIsMasterDownByAddr(args []string) *resp2.RESPValue {
+	if len(args) != 4 {
+		return wrongArgs("SENTINEL|IS-MASTER-DOWN-BY-ADDR")
+	}
+	addr, err := sentinel.ParseAddr(args[0], args[1])
+	if err != nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR Invalid port"}
+	}
+	epoch, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		return &resp2.RESPValue{Type: resp2.Error, Str: "ERR Invalid epoch"}
+	}
+	down, leader, leaderEpoch := s.sentinel.IsMasterDownByAddr(addr, epoch, args[3], time.Now())
+	return &resp2.RESPValue{Type: resp2.Array, Array: []resp2.RESPValue{
+		{Type: resp2.Integer, Int: int64(boolToInt(down))},
+		{Type: resp2.BulkString, Str: leader},
+		{Type: resp2.Integer, Int: int64(leaderEpoch)},
+	}}
+}
+
+// fieldList renders names and values as a flat list of bulk strings
+func fieldList(fields ...string) resp2.RESPValue {
+	list := make([]resp2.RESPValue, len(fields))
+	for i, field := range fields {
+		list[i] = resp2.RESPValue{Type: resp2.BulkString, Str: field}
+	}
+	return resp2.RESPValue{Type: resp2.Array, Array: list}
+}
+
+// instanceFlags renders the flags of an instance as in Redis Sentinel
+func instanceFlags(role string, i sentinel.Instance, extra ...string) string {
+	flags := []string{role}
+	if i.SDown {
+		flags = append(flags, "s_down")
+	}
+	return strings.Join(append(flags, extra...), ",")
+}
+
+// sinceMs renders how many milliseconds ago a Unix time in milliseconds
+// was, 0 for none
+func sinceMs(at int64) string {
+	if at == 0 {
+		return "0"
+	}
+	return strconv.FormatInt(time.Now().UnixMilli()-at, 10)
+}
+
+// describeMaster renders a master as in SENTINEL MASTER
+func describeMaster(m sentinel.Master) resp2.RESPValue {
+	var extra []string
+	if m.ODown {
+		extra = append(extra, "o_down")
+	}
+	if m.Failover != sentinel.FailoverNone {
+		extra = append(extra, "failover_in_progress")
+	}
+	return fieldList(
+		"name", m.Name,
+		"ip", m.Host,
+		"port", strconv.Itoa(m.Port),
+		"flags", instanceFlags("master", m.Instance, extra...),
+		"last-ping-sent", sinceMs(m.PingSent),
+		"last-ok-ping-reply", sinceMs(m.LastPong),
+		"num-slaves", strconv.Itoa(len(m.Replicas)),
+		"num-other-sentinels", strconv.Itoa(len(m.Sentinels)),
+		"quorum", strconv.Itoa(m.Quorum),
+		"down-after-milliseconds", strconv.FormatInt(m.DownAfter.Milliseconds(), 10),
+		"failover-timeout", strconv.FormatInt(m.FailoverTimeout.Milliseconds(), 10),
+		"config-epoch", strconv.FormatUint(m.ConfigEpoch, 10),
+		"failover-state", string(m.Failover),
+	)
+}
+
+// describeReplica renders a replica as in SENTINEL REPLICAS
+func describeReplica(r sentinel.Instance) resp2.RESPValue {
+	linkStatus := "err"
+	if r.Role.LinkUp {
+		linkStatus = "ok"
+	}
+	role := "slave"
+	if r.RoleAt != 0 && r.Role.Master {
+		role = "master"
+	}
+	return fieldList(
+		"name", r.String(),
+		"ip", r.Host,
+		"port", strconv.Itoa(r.Port),
+		"flags", instanceFlags("slave", r),
+		"last-ping-sent", sinceMs(r.PingSent),
+		"last-ok-ping-reply", sinceMs(r.LastPong),
+		"role-reported", role,
+		"master-host", r.Role.MasterAddr.Host,
+		"master-port", strconv.Itoa(r.Role.MasterAddr.Port),
+		"master-link-status", linkStatus,
+		"slave-repl-offset", strconv.FormatInt(r.Role.Offset, 10),
+	)
+}
+
+// describeSentinel renders another sentinel as in SENTINEL SENTINELS
+func describeSentinel(r sentinel.Instance) resp2.RESPValue {
+	return fieldList(
+		"name", r.RunID,
+		"ip", r.Host,
+		"port", strconv.Itoa(r.Port),
+		"runid", r.RunID,
+		"flags", instanceFlags("sentinel", r),
+		"last-ping-sent", sinceMs(r.PingSent),
+		"last-ok-ping-reply", sinceMs(r.LastPong),
+		"voted-leader", r.Leader,
+		"voted-leader-epoch", strconv.FormatUint(r.LeaderEpoch, 10),
+	)
+}
+
+// infoSentinel renders the Sentinel section of INFO
+func (s *Server) infoSentinel() []string {
+	masters := s.sentinel.Masters()
+	lines := []string{fmt.Sprintf("sentinel_masters:%d", len(masters))}
+	for i, m := range masters {
+		status := "ok"
+		if m.ODown {
+			status = "odown"
+		} else if m.SDown {
+			status = "sdown"
+		}
+		lines = append(lines, fmt.Sprintf("master%d:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d",
+			i, m.Name, status, m.Addr, len(m.Replicas), len(m.Sentinels)+1))
+	}
+	return lines
+}
@@ -6,22 +6,131 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"redis-like-server/internal/aof"
+	"redis-like-server/internal/cluster"
 	"redis-like-server/internal/connection"
+	"redis-like-server/internal/crdt"
+	"redis-like-server/internal/crypt"
 	"redis-like-server/internal/handler"
+	"redis-like-server/internal/jsonl"
 	"redis-like-server/internal/resp2"
+	"redis-like-server/internal/sentinel"
 	"redis-like-server/internal/store"
 )
 
 // ServerConfig holds the server configuration
 type ServerConfig struct {
-	Port         int
-	MaxClients   int
-	ReadTimeout  time.Duration
-	WriteTimeout time.Duration
+	Port                 int
+	MaxClients           int
+	ReadTimeout          time.Duration
+	WriteTimeout         time.Duration
+	NotifyKeyspaceEvents string
+
+	// Snapshot persistence; an empty DBFilename disables snapshots
+	Dir        string
+	DBFilename string
+	SaveRules  []SaveRule
+
+	// Append-only file persistence
+	AppendOnly       bool
+	AppendFilename   string
+	AppendDirname    string
+	AppendFsync      aof.FsyncPolicy
+	AOFLoadTruncated bool
+	// AOFTimestampEnabled annotates the append-only file with the time
+	// commands were logged, for point-in-time recovery
+	AOFTimestampEnabled bool
+
+	// Encryption encrypts snapshots and append-only files with its current
+	// key and decrypts files written with any of its keys; nil disables
+	// encryption
+	Encryption *crypt.Keyring
+
+	// StorageEngine names the storage engine holding the dataset, "memory"
+	// by default; StorageDir is where a persistent engine keeps its files,
+	// relative to Dir unless absolute, "storage" by default
+	StorageEngine string
+	StorageDir    string
+	// TieredMemoryLimit is how many bytes of values the tiered engine keeps
+	// in memory, and TieredPolicy picks the ones it spills: "lru" or "lfu"
+	TieredMemoryLimit int64
+	TieredPolicy      string
+
+	// ImportJSONL, when set, is a JSON Lines file imported into the dataset
+	// at startup, resolving keys that already exist by ImportConflict
+	ImportJSONL    string
+	ImportConflict jsonl.ConflictPolicy
+
+	// ReplicaOf, as "host port", makes the server a replica of that master
+	// at startup; ReplBacklogSize is the size in bytes of the backlog
+	// replicas resume from after a short disconnect
+	ReplicaOf       string
+	ReplBacklogSize int
+	// ReplicaReadOnly makes a replica refuse writes from its clients.
+	// A master refuses writes while fewer than MinReplicasToWrite replicas
+	// acknowledged the stream within MinReplicasMaxLag seconds; 0 replicas
+	// disables the check
+	ReplicaReadOnly    bool
+	MinReplicasToWrite int
+	MinReplicasMaxLag  int
+
+	// ClusterEnabled runs the server as a node of a cluster, serving the
+	// hash slots it is assigned and redirecting clients to the nodes
+	// serving the others. ClusterConfigFile is where the node keeps its
+	// view of the cluster, relative to Dir unless absolute, "nodes.conf" by
+	// default; ClusterPort is the port of the cluster bus, the client port
+	// plus 10000 by default. A node silent for ClusterNodeTimeout is
+	// flagged as failing, DefaultClusterNodeTimeout when zero
+	ClusterEnabled     bool
+	ClusterConfigFile  string
+	ClusterPort        int
+	ClusterNodeTimeout time.Duration
+
+	// Sentinel runs the server as a sentinel monitoring the masters of
+	// SentinelMonitor, given as "name host port quorum", and failing them
+	// over to a replica when a quorum of sentinels sees them down, instead
+	// of serving a dataset. A master silent for SentinelDownAfter is down;
+	// SentinelFailoverTimeout bounds each step of a failover
+	Sentinel                bool
+	SentinelMonitor         []string
+	SentinelDownAfter       time.Duration
+	SentinelFailoverTimeout time.Duration
+
+	// ActiveActive makes the server one of several instances accepting
+	// writes: it exchanges them with ActiveActivePeers, given as
+	// "host:port", and resolves conflicts so that all converge.
+	// ActiveActiveFile is where it keeps its replicated state, relative to
+	// Dir unless absolute, "crdt.conf" by default
+	ActiveActive      bool
+	ActiveActivePeers []string
+	ActiveActiveFile  string
+
+	// Raft makes the server a member of a group replicating every command
+	// through a Raft log, acknowledging writes once a majority holds them
+	// and redirecting clients of followers to the leader. A new member
+	// starts its own group unless RaftJoin, as "host:port", names a member
+	// of one to join. RaftAddr is where the others reach this member,
+	// 127.0.0.1 and the client port by default; RaftDir is where it keeps
+	// its log, relative to Dir unless absolute, "raft" by default
+	Raft     bool
+	RaftJoin string
+	RaftAddr string
+	RaftDir  string
+
+	// RecoveryTarget, when set, rebuilds the dataset at startup from the
+	// append-only file up to this point instead of loading it normally
+	RecoveryTarget *aof.Target
+
+	// Automatic AOF rewrite once the file grew by this percentage over its
+	// base and is at least the minimum size; a percentage of 0 disables it
+	AutoAOFRewritePercentage int
+	AutoAOFRewriteMinSize    int64
 }
 
 // Server represents the main Redis-like server
@@ -31,31 +140,181 @@ type Server struct {
 	parser      resp2.RESP2Parser
 	handler     handler.CommandHandler
 	connManager connection.ConnectionManager
+	notifier    *handler.KeyspaceNotifier
 	config      *ServerConfig
 	ctx         context.Context
 	cancel      context.CancelFunc
 	wg          sync.WaitGroup
 	shutdown    chan struct{}
+	startTime   time.Time
+
+	// Persistence state
+	dirty            atomic.Int64
+	lastSave         atomic.Int64
+	bgsaveInProgress atomic.Bool
+	lastBgsaveOK     atomic.Bool
+	saveMutex        sync.Mutex
+	configMutex      sync.RWMutex
+	saveRules        []SaveRule
+	aof              *aof.MultiPartAOF
+	// storageAside is where the storage directory was moved for a recovery
+	storageAside string
+
+	// AOF rewrite state
+	aofRewriteInProgress     atomic.Bool
+	lastBgrewriteOK          atomic.Bool
+	autoAOFRewritePercentage atomic.Int64
+	autoAOFRewriteMinSize    atomic.Int64
+	aofTimestampEnabled      atomic.Bool
+
+	// Cluster state; nil unless cluster mode is enabled
+	cluster  *cluster.State
+	bus      *clusterBus
+	keyIndex *cluster.IndexedStore
+	// clusterSaveMutex serializes the writes of the nodes configuration file
+	clusterSaveMutex   sync.Mutex
+	clusterNodeTimeout atomic.Int64
+	failover           *failoverState
+
+	// Sentinel state; nil unless sentinel mode is enabled
+	sentinel      *sentinel.State
+	sentinelLinks *sentinelLinks
+
+	// Active-active state; nil unless active-active mode is enabled
+	crdt  *crdt.State
+	peers *peerLinks
+
+	// Raft state; nil unless Raft mode is enabled
+	raft *raftState
+
+	// Connections cached for the next MIGRATE to the same target
+	migrateSockets *migrateCache
+
+	// Replication state
+	repl               *replState
+	replicaReadOnly    atomic.Bool
+	minReplicasToWrite atomic.Int64
+	minReplicasMaxLag  atomic.Int64
+
+	// writeMutex serializes write commands so the order in which they change
+	// the store is the order in which they are logged
+	writeMutex sync.Mutex
 }
 
 // NewServer creates a new server instance
 func NewServer(config *ServerConfig) *Server {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Server{
-		config:   config,
-		ctx:      ctx,
-		cancel:   cancel,
-		shutdown: make(chan struct{}),
+	s := &Server{
+		config:    config,
+		ctx:       ctx,
+		cancel:    cancel,
+		shutdown:  make(chan struct{}),
+		saveRules: config.SaveRules,
+		repl:      newReplState(config.ReplBacklogSize),
+		failover:  &failoverState{},
+
+		migrateSockets: newMigrateCache(),
 	}
+	s.lastSave.Store(time.Now().Unix())
+	s.lastBgsaveOK.Store(true)
+	s.lastBgrewriteOK.Store(true)
+	s.autoAOFRewritePercentage.Store(int64(config.AutoAOFRewritePercentage))
+	s.autoAOFRewriteMinSize.Store(config.AutoAOFRewriteMinSize)
+	s.aofTimestampEnabled.Store(config.AOFTimestampEnabled)
+	s.replicaReadOnly.Store(config.ReplicaReadOnly)
+	s.minReplicasToWrite.Store(int64(config.MinReplicasToWrite))
+	s.minReplicasMaxLag.Store(int64(config.MinReplicasMaxLag))
+	nodeTimeout := config.ClusterNodeTimeout
+	if nodeTimeout <= 0 {
+		nodeTimeout = DefaultClusterNodeTimeout
+	}
+	s.clusterNodeTimeout.Store(nodeTimeout.Milliseconds())
+	return s
 }
 
 // Start initializes and starts the server
 func (s *Server) Start() error {
+	s.startTime = time.Now()
+	if s.config.Sentinel {
+		return s.startSentinel()
+	}
+	notifyClasses, err := handler.ParseKeyspaceEvents(s.config.NotifyKeyspaceEvents)
+	if err != nil {
+		return err
+	}
+	var masterHost string
+	var masterPort int
+	if s.config.ReplicaOf != "" {
+		if s.config.ClusterEnabled {
+			return fmt.Errorf("replicaof is not allowed in cluster mode")
+		}
+		if s.config.ActiveActive {
+			return fmt.Errorf("replicaof is not allowed in active-active mode")
+		}
+		if s.config.Raft {
+			return fmt.Errorf("replicaof is not allowed in Raft mode")
+		}
+		if masterHost, masterPort, err = ParseReplicaOf(s.config.ReplicaOf); err != nil {
+			return err
+		}
+	}
+	
 	// Initialize all components
-	s.store = store.NewInMemoryStore()
+	s.store, err = s.openStore()
+	if err != nil {
+		return fmt.Errorf("failed to open the %s storage engine: %w", s.storageEngine(), err)
+	}
+	if s.config.ClusterEnabled {
+		if err := s.indexSlots(); err != nil {
+			return err
+		}
+	}
 	s.parser = resp2.NewRESP2Parser()
-	s.handler = handler.NewCommandHandler(s.store)
 	s.connManager = connection.NewConnectionManager(s.config.MaxClients)
+	s.notifier = handler.NewKeyspaceNotifier(s.connManager.GetPubSub(), notifyClasses)
+	s.handler = handler.NewCommandHandlerWithNotifier(s.store, s.notifier)
+	
+	// Restore the dataset before accepting any client
+	if s.config.Raft {
+		switch {
+		case s.config.ClusterEnabled:
+			return fmt.Errorf("Raft mode is not allowed in cluster mode")
+		case s.config.ActiveActive:
+			return fmt.Errorf("Raft mode is not allowed in active-active mode")
+		case s.config.AppendOnly, s.config.RecoveryTarget != nil:
+			return fmt.Errorf("the Raft log replaces the append-only file")
+		case s.config.ImportJSONL != "":
+			return fmt.Errorf("importing is not allowed in Raft mode")
+		}
+		if err := s.openRaft(); err != nil {
+			return err
+		}
+	} else if err := s.loadData(); err != nil {
+		return err
+	}
+	if s.config.AppendOnly {
+		if err := s.openAppendOnlyFile(); err != nil {
+			return err
+		}
+	}
+	if s.config.ImportJSONL != "" {
+		if err := s.importJSONL(); err != nil {
+			return err
+		}
+	}
+	if s.config.ClusterEnabled {
+		if err := s.loadClusterConfig(); err != nil {
+			return err
+		}
+	}
+	if s.config.ActiveActive {
+		if s.config.ClusterEnabled {
+			return fmt.Errorf("active-active mode is not allowed in cluster mode")
+		}
+		if err := s.loadActiveActive(); err != nil {
+			return err
+		}
+	}
 	
 	// Set up TCP listener on configurable port
 	addr := fmt.Sprintf(":%d", s.config.Port)
@@ -65,6 +324,12 @@ func (s *Server) Start() error {
 	}
 	
 	s.listener = listener
+	if s.config.ClusterEnabled {
+		if err := s.startCluster(); err != nil {
+			listener.Close()
+			return err
+		}
+	}
 	
 	// Set up signal handling for graceful shutdown
 	s.setupSignalHandling()
@@ -73,6 +338,30 @@ func (s *Server) Start() error {
 	s.wg.Add(1)
 	go s.acceptConnections()
 	
+	// Start automatic snapshotting and AOF rewriting
+	if s.snapshotEnabled() || s.aof != nil {
+		s.wg.Add(1)
+		go s.persistenceCron()
+	}
+	
+	// Start pinging replicas and, when configured, replicating a master
+	s.wg.Add(1)
+	go s.replicationCron()
+	s.wg.Add(1)
+	go s.migrateCron()
+	if masterHost != "" {
+		s.startReplication(masterHost, masterPort, false)
+	}
+	// Expired keys are deleted once it is known whether this is a replica
+	s.wg.Add(1)
+	go s.expireCron()
+	if s.crdt != nil {
+		s.startActiveActive()
+	}
+	if s.raft != nil {
+		s.startRaft()
+	}
+	
 	return nil
 }
 
@@ -149,6 +438,28 @@ func (s *Server) Stop() error {
 		fmt.Println("Timeout waiting for connections to close, forcing shutdown")
 	}
 	
+	// Like Redis, save a final snapshot on shutdown when save rules are configured
+	if s.snapshotEnabled() && len(s.getSaveRules()) > 0 && s.store != nil {
+		fmt.Println("Saving the final snapshot before exiting...")
+		if err := s.saveSnapshot(); err != nil {
+			fmt.Printf("Error saving final snapshot: %v\n", err)
+		}
+	}
+	if s.aof != nil {
+		s.aof.Close()
+	}
+	if s.peers != nil && s.peers.file != nil {
+		s.peers.file.Close()
+	}
+	if s.raft != nil {
+		s.raft.storage.Close()
+	}
+	if s.store != nil {
+		if err := s.store.Close(); err != nil {
+			fmt.Printf("Error closing the storage engine: %v\n", err)
+		}
+	}
+	
 	// Signal that shutdown is complete
 	close(s.shutdown)
 	
@@ -179,16 +490,14 @@ func (s *Server) handleConnection(conn net.Conn) {
 	
 	// Ensure cleanup when function exits
 	defer func() {
+		s.removeReplica(clientConn)
+		s.removePeer(clientConn)
 		s.connManager.RemoveConnection(clientConn.GetID())
 	}()
 	
-	// Set connection timeouts if configured
-	if s.config.ReadTimeout > 0 {
-		conn.SetReadDeadline(time.Now().Add(s.config.ReadTimeout))
-	}
-	if s.config.WriteTimeout > 0 {
-		conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
-	}
+	// Writes may come from publishers as well as this goroutine, so the
+	// connection applies the write deadline itself on every write
+	clientConn.SetWriteTimeout(s.config.WriteTimeout)
 	
 	// Client request-response loop
 	for {
@@ -197,6 +506,14 @@ func (s *Server) handleConnection(conn net.Conn) {
 			// Server is shutting down, close connection gracefully
 			return
 		default:
+			// Subscribers and replicas may legitimately stay silent, so only
+			// idle request-response clients are subject to the read timeout
+			if s.config.ReadTimeout > 0 && !clientConn.IsSubscriber() && !clientConn.IsReplica() {
+				conn.SetReadDeadline(time.Now().Add(s.config.ReadTimeout))
+			} else {
+				conn.SetReadDeadline(time.Time{})
+			}
+			
 			// Read RESP2 commands from client connections
 			respValue, err := s.parser.Parse(clientConn.GetReader())
 			if err != nil {
@@ -228,8 +545,18 @@ func (s *Server) handleConnection(conn net.Conn) {
 				continue
 			}
 			
+			// QUIT acknowledges and then closes the connection
+			if cmd.Name == "QUIT" {
+				clientConn.Write(s.parser.Serialize(&resp2.RESPValue{Type: resp2.SimpleString, Str: "OK"}))
+				return
+			}
+			
 			// Execute command and get response
-			response := s.handler.Execute(cmd)
+			response := s.executeCommand(clientConn, cmd)
+			if response == nil {
+				// The command already wrote its replies
+				continue
+			}
 			
 			// Send response back to client
 			responseBytes := s.parser.Serialize(response)
@@ -238,14 +565,167 @@ func (s *Server) handleConnection(conn net.Conn) {
 				// Connection write error, cleanup and exit
 				return
 			}
-			
-			// Update connection timeouts for next iteration
-			if s.config.ReadTimeout > 0 {
-				conn.SetReadDeadline(time.Now().Add(s.config.ReadTimeout))
-			}
-			if s.config.WriteTimeout > 0 {
-				conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
-			}
 		}
 	}
-}
\ No newline at end of file
+}
+
+// executeCommand executes a command on behalf of a client. Commands that need
+// the client connection or server-wide state are handled here; everything
+// else is delegated to the command handler. A nil response means the command
+// has already written its replies to the client.
+func (s *Server) executeCommand(clientConn *connection.ClientConnection, cmd *resp2.Command) *resp2.RESPValue {
+	if clientConn.IsSubscriber() && !subscriberCommands[cmd.Name] {
+		return &resp2.RESPValue{
+			Type: resp2.Error,
+			Str: fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context",
+				strings.ToLower(cmd.Name)),
+		}
+	}
+	if s.sentinel != nil {
+		return s.executeSentinelCommand(clientConn, cmd)
+	}
+	// ASKING only holds for the command right after it
+	asking := clientConn.TakeAsking()
+	
+	switch cmd.Name {
+	case "SUBSCRIBE":
+		return s.handleSubscribe(clientConn, cmd.Args)
+	case "UNSUBSCRIBE":
+		return s.handleUnsubscribe(clientConn, cmd.Args)
+	case "PSUBSCRIBE":
+		return s.handlePSubscribe(clientConn, cmd.Args)
+	case "PUNSUBSCRIBE":
+		return s.handlePUnsubscribe(clientConn, cmd.Args)
+	case "PUBLISH":
+		return s.handlePublish(cmd.Args)
+	case "PUBSUB":
+		return s.handlePubSub(cmd.Args)
+	case "CONFIG":
+		return s.handleConfig(cmd.Args)
+	case "SAVE":
+		return s.handleSave(cmd.Args)
+	case "BGSAVE":
+		return s.handleBgsave(cmd.Args)
+	case "LASTSAVE":
+		return s.handleLastsave(cmd.Args)
+	case "BGREWRITEAOF":
+		return s.handleBgrewriteaof(cmd.Args)
+	case "INFO":
+		return s.handleInfo(cmd.Args)
+	case "REPLICAOF", "SLAVEOF":
+		return s.handleReplicaof(cmd.Args)
+	case "REPLCONF":
+		return s.handleReplconf(clientConn, cmd.Args)
+	case "PSYNC", "SYNC":
+		if cmd.Name == "SYNC" {
+			cmd = &resp2.Command{Name: "PSYNC", Args: []string{"?", "-1"}}
+		}
+		return s.handlePsync(clientConn, cmd.Args)
+	case "ROLE":
+		return s.handleRole(cmd.Args)
+	case "CLUSTER":
+		return s.handleCluster(clientConn, cmd.Args)
+	case "WAIT":
+		return s.handleWait(clientConn, cmd.Args)
+	case "ASKING":
+		return s.handleAsking(clientConn, cmd.Args)
+	case "MIGRATE":
+		return s.handleMigrate(cmd.Args)
+	case "CRDT.SYNC":
+		return s.handleCrdtSync(clientConn, cmd.Args)
+	case "RAFT.MESSAGE":
+		return s.handleRaftMessage(cmd.Args)
+	case "RAFT.JOIN":
+		return s.handleRaftJoin(cmd.Args)
+	case "RAFT.REMOVE":
+		return s.handleRaftRemove(cmd.Args)
+	case "HELLO":
+		return s.handleHello(cmd.Args)
+	case "CLIENT":
+		return s.handleClient(cmd.Args)
+	case "RESTORE-ASKING":
+		cmd, asking = &resp2.Command{Name: "RESTORE", Args: cmd.Args}, true
+	case "PING":
+		if clientConn.IsSubscriber() {
+			return s.handleSubscriberPing(cmd.Args)
+		}
+	}
+	
+	s.expireKeys(cmd)
+	if s.cluster != nil {
+		return s.executeInCluster(cmd, asking)
+	}
+	if s.raft != nil {
+		return s.executeInRaft(cmd)
+	}
+	return s.executeKeyspaceCommand(cmd)
+}
+
+// executeKeyspaceCommand executes a command of the command handler; writes
+// are serialized and propagated
+func (s *Server) executeKeyspaceCommand(cmd *resp2.Command) *resp2.RESPValue {
+	if !handler.IsWriteCommand(cmd.Name) {
+		return s.handler.Execute(cmd)
+	}
+	
+	if refusal := s.checkWritable(); refusal != nil {
+		return refusal
+	}
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	return s.executeWrite(cmd)
+}
+
+// executeWrite executes a write command and propagates it when it
+// succeeds; the caller must hold writeMutex. A write the storage engine
+// failed to store is an error and is not propagated. While the append-only
+// file fails, writes are refused before they are applied; a write whose own
+// append fails has been applied and propagated, so it succeeds and is kept
+// by the append-only file to be written again.
+func (s *Server) executeWrite(cmd *resp2.Command) *resp2.RESPValue {
+	if s.aof != nil {
+		if err := s.aof.LastError(); err != nil {
+			return aofErrorReply(err)
+		}
+	}
+	cmd = handler.PropagationForm(cmd)
+	failedBefore := s.storageError() != nil
+	response := s.handler.Execute(cmd)
+	if err := s.storageError(); err != nil && !failedBefore {
+		return storageErrorReply(err)
+	}
+	if response.Type != resp2.Error {
+		s.propagate(cmd)
+		if s.crdt != nil {
+			s.recordWrite(cmd)
+		}
+	}
+	return response
+}
+
+// propagate records a successfully executed write command and feeds it to
+// the replicas, returning the error appending it to the append-only file;
+// the caller must hold writeMutex. A replica only passes on its master's
+// stream, so its own clients' writes stay local.
+func (s *Server) propagate(cmd *resp2.Command) error {
+	err := s.logWrite(cmd)
+	if !s.isReplica() {
+		s.replicationFeed(s.parser.Serialize(resp2.NewCommandValue(cmd.Name, cmd.Args)))
+	}
+	return err
+}
+
+// logWrite counts a write command towards the save rules and appends it to
+// the append-only file; the caller must hold writeMutex. A command whose
+// append fails is retried by the append-only file, and writes are refused
+// meanwhile.
+func (s *Server) logWrite(cmd *resp2.Command) error {
+	s.dirty.Add(1)
+	if s.aof != nil {
+		if err := s.aof.Append(cmd); err != nil {
+			fmt.Printf("Error writing to the append only file: %v\n", err)
+			return err
+		}
+	}
+	return nil
+}
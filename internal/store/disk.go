@@ -0,0 +1,1016 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSegmentSize is the size at which the disk engine starts a new log
+// segment unless configured otherwise
+const DefaultSegmentSize = 64 << 20
+
+const (
+	segmentSuffix    = ".seg"
+	tempSuffix       = ".tmp"
+	compactionMarker = "COMPACTION"
+
+	// A record is laid out as
+	//
+	//	crc (4) | seq (8) | expireAt (8) | flags (1) | key length (4) | value length (4) | key | value
+	//
+	// with the CRC-32 covering everything after it
+	recordHeaderSize = 29
+	flagTombstone    = 1
+	// maxFieldSize bounds key and value lengths so a corrupt header cannot
+	// make loading allocate arbitrary amounts of memory
+	maxFieldSize = 512 << 20
+
+	// syncInterval is how often written segments are fsynced
+	syncInterval = time.Second
+)
+
+// ErrCorruptSegment is returned when a segment holds a damaged record
+var ErrCorruptSegment = errors.New("corrupt segment")
+
+// location is where the latest record of a key lives
+type location struct {
+	segment  uint64
+	offset   int64
+	size     int64
+	expireAt int64
+	seq      uint64
+}
+
+// segment is one file of the log. The store holds a reference to every
+// segment it lists and each open view holds one to every segment it may
+// read, so a compacted segment is only closed once nothing can read it.
+type segment struct {
+	id   uint64
+	path string
+	file *os.File
+	size int64
+	refs atomic.Int32
+}
+
+// unref drops a reference, closing the file after the last one
+func (g *segment) unref() {
+	if g.refs.Add(-1) == 0 {
+		g.file.Close()
+	}
+}
+
+// DiskStore is a persistent implementation of KeyValueStore that keeps
+// values on local disk, so datasets larger than memory can be served.
+//
+// Every write appends a record to the active segment of a log and updates
+// an in-memory index from keys to the latest record, so reads take a single
+// disk access. Records carry a sequence number, which decides the latest
+// record of a key however segments are ordered. Once most of the log is
+// made of overwritten or deleted records, compaction copies the live
+// records of every segment but the active one into new segments and deletes
+// the old ones, in the background. The index is a layered map, so views
+// freeze it in constant time the same way InMemoryStore does.
+//
+// Segments are fsynced once per second and on Close. A record torn by a
+// crash at the end of a segment is discarded when the store is reopened.
+type DiskStore struct {
+	dir         string
+	segmentSize int64
+
+	mutex    sync.RWMutex
+	index    *layered[location]
+	expires  expiring
+	segments map[uint64]*segment
+	active   *segment
+	nextID   uint64
+	seq      uint64
+	// live is the size of the records the index refers to and total the
+	// size of every segment; the difference is what compaction reclaims
+	live  int64
+	total int64
+
+	dirty bool
+	// compacting is set while a background compaction is pending, and
+	// compactMutex serializes compactions. stuck is set when a compaction
+	// failed after writing its marker: no other compaction may run, as it
+	// would replace the marker, until reopening the store completes it.
+	compacting   bool
+	compactMutex sync.Mutex
+	stuck        bool
+	closed       bool
+	lastError    error
+	done         chan struct{}
+	wg           sync.WaitGroup
+}
+
+// NewDiskStore opens the disk engine in options.Dir, creating it if needed
+// and loading the index from the segments found there
+func NewDiskStore(options Options) (KeyValueStore, error) {
+	if options.Dir == "" {
+		return nil, errors.New("the disk storage engine needs a directory")
+	}
+	if options.SegmentSize <= 0 {
+		options.SegmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(options.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	s := &DiskStore{
+		dir:         options.Dir,
+		segmentSize: options.SegmentSize,
+		index:       newLayered[location](),
+		expires:     make(expiring),
+		segments:    make(map[uint64]*segment),
+		done:        make(chan struct{}),
+	}
+	if err := finishCompaction(s.dir); err != nil {
+		return nil, err
+	}
+	if err := s.load(); err != nil {
+		s.closeSegments()
+		return nil, err
+	}
+	if err := s.startSegment(); err != nil {
+		s.closeSegments()
+		return nil, err
+	}
+
+	s.wg.Add(1)
+	go s.syncLoop()
+	return s, nil
+}
+
+// load rebuilds the index from the segments on disk
+func (s *DiskStore) load() error {
+	ids, err := listSegments(s.dir)
+	if err != nil {
+		return err
+	}
+	// tombstones remembers deleted keys while loading, since a segment
+	// listed later may hold an older record of the same key
+	tombstones := make(map[string]uint64)
+	for _, id := range ids {
+		seg, err := openSegment(s.dir, id)
+		if err != nil {
+			return err
+		}
+		s.segments[id] = seg
+		s.nextID = id + 1
+
+		err = scanSegment(seg, func(key string, loc location, tombstone bool) {
+			s.seq = max(s.seq, loc.seq)
+			current, exists := s.index.get(key)
+			if (exists && current.seq >= loc.seq) || tombstones[key] >= loc.seq {
+				return
+			}
+			if tombstone {
+				s.index.remove(key)
+				tombstones[key] = loc.seq
+				return
+			}
+			s.index.put(key, loc)
+			delete(tombstones, key)
+		})
+		if err != nil {
+			return err
+		}
+		s.total += seg.size
+	}
+	rangeLayers(s.index.layers, func(key string, loc location) bool {
+		s.live += loc.size
+		s.expires.track(key, loc.expireAt)
+		return true
+	})
+	return nil
+}
+
+// startSegment makes a new, empty segment the active one; the caller must
+// hold the write lock unless the store is not shared yet
+func (s *DiskStore) startSegment() error {
+	seg, err := createSegment(filepath.Join(s.dir, segmentName(s.nextID)), s.nextID)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		seg.file.Close()
+		return err
+	}
+	s.nextID++
+	s.segments[seg.id] = seg
+	s.active = seg
+	return nil
+}
+
+// roll syncs the active segment and starts a new one; the caller must hold
+// the write lock
+func (s *DiskStore) roll() error {
+	if err := s.active.file.Sync(); err != nil {
+		return err
+	}
+	return s.startSegment()
+}
+
+// write appends a record to the active segment; the caller must hold the
+// write lock
+func (s *DiskStore) write(key, value string, expireAt int64, tombstone bool) (location, error) {
+	if s.closed {
+		return location{}, errors.New("disk store is closed")
+	}
+	seq := s.seq + 1
+	record := encodeRecord(seq, key, value, expireAt, tombstone)
+	// Writing at the tracked size rather than appending lets a later write
+	// overwrite the remains of a failed one
+	if _, err := s.active.file.WriteAt(record, s.active.size); err != nil {
+		return location{}, err
+	}
+	s.seq = seq
+	loc := location{segment: s.active.id, offset: s.active.size, size: int64(len(record)), expireAt: expireAt, seq: seq}
+	s.active.size += loc.size
+	s.total += loc.size
+	s.dirty = true
+	if s.active.size >= s.segmentSize {
+		if err := s.roll(); err != nil {
+			s.fail(err)
+		}
+	}
+	return loc, nil
+}
+
+// fail records a write error, reported by LastError until recover
+// succeeds; the caller must hold the write lock
+func (s *DiskStore) fail(err error) {
+	s.lastError = err
+	fmt.Printf("Disk store write failed: %v\n", err)
+}
+
+// recover retries what a failed write left undone, syncing the active
+// segment and rolling it when it is full, and clears the error once that
+// succeeds; the caller must hold the write lock
+func (s *DiskStore) recover() {
+	if err := s.active.file.Sync(); err != nil {
+		s.lastError = err
+		return
+	}
+	if s.active.size >= s.segmentSize {
+		if err := s.startSegment(); err != nil {
+			s.lastError = err
+			return
+		}
+	}
+	s.lastError = nil
+	s.dirty = false
+	fmt.Println("Disk store writes recovered")
+}
+
+// set writes a value; the caller must hold the write lock
+func (s *DiskStore) set(key, value string, expireAt int64) error {
+	loc, err := s.write(key, value, expireAt, false)
+	if err != nil {
+		s.fail(err)
+		return err
+	}
+	if old, exists := s.index.get(key); exists {
+		s.live -= old.size
+	}
+	s.index.put(key, loc)
+	s.expires.track(key, expireAt)
+	s.live += loc.size
+	s.maybeCompact()
+	return nil
+}
+
+// deleteLocked removes a key, reporting whether it was live; an expired key
+// is removed too but does not count. The caller must hold the write lock.
+func (s *DiskStore) deleteLocked(key string, now int64) bool {
+	old, exists := s.index.get(key)
+	if !exists {
+		return false
+	}
+	if _, err := s.write(key, "", 0, true); err != nil {
+		s.fail(err)
+		return false
+	}
+	s.index.remove(key)
+	s.expires.track(key, 0)
+	s.live -= old.size
+	s.maybeCompact()
+	return old.expireAt == 0 || old.expireAt > now
+}
+
+// Set stores a key-value pair, clearing any expiry, and reports whether it
+// created the key; a write that fails creates nothing
+func (s *DiskStore) Set(key, value string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	old, exists := s.index.get(key)
+	if s.set(key, value, 0) != nil {
+		return false
+	}
+	return !exists || (old.expireAt != 0 && old.expireAt <= time.Now().UnixMilli())
+}
+
+// store writes a value, returning any write error
+func (s *DiskStore) store(key, value string, expireAt int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.set(key, value, expireAt)
+}
+
+// SetWithExpiry stores a key-value pair that expires at expireAt, in Unix
+// milliseconds; an expireAt of 0 means no expiry
+func (s *DiskStore) SetWithExpiry(key, value string, expireAt int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.set(key, value, expireAt)
+}
+
+// Get retrieves a value by key. A read that fails is reported on the
+// console and treated as a miss.
+func (s *DiskStore) Get(key string) (string, bool) {
+	value, exists, err := s.read(key)
+	if err != nil {
+		fmt.Printf("Disk store read of %q failed: %v\n", key, err)
+		return "", false
+	}
+	return value, exists
+}
+
+// read retrieves a value by key, returning any read error
+func (s *DiskStore) read(key string) (string, bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	loc, exists := s.index.get(key)
+	if !exists || (loc.expireAt != 0 && loc.expireAt <= time.Now().UnixMilli()) {
+		return "", false, nil
+	}
+	value, err := readValue(s.segments[loc.segment], key, loc)
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// Exists checks if a key exists, without reading its value
+func (s *DiskStore) Exists(key string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	loc, exists := s.index.get(key)
+	return exists && (loc.expireAt == 0 || loc.expireAt > time.Now().UnixMilli())
+}
+
+// ExpireAt returns the expiry of a key, without reading its value
+func (s *DiskStore) ExpireAt(key string) (int64, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	loc, exists := s.index.get(key)
+	if !exists || (loc.expireAt != 0 && loc.expireAt <= time.Now().UnixMilli()) {
+		return 0, false
+	}
+	return loc.expireAt, true
+}
+
+// Expired reports whether a key is held past its expiry
+func (s *DiskStore) Expired(key string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	loc, exists := s.index.get(key)
+	return exists && loc.expireAt != 0 && loc.expireAt <= time.Now().UnixMilli()
+}
+
+// ExpiredKeys samples the keys with an expiry for those past it
+func (s *DiskStore) ExpiredKeys(sample int) []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.expires.sample(sample, time.Now().UnixMilli())
+}
+
+// Delete removes a key
+func (s *DiskStore) Delete(key string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.deleteLocked(key, time.Now().UnixMilli())
+}
+
+// DeleteMultiple removes multiple keys and returns count of deleted keys
+func (s *DiskStore) DeleteMultiple(keys []string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now().UnixMilli()
+	deletedCount := 0
+	for _, key := range keys {
+		if s.deleteLocked(key, now) {
+			deletedCount++
+		}
+	}
+	return deletedCount
+}
+
+// Snapshot returns a point-in-time copy of all live keys with their expiries
+func (s *DiskStore) Snapshot() map[string]Item {
+	return snapshotOf(s.View())
+}
+
+// View freezes the current contents of the store. The index is frozen in
+// constant time and values are read from the segments as the view is
+// ranged over.
+func (s *DiskStore) View() View {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	segments := make(map[uint64]*segment, len(s.segments))
+	for id, seg := range s.segments {
+		seg.refs.Add(1)
+		segments[id] = seg
+	}
+	return &diskView{store: s, layers: s.index.freeze(), segments: segments, now: time.Now().UnixMilli()}
+}
+
+// Len counts the live keys from the index alone, without reading values
+func (s *DiskStore) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	now := time.Now().UnixMilli()
+	keys := 0
+	rangeLayers(s.index.layers, func(key string, loc location) bool {
+		if loc.expireAt == 0 || loc.expireAt > now {
+			keys++
+		}
+		return true
+	})
+	return keys
+}
+
+// LastError implements ErrorReporter
+func (s *DiskStore) LastError() error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.lastError
+}
+
+// Close waits for a running compaction, syncs the active segment and closes
+// every segment
+func (s *DiskStore) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	s.mutex.Unlock()
+	s.wg.Wait()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := s.active.file.Sync()
+	s.closeSegments()
+	return err
+}
+
+// closeSegments drops the store's reference to every segment
+func (s *DiskStore) closeSegments() {
+	for id, seg := range s.segments {
+		delete(s.segments, id)
+		seg.unref()
+	}
+}
+
+// syncLoop fsyncs the active segment once per second while it has
+// unsynced writes, or retries it after a write failed
+func (s *DiskStore) syncLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		s.mutex.Lock()
+		if s.lastError != nil && !s.closed {
+			s.recover()
+			s.mutex.Unlock()
+			continue
+		}
+		active, dirty := s.active, s.dirty
+		s.dirty = false
+		s.mutex.Unlock()
+		// Rolled segments are synced when rolled and only closed once
+		// compacted, so syncing outside the lock is safe
+		if dirty {
+			if err := active.file.Sync(); err != nil {
+				s.mutex.Lock()
+				s.fail(err)
+				s.mutex.Unlock()
+			}
+		}
+	}
+}
+
+// maybeCompact starts a background compaction once at least a segment's
+// worth of the log and more than half of it is garbage; the caller must
+// hold the write lock
+func (s *DiskStore) maybeCompact() {
+	garbage := s.total - s.live
+	if s.compacting || s.closed || garbage < s.segmentSize || garbage*2 < s.total {
+		return
+	}
+	s.compacting = true
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := s.compact(); err != nil {
+			fmt.Printf("Disk store compaction failed: %v\n", err)
+		}
+		s.mutex.Lock()
+		s.compacting = false
+		s.mutex.Unlock()
+	}()
+}
+
+// Compact rewrites the live records of every segment but the active one
+// into new segments and deletes the old ones, after waiting for a
+// compaction already running
+func (s *DiskStore) Compact() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.wg.Add(1)
+	s.mutex.Unlock()
+	defer s.wg.Done()
+	return s.compact()
+}
+
+// move records where compaction copied a record; a zero destination means
+// the record expired and was dropped
+type move struct {
+	key      string
+	from, to location
+}
+
+// compact runs a compaction once any other one finished.
+//
+// Every segment but a freshly started active one is an input, so all
+// records older than the new active segment are inputs and tombstones can
+// be dropped along with the records they hide. The outputs are written
+// under temporary names and synced, then a marker listing inputs and
+// outputs is written before the outputs are renamed and the inputs
+// deleted; reopening the store completes a compaction that has a marker
+// and discards one that has not.
+func (s *DiskStore) compact() error {
+	s.compactMutex.Lock()
+	defer s.compactMutex.Unlock()
+
+	s.mutex.Lock()
+	if s.stuck {
+		s.mutex.Unlock()
+		return errors.New("an earlier compaction failed halfway, reopen the store to complete it")
+	}
+	if err := s.roll(); err != nil {
+		s.mutex.Unlock()
+		return err
+	}
+	inputs := make(map[uint64]*segment)
+	for id, seg := range s.segments {
+		if seg != s.active {
+			seg.refs.Add(1)
+			inputs[id] = seg
+		}
+	}
+	layers := s.index.freeze()
+	now := time.Now().UnixMilli()
+	s.mutex.Unlock()
+
+	stuck := false
+	defer func() {
+		s.mutex.Lock()
+		s.index.thaw()
+		s.stuck = stuck
+		s.mutex.Unlock()
+		for _, seg := range inputs {
+			seg.unref()
+		}
+	}()
+
+	var outputs []*segment
+	abort := func(err error) error {
+		for _, seg := range outputs {
+			seg.file.Close()
+			os.Remove(seg.path)
+		}
+		return err
+	}
+
+	var moves []move
+	var output *segment
+	var err error
+	rangeLayers(layers, func(key string, loc location) bool {
+		input, isInput := inputs[loc.segment]
+		if !isInput {
+			return true
+		}
+		if loc.expireAt != 0 && loc.expireAt <= now {
+			moves = append(moves, move{key: key, from: loc})
+			return true
+		}
+		record := make([]byte, loc.size)
+		if _, err = input.file.ReadAt(record, loc.offset); err != nil {
+			return false
+		}
+		if output == nil || output.size >= s.segmentSize {
+			if output, err = s.createOutput(); err != nil {
+				return false
+			}
+			outputs = append(outputs, output)
+		}
+		if _, err = output.file.WriteAt(record, output.size); err != nil {
+			return false
+		}
+		to := loc
+		to.segment, to.offset = output.id, output.size
+		output.size += loc.size
+		moves = append(moves, move{key: key, from: loc, to: to})
+		return true
+	})
+	if err != nil {
+		return abort(err)
+	}
+	for _, seg := range outputs {
+		if err := seg.file.Sync(); err != nil {
+			return abort(err)
+		}
+	}
+
+	if err := writeMarker(s.dir, inputs, outputs); err != nil {
+		return abort(err)
+	}
+	for _, seg := range outputs {
+		final := filepath.Join(s.dir, segmentName(seg.id))
+		if err := os.Rename(seg.path, final); err != nil {
+			stuck = true
+			return err
+		}
+		seg.path = final
+	}
+	if err := syncDir(s.dir); err != nil {
+		stuck = true
+		return err
+	}
+
+	s.mutex.Lock()
+	for _, m := range moves {
+		current, exists := s.index.get(m.key)
+		if !exists || current != m.from {
+			continue
+		}
+		s.live -= m.from.size
+		if m.to.size == 0 {
+			s.index.remove(m.key)
+			s.expires.track(m.key, 0)
+			continue
+		}
+		s.index.put(m.key, m.to)
+		s.live += m.to.size
+	}
+	for _, seg := range outputs {
+		s.segments[seg.id] = seg
+		s.total += seg.size
+	}
+	for id, seg := range inputs {
+		delete(s.segments, id)
+		s.total -= seg.size
+		seg.unref()
+	}
+	s.mutex.Unlock()
+
+	for _, seg := range inputs {
+		if err := os.Remove(seg.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			stuck = true
+			return err
+		}
+	}
+	if err := os.Remove(filepath.Join(s.dir, compactionMarker)); err != nil {
+		stuck = true
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// createOutput creates a compaction output under a temporary name
+func (s *DiskStore) createOutput() (*segment, error) {
+	s.mutex.Lock()
+	id := s.nextID
+	s.nextID++
+	s.mutex.Unlock()
+	return createSegment(filepath.Join(s.dir, segmentName(id)+tempSuffix), id)
+}
+
+// diskView is a View over a frozen index and the segments it refers to
+type diskView struct {
+	store    *DiskStore
+	layers   []layer[location]
+	segments map[uint64]*segment
+	now      int64
+	err      error
+	release  sync.Once
+}
+
+// Range calls fn for every key live when the view was taken, reading each
+// value from disk; it stops at the first read error, which Err returns
+func (v *diskView) Range(fn func(key string, item Item) bool) {
+	rangeLayers(v.layers, func(key string, loc location) bool {
+		if loc.expireAt != 0 && loc.expireAt <= v.now {
+			return true
+		}
+		value, err := readValue(v.segments[loc.segment], key, loc)
+		if err != nil {
+			v.err = fmt.Errorf("failed to read %q: %w", key, err)
+			return false
+		}
+		return fn(key, Item{Value: value, ExpireAt: loc.expireAt})
+	})
+}
+
+// get reads the value a key had when the view was taken, ignoring expiry
+func (v *diskView) get(key string) (string, bool, error) {
+	loc, exists := getLayers(v.layers, key)
+	if !exists {
+		return "", false, nil
+	}
+	value, err := readValue(v.segments[loc.segment], key, loc)
+	return value, err == nil, err
+}
+
+// Err returns the read error that stopped Range, if any
+func (v *diskView) Err() error {
+	return v.err
+}
+
+// Release releases the view; calling it more than once has no effect
+func (v *diskView) Release() {
+	v.release.Do(func() {
+		v.store.mutex.Lock()
+		v.store.index.thaw()
+		v.store.mutex.Unlock()
+		for _, seg := range v.segments {
+			seg.unref()
+		}
+	})
+}
+
+// encodeRecord builds a log record
+func encodeRecord(seq uint64, key, value string, expireAt int64, tombstone bool) []byte {
+	record := make([]byte, recordHeaderSize+len(key)+len(value))
+	binary.BigEndian.PutUint64(record[4:], seq)
+	binary.BigEndian.PutUint64(record[12:], uint64(expireAt))
+	if tombstone {
+		record[20] = flagTombstone
+	}
+	binary.BigEndian.PutUint32(record[21:], uint32(len(key)))
+	binary.BigEndian.PutUint32(record[25:], uint32(len(value)))
+	copy(record[recordHeaderSize:], key)
+	copy(record[recordHeaderSize+len(key):], value)
+	binary.BigEndian.PutUint32(record, crc32.ChecksumIEEE(record[4:]))
+	return record
+}
+
+// readValue reads and verifies the record at loc, returning its value
+func readValue(seg *segment, key string, loc location) (string, error) {
+	if seg == nil {
+		return "", fmt.Errorf("segment %d is missing", loc.segment)
+	}
+	record := make([]byte, loc.size)
+	if _, err := seg.file.ReadAt(record, loc.offset); err != nil {
+		return "", err
+	}
+	if binary.BigEndian.Uint32(record) != crc32.ChecksumIEEE(record[4:]) {
+		return "", fmt.Errorf("%w: checksum mismatch in %s at offset %d", ErrCorruptSegment, seg.path, loc.offset)
+	}
+	return string(record[recordHeaderSize+len(key):]), nil
+}
+
+// scanSegment passes every record of a segment to fn. A record cut short,
+// or failing its checksum as the last record, is what a crash while
+// appending leaves behind: the segment is truncated before it. A bad
+// record followed by more data means the segment is corrupt.
+func scanSegment(seg *segment, fn func(key string, loc location, tombstone bool)) error {
+	reader := bufio.NewReader(io.NewSectionReader(seg.file, 0, seg.size))
+	header := make([]byte, recordHeaderSize)
+	var offset int64
+	for offset < seg.size {
+		torn := func(reason string) error {
+			fmt.Printf("!!! Warning: discarding %d bytes of %s after a %s at offset %d\n", seg.size-offset, seg.path, reason, offset)
+			if err := seg.file.Truncate(offset); err != nil {
+				return fmt.Errorf("failed to truncate %s: %w", seg.path, err)
+			}
+			seg.size = offset
+			return nil
+		}
+
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				return err
+			}
+			return torn("partial record header")
+		}
+		keyLen := binary.BigEndian.Uint32(header[21:])
+		valueLen := binary.BigEndian.Uint32(header[25:])
+		if keyLen > maxFieldSize || valueLen > maxFieldSize {
+			if offset+recordHeaderSize == seg.size {
+				return torn("bad record header")
+			}
+			return fmt.Errorf("%w: %s has a bad record header at offset %d", ErrCorruptSegment, seg.path, offset)
+		}
+		size := int64(recordHeaderSize) + int64(keyLen) + int64(valueLen)
+		if offset+size > seg.size {
+			return torn("partial record")
+		}
+
+		crc := crc32.NewIEEE()
+		crc.Write(header[4:])
+		body := make([]byte, keyLen)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return err
+		}
+		crc.Write(body)
+		if _, err := io.CopyN(crc, reader, int64(valueLen)); err != nil {
+			return err
+		}
+		if crc.Sum32() != binary.BigEndian.Uint32(header) {
+			if offset+size == seg.size {
+				return torn("checksum mismatch")
+			}
+			return fmt.Errorf("%w: %s has a checksum mismatch at offset %d", ErrCorruptSegment, seg.path, offset)
+		}
+
+		loc := location{
+			segment:  seg.id,
+			offset:   offset,
+			size:     size,
+			expireAt: int64(binary.BigEndian.Uint64(header[12:])),
+			seq:      binary.BigEndian.Uint64(header[4:]),
+		}
+		fn(string(body), loc, header[20]&flagTombstone != 0)
+		offset += size
+	}
+	return nil
+}
+
+// segmentName returns the file name of a segment
+func segmentName(id uint64) string {
+	return fmt.Sprintf("%020d%s", id, segmentSuffix)
+}
+
+// listSegments returns the IDs of the segments in dir, sorted
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, entry := range entries {
+		name, found := strings.CutSuffix(entry.Name(), segmentSuffix)
+		if !found {
+			continue
+		}
+		id, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected file %s in %s", entry.Name(), dir)
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// openSegment opens an existing segment
+func openSegment(dir string, id uint64) (*segment, error) {
+	path := filepath.Join(dir, segmentName(id))
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	seg := &segment{id: id, path: path, file: file, size: info.Size()}
+	seg.refs.Store(1)
+	return seg, nil
+}
+
+// createSegment creates an empty segment file
+func createSegment(path string, id uint64) (*segment, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create segment: %w", err)
+	}
+	seg := &segment{id: id, path: path, file: file}
+	seg.refs.Store(1)
+	return seg, nil
+}
+
+// writeMarker atomically records a compaction's inputs and outputs
+func writeMarker(dir string, inputs map[uint64]*segment, outputs []*segment) error {
+	var b strings.Builder
+	for id := range inputs {
+		fmt.Fprintf(&b, "input %d\n", id)
+	}
+	for _, seg := range outputs {
+		fmt.Fprintf(&b, "output %d\n", seg.id)
+	}
+	path := filepath.Join(dir, compactionMarker)
+	file, err := os.Create(path + tempSuffix)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(b.String()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+tempSuffix, path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// finishCompaction completes a compaction interrupted after its marker was
+// written and discards the temporary files of any other
+func finishCompaction(dir string) error {
+	path := filepath.Join(dir, compactionMarker)
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			kind, value, _ := strings.Cut(line, " ")
+			id, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("bad compaction marker line %q", line)
+			}
+			final := filepath.Join(dir, segmentName(id))
+			switch kind {
+			case "output":
+				if err := os.Rename(final+tempSuffix, final); err != nil && !errors.Is(err, os.ErrNotExist) {
+					return err
+				}
+			case "input":
+				if err := os.Remove(final); err != nil && !errors.Is(err, os.ErrNotExist) {
+					return err
+				}
+			default:
+				return fmt.Errorf("bad compaction marker line %q", line)
+			}
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	temps, err := filepath.Glob(filepath.Join(dir, "*"+tempSuffix))
+	if err != nil {
+		return err
+	}
+	for _, temp := range temps {
+		if err := os.Remove(temp); err != nil {
+			return err
+		}
+	}
+	return syncDir(dir)
+}
+
+// syncDir fsyncs a directory so renames and new files in it are durable
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
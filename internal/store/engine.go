@@ -0,0 +1,91 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Names of the built-in storage engines
+const (
+	EngineMemory = "memory"
+	EngineDisk   = "disk"
+	EngineTiered = "tiered"
+)
+
+// Options configures a storage engine
+type Options struct {
+	// Dir is where a persistent engine keeps its files
+	Dir string
+	// SegmentSize is the size at which the disk engine starts a new log
+	// segment; 0 uses DefaultSegmentSize
+	SegmentSize int64
+	// MemoryLimit is how many bytes of values the tiered engine keeps in
+	// memory before spilling cold ones to disk; 0 uses DefaultMemoryLimit
+	MemoryLimit int64
+	// TieringPolicy picks the values the tiered engine spills: "lru" spills
+	// the least recently used, "lfu" (the default) the least frequently used
+	TieringPolicy string
+}
+
+// Reporter is implemented by storage engines with statistics to report in
+// INFO, as "field:value" lines
+type Reporter interface {
+	Info() []string
+}
+
+// ErrorReporter is implemented by storage engines whose writes can fail,
+// such as those writing to disk. The KeyValueStore methods cannot return
+// the error, so LastError returns it until the engine recovered, nil
+// meaning writes are stored.
+type ErrorReporter interface {
+	LastError() error
+}
+
+// Engine opens a storage engine with the given options
+type Engine func(options Options) (KeyValueStore, error)
+
+var (
+	enginesMutex sync.RWMutex
+	engines      = map[string]Engine{
+		EngineMemory: func(Options) (KeyValueStore, error) { return NewInMemoryStore(), nil },
+		EngineDisk:   NewDiskStore,
+		EngineTiered: NewTieredStore,
+	}
+)
+
+// RegisterEngine makes a storage engine available to Open under name,
+// replacing any engine registered under the same name
+func RegisterEngine(name string, engine Engine) {
+	enginesMutex.Lock()
+	defer enginesMutex.Unlock()
+	engines[strings.ToLower(name)] = engine
+}
+
+// Open opens the storage engine registered under name; an empty name opens
+// the in-memory engine
+func Open(name string, options Options) (KeyValueStore, error) {
+	if name == "" {
+		name = EngineMemory
+	}
+	enginesMutex.RLock()
+	engine, exists := engines[strings.ToLower(name)]
+	enginesMutex.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("unknown storage engine '%s', expected one of %s", name, strings.Join(Engines(), ", "))
+	}
+	return engine(options)
+}
+
+// Engines returns the names of the registered storage engines, sorted
+func Engines() []string {
+	enginesMutex.RLock()
+	defer enginesMutex.RUnlock()
+	names := make([]string, 0, len(engines))
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
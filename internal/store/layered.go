@@ -0,0 +1,114 @@
+package store
+
+// slot is an entry in a layer; a deleted slot is a tombstone hiding the key
+// in the layers below
+type slot[V any] struct {
+	value   V
+	deleted bool
+}
+
+// layer maps keys to the entries written while it was the top layer
+type layer[V any] map[string]slot[V]
+
+// layered is a map that can be frozen in constant time.
+//
+// The entries live in a stack of layers: writes always go to the top layer
+// and reads look from the top down. Freezing hands out every current layer
+// and pushes a fresh one, so only the keys written while frozen layers are
+// in use get copied, into the new layer, rather than the whole map. Once
+// the last frozen set is thawed the upper layers are merged back into the
+// base. It is not safe for concurrent use; callers provide the locking.
+type layered[V any] struct {
+	layers []layer[V]
+	frozen int
+}
+
+// newLayered creates an empty layered map
+func newLayered[V any]() *layered[V] {
+	return &layered[V]{layers: []layer[V]{make(layer[V])}}
+}
+
+// get finds the entry of a key
+func (l *layered[V]) get(key string) (V, bool) {
+	return getLayers(l.layers, key)
+}
+
+// put writes an entry to the top layer
+func (l *layered[V]) put(key string, value V) {
+	l.layers[len(l.layers)-1][key] = slot[V]{value: value}
+}
+
+// remove deletes a key, leaving a tombstone when frozen layers may still
+// hold it
+func (l *layered[V]) remove(key string) {
+	if len(l.layers) == 1 {
+		delete(l.layers[0], key)
+		return
+	}
+	l.layers[len(l.layers)-1][key] = slot[V]{deleted: true}
+}
+
+// freeze returns the current layers, which stay unchanged until thaw is
+// called as many times as freeze
+func (l *layered[V]) freeze() []layer[V] {
+	frozen := append([]layer[V](nil), l.layers...)
+	l.layers = append(l.layers, make(layer[V]))
+	l.frozen++
+	return frozen
+}
+
+// thaw releases one frozen set of layers, merging the upper layers into the
+// base once none is in use
+func (l *layered[V]) thaw() {
+	l.frozen--
+	if l.frozen > 0 {
+		return
+	}
+	base := l.layers[0]
+	for _, upper := range l.layers[1:] {
+		for key, entry := range upper {
+			if entry.deleted {
+				delete(base, key)
+			} else {
+				base[key] = entry
+			}
+		}
+	}
+	l.layers = l.layers[:1]
+}
+
+// getLayers finds the entry of a key in a stack of layers
+func getLayers[V any](layers []layer[V], key string) (V, bool) {
+	for i := len(layers) - 1; i >= 0; i-- {
+		if entry, exists := layers[i][key]; exists {
+			return entry.value, !entry.deleted
+		}
+	}
+	var zero V
+	return zero, false
+}
+
+// rangeLayers calls fn for every key present in frozen layers until fn
+// returns false. The layers are immutable, so no lock is needed.
+func rangeLayers[V any](layers []layer[V], fn func(key string, value V) bool) {
+	for i := len(layers) - 1; i >= 0; i-- {
+		for key, entry := range layers[i] {
+			if entry.deleted || shadowed(layers, key, i) {
+				continue
+			}
+			if !fn(key, entry.value) {
+				return
+			}
+		}
+	}
+}
+
+// shadowed reports whether a layer above index holds the key
+func shadowed[V any](layers []layer[V], key string, index int) bool {
+	for j := index + 1; j < len(layers); j++ {
+		if _, exists := layers[j][key]; exists {
+			return true
+		}
+	}
+	return false
+}
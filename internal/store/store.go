@@ -2,75 +2,260 @@ package store
 
 import (
 	"sync"
+	"time"
 )
 
 // KeyValueStore provides thread-safe key-value storage operations
 type KeyValueStore interface {
-	Set(key, value string)
+	// Set stores a value, clearing any expiry, and reports whether it created
+	// the key. The check and the write are atomic, so of concurrent writers
+	// creating a key exactly one is told it did.
+	Set(key, value string) bool
+	SetWithExpiry(key, value string, expireAt int64)
 	Get(key string) (string, bool)
 	Exists(key string) bool
+	// ExpireAt returns the expiry of a live key in Unix milliseconds, 0 when
+	// it has none
+	ExpireAt(key string) (int64, bool)
 	Delete(key string) bool
 	DeleteMultiple(keys []string) int
+	// Expired reports whether a key is still held past its expiry, hidden
+	// from reads until it is deleted
+	Expired(key string) bool
+	// ExpiredKeys checks up to sample of the keys with an expiry, picked at
+	// random, and returns those past it
+	ExpiredKeys(sample int) []string
+	Snapshot() map[string]Item
+	View() View
+	// Close releases the resources held by the store, flushing any pending
+	// writes of a persistent engine
+	Close() error
 }
 
-// InMemoryStore is an in-memory implementation of KeyValueStore
+// View is a frozen point-in-time view of the store. It can be read without
+// blocking writers for as long as needed and must be released when done.
+type View interface {
+	// Range calls fn for every live key until fn returns false
+	Range(fn func(key string, item Item) bool)
+	// Err returns the error that stopped Range early, if reading failed
+	Err() error
+	// Release lets the store reclaim the memory held for the view
+	Release()
+}
+
+// Item is a stored value with its expiry
+type Item struct {
+	Value string
+	// ExpireAt is the absolute expiry in Unix milliseconds, or 0 for no expiry
+	ExpireAt int64
+}
+
+// expired reports whether the item expired by now, in Unix milliseconds
+func (i Item) expired(now int64) bool {
+	return i.ExpireAt != 0 && i.ExpireAt <= now
+}
+
+// expiring tracks the expiry of the keys that have one, so the keys past it
+// can be found without going through every key; the store guards it
+type expiring map[string]int64
+
+// track records the expiry of a key, 0 meaning it has none
+func (e expiring) track(key string, expireAt int64) {
+	if expireAt == 0 {
+		delete(e, key)
+	} else {
+		e[key] = expireAt
+	}
+}
+
+// sample checks up to count keys with an expiry, relying on the random
+// order of map iteration, and returns those past it by now
+func (e expiring) sample(count int, now int64) []string {
+	var expired []string
+	for key, expireAt := range e {
+		if count == 0 {
+			break
+		}
+		count--
+		if expireAt <= now {
+			expired = append(expired, key)
+		}
+	}
+	return expired
+}
+
+// InMemoryStore is an in-memory implementation of KeyValueStore.
+//
+// The data lives in a layered map, so taking a view freezes the current
+// contents in constant time and only the keys written while the view is open
+// are copied rather than the whole dataset.
+//
+// Keys with an expiry read as absent once past it, until they are deleted
+// by a write or by the server finding them with Expired and ExpiredKeys.
 type InMemoryStore struct {
-	data  map[string]string
-	mutex sync.RWMutex
+	data    *layered[Item]
+	expires expiring
+	mutex   sync.RWMutex
 }
 
 // NewInMemoryStore creates a new in-memory key-value store
 func NewInMemoryStore() KeyValueStore {
-	return &InMemoryStore{
-		data: make(map[string]string),
+	return &InMemoryStore{data: newLayered[Item](), expires: make(expiring)}
+}
+
+// lookup finds the live item of a key; the caller must hold the mutex
+func (s *InMemoryStore) lookup(key string, now int64) (Item, bool) {
+	item, exists := s.data.get(key)
+	if !exists || item.expired(now) {
+		return Item{}, false
 	}
+	return item, true
 }
 
-// Set stores a key-value pair
-func (s *InMemoryStore) Set(key, value string) {
+// Set stores a key-value pair, clearing any expiry, and reports whether it
+// created the key
+func (s *InMemoryStore) Set(key, value string) bool {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.data[key] = value
+	_, exists := s.lookup(key, time.Now().UnixMilli())
+	s.data.put(key, Item{Value: value})
+	s.expires.track(key, 0)
+	return !exists
+}
+
+// SetWithExpiry stores a key-value pair that expires at expireAt, in Unix
+// milliseconds; an expireAt of 0 means no expiry
+func (s *InMemoryStore) SetWithExpiry(key, value string, expireAt int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data.put(key, Item{Value: value, ExpireAt: expireAt})
+	s.expires.track(key, expireAt)
 }
 
 // Get retrieves a value by key
 func (s *InMemoryStore) Get(key string) (string, bool) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
-	value, exists := s.data[key]
-	return value, exists
+	item, exists := s.lookup(key, time.Now().UnixMilli())
+	return item.Value, exists
 }
 
 // Exists checks if a key exists
 func (s *InMemoryStore) Exists(key string) bool {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
-	_, exists := s.data[key]
+	_, exists := s.lookup(key, time.Now().UnixMilli())
 	return exists
 }
 
+// ExpireAt returns the expiry of a key
+func (s *InMemoryStore) ExpireAt(key string) (int64, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	item, exists := s.lookup(key, time.Now().UnixMilli())
+	return item.ExpireAt, exists
+}
+
 // Delete removes a key
 func (s *InMemoryStore) Delete(key string) bool {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	_, exists := s.data[key]
-	if exists {
-		delete(s.data, key)
-	}
-	return exists
+	return s.deleteLocked(key, time.Now().UnixMilli())
 }
 
 // DeleteMultiple removes multiple keys and returns count of deleted keys
 func (s *InMemoryStore) DeleteMultiple(keys []string) int {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	
+
+	now := time.Now().UnixMilli()
 	deletedCount := 0
 	for _, key := range keys {
-		if _, exists := s.data[key]; exists {
-			delete(s.data, key)
+		if s.deleteLocked(key, now) {
 			deletedCount++
 		}
 	}
 	return deletedCount
-}
\ No newline at end of file
+}
+
+// deleteLocked removes a key, reporting whether it was live; an expired key
+// is removed too but does not count. The caller must hold the write lock.
+func (s *InMemoryStore) deleteLocked(key string, now int64) bool {
+	_, live := s.lookup(key, now)
+	s.data.remove(key)
+	s.expires.track(key, 0)
+	return live
+}
+
+// Expired reports whether a key is held past its expiry
+func (s *InMemoryStore) Expired(key string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	item, exists := s.data.get(key)
+	return exists && item.expired(time.Now().UnixMilli())
+}
+
+// ExpiredKeys samples the keys with an expiry for those past it
+func (s *InMemoryStore) ExpiredKeys(sample int) []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.expires.sample(sample, time.Now().UnixMilli())
+}
+
+// Snapshot returns a point-in-time copy of all live keys with their expiries
+func (s *InMemoryStore) Snapshot() map[string]Item {
+	return snapshotOf(s.View())
+}
+
+// snapshotOf copies the contents of a view, releasing it
+func snapshotOf(view View) map[string]Item {
+	defer view.Release()
+
+	snapshot := make(map[string]Item)
+	view.Range(func(key string, item Item) bool {
+		snapshot[key] = item
+		return true
+	})
+	return snapshot
+}
+
+// View freezes the current contents of the store in constant time
+func (s *InMemoryStore) View() View {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return &layeredView{store: s, layers: s.data.freeze(), now: time.Now().UnixMilli()}
+}
+
+// Close has nothing to release for an in-memory store
+func (s *InMemoryStore) Close() error {
+	return nil
+}
+
+// layeredView is a View over layers that are no longer written to
+type layeredView struct {
+	store   *InMemoryStore
+	layers  []layer[Item]
+	now     int64
+	release sync.Once
+}
+
+// Range calls fn for every key live when the view was taken
+func (v *layeredView) Range(fn func(key string, item Item) bool) {
+	rangeLayers(v.layers, func(key string, item Item) bool {
+		return item.expired(v.now) || fn(key, item)
+	})
+}
+
+// Err always returns nil: reading memory cannot fail
+func (v *layeredView) Err() error {
+	return nil
+}
+
+// Release releases the view; calling it more than once has no effect
+func (v *layeredView) Release() {
+	v.release.Do(func() {
+		v.store.mutex.Lock()
+		defer v.store.mutex.Unlock()
+		v.store.data.thaw()
+	})
+}
@@ -1,7 +1,13 @@
 package store
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/leanovate/gopter"
 	"github.com/leanovate/gopter/gen"
@@ -207,4 +213,514 @@ func TestConcurrentDataConsistency(t *testing.T) {
 	))
 
 	properties.TestingRun(t, gopter.ConsoleReporter(false))
-}
\ No newline at end of file
+}
+// Property-based test setup for key expiry
+func TestExpiry(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	// For any key, an expiry in the past hides it, one in the future does
+	// not, and a plain SET clears the expiry
+	properties.Property("expired keys read as absent", prop.ForAll(
+		func(key, value string) bool {
+			store := NewInMemoryStore()
+			now := time.Now().UnixMilli()
+
+			store.SetWithExpiry(key, value, now-1)
+			if store.Exists(key) || store.Delete(key) {
+				return false
+			}
+			if _, exists := store.Snapshot()[key]; exists {
+				return false
+			}
+
+			store.SetWithExpiry(key, value, now+60000)
+			got, exists := store.Get(key)
+			if !exists || got != value || store.Snapshot()[key].ExpireAt != now+60000 {
+				return false
+			}
+
+			store.Set(key, value)
+			return store.Snapshot()[key].ExpireAt == 0
+		},
+		gen.AlphaString(),
+		gen.AlphaString(),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
+
+// viewContents collects everything a view holds
+func viewContents(view View) map[string]string {
+	contents := make(map[string]string)
+	view.Range(func(key string, item Item) bool {
+		contents[key] = item.Value
+		return true
+	})
+	return contents
+}
+
+// Property-based test setup for copy-on-write views
+func TestViewIsolation(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	// For any dataset and any writes made afterwards, overlapping views keep
+	// the contents they were taken with, and once they are released the
+	// store holds exactly the latest writes
+	properties.Property("views are frozen and released cleanly", prop.ForAll(
+		func(initial, later []string) bool {
+			store := NewInMemoryStore()
+			want := make(map[string]string)
+			for _, key := range initial {
+				store.Set(key, "a"+key)
+				want[key] = "a" + key
+			}
+
+			first := store.View()
+			frozenFirst := make(map[string]string, len(want))
+			for key, value := range want {
+				frozenFirst[key] = value
+			}
+
+			for i, key := range later {
+				if i%2 == 0 {
+					store.Set(key, "b"+key)
+					want[key] = "b" + key
+				} else {
+					store.Delete(key)
+					delete(want, key)
+				}
+			}
+
+			second := store.View()
+			store.Set("after", "c")
+			store.Delete("after")
+			if !reflect.DeepEqual(viewContents(first), frozenFirst) || !reflect.DeepEqual(viewContents(second), want) {
+				return false
+			}
+
+			first.Release()
+			first.Release()
+			if !reflect.DeepEqual(viewContents(second), want) {
+				return false
+			}
+			second.Release()
+
+			for _, key := range later {
+				store.Set(key, "d"+key)
+				want[key] = "d" + key
+			}
+			snapshot := store.Snapshot()
+			if len(snapshot) != len(want) {
+				return false
+			}
+			for key, value := range want {
+				if got, exists := store.Get(key); !exists || got != value || snapshot[key].Value != value {
+					return false
+				}
+			}
+			return len(store.(*InMemoryStore).data.layers) == 1
+		},
+		gen.SliceOf(gen.AlphaString()),
+		gen.SliceOf(gen.AlphaString()),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
+
+// openDisk opens a disk store in dir with tiny segments so tests roll and
+// compact them
+func openDisk(t *testing.T, dir string) *DiskStore {
+	opened, err := NewDiskStore(Options{Dir: dir, SegmentSize: 256})
+	if err != nil {
+		t.Fatalf("NewDiskStore failed: %v", err)
+	}
+	return opened.(*DiskStore)
+}
+
+// diskOp is one write applied to a store in the disk engine tests
+type diskOp struct {
+	Key    string
+	Delete bool
+	Expire bool
+}
+
+// applyOps applies writes to a store
+func applyOps(store KeyValueStore, ops []diskOp, round int, now int64) {
+	for i, op := range ops {
+		switch {
+		case op.Delete:
+			store.Delete(op.Key)
+		case op.Expire:
+			store.SetWithExpiry(op.Key, "expired", now-1)
+		default:
+			store.SetWithExpiry(op.Key, fmt.Sprintf("%s:%d:%d", op.Key, round, i), int64(i%3)*(now+60000))
+		}
+	}
+}
+
+// Property-based test setup for the disk engine
+func TestDiskStoreMatchesMemory(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	genOp := gen.Struct(reflect.TypeOf(diskOp{}), map[string]gopter.Gen{
+		"Key":    gen.OneConstOf("a", "b", "c", "d", "e", "f", "g", "h"),
+		"Delete": gen.Weighted([]gen.WeightedGen{{Weight: 1, Gen: gen.Const(true)}, {Weight: 3, Gen: gen.Const(false)}}),
+		"Expire": gen.Weighted([]gen.WeightedGen{{Weight: 1, Gen: gen.Const(true)}, {Weight: 5, Gen: gen.Const(false)}}),
+	})
+
+	// For any writes, the disk engine holds what the in-memory engine holds,
+	// and keeps holding it across compactions and reopening
+	properties.Property("disk engine survives compaction and reopening", prop.ForAll(
+		func(first, second []diskOp) bool {
+			dir := t.TempDir()
+			memory := NewInMemoryStore()
+			disk := openDisk(t, dir)
+			now := time.Now().UnixMilli()
+
+			applyOps(memory, first, 0, now)
+			applyOps(disk, first, 0, now)
+			if disk.Compact() != nil {
+				return false
+			}
+			applyOps(memory, second, 1, now)
+			applyOps(disk, second, 1, now)
+			if !reflect.DeepEqual(disk.Snapshot(), memory.Snapshot()) || disk.Close() != nil {
+				return false
+			}
+
+			reopened := openDisk(t, dir)
+			defer reopened.Close()
+			if !reflect.DeepEqual(reopened.Snapshot(), memory.Snapshot()) || reopened.Len() != len(memory.Snapshot()) || reopened.Compact() != nil {
+				return false
+			}
+			for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+				want, wantExists := memory.Get(key)
+				got, exists := reopened.Get(key)
+				if got != want || exists != wantExists || reopened.Exists(key) != wantExists {
+					return false
+				}
+				wantExpiry, _ := memory.ExpireAt(key)
+				if expiry, exists := reopened.ExpireAt(key); expiry != wantExpiry || exists != wantExists {
+					return false
+				}
+			}
+			reopened.Close()
+			return reflect.DeepEqual(openDisk(t, dir).Snapshot(), memory.Snapshot())
+		},
+		gen.SliceOf(genOp),
+		gen.SliceOf(genOp),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
+
+func TestDiskStoreViewSurvivesCompaction(t *testing.T) {
+	disk := openDisk(t, t.TempDir())
+	defer disk.Close()
+	for i := 0; i < 50; i++ {
+		disk.Set(fmt.Sprintf("key%d", i%10), fmt.Sprintf("value%d", i))
+	}
+
+	view := disk.View()
+	disk.Set("key0", "changed")
+	disk.Delete("key1")
+	if err := disk.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	contents := viewContents(view)
+	if view.Err() != nil || len(contents) != 10 || contents["key0"] != "value40" || contents["key1"] != "value41" {
+		t.Errorf("Unexpected view contents %v, %v", contents, view.Err())
+	}
+	view.Release()
+
+	if value, _ := disk.Get("key0"); value != "changed" || disk.Exists("key1") {
+		t.Errorf("Unexpected store contents after compaction: key0=%q", value)
+	}
+	segments, _ := filepath.Glob(filepath.Join(disk.dir, "*"+segmentSuffix))
+	var total int64
+	for _, path := range segments {
+		info, _ := os.Stat(path)
+		total += info.Size()
+	}
+	if total > 2*disk.segmentSize {
+		t.Errorf("Expected compaction to reclaim space, %d bytes left in %d segments", total, len(segments))
+	}
+}
+
+func TestDiskStoreFindsExpiredKeysAfterReopening(t *testing.T) {
+	dir := t.TempDir()
+	opened, err := NewDiskStore(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened.SetWithExpiry("expired", "value", time.Now().UnixMilli()-1)
+	opened.Set("key", "value")
+	opened.Close()
+
+	reopened, err := NewDiskStore(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if expired := reopened.ExpiredKeys(10); len(expired) != 1 || expired[0] != "expired" {
+		t.Errorf("ExpiredKeys after reopening = %v, want [expired]", expired)
+	}
+}
+
+func TestDiskStoreTornTail(t *testing.T) {
+	dir := t.TempDir()
+	disk := openDisk(t, dir)
+	disk.Set("kept", "value")
+	active := disk.active.path
+	disk.Close()
+
+	// A record cut short by a crash is dropped
+	file, _ := os.OpenFile(active, os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write(encodeRecord(99, "torn", "value", 0, false)[:20])
+	file.Close()
+	disk = openDisk(t, dir)
+	if value, exists := disk.Get("kept"); !exists || value != "value" || disk.Exists("torn") {
+		t.Errorf("Unexpected contents after a torn write: kept=%q", value)
+	}
+	disk.Close()
+
+	// A damaged record followed by more data is corruption
+	data, _ := os.ReadFile(active)
+	data[recordHeaderSize] ^= 0xff
+	os.WriteFile(active, append(data, encodeRecord(100, "later", "value", 0, false)...), 0644)
+	if _, err := NewDiskStore(Options{Dir: dir}); !errors.Is(err, ErrCorruptSegment) {
+		t.Errorf("Expected ErrCorruptSegment, got %v", err)
+	}
+}
+
+func TestDiskStoreInterruptedCompaction(t *testing.T) {
+	dir := t.TempDir()
+	disk := openDisk(t, dir)
+	disk.Set("key", "old")
+	disk.Delete("key")
+	disk.Set("other", "value")
+	disk.Close()
+	before, _ := listSegments(dir)
+
+	// Without a marker, leftover outputs are discarded
+	os.WriteFile(filepath.Join(dir, segmentName(1000)+tempSuffix), []byte("partial"), 0644)
+	disk = openDisk(t, dir)
+	if _, err := os.Stat(filepath.Join(dir, segmentName(1000)+tempSuffix)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the temporary output to be removed, got %v", err)
+	}
+	disk.Close()
+
+	// With a marker, the inputs are deleted and the outputs kept
+	output := filepath.Join(dir, segmentName(2000))
+	os.WriteFile(output+tempSuffix, encodeRecord(50, "other", "value", 0, false), 0644)
+	marker := fmt.Sprintf("output %d\n", 2000)
+	for _, id := range before {
+		marker += fmt.Sprintf("input %d\n", id)
+	}
+	os.WriteFile(filepath.Join(dir, compactionMarker), []byte(marker), 0644)
+	disk = openDisk(t, dir)
+	defer disk.Close()
+	if value, _ := disk.Get("other"); value != "value" || disk.Exists("key") {
+		t.Errorf("Unexpected contents after finishing a compaction: other=%q", value)
+	}
+	for _, id := range before {
+		if _, err := os.Stat(filepath.Join(dir, segmentName(id))); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Expected input segment %d to be deleted", id)
+		}
+	}
+}
+
+func TestOpenEngine(t *testing.T) {
+	for _, name := range []string{"", EngineMemory, "MEMORY", EngineDisk, EngineTiered} {
+		opened, err := Open(name, Options{Dir: t.TempDir()})
+		if err != nil {
+			t.Fatalf("Open(%q) failed: %v", name, err)
+		}
+		if !opened.Set("key", "value") {
+			t.Errorf("Open(%q): SET of a new key did not report creating it", name)
+		}
+		if value, _ := opened.Get("key"); value != "value" {
+			t.Errorf("Open(%q) returned a store that lost a write", name)
+		}
+		if opened.Set("key", "other") {
+			t.Errorf("Open(%q): SET of an existing key reported creating it", name)
+		}
+		opened.SetWithExpiry("expired", "value", time.Now().UnixMilli()-1)
+		opened.SetWithExpiry("later", "value", time.Now().UnixMilli()+60000)
+		if !opened.Expired("expired") || opened.Expired("later") || opened.Expired("key") {
+			t.Errorf("Open(%q): Expired does not tell the key past its expiry", name)
+		}
+		if expired := opened.ExpiredKeys(10); len(expired) != 1 || expired[0] != "expired" {
+			t.Errorf("Open(%q): ExpiredKeys = %v, want [expired]", name, expired)
+		}
+		if !opened.Set("expired", "value") {
+			t.Errorf("Open(%q): SET of an expired key did not report creating it", name)
+		}
+		if opened.Expired("expired") || len(opened.ExpiredKeys(10)) != 0 {
+			t.Errorf("Open(%q): a key rewritten without an expiry is still expired", name)
+		}
+		opened.Close()
+	}
+	if _, err := Open("tape", Options{}); err == nil {
+		t.Error("Expected an unknown engine to be rejected")
+	}
+	RegisterEngine("custom", func(Options) (KeyValueStore, error) { return NewInMemoryStore(), nil })
+	if _, err := Open("custom", Options{}); err != nil {
+		t.Errorf("Expected a registered engine to open, got %v", err)
+	}
+}
+
+// openTiered opens a tiered store holding at most limit bytes of values in
+// memory
+func openTiered(t *testing.T, limit int64, policy string) *TieredStore {
+	opened, err := NewTieredStore(Options{Dir: t.TempDir(), SegmentSize: 256, MemoryLimit: limit, TieringPolicy: policy})
+	if err != nil {
+		t.Fatalf("NewTieredStore failed: %v", err)
+	}
+	return opened.(*TieredStore)
+}
+
+func TestTieredStoreMatchesMemory(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	genOp := gen.Struct(reflect.TypeOf(diskOp{}), map[string]gopter.Gen{
+		"Key":    gen.OneConstOf("a", "b", "c", "d", "e", "f", "g", "h"),
+		"Delete": gen.Weighted([]gen.WeightedGen{{Weight: 1, Gen: gen.Const(true)}, {Weight: 3, Gen: gen.Const(false)}}),
+		"Expire": gen.Weighted([]gen.WeightedGen{{Weight: 1, Gen: gen.Const(true)}, {Weight: 5, Gen: gen.Const(false)}}),
+	})
+
+	// For any writes and reads, the tiered engine holds what the in-memory
+	// engine holds while keeping its hot values within the memory limit
+	properties.Property("tiered engine matches the in-memory engine", prop.ForAll(
+		func(first, second []diskOp, policy string) bool {
+			memory := NewInMemoryStore()
+			tiered := openTiered(t, 16, policy)
+			defer tiered.Close()
+			now := time.Now().UnixMilli()
+
+			applyOps(memory, first, 0, now)
+			applyOps(tiered, first, 0, now)
+			for _, op := range second {
+				want, wantExists := memory.Get(op.Key)
+				if got, exists := tiered.Get(op.Key); got != want || exists != wantExists {
+					return false
+				}
+				wantExpiry, _ := memory.ExpireAt(op.Key)
+				if expiry, exists := tiered.ExpireAt(op.Key); expiry != wantExpiry || exists != wantExists {
+					return false
+				}
+			}
+			view := tiered.View()
+			defer view.Release()
+			applyOps(memory, second, 1, now)
+			applyOps(tiered, second, 1, now)
+			return tiered.hotBytes <= tiered.limit &&
+				reflect.DeepEqual(tiered.Snapshot(), memory.Snapshot())
+		},
+		gen.SliceOf(genOp),
+		gen.SliceOf(genOp),
+		gen.OneConstOf(PolicyLRU, PolicyLFU),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
+
+func TestTieredStoreSpillsAndFaults(t *testing.T) {
+	tiered := openTiered(t, 100, PolicyLFU)
+	for i := 0; i < 20; i++ {
+		tiered.Set(fmt.Sprintf("key%d", i), fmt.Sprintf("value%05d", i))
+	}
+	if tiered.hotBytes > 100 || tiered.coldKeys == 0 || tiered.Len() != 20 {
+		t.Fatalf("Expected values to spill, %d hot bytes and %d cold keys", tiered.hotBytes, tiered.coldKeys)
+	}
+
+	for i := 0; i < 20; i++ {
+		if value, _ := tiered.Get(fmt.Sprintf("key%d", i)); value != fmt.Sprintf("value%05d", i) {
+			t.Errorf("Expected key%d to read back, got %q", i, value)
+		}
+	}
+	if tiered.diskHits.Load() == 0 || tiered.faults == 0 || tiered.hotBytes > 100 {
+		t.Errorf("Expected spilled values to fault back, %d disk hits and %d faults", tiered.diskHits.Load(), tiered.faults)
+	}
+	tiered.Get("missing")
+	if tiered.misses.Load() != 1 {
+		t.Errorf("Expected one miss, got %d", tiered.misses.Load())
+	}
+
+	tiered.Close()
+	if _, err := os.Stat(tiered.dir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the spill directory to be removed on close, got %v", err)
+	}
+}
+
+func TestTieredStoreViewIsolation(t *testing.T) {
+	tiered := openTiered(t, 40, PolicyLRU)
+	defer tiered.Close()
+	for i := 0; i < 10; i++ {
+		tiered.Set(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+
+	// Spilling, faulting and overwriting after the view was taken leave it
+	// unchanged
+	view := tiered.View()
+	for i := 0; i < 10; i++ {
+		tiered.Get(fmt.Sprintf("key%d", i))
+	}
+	tiered.Set("key0", "changed")
+	tiered.Delete("key1")
+	tiered.Set("new", "value")
+	contents := viewContents(view)
+	view.Release()
+	if view.Err() != nil || len(contents) != 10 || contents["key0"] != "value0" || contents["key1"] != "value1" {
+		t.Errorf("Unexpected view contents %v, %v", contents, view.Err())
+	}
+	if value, _ := tiered.Get("key0"); value != "changed" || tiered.Exists("key1") || tiered.Len() != 10 {
+		t.Errorf("Unexpected store contents: key0=%q", value)
+	}
+}
+
+func TestTieredStoreLRUKeepsRecentValues(t *testing.T) {
+	tiered := openTiered(t, 30, PolicyLRU)
+	defer tiered.Close()
+	tiered.Set("recent", "0123456789")
+	for i := 0; i < 50; i++ {
+		time.Sleep(time.Millisecond)
+		tiered.Get("recent")
+		tiered.Set(fmt.Sprintf("key%d", i), "0123456789")
+	}
+	if entry, _ := tiered.data.get("recent"); entry.cold {
+		t.Error("Expected the recently read value to stay in memory")
+	}
+}
+
+func TestDiskStoreWriteErrors(t *testing.T) {
+	disk := openDisk(t, t.TempDir())
+	defer disk.Close()
+	disk.Set("kept", "value")
+
+	// A write that fails is not stored and is reported until the store
+	// recovers
+	disk.mutex.Lock()
+	file := disk.active.file
+	file.Close()
+	disk.mutex.Unlock()
+	disk.Set("lost", "value")
+	if disk.Exists("lost") || disk.LastError() == nil {
+		t.Fatalf("Expected a failed write to be reported, got exists=%v error=%v", disk.Exists("lost"), disk.LastError())
+	}
+	if disk.Delete("kept") || !disk.Exists("kept") {
+		t.Error("Expected a failed delete to keep the key")
+	}
+
+	disk.mutex.Lock()
+	disk.active.file, _ = os.OpenFile(disk.active.path, os.O_RDWR, 0644)
+	disk.recover()
+	disk.mutex.Unlock()
+	if err := disk.LastError(); err != nil {
+		t.Fatalf("Expected the store to recover, got %v", err)
+	}
+	disk.Set("stored", "value")
+	if value, _ := disk.Get("stored"); value != "value" || disk.LastError() != nil {
+		t.Errorf("Expected writes to be stored again, got %q, %v", value, disk.LastError())
+	}
+}
@@ -0,0 +1,502 @@
+package store
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMemoryLimit is how many bytes of values the tiered engine keeps in
+// memory unless configured otherwise
+const DefaultMemoryLimit = 64 << 20
+
+// Tiering policies
+const (
+	PolicyLRU = "lru"
+	PolicyLFU = "lfu"
+)
+
+const (
+	// spillDirName is the directory, inside the storage directory, holding
+	// spilled values; it is scratch space emptied on open and close
+	spillDirName = "spill"
+	// spillSamples is how many hot values are compared to pick the one to
+	// spill, as Redis samples keys for eviction
+	spillSamples = 5
+
+	// The access frequency is a logarithmic counter as in Redis' LFU: new
+	// keys start at lfuInitial, each access increments the counter with a
+	// probability falling as it grows, and it decays by one for every
+	// lfuDecayPeriod without access
+	lfuInitial     = 5
+	lfuLogFactor   = 10
+	lfuDecayPeriod = time.Minute
+)
+
+// accessStats tracks how a key is used, to tell cold values from hot ones.
+// It is updated under the read lock, so its fields are atomic; concurrent
+// updates may lose an increment, which only makes the statistics
+// approximate.
+type accessStats struct {
+	lastAccess atomic.Int64
+	counter    atomic.Uint32
+}
+
+// newAccessStats starts the statistics of a key written at now
+func newAccessStats(now int64) *accessStats {
+	stats := &accessStats{}
+	stats.lastAccess.Store(now)
+	stats.counter.Store(lfuInitial)
+	return stats
+}
+
+// frequency returns the access counter decayed to now
+func (a *accessStats) frequency(now int64) uint32 {
+	counter := a.counter.Load()
+	periods := uint32((now - a.lastAccess.Load()) / lfuDecayPeriod.Milliseconds())
+	if periods >= counter {
+		return 0
+	}
+	return counter - periods
+}
+
+// touch records an access at now
+func (a *accessStats) touch(now int64) {
+	counter := a.frequency(now)
+	if counter < 255 {
+		base := float64(max(int(counter)-lfuInitial, 0))
+		if rand.Float64() < 1/(base*lfuLogFactor+1) {
+			counter++
+		}
+	}
+	a.counter.Store(counter)
+	a.lastAccess.Store(now)
+}
+
+// tieredEntry is a key's metadata along with its value while hot
+type tieredEntry struct {
+	value    string
+	cold     bool
+	size     int64
+	expireAt int64
+	access   *accessStats
+}
+
+// expired reports whether the entry expired by now
+func (e tieredEntry) expired(now int64) bool {
+	return e.expireAt != 0 && e.expireAt <= now
+}
+
+// TieredStore is an implementation of KeyValueStore that keeps every key
+// and its metadata in memory but only the hot values: once the values held
+// in memory exceed the memory limit, the coldest ones are spilled to a disk
+// engine and faulted back into memory when read.
+//
+// Spilling samples a few hot values and moves the least recently or least
+// frequently used, like Redis picks keys to evict. The dataset itself is
+// not persistent: the spilled values are scratch space, and persistence
+// comes from snapshots and the append-only file as with InMemoryStore.
+// Keys are held in a layered map, so views freeze them in constant time
+// together with a view of the spilled values.
+type TieredStore struct {
+	mutex sync.RWMutex
+	data  *layered[tieredEntry]
+	// hot lists the keys whose value is in memory, to sample from
+	hot     map[string]struct{}
+	expires expiring
+	cold    *DiskStore
+	dir     string
+	limit   int64
+	policy  string
+
+	hotKeys   int64
+	hotBytes  int64
+	coldKeys  int64
+	coldBytes int64
+	spills    int64
+	faults    int64
+
+	memoryHits atomic.Int64
+	diskHits   atomic.Int64
+	misses     atomic.Int64
+}
+
+// NewTieredStore opens the tiered engine, spilling values to a scratch
+// directory inside options.Dir
+func NewTieredStore(options Options) (KeyValueStore, error) {
+	if options.Dir == "" {
+		return nil, fmt.Errorf("the tiered storage engine needs a directory")
+	}
+	if options.MemoryLimit <= 0 {
+		options.MemoryLimit = DefaultMemoryLimit
+	}
+	switch options.TieringPolicy = strings.ToLower(options.TieringPolicy); options.TieringPolicy {
+	case "":
+		options.TieringPolicy = PolicyLFU
+	case PolicyLRU, PolicyLFU:
+	default:
+		return nil, fmt.Errorf("unknown tiering policy '%s', expected lru or lfu", options.TieringPolicy)
+	}
+
+	dir := filepath.Join(options.Dir, spillDirName)
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("failed to clear the spill directory: %w", err)
+	}
+	cold, err := NewDiskStore(Options{Dir: dir, SegmentSize: options.SegmentSize})
+	if err != nil {
+		return nil, err
+	}
+	return &TieredStore{
+		data:    newLayered[tieredEntry](),
+		hot:     make(map[string]struct{}),
+		expires: make(expiring),
+		cold:    cold.(*DiskStore),
+		dir:     dir,
+		limit:   options.MemoryLimit,
+		policy:  options.TieringPolicy,
+	}, nil
+}
+
+// account adds or removes a key's entry from its tier; the caller must
+// hold the write lock
+func (s *TieredStore) account(key string, entry tieredEntry, sign int64) {
+	if entry.cold {
+		s.coldKeys += sign
+		s.coldBytes += sign * entry.size
+		return
+	}
+	s.hotKeys += sign
+	s.hotBytes += sign * entry.size
+	if sign > 0 {
+		s.hot[key] = struct{}{}
+	} else {
+		delete(s.hot, key)
+	}
+}
+
+// set writes a hot value, dropping any spilled copy; the caller must hold
+// the write lock
+func (s *TieredStore) set(key, value string, expireAt int64) {
+	now := time.Now().UnixMilli()
+	s.removeLocked(key)
+	entry := tieredEntry{value: value, size: int64(len(value)), expireAt: expireAt, access: newAccessStats(now)}
+	s.data.put(key, entry)
+	s.expires.track(key, expireAt)
+	s.account(key, entry, 1)
+	s.spill(key, now)
+}
+
+// removeLocked removes a key, reporting its entry; the caller must hold the
+// write lock
+func (s *TieredStore) removeLocked(key string) (tieredEntry, bool) {
+	old, exists := s.data.get(key)
+	if !exists {
+		return tieredEntry{}, false
+	}
+	if old.cold {
+		s.cold.Delete(key)
+	}
+	s.expires.track(key, 0)
+	s.data.remove(key)
+	s.account(key, old, -1)
+	return old, true
+}
+
+// spill moves the coldest hot values to disk until the hot values fit the
+// memory limit, never picking keep; the caller must hold the write lock
+func (s *TieredStore) spill(keep string, now int64) {
+	for s.hotBytes > s.limit {
+		key, entry, found := s.coldestHot(keep, now)
+		if !found {
+			return
+		}
+		if entry.expired(now) {
+			s.removeLocked(key)
+			continue
+		}
+		if err := s.cold.store(key, entry.value, entry.expireAt); err != nil {
+			// The value stays in memory; the disk engine reported the error
+			return
+		}
+		s.account(key, entry, -1)
+		entry.value, entry.cold = "", true
+		s.data.put(key, entry)
+		s.account(key, entry, 1)
+		s.spills++
+	}
+}
+
+// coldestHot samples hot values and returns the coldest by the tiering
+// policy; expired entries are returned first so they get dropped. The
+// caller must hold the write lock.
+func (s *TieredStore) coldestHot(keep string, now int64) (string, tieredEntry, bool) {
+	var coldestKey string
+	var coldest tieredEntry
+	found, sampled := false, 0
+	// Map iteration starts at a random position, which makes this a sample
+	for key := range s.hot {
+		if key == keep {
+			continue
+		}
+		entry, _ := s.data.get(key)
+		if entry.expired(now) {
+			return key, entry, true
+		}
+		if !found || s.colder(entry, coldest, now) {
+			coldestKey, coldest, found = key, entry, true
+		}
+		if sampled++; sampled == spillSamples {
+			break
+		}
+	}
+	return coldestKey, coldest, found
+}
+
+// colder reports whether a is colder than b under the tiering policy
+func (s *TieredStore) colder(a, b tieredEntry, now int64) bool {
+	if s.policy == PolicyLFU {
+		if fa, fb := a.access.frequency(now), b.access.frequency(now); fa != fb {
+			return fa < fb
+		}
+	}
+	return a.access.lastAccess.Load() < b.access.lastAccess.Load()
+}
+
+// Set stores a key-value pair in memory, clearing any expiry, and reports
+// whether it created the key
+func (s *TieredStore) Set(key, value string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	old, exists := s.data.get(key)
+	s.set(key, value, 0)
+	return !exists || old.expired(time.Now().UnixMilli())
+}
+
+// SetWithExpiry stores a key-value pair in memory that expires at
+// expireAt, in Unix milliseconds; an expireAt of 0 means no expiry
+func (s *TieredStore) SetWithExpiry(key, value string, expireAt int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.set(key, value, expireAt)
+}
+
+// Get retrieves a value by key, faulting a spilled value back into memory
+func (s *TieredStore) Get(key string) (string, bool) {
+	now := time.Now().UnixMilli()
+	s.mutex.RLock()
+	entry, exists := s.data.get(key)
+	if !exists || entry.expired(now) {
+		s.mutex.RUnlock()
+		s.misses.Add(1)
+		return "", false
+	}
+	entry.access.touch(now)
+	if !entry.cold {
+		s.mutex.RUnlock()
+		s.memoryHits.Add(1)
+		return entry.value, true
+	}
+	value, exists, err := s.cold.read(key)
+	s.mutex.RUnlock()
+	if err != nil || !exists {
+		if err != nil {
+			fmt.Printf("Tiered store read of %q failed: %v\n", key, err)
+		}
+		s.misses.Add(1)
+		return "", false
+	}
+	s.diskHits.Add(1)
+	s.fault(key, entry, value)
+	return value, true
+}
+
+// fault moves a value read from disk back into memory, unless the key
+// changed meanwhile
+func (s *TieredStore) fault(key string, entry tieredEntry, value string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, exists := s.data.get(key)
+	if !exists || !current.cold || current.access != entry.access {
+		return
+	}
+	s.cold.Delete(key)
+	s.account(key, current, -1)
+	current.value, current.cold = value, false
+	s.data.put(key, current)
+	s.account(key, current, 1)
+	s.faults++
+	s.spill(key, time.Now().UnixMilli())
+}
+
+// Exists checks if a key exists, without reading its value
+func (s *TieredStore) Exists(key string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	entry, exists := s.data.get(key)
+	return exists && !entry.expired(time.Now().UnixMilli())
+}
+
+// ExpireAt returns the expiry of a key, without reading its value
+func (s *TieredStore) ExpireAt(key string) (int64, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	entry, exists := s.data.get(key)
+	if !exists || entry.expired(time.Now().UnixMilli()) {
+		return 0, false
+	}
+	return entry.expireAt, true
+}
+
+// Expired reports whether a key is held past its expiry
+func (s *TieredStore) Expired(key string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	entry, exists := s.data.get(key)
+	return exists && entry.expired(time.Now().UnixMilli())
+}
+
+// ExpiredKeys samples the keys with an expiry for those past it
+func (s *TieredStore) ExpiredKeys(sample int) []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.expires.sample(sample, time.Now().UnixMilli())
+}
+
+// Delete removes a key
+func (s *TieredStore) Delete(key string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	old, exists := s.removeLocked(key)
+	return exists && !old.expired(time.Now().UnixMilli())
+}
+
+// DeleteMultiple removes multiple keys and returns count of deleted keys
+func (s *TieredStore) DeleteMultiple(keys []string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now().UnixMilli()
+	deletedCount := 0
+	for _, key := range keys {
+		if old, exists := s.removeLocked(key); exists && !old.expired(now) {
+			deletedCount++
+		}
+	}
+	return deletedCount
+}
+
+// Snapshot returns a point-in-time copy of all live keys with their expiries
+func (s *TieredStore) Snapshot() map[string]Item {
+	return snapshotOf(s.View())
+}
+
+// View freezes the keys in constant time along with the spilled values
+func (s *TieredStore) View() View {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return &tieredView{
+		store:  s,
+		layers: s.data.freeze(),
+		cold:   s.cold.View().(*diskView),
+		now:    time.Now().UnixMilli(),
+	}
+}
+
+// Info reports how many keys and bytes each tier holds and how reads were
+// served
+func (s *TieredStore) Info() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	memoryHits, diskHits := s.memoryHits.Load(), s.diskHits.Load()
+	rate := func(hits int64) float64 {
+		if memoryHits+diskHits == 0 {
+			return 0
+		}
+		return float64(hits) / float64(memoryHits+diskHits)
+	}
+	return []string{
+		fmt.Sprintf("tiered_memory_limit:%d", s.limit),
+		fmt.Sprintf("tiered_policy:%s", s.policy),
+		fmt.Sprintf("tiered_hot_keys:%d", s.hotKeys),
+		fmt.Sprintf("tiered_hot_bytes:%d", s.hotBytes),
+		fmt.Sprintf("tiered_cold_keys:%d", s.coldKeys),
+		fmt.Sprintf("tiered_cold_bytes:%d", s.coldBytes),
+		fmt.Sprintf("tiered_memory_hits:%d", memoryHits),
+		fmt.Sprintf("tiered_disk_hits:%d", diskHits),
+		fmt.Sprintf("tiered_misses:%d", s.misses.Load()),
+		fmt.Sprintf("tiered_memory_hit_rate:%.4f", rate(memoryHits)),
+		fmt.Sprintf("tiered_disk_hit_rate:%.4f", rate(diskHits)),
+		fmt.Sprintf("tiered_spills:%d", s.spills),
+		fmt.Sprintf("tiered_faults:%d", s.faults),
+	}
+}
+
+// Len returns how many keys the store holds, counting expired keys not yet
+// removed
+func (s *TieredStore) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return int(s.hotKeys + s.coldKeys)
+}
+
+// Close closes the disk engine holding spilled values and deletes its files
+func (s *TieredStore) Close() error {
+	if err := s.cold.Close(); err != nil {
+		return err
+	}
+	return os.RemoveAll(s.dir)
+}
+
+// tieredView is a View over frozen keys and the spilled values they refer to
+type tieredView struct {
+	store   *TieredStore
+	layers  []layer[tieredEntry]
+	cold    *diskView
+	now     int64
+	err     error
+	release sync.Once
+}
+
+// Range calls fn for every key live when the view was taken, reading
+// spilled values from disk; it stops at the first read error, which Err
+// returns
+func (v *tieredView) Range(fn func(key string, item Item) bool) {
+	rangeLayers(v.layers, func(key string, entry tieredEntry) bool {
+		if entry.expired(v.now) {
+			return true
+		}
+		value := entry.value
+		if entry.cold {
+			var exists bool
+			var err error
+			if value, exists, err = v.cold.get(key); err != nil || !exists {
+				if err == nil {
+					err = fmt.Errorf("spilled value is missing")
+				}
+				v.err = fmt.Errorf("failed to read %q: %w", key, err)
+				return false
+			}
+		}
+		return fn(key, Item{Value: value, ExpireAt: entry.expireAt})
+	})
+}
+
+// Err returns the read error that stopped Range, if any
+func (v *tieredView) Err() error {
+	return v.err
+}
+
+// Release releases the view; calling it more than once has no effect
+func (v *tieredView) Release() {
+	v.release.Do(func() {
+		v.store.mutex.Lock()
+		v.store.data.thaw()
+		v.store.mutex.Unlock()
+		v.cold.Release()
+	})
+}
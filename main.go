@@ -1,12 +1,19 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
+	"redis-like-server/internal/aof"
+	"redis-like-server/internal/crypt"
+	"redis-like-server/internal/jsonl"
+	"redis-like-server/internal/replication"
 	"redis-like-server/internal/server"
+	"redis-like-server/internal/store"
 )
 
 func main() {
@@ -15,14 +22,129 @@ func main() {
 	maxClients := flag.Int("max-clients", 1000, "Maximum number of concurrent clients")
 	readTimeout := flag.Duration("read-timeout", 30*time.Second, "Read timeout for client connections")
 	writeTimeout := flag.Duration("write-timeout", 30*time.Second, "Write timeout for client connections")
+	notifyKeyspaceEvents := flag.String("notify-keyspace-events", "", "Keyspace notification classes to publish (e.g. KEA)")
+	dir := flag.String("dir", ".", "Directory for persistence files")
+	dbFilename := flag.String("dbfilename", "dump.rdb", "Snapshot file name")
+	save := flag.String("save", "", "Automatic snapshot rules as <seconds> <changes> pairs, e.g. \"3600 1 300 100 60 10000\" (empty to disable)")
+	appendOnly := flag.Bool("appendonly", false, "Log every write command to the append-only file")
+	appendFilename := flag.String("appendfilename", "appendonly.aof", "Append-only file name")
+	appendDirname := flag.String("appenddirname", "appendonlydir", "Directory, inside -dir, holding the append-only file parts")
+	appendFsync := flag.String("appendfsync", "everysec", "Append-only file fsync policy: always, everysec or no")
+	aofLoadTruncated := flag.Bool("aof-load-truncated", true, "Load an append-only file whose last command is incomplete")
+	aofTimestampEnabled := flag.Bool("aof-timestamp-enabled", false, "Annotate the append-only file with timestamps for point-in-time recovery")
+	recoverToTime := flag.String("recover-to-time", "", "Rebuild the dataset from the append-only file up to this time (RFC 3339, \"YYYY-MM-DD HH:MM:SS\" or Unix seconds)")
+	recoverToOffset := flag.String("recover-to-offset", "", "Rebuild the dataset from the append-only file up to this byte offset of its command logs")
+	storageEngine := flag.String("storage-engine", store.EngineMemory, "Storage engine holding the dataset: "+strings.Join(store.Engines(), " or "))
+	storageDir := flag.String("storage-dir", "storage", "Directory, relative to -dir unless absolute, where a persistent storage engine keeps its files")
+	tieredMemoryLimit := flag.Int64("tiered-memory-limit", store.DefaultMemoryLimit, "Bytes of values the tiered storage engine keeps in memory before spilling cold ones to disk")
+	tieredPolicy := flag.String("tiered-policy", store.PolicyLFU, "Values the tiered storage engine spills first: lru (least recently used) or lfu (least frequently used)")
+	importJSONL := flag.String("import-jsonl", "", "JSON Lines file to import into the dataset at startup, as written by export-jsonl")
+	importConflict := flag.String("import-conflict", "fail", "What -import-jsonl does with keys that already exist: skip, replace or fail")
+	replicaOf := flag.String("replicaof", "", "Replicate the master at \"host port\"")
+	replBacklogSize := flag.Int("repl-backlog-size", replication.DefaultBacklogSize, "Bytes of the replication stream kept for replicas to resume from after a disconnect")
+	replicaReadOnly := flag.Bool("replica-read-only", true, "Refuse writes from clients while replicating a master")
+	minReplicasToWrite := flag.Int("min-replicas-to-write", 0, "Refuse writes unless this many replicas are connected and not lagging (0 disables)")
+	minReplicasMaxLag := flag.Int("min-replicas-max-lag", 10, "Seconds since its last acknowledgement after which a replica counts as lagging")
+	clusterEnabled := flag.Bool("cluster-enabled", false, "Run as a node of a cluster serving a share of the hash slots")
+	clusterConfigFile := flag.String("cluster-config-file", "nodes.conf", "File where a cluster node keeps its view of the cluster, relative to -dir")
+	clusterPort := flag.Int("cluster-port", 0, "Port of the cluster bus (default: the client port plus 10000)")
+	clusterNodeTimeout := flag.Int("cluster-node-timeout", int(server.DefaultClusterNodeTimeout.Milliseconds()), "Milliseconds a cluster node may stay unreachable before it is flagged as failing")
+	sentinelMode := flag.Bool("sentinel", false, "Run as a sentinel monitoring masters and failing them over, instead of serving a dataset")
+	sentinelMonitor := flag.String("sentinel-monitor", "", "Comma-separated masters for a sentinel to monitor, each as \"name host port quorum\"")
+	sentinelDownAfter := flag.Int("sentinel-down-after", int(server.DefaultSentinelDownAfter.Milliseconds()), "Milliseconds a monitored instance may stay unreachable before a sentinel sees it down")
+	sentinelFailoverTimeout := flag.Int("sentinel-failover-timeout", int(server.DefaultSentinelFailoverTimeout.Milliseconds()), "Milliseconds each step of a sentinel failover may take")
+	activeActive := flag.Bool("active-active", false, "Accept writes alongside peer instances, exchanging them and resolving conflicts so all converge")
+	activeActivePeers := flag.String("active-active-peers", "", "Comma-separated \"host:port\" addresses of the active-active peers")
+	activeActiveFile := flag.String("active-active-file", "crdt.conf", "File where an active-active instance keeps its replicated state, relative to -dir")
+	raftMode := flag.Bool("raft", false, "Replicate every command through a Raft log shared with a group of instances, acknowledging writes once a majority holds them")
+	raftJoin := flag.String("raft-join", "", "\"host:port\" of a member of the Raft group to join, instead of starting a new group")
+	raftAddr := flag.String("raft-addr", "", "\"host:port\" where the other Raft members and redirected clients reach this instance (default: 127.0.0.1 and -port)")
+	raftDir := flag.String("raft-dir", "raft", "Directory where a Raft member keeps its log and snapshot, relative to -dir")
+	encryptionKeyFile := flag.String("encryption-key-file", "", "File holding the key snapshots and append-only files are encrypted with (hex or base64; defaults to $"+crypt.EnvKey+")")
+	encryptionOldKeyFiles := flag.String("encryption-old-key-files", "", "Comma-separated key files of earlier keys, to read and re-encrypt files written with them")
+	autoAOFRewritePercentage := flag.Int("auto-aof-rewrite-percentage", 100, "Rewrite the append-only file once it grew by this percentage over its base (0 to disable)")
+	autoAOFRewriteMinSize := flag.Int64("auto-aof-rewrite-min-size", 64<<20, "Minimum append-only file size in bytes for an automatic rewrite")
 	flag.Parse()
 
+	saveRules, err := server.ParseSaveRules(*save)
+	if err != nil {
+		log.Fatalf("Invalid -save: %v", err)
+	}
+	fsyncPolicy, err := aof.ParseFsyncPolicy(*appendFsync)
+	if err != nil {
+		log.Fatalf("Invalid -appendfsync: %v", err)
+	}
+	recoveryTarget, err := aof.ParseTarget(*recoverToTime, *recoverToOffset)
+	if err != nil {
+		log.Fatalf("Invalid recovery target: %v", err)
+	}
+	conflictPolicy, err := jsonl.ParseConflictPolicy(*importConflict)
+	if err != nil {
+		log.Fatalf("Invalid -import-conflict: %v", err)
+	}
+	var sentinelMasters []string
+	if *sentinelMonitor != "" {
+		sentinelMasters = strings.Split(*sentinelMonitor, ",")
+	}
+	var peers []string
+	if *activeActivePeers != "" {
+		peers = strings.Split(*activeActivePeers, ",")
+	}
+	keyring, err := crypt.LoadKeyring(*encryptionKeyFile, *encryptionOldKeyFiles)
+	if err != nil {
+		log.Fatalf("Invalid encryption key: %v", err)
+	}
+
 	// Create server configuration
 	config := &server.ServerConfig{
-		Port:         *port,
-		MaxClients:   *maxClients,
-		ReadTimeout:  *readTimeout,
-		WriteTimeout: *writeTimeout,
+		Port:                 *port,
+		MaxClients:           *maxClients,
+		ReadTimeout:          *readTimeout,
+		WriteTimeout:         *writeTimeout,
+		NotifyKeyspaceEvents: *notifyKeyspaceEvents,
+		Dir:                  *dir,
+		DBFilename:           *dbFilename,
+		SaveRules:            saveRules,
+		AppendOnly:           *appendOnly,
+		AppendFilename:       *appendFilename,
+		AppendDirname:        *appendDirname,
+		AppendFsync:          fsyncPolicy,
+		AOFLoadTruncated:     *aofLoadTruncated,
+		AOFTimestampEnabled:  *aofTimestampEnabled,
+		RecoveryTarget:       recoveryTarget,
+		Encryption:           keyring,
+		StorageEngine:        *storageEngine,
+		StorageDir:           *storageDir,
+		TieredMemoryLimit:    *tieredMemoryLimit,
+		TieredPolicy:         *tieredPolicy,
+		ImportJSONL:          *importJSONL,
+		ImportConflict:       conflictPolicy,
+		ReplicaOf:            *replicaOf,
+		ReplBacklogSize:      *replBacklogSize,
+		ReplicaReadOnly:      *replicaReadOnly,
+		MinReplicasToWrite:   *minReplicasToWrite,
+		MinReplicasMaxLag:    *minReplicasMaxLag,
+		ClusterEnabled:       *clusterEnabled,
+		ClusterConfigFile:    *clusterConfigFile,
+		ClusterPort:          *clusterPort,
+		ClusterNodeTimeout:   time.Duration(*clusterNodeTimeout) * time.Millisecond,
+
+		Sentinel:                *sentinelMode,
+		SentinelMonitor:         sentinelMasters,
+		SentinelDownAfter:       time.Duration(*sentinelDownAfter) * time.Millisecond,
+		SentinelFailoverTimeout: time.Duration(*sentinelFailoverTimeout) * time.Millisecond,
+
+		ActiveActive:      *activeActive,
+		ActiveActivePeers: peers,
+		ActiveActiveFile:  *activeActiveFile,
+
+		Raft:     *raftMode,
+		RaftJoin: *raftJoin,
+		RaftAddr: *raftAddr,
+		RaftDir:  *raftDir,
+
+		AutoAOFRewritePercentage: *autoAOFRewritePercentage,
+		AutoAOFRewriteMinSize:    *autoAOFRewriteMinSize,
 	}
 
 	// Create and start server
@@ -30,6 +152,9 @@ func main() {
 	
 	fmt.Printf("Starting Redis-like server on port %d...\n", config.Port)
 	if err := srv.Start(); err != nil {
+		if errors.Is(err, crypt.ErrNoKey) || errors.Is(err, crypt.ErrUnknownKey) {
+			log.Fatalf("Failed to start server: %v (check -encryption-key-file and -encryption-old-key-files)", err)
+		}
 		log.Fatalf("Failed to start server: %v", err)
 	}
 	